@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/src/keyconnector"
+)
+
+func main() {
+	issuer := os.Getenv("KEY_CONNECTOR_ISSUER")
+	audience := os.Getenv("KEY_CONNECTOR_URL")
+	if issuer == "" || audience == "" {
+		log.Fatal("KEY_CONNECTOR_ISSUER and KEY_CONNECTOR_URL are required")
+	}
+
+	wrappingKey, err := base64.StdEncoding.DecodeString(os.Getenv("KEY_CONNECTOR_WRAPPING_KEY"))
+	if err != nil {
+		log.Fatalf("Invalid KEY_CONNECTOR_WRAPPING_KEY: %v", err)
+	}
+
+	store, err := keyconnector.NewFileStore(getEnv("KEY_CONNECTOR_DATA_DIR", "data/keyconnector"))
+	if err != nil {
+		log.Fatalf("Failed to open key store: %v", err)
+	}
+
+	server, err := keyconnector.NewServer(keyconnector.Config{
+		Issuer:      issuer,
+		Audience:    audience,
+		JWKSURL:     getEnv("KEY_CONNECTOR_JWKS_URL", strings.TrimSuffix(issuer, "/")+"/api/key-connector/jwks"),
+		WrappingKey: wrappingKey,
+		Store:       store,
+	})
+	if err != nil {
+		log.Fatalf("Failed to create key connector: %v", err)
+	}
+
+	addr := getEnv("KEY_CONNECTOR_ADDR", ":5000")
+	srv := &http.Server{
+		Addr:         addr,
+		Handler:      server.Handler(),
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+	}
+
+	certFile, keyFile := os.Getenv("KEY_CONNECTOR_TLS_CERT"), os.Getenv("KEY_CONNECTOR_TLS_KEY")
+	go func() {
+		log.Printf("Starting key connector on %s", addr)
+		var err error
+		if certFile != "" && keyFile != "" {
+			err = srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
+			log.Fatalf("Key connector failed: %v", err)
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Key connector forced to shutdown: %v", err)
+	}
+
+	log.Println("Key connector stopped gracefully")
+}
+
+func getEnv(key, fallback string) string {
+	if value, exists := os.LookupEnv(key); exists {
+		return value
+	}
+	return fallback
+}
@@ -0,0 +1,84 @@
+-- Versioned keys, resumable key rotation and the records they protect
+
+-- Key versions on users and vault items
+ALTER TABLE users ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE vault_items ADD COLUMN encrypted_key TEXT;
+ALTER TABLE vault_items ADD COLUMN key_version INTEGER NOT NULL DEFAULT 1;
+
+-- Folders table
+CREATE TABLE folders (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    encrypted_name TEXT NOT NULL,
+    key_version INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Sends table
+CREATE TABLE sends (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    encrypted_key TEXT NOT NULL,
+    encrypted_data TEXT NOT NULL,
+    key_version INTEGER NOT NULL DEFAULT 1,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    deletion_date TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Encryption keys table
+CREATE TABLE encryption_keys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner_type VARCHAR(50) NOT NULL,
+    owner_id UUID NOT NULL,
+    version INTEGER NOT NULL,
+    wrapped_key TEXT NOT NULL,
+    public_key TEXT,
+    wrapped_private_key TEXT,
+    metadata JSONB,
+    is_active BOOLEAN DEFAULT false,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (owner_type, owner_id, version)
+);
+
+-- Key rotation jobs table
+CREATE TABLE key_rotation_jobs (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    owner_type VARCHAR(50) NOT NULL,
+    owner_id UUID NOT NULL,
+    old_key_id UUID REFERENCES encryption_keys(id),
+    new_key_id UUID NOT NULL REFERENCES encryption_keys(id),
+    status VARCHAR(50) NOT NULL,
+    phase VARCHAR(50) NOT NULL,
+    processed INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Sessions table
+CREATE TABLE sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token VARCHAR(255) UNIQUE NOT NULL,
+    device_info TEXT,
+    key_version INTEGER NOT NULL DEFAULT 1,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    last_used TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX idx_folders_user_id ON folders(user_id);
+CREATE INDEX idx_sends_user_id ON sends(user_id);
+CREATE INDEX idx_vault_items_user_key_version ON vault_items(user_id, key_version);
+CREATE INDEX idx_encryption_keys_owner ON encryption_keys(owner_type, owner_id);
+CREATE INDEX idx_key_rotation_jobs_owner ON key_rotation_jobs(owner_type, owner_id);
+CREATE INDEX idx_sessions_user_id ON sessions(user_id);
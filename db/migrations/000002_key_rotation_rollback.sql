@@ -0,0 +1,21 @@
+-- Rollback key rotation migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_sessions_user_id;
+DROP INDEX IF EXISTS idx_key_rotation_jobs_owner;
+DROP INDEX IF EXISTS idx_encryption_keys_owner;
+DROP INDEX IF EXISTS idx_vault_items_user_key_version;
+DROP INDEX IF EXISTS idx_sends_user_id;
+DROP INDEX IF EXISTS idx_folders_user_id;
+
+-- Drop tables in reverse order of creation to handle dependencies
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS key_rotation_jobs;
+DROP TABLE IF EXISTS encryption_keys;
+DROP TABLE IF EXISTS sends;
+DROP TABLE IF EXISTS folders;
+
+-- Drop columns
+ALTER TABLE vault_items DROP COLUMN IF EXISTS key_version;
+ALTER TABLE vault_items DROP COLUMN IF EXISTS encrypted_key;
+ALTER TABLE users DROP COLUMN IF EXISTS key_version;
@@ -0,0 +1,21 @@
+-- Organization key distribution and collections
+
+-- Membership status and the organization key wrapped for each member
+ALTER TABLE user_organizations ADD COLUMN status VARCHAR(50) NOT NULL DEFAULT 'confirmed';
+ALTER TABLE user_organizations ADD COLUMN encrypted_key TEXT;
+ALTER TABLE user_organizations ADD COLUMN key_version INTEGER NOT NULL DEFAULT 0;
+
+-- Collections table
+CREATE TABLE collections (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    is_shared BOOLEAN DEFAULT false,
+    key_version INTEGER NOT NULL DEFAULT 1,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX idx_collections_organization_id ON collections(organization_id);
+CREATE INDEX idx_vault_items_org_key_version ON vault_items(organization_id, key_version);
@@ -0,0 +1,13 @@
+-- Rollback organization key migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_vault_items_org_key_version;
+DROP INDEX IF EXISTS idx_collections_organization_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS collections;
+
+-- Drop columns
+ALTER TABLE user_organizations DROP COLUMN IF EXISTS key_version;
+ALTER TABLE user_organizations DROP COLUMN IF EXISTS encrypted_key;
+ALTER TABLE user_organizations DROP COLUMN IF EXISTS status;
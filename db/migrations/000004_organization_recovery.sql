@@ -0,0 +1,63 @@
+-- Organization recovery keys
+
+-- Recovery keys table
+CREATE TABLE organization_recovery_keys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    public_key TEXT NOT NULL,
+    verification_hash VARCHAR(255) NOT NULL,
+    threshold INTEGER NOT NULL,
+    wrapped_org_key TEXT,
+    org_key_version INTEGER NOT NULL DEFAULT 0,
+    is_active BOOLEAN DEFAULT true,
+    created_by UUID REFERENCES users(id),
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Recovery custodians table. Custodians are members holding a share encrypted with
+-- their public key and a hash of the share.
+CREATE TABLE recovery_custodians (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_recovery_key_id UUID NOT NULL REFERENCES organization_recovery_keys(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    email VARCHAR(255),
+    share_index INTEGER NOT NULL,
+    encrypted_share TEXT NOT NULL,
+    share_commitment VARCHAR(64) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE(organization_recovery_key_id, share_index)
+);
+
+-- Recovery sessions table
+CREATE TABLE recovery_sessions (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    recovery_key_id UUID NOT NULL REFERENCES organization_recovery_keys(id) ON DELETE CASCADE,
+    initiated_by UUID NOT NULL REFERENCES users(id),
+    status VARCHAR(50) NOT NULL,
+    shares_received INTEGER NOT NULL DEFAULT 0,
+    shares_required INTEGER NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    unlocked_at TIMESTAMP WITH TIME ZONE,
+    closed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Shares submitted to a recovery session, one per custodian
+CREATE TABLE recovery_session_shares (
+    recovery_session_id UUID NOT NULL REFERENCES recovery_sessions(id) ON DELETE CASCADE,
+    custodian_id UUID NOT NULL REFERENCES recovery_custodians(id) ON DELETE CASCADE,
+    encrypted_share TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (recovery_session_id, custodian_id)
+);
+
+-- Indexes
+CREATE INDEX idx_organization_recovery_keys_organization_id ON organization_recovery_keys(organization_id);
+CREATE INDEX idx_recovery_custodians_recovery_key_id ON recovery_custodians(organization_recovery_key_id);
+CREATE UNIQUE INDEX idx_recovery_custodians_user_id ON recovery_custodians(organization_recovery_key_id, user_id);
+CREATE INDEX idx_recovery_sessions_organization_id ON recovery_sessions(organization_id);
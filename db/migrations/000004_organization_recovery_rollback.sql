@@ -0,0 +1,13 @@
+-- Rollback organization recovery migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_recovery_sessions_organization_id;
+DROP INDEX IF EXISTS idx_recovery_custodians_user_id;
+DROP INDEX IF EXISTS idx_recovery_custodians_recovery_key_id;
+DROP INDEX IF EXISTS idx_organization_recovery_keys_organization_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS recovery_session_shares;
+DROP TABLE IF EXISTS recovery_sessions;
+DROP TABLE IF EXISTS recovery_custodians;
+DROP TABLE IF EXISTS organization_recovery_keys;
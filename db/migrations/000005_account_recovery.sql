@@ -0,0 +1,22 @@
+-- Account recovery enrollment
+
+-- Member user keys wrapped with the organization public key
+ALTER TABLE user_organizations ADD COLUMN reset_password_key TEXT;
+ALTER TABLE user_organizations ADD COLUMN reset_password_enrolled_at TIMESTAMP WITH TIME ZONE;
+
+-- Account recovery requests table
+CREATE TABLE account_recovery_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    requested_by UUID NOT NULL REFERENCES users(id),
+    status VARCHAR(50) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX idx_account_recovery_requests_organization_id ON account_recovery_requests(organization_id);
+CREATE INDEX idx_account_recovery_requests_user_id ON account_recovery_requests(user_id);
@@ -0,0 +1,12 @@
+-- Rollback account recovery migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_account_recovery_requests_user_id;
+DROP INDEX IF EXISTS idx_account_recovery_requests_organization_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS account_recovery_requests;
+
+-- Drop columns
+ALTER TABLE user_organizations DROP COLUMN IF EXISTS reset_password_enrolled_at;
+ALTER TABLE user_organizations DROP COLUMN IF EXISTS reset_password_key;
@@ -0,0 +1,7 @@
+-- Rollback two-factor recovery codes migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_two_factor_recovery_codes_user_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS two_factor_recovery_codes;
@@ -0,0 +1,43 @@
+-- Multiple two-factor methods per user
+
+-- Two-factor methods table
+CREATE TABLE two_factor_methods (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(20) NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    secret VARCHAR(255),
+    credential_id VARCHAR(1024),
+    credential TEXT,
+    code_hash VARCHAR(255),
+    code_expires_at TIMESTAMP WITH TIME ZONE,
+    code_attempts INTEGER NOT NULL DEFAULT 0,
+    verified BOOLEAN DEFAULT false,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    last_totp_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- State between the two steps of two-factor login or security key registration
+CREATE TABLE two_factor_ceremonies (
+    key_hash VARCHAR(64) PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID,
+    web_authn_session TEXT,
+    phishing_resistant_only BOOLEAN NOT NULL DEFAULT false,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Indexes
+CREATE INDEX idx_two_factor_ceremonies_expires_at ON two_factor_ceremonies(expires_at);
+CREATE INDEX idx_two_factor_methods_user_id ON two_factor_methods(user_id);
+CREATE UNIQUE INDEX idx_two_factor_methods_credential_id ON two_factor_methods(credential_id) WHERE credential_id IS NOT NULL AND credential_id <> '';
+
+-- Move existing TOTP secrets into methods
+INSERT INTO two_factor_methods (user_id, type, name, secret, verified)
+SELECT id, 'totp', 'Authenticator app', two_factor_secret, two_factor_enabled
+FROM users
+WHERE two_factor_secret IS NOT NULL AND two_factor_secret <> '';
+
+ALTER TABLE users DROP COLUMN two_factor_secret;
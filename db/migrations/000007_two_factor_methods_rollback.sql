@@ -0,0 +1,22 @@
+-- Rollback multiple two-factor methods migration
+
+-- Restore the single TOTP secret column, keeping the most recently created TOTP method
+ALTER TABLE users ADD COLUMN two_factor_secret VARCHAR(255);
+
+UPDATE users SET two_factor_secret = (
+    SELECT secret FROM two_factor_methods
+    WHERE two_factor_methods.user_id = users.id AND type = 'totp' AND verified
+    ORDER BY created_at DESC
+    LIMIT 1
+);
+
+UPDATE users SET two_factor_enabled = false WHERE two_factor_secret IS NULL;
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_two_factor_ceremonies_expires_at;
+DROP INDEX IF EXISTS idx_two_factor_methods_credential_id;
+DROP INDEX IF EXISTS idx_two_factor_methods_user_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS two_factor_ceremonies;
+DROP TABLE IF EXISTS two_factor_methods;
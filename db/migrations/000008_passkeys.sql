@@ -0,0 +1,20 @@
+-- Passwordless login with passkeys
+
+-- Passkeys table
+CREATE TABLE passkeys (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    credential_id VARCHAR(1024) NOT NULL,
+    credential TEXT NOT NULL,
+    prf_enabled BOOLEAN DEFAULT false,
+    encrypted_user_key TEXT,
+    user_key_version INTEGER NOT NULL DEFAULT 0,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX idx_passkeys_user_id ON passkeys(user_id);
+CREATE UNIQUE INDEX idx_passkeys_credential_id ON passkeys(credential_id);
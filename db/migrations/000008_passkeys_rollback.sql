@@ -0,0 +1,8 @@
+-- Rollback passkeys migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_passkeys_credential_id;
+DROP INDEX IF EXISTS idx_passkeys_user_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS passkeys;
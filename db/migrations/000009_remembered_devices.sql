@@ -0,0 +1,35 @@
+-- Devices and two-factor remember tokens
+
+-- Devices table
+CREATE TABLE IF NOT EXISTS devices (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    type VARCHAR(20) NOT NULL,
+    identifier VARCHAR(255),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    last_ip VARCHAR(45),
+    last_seen_at TIMESTAMP WITH TIME ZONE,
+    authorized_at TIMESTAMP WITH TIME ZONE,
+    blocked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Remember tokens table
+CREATE TABLE two_factor_remember_tokens (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX IF NOT EXISTS idx_devices_user_id ON devices(user_id);
+CREATE INDEX IF NOT EXISTS idx_devices_identifier ON devices(identifier);
+CREATE UNIQUE INDEX idx_two_factor_remember_tokens_token_hash ON two_factor_remember_tokens(token_hash);
+CREATE INDEX idx_two_factor_remember_tokens_user_id ON two_factor_remember_tokens(user_id);
+CREATE INDEX idx_two_factor_remember_tokens_device_id ON two_factor_remember_tokens(device_id);
@@ -0,0 +1,12 @@
+-- Rollback devices and two-factor remember tokens migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_two_factor_remember_tokens_device_id;
+DROP INDEX IF EXISTS idx_two_factor_remember_tokens_user_id;
+DROP INDEX IF EXISTS idx_two_factor_remember_tokens_token_hash;
+DROP INDEX IF EXISTS idx_devices_identifier;
+DROP INDEX IF EXISTS idx_devices_user_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS two_factor_remember_tokens;
+DROP TABLE IF EXISTS devices;
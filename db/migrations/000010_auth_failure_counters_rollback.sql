@@ -0,0 +1,7 @@
+-- Rollback brute-force protection migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_auth_failure_counters_key;
+
+-- Drop tables
+DROP TABLE IF EXISTS auth_failure_counters;
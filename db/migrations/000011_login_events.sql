@@ -0,0 +1,22 @@
+-- Login history for suspicious login detection
+
+-- Login events table
+CREATE TABLE login_events (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    device_id UUID REFERENCES devices(id) ON DELETE SET NULL,
+    ip VARCHAR(45),
+    country VARCHAR(2),
+    city VARCHAR(255),
+    latitude DOUBLE PRECISION,
+    longitude DOUBLE PRECISION,
+    risk_score INTEGER NOT NULL DEFAULT 0,
+    flags VARCHAR(255),
+    action VARCHAR(20) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX idx_login_events_user_id_created_at ON login_events(user_id, created_at DESC);
+CREATE INDEX idx_login_events_user_id_country ON login_events(user_id, country);
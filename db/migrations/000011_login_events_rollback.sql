@@ -0,0 +1,8 @@
+-- Rollback login history migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_login_events_user_id_country;
+DROP INDEX IF EXISTS idx_login_events_user_id_created_at;
+
+-- Drop tables
+DROP TABLE IF EXISTS login_events;
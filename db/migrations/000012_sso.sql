@@ -0,0 +1,49 @@
+-- Single sign-on configuration and linked identities
+
+-- SSO configurations table
+CREATE TABLE sso_configurations (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    provider VARCHAR(20) NOT NULL,
+    encrypted_config TEXT NOT NULL,
+    enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- SSO identities table
+CREATE TABLE sso_identities (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    issuer VARCHAR(1024) NOT NULL,
+    subject VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Logins between the redirect to the identity provider and its callback, shared by
+-- all servers
+CREATE TABLE sso_logins (
+    state_hash VARCHAR(64) PRIMARY KEY,
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    provider VARCHAR(50) NOT NULL,
+    nonce VARCHAR(255),
+    code_verifier VARCHAR(255),
+    request_id VARCHAR(255),
+    device_id UUID,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Accepted SAML assertions, kept until they expire so they cannot be replayed
+CREATE TABLE used_saml_assertions (
+    assertion_hash VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Indexes
+CREATE UNIQUE INDEX idx_sso_configurations_organization_id ON sso_configurations(organization_id);
+CREATE UNIQUE INDEX idx_sso_identities_subject ON sso_identities(organization_id, issuer, subject);
+CREATE INDEX idx_sso_identities_user_id ON sso_identities(user_id);
+CREATE INDEX idx_sso_logins_expires_at ON sso_logins(expires_at);
+CREATE INDEX idx_used_saml_assertions_expires_at ON used_saml_assertions(expires_at);
@@ -0,0 +1,14 @@
+-- Rollback single sign-on migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_used_saml_assertions_expires_at;
+DROP INDEX IF EXISTS idx_sso_logins_expires_at;
+DROP INDEX IF EXISTS idx_sso_identities_user_id;
+DROP INDEX IF EXISTS idx_sso_identities_subject;
+DROP INDEX IF EXISTS idx_sso_configurations_organization_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS used_saml_assertions;
+DROP TABLE IF EXISTS sso_logins;
+DROP TABLE IF EXISTS sso_identities;
+DROP TABLE IF EXISTS sso_configurations;
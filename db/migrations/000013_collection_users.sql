@@ -0,0 +1,14 @@
+-- Collection access for organization members
+
+-- Collection users table
+CREATE TABLE collection_users (
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    read_only BOOLEAN NOT NULL DEFAULT FALSE,
+    managed_by_sso BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (collection_id, user_id)
+);
+
+-- Indexes
+CREATE INDEX idx_collection_users_user_id ON collection_users(user_id);
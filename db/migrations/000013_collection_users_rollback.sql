@@ -0,0 +1,7 @@
+-- Rollback collection users migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_collection_users_user_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS collection_users;
@@ -0,0 +1,6 @@
+-- Key connector unlock for SSO users
+
+-- Users who unlock with an organization's key connector instead of a master password
+ALTER TABLE users ADD COLUMN uses_key_connector BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN key_connector_organization_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
+ALTER TABLE users ADD COLUMN key_connector_url VARCHAR(1024);
@@ -0,0 +1,6 @@
+-- Rollback key connector migration
+
+-- Drop columns
+ALTER TABLE users DROP COLUMN IF EXISTS key_connector_url;
+ALTER TABLE users DROP COLUMN IF EXISTS key_connector_organization_id;
+ALTER TABLE users DROP COLUMN IF EXISTS uses_key_connector;
@@ -0,0 +1,25 @@
+-- Login approval requests from new devices
+
+-- Auth requests table
+CREATE TABLE auth_requests (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    public_key TEXT NOT NULL,
+    fingerprint VARCHAR(255) NOT NULL,
+    access_code_hash VARCHAR(64) NOT NULL,
+    device_name VARCHAR(255),
+    device_type VARCHAR(20),
+    request_ip VARCHAR(45),
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    response_device_id UUID REFERENCES devices(id) ON DELETE SET NULL,
+    encrypted_user_key TEXT,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    used_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Indexes
+CREATE INDEX idx_auth_requests_user_id ON auth_requests(user_id);
+CREATE INDEX idx_auth_requests_expires_at ON auth_requests(expires_at);
@@ -0,0 +1,8 @@
+-- Rollback login approval requests migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_auth_requests_expires_at;
+DROP INDEX IF EXISTS idx_auth_requests_user_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS auth_requests;
@@ -0,0 +1,25 @@
+-- Hashed session tokens with sliding and absolute expiry
+
+-- Sessions store a SHA-256 hash of the token instead of the token
+ALTER TABLE sessions ADD COLUMN token_hash VARCHAR(64);
+UPDATE sessions SET token_hash = encode(sha256(convert_to(token, 'UTF8')), 'hex');
+ALTER TABLE sessions ALTER COLUMN token_hash SET NOT NULL;
+ALTER TABLE sessions DROP COLUMN token;
+
+-- Expiry limits
+ALTER TABLE sessions ADD COLUMN idle_timeout_minutes INTEGER NOT NULL DEFAULT 1440;
+ALTER TABLE sessions ADD COLUMN absolute_expires_at TIMESTAMP WITH TIME ZONE;
+UPDATE sessions SET absolute_expires_at = expires_at;
+ALTER TABLE sessions ALTER COLUMN absolute_expires_at SET NOT NULL;
+
+-- Single-use tickets that open a notifications hub connection for a session
+CREATE TABLE session_tickets (
+    ticket_hash VARCHAR(64) PRIMARY KEY,
+    session_id UUID NOT NULL REFERENCES sessions(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Indexes
+CREATE UNIQUE INDEX idx_sessions_token_hash ON sessions(token_hash);
+CREATE INDEX idx_sessions_expires_at ON sessions(expires_at);
+CREATE INDEX idx_session_tickets_expires_at ON session_tickets(expires_at);
@@ -0,0 +1,21 @@
+-- Rollback hashed session tokens migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_session_tickets_expires_at;
+DROP INDEX IF EXISTS idx_sessions_expires_at;
+DROP INDEX IF EXISTS idx_sessions_token_hash;
+
+-- Drop tables
+DROP TABLE IF EXISTS session_tickets;
+
+-- Restore the token column; the original tokens cannot be recovered, so every session
+-- is revoked
+ALTER TABLE sessions ADD COLUMN token VARCHAR(255);
+UPDATE sessions SET token = token_hash, revoked_at = COALESCE(revoked_at, CURRENT_TIMESTAMP);
+ALTER TABLE sessions ALTER COLUMN token SET NOT NULL;
+ALTER TABLE sessions ADD CONSTRAINT sessions_token_key UNIQUE (token);
+
+-- Drop columns
+ALTER TABLE sessions DROP COLUMN IF EXISTS absolute_expires_at;
+ALTER TABLE sessions DROP COLUMN IF EXISTS idle_timeout_minutes;
+ALTER TABLE sessions DROP COLUMN IF EXISTS token_hash;
@@ -0,0 +1,9 @@
+-- Client details of sessions
+
+-- Client type parsed from the user agent and the IP address the session was last used from
+ALTER TABLE sessions ADD COLUMN client_type VARCHAR(20);
+ALTER TABLE sessions ADD COLUMN ip_address VARCHAR(45);
+
+-- Organization whose single sign-on signed the session in, whose admins may revoke it
+ALTER TABLE sessions ADD COLUMN organization_id UUID REFERENCES organizations(id) ON DELETE SET NULL;
+CREATE INDEX idx_sessions_organization_id ON sessions(organization_id);
@@ -0,0 +1,9 @@
+-- Rollback session details migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_sessions_organization_id;
+
+-- Drop columns
+ALTER TABLE sessions DROP COLUMN IF EXISTS organization_id;
+ALTER TABLE sessions DROP COLUMN IF EXISTS ip_address;
+ALTER TABLE sessions DROP COLUMN IF EXISTS client_type;
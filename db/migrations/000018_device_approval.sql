@@ -0,0 +1,13 @@
+-- Device approval
+
+-- Devices were registered as pending but never held, so the devices that exist are
+-- treated as approved
+UPDATE devices SET status = 'authorized', authorized_at = CURRENT_TIMESTAMP WHERE status = 'pending';
+
+-- Device a session or login request belongs to
+ALTER TABLE sessions ADD COLUMN device_id UUID REFERENCES devices(id) ON DELETE SET NULL;
+ALTER TABLE auth_requests ADD COLUMN device_id UUID REFERENCES devices(id) ON DELETE SET NULL;
+
+-- Indexes
+CREATE INDEX idx_sessions_device_id ON sessions(device_id);
+CREATE INDEX idx_devices_status ON devices(status);
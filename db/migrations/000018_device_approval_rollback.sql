@@ -0,0 +1,10 @@
+-- Rollback device approval migration
+-- Devices approved by the migration stay authorized
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_devices_status;
+DROP INDEX IF EXISTS idx_sessions_device_id;
+
+-- Drop columns
+ALTER TABLE auth_requests DROP COLUMN IF EXISTS device_id;
+ALTER TABLE sessions DROP COLUMN IF EXISTS device_id;
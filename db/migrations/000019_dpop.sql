@@ -0,0 +1,18 @@
+-- DPoP sender-constrained tokens
+
+-- Public key a device signs its DPoP proofs with
+ALTER TABLE devices ADD COLUMN public_key TEXT;
+ALTER TABLE devices ADD COLUMN key_thumbprint VARCHAR(255);
+
+-- Key the session token is bound to
+ALTER TABLE sessions ADD COLUMN key_thumbprint VARCHAR(255);
+
+-- Used proofs, kept until they expire so they cannot be replayed
+CREATE TABLE used_dpop_proofs (
+    proof_hash VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+-- Indexes
+CREATE INDEX idx_devices_key_thumbprint ON devices(key_thumbprint);
+CREATE INDEX idx_used_dpop_proofs_expires_at ON used_dpop_proofs(expires_at);
@@ -0,0 +1,13 @@
+-- Rollback DPoP migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_used_dpop_proofs_expires_at;
+DROP INDEX IF EXISTS idx_devices_key_thumbprint;
+
+-- Drop tables
+DROP TABLE IF EXISTS used_dpop_proofs;
+
+-- Drop columns
+ALTER TABLE sessions DROP COLUMN IF EXISTS key_thumbprint;
+ALTER TABLE devices DROP COLUMN IF EXISTS key_thumbprint;
+ALTER TABLE devices DROP COLUMN IF EXISTS public_key;
@@ -0,0 +1,8 @@
+-- Permission resolution
+
+-- Permissions are looked up by name
+CREATE UNIQUE INDEX idx_permissions_name ON permissions(name);
+
+-- Members are resolved through their role
+CREATE INDEX idx_user_organizations_role_id ON user_organizations(role_id);
+CREATE INDEX idx_role_permissions_permission_id ON role_permissions(permission_id);
@@ -0,0 +1,6 @@
+-- Rollback permission resolution migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_role_permissions_permission_id;
+DROP INDEX IF EXISTS idx_user_organizations_role_id;
+DROP INDEX IF EXISTS idx_permissions_name;
@@ -0,0 +1,75 @@
+-- Permission catalog
+-- Keep in step with PermissionCatalog in services/permissions.go
+
+INSERT INTO permissions (name, description) VALUES
+    ('create_vault_item', 'Add items to the organization vault'),
+    ('read_vault_items', 'Read items in the organization vault'),
+    ('manage_collections', 'Create, change and delete collections and grant access to them'),
+    ('manage_members', 'Invite and remove members and change their role'),
+    ('manage_roles', 'Create roles and choose their permissions'),
+    ('manage_policies', 'Enable and configure organization policies'),
+    ('view_audit_logs', 'Read the organization audit log'),
+    ('manage_sessions', 'View and revoke the sessions of members'),
+    ('unlock_accounts', 'View and clear the sign-in lockout of members'),
+    ('approve_devices', 'Approve or deny the new devices of members'),
+    ('manage_account_recovery', 'Reset the master password of members enrolled in account recovery'),
+    ('manage_passkeys', 'View and revoke the passkeys of members'),
+    ('manage_sso', 'View and change the single sign-on configuration'),
+    ('manage_groups', 'Create and change groups and their members'),
+    ('manage_organization_recovery', 'Set up the organization recovery key and run a recovery')
+ON CONFLICT (name) DO UPDATE SET description = EXCLUDED.description;
+
+-- Give organizations created before the catalog the built-in roles. A role that already
+-- has a built-in name, such as the Admin role organizations used to be created with, is
+-- kept and granted that template's permissions.
+INSERT INTO roles (name, description, organization_id)
+SELECT templates.name, templates.description, organizations.id
+FROM organizations
+CROSS JOIN (VALUES
+    ('Owner', 'Full control of the organization'),
+    ('Admin', 'Manages members, collections and member security'),
+    ('Manager', 'Manages collections and their access'),
+    ('User', 'Uses the organization vault'),
+    ('Custom', 'Permissions chosen by an admin')
+) AS templates (name, description)
+WHERE NOT EXISTS (
+    SELECT 1 FROM roles
+    WHERE roles.organization_id = organizations.id AND roles.name = templates.name
+);
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT roles.id, permissions.id
+FROM roles
+JOIN (VALUES
+    ('Owner', 'create_vault_item'), ('Owner', 'read_vault_items'), ('Owner', 'manage_collections'),
+    ('Owner', 'manage_members'), ('Owner', 'manage_roles'), ('Owner', 'manage_policies'),
+    ('Owner', 'view_audit_logs'), ('Owner', 'manage_sessions'), ('Owner', 'unlock_accounts'),
+    ('Owner', 'approve_devices'), ('Owner', 'manage_account_recovery'), ('Owner', 'manage_passkeys'),
+    ('Owner', 'manage_sso'), ('Owner', 'manage_groups'), ('Owner', 'manage_organization_recovery'),
+    ('Admin', 'create_vault_item'), ('Admin', 'read_vault_items'), ('Admin', 'manage_collections'),
+    ('Admin', 'manage_members'), ('Admin', 'manage_groups'), ('Admin', 'view_audit_logs'),
+    ('Admin', 'manage_sessions'), ('Admin', 'unlock_accounts'), ('Admin', 'approve_devices'),
+    ('Admin', 'manage_passkeys'),
+    ('Manager', 'create_vault_item'), ('Manager', 'read_vault_items'), ('Manager', 'manage_collections'),
+    ('User', 'create_vault_item'), ('User', 'read_vault_items')
+) AS grants (role_name, permission_name) ON grants.role_name = roles.name
+JOIN permissions ON permissions.name = grants.permission_name
+WHERE roles.organization_id IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+-- Memberships from before roles were kept on them have none. The first member of an
+-- organization created it and becomes its Owner; everyone else becomes a User.
+UPDATE user_organizations
+SET role_id = roles.id
+FROM roles
+WHERE user_organizations.role_id IS NULL
+    AND roles.organization_id = user_organizations.organization_id
+    AND roles.name = CASE
+        WHEN user_organizations.user_id = (
+            SELECT earliest.user_id FROM user_organizations AS earliest
+            WHERE earliest.organization_id = user_organizations.organization_id
+            ORDER BY earliest.created_at, earliest.user_id
+            LIMIT 1
+        ) THEN 'Owner'
+        ELSE 'User'
+    END;
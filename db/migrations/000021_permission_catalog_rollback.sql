@@ -0,0 +1,17 @@
+-- Rollback permission catalog migration
+
+-- Remove the catalog and the grants of it
+DELETE FROM role_permissions WHERE permission_id IN (
+    SELECT id FROM permissions WHERE name IN (
+        'create_vault_item', 'read_vault_items', 'manage_collections', 'manage_members',
+        'manage_roles', 'manage_policies', 'view_audit_logs', 'manage_sessions',
+        'unlock_accounts', 'approve_devices', 'manage_account_recovery', 'manage_passkeys',
+        'manage_sso', 'manage_groups', 'manage_organization_recovery'
+    )
+);
+DELETE FROM permissions WHERE name IN (
+    'create_vault_item', 'read_vault_items', 'manage_collections', 'manage_members',
+    'manage_roles', 'manage_policies', 'view_audit_logs', 'manage_sessions',
+    'unlock_accounts', 'approve_devices', 'manage_account_recovery', 'manage_passkeys',
+    'manage_sso', 'manage_groups', 'manage_organization_recovery'
+);
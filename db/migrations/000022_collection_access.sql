@@ -0,0 +1,14 @@
+-- Collection access levels
+
+-- Grants carry an access level instead of a read-only flag
+ALTER TABLE collection_users ADD COLUMN access VARCHAR(32) NOT NULL DEFAULT 'edit';
+UPDATE collection_users SET access = 'view' WHERE read_only;
+ALTER TABLE collection_users DROP COLUMN read_only;
+
+-- Organization items belong to a collection; the password is kept apart from the rest
+-- of the item so it can be withheld
+ALTER TABLE vault_items ADD COLUMN collection_id UUID REFERENCES collections(id) ON DELETE SET NULL;
+ALTER TABLE vault_items ADD COLUMN encrypted_password TEXT;
+
+-- Indexes
+CREATE INDEX idx_vault_items_collection_id ON vault_items(collection_id);
@@ -0,0 +1,13 @@
+-- Rollback collection access levels migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_vault_items_collection_id;
+
+-- Drop vault item columns
+ALTER TABLE vault_items DROP COLUMN IF EXISTS encrypted_password;
+ALTER TABLE vault_items DROP COLUMN IF EXISTS collection_id;
+
+-- Restore the read-only flag for grants that cannot edit
+ALTER TABLE collection_users ADD COLUMN read_only BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE collection_users SET read_only = TRUE WHERE access IN ('view', 'view_except_passwords');
+ALTER TABLE collection_users DROP COLUMN IF EXISTS access;
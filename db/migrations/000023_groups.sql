@@ -0,0 +1,38 @@
+-- Organization groups
+
+-- Groups table
+CREATE TABLE groups (
+    id UUID PRIMARY KEY DEFAULT uuid_generate_v4(),
+    organization_id UUID NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    name VARCHAR(255) NOT NULL,
+    external_id VARCHAR(255),
+    role_id UUID REFERENCES roles(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Group users table
+CREATE TABLE group_users (
+    group_id UUID NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    managed_by_sso BOOLEAN NOT NULL DEFAULT FALSE,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (group_id, user_id)
+);
+
+-- Collection groups table
+CREATE TABLE collection_groups (
+    collection_id UUID NOT NULL REFERENCES collections(id) ON DELETE CASCADE,
+    group_id UUID NOT NULL REFERENCES groups(id) ON DELETE CASCADE,
+    access VARCHAR(32) NOT NULL DEFAULT 'edit',
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (collection_id, group_id)
+);
+
+-- Indexes
+CREATE INDEX idx_groups_organization_id ON groups(organization_id);
+CREATE UNIQUE INDEX idx_groups_external_id ON groups(organization_id, external_id) WHERE external_id <> '';
+CREATE INDEX idx_groups_role_id ON groups(role_id);
+CREATE INDEX idx_group_users_user_id ON group_users(user_id);
+CREATE INDEX idx_collection_groups_group_id ON collection_groups(group_id);
+
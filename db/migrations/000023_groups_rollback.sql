@@ -0,0 +1,13 @@
+-- Rollback organization groups migration
+
+-- Drop indexes
+DROP INDEX IF EXISTS idx_collection_groups_group_id;
+DROP INDEX IF EXISTS idx_group_users_user_id;
+DROP INDEX IF EXISTS idx_groups_role_id;
+DROP INDEX IF EXISTS idx_groups_external_id;
+DROP INDEX IF EXISTS idx_groups_organization_id;
+
+-- Drop tables
+DROP TABLE IF EXISTS collection_groups;
+DROP TABLE IF EXISTS group_users;
+DROP TABLE IF EXISTS groups;
@@ -14,15 +14,88 @@ type Base struct {
 	UpdatedAt time.Time
 }
 
-// User represents a system user
+// User represents a system user. A user who unlocks with a key connector has no master
+// password; KeyConnectorURL is the connector holding their user key.
 type User struct {
 	Base
-	Email            string `gorm:"uniqueIndex;not null"`
-	Name             string `gorm:"not null"`
-	PasswordHash     string `gorm:"not null"`
-	TwoFactorEnabled bool   `gorm:"default:false"`
-	TwoFactorSecret  string
-	Organizations    []Organization `gorm:"many2many:user_organizations;"`
+	Email                      string     `gorm:"uniqueIndex;not null"`
+	Name                       string     `gorm:"not null"`
+	PasswordHash               string     `gorm:"not null"`
+	TwoFactorEnabled           bool       `gorm:"default:false"`
+	KeyVersion                 int        `gorm:"not null;default:1"`
+	UsesKeyConnector           bool       `gorm:"default:false"`
+	KeyConnectorOrganizationID *uuid.UUID `gorm:"type:uuid"`
+	KeyConnectorURL            string
+	Organizations              []Organization `gorm:"many2many:user_organizations;"`
+}
+
+// TwoFactorMethod is a second factor registered by a user. A user can register several
+// methods of different types. Secret holds the TOTP secret, Credential the JSON-encoded
+// WebAuthn credential, and email methods keep the hash of the last code sent.
+type TwoFactorMethod struct {
+	Base
+	UserID        uuid.UUID `gorm:"type:uuid;index;not null"`
+	Type          string    `gorm:"not null"`
+	Name          string    `gorm:"not null"`
+	Secret        string
+	CredentialID  string `gorm:"index"`
+	Credential    string `gorm:"type:text"`
+	CodeHash      string
+	CodeExpiresAt *time.Time
+	CodeAttempts  int  `gorm:"not null;default:0"`
+	Verified      bool `gorm:"default:false"`
+	LastUsedAt    *time.Time
+	// LastTOTPStep is the time step of the last TOTP code accepted, so that a code
+	// cannot be used twice
+	LastTOTPStep int64 `gorm:"not null;default:0"`
+}
+
+// TwoFactorCeremony holds the state between the two steps of two-factor login or
+// security key registration. KeyHash is the SHA-256 of the login challenge ID, or of
+// the method ID for a registration. WebAuthnSession is the JSON WebAuthn session data.
+type TwoFactorCeremony struct {
+	KeyHash               string     `gorm:"primaryKey"`
+	UserID                uuid.UUID  `gorm:"type:uuid;not null"`
+	DeviceID              *uuid.UUID `gorm:"type:uuid"`
+	WebAuthnSession       string     `gorm:"type:text"`
+	PhishingResistantOnly bool       `gorm:"not null;default:false"`
+	ExpiresAt             time.Time  `gorm:"index;not null"`
+}
+
+// Passkey is a discoverable WebAuthn credential used to sign in without the master
+// password. When the authenticator supports the PRF extension, EncryptedUserKey holds the
+// user key wrapped client-side with a key derived from the PRF output, so the passkey can
+// unlock the vault as well. UserKeyVersion is the user key version it wraps.
+type Passkey struct {
+	Base
+	UserID           uuid.UUID `gorm:"type:uuid;index;not null"`
+	Name             string    `gorm:"not null"`
+	CredentialID     string    `gorm:"uniqueIndex;not null"`
+	Credential       string    `gorm:"type:text;not null"`
+	PRFEnabled       bool      `gorm:"default:false"`
+	EncryptedUserKey string    `gorm:"type:text"`
+	UserKeyVersion   int       `gorm:"not null;default:0"`
+	LastUsedAt       *time.Time
+}
+
+// TwoFactorRememberToken lets a device skip the second factor until it expires. Only a
+// hash of the token is stored; the token is deleted when the device is blocked or
+// deregistered or the user's password changes.
+type TwoFactorRememberToken struct {
+	Base
+	UserID    uuid.UUID `gorm:"type:uuid;index;not null"`
+	DeviceID  uuid.UUID `gorm:"type:uuid;index;not null"`
+	TokenHash string    `gorm:"uniqueIndex;not null"`
+	ExpiresAt time.Time `gorm:"not null"`
+}
+
+// TwoFactorRecoveryCode is a single-use code that satisfies two-factor authentication.
+// Only a slow hash of the code is stored.
+type TwoFactorRecoveryCode struct {
+	Base
+	UserID   uuid.UUID `gorm:"type:uuid;index;not null"`
+	CodeHash string    `gorm:"not null"`
+	UsedAt   *time.Time
 }
 
 // Organization represents a group of users
@@ -34,6 +107,82 @@ type Organization struct {
 	Roles []Role
 }
 
+// OrganizationUser is a user's membership in an organization. EncryptedKey holds the
+// organization key wrapped with the member's public key. ResetPasswordKey holds the
+// member's user key wrapped with the organization's public key once the member has
+// enrolled in account recovery.
+type OrganizationUser struct {
+	UserID                  uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	OrganizationID          uuid.UUID  `gorm:"type:uuid;primaryKey"`
+	RoleID                  *uuid.UUID `gorm:"type:uuid"`
+	Status                  string     `gorm:"not null;default:confirmed"`
+	EncryptedKey            string     `gorm:"type:text"`
+	KeyVersion              int        `gorm:"not null;default:0"`
+	ResetPasswordKey        string     `gorm:"type:text"`
+	ResetPasswordEnrolledAt *time.Time
+	CreatedAt               time.Time
+}
+
+// TableName maps OrganizationUser onto the user/organization join table
+func (OrganizationUser) TableName() string {
+	return "user_organizations"
+}
+
+// Collection groups organization vault items; the name is encrypted with the organization key
+type Collection struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;default:uuid_generate_v4()"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;index;not null"`
+	Name           string    `gorm:"not null;type:text"`
+	IsShared       bool      `gorm:"default:false"`
+	KeyVersion     int       `gorm:"not null;default:1"`
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+	Users          []CollectionUser  `gorm:"foreignKey:CollectionID"`
+	Groups         []CollectionGroup `gorm:"foreignKey:CollectionID"`
+}
+
+// CollectionUser grants a member access to a collection. Access is the level of the
+// grant (view, view_except_passwords, edit, edit_except_passwords or manage).
+// ManagedBySSO marks grants made by the organization's SSO group mapping, which are
+// revoked again when the mapping no longer matches.
+type CollectionUser struct {
+	CollectionID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserID       uuid.UUID `gorm:"type:uuid;primaryKey;index"`
+	Access       string    `gorm:"not null;default:edit"`
+	ManagedBySSO bool      `gorm:"default:false"`
+	CreatedAt    time.Time
+}
+
+// Group is a set of organization members managed together. Members get the group's
+// role and collection access in addition to their own. ExternalID identifies the group
+// in the directory or identity provider it is synced from.
+type Group struct {
+	Base
+	OrganizationID uuid.UUID  `gorm:"type:uuid;index;not null"`
+	Name           string     `gorm:"not null"`
+	ExternalID     string     `gorm:"index"`
+	RoleID         *uuid.UUID `gorm:"type:uuid"`
+}
+
+// GroupUser is a member's membership in a group. ManagedBySSO marks memberships made by
+// the organization's SSO group mapping, which are removed again when the mapping no
+// longer matches.
+type GroupUser struct {
+	GroupID      uuid.UUID `gorm:"type:uuid;primaryKey"`
+	UserID       uuid.UUID `gorm:"type:uuid;primaryKey;index"`
+	ManagedBySSO bool      `gorm:"default:false"`
+	CreatedAt    time.Time
+}
+
+// CollectionGroup grants a group's members access to a collection; Access is the level
+// of the grant, as for CollectionUser
+type CollectionGroup struct {
+	CollectionID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	GroupID      uuid.UUID `gorm:"type:uuid;primaryKey;index"`
+	Access       string    `gorm:"not null;default:edit"`
+	CreatedAt    time.Time
+}
+
 // Role represents a set of permissions
 type Role struct {
 	Base
@@ -52,16 +201,289 @@ type Permission struct {
 	Roles       []Role `gorm:"many2many:role_permissions;"`
 }
 
-// VaultItem represents an encrypted item in a user's vault
+// VaultItem represents an encrypted item in a user's vault. An organization item may
+// belong to a collection. EncryptedPassword is kept apart from EncryptedData so it can
+// be withheld from members whose collection access hides passwords. Both are encrypted
+// with EncryptedKey when the item has one, else with the owner's key at KeyVersion.
 type VaultItem struct {
 	Base
-	UserID         uuid.UUID
-	User           User
-	OrganizationID uuid.UUID
-	Organization   Organization
-	Type           string `gorm:"not null"`
-	Name           string `gorm:"not null"`
-	EncryptedData  string `gorm:"not null;type:text"`
+	UserID            uuid.UUID
+	User              User
+	OrganizationID    uuid.UUID
+	Organization      Organization
+	CollectionID      *uuid.UUID `gorm:"type:uuid;index"`
+	Type              string     `gorm:"not null"`
+	Name              string     `gorm:"not null"`
+	EncryptedData     string     `gorm:"not null;type:text"`
+	EncryptedPassword string     `gorm:"type:text"`
+	EncryptedKey      string     `gorm:"type:text"`
+	KeyVersion        int        `gorm:"not null;default:1"`
+}
+
+// Folder groups a user's vault items; the name is encrypted with the user key
+type Folder struct {
+	Base
+	UserID        uuid.UUID `gorm:"type:uuid;index;not null"`
+	EncryptedName string    `gorm:"not null;type:text"`
+	KeyVersion    int       `gorm:"not null;default:1"`
+}
+
+// Send represents an item shared through a link; its key is wrapped with the user key
+type Send struct {
+	Base
+	UserID        uuid.UUID `gorm:"type:uuid;index;not null"`
+	Type          string    `gorm:"not null"`
+	EncryptedKey  string    `gorm:"not null;type:text"`
+	EncryptedData string    `gorm:"not null;type:text"`
+	KeyVersion    int       `gorm:"not null;default:1"`
+	ExpiresAt     *time.Time
+	DeletionDate  time.Time
+}
+
+// EncryptionKey is a versioned user or organization key, wrapped with the server key
+type EncryptionKey struct {
+	Base
+	OwnerType         string    `gorm:"not null;index:idx_encryption_keys_owner"`
+	OwnerID           uuid.UUID `gorm:"type:uuid;not null;index:idx_encryption_keys_owner"`
+	Version           int       `gorm:"not null"`
+	WrappedKey        string    `gorm:"not null;type:text"`
+	PublicKey         string    `gorm:"type:text"`
+	WrappedPrivateKey string    `gorm:"type:text"`
+	Metadata          []byte    `gorm:"type:jsonb"`
+	IsActive          bool      `gorm:"default:false"`
+}
+
+// KeyRotationJob tracks the progress of a key rotation so that it can be resumed
+type KeyRotationJob struct {
+	Base
+	OwnerType   string    `gorm:"not null;index:idx_key_rotation_jobs_owner"`
+	OwnerID     uuid.UUID `gorm:"type:uuid;not null;index:idx_key_rotation_jobs_owner"`
+	OldKeyID    uuid.UUID `gorm:"type:uuid"`
+	NewKeyID    uuid.UUID `gorm:"type:uuid;not null"`
+	Status      string    `gorm:"not null"`
+	Phase       string    `gorm:"not null"`
+	Processed   int       `gorm:"not null;default:0"`
+	Error       string
+	CompletedAt *time.Time
+}
+
+// Device is a client installation a user signs in from. Status is pending, authorized
+// or blocked.
+type Device struct {
+	Base
+	UserID        uuid.UUID `gorm:"type:uuid;index;not null"`
+	Name          string    `gorm:"not null"`
+	Type          string    `gorm:"not null"`
+	Identifier    string    `gorm:"index"`
+	Status        string    `gorm:"not null;default:pending"`
+	PublicKey     string    `gorm:"type:text"`
+	KeyThumbprint string    `gorm:"index"`
+	LastIP        string
+	LastSeenAt    *time.Time
+	AuthorizedAt  *time.Time
+	BlockedAt     *time.Time
+}
+
+// AuthRequest is a login from a new device waiting for one of the user's authorized
+// devices to approve it. The approving device encrypts the user key to the requesting
+// device's ephemeral PublicKey, so the server never sees it. Only a hash of the access
+// code the requesting device polls with is stored.
+type AuthRequest struct {
+	Base
+	UserID           uuid.UUID  `gorm:"type:uuid;index;not null"`
+	PublicKey        string     `gorm:"not null"`
+	Fingerprint      string     `gorm:"not null"`
+	AccessCodeHash   string     `gorm:"not null"`
+	DeviceID         *uuid.UUID `gorm:"type:uuid"`
+	DeviceName       string
+	DeviceType       string
+	RequestIP        string
+	Status           string     `gorm:"not null;default:pending"`
+	ResponseDeviceID *uuid.UUID `gorm:"type:uuid"`
+	EncryptedUserKey string
+	ExpiresAt        time.Time `gorm:"index;not null"`
+	RespondedAt      *time.Time
+	UsedAt           *time.Time
+}
+
+// UsedDPoPProof remembers a DPoP proof until it expires so it cannot be replayed.
+// ProofHash is the SHA-256 of the signing key's thumbprint and the proof's jti.
+type UsedDPoPProof struct {
+	ProofHash string    `gorm:"primaryKey"`
+	ExpiresAt time.Time `gorm:"index;not null"`
+}
+
+// TableName keeps gorm from splitting DPoP into separate words
+func (UsedDPoPProof) TableName() string {
+	return "used_dpop_proofs"
+}
+
+// AuthFailureCounter counts recent failed sign-in attempts for one key: an account or
+// a client IP, for passwords or two-factor codes. LockedUntil is set on account
+// counters that reached the lockout threshold.
+type AuthFailureCounter struct {
+	Base
+	Key           string    `gorm:"uniqueIndex;not null"`
+	Failures      int       `gorm:"not null;default:0"`
+	LastFailureAt time.Time `gorm:"not null"`
+	LockedUntil   *time.Time
+}
+
+// LoginEvent records a sign-in that completed, including any second factor, with where
+// it came from and how risky it looked. Flags is a comma-separated list.
+type LoginEvent struct {
+	Base
+	UserID    uuid.UUID  `gorm:"type:uuid;index;not null"`
+	DeviceID  *uuid.UUID `gorm:"type:uuid"`
+	IP        string
+	Country   string `gorm:"index"`
+	City      string
+	Latitude  float64
+	Longitude float64
+	RiskScore int
+	Flags     string
+	Action    string `gorm:"not null"`
+}
+
+// SSOConfiguration holds an organization's single sign-on settings. EncryptedConfig is
+// the JSON-encoded configuration, including the client secret, encrypted with the
+// server's SSO key.
+type SSOConfiguration struct {
+	Base
+	OrganizationID  uuid.UUID `gorm:"type:uuid;uniqueIndex;not null"`
+	Provider        string    `gorm:"not null"`
+	EncryptedConfig string    `gorm:"type:text;not null"`
+	Enabled         bool      `gorm:"not null;default:false"`
+}
+
+// SSOIdentity links a user to the subject an organization's identity provider knows
+// them by
+type SSOIdentity struct {
+	Base
+	UserID         uuid.UUID `gorm:"type:uuid;index;not null"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;uniqueIndex:idx_sso_identities_subject;not null"`
+	Issuer         string    `gorm:"uniqueIndex:idx_sso_identities_subject;not null"`
+	Subject        string    `gorm:"uniqueIndex:idx_sso_identities_subject;not null"`
+}
+
+// SSOLogin holds an SSO login between the redirect to the identity provider and its
+// callback: the nonce and PKCE verifier for OIDC, the AuthnRequest ID for SAML.
+// StateHash is the SHA-256 of the OIDC state or SAML RelayState.
+type SSOLogin struct {
+	StateHash      string    `gorm:"primaryKey"`
+	OrganizationID uuid.UUID `gorm:"type:uuid;not null"`
+	Provider       string    `gorm:"not null"`
+	Nonce          string
+	CodeVerifier   string
+	RequestID      string
+	DeviceID       *uuid.UUID `gorm:"type:uuid"`
+	ExpiresAt      time.Time  `gorm:"index;not null"`
+}
+
+// UsedSAMLAssertion remembers an accepted SAML assertion until it expires so it cannot
+// be replayed. AssertionHash is the SHA-256 of the issuer and the assertion ID.
+type UsedSAMLAssertion struct {
+	AssertionHash string    `gorm:"primaryKey"`
+	ExpiresAt     time.Time `gorm:"index;not null"`
+}
+
+// Session represents an authenticated client session. Only a hash of the token is
+// stored; Token is set on the session returned when it is created. ExpiresAt slides
+// forward by the idle timeout on use but never past AbsoluteExpiresAt. OrganizationID is
+// set on sessions signed in through an organization's single sign-on.
+type Session struct {
+	Base
+	UserID             uuid.UUID  `gorm:"type:uuid;index;not null"`
+	Token              string     `gorm:"-"`
+	TokenHash          string     `gorm:"uniqueIndex;not null"`
+	DeviceID           *uuid.UUID `gorm:"type:uuid;index"`
+	OrganizationID     *uuid.UUID `gorm:"type:uuid;index"`
+	DeviceInfo         string
+	ClientType         string
+	IPAddress          string
+	KeyThumbprint      string
+	KeyVersion         int `gorm:"not null;default:1"`
+	IdleTimeoutMinutes int `gorm:"not null"`
+	ExpiresAt          time.Time
+	AbsoluteExpiresAt  time.Time `gorm:"not null"`
+	LastUsed           time.Time
+	RevokedAt          *time.Time
+}
+
+// SessionTicket lets a session open one connection that cannot carry the session token,
+// such as a browser WebSocket. Only a hash of the ticket is stored; Ticket is set on the
+// ticket returned when it is created.
+type SessionTicket struct {
+	TicketHash string    `gorm:"primaryKey"`
+	Ticket     string    `gorm:"-"`
+	SessionID  uuid.UUID `gorm:"type:uuid;not null"`
+	ExpiresAt  time.Time `gorm:"index;not null"`
+}
+
+// OrganizationRecoveryKey is a break-glass key pair for an organization. The private
+// key is split into shares held by custodians; the server keeps only its public key,
+// a verification hash and the organization key wrapped with the public key.
+type OrganizationRecoveryKey struct {
+	Base
+	OrganizationID   uuid.UUID `gorm:"type:uuid;index;not null"`
+	PublicKey        string    `gorm:"not null;type:text"`
+	VerificationHash string    `gorm:"not null"`
+	Threshold        int       `gorm:"not null"`
+	WrappedOrgKey    string    `gorm:"type:text"`
+	OrgKeyVersion    int       `gorm:"not null;default:0"`
+	IsActive         bool      `gorm:"default:true"`
+	CreatedBy        uuid.UUID `gorm:"type:uuid"`
+	Custodians       []RecoveryCustodian
+}
+
+// RecoveryCustodian is a user holding one share of an organization recovery key. The
+// share is kept encrypted with the custodian's public key; ShareCommitment is its
+// SHA-256 hash, which a submitted share must match.
+type RecoveryCustodian struct {
+	Base
+	OrganizationRecoveryKeyID uuid.UUID `gorm:"type:uuid;index;not null"`
+	UserID                    uuid.UUID `gorm:"type:uuid;index;not null"`
+	Name                      string    `gorm:"not null"`
+	Email                     string
+	ShareIndex                int    `gorm:"not null"`
+	EncryptedShare            string `gorm:"not null;type:text"`
+	ShareCommitment           string `gorm:"not null"`
+}
+
+// RecoverySession tracks the collection of recovery key shares and the time-limited
+// window in which the reconstructed key may be used
+type RecoverySession struct {
+	Base
+	OrganizationID uuid.UUID `gorm:"type:uuid;index;not null"`
+	RecoveryKeyID  uuid.UUID `gorm:"type:uuid;not null"`
+	InitiatedBy    uuid.UUID `gorm:"type:uuid;not null"`
+	Status         string    `gorm:"not null"`
+	SharesReceived int       `gorm:"not null;default:0"`
+	SharesRequired int       `gorm:"not null"`
+	ExpiresAt      time.Time
+	UnlockedAt     *time.Time
+	ClosedAt       *time.Time
+}
+
+// RecoverySessionShare is a share a custodian submitted to a recovery session,
+// encrypted at rest. It is deleted when the session ends.
+type RecoverySessionShare struct {
+	RecoverySessionID uuid.UUID `gorm:"type:uuid;primaryKey"`
+	CustodianID       uuid.UUID `gorm:"type:uuid;primaryKey"`
+	EncryptedShare    string    `gorm:"not null;type:text"`
+	CreatedAt         time.Time
+}
+
+// AccountRecoveryRequest is an admin's request to reset a member's master password.
+// It must be confirmed by the same admin before it expires.
+type AccountRecoveryRequest struct {
+	Base
+	OrganizationID uuid.UUID `gorm:"type:uuid;index;not null"`
+	UserID         uuid.UUID `gorm:"type:uuid;index;not null"`
+	RequestedBy    uuid.UUID `gorm:"type:uuid;not null"`
+	Status         string    `gorm:"not null"`
+	ExpiresAt      time.Time
+	CompletedAt    *time.Time
 }
 
 // AuditLog represents a system audit event
@@ -0,0 +1,89 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"gorm.io/gorm"
+)
+
+// Authentication failure counter operations
+
+// ReserveAuthAttempt counts an attempt for the key before it is checked, in a single
+// statement, so concurrent attempts each get their own count. The count starts over
+// when the previous attempt happened before resetBefore. It returns the counter
+// including this attempt and when the attempt before it was counted, which is nil for a
+// new counter.
+func (r *repository) ReserveAuthAttempt(ctx context.Context, key string, resetBefore time.Time) (*models.AuthFailureCounter, *time.Time, error) {
+	now := time.Now()
+	var reserved struct {
+		models.AuthFailureCounter
+		PreviousFailureAt *time.Time
+	}
+	// The row lock taken by the CTE makes a concurrent attempt wait and then read the
+	// time this one was counted at
+	err := r.db.WithContext(ctx).Raw(`
+		WITH previous AS (
+			SELECT last_failure_at FROM auth_failure_counters WHERE key = ? FOR UPDATE
+		)
+		INSERT INTO auth_failure_counters (key, failures, last_failure_at, created_at, updated_at)
+		VALUES (?, 1, ?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET
+			failures = CASE
+				WHEN auth_failure_counters.last_failure_at < ? THEN 1
+				ELSE auth_failure_counters.failures + 1
+			END,
+			last_failure_at = EXCLUDED.last_failure_at,
+			updated_at = EXCLUDED.updated_at
+		RETURNING auth_failure_counters.*, (SELECT last_failure_at FROM previous) AS previous_failure_at`,
+		key, key, now, now, now, resetBefore,
+	).Scan(&reserved).Error
+	if err != nil {
+		return nil, nil, err
+	}
+	return &reserved.AuthFailureCounter, reserved.PreviousFailureAt, nil
+}
+
+// ReleaseAuthAttempt takes back an attempt reserved for the key that succeeded
+func (r *repository) ReleaseAuthAttempt(ctx context.Context, key string) error {
+	return r.db.WithContext(ctx).
+		Model(&models.AuthFailureCounter{}).
+		Where("key = ?", key).
+		Updates(map[string]interface{}{
+			"failures":   gorm.Expr("GREATEST(failures - 1, 0)"),
+			"updated_at": time.Now(),
+		}).Error
+}
+
+func (r *repository) GetAuthFailureCounter(ctx context.Context, key string) (*models.AuthFailureCounter, error) {
+	var counter models.AuthFailureCounter
+	err := r.db.WithContext(ctx).Where("key = ?", key).First(&counter).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &counter, nil
+}
+
+// LockAuthFailureCounter locks the key until the given time and starts its count over
+func (r *repository) LockAuthFailureCounter(ctx context.Context, key string, until time.Time) error {
+	return r.db.WithContext(ctx).
+		Model(&models.AuthFailureCounter{}).
+		Where("key = ?", key).
+		Updates(map[string]interface{}{
+			"failures":     0,
+			"locked_until": until,
+			"updated_at":   time.Now(),
+		}).Error
+}
+
+func (r *repository) DeleteAuthFailureCounters(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return r.db.WithContext(ctx).Where("key IN ?", keys).Delete(&models.AuthFailureCounter{}).Error
+}
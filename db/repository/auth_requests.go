@@ -0,0 +1,79 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Auth request operations
+
+func (r *repository) CreateAuthRequest(ctx context.Context, request *models.AuthRequest) error {
+	return r.db.WithContext(ctx).Create(request).Error
+}
+
+func (r *repository) GetAuthRequest(ctx context.Context, id uuid.UUID) (*models.AuthRequest, error) {
+	var request models.AuthRequest
+	err := r.db.WithContext(ctx).First(&request, "id = ?", id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &request, nil
+}
+
+// ListPendingAuthRequests returns the user's unanswered requests that have not expired,
+// newest first
+func (r *repository) ListPendingAuthRequests(ctx context.Context, userID uuid.UUID) ([]models.AuthRequest, error) {
+	var requests []models.AuthRequest
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND status = ? AND expires_at > ?", userID, "pending", time.Now()).
+		Order("created_at DESC").
+		Find(&requests).Error
+	if err != nil {
+		return nil, err
+	}
+	return requests, nil
+}
+
+// RespondToAuthRequest stores the response if the request is still pending. It reports
+// whether the request was updated, so only one device's answer counts.
+func (r *repository) RespondToAuthRequest(ctx context.Context, request *models.AuthRequest) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&models.AuthRequest{}).
+		Where("id = ? AND status = ?", request.ID, "pending").
+		Updates(map[string]interface{}{
+			"status":             request.Status,
+			"response_device_id": request.ResponseDeviceID,
+			"encrypted_user_key": request.EncryptedUserKey,
+			"responded_at":       request.RespondedAt,
+			"updated_at":         time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// ConsumeAuthRequest marks an approved request used. It reports whether this call did,
+// so an approval signs in one device only.
+func (r *repository) ConsumeAuthRequest(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&models.AuthRequest{}).
+		Where("id = ? AND status = ? AND used_at IS NULL", id, "approved").
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *repository) DeleteExpiredAuthRequests(ctx context.Context, before time.Time) error {
+	return r.db.WithContext(ctx).Where("expires_at < ?", before).Delete(&models.AuthRequest{}).Error
+}
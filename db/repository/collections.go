@@ -0,0 +1,81 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func (r *repository) GetCollection(ctx context.Context, id uuid.UUID) (*models.Collection, error) {
+	var collection models.Collection
+	if err := r.db.WithContext(ctx).First(&collection, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &collection, nil
+}
+
+// ListCollectionsByKeyVersion returns collections encrypted with the given organization key version
+func (r *repository) ListCollectionsByKeyVersion(ctx context.Context, orgID uuid.UUID, version, limit int) ([]models.Collection, error) {
+	var collections []models.Collection
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND key_version = ?", orgID, version).
+		Order("id").
+		Limit(limit).
+		Find(&collections).Error
+	if err != nil {
+		return nil, err
+	}
+	return collections, nil
+}
+
+// UpdateCollections saves a batch of collections in a single transaction
+func (r *repository) UpdateCollections(ctx context.Context, collections []models.Collection) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range collections {
+			if err := tx.Save(&collections[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddCollectionUser grants a member access to a collection, replacing any existing grant
+func (r *repository) AddCollectionUser(ctx context.Context, collectionID, userID uuid.UUID, access string) error {
+	return r.db.WithContext(ctx).Save(&models.CollectionUser{
+		CollectionID: collectionID,
+		UserID:       userID,
+		Access:       access,
+		CreatedAt:    time.Now(),
+	}).Error
+}
+
+func (r *repository) UpdateCollectionUser(ctx context.Context, grant *models.CollectionUser) error {
+	return r.db.WithContext(ctx).Save(grant).Error
+}
+
+func (r *repository) RemoveCollectionUser(ctx context.Context, collectionID, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).
+		Where("collection_id = ? AND user_id = ?", collectionID, userID).
+		Delete(&models.CollectionUser{}).Error
+}
+
+// ListUserCollectionGrants returns the member's grants to the organization's collections
+func (r *repository) ListUserCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionUser, error) {
+	var grants []models.CollectionUser
+	err := r.db.WithContext(ctx).
+		Joins("JOIN collections ON collections.id = collection_users.collection_id").
+		Where("collections.organization_id = ? AND collection_users.user_id = ?", orgID, userID).
+		Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
@@ -0,0 +1,131 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Device operations
+
+func (r *repository) CreateDevice(ctx context.Context, device *models.Device) error {
+	return r.db.WithContext(ctx).Create(device).Error
+}
+
+func (r *repository) GetDevice(ctx context.Context, id uuid.UUID) (*models.Device, error) {
+	var device models.Device
+	err := r.db.WithContext(ctx).First(&device, "id = ?", id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &device, nil
+}
+
+func (r *repository) ListDevices(ctx context.Context, userID uuid.UUID) ([]models.Device, error) {
+	var devices []models.Device
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("created_at").
+		Find(&devices).Error
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func (r *repository) UpdateDevice(ctx context.Context, device *models.Device) error {
+	return r.db.WithContext(ctx).Save(device).Error
+}
+
+// DeleteDevice removes the device together with its two-factor remember tokens
+func (r *repository) DeleteDevice(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("device_id = ?", id).Delete(&models.TwoFactorRememberToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&models.Device{}, "id = ?", id).Error
+	})
+}
+
+// ListPendingOrganizationDevices returns the devices waiting for approval that belong to
+// confirmed members of the organization, oldest first
+func (r *repository) ListPendingOrganizationDevices(ctx context.Context, orgID uuid.UUID) ([]models.Device, error) {
+	var devices []models.Device
+	err := r.db.WithContext(ctx).
+		Joins("JOIN user_organizations ON user_organizations.user_id = devices.user_id").
+		Where("user_organizations.organization_id = ? AND user_organizations.status = ? AND devices.status = ?", orgID, "confirmed", "pending").
+		Order("devices.created_at").
+		Find(&devices).Error
+	if err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+// ReviewPendingDevice stores the outcome of an approval if the device is still pending.
+// It reports whether the device was updated, so only the first decision counts.
+func (r *repository) ReviewPendingDevice(ctx context.Context, device *models.Device) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&models.Device{}).
+		Where("id = ? AND status = ?", device.ID, "pending").
+		Updates(map[string]interface{}{
+			"status":        device.Status,
+			"authorized_at": device.AuthorizedAt,
+			"blocked_at":    device.BlockedAt,
+			"updated_at":    time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// SetDeviceKey stores the device's DPoP key if it has none yet. It reports whether the
+// key was stored, so a registered key is never replaced.
+func (r *repository) SetDeviceKey(ctx context.Context, id uuid.UUID, publicKey, thumbprint string) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&models.Device{}).
+		Where("id = ? AND (key_thumbprint IS NULL OR key_thumbprint = '')", id).
+		Updates(map[string]interface{}{
+			"public_key":     publicKey,
+			"key_thumbprint": thumbprint,
+			"updated_at":     time.Now(),
+		})
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Two-factor remember token operations
+
+func (r *repository) CreateTwoFactorRememberToken(ctx context.Context, token *models.TwoFactorRememberToken) error {
+	return r.db.WithContext(ctx).Create(token).Error
+}
+
+func (r *repository) GetTwoFactorRememberTokenByHash(ctx context.Context, tokenHash string) (*models.TwoFactorRememberToken, error) {
+	var token models.TwoFactorRememberToken
+	err := r.db.WithContext(ctx).Where("token_hash = ?", tokenHash).First(&token).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *repository) DeleteTwoFactorRememberTokensForDevice(ctx context.Context, deviceID uuid.UUID) error {
+	return r.db.WithContext(ctx).Where("device_id = ?", deviceID).Delete(&models.TwoFactorRememberToken{}).Error
+}
+
+func (r *repository) DeleteTwoFactorRememberTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&models.TwoFactorRememberToken{}).Error
+}
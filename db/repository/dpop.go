@@ -0,0 +1,31 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+)
+
+// DPoP proof operations
+
+// RecordDPoPProof remembers a proof until expiresAt. It reports false if the proof
+// was recorded before, in a single statement so concurrent replays cannot both win.
+func (r *repository) RecordDPoPProof(ctx context.Context, proofHash string, expiresAt time.Time) (bool, error) {
+	result := r.db.WithContext(ctx).Exec(`
+		INSERT INTO used_dpop_proofs (proof_hash, expires_at)
+		VALUES (?, ?)
+		ON CONFLICT (proof_hash) DO NOTHING`,
+		proofHash, expiresAt,
+	)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// DeleteExpiredDPoPProofs forgets proofs that can no longer be replayed
+func (r *repository) DeleteExpiredDPoPProofs(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("expires_at < ?", before).Delete(&models.UsedDPoPProof{})
+	return result.RowsAffected, result.Error
+}
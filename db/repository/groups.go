@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Group operations
+func (r *repository) CreateGroup(ctx context.Context, group *models.Group) error {
+	return r.db.WithContext(ctx).Create(group).Error
+}
+
+func (r *repository) GetGroup(ctx context.Context, id uuid.UUID) (*models.Group, error) {
+	var group models.Group
+	if err := r.db.WithContext(ctx).First(&group, "id = ?", id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GetGroupByExternalID returns the organization's group synced from the given directory
+// or identity provider group
+func (r *repository) GetGroupByExternalID(ctx context.Context, orgID uuid.UUID, externalID string) (*models.Group, error) {
+	var group models.Group
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND external_id = ?", orgID, externalID).
+		First(&group).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (r *repository) UpdateGroup(ctx context.Context, group *models.Group) error {
+	return r.db.WithContext(ctx).Save(group).Error
+}
+
+// DeleteGroup deletes the group; its memberships and collection grants go with it
+func (r *repository) DeleteGroup(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Delete(&models.Group{}, "id = ?", id).Error
+}
+
+func (r *repository) ListGroups(ctx context.Context, orgID uuid.UUID) ([]models.Group, error) {
+	var groups []models.Group
+	if err := r.db.WithContext(ctx).Where("organization_id = ?", orgID).Order("name").Find(&groups).Error; err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+// AddGroupUser adds a member to a group, replacing any existing membership
+func (r *repository) AddGroupUser(ctx context.Context, membership *models.GroupUser) error {
+	return r.db.WithContext(ctx).Save(membership).Error
+}
+
+func (r *repository) RemoveGroupUser(ctx context.Context, groupID, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).
+		Where("group_id = ? AND user_id = ?", groupID, userID).
+		Delete(&models.GroupUser{}).Error
+}
+
+func (r *repository) ListGroupUsers(ctx context.Context, groupID uuid.UUID) ([]models.GroupUser, error) {
+	var memberships []models.GroupUser
+	if err := r.db.WithContext(ctx).Where("group_id = ?", groupID).Find(&memberships).Error; err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// ListUserGroups returns the member's memberships in the organization's groups
+func (r *repository) ListUserGroups(ctx context.Context, orgID, userID uuid.UUID) ([]models.GroupUser, error) {
+	var memberships []models.GroupUser
+	err := r.db.WithContext(ctx).
+		Joins("JOIN groups ON groups.id = group_users.group_id").
+		Where("groups.organization_id = ? AND group_users.user_id = ?", orgID, userID).
+		Find(&memberships).Error
+	if err != nil {
+		return nil, err
+	}
+	return memberships, nil
+}
+
+// ReplaceGroupUsers makes the users the group's only members in a single transaction
+func (r *repository) ReplaceGroupUsers(ctx context.Context, groupID uuid.UUID, userIDs []uuid.UUID) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		remove := tx.Where("group_id = ?", groupID)
+		if len(userIDs) > 0 {
+			remove = remove.Where("user_id NOT IN ?", userIDs)
+		}
+		if err := remove.Delete(&models.GroupUser{}).Error; err != nil {
+			return err
+		}
+		for _, userID := range userIDs {
+			err := tx.Exec(`
+				INSERT INTO group_users (group_id, user_id, managed_by_sso, created_at)
+				VALUES (?, ?, FALSE, ?)
+				ON CONFLICT (group_id, user_id) DO NOTHING`,
+				groupID, userID, time.Now(),
+			).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SetCollectionGroup grants a group access to a collection, replacing any existing grant
+func (r *repository) SetCollectionGroup(ctx context.Context, grant *models.CollectionGroup) error {
+	return r.db.WithContext(ctx).Save(grant).Error
+}
+
+func (r *repository) RemoveCollectionGroup(ctx context.Context, collectionID, groupID uuid.UUID) error {
+	return r.db.WithContext(ctx).
+		Where("collection_id = ? AND group_id = ?", collectionID, groupID).
+		Delete(&models.CollectionGroup{}).Error
+}
+
+func (r *repository) ListGroupCollections(ctx context.Context, groupID uuid.UUID) ([]models.CollectionGroup, error) {
+	var grants []models.CollectionGroup
+	if err := r.db.WithContext(ctx).Where("group_id = ?", groupID).Find(&grants).Error; err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// ListUserGroupCollectionGrants returns the grants to the organization's collections
+// the member has through their groups
+func (r *repository) ListUserGroupCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionGroup, error) {
+	var grants []models.CollectionGroup
+	err := r.db.WithContext(ctx).
+		Joins("JOIN group_users ON group_users.group_id = collection_groups.group_id").
+		Joins("JOIN groups ON groups.id = collection_groups.group_id").
+		Where("groups.organization_id = ? AND group_users.user_id = ?", orgID, userID).
+		Find(&grants).Error
+	if err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
@@ -0,0 +1,224 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Encryption key operations
+func (r *repository) CreateEncryptionKey(ctx context.Context, key *models.EncryptionKey) error {
+	return r.db.WithContext(ctx).Create(key).Error
+}
+
+func (r *repository) GetEncryptionKey(ctx context.Context, id uuid.UUID) (*models.EncryptionKey, error) {
+	var key models.EncryptionKey
+	if err := r.db.WithContext(ctx).First(&key, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *repository) GetActiveEncryptionKey(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.EncryptionKey, error) {
+	var key models.EncryptionKey
+	err := r.db.WithContext(ctx).
+		Where("owner_type = ? AND owner_id = ? AND is_active = ?", ownerType, ownerID, true).
+		Order("version desc").
+		First(&key).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ActivateEncryptionKey marks the given key as the only active key of its owner
+func (r *repository) ActivateEncryptionKey(ctx context.Context, key *models.EncryptionKey) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.EncryptionKey{}).
+			Where("owner_type = ? AND owner_id = ? AND id <> ?", key.OwnerType, key.OwnerID, key.ID).
+			Update("is_active", false).Error; err != nil {
+			return err
+		}
+
+		key.IsActive = true
+		return tx.Model(key).Select("is_active", "metadata").Updates(key).Error
+	})
+}
+
+// Key rotation operations
+
+// CreateKeyRotation stores a new key and the job that rolls it out in one transaction,
+// so that a failure cannot leave a key without a job holding its version
+func (r *repository) CreateKeyRotation(ctx context.Context, key *models.EncryptionKey, job *models.KeyRotationJob) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(key).Error; err != nil {
+			return err
+		}
+		job.NewKeyID = key.ID
+		return tx.Create(job).Error
+	})
+}
+
+func (r *repository) UpdateKeyRotationJob(ctx context.Context, job *models.KeyRotationJob) error {
+	return r.db.WithContext(ctx).Save(job).Error
+}
+
+func (r *repository) GetUnfinishedKeyRotationJob(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.KeyRotationJob, error) {
+	var job models.KeyRotationJob
+	err := r.db.WithContext(ctx).
+		Where("owner_type = ? AND owner_id = ? AND status IN ?", ownerType, ownerID, []string{"pending", "running"}).
+		Order("created_at desc").
+		First(&job).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (r *repository) GetLatestKeyRotationJob(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.KeyRotationJob, error) {
+	var job models.KeyRotationJob
+	err := r.db.WithContext(ctx).
+		Where("owner_type = ? AND owner_id = ?", ownerType, ownerID).
+		Order("created_at desc").
+		First(&job).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ListStaleKeyRotationJobs returns running jobs that have not been saved since updatedBefore
+func (r *repository) ListStaleKeyRotationJobs(ctx context.Context, ownerType string, updatedBefore time.Time) ([]models.KeyRotationJob, error) {
+	var jobs []models.KeyRotationJob
+	err := r.db.WithContext(ctx).
+		Where("owner_type = ? AND status = ? AND updated_at < ?", ownerType, "running", updatedBefore).
+		Order("created_at").
+		Find(&jobs).Error
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// ClaimKeyRotationJob touches the job if nobody saved it since it was read. It reports
+// whether this call did, so only one server takes over a stale job.
+func (r *repository) ClaimKeyRotationJob(ctx context.Context, job *models.KeyRotationJob) (bool, error) {
+	now := time.Now()
+	result := r.db.WithContext(ctx).
+		Model(&models.KeyRotationJob{}).
+		Where("id = ? AND status = ? AND updated_at = ?", job.ID, "running", job.UpdatedAt).
+		Update("updated_at", now)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	if result.RowsAffected != 1 {
+		return false, nil
+	}
+	job.UpdatedAt = now
+	return true, nil
+}
+
+// ListUserVaultItemsBelowKeyVersion returns personal vault items not yet encrypted with the given key version
+func (r *repository) ListUserVaultItemsBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.VaultItem, error) {
+	var items []models.VaultItem
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND (organization_id IS NULL OR organization_id = ?) AND key_version < ?", userID, uuid.Nil, version).
+		Order("id").
+		Limit(limit).
+		Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// ListOrganizationVaultItemsByKeyVersion returns organization vault items encrypted with the given key version
+func (r *repository) ListOrganizationVaultItemsByKeyVersion(ctx context.Context, orgID uuid.UUID, version, limit int) ([]models.VaultItem, error) {
+	var items []models.VaultItem
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND key_version = ?", orgID, version).
+		Order("id").
+		Limit(limit).
+		Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *repository) ListFoldersBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.Folder, error) {
+	var folders []models.Folder
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND key_version < ?", userID, version).
+		Order("id").
+		Limit(limit).
+		Find(&folders).Error
+	if err != nil {
+		return nil, err
+	}
+	return folders, nil
+}
+
+func (r *repository) ListSendsBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.Send, error) {
+	var sends []models.Send
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND key_version < ?", userID, version).
+		Order("id").
+		Limit(limit).
+		Find(&sends).Error
+	if err != nil {
+		return nil, err
+	}
+	return sends, nil
+}
+
+// UpdateVaultItems saves a batch of vault items in a single transaction
+func (r *repository) UpdateVaultItems(ctx context.Context, items []models.VaultItem) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range items {
+			if err := tx.Omit(clause.Associations).Save(&items[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *repository) UpdateFolders(ctx context.Context, folders []models.Folder) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range folders {
+			if err := tx.Save(&folders[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (r *repository) UpdateSends(ctx context.Context, sends []models.Send) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for i := range sends {
+			if err := tx.Save(&sends[i]).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
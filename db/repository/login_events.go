@@ -0,0 +1,47 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Login event operations
+
+func (r *repository) CreateLoginEvent(ctx context.Context, event *models.LoginEvent) error {
+	return r.db.WithContext(ctx).Create(event).Error
+}
+
+// GetLatestLoginEvent returns the user's most recent completed login that was not
+// blocked
+func (r *repository) GetLatestLoginEvent(ctx context.Context, userID uuid.UUID) (*models.LoginEvent, error) {
+	var event models.LoginEvent
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND action <> ?", userID, "block").
+		Order("created_at desc").
+		First(&event).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &event, nil
+}
+
+// HasLoginFromCountry reports whether the user has completed a login from the country
+// before without being blocked
+func (r *repository) HasLoginFromCountry(ctx context.Context, userID uuid.UUID, country string) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).
+		Model(&models.LoginEvent{}).
+		Where("user_id = ? AND country = ? AND action <> ?", userID, country, "block").
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
@@ -0,0 +1,54 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Organization membership operations
+func (r *repository) GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	var member models.OrganizationUser
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND user_id = ?", orgID, userID).
+		First(&member).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &member, nil
+}
+
+func (r *repository) ListOrganizationUsersByStatus(ctx context.Context, orgID uuid.UUID, status string) ([]models.OrganizationUser, error) {
+	var members []models.OrganizationUser
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND status = ?", orgID, status).
+		Find(&members).Error
+	if err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (r *repository) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error) {
+	var members []models.OrganizationUser
+	if err := r.db.WithContext(ctx).Where("user_id = ?", userID).Find(&members).Error; err != nil {
+		return nil, err
+	}
+	return members, nil
+}
+
+func (r *repository) UpdateOrganizationUser(ctx context.Context, member *models.OrganizationUser) error {
+	return r.db.WithContext(ctx).Save(member).Error
+}
+
+func (r *repository) RemoveOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).
+		Where("organization_id = ? AND user_id = ?", orgID, userID).
+		Delete(&models.OrganizationUser{}).Error
+}
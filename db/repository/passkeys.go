@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Passkey operations
+
+func (r *repository) CreatePasskey(ctx context.Context, passkey *models.Passkey) error {
+	return r.db.WithContext(ctx).Create(passkey).Error
+}
+
+func (r *repository) GetPasskey(ctx context.Context, id uuid.UUID) (*models.Passkey, error) {
+	var passkey models.Passkey
+	err := r.db.WithContext(ctx).First(&passkey, "id = ?", id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+func (r *repository) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]models.Passkey, error) {
+	var passkeys []models.Passkey
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("created_at").
+		Find(&passkeys).Error
+	if err != nil {
+		return nil, err
+	}
+	return passkeys, nil
+}
+
+func (r *repository) UpdatePasskey(ctx context.Context, passkey *models.Passkey) error {
+	return r.db.WithContext(ctx).Save(passkey).Error
+}
+
+func (r *repository) DeletePasskey(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Delete(&models.Passkey{}, "id = ?", id).Error
+}
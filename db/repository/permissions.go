@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+)
+
+// Permission resolution operations. Each answer is a single query joining the member's
+// confirmed membership through its roles to the permissions they grant. A member holds
+// their own role and the role of each group they belong to.
+
+// memberRoles selects the organizations a user is a confirmed member of and the roles
+// they hold there. It takes the user ID twice.
+const memberRoles = `
+	WITH member_roles AS (
+		SELECT user_organizations.organization_id, user_organizations.role_id
+		FROM user_organizations
+		WHERE user_organizations.user_id = ?
+			AND user_organizations.status = 'confirmed'
+			AND user_organizations.role_id IS NOT NULL
+		UNION
+		SELECT groups.organization_id, groups.role_id
+		FROM group_users
+		JOIN groups ON groups.id = group_users.group_id
+		JOIN user_organizations ON user_organizations.organization_id = groups.organization_id
+			AND user_organizations.user_id = group_users.user_id
+		WHERE group_users.user_id = ?
+			AND user_organizations.status = 'confirmed'
+			AND groups.role_id IS NOT NULL
+	)`
+
+// ListMemberPermissions returns the names of the permissions the member's roles grant in
+// the organization. It is empty unless the user is a confirmed member with a role.
+func (r *repository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	var names []string
+	err := r.db.WithContext(ctx).Raw(memberRoles+`
+		SELECT DISTINCT permissions.name
+		FROM member_roles
+		JOIN role_permissions ON role_permissions.role_id = member_roles.role_id
+		JOIN permissions ON permissions.id = role_permissions.permission_id
+		WHERE member_roles.organization_id = ?`,
+		userID, userID, orgID,
+	).Scan(&names).Error
+	if err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// MemberHasPermission reports whether the member's roles grant the permission in the
+// organization
+func (r *repository) MemberHasPermission(ctx context.Context, orgID, userID uuid.UUID, permissionName string) (bool, error) {
+	var allowed bool
+	err := r.db.WithContext(ctx).Raw(memberRoles+`
+		SELECT EXISTS (
+			SELECT 1
+			FROM member_roles
+			JOIN role_permissions ON role_permissions.role_id = member_roles.role_id
+			JOIN permissions ON permissions.id = role_permissions.permission_id
+			WHERE member_roles.organization_id = ?
+				AND permissions.name = ?
+		)`,
+		userID, userID, orgID, permissionName,
+	).Scan(&allowed).Error
+	if err != nil {
+		return false, err
+	}
+	return allowed, nil
+}
+
+// ListMembersWithPermission returns the confirmed members of the organization whose
+// roles grant the permission
+func (r *repository) ListMembersWithPermission(ctx context.Context, orgID uuid.UUID, permissionName string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := r.db.WithContext(ctx).Raw(`
+		WITH member_roles AS (
+			SELECT user_organizations.user_id, user_organizations.role_id
+			FROM user_organizations
+			WHERE user_organizations.organization_id = ?
+				AND user_organizations.status = 'confirmed'
+				AND user_organizations.role_id IS NOT NULL
+			UNION
+			SELECT group_users.user_id, groups.role_id
+			FROM groups
+			JOIN group_users ON group_users.group_id = groups.id
+			JOIN user_organizations ON user_organizations.organization_id = groups.organization_id
+				AND user_organizations.user_id = group_users.user_id
+			WHERE groups.organization_id = ?
+				AND user_organizations.status = 'confirmed'
+				AND groups.role_id IS NOT NULL
+		)
+		SELECT DISTINCT member_roles.user_id
+		FROM member_roles
+		JOIN role_permissions ON role_permissions.role_id = member_roles.role_id
+		JOIN permissions ON permissions.id = role_permissions.permission_id
+		WHERE permissions.name = ?`,
+		orgID, orgID, permissionName,
+	).Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ListOrganizationsWithPermission returns the organizations among orgIDs in which the
+// user's roles grant the permission
+func (r *repository) ListOrganizationsWithPermission(ctx context.Context, userID uuid.UUID, orgIDs []uuid.UUID, permissionName string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := r.db.WithContext(ctx).Raw(memberRoles+`
+		SELECT DISTINCT member_roles.organization_id
+		FROM member_roles
+		JOIN role_permissions ON role_permissions.role_id = member_roles.role_id
+		JOIN permissions ON permissions.id = role_permissions.permission_id
+		WHERE member_roles.organization_id IN ?
+			AND permissions.name = ?`,
+		userID, userID, orgIDs, permissionName,
+	).Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// ListCollectionsWithPermission returns the collections among collectionIDs that the
+// user was granted, directly or through a group, and in whose organization the user's
+// roles grant the permission
+func (r *repository) ListCollectionsWithPermission(ctx context.Context, userID uuid.UUID, collectionIDs []uuid.UUID, permissionName string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := r.db.WithContext(ctx).Raw(memberRoles+`,
+		member_collections AS (
+			SELECT collection_users.collection_id
+			FROM collection_users
+			WHERE collection_users.user_id = ?
+			UNION
+			SELECT collection_groups.collection_id
+			FROM collection_groups
+			JOIN group_users ON group_users.group_id = collection_groups.group_id
+			WHERE group_users.user_id = ?
+		)
+		SELECT DISTINCT collections.id
+		FROM collections
+		JOIN member_collections ON member_collections.collection_id = collections.id
+		JOIN member_roles ON member_roles.organization_id = collections.organization_id
+		JOIN role_permissions ON role_permissions.role_id = member_roles.role_id
+		JOIN permissions ON permissions.id = role_permissions.permission_id
+		WHERE collections.id IN ?
+			AND permissions.name = ?`,
+		userID, userID, userID, userID, collectionIDs, permissionName,
+	).Scan(&ids).Error
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
@@ -0,0 +1,12 @@
+package repository
+
+import (
+	"context"
+)
+
+// Push notification operations
+
+// Notify sends the payload to every connection listening on the Postgres channel
+func (r *repository) Notify(ctx context.Context, channel, payload string) error {
+	return r.db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", channel, payload).Error
+}
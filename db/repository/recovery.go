@@ -0,0 +1,141 @@
+package repository
+
+import (
+	"context"
+	"errors"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Organization recovery operations
+
+// CreateOrganizationRecoveryKey stores the key with its custodians and deactivates
+// any previous recovery key of the organization
+func (r *repository) CreateOrganizationRecoveryKey(ctx context.Context, key *models.OrganizationRecoveryKey) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.OrganizationRecoveryKey{}).
+			Where("organization_id = ? AND is_active = ?", key.OrganizationID, true).
+			Update("is_active", false).Error; err != nil {
+			return err
+		}
+		return tx.Create(key).Error
+	})
+}
+
+func (r *repository) GetActiveOrganizationRecoveryKey(ctx context.Context, orgID uuid.UUID) (*models.OrganizationRecoveryKey, error) {
+	var key models.OrganizationRecoveryKey
+	err := r.db.WithContext(ctx).
+		Preload("Custodians", func(db *gorm.DB) *gorm.DB {
+			return db.Order("share_index")
+		}).
+		Where("organization_id = ? AND is_active = ?", orgID, true).
+		First(&key).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *repository) GetOrganizationRecoveryKey(ctx context.Context, id uuid.UUID) (*models.OrganizationRecoveryKey, error) {
+	var key models.OrganizationRecoveryKey
+	err := r.db.WithContext(ctx).
+		Preload("Custodians", func(db *gorm.DB) *gorm.DB {
+			return db.Order("share_index")
+		}).
+		First(&key, id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (r *repository) UpdateOrganizationRecoveryKey(ctx context.Context, key *models.OrganizationRecoveryKey) error {
+	return r.db.WithContext(ctx).Omit(clause.Associations).Save(key).Error
+}
+
+func (r *repository) CreateRecoverySession(ctx context.Context, session *models.RecoverySession) error {
+	return r.db.WithContext(ctx).Create(session).Error
+}
+
+func (r *repository) GetRecoverySession(ctx context.Context, id uuid.UUID) (*models.RecoverySession, error) {
+	var session models.RecoverySession
+	if err := r.db.WithContext(ctx).First(&session, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetOpenRecoverySession returns the organization's recovery session that has not been closed
+func (r *repository) GetOpenRecoverySession(ctx context.Context, orgID uuid.UUID) (*models.RecoverySession, error) {
+	var session models.RecoverySession
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND closed_at IS NULL", orgID).
+		Order("created_at desc").
+		First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *repository) UpdateRecoverySession(ctx context.Context, session *models.RecoverySession) error {
+	return r.db.WithContext(ctx).Save(session).Error
+}
+
+// CreateRecoverySessionShare stores a submitted share unless the custodian already
+// submitted one to the session, so the first of two racing submissions wins. It
+// reports whether the share was stored.
+func (r *repository) CreateRecoverySessionShare(ctx context.Context, share *models.RecoverySessionShare) (bool, error) {
+	result := r.db.WithContext(ctx).Clauses(clause.OnConflict{DoNothing: true}).Create(share)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *repository) ListRecoverySessionShares(ctx context.Context, sessionID uuid.UUID) ([]models.RecoverySessionShare, error) {
+	var shares []models.RecoverySessionShare
+	if err := r.db.WithContext(ctx).Where("recovery_session_id = ?", sessionID).Find(&shares).Error; err != nil {
+		return nil, err
+	}
+	return shares, nil
+}
+
+func (r *repository) DeleteRecoverySessionShares(ctx context.Context, sessionID uuid.UUID) error {
+	return r.db.WithContext(ctx).Where("recovery_session_id = ?", sessionID).Delete(&models.RecoverySessionShare{}).Error
+}
+
+// Account recovery operations
+func (r *repository) CreateAccountRecoveryRequest(ctx context.Context, request *models.AccountRecoveryRequest) error {
+	return r.db.WithContext(ctx).Create(request).Error
+}
+
+func (r *repository) GetAccountRecoveryRequest(ctx context.Context, id uuid.UUID) (*models.AccountRecoveryRequest, error) {
+	var request models.AccountRecoveryRequest
+	if err := r.db.WithContext(ctx).First(&request, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &request, nil
+}
+
+func (r *repository) UpdateAccountRecoveryRequest(ctx context.Context, request *models.AccountRecoveryRequest) error {
+	return r.db.WithContext(ctx).Save(request).Error
+}
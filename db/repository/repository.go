@@ -3,6 +3,7 @@ package repository
 import (
 	"context"
 	"errors"
+	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
 	"github.com/google/uuid"
@@ -18,8 +19,61 @@ type Repository interface {
 	UpdateUser(ctx context.Context, user *models.User) error
 	DeleteUser(ctx context.Context, id uuid.UUID) error
 
+	// Two-factor method operations
+	CreateTwoFactorMethod(ctx context.Context, method *models.TwoFactorMethod) error
+	GetTwoFactorMethod(ctx context.Context, id uuid.UUID) (*models.TwoFactorMethod, error)
+	ListTwoFactorMethods(ctx context.Context, userID uuid.UUID) ([]models.TwoFactorMethod, error)
+	UpdateTwoFactorMethod(ctx context.Context, method *models.TwoFactorMethod) error
+	DeleteTwoFactorMethod(ctx context.Context, id uuid.UUID) error
+	DeleteTwoFactorMethods(ctx context.Context, userID uuid.UUID) error
+	RecordTOTPStep(ctx context.Context, methodID uuid.UUID, step int64) (bool, error)
+
+	// Two-factor ceremony operations
+	CreateTwoFactorCeremony(ctx context.Context, ceremony *models.TwoFactorCeremony) error
+	GetTwoFactorCeremony(ctx context.Context, keyHash string) (*models.TwoFactorCeremony, error)
+	TakeTwoFactorCeremony(ctx context.Context, keyHash string) (*models.TwoFactorCeremony, error)
+	DeleteExpiredTwoFactorCeremonies(ctx context.Context, before time.Time) (int64, error)
+
+	// Passkey operations
+	CreatePasskey(ctx context.Context, passkey *models.Passkey) error
+	GetPasskey(ctx context.Context, id uuid.UUID) (*models.Passkey, error)
+	ListPasskeys(ctx context.Context, userID uuid.UUID) ([]models.Passkey, error)
+	UpdatePasskey(ctx context.Context, passkey *models.Passkey) error
+	DeletePasskey(ctx context.Context, id uuid.UUID) error
+
+	// Two-factor recovery code operations
+	ReplaceTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID, codes []models.TwoFactorRecoveryCode) error
+	ListUnusedTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]models.TwoFactorRecoveryCode, error)
+	ConsumeTwoFactorRecoveryCode(ctx context.Context, id uuid.UUID) (bool, error)
+	DeleteTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID) error
+
+	// Device operations
+	CreateDevice(ctx context.Context, device *models.Device) error
+	GetDevice(ctx context.Context, id uuid.UUID) (*models.Device, error)
+	ListDevices(ctx context.Context, userID uuid.UUID) ([]models.Device, error)
+	UpdateDevice(ctx context.Context, device *models.Device) error
+	DeleteDevice(ctx context.Context, id uuid.UUID) error
+	ListPendingOrganizationDevices(ctx context.Context, orgID uuid.UUID) ([]models.Device, error)
+	ReviewPendingDevice(ctx context.Context, device *models.Device) (bool, error)
+	SetDeviceKey(ctx context.Context, id uuid.UUID, publicKey, thumbprint string) (bool, error)
+
+	// Auth request operations
+	CreateAuthRequest(ctx context.Context, request *models.AuthRequest) error
+	GetAuthRequest(ctx context.Context, id uuid.UUID) (*models.AuthRequest, error)
+	ListPendingAuthRequests(ctx context.Context, userID uuid.UUID) ([]models.AuthRequest, error)
+	RespondToAuthRequest(ctx context.Context, request *models.AuthRequest) (bool, error)
+	ConsumeAuthRequest(ctx context.Context, id uuid.UUID) (bool, error)
+	DeleteExpiredAuthRequests(ctx context.Context, before time.Time) error
+
+	// Two-factor remember token operations
+	CreateTwoFactorRememberToken(ctx context.Context, token *models.TwoFactorRememberToken) error
+	GetTwoFactorRememberTokenByHash(ctx context.Context, tokenHash string) (*models.TwoFactorRememberToken, error)
+	DeleteTwoFactorRememberTokensForDevice(ctx context.Context, deviceID uuid.UUID) error
+	DeleteTwoFactorRememberTokensForUser(ctx context.Context, userID uuid.UUID) error
+
 	// Organization operations
 	CreateOrganization(ctx context.Context, org *models.Organization) error
+	CreateOrganizationWithOwner(ctx context.Context, org *models.Organization, roles []*models.Role, owner *models.OrganizationUser) error
 	GetOrganizationByID(ctx context.Context, id uuid.UUID) (*models.Organization, error)
 	UpdateOrganization(ctx context.Context, org *models.Organization) error
 	DeleteOrganization(ctx context.Context, id uuid.UUID) error
@@ -29,16 +83,149 @@ type Repository interface {
 	GetRoleByID(ctx context.Context, id uuid.UUID) (*models.Role, error)
 	UpdateRole(ctx context.Context, role *models.Role) error
 	DeleteRole(ctx context.Context, id uuid.UUID) error
+	RoleHasPermission(ctx context.Context, roleID uuid.UUID, permissionName string) (bool, error)
+	ReplaceRolePermissions(ctx context.Context, role *models.Role, permissions []models.Permission) error
+
+	// Permission operations
+	ListPermissions(ctx context.Context) ([]models.Permission, error)
+	GetPermissionsByIDs(ctx context.Context, ids []uuid.UUID) ([]models.Permission, error)
+
+	// Permission resolution operations
+	ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error)
+	MemberHasPermission(ctx context.Context, orgID, userID uuid.UUID, permissionName string) (bool, error)
+	ListMembersWithPermission(ctx context.Context, orgID uuid.UUID, permissionName string) ([]uuid.UUID, error)
+	ListOrganizationsWithPermission(ctx context.Context, userID uuid.UUID, orgIDs []uuid.UUID, permissionName string) ([]uuid.UUID, error)
+	ListCollectionsWithPermission(ctx context.Context, userID uuid.UUID, collectionIDs []uuid.UUID, permissionName string) ([]uuid.UUID, error)
+
+	// Organization membership operations
+	GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error)
+	ListOrganizationUsersByStatus(ctx context.Context, orgID uuid.UUID, status string) ([]models.OrganizationUser, error)
+	ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error)
+	UpdateOrganizationUser(ctx context.Context, member *models.OrganizationUser) error
+	RemoveOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) error
+
+	// Collection operations
+	GetCollection(ctx context.Context, id uuid.UUID) (*models.Collection, error)
+	ListCollectionsByKeyVersion(ctx context.Context, orgID uuid.UUID, version, limit int) ([]models.Collection, error)
+	UpdateCollections(ctx context.Context, collections []models.Collection) error
+	AddCollectionUser(ctx context.Context, collectionID, userID uuid.UUID, access string) error
+	UpdateCollectionUser(ctx context.Context, grant *models.CollectionUser) error
+	RemoveCollectionUser(ctx context.Context, collectionID, userID uuid.UUID) error
+	ListUserCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionUser, error)
+
+	// Group operations
+	CreateGroup(ctx context.Context, group *models.Group) error
+	GetGroup(ctx context.Context, id uuid.UUID) (*models.Group, error)
+	GetGroupByExternalID(ctx context.Context, orgID uuid.UUID, externalID string) (*models.Group, error)
+	UpdateGroup(ctx context.Context, group *models.Group) error
+	DeleteGroup(ctx context.Context, id uuid.UUID) error
+	ListGroups(ctx context.Context, orgID uuid.UUID) ([]models.Group, error)
+	AddGroupUser(ctx context.Context, membership *models.GroupUser) error
+	RemoveGroupUser(ctx context.Context, groupID, userID uuid.UUID) error
+	ListGroupUsers(ctx context.Context, groupID uuid.UUID) ([]models.GroupUser, error)
+	ListUserGroups(ctx context.Context, orgID, userID uuid.UUID) ([]models.GroupUser, error)
+	ReplaceGroupUsers(ctx context.Context, groupID uuid.UUID, userIDs []uuid.UUID) error
+	SetCollectionGroup(ctx context.Context, grant *models.CollectionGroup) error
+	RemoveCollectionGroup(ctx context.Context, collectionID, groupID uuid.UUID) error
+	ListGroupCollections(ctx context.Context, groupID uuid.UUID) ([]models.CollectionGroup, error)
+	ListUserGroupCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionGroup, error)
 
 	// VaultItem operations
 	CreateVaultItem(ctx context.Context, item *models.VaultItem) error
 	GetVaultItemByID(ctx context.Context, id uuid.UUID) (*models.VaultItem, error)
 	UpdateVaultItem(ctx context.Context, item *models.VaultItem) error
 	DeleteVaultItem(ctx context.Context, id uuid.UUID) error
+	ListPersonalVaultItems(ctx context.Context, userID uuid.UUID) ([]models.VaultItem, error)
+	ListOrganizationVaultItems(ctx context.Context, orgID uuid.UUID) ([]models.VaultItem, error)
 
 	// Audit operations
 	CreateAuditLog(ctx context.Context, log *models.AuditLog) error
 	GetAuditLogs(ctx context.Context, userID, orgID uuid.UUID, limit, offset int) ([]models.AuditLog, error)
+
+	// Encryption key operations
+	CreateEncryptionKey(ctx context.Context, key *models.EncryptionKey) error
+	GetEncryptionKey(ctx context.Context, id uuid.UUID) (*models.EncryptionKey, error)
+	GetActiveEncryptionKey(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.EncryptionKey, error)
+	ActivateEncryptionKey(ctx context.Context, key *models.EncryptionKey) error
+
+	// Key rotation operations
+	CreateKeyRotation(ctx context.Context, key *models.EncryptionKey, job *models.KeyRotationJob) error
+	UpdateKeyRotationJob(ctx context.Context, job *models.KeyRotationJob) error
+	GetUnfinishedKeyRotationJob(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.KeyRotationJob, error)
+	GetLatestKeyRotationJob(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.KeyRotationJob, error)
+	ListStaleKeyRotationJobs(ctx context.Context, ownerType string, updatedBefore time.Time) ([]models.KeyRotationJob, error)
+	ClaimKeyRotationJob(ctx context.Context, job *models.KeyRotationJob) (bool, error)
+	ListUserVaultItemsBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.VaultItem, error)
+	ListFoldersBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.Folder, error)
+	ListSendsBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.Send, error)
+	ListOrganizationVaultItemsByKeyVersion(ctx context.Context, orgID uuid.UUID, version, limit int) ([]models.VaultItem, error)
+	UpdateVaultItems(ctx context.Context, items []models.VaultItem) error
+	UpdateFolders(ctx context.Context, folders []models.Folder) error
+	UpdateSends(ctx context.Context, sends []models.Send) error
+
+	// Login event operations
+	CreateLoginEvent(ctx context.Context, event *models.LoginEvent) error
+	GetLatestLoginEvent(ctx context.Context, userID uuid.UUID) (*models.LoginEvent, error)
+	HasLoginFromCountry(ctx context.Context, userID uuid.UUID, country string) (bool, error)
+
+	// Authentication failure counter operations
+	ReserveAuthAttempt(ctx context.Context, key string, resetBefore time.Time) (*models.AuthFailureCounter, *time.Time, error)
+	ReleaseAuthAttempt(ctx context.Context, key string) error
+	GetAuthFailureCounter(ctx context.Context, key string) (*models.AuthFailureCounter, error)
+	LockAuthFailureCounter(ctx context.Context, key string, until time.Time) error
+	DeleteAuthFailureCounters(ctx context.Context, keys ...string) error
+
+	// SSO operations
+	CreateSSOConfiguration(ctx context.Context, config *models.SSOConfiguration) error
+	GetSSOConfiguration(ctx context.Context, orgID uuid.UUID) (*models.SSOConfiguration, error)
+	UpdateSSOConfiguration(ctx context.Context, config *models.SSOConfiguration) error
+	CreateSSOIdentity(ctx context.Context, identity *models.SSOIdentity) error
+	GetSSOIdentity(ctx context.Context, orgID uuid.UUID, issuer, subject string) (*models.SSOIdentity, error)
+	CreateSSOLogin(ctx context.Context, login *models.SSOLogin) error
+	TakeSSOLogin(ctx context.Context, stateHash string) (*models.SSOLogin, error)
+	DeleteExpiredSSOLogins(ctx context.Context, before time.Time) (int64, error)
+	RecordSAMLAssertion(ctx context.Context, assertionHash string, expiresAt time.Time) (bool, error)
+	DeleteExpiredSAMLAssertions(ctx context.Context, before time.Time) (int64, error)
+
+	// Session operations
+	CreateSession(ctx context.Context, session *models.Session) error
+	GetSession(ctx context.Context, id uuid.UUID) (*models.Session, error)
+	GetSessionByTokenHash(ctx context.Context, tokenHash string) (*models.Session, error)
+	ListActiveUserSessions(ctx context.Context, userID uuid.UUID) ([]models.Session, error)
+	ListActiveOrganizationSessions(ctx context.Context, orgID, userID uuid.UUID) ([]models.Session, error)
+	TouchSession(ctx context.Context, id uuid.UUID, lastUsed, expiresAt time.Time, ipAddress string) (bool, error)
+	RevokeSession(ctx context.Context, id uuid.UUID) (bool, error)
+	RevokeUserSessions(ctx context.Context, userID, exceptSessionID uuid.UUID) error
+	RevokeDeviceSessions(ctx context.Context, deviceID uuid.UUID) ([]string, error)
+	RevokeOrganizationSessions(ctx context.Context, orgID, userID uuid.UUID) ([]models.Session, error)
+	SetSessionKeyVersion(ctx context.Context, id uuid.UUID, version int) error
+	DeleteStaleSessions(ctx context.Context, before time.Time) (int64, error)
+	CreateSessionTicket(ctx context.Context, ticket *models.SessionTicket) error
+	TakeSessionTicket(ctx context.Context, ticketHash string) (*models.SessionTicket, error)
+	DeleteExpiredSessionTickets(ctx context.Context, before time.Time) (int64, error)
+
+	// DPoP proof operations
+	RecordDPoPProof(ctx context.Context, proofHash string, expiresAt time.Time) (bool, error)
+	DeleteExpiredDPoPProofs(ctx context.Context, before time.Time) (int64, error)
+
+	// Push notification operations
+	Notify(ctx context.Context, channel, payload string) error
+
+	// Organization recovery operations
+	CreateOrganizationRecoveryKey(ctx context.Context, key *models.OrganizationRecoveryKey) error
+	GetActiveOrganizationRecoveryKey(ctx context.Context, orgID uuid.UUID) (*models.OrganizationRecoveryKey, error)
+	GetOrganizationRecoveryKey(ctx context.Context, id uuid.UUID) (*models.OrganizationRecoveryKey, error)
+	UpdateOrganizationRecoveryKey(ctx context.Context, key *models.OrganizationRecoveryKey) error
+	CreateRecoverySession(ctx context.Context, session *models.RecoverySession) error
+	GetRecoverySession(ctx context.Context, id uuid.UUID) (*models.RecoverySession, error)
+	GetOpenRecoverySession(ctx context.Context, orgID uuid.UUID) (*models.RecoverySession, error)
+	UpdateRecoverySession(ctx context.Context, session *models.RecoverySession) error
+	CreateRecoverySessionShare(ctx context.Context, share *models.RecoverySessionShare) (bool, error)
+	ListRecoverySessionShares(ctx context.Context, sessionID uuid.UUID) ([]models.RecoverySessionShare, error)
+	DeleteRecoverySessionShares(ctx context.Context, sessionID uuid.UUID) error
+	CreateAccountRecoveryRequest(ctx context.Context, request *models.AccountRecoveryRequest) error
+	GetAccountRecoveryRequest(ctx context.Context, id uuid.UUID) (*models.AccountRecoveryRequest, error)
+	UpdateAccountRecoveryRequest(ctx context.Context, request *models.AccountRecoveryRequest) error
 }
 
 type repository struct {
@@ -90,6 +277,22 @@ func (r *repository) CreateOrganization(ctx context.Context, org *models.Organiz
 	return r.db.WithContext(ctx).Create(org).Error
 }
 
+// CreateOrganizationWithOwner stores a new organization with its roles and its owner's
+// membership, or none of them
+func (r *repository) CreateOrganizationWithOwner(ctx context.Context, org *models.Organization, roles []*models.Role, owner *models.OrganizationUser) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(org).Error; err != nil {
+			return err
+		}
+		for _, role := range roles {
+			if err := tx.Create(role).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Save(owner).Error
+	})
+}
+
 func (r *repository) GetOrganizationByID(ctx context.Context, id uuid.UUID) (*models.Organization, error) {
 	var org models.Organization
 	if err := r.db.WithContext(ctx).First(&org, id).Error; err != nil {
@@ -133,6 +336,46 @@ func (r *repository) DeleteRole(ctx context.Context, id uuid.UUID) error {
 	return r.db.WithContext(ctx).Delete(&models.Role{}, id).Error
 }
 
+// RoleHasPermission reports whether the role grants the named permission
+func (r *repository) RoleHasPermission(ctx context.Context, roleID uuid.UUID, permissionName string) (bool, error) {
+	var count int64
+	err := r.db.WithContext(ctx).
+		Table("role_permissions").
+		Joins("JOIN permissions ON permissions.id = role_permissions.permission_id").
+		Where("role_permissions.role_id = ? AND permissions.name = ?", roleID, permissionName).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// ReplaceRolePermissions sets the permissions the role grants, removing any it no
+// longer lists
+func (r *repository) ReplaceRolePermissions(ctx context.Context, role *models.Role, permissions []models.Permission) error {
+	return r.db.WithContext(ctx).Model(role).Association("Permissions").Replace(permissions)
+}
+
+// Permission operations
+func (r *repository) ListPermissions(ctx context.Context) ([]models.Permission, error) {
+	var permissions []models.Permission
+	if err := r.db.WithContext(ctx).Order("name").Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (r *repository) GetPermissionsByIDs(ctx context.Context, ids []uuid.UUID) ([]models.Permission, error) {
+	var permissions []models.Permission
+	if len(ids) == 0 {
+		return permissions, nil
+	}
+	if err := r.db.WithContext(ctx).Where("id IN ?", ids).Find(&permissions).Error; err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
 // VaultItem operations
 func (r *repository) CreateVaultItem(ctx context.Context, item *models.VaultItem) error {
 	return r.db.WithContext(ctx).Create(item).Error
@@ -157,6 +400,26 @@ func (r *repository) DeleteVaultItem(ctx context.Context, id uuid.UUID) error {
 	return r.db.WithContext(ctx).Delete(&models.VaultItem{}, id).Error
 }
 
+// ListPersonalVaultItems returns the user's items that belong to no organization
+func (r *repository) ListPersonalVaultItems(ctx context.Context, userID uuid.UUID) ([]models.VaultItem, error) {
+	var items []models.VaultItem
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND (organization_id IS NULL OR organization_id = ?)", userID, uuid.Nil).
+		Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (r *repository) ListOrganizationVaultItems(ctx context.Context, orgID uuid.UUID) ([]models.VaultItem, error) {
+	var items []models.VaultItem
+	if err := r.db.WithContext(ctx).Where("organization_id = ?", orgID).Find(&items).Error; err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 // Audit operations
 func (r *repository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
 	return r.db.WithContext(ctx).Create(log).Error
@@ -0,0 +1,187 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Session operations
+
+func (r *repository) CreateSession(ctx context.Context, session *models.Session) error {
+	return r.db.WithContext(ctx).Create(session).Error
+}
+
+func (r *repository) GetSession(ctx context.Context, id uuid.UUID) (*models.Session, error) {
+	var session models.Session
+	err := r.db.WithContext(ctx).First(&session, "id = ?", id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+func (r *repository) GetSessionByTokenHash(ctx context.Context, tokenHash string) (*models.Session, error) {
+	var session models.Session
+	err := r.db.WithContext(ctx).Where("token_hash = ?", tokenHash).First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &session, nil
+}
+
+// ListActiveUserSessions returns the user's sessions that are neither revoked nor
+// expired, most recently used first
+func (r *repository) ListActiveUserSessions(ctx context.Context, userID uuid.UUID) ([]models.Session, error) {
+	var sessions []models.Session
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND revoked_at IS NULL AND expires_at > ?", userID, time.Now()).
+		Order("last_used DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// ListActiveOrganizationSessions lists the user's active sessions signed in through the
+// organization, most recently used first
+func (r *repository) ListActiveOrganizationSessions(ctx context.Context, orgID, userID uuid.UUID) ([]models.Session, error) {
+	var sessions []models.Session
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND user_id = ? AND revoked_at IS NULL AND expires_at > ?", orgID, userID, time.Now()).
+		Order("last_used DESC").
+		Find(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// TouchSession records a use of the session from an IP address and moves its expiry. It
+// reports whether the session was still active.
+func (r *repository) TouchSession(ctx context.Context, id uuid.UUID, lastUsed, expiresAt time.Time, ipAddress string) (bool, error) {
+	updates := map[string]interface{}{
+		"last_used":  lastUsed,
+		"expires_at": expiresAt,
+	}
+	if ipAddress != "" {
+		updates["ip_address"] = ipAddress
+	}
+	result := r.db.WithContext(ctx).
+		Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL AND expires_at > ?", id, lastUsed).
+		Updates(updates)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// RevokeSession revokes the session and reports whether it was active
+func (r *repository) RevokeSession(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&models.Session{}).
+		Where("id = ? AND revoked_at IS NULL", id).
+		Update("revoked_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// RevokeUserSessions revokes every active session of a user except the given one
+func (r *repository) RevokeUserSessions(ctx context.Context, userID, exceptSessionID uuid.UUID) error {
+	return r.db.WithContext(ctx).
+		Model(&models.Session{}).
+		Where("user_id = ? AND id <> ? AND revoked_at IS NULL", userID, exceptSessionID).
+		Update("revoked_at", time.Now()).Error
+}
+
+// RevokeOrganizationSessions revokes every active session of the user signed in through
+// the organization and returns them, so that cached copies can be evicted
+func (r *repository) RevokeOrganizationSessions(ctx context.Context, orgID, userID uuid.UUID) ([]models.Session, error) {
+	var sessions []models.Session
+	err := r.db.WithContext(ctx).Raw(`
+		UPDATE sessions SET revoked_at = ?
+		WHERE organization_id = ? AND user_id = ? AND revoked_at IS NULL
+		RETURNING *`,
+		time.Now(), orgID, userID,
+	).Scan(&sessions).Error
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeDeviceSessions revokes every active session signed in from the device and
+// returns their token hashes, so that cached copies can be evicted
+func (r *repository) RevokeDeviceSessions(ctx context.Context, deviceID uuid.UUID) ([]string, error) {
+	var tokenHashes []string
+	err := r.db.WithContext(ctx).Raw(`
+		UPDATE sessions SET revoked_at = ?
+		WHERE device_id = ? AND revoked_at IS NULL
+		RETURNING token_hash`,
+		time.Now(), deviceID,
+	).Scan(&tokenHashes).Error
+	if err != nil {
+		return nil, err
+	}
+	return tokenHashes, nil
+}
+
+// SetSessionKeyVersion records the user key version the session is entitled to
+func (r *repository) SetSessionKeyVersion(ctx context.Context, id uuid.UUID, version int) error {
+	return r.db.WithContext(ctx).
+		Model(&models.Session{}).
+		Where("id = ?", id).
+		Update("key_version", version).Error
+}
+
+// DeleteStaleSessions deletes sessions that expired or were revoked before the given
+// time and returns how many were deleted
+func (r *repository) DeleteStaleSessions(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).
+		Where("expires_at < ? OR revoked_at < ?", before, before).
+		Delete(&models.Session{})
+	return result.RowsAffected, result.Error
+}
+
+func (r *repository) CreateSessionTicket(ctx context.Context, ticket *models.SessionTicket) error {
+	return r.db.WithContext(ctx).Create(ticket).Error
+}
+
+// TakeSessionTicket deletes the ticket and returns it, in a single statement so that a
+// ticket opens one connection only. It returns nil if there is no such ticket.
+func (r *repository) TakeSessionTicket(ctx context.Context, ticketHash string) (*models.SessionTicket, error) {
+	var ticket models.SessionTicket
+	result := r.db.WithContext(ctx).Raw(`
+		DELETE FROM session_tickets
+		WHERE ticket_hash = ?
+		RETURNING *`,
+		ticketHash,
+	).Scan(&ticket)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &ticket, nil
+}
+
+// DeleteExpiredSessionTickets forgets tickets that were not used in time
+func (r *repository) DeleteExpiredSessionTickets(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("expires_at < ?", before).Delete(&models.SessionTicket{})
+	return result.RowsAffected, result.Error
+}
@@ -0,0 +1,103 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// SSO operations
+
+func (r *repository) CreateSSOConfiguration(ctx context.Context, config *models.SSOConfiguration) error {
+	return r.db.WithContext(ctx).Create(config).Error
+}
+
+func (r *repository) GetSSOConfiguration(ctx context.Context, orgID uuid.UUID) (*models.SSOConfiguration, error) {
+	var config models.SSOConfiguration
+	err := r.db.WithContext(ctx).First(&config, "organization_id = ?", orgID).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &config, nil
+}
+
+func (r *repository) UpdateSSOConfiguration(ctx context.Context, config *models.SSOConfiguration) error {
+	return r.db.WithContext(ctx).Save(config).Error
+}
+
+func (r *repository) CreateSSOIdentity(ctx context.Context, identity *models.SSOIdentity) error {
+	return r.db.WithContext(ctx).Create(identity).Error
+}
+
+// GetSSOIdentity returns the identity the organization's provider issued the subject for
+func (r *repository) GetSSOIdentity(ctx context.Context, orgID uuid.UUID, issuer, subject string) (*models.SSOIdentity, error) {
+	var identity models.SSOIdentity
+	err := r.db.WithContext(ctx).
+		Where("organization_id = ? AND issuer = ? AND subject = ?", orgID, issuer, subject).
+		First(&identity).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (r *repository) CreateSSOLogin(ctx context.Context, login *models.SSOLogin) error {
+	return r.db.WithContext(ctx).Create(login).Error
+}
+
+// TakeSSOLogin deletes the login and returns it, in a single statement so that a state
+// can complete one login only. It returns nil if there is no such login.
+func (r *repository) TakeSSOLogin(ctx context.Context, stateHash string) (*models.SSOLogin, error) {
+	var login models.SSOLogin
+	result := r.db.WithContext(ctx).Raw(`
+		DELETE FROM sso_logins
+		WHERE state_hash = ?
+		RETURNING *`,
+		stateHash,
+	).Scan(&login)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &login, nil
+}
+
+// DeleteExpiredSSOLogins forgets logins the user did not finish in time
+func (r *repository) DeleteExpiredSSOLogins(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("expires_at < ?", before).Delete(&models.SSOLogin{})
+	return result.RowsAffected, result.Error
+}
+
+// RecordSAMLAssertion remembers an assertion until expiresAt. It reports false if the
+// assertion was recorded before, in a single statement so concurrent replays cannot
+// both win.
+func (r *repository) RecordSAMLAssertion(ctx context.Context, assertionHash string, expiresAt time.Time) (bool, error) {
+	result := r.db.WithContext(ctx).Exec(`
+		INSERT INTO used_saml_assertions (assertion_hash, expires_at)
+		VALUES (?, ?)
+		ON CONFLICT (assertion_hash) DO NOTHING`,
+		assertionHash, expiresAt,
+	)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// DeleteExpiredSAMLAssertions forgets assertions that can no longer be replayed
+func (r *repository) DeleteExpiredSAMLAssertions(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("expires_at < ?", before).Delete(&models.UsedSAMLAssertion{})
+	return result.RowsAffected, result.Error
+}
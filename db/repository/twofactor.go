@@ -0,0 +1,155 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Two-factor method operations
+
+func (r *repository) CreateTwoFactorMethod(ctx context.Context, method *models.TwoFactorMethod) error {
+	return r.db.WithContext(ctx).Create(method).Error
+}
+
+func (r *repository) GetTwoFactorMethod(ctx context.Context, id uuid.UUID) (*models.TwoFactorMethod, error) {
+	var method models.TwoFactorMethod
+	err := r.db.WithContext(ctx).First(&method, "id = ?", id).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &method, nil
+}
+
+// ListTwoFactorMethods returns all of the user's methods, verified or not, oldest first
+func (r *repository) ListTwoFactorMethods(ctx context.Context, userID uuid.UUID) ([]models.TwoFactorMethod, error) {
+	var methods []models.TwoFactorMethod
+	err := r.db.WithContext(ctx).
+		Where("user_id = ?", userID).
+		Order("created_at").
+		Find(&methods).Error
+	if err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+func (r *repository) UpdateTwoFactorMethod(ctx context.Context, method *models.TwoFactorMethod) error {
+	return r.db.WithContext(ctx).Save(method).Error
+}
+
+func (r *repository) DeleteTwoFactorMethod(ctx context.Context, id uuid.UUID) error {
+	return r.db.WithContext(ctx).Delete(&models.TwoFactorMethod{}, "id = ?", id).Error
+}
+
+func (r *repository) DeleteTwoFactorMethods(ctx context.Context, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&models.TwoFactorMethod{}).Error
+}
+
+// RecordTOTPStep stores the time step of an accepted TOTP code. It returns false if a
+// code of the same or a later step was accepted before, in a single statement so that
+// concurrent requests cannot both use one code.
+func (r *repository) RecordTOTPStep(ctx context.Context, methodID uuid.UUID, step int64) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&models.TwoFactorMethod{}).
+		Where("id = ? AND last_totp_step < ?", methodID, step).
+		Update("last_totp_step", step)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// Two-factor ceremony operations
+
+func (r *repository) CreateTwoFactorCeremony(ctx context.Context, ceremony *models.TwoFactorCeremony) error {
+	return r.db.WithContext(ctx).Create(ceremony).Error
+}
+
+func (r *repository) GetTwoFactorCeremony(ctx context.Context, keyHash string) (*models.TwoFactorCeremony, error) {
+	var ceremony models.TwoFactorCeremony
+	err := r.db.WithContext(ctx).First(&ceremony, "key_hash = ?", keyHash).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ceremony, nil
+}
+
+// TakeTwoFactorCeremony deletes the ceremony and returns it, in a single statement so
+// that a challenge can be answered once only. It returns nil if there is no such
+// ceremony.
+func (r *repository) TakeTwoFactorCeremony(ctx context.Context, keyHash string) (*models.TwoFactorCeremony, error) {
+	var ceremony models.TwoFactorCeremony
+	result := r.db.WithContext(ctx).Raw(`
+		DELETE FROM two_factor_ceremonies
+		WHERE key_hash = ?
+		RETURNING *`,
+		keyHash,
+	).Scan(&ceremony)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+	return &ceremony, nil
+}
+
+// DeleteExpiredTwoFactorCeremonies forgets ceremonies the user did not finish in time
+func (r *repository) DeleteExpiredTwoFactorCeremonies(ctx context.Context, before time.Time) (int64, error) {
+	result := r.db.WithContext(ctx).Where("expires_at < ?", before).Delete(&models.TwoFactorCeremony{})
+	return result.RowsAffected, result.Error
+}
+
+// Two-factor recovery code operations
+
+// ReplaceTwoFactorRecoveryCodes deletes the user's existing recovery codes and stores new ones
+func (r *repository) ReplaceTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID, codes []models.TwoFactorRecoveryCode) error {
+	return r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.TwoFactorRecoveryCode{}).Error; err != nil {
+			return err
+		}
+		if len(codes) == 0 {
+			return nil
+		}
+		return tx.Create(&codes).Error
+	})
+}
+
+func (r *repository) ListUnusedTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]models.TwoFactorRecoveryCode, error) {
+	var codes []models.TwoFactorRecoveryCode
+	err := r.db.WithContext(ctx).
+		Where("user_id = ? AND used_at IS NULL", userID).
+		Find(&codes).Error
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// ConsumeTwoFactorRecoveryCode marks the code used. It returns false if the code was
+// already used, so a code cannot be redeemed twice by concurrent requests.
+func (r *repository) ConsumeTwoFactorRecoveryCode(ctx context.Context, id uuid.UUID) (bool, error) {
+	result := r.db.WithContext(ctx).
+		Model(&models.TwoFactorRecoveryCode{}).
+		Where("id = ? AND used_at IS NULL", id).
+		Update("used_at", time.Now())
+	if result.Error != nil {
+		return false, result.Error
+	}
+	return result.RowsAffected == 1, nil
+}
+
+func (r *repository) DeleteTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID) error {
+	return r.db.WithContext(ctx).Where("user_id = ?", userID).Delete(&models.TwoFactorRecoveryCode{}).Error
+}
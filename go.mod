@@ -3,8 +3,16 @@ module github.com/emailimmunity/passwordimmunity
 go 1.21
 
 require (
+	github.com/beevik/etree v1.1.0
+	github.com/coreos/go-oidc/v3 v3.9.0
+	github.com/crewjam/saml v0.4.14
+	github.com/fxamacker/cbor/v2 v2.6.0
+	github.com/go-webauthn/webauthn v0.10.2
 	github.com/google/uuid v1.4.0
 	github.com/lib/pq v1.10.9
+	github.com/oschwald/geoip2-golang v1.9.0
+	github.com/russellhaering/goxmldsig v1.3.0
+	golang.org/x/oauth2 v0.15.0
 	gorm.io/gorm v1.25.5
 	gorm.io/driver/postgres v1.5.4
 )
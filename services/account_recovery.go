@@ -0,0 +1,339 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrNotEnrolledInAccountRecovery = errors.New("member is not enrolled in account recovery")
+	ErrAccountRecoveryRequired      = errors.New("organization policy requires account recovery enrollment")
+	ErrPasswordPolicyViolation      = errors.New("password does not meet the organization's master password policy")
+	ErrRecoveryRequestNotFound      = errors.New("account recovery request not found")
+	ErrRecoveryRequestExpired       = errors.New("account recovery request has expired")
+)
+
+const (
+	accountRecoveryRequestPending   = "pending"
+	accountRecoveryRequestCompleted = "completed"
+	accountRecoveryRequestCancelled = "cancelled"
+
+	// accountRecoveryRequestTTL is how long an admin has to confirm a password reset
+	accountRecoveryRequestTTL = 15 * time.Minute
+)
+
+// AccountRecoveryService lets organization members escrow their user key with the
+// organization so that an admin can reset a forgotten master password
+type AccountRecoveryService interface {
+	EnrollAccountRecovery(ctx context.Context, orgID, userID uuid.UUID) error
+	WithdrawAccountRecovery(ctx context.Context, orgID, userID uuid.UUID) error
+	ApplyAccountRecoveryPolicy(ctx context.Context, orgID, userID uuid.UUID) error
+	InitiatePasswordReset(ctx context.Context, orgID, adminID, memberID uuid.UUID) (*models.AccountRecoveryRequest, error)
+	ConfirmPasswordReset(ctx context.Context, requestID, adminID uuid.UUID, adminPassword, newPassword string) error
+	CancelPasswordReset(ctx context.Context, requestID, adminID uuid.UUID) error
+}
+
+type accountRecoveryService struct {
+	repo        repository.Repository
+	keys        KeyRotationService
+	policies    PolicyService
+	sessions    SessionService
+	email       EmailService
+	permissions PermissionResolver
+}
+
+func NewAccountRecoveryService(
+	repo repository.Repository,
+	keys KeyRotationService,
+	policies PolicyService,
+	sessions SessionService,
+	email EmailService,
+	permissions PermissionResolver,
+) AccountRecoveryService {
+	return &accountRecoveryService{
+		repo:        repo,
+		keys:        keys,
+		policies:    policies,
+		sessions:    sessions,
+		email:       email,
+		permissions: permissions,
+	}
+}
+
+// EnrollAccountRecovery escrows the member's user key with the organization's public key
+func (s *accountRecoveryService) EnrollAccountRecovery(ctx context.Context, orgID, userID uuid.UUID) error {
+	member, err := confirmedMember(ctx, s.repo, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	escrow, err := s.keys.EscrowUserKey(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	member.ResetPasswordKey = escrow
+	member.ResetPasswordEnrolledAt = &now
+	if err := s.repo.UpdateOrganizationUser(ctx, member); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("account_recovery_enrolled", "Member enrolled in account recovery")
+	return s.createAuditLog(ctx, "account_recovery.enrolled", userID, orgID, metadata)
+}
+
+// WithdrawAccountRecovery removes the member's escrowed key unless policy requires enrollment
+func (s *accountRecoveryService) WithdrawAccountRecovery(ctx context.Context, orgID, userID uuid.UUID) error {
+	member, err := confirmedMember(ctx, s.repo, orgID, userID)
+	if err != nil {
+		return err
+	}
+
+	settings, err := s.policies.GetMasterPasswordPolicy(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	if settings.RequireAccountRecovery {
+		return ErrAccountRecoveryRequired
+	}
+
+	member.ResetPasswordKey = ""
+	member.ResetPasswordEnrolledAt = nil
+	if err := s.repo.UpdateOrganizationUser(ctx, member); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("account_recovery_withdrawn", "Member withdrew from account recovery")
+	return s.createAuditLog(ctx, "account_recovery.withdrawn", userID, orgID, metadata)
+}
+
+// ApplyAccountRecoveryPolicy enrolls a member when the organization's master_password
+// policy asks for automatic enrollment. It is called when a member joins, either added by
+// an admin or provisioned by SSO. A member without a user key yet has nothing to escrow
+// and is left for EnrollAccountRecovery once they set up their keys.
+func (s *accountRecoveryService) ApplyAccountRecoveryPolicy(ctx context.Context, orgID, userID uuid.UUID) error {
+	settings, err := s.policies.GetMasterPasswordPolicy(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	if !settings.AutoEnrollAccountRecovery && !settings.RequireAccountRecovery {
+		return nil
+	}
+
+	member, err := confirmedMember(ctx, s.repo, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member.ResetPasswordKey != "" {
+		return nil
+	}
+
+	userKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerUser, userID)
+	if err != nil {
+		return err
+	}
+	if userKey == nil {
+		return nil
+	}
+	return s.EnrollAccountRecovery(ctx, orgID, userID)
+}
+
+// InitiatePasswordReset starts a master password reset for an enrolled member. The
+// reset only happens once the admin confirms it with ConfirmPasswordReset. Admins can
+// only reset members whose permissions they hold themselves.
+func (s *accountRecoveryService) InitiatePasswordReset(ctx context.Context, orgID, adminID, memberID uuid.UUID) (*models.AccountRecoveryRequest, error) {
+	// Admins cannot reset their own master password
+	if adminID == memberID {
+		return nil, ErrInvalidOperation
+	}
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageAccountRecovery); err != nil {
+		return nil, err
+	}
+	if err := s.requireMemberPermissions(ctx, orgID, adminID, memberID); err != nil {
+		return nil, err
+	}
+
+	member, err := confirmedMember(ctx, s.repo, orgID, memberID)
+	if err != nil {
+		return nil, err
+	}
+	if member.ResetPasswordKey == "" {
+		return nil, ErrNotEnrolledInAccountRecovery
+	}
+
+	request := &models.AccountRecoveryRequest{
+		OrganizationID: orgID,
+		UserID:         memberID,
+		RequestedBy:    adminID,
+		Status:         accountRecoveryRequestPending,
+		ExpiresAt:      time.Now().Add(accountRecoveryRequestTTL),
+	}
+	if err := s.repo.CreateAccountRecoveryRequest(ctx, request); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("account_recovery_initiated", "Master password reset requested")
+	metadata["request_id"] = request.ID.String()
+	metadata["member_id"] = memberID.String()
+	if err := s.createAuditLog(ctx, "account_recovery.initiated", adminID, orgID, metadata); err != nil {
+		return nil, err
+	}
+
+	return request, nil
+}
+
+// ConfirmPasswordReset re-authenticates the admin, checks the member's escrowed key and
+// sets the new master password. The member's sessions are revoked and the member is notified.
+func (s *accountRecoveryService) ConfirmPasswordReset(ctx context.Context, requestID, adminID uuid.UUID, adminPassword, newPassword string) error {
+	request, err := s.pendingRequest(ctx, requestID, adminID)
+	if err != nil {
+		return err
+	}
+	if err := s.permissions.RequirePermission(ctx, adminID, request.OrganizationID, PermissionManageAccountRecovery); err != nil {
+		return err
+	}
+	// The member's role may have changed since the reset was requested
+	if err := s.requireMemberPermissions(ctx, request.OrganizationID, adminID, request.UserID); err != nil {
+		return err
+	}
+
+	admin, err := s.repo.GetUserByID(ctx, adminID)
+	if err != nil {
+		return err
+	}
+	if admin == nil {
+		return ErrUserNotFound
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(admin.PasswordHash), []byte(adminPassword)); err != nil {
+		return ErrInvalidPassword
+	}
+
+	member, err := confirmedMember(ctx, s.repo, request.OrganizationID, request.UserID)
+	if err != nil {
+		return err
+	}
+	if member.ResetPasswordKey == "" {
+		return ErrNotEnrolledInAccountRecovery
+	}
+	if err := s.keys.VerifyEscrowedUserKey(ctx, request.OrganizationID, request.UserID, member.ResetPasswordKey); err != nil {
+		return err
+	}
+
+	if err := validatePassword(newPassword, DefaultPasswordPolicy); err != nil {
+		return fmt.Errorf("%w: %v", ErrPasswordPolicyViolation, err)
+	}
+	allowed, err := s.policies.EvaluatePolicy(ctx, request.OrganizationID, PolicyMasterPassword, newPassword)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return ErrPasswordPolicyViolation
+	}
+
+	user, err := s.repo.GetUserByID(ctx, request.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	user.PasswordHash = string(hashedPassword)
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteTwoFactorRememberTokensForUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	request.Status = accountRecoveryRequestCompleted
+	request.CompletedAt = &now
+	if err := s.repo.UpdateAccountRecoveryRequest(ctx, request); err != nil {
+		return err
+	}
+
+	if err := s.sessions.RevokeAllUserSessions(ctx, user.ID); err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"Name":           user.Name,
+		"OrganizationID": request.OrganizationID,
+		"ResetAt":        now,
+	}
+	if err := s.email.SendTemplatedEmail(ctx, "account_recovery_password_reset", data, []string{user.Email}); err != nil {
+		log.Printf("Failed to notify user %s of master password reset: %v", user.ID, err)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("account_recovery_password_reset", "Member master password reset by admin")
+	metadata["request_id"] = request.ID.String()
+	metadata["member_id"] = user.ID.String()
+	return s.createAuditLog(ctx, "account_recovery.password_reset", adminID, request.OrganizationID, metadata)
+}
+
+func (s *accountRecoveryService) CancelPasswordReset(ctx context.Context, requestID, adminID uuid.UUID) error {
+	request, err := s.pendingRequest(ctx, requestID, adminID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	request.Status = accountRecoveryRequestCancelled
+	request.CompletedAt = &now
+	if err := s.repo.UpdateAccountRecoveryRequest(ctx, request); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("account_recovery_cancelled", "Master password reset cancelled")
+	metadata["request_id"] = request.ID.String()
+	metadata["member_id"] = request.UserID.String()
+	return s.createAuditLog(ctx, "account_recovery.cancelled", adminID, request.OrganizationID, metadata)
+}
+
+// pendingRequest loads a request that the admin may still confirm or cancel
+// requireMemberPermissions returns ErrUnauthorized if the member holds any permission the
+// admin lacks. Taking over the member's account would otherwise hand the admin those
+// permissions.
+func (s *accountRecoveryService) requireMemberPermissions(ctx context.Context, orgID, adminID, memberID uuid.UUID) error {
+	permissions, err := s.repo.ListMemberPermissions(ctx, orgID, memberID)
+	if err != nil {
+		return err
+	}
+	return s.permissions.RequirePermission(ctx, adminID, orgID, permissions...)
+}
+
+func (s *accountRecoveryService) pendingRequest(ctx context.Context, requestID, adminID uuid.UUID) (*models.AccountRecoveryRequest, error) {
+	request, err := s.repo.GetAccountRecoveryRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request == nil || request.RequestedBy != adminID {
+		return nil, ErrRecoveryRequestNotFound
+	}
+	if request.Status != accountRecoveryRequestPending {
+		return nil, ErrInvalidOperation
+	}
+	if time.Now().After(request.ExpiresAt) {
+		return nil, ErrRecoveryRequestExpired
+	}
+	return request, nil
+}
@@ -95,6 +95,8 @@ func (s *apiService) RevokeAPIKey(ctx context.Context, keyID uuid.UUID) error {
 	return s.repo.DeleteAPIKey(ctx, keyID)
 }
 
+// ValidateAPIKey does not check DPoP proofs: API keys are not served by any route yet,
+// and require_dpop covers sessions only
 func (s *apiService) ValidateAPIKey(ctx context.Context, key string) (*models.APIKey, error) {
 	apiKey, err := s.repo.GetAPIKeyByKey(ctx, key)
 	if err != nil {
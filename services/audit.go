@@ -48,7 +48,7 @@ func (s *service) createAuditLog(ctx context.Context, eventType AuditEventType,
 
 func (s *service) GetAuditLogs(ctx context.Context, userID, orgID uuid.UUID, limit, offset int) ([]models.AuditLog, error) {
 	// Verify user has permission to view audit logs
-	hasAccess, err := s.hasPermission(ctx, userID, orgID, "view_audit_logs")
+	hasAccess, err := s.hasPermission(ctx, userID, orgID, PermissionViewAuditLogs)
 	if err != nil {
 		return nil, err
 	}
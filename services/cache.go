@@ -122,6 +122,17 @@ func (s *cacheService) GetOrSet(ctx context.Context, key string, fn func() (inte
 	return value, nil
 }
 
+// decodeCachedValue converts a value read from the cache into target. Values read back
+// from Redis are decoded generically rather than into the type that was stored, so they
+// are converted through JSON.
+func decodeCachedValue(value, target interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, target)
+}
+
 // Helper functions for generating cache keys
 func generateUserCacheKey(userID uuid.UUID) string {
 	return fmt.Sprintf("user:%s", userID.String())
@@ -138,3 +149,7 @@ func generateVaultItemCacheKey(itemID uuid.UUID) string {
 func generateCollectionCacheKey(collectionID uuid.UUID) string {
 	return fmt.Sprintf("collection:%s", collectionID.String())
 }
+
+func generateSessionCacheKey(tokenHash string) string {
+	return fmt.Sprintf("session:%s", tokenHash)
+}
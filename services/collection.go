@@ -3,6 +3,7 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
@@ -15,19 +16,23 @@ type CollectionService interface {
 	DeleteCollection(ctx context.Context, collectionID uuid.UUID) error
 	GetCollection(ctx context.Context, collectionID uuid.UUID) (*models.Collection, error)
 	ListCollections(ctx context.Context, orgID uuid.UUID) ([]models.Collection, error)
-	AddUserToCollection(ctx context.Context, collectionID, userID uuid.UUID, readOnly bool) error
+	AddUserToCollection(ctx context.Context, collectionID, userID uuid.UUID, access CollectionAccess) error
 	RemoveUserFromCollection(ctx context.Context, collectionID, userID uuid.UUID) error
 }
 
 type collectionService struct {
 	repo repository.Repository
 	roleService RoleService
+	push NotificationHub
 }
 
-func NewCollectionService(repo repository.Repository, roleService RoleService) CollectionService {
+// NewCollectionService creates the collection service. push may be nil, in which case
+// connected clients are not told about changes.
+func NewCollectionService(repo repository.Repository, roleService RoleService, push NotificationHub) CollectionService {
 	return &collectionService{
 		repo: repo,
 		roleService: roleService,
+		push: push,
 	}
 }
 
@@ -51,6 +56,7 @@ func (s *collectionService) CreateCollection(ctx context.Context, orgID uuid.UUI
 		return nil, err
 	}
 
+	pushSync(ctx, s.push, collectionPushTarget(orgID, collection.ID), PushSyncCollection, collection.ID, orgID)
 	return collection, nil
 }
 
@@ -64,7 +70,12 @@ func (s *collectionService) UpdateCollection(ctx context.Context, collection *mo
 		return err
 	}
 
-	return s.repo.UpdateCollection(ctx, collection)
+	if err := s.repo.UpdateCollection(ctx, collection); err != nil {
+		return err
+	}
+
+	pushSync(ctx, s.push, collectionPushTarget(collection.OrganizationID, collection.ID), PushSyncCollection, collection.ID, collection.OrganizationID)
+	return nil
 }
 
 func (s *collectionService) DeleteCollection(ctx context.Context, collectionID uuid.UUID) error {
@@ -80,7 +91,14 @@ func (s *collectionService) DeleteCollection(ctx context.Context, collectionID u
 		return err
 	}
 
-	return s.repo.DeleteCollection(ctx, collectionID)
+	if err := s.repo.DeleteCollection(ctx, collectionID); err != nil {
+		return err
+	}
+
+	// The grants are gone with the collection, so members are asked to sync the
+	// organization without learning which collection went
+	pushSync(ctx, s.push, PushTarget{OrganizationID: collection.OrganizationID}, PushSyncOrganization, uuid.Nil, collection.OrganizationID)
+	return nil
 }
 
 func (s *collectionService) GetCollection(ctx context.Context, collectionID uuid.UUID) (*models.Collection, error) {
@@ -91,7 +109,11 @@ func (s *collectionService) ListCollections(ctx context.Context, orgID uuid.UUID
 	return s.repo.ListCollections(ctx, orgID)
 }
 
-func (s *collectionService) AddUserToCollection(ctx context.Context, collectionID, userID uuid.UUID, readOnly bool) error {
+func (s *collectionService) AddUserToCollection(ctx context.Context, collectionID, userID uuid.UUID, access CollectionAccess) error {
+	if !access.Valid() {
+		return fmt.Errorf("%w: unknown collection access %q", ErrInvalidOperation, access)
+	}
+
 	collection, err := s.GetCollection(ctx, collectionID)
 	if err != nil {
 		return err
@@ -100,12 +122,17 @@ func (s *collectionService) AddUserToCollection(ctx context.Context, collectionI
 	// Create audit log
 	metadata := createBasicMetadata("user_added_to_collection", "User added to collection")
 	metadata["collection_name"] = collection.Name
-	metadata["read_only"] = readOnly
+	metadata["access"] = string(access)
 	if err := s.createAuditLog(ctx, "collection.user.added", userID, collection.OrganizationID, metadata); err != nil {
 		return err
 	}
 
-	return s.repo.AddCollectionUser(ctx, collectionID, userID, readOnly)
+	if err := s.repo.AddCollectionUser(ctx, collectionID, userID, string(access)); err != nil {
+		return err
+	}
+
+	pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncCollection, collectionID, collection.OrganizationID)
+	return nil
 }
 
 func (s *collectionService) RemoveUserFromCollection(ctx context.Context, collectionID, userID uuid.UUID) error {
@@ -121,5 +148,10 @@ func (s *collectionService) RemoveUserFromCollection(ctx context.Context, collec
 		return err
 	}
 
-	return s.repo.RemoveCollectionUser(ctx, collectionID, userID)
+	if err := s.repo.RemoveCollectionUser(ctx, collectionID, userID); err != nil {
+		return err
+	}
+
+	pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncCollection, collectionID, collection.OrganizationID)
+	return nil
 }
@@ -0,0 +1,94 @@
+package services
+
+import (
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+// CollectionAccess is the level of access a grant gives to a collection's items
+type CollectionAccess string
+
+const (
+	// CollectionAccessView allows reading the items
+	CollectionAccessView CollectionAccess = "view"
+	// CollectionAccessViewExceptPasswords allows reading and autofilling the items; their
+	// passwords are never returned
+	CollectionAccessViewExceptPasswords CollectionAccess = "view_except_passwords"
+	// CollectionAccessEdit allows reading and changing the items
+	CollectionAccessEdit CollectionAccess = "edit"
+	// CollectionAccessEditExceptPasswords allows changing the items without seeing their
+	// passwords
+	CollectionAccessEditExceptPasswords CollectionAccess = "edit_except_passwords"
+	// CollectionAccessManage allows changing the items and who has access to the collection
+	CollectionAccessManage CollectionAccess = "manage"
+)
+
+// Valid reports whether the access is one of the defined levels
+func (a CollectionAccess) Valid() bool {
+	switch a {
+	case CollectionAccessView, CollectionAccessViewExceptPasswords, CollectionAccessEdit,
+		CollectionAccessEditExceptPasswords, CollectionAccessManage:
+		return true
+	}
+	return false
+}
+
+// CanEdit reports whether the access allows changing the collection's items
+func (a CollectionAccess) CanEdit() bool {
+	return a == CollectionAccessEdit || a == CollectionAccessEditExceptPasswords || a == CollectionAccessManage
+}
+
+// CanManage reports whether the access allows granting others access to the collection
+func (a CollectionAccess) CanManage() bool {
+	return a == CollectionAccessManage
+}
+
+// HidesPasswords reports whether item passwords must be withheld
+func (a CollectionAccess) HidesPasswords() bool {
+	return a == CollectionAccessViewExceptPasswords || a == CollectionAccessEditExceptPasswords
+}
+
+// MergeCollectionAccess combines two grants to the same collection into the access
+// either of them allows. Passwords stay hidden only if both grants hide them.
+func MergeCollectionAccess(a, b CollectionAccess) CollectionAccess {
+	if a == "" {
+		return b
+	}
+	if b == "" {
+		return a
+	}
+	switch {
+	case a.CanManage() || b.CanManage():
+		return CollectionAccessManage
+	case a.HidesPasswords() && b.HidesPasswords():
+		if a.CanEdit() || b.CanEdit() {
+			return CollectionAccessEditExceptPasswords
+		}
+		return CollectionAccessViewExceptPasswords
+	case a.CanEdit() || b.CanEdit():
+		return CollectionAccessEdit
+	default:
+		return CollectionAccessView
+	}
+}
+
+// RestrictVaultItems returns the organization items a member may see given their access
+// to each collection. Items outside any collection or in a collection the member has no
+// access to are left out, and passwords are withheld where the access hides them.
+func RestrictVaultItems(items []models.VaultItem, access map[uuid.UUID]CollectionAccess) []models.VaultItem {
+	restricted := make([]models.VaultItem, 0, len(items))
+	for _, item := range items {
+		if item.CollectionID == nil {
+			continue
+		}
+		level, ok := access[*item.CollectionID]
+		if !ok {
+			continue
+		}
+		if level.HidesPasswords() {
+			item.EncryptedPassword = ""
+		}
+		restricted = append(restricted, item)
+	}
+	return restricted
+}
@@ -2,9 +2,11 @@ package services
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
 	"github.com/google/uuid"
 )
 
@@ -25,34 +27,90 @@ type DeviceService interface {
 	AuthorizeDevice(ctx context.Context, deviceID uuid.UUID) error
 	BlockDevice(ctx context.Context, deviceID uuid.UUID) error
 	ValidateDeviceAccess(ctx context.Context, deviceID uuid.UUID) error
+
+	// Device approval
+	CheckLoginDevice(ctx context.Context, userID, deviceID uuid.UUID, deviceInfo string) (*models.Device, error)
+	ReviewDevice(ctx context.Context, userID, approverDeviceID, deviceID uuid.UUID, approve bool) error
+	ListPendingDevices(ctx context.Context, orgID, adminID uuid.UUID) ([]PendingDevice, error)
+	ReviewMemberDevice(ctx context.Context, orgID, adminID, deviceID uuid.UUID, approve bool) error
+	RegisterDeviceKey(ctx context.Context, userID, sessionDeviceID, deviceID uuid.UUID) error
+
+	// Login approval from an authorized device
+	CreateAuthRequest(ctx context.Context, email, publicKey, fingerprint string, deviceID uuid.UUID, deviceName string, deviceType DeviceType) (*CreatedAuthRequest, error)
+	ListPendingAuthRequests(ctx context.Context, userID uuid.UUID) ([]AuthRequestInfo, error)
+	RespondToAuthRequest(ctx context.Context, userID, requestID, deviceID uuid.UUID, approve bool, encryptedUserKey string) error
+	GetAuthRequestStatus(ctx context.Context, requestID uuid.UUID, accessCode string) (*AuthRequestInfo, error)
+	CompleteAuthRequest(ctx context.Context, requestID uuid.UUID, accessCode string) (*AuthRequestLoginResult, error)
 }
 
 type deviceService struct {
-	repo        repository.Repository
-	audit       AuditService
-	policy      PolicyService
+	repo          repository.Repository
+	audit         AuditService
+	policy        PolicyService
+	notifications NotificationService
+	permissions   PermissionResolver
+	sessionCache  CacheService
+	push          NotificationHub
 }
 
+// NewDeviceService creates the device service. sessionCache is the cache the session
+// service keeps sessions in, or nil; sessions of a blocked or removed device are
+// evicted from it. push may be nil; when set, connections from a blocked or removed
+// device are told to log out.
 func NewDeviceService(
 	repo repository.Repository,
 	audit AuditService,
 	policy PolicyService,
+	notifications NotificationService,
+	permissions PermissionResolver,
+	sessionCache CacheService,
+	push NotificationHub,
 ) DeviceService {
 	return &deviceService{
-		repo:   repo,
-		audit:  audit,
-		policy: policy,
+		repo:          repo,
+		audit:         audit,
+		policy:        policy,
+		notifications: notifications,
+		permissions:   permissions,
+		sessionCache:  sessionCache,
+		push:          push,
 	}
 }
 
 func (s *deviceService) RegisterDevice(ctx context.Context, userID uuid.UUID, device models.Device) error {
+	return s.registerDevice(ctx, userID, &device)
+}
+
+// registerDevice stores a new device of the user. It is authorized right away unless
+// an organization of the user requires device approval, in which case it stays pending
+// and the user and the organization's approvers are asked to review it. A DPoP proof sent
+// with the request registers its key as the device key, to be approved with the device.
+func (s *deviceService) registerDevice(ctx context.Context, userID uuid.UUID, device *models.Device) error {
+	orgIDs, adminOnly, err := s.deviceApproval(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
 	device.ID = uuid.New()
 	device.UserID = userID
-	device.Status = "pending"
-	device.CreatedAt = time.Now()
-	device.UpdatedAt = time.Now()
+	device.Status = "authorized"
+	device.AuthorizedAt = &now
+	if len(orgIDs) > 0 {
+		device.Status = "pending"
+		device.AuthorizedAt = nil
+	}
+	if device.LastIP == "" {
+		device.LastIP = ClientIPFromContext(ctx)
+	}
+	if proof := DPoPProofFromContext(ctx); proof != nil {
+		device.PublicKey = string(proof.PublicKey)
+		device.KeyThumbprint = proof.Thumbprint
+	}
+	device.CreatedAt = now
+	device.UpdatedAt = now
 
-	if err := s.repo.CreateDevice(ctx, &device); err != nil {
+	if err := s.repo.CreateDevice(ctx, device); err != nil {
 		return err
 	}
 
@@ -60,10 +118,14 @@ func (s *deviceService) RegisterDevice(ctx context.Context, userID uuid.UUID, de
 	metadata := createBasicMetadata("device_registered", "Device registration requested")
 	metadata["device_type"] = string(device.Type)
 	metadata["device_name"] = device.Name
+	metadata["status"] = device.Status
 	if err := s.createAuditLog(ctx, "device.registered", userID, uuid.Nil, metadata); err != nil {
 		return err
 	}
 
+	if device.Status == "pending" {
+		s.requestDeviceApproval(ctx, device, orgIDs, adminOnly)
+	}
 	return nil
 }
 
@@ -73,6 +135,9 @@ func (s *deviceService) DeregisterDevice(ctx context.Context, deviceID uuid.UUID
 		return err
 	}
 
+	if err := s.signOutDevice(ctx, device); err != nil {
+		return err
+	}
 	if err := s.repo.DeleteDevice(ctx, deviceID); err != nil {
 		return err
 	}
@@ -88,6 +153,20 @@ func (s *deviceService) DeregisterDevice(ctx context.Context, deviceID uuid.UUID
 	return nil
 }
 
+// signOutDevice revokes the device's sessions, evicts them from the session cache and
+// tells its connections to log out
+func (s *deviceService) signOutDevice(ctx context.Context, device *models.Device) error {
+	tokenHashes, err := s.repo.RevokeDeviceSessions(ctx, device.ID)
+	if err != nil {
+		return err
+	}
+	for _, tokenHash := range tokenHashes {
+		evictCachedSession(ctx, s.sessionCache, tokenHash)
+	}
+	pushSync(ctx, s.push, PushTarget{UserID: device.UserID, DeviceID: device.ID}, PushLogout, uuid.Nil, uuid.Nil)
+	return nil
+}
+
 func (s *deviceService) GetDevice(ctx context.Context, deviceID uuid.UUID) (*models.Device, error) {
 	return s.repo.GetDevice(ctx, deviceID)
 }
@@ -137,6 +216,15 @@ func (s *deviceService) BlockDevice(ctx context.Context, deviceID uuid.UUID) err
 		return err
 	}
 
+	// A blocked device is signed out and must pass two-factor authentication again if it
+	// is unblocked
+	if err := s.signOutDevice(ctx, device); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteTwoFactorRememberTokensForDevice(ctx, device.ID); err != nil {
+		return err
+	}
+
 	// Create audit log
 	metadata := createBasicMetadata("device_blocked", "Device blocked")
 	metadata["device_type"] = string(device.Type)
@@ -0,0 +1,420 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrDevicePendingApproval = errors.New("device is waiting for approval")
+	ErrDeviceBlocked         = errors.New("device is blocked")
+	ErrDeviceNotFound        = errors.New("device not found")
+	ErrDeviceNotPending      = errors.New("device is not waiting for approval")
+	ErrDeviceKeyRegistered   = errors.New("device already has a key")
+)
+
+// maxDeviceNameLength is the size of the device name column
+const maxDeviceNameLength = 255
+
+// DevicePendingError is returned when a login comes from a device that must be approved
+// first. It wraps ErrDevicePendingApproval and identifies the device, so the client can
+// sign in with the same device ID once it has been approved.
+type DevicePendingError struct {
+	DeviceID uuid.UUID
+}
+
+func (e *DevicePendingError) Error() string {
+	return ErrDevicePendingApproval.Error()
+}
+
+func (e *DevicePendingError) Unwrap() error {
+	return ErrDevicePendingApproval
+}
+
+// PendingDevice is a device in an organization's approval queue
+type PendingDevice struct {
+	ID        uuid.UUID `json:"id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Email     string    `json:"email"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	LastIP    string    `json:"last_ip,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CheckLoginDevice decides whether a login from the device may start a session and
+// returns the device the session belongs to, or nil. Blocked devices are always
+// refused. When an organization of the user requires device approval, pending devices
+// are refused, and a login that names no device of the user registers a pending device
+// from its user agent and asks for it to be approved. Once the device has a key, logins
+// from it must come with a DPoP proof signed by that key.
+func (s *deviceService) CheckLoginDevice(ctx context.Context, userID, deviceID uuid.UUID, deviceInfo string) (*models.Device, error) {
+	orgIDs, _, err := s.deviceApproval(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	required := len(orgIDs) > 0
+
+	var device *models.Device
+	if deviceID != uuid.Nil {
+		device, err = s.GetDevice(ctx, deviceID)
+		if err != nil {
+			return nil, err
+		}
+		if device != nil && device.UserID != userID {
+			device = nil
+		}
+	}
+
+	if device == nil {
+		if !required {
+			return nil, nil
+		}
+		device = &models.Device{
+			Name: truncateDeviceName(deviceInfo),
+			Type: string(sessionClientType(deviceInfo)),
+		}
+		if device.Name == "" {
+			device.Name = "Unknown device"
+		}
+		if device.Type == "" {
+			device.Type = string(DeviceBrowser)
+		}
+		if err := s.registerDevice(ctx, userID, device); err != nil {
+			return nil, err
+		}
+		return nil, &DevicePendingError{DeviceID: device.ID}
+	}
+
+	switch {
+	case device.Status == "blocked":
+		return nil, ErrDeviceBlocked
+	case device.Status == "pending" && required:
+		return nil, &DevicePendingError{DeviceID: device.ID}
+	}
+	if err := checkDeviceKey(ctx, device); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	device.LastSeenAt = &now
+	if ip := ClientIPFromContext(ctx); ip != "" {
+		device.LastIP = ip
+	}
+	device.UpdatedAt = now
+	if err := s.repo.UpdateDevice(ctx, device); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// checkDeviceKey checks the DPoP proof sent with a login against the key registered for
+// the device. A proof never registers a key by itself: devices get their key when they
+// are registered or through RegisterDeviceKey.
+func checkDeviceKey(ctx context.Context, device *models.Device) error {
+	if device.KeyThumbprint == "" {
+		return nil
+	}
+	proof := DPoPProofFromContext(ctx)
+	if proof == nil {
+		return ErrDPoPProofRequired
+	}
+	if proof.Thumbprint != device.KeyThumbprint {
+		return fmt.Errorf("%w: proof is not signed by the device key", ErrInvalidDPoPProof)
+	}
+	return nil
+}
+
+// RegisterDeviceKey registers the key of the DPoP proof sent with the request for an
+// authorized device registered without one. The request must come from a session on
+// that device, and a device's key cannot be replaced.
+func (s *deviceService) RegisterDeviceKey(ctx context.Context, userID, sessionDeviceID, deviceID uuid.UUID) error {
+	if sessionDeviceID != deviceID {
+		return fmt.Errorf("%w: a device can only register its own key", ErrUnauthorized)
+	}
+	proof := DPoPProofFromContext(ctx)
+	if proof == nil {
+		return ErrDPoPProofRequired
+	}
+
+	device, err := s.GetDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil || device.UserID != userID || device.Status != "authorized" {
+		return ErrDeviceNotFound
+	}
+	registered, err := s.repo.SetDeviceKey(ctx, device.ID, string(proof.PublicKey), proof.Thumbprint)
+	if err != nil {
+		return err
+	}
+	if !registered {
+		return ErrDeviceKeyRegistered
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("device_key_registered", "Device key registered")
+	metadata["device_id"] = device.ID.String()
+	metadata["device_name"] = device.Name
+	metadata["key_thumbprint"] = proof.Thumbprint
+	return s.createAuditLog(ctx, "device.key_registered", userID, uuid.Nil, metadata)
+}
+
+// ReviewDevice lets the user approve or deny one of their pending devices from an
+// authorized device, unless one of their organizations only lets admins approve devices
+func (s *deviceService) ReviewDevice(ctx context.Context, userID, approverDeviceID, deviceID uuid.UUID, approve bool) error {
+	approver, err := s.GetDevice(ctx, approverDeviceID)
+	if err != nil {
+		return err
+	}
+	if approver == nil || approver.UserID != userID || approver.Status != "authorized" {
+		return fmt.Errorf("%w: only an authorized device can approve devices", ErrUnauthorized)
+	}
+
+	_, adminOnly, err := s.deviceApproval(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if adminOnly {
+		return fmt.Errorf("%w: new devices must be approved by an admin", ErrUnauthorized)
+	}
+
+	device, err := s.GetDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil || device.UserID != userID {
+		return ErrDeviceNotFound
+	}
+	if err := s.reviewDevice(ctx, device, approve); err != nil {
+		return err
+	}
+
+	// Create audit log
+	event, action, detail := "device.denied", "device_denied", "Device denied from an authorized device"
+	if approve {
+		event, action, detail = "device.approved", "device_approved", "Device approved from an authorized device"
+	}
+	metadata := createBasicMetadata(action, detail)
+	metadata["device_id"] = device.ID.String()
+	metadata["device_name"] = device.Name
+	metadata["approver_device_id"] = approver.ID.String()
+	return s.createAuditLog(ctx, event, userID, uuid.Nil, metadata)
+}
+
+// ListPendingDevices returns the organization's approval queue to an admin with the
+// approve_devices permission
+func (s *deviceService) ListPendingDevices(ctx context.Context, orgID, adminID uuid.UUID) ([]PendingDevice, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionApproveDevices); err != nil {
+		return nil, err
+	}
+
+	devices, err := s.repo.ListPendingOrganizationDevices(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+
+	emails := make(map[uuid.UUID]string)
+	pending := make([]PendingDevice, 0, len(devices))
+	for _, device := range devices {
+		email, ok := emails[device.UserID]
+		if !ok {
+			user, err := s.repo.GetUserByID(ctx, device.UserID)
+			if err != nil {
+				return nil, err
+			}
+			if user != nil {
+				email = user.Email
+			}
+			emails[device.UserID] = email
+		}
+		pending = append(pending, PendingDevice{
+			ID:        device.ID,
+			UserID:    device.UserID,
+			Email:     email,
+			Name:      device.Name,
+			Type:      device.Type,
+			LastIP:    device.LastIP,
+			CreatedAt: device.CreatedAt,
+		})
+	}
+	return pending, nil
+}
+
+// ReviewMemberDevice lets an admin with the approve_devices permission approve or deny
+// a pending device of a member
+func (s *deviceService) ReviewMemberDevice(ctx context.Context, orgID, adminID, deviceID uuid.UUID, approve bool) error {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionApproveDevices); err != nil {
+		return err
+	}
+
+	device, err := s.GetDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil {
+		return ErrDeviceNotFound
+	}
+	member, err := s.repo.GetOrganizationUser(ctx, orgID, device.UserID)
+	if err != nil {
+		return err
+	}
+	if member == nil || member.Status != organizationMemberStatusConfirmed {
+		return ErrDeviceNotFound
+	}
+	if err := s.reviewDevice(ctx, device, approve); err != nil {
+		return err
+	}
+
+	// Create audit log
+	event, action, detail := "organization.device_denied", "member_device_denied", "Member device denied by admin"
+	if approve {
+		event, action, detail = "organization.device_approved", "member_device_approved", "Member device approved by admin"
+	}
+	metadata := createBasicMetadata(action, detail)
+	metadata["device_id"] = device.ID.String()
+	metadata["device_name"] = device.Name
+	metadata["member_id"] = device.UserID.String()
+	return s.createAuditLog(ctx, event, adminID, orgID, metadata)
+}
+
+// reviewDevice authorizes or blocks a pending device and tells its owner. Only the first
+// decision counts.
+func (s *deviceService) reviewDevice(ctx context.Context, device *models.Device, approve bool) error {
+	if device.Status != "pending" {
+		return ErrDeviceNotPending
+	}
+
+	now := time.Now()
+	if approve {
+		device.Status = "authorized"
+		device.AuthorizedAt = &now
+	} else {
+		device.Status = "blocked"
+		device.BlockedAt = &now
+	}
+	reviewed, err := s.repo.ReviewPendingDevice(ctx, device)
+	if err != nil {
+		return err
+	}
+	if !reviewed {
+		return ErrDeviceNotPending
+	}
+	if !approve {
+		if err := s.repo.DeleteTwoFactorRememberTokensForDevice(ctx, device.ID); err != nil {
+			return err
+		}
+	}
+
+	message := fmt.Sprintf("Your device %s was approved.", device.Name)
+	notificationType := NotificationTypeInfo
+	if !approve {
+		message = fmt.Sprintf("Your device %s was denied and can no longer sign in.", device.Name)
+		notificationType = NotificationTypeWarning
+	}
+	if err := s.notifications.CreateNotification(ctx, device.UserID, notificationType, message, map[string]interface{}{
+		"device_id":   device.ID.String(),
+		"device_name": device.Name,
+		"status":      device.Status,
+	}); err != nil {
+		log.Printf("Failed to notify user %s of device %s review: %v", device.UserID, device.ID, err)
+	}
+	return nil
+}
+
+// deviceApproval returns the organizations of the user that require device approval
+// and whether any of them only lets admins approve devices
+func (s *deviceService) deviceApproval(ctx context.Context, userID uuid.UUID) ([]uuid.UUID, bool, error) {
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var orgIDs []uuid.UUID
+	adminOnly := false
+	for _, member := range memberships {
+		if member.Status != organizationMemberStatusConfirmed {
+			continue
+		}
+		policy, err := s.policy.GetDeviceApprovalPolicy(ctx, member.OrganizationID)
+		if err != nil {
+			return nil, false, err
+		}
+		if policy == nil {
+			continue
+		}
+		orgIDs = append(orgIDs, member.OrganizationID)
+		adminOnly = adminOnly || policy.AdminApprovalOnly
+	}
+	return orgIDs, adminOnly, nil
+}
+
+// requestDeviceApproval tells the user and the admins who can approve devices in the
+// organizations requiring approval that a device is waiting
+func (s *deviceService) requestDeviceApproval(ctx context.Context, device *models.Device, orgIDs []uuid.UUID, adminOnly bool) {
+	metadata := map[string]interface{}{
+		"device_id":   device.ID.String(),
+		"device_name": device.Name,
+		"device_type": device.Type,
+		"ip":          device.LastIP,
+	}
+
+	message := fmt.Sprintf("New device %s is waiting for approval. Approve it from a device you already use.", device.Name)
+	if adminOnly {
+		message = fmt.Sprintf("New device %s is waiting for approval by an administrator.", device.Name)
+	}
+	if err := s.notifications.CreateNotification(ctx, device.UserID, NotificationTypeWarning, message, metadata); err != nil {
+		log.Printf("Failed to notify user %s of pending device %s: %v", device.UserID, device.ID, err)
+	}
+
+	user, err := s.repo.GetUserByID(ctx, device.UserID)
+	if err != nil || user == nil {
+		log.Printf("Failed to load user %s to request approval of device %s: %v", device.UserID, device.ID, err)
+		return
+	}
+	notified := make(map[uuid.UUID]bool)
+	for _, orgID := range orgIDs {
+		admins, err := s.deviceApprovers(ctx, orgID)
+		if err != nil {
+			log.Printf("Failed to list device approvers of organization %s: %v", orgID, err)
+			continue
+		}
+		for _, adminID := range admins {
+			if notified[adminID] || adminID == device.UserID {
+				continue
+			}
+			notified[adminID] = true
+			message := fmt.Sprintf("Device %s of %s is waiting for approval.", device.Name, user.Email)
+			adminMetadata := map[string]interface{}{
+				"organization_id": orgID.String(),
+				"member_id":       device.UserID.String(),
+			}
+			for k, v := range metadata {
+				adminMetadata[k] = v
+			}
+			if err := s.notifications.CreateNotification(ctx, adminID, NotificationTypeInfo, message, adminMetadata); err != nil {
+				log.Printf("Failed to notify admin %s of pending device %s: %v", adminID, device.ID, err)
+			}
+		}
+	}
+}
+
+// deviceApprovers returns the confirmed members of the organization whose roles, held
+// directly or through a group, have the approve_devices permission
+func (s *deviceService) deviceApprovers(ctx context.Context, orgID uuid.UUID) ([]uuid.UUID, error) {
+	return s.repo.ListMembersWithPermission(ctx, orgID, PermissionApproveDevices)
+}
+
+func truncateDeviceName(name string) string {
+	runes := []rune(name)
+	if len(runes) > maxDeviceNameLength {
+		return string(runes[:maxDeviceNameLength])
+	}
+	return name
+}
@@ -0,0 +1,460 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrAuthRequestNotFound    = errors.New("auth request not found")
+	ErrAuthRequestExpired     = errors.New("auth request has expired")
+	ErrAuthRequestAnswered    = errors.New("auth request has already been answered")
+	ErrAuthRequestUnavailable = errors.New("login approval is not available for this account")
+	ErrInvalidAuthRequest     = errors.New("invalid auth request")
+)
+
+const (
+	// authRequestTTL is how long a request can be approved and then used to sign in
+	authRequestTTL = 5 * time.Minute
+	// authRequestFingerprintWords is the length of the fingerprint phrase
+	authRequestFingerprintWords = 5
+
+	authRequestStatusPending  = "pending"
+	authRequestStatusApproved = "approved"
+	authRequestStatusDenied   = "denied"
+	authRequestStatusExpired  = "expired"
+)
+
+// AuthRequestInfo describes a login request without its access code or response
+type AuthRequestInfo struct {
+	ID          uuid.UUID  `json:"id"`
+	PublicKey   string     `json:"public_key"`
+	Fingerprint string     `json:"fingerprint"`
+	DeviceName  string     `json:"device_name,omitempty"`
+	DeviceType  string     `json:"device_type,omitempty"`
+	RequestIP   string     `json:"request_ip,omitempty"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	RespondedAt *time.Time `json:"responded_at,omitempty"`
+}
+
+// CreatedAuthRequest is returned to the requesting device. The access code is shown
+// once and is needed to poll the request and sign in with it.
+type CreatedAuthRequest struct {
+	ID          uuid.UUID `json:"id"`
+	AccessCode  string    `json:"access_code"`
+	Fingerprint string    `json:"fingerprint"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// AuthRequestLoginResult is the outcome of signing in with an approved request.
+// EncryptedUserKey is the user key sealed to the request's public key.
+type AuthRequestLoginResult struct {
+	User             *models.User `json:"-"`
+	DeviceID         uuid.UUID    `json:"-"`
+	EncryptedUserKey string       `json:"encrypted_user_key"`
+}
+
+// CreateAuthRequest starts a login that one of the user's authorized devices approves.
+// publicKey is the base64 X25519 public key of a key pair the requesting device made
+// for this request, and fingerprint the phrase it shows, which must equal
+// AuthRequestFingerprint. deviceID is the requesting device if it is already registered;
+// approving the request then also approves the device if it is pending. The user's
+// devices are notified.
+func (s *deviceService) CreateAuthRequest(ctx context.Context, email, publicKey, fingerprint string, deviceID uuid.UUID, deviceName string, deviceType DeviceType) (*CreatedAuthRequest, error) {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: public key is not base64", ErrInvalidAuthRequest)
+	}
+	if _, err := ecdh.X25519().NewPublicKey(key); err != nil {
+		return nil, fmt.Errorf("%w: public key is not an X25519 key", ErrInvalidAuthRequest)
+	}
+	expected := AuthRequestFingerprint(email, key)
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(strings.TrimSpace(fingerprint))), []byte(expected)) != 1 {
+		return nil, fmt.Errorf("%w: fingerprint does not match the public key", ErrInvalidAuthRequest)
+	}
+
+	// Unknown accounts and accounts without a device to approve look the same
+	user, err := s.repo.GetUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrAuthRequestUnavailable
+	}
+	devices, err := s.repo.ListDevices(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	approvers := 0
+	var requestDeviceID *uuid.UUID
+	for i := range devices {
+		if devices[i].Status == "authorized" {
+			approvers++
+		}
+		if devices[i].ID == deviceID {
+			requestDeviceID = &devices[i].ID
+		}
+	}
+	if approvers == 0 {
+		return nil, ErrAuthRequestUnavailable
+	}
+
+	accessCode := make([]byte, 32)
+	if _, err := rand.Read(accessCode); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	request := &models.AuthRequest{
+		Base:           models.Base{ID: uuid.New(), CreatedAt: now, UpdatedAt: now},
+		UserID:         user.ID,
+		PublicKey:      publicKey,
+		Fingerprint:    expected,
+		AccessCodeHash: hashAuthRequestAccessCode(hex.EncodeToString(accessCode)),
+		DeviceID:       requestDeviceID,
+		DeviceName:     deviceName,
+		DeviceType:     string(deviceType),
+		RequestIP:      ClientIPFromContext(ctx),
+		Status:         authRequestStatusPending,
+		ExpiresAt:      now.Add(authRequestTTL),
+	}
+	if err := s.repo.CreateAuthRequest(ctx, request); err != nil {
+		return nil, err
+	}
+
+	// Requests are kept for a while after they expire so the requesting device can
+	// still learn what happened
+	if err := s.repo.DeleteExpiredAuthRequests(ctx, now.Add(-authRequestTTL)); err != nil {
+		log.Printf("Failed to delete expired auth requests: %v", err)
+	}
+
+	message := fmt.Sprintf("Login request from %s. Check that the fingerprint phrase is %s.", authRequestDeviceLabel(request), expected)
+	if err := s.notifications.CreateNotification(ctx, user.ID, NotificationTypeInfo, message, map[string]interface{}{
+		"auth_request_id": request.ID.String(),
+		"fingerprint":     expected,
+		"device_name":     deviceName,
+		"device_type":     string(deviceType),
+		"ip":              request.RequestIP,
+	}); err != nil {
+		log.Printf("Failed to notify user %s of auth request %s: %v", user.ID, request.ID, err)
+	}
+
+	return &CreatedAuthRequest{
+		ID:          request.ID,
+		AccessCode:  hex.EncodeToString(accessCode),
+		Fingerprint: expected,
+		ExpiresAt:   request.ExpiresAt,
+	}, nil
+}
+
+// ListPendingAuthRequests returns the user's requests that are waiting for an answer
+func (s *deviceService) ListPendingAuthRequests(ctx context.Context, userID uuid.UUID) ([]AuthRequestInfo, error) {
+	requests, err := s.repo.ListPendingAuthRequests(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]AuthRequestInfo, 0, len(requests))
+	for i := range requests {
+		infos = append(infos, authRequestInfo(&requests[i]))
+	}
+	return infos, nil
+}
+
+// RespondToAuthRequest approves or denies a request from one of the user's authorized
+// devices. An approval carries the user key sealed with HPKE to the request's public
+// key, with the request ID as additional data.
+func (s *deviceService) RespondToAuthRequest(ctx context.Context, userID, requestID, deviceID uuid.UUID, approve bool, encryptedUserKey string) error {
+	device, err := s.GetDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil || device.UserID != userID || device.Status != "authorized" {
+		return fmt.Errorf("%w: only an authorized device can answer login requests", ErrUnauthorized)
+	}
+
+	request, err := s.repo.GetAuthRequest(ctx, requestID)
+	if err != nil {
+		return err
+	}
+	if request == nil || request.UserID != userID {
+		return ErrAuthRequestNotFound
+	}
+	if request.Status != authRequestStatusPending {
+		return ErrAuthRequestAnswered
+	}
+	if time.Now().After(request.ExpiresAt) {
+		return ErrAuthRequestExpired
+	}
+
+	now := time.Now()
+	request.ResponseDeviceID = &device.ID
+	request.RespondedAt = &now
+	request.Status = authRequestStatusDenied
+	if approve {
+		sealed, err := base64.StdEncoding.DecodeString(encryptedUserKey)
+		if err != nil || len(sealed) <= hpkeEncLength {
+			return fmt.Errorf("%w: encrypted user key is not a sealed box", ErrInvalidAuthRequest)
+		}
+		request.Status = authRequestStatusApproved
+		request.EncryptedUserKey = encryptedUserKey
+	}
+
+	answered, err := s.repo.RespondToAuthRequest(ctx, request)
+	if err != nil {
+		return err
+	}
+	if !answered {
+		return ErrAuthRequestAnswered
+	}
+
+	// Approving the login from a trusted device also approves the requesting device,
+	// unless only admins may approve devices
+	if approve && request.DeviceID != nil {
+		if err := s.approveRequestDevice(ctx, userID, *request.DeviceID); err != nil {
+			return err
+		}
+	}
+
+	// Create audit log
+	event, action, detail := "device.auth_request_denied", "auth_request_denied", "Login request denied"
+	if approve {
+		event, action, detail = "device.auth_request_approved", "auth_request_approved", "Login request approved"
+	}
+	metadata := createBasicMetadata(action, detail)
+	metadata["auth_request_id"] = request.ID.String()
+	metadata["device_id"] = device.ID.String()
+	metadata["device_name"] = device.Name
+	metadata["request_device_name"] = request.DeviceName
+	metadata["request_ip"] = request.RequestIP
+	if request.DeviceID != nil {
+		metadata["request_device_id"] = request.DeviceID.String()
+	}
+	return s.createAuditLog(ctx, event, userID, uuid.Nil, metadata)
+}
+
+// GetAuthRequestStatus lets the requesting device poll its request
+func (s *deviceService) GetAuthRequestStatus(ctx context.Context, requestID uuid.UUID, accessCode string) (*AuthRequestInfo, error) {
+	request, err := s.getAuthRequestWithCode(ctx, requestID, accessCode)
+	if err != nil {
+		return nil, err
+	}
+	info := authRequestInfo(request)
+	return &info, nil
+}
+
+// CompleteAuthRequest signs the requesting device in with an approved request. Each
+// approval can be used once, before the request expires.
+func (s *deviceService) CompleteAuthRequest(ctx context.Context, requestID uuid.UUID, accessCode string) (*AuthRequestLoginResult, error) {
+	request, err := s.getAuthRequestWithCode(ctx, requestID, accessCode)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().After(request.ExpiresAt) {
+		return nil, ErrAuthRequestExpired
+	}
+	if request.Status != authRequestStatusApproved {
+		return nil, fmt.Errorf("%w: request is %s", ErrUnauthorized, request.Status)
+	}
+
+	consumed, err := s.repo.ConsumeAuthRequest(ctx, request.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !consumed {
+		return nil, ErrAuthRequestAnswered
+	}
+
+	user, err := s.repo.GetUserByID(ctx, request.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("auth_request_login", "Signed in with an approved login request")
+	metadata["auth_request_id"] = request.ID.String()
+	metadata["device_name"] = request.DeviceName
+	metadata["ip"] = request.RequestIP
+	if request.ResponseDeviceID != nil {
+		metadata["approved_by_device_id"] = request.ResponseDeviceID.String()
+	}
+	if err := s.createAuditLog(ctx, "user.auth_request_login", user.ID, uuid.Nil, metadata); err != nil {
+		return nil, err
+	}
+
+	result := &AuthRequestLoginResult{User: user, EncryptedUserKey: request.EncryptedUserKey}
+	if request.DeviceID != nil {
+		result.DeviceID = *request.DeviceID
+	}
+	return result, nil
+}
+
+// loginCheckingDevices is a device service whose approved login requests go through the
+// same lockout and risk checks as password logins
+type loginCheckingDevices struct {
+	DeviceService
+	risk       LoginRiskService
+	protection LoginProtectionService
+}
+
+// NewLoginCheckingDeviceService wraps devices so that CompleteAuthRequest refuses the
+// login while the account is locked or when risk blocks it. Handlers that sign users in
+// with login requests are given the wrapped service; the risk service itself depends on
+// the plain one. A refused login still uses up the approval.
+func NewLoginCheckingDeviceService(devices DeviceService, risk LoginRiskService, protection LoginProtectionService) DeviceService {
+	return &loginCheckingDevices{
+		DeviceService: devices,
+		risk:          risk,
+		protection:    protection,
+	}
+}
+
+func (s *loginCheckingDevices) CompleteAuthRequest(ctx context.Context, requestID uuid.UUID, accessCode string) (*AuthRequestLoginResult, error) {
+	result, err := s.DeviceService.CompleteAuthRequest(ctx, requestID, accessCode)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.protection.CheckLockout(ctx, result.User.ID); err != nil {
+		return nil, err
+	}
+	if _, err := s.risk.AssessLogin(ctx, result.User, result.DeviceID); err != nil {
+		return nil, err
+	}
+	if err := s.risk.RecordLogin(ctx, result.User, result.DeviceID); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (s *deviceService) approveRequestDevice(ctx context.Context, userID, deviceID uuid.UUID) error {
+	device, err := s.GetDevice(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+	if device == nil || device.UserID != userID || device.Status != "pending" {
+		return nil
+	}
+	_, adminOnly, err := s.deviceApproval(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if adminOnly {
+		return nil
+	}
+	if err := s.reviewDevice(ctx, device, true); err != nil && !errors.Is(err, ErrDeviceNotPending) {
+		return err
+	}
+	return nil
+}
+
+func (s *deviceService) getAuthRequestWithCode(ctx context.Context, requestID uuid.UUID, accessCode string) (*models.AuthRequest, error) {
+	request, err := s.repo.GetAuthRequest(ctx, requestID)
+	if err != nil {
+		return nil, err
+	}
+	if request == nil || subtle.ConstantTimeCompare([]byte(hashAuthRequestAccessCode(accessCode)), []byte(request.AccessCodeHash)) != 1 {
+		return nil, ErrAuthRequestNotFound
+	}
+	return request, nil
+}
+
+// AuthRequestFingerprint derives the phrase both devices show for a request from the
+// account's email address and the request's public key. Users compare the phrases
+// before approving, so a request made by someone else with their own key is noticed.
+func AuthRequestFingerprint(email string, publicKey []byte) string {
+	h := sha256.New()
+	h.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	h.Write([]byte{0})
+	h.Write(publicKey)
+	digest := h.Sum(nil)
+
+	words := make([]string, authRequestFingerprintWords)
+	for i := range words {
+		words[i] = fingerprintWords[digest[i]]
+	}
+	return strings.Join(words, "-")
+}
+
+func hashAuthRequestAccessCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func authRequestInfo(request *models.AuthRequest) AuthRequestInfo {
+	status := request.Status
+	if status == authRequestStatusPending && time.Now().After(request.ExpiresAt) {
+		status = authRequestStatusExpired
+	}
+	return AuthRequestInfo{
+		ID:          request.ID,
+		PublicKey:   request.PublicKey,
+		Fingerprint: request.Fingerprint,
+		DeviceName:  request.DeviceName,
+		DeviceType:  request.DeviceType,
+		RequestIP:   request.RequestIP,
+		Status:      status,
+		CreatedAt:   request.CreatedAt,
+		ExpiresAt:   request.ExpiresAt,
+		RespondedAt: request.RespondedAt,
+	}
+}
+
+func authRequestDeviceLabel(request *models.AuthRequest) string {
+	label := request.DeviceName
+	if label == "" {
+		label = "a new device"
+	}
+	if request.RequestIP != "" {
+		label += " (" + request.RequestIP + ")"
+	}
+	return label
+}
+
+// fingerprintWords maps each byte of the fingerprint digest to a word
+var fingerprintWords = [256]string{
+	"acid", "acorn", "actor", "adult", "agent", "alarm", "album", "alert", "alley",
+	"amber", "angle", "ankle", "apple", "apron", "arena", "armor", "arrow", "atlas",
+	"attic", "audio", "autumn", "award", "bacon", "badge", "bagel", "baker", "bamboo",
+	"banjo", "barn", "basil", "basket", "beach", "beard", "beaver", "bench", "berry",
+	"bison", "blade", "blaze", "board", "bonus", "border", "bottle", "brain", "branch",
+	"brave", "bread", "brick", "bridge", "broom", "brush", "bubble", "bucket", "bugle",
+	"cabin", "cactus", "camel", "candle", "canoe", "canvas", "canyon", "carbon", "cargo",
+	"carpet", "castle", "cedar", "cellar", "cement", "chalk", "cherry", "chess", "cider",
+	"circus", "citrus", "clay", "cliff", "clock", "cloud", "clover", "coast", "cobalt",
+	"cocoa", "comet", "copper", "coral", "cotton", "cougar", "crater", "crayon", "cube",
+	"cycle", "daisy", "delta", "denim", "desert", "dinner", "donkey", "dragon", "drum",
+	"eagle", "easel", "echo", "elbow", "ember", "engine", "falcon", "fence", "fern",
+	"ferry", "fiddle", "fig", "flame", "flute", "forest", "fossil", "fox", "galaxy",
+	"garden", "garlic", "gecko", "ginger", "globe", "goose", "grape", "gravel", "guitar",
+	"hammer", "harbor", "harp", "hazel", "helmet", "heron", "hippo", "honey", "hornet",
+	"igloo", "island", "ivory", "jacket", "jaguar", "jelly", "jigsaw", "jungle", "kayak",
+	"kernel", "kettle", "kitten", "koala", "ladder", "lagoon", "laptop", "lemon",
+	"lentil", "lily", "lizard", "locket", "lotus", "magnet", "mango", "maple", "marble",
+	"meadow", "melon", "meteor", "mint", "mirror", "mitten", "monkey", "mosaic", "moss",
+	"motor", "muffin", "museum", "napkin", "nectar", "needle", "nickel", "noodle",
+	"nutmeg", "oasis", "ocean", "olive", "onion", "orbit", "orchid", "otter", "oyster",
+	"paddle", "panda", "paper", "parrot", "peach", "peanut", "pebble", "pencil", "pepper",
+	"piano", "pickle", "pigeon", "pillow", "pilot", "planet", "plum", "pocket", "pollen",
+	"pony", "poppy", "potato", "prism", "puzzle", "quartz", "quill", "rabbit", "radar",
+	"radish", "raven", "ribbon", "river", "robin", "rocket", "saddle", "salmon", "sandal",
+	"satin", "scarf", "shadow", "shell", "silver", "sketch", "sled", "spider", "spruce",
+	"squid", "statue", "stone", "summit", "sunset", "swan", "tablet", "tiger", "timber",
+	"tomato", "topaz", "tulip", "tunnel", "turtle", "valley", "velvet", "violet", "wagon",
+	"walnut", "walrus", "whale", "willow", "window", "zebra",
+}
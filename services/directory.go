@@ -20,7 +20,9 @@ const (
 
 type DirectoryService interface {
 	ConfigureDirectory(ctx context.Context, orgID uuid.UUID, config models.DirectoryConfig) error
-	SyncDirectory(ctx context.Context, orgID uuid.UUID) error
+	// SyncDirectory reads the organization's directory. adminID is the member running
+	// the sync; synced groups change only as far as they may change them.
+	SyncDirectory(ctx context.Context, orgID, adminID uuid.UUID) error
 	GetSyncStatus(ctx context.Context, orgID uuid.UUID) (*models.DirectorySync, error)
 	ListDirectoryUsers(ctx context.Context, orgID uuid.UUID) ([]models.DirectoryUser, error)
 	ValidateDirectoryConfig(ctx context.Context, config models.DirectoryConfig) error
@@ -31,14 +33,18 @@ type directoryService struct {
 	repo        repository.Repository
 	audit       AuditService
 	licensing   LicensingService
+	groups      GroupService
 	sync        sync.Mutex
 }
 
-func NewDirectoryService(repo repository.Repository, audit AuditService, licensing LicensingService) DirectoryService {
+// NewDirectoryService creates the directory service. Directory groups are synced into
+// organization groups through groups.
+func NewDirectoryService(repo repository.Repository, audit AuditService, licensing LicensingService, groups GroupService) DirectoryService {
 	return &directoryService{
 		repo:      repo,
 		audit:     audit,
 		licensing: licensing,
+		groups:    groups,
 	}
 }
 
@@ -75,7 +81,7 @@ func (s *directoryService) ConfigureDirectory(ctx context.Context, orgID uuid.UU
 	return nil
 }
 
-func (s *directoryService) SyncDirectory(ctx context.Context, orgID uuid.UUID) error {
+func (s *directoryService) SyncDirectory(ctx context.Context, orgID, adminID uuid.UUID) error {
 	s.sync.Lock()
 	defer s.sync.Unlock()
 
@@ -99,11 +105,11 @@ func (s *directoryService) SyncDirectory(ctx context.Context, orgID uuid.UUID) e
 	var syncErr error
 	switch config.Type {
 	case DirectoryTypeLDAP:
-		syncErr = s.syncLDAP(ctx, config)
+		syncErr = s.syncLDAP(ctx, adminID, config)
 	case DirectoryTypeAD:
-		syncErr = s.syncActiveDirectory(ctx, config)
+		syncErr = s.syncActiveDirectory(ctx, adminID, config)
 	case DirectoryTypeOkta:
-		syncErr = s.syncOkta(ctx, config)
+		syncErr = s.syncOkta(ctx, adminID, config)
 	default:
 		syncErr = errors.New("unsupported directory type")
 	}
@@ -123,7 +129,7 @@ func (s *directoryService) SyncDirectory(ctx context.Context, orgID uuid.UUID) e
 	// Create audit log
 	metadata := createBasicMetadata("directory_synced", "Directory sync completed")
 	metadata["status"] = sync.Status
-	if err := s.createAuditLog(ctx, "directory.synced", uuid.Nil, orgID, metadata); err != nil {
+	if err := s.createAuditLog(ctx, "directory.synced", adminID, orgID, metadata); err != nil {
 		return err
 	}
 
@@ -156,18 +162,38 @@ func (s *directoryService) GetDirectoryGroups(ctx context.Context, orgID uuid.UU
 }
 
 
-// Private helper methods for specific directory types
-func (s *directoryService) syncLDAP(ctx context.Context, config models.DirectoryConfig) error {
+// directoryGroup is a group read from the directory, with the members that are
+// users of this server
+type directoryGroup struct {
+	ExternalID string
+	Name       string
+	Members    []uuid.UUID
+}
+
+// syncGroups writes the groups read from the directory into organization groups, which
+// carry the role and collection access of their members
+func (s *directoryService) syncGroups(ctx context.Context, orgID, adminID uuid.UUID, groups []directoryGroup) error {
+	for _, group := range groups {
+		if _, err := s.groups.SyncGroup(ctx, orgID, adminID, group.ExternalID, group.Name, group.Members); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Private helper methods for specific directory types. Each reads the directory's
+// users and groups and passes the groups to syncGroups.
+func (s *directoryService) syncLDAP(ctx context.Context, adminID uuid.UUID, config models.DirectoryConfig) error {
 	// Implement LDAP synchronization
 	return nil
 }
 
-func (s *directoryService) syncActiveDirectory(ctx context.Context, config models.DirectoryConfig) error {
+func (s *directoryService) syncActiveDirectory(ctx context.Context, adminID uuid.UUID, config models.DirectoryConfig) error {
 	// Implement Active Directory synchronization
 	return nil
 }
 
-func (s *directoryService) syncOkta(ctx context.Context, config models.DirectoryConfig) error {
+func (s *directoryService) syncOkta(ctx context.Context, adminID uuid.UUID, config models.DirectoryConfig) error {
 	// Implement Okta synchronization
 	return nil
 }
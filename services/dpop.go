@@ -0,0 +1,311 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+)
+
+var (
+	ErrInvalidDPoPProof  = errors.New("invalid DPoP proof")
+	ErrDPoPProofRequired = errors.New("DPoP proof required")
+)
+
+const (
+	// dpopProofType is the typ header of DPoP proofs
+	dpopProofType = "dpop+jwt"
+	// dpopProofMaxAge is how old a proof may be. Its jti is remembered this long.
+	dpopProofMaxAge = 5 * time.Minute
+	// dpopClockSkew tolerates clients whose clock runs slightly ahead
+	dpopClockSkew = 30 * time.Second
+)
+
+// DPoPProof is a verified DPoP proof (RFC 9449). Thumbprint is the RFC 7638 thumbprint
+// of the public key that signed it, and AccessTokenHash the ath claim, if any.
+type DPoPProof struct {
+	Thumbprint      string
+	PublicKey       json.RawMessage
+	JTI             string
+	IssuedAt        time.Time
+	AccessTokenHash string
+}
+
+// DPoPService verifies the DPoP proofs clients send with each request and makes sure
+// each proof is used only once
+type DPoPService interface {
+	// VerifyProof checks the proof for a request with method to targetURL, the public URL
+	// of the endpoint without query or fragment
+	VerifyProof(ctx context.Context, proof, method, targetURL string) (*DPoPProof, error)
+	// RunCleanup forgets expired proofs every interval until ctx is done
+	RunCleanup(ctx context.Context, interval time.Duration)
+}
+
+type dpopService struct {
+	repo repository.Repository
+}
+
+// NewDPoPService creates a DPoP service remembering used proofs in Postgres, so a
+// proof replayed against another server is refused too
+func NewDPoPService(repo repository.Repository) DPoPService {
+	return &dpopService{repo: repo}
+}
+
+func (s *dpopService) VerifyProof(ctx context.Context, proof, method, targetURL string) (*DPoPProof, error) {
+	verified, err := ParseDPoPProof(proof, method, targetURL, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	// The same jti may be used by different keys; only the pair has to be unique
+	sum := sha256.Sum256([]byte(verified.Thumbprint + "." + verified.JTI))
+	fresh, err := s.repo.RecordDPoPProof(ctx, hex.EncodeToString(sum[:]), verified.IssuedAt.Add(dpopProofMaxAge+dpopClockSkew))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, fmt.Errorf("%w: proof has already been used", ErrInvalidDPoPProof)
+	}
+	return verified, nil
+}
+
+func (s *dpopService) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.repo.DeleteExpiredDPoPProofs(ctx, time.Now()); err != nil {
+				log.Printf("Failed to delete expired DPoP proofs: %v", err)
+			}
+		}
+	}
+}
+
+type dpopContextKey struct{}
+
+// ContextWithDPoPProof returns a context carrying the verified proof sent with the request
+func ContextWithDPoPProof(ctx context.Context, proof *DPoPProof) context.Context {
+	return context.WithValue(ctx, dpopContextKey{}, proof)
+}
+
+// DPoPProofFromContext returns the verified proof sent with the request, or nil
+func DPoPProofFromContext(ctx context.Context) *DPoPProof {
+	proof, _ := ctx.Value(dpopContextKey{}).(*DPoPProof)
+	return proof
+}
+
+// CheckDPoPBinding checks that a token bound to the key with the given thumbprint came
+// with a proof signed by that key for that token. Unbound tokens need no proof.
+func CheckDPoPBinding(ctx context.Context, thumbprint, token string) error {
+	if thumbprint == "" {
+		return nil
+	}
+	proof := DPoPProofFromContext(ctx)
+	if proof == nil {
+		return ErrDPoPProofRequired
+	}
+	if subtle.ConstantTimeCompare([]byte(proof.Thumbprint), []byte(thumbprint)) != 1 {
+		return fmt.Errorf("%w: proof is signed by another key", ErrInvalidDPoPProof)
+	}
+	if subtle.ConstantTimeCompare([]byte(proof.AccessTokenHash), []byte(DPoPAccessTokenHash(token))) != 1 {
+		return fmt.Errorf("%w: proof is for another token", ErrInvalidDPoPProof)
+	}
+	return nil
+}
+
+// DPoPAccessTokenHash returns the ath claim a proof carries for the access token
+func DPoPAccessTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// ParseDPoPProof verifies a DPoP proof for a request with method to targetURL at the
+// given time: the signature with the public key in its header, its type, and its htm,
+// htu and iat claims. Proofs are signed with ES256 or EdDSA (Ed25519). It does not
+// check whether the jti was used before or the ath claim.
+func ParseDPoPProof(proof, method, targetURL string, now time.Time) (*DPoPProof, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: not a compact JWS", ErrInvalidDPoPProof)
+	}
+
+	var header struct {
+		Typ string          `json:"typ"`
+		Alg string          `json:"alg"`
+		JWK json.RawMessage `json:"jwk"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Typ != dpopProofType {
+		return nil, fmt.Errorf("%w: typ must be %s", ErrInvalidDPoPProof, dpopProofType)
+	}
+
+	key, thumbprint, err := parseDPoPKey(header.Alg, header.JWK)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature is not base64url", ErrInvalidDPoPProof)
+	}
+	if !verifyDPoPSignature(key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidDPoPProof)
+	}
+
+	var claims struct {
+		JTI string `json:"jti"`
+		HTM string `json:"htm"`
+		HTU string `json:"htu"`
+		IAT int64  `json:"iat"`
+		ATH string `json:"ath"`
+	}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims.JTI == "" || len(claims.JTI) > 256 {
+		return nil, fmt.Errorf("%w: missing jti", ErrInvalidDPoPProof)
+	}
+	if claims.HTM != method {
+		return nil, fmt.Errorf("%w: htm does not match the request method", ErrInvalidDPoPProof)
+	}
+	if !sameDPoPTarget(claims.HTU, targetURL) {
+		return nil, fmt.Errorf("%w: htu does not match the request URL", ErrInvalidDPoPProof)
+	}
+	issuedAt := time.Unix(claims.IAT, 0)
+	if issuedAt.After(now.Add(dpopClockSkew)) || now.Sub(issuedAt) > dpopProofMaxAge {
+		return nil, fmt.Errorf("%w: iat is outside the accepted window", ErrInvalidDPoPProof)
+	}
+
+	return &DPoPProof{
+		Thumbprint:      thumbprint,
+		PublicKey:       header.JWK,
+		JTI:             claims.JTI,
+		IssuedAt:        issuedAt,
+		AccessTokenHash: claims.ATH,
+	}, nil
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: segment is not base64url", ErrInvalidDPoPProof)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: segment is not JSON", ErrInvalidDPoPProof)
+	}
+	return nil
+}
+
+// parseDPoPKey reads the public JWK of a proof, checks that it suits the algorithm and
+// returns it with its RFC 7638 thumbprint
+func parseDPoPKey(alg string, raw json.RawMessage) (interface{}, string, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		Crv string `json:"crv"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+		D   string `json:"d"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &jwk) != nil {
+		return nil, "", fmt.Errorf("%w: missing jwk", ErrInvalidDPoPProof)
+	}
+	if jwk.D != "" {
+		return nil, "", fmt.Errorf("%w: jwk contains a private key", ErrInvalidDPoPProof)
+	}
+
+	var key interface{}
+	var members interface{}
+	switch {
+	case alg == "ES256" && jwk.Kty == "EC" && jwk.Crv == "P-256":
+		x, errX := base64.RawURLEncoding.DecodeString(jwk.X)
+		y, errY := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, "", fmt.Errorf("%w: bad EC key", ErrInvalidDPoPProof)
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, "", fmt.Errorf("%w: bad EC key", ErrInvalidDPoPProof)
+		}
+		key = public
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		}{jwk.Crv, jwk.Kty, jwk.X, jwk.Y}
+	case alg == "EdDSA" && jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, "", fmt.Errorf("%w: bad Ed25519 key", ErrInvalidDPoPProof)
+		}
+		key = ed25519.PublicKey(x)
+		members = struct {
+			Crv string `json:"crv"`
+			Kty string `json:"kty"`
+			X   string `json:"x"`
+		}{jwk.Crv, jwk.Kty, jwk.X}
+	default:
+		return nil, "", fmt.Errorf("%w: unsupported algorithm or key type", ErrInvalidDPoPProof)
+	}
+
+	// The thumbprint hashes the required members in lexicographic order
+	canonical, err := json.Marshal(members)
+	if err != nil {
+		return nil, "", err
+	}
+	digest := sha256.Sum256(canonical)
+	return key, base64.RawURLEncoding.EncodeToString(digest[:]), nil
+}
+
+func verifyDPoPSignature(key interface{}, signingInput, signature []byte) bool {
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		// JWS encodes the signature as the fixed-size r and s values
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(signingInput)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(key, digest[:], r, s)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, signingInput, signature)
+	default:
+		return false
+	}
+}
+
+// sameDPoPTarget compares the htu claim with the request URL, ignoring any query or
+// fragment and the case of the scheme and host
+func sameDPoPTarget(htu, target string) bool {
+	claimed, err := url.Parse(htu)
+	if err != nil {
+		return false
+	}
+	expected, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(claimed.Scheme, expected.Scheme) &&
+		strings.EqualFold(claimed.Host, expected.Host) &&
+		claimed.EscapedPath() == expected.EscapedPath()
+}
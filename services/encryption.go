@@ -3,6 +3,8 @@ package services
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
@@ -13,10 +15,39 @@ import (
 	"io"
 )
 
+// KeyAlgorithm identifies the algorithm an asymmetric key is used with. It is stored
+// in the "Algorithm" header of PEM encoded keys.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmX25519HPKE KeyAlgorithm = "x25519-hpke"
+	KeyAlgorithmEd25519    KeyAlgorithm = "ed25519"
+	KeyAlgorithmRSAOAEP    KeyAlgorithm = "rsa-oaep-sha256"
+
+	// DefaultKeyAlgorithm is used by GenerateKeyPair
+	DefaultKeyAlgorithm = KeyAlgorithmX25519HPKE
+
+	// MinRSAKeyBits is the minimum size accepted for new long-lived RSA keys
+	MinRSAKeyBits = 4096
+
+	pemAlgorithmHeader = "Algorithm"
+)
+
+var (
+	ErrUnsupportedKeyAlgorithm = errors.New("unsupported key algorithm")
+	ErrKeyTooWeak              = errors.New("key is below the minimum strength")
+	ErrInvalidSignature        = errors.New("invalid signature")
+)
+
 type EncryptionService interface {
 	GenerateKeyPair() (publicKey, privateKey []byte, err error)
+	GenerateKeyPairWithAlgorithm(algorithm KeyAlgorithm) (publicKey, privateKey []byte, err error)
+	KeyAlgorithmOf(key []byte) (KeyAlgorithm, error)
+	ValidatePublicKey(publicKey []byte) (KeyAlgorithm, error)
 	EncryptWithPublicKey(data []byte, publicKey []byte) ([]byte, error)
 	DecryptWithPrivateKey(ciphertext []byte, privateKey []byte) ([]byte, error)
+	Sign(data []byte, privateKey []byte) ([]byte, error)
+	Verify(data, signature []byte, publicKey []byte) error
 	GenerateSymmetricKey() ([]byte, error)
 	EncryptSymmetric(data []byte, key []byte) ([]byte, error)
 	DecryptSymmetric(ciphertext []byte, key []byte) ([]byte, error)
@@ -28,65 +59,200 @@ func NewEncryptionService() EncryptionService {
 	return &encryptionService{}
 }
 
+// GenerateKeyPair generates a key pair for key wrapping using DefaultKeyAlgorithm
 func (s *encryptionService) GenerateKeyPair() ([]byte, []byte, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	return s.GenerateKeyPairWithAlgorithm(DefaultKeyAlgorithm)
+}
+
+// GenerateKeyPairWithAlgorithm generates a key pair and returns the SPKI public key
+// and PKCS#8 private key as PEM, both tagged with the algorithm
+func (s *encryptionService) GenerateKeyPairWithAlgorithm(algorithm KeyAlgorithm) ([]byte, []byte, error) {
+	var publicKey, privateKey interface{}
+	switch algorithm {
+	case KeyAlgorithmX25519HPKE:
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		publicKey, privateKey = key.PublicKey(), key
+	case KeyAlgorithmEd25519:
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		publicKey, privateKey = public, private
+	case KeyAlgorithmRSAOAEP:
+		key, err := rsa.GenerateKey(rand.Reader, MinRSAKeyBits)
+		if err != nil {
+			return nil, nil, err
+		}
+		publicKey, privateKey = &key.PublicKey, key
+	default:
+		return nil, nil, ErrUnsupportedKeyAlgorithm
+	}
+
+	publicKeyDER, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	privateKeyDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	// Convert private key to PEM format
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
-	})
-
-	// Convert public key to PEM format
+	headers := map[string]string{pemAlgorithmHeader: string(algorithm)}
 	publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(&privateKey.PublicKey),
+		Type:    "PUBLIC KEY",
+		Headers: headers,
+		Bytes:   publicKeyDER,
+	})
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:    "PRIVATE KEY",
+		Headers: headers,
+		Bytes:   privateKeyDER,
 	})
 
 	return publicKeyPEM, privateKeyPEM, nil
 }
 
+// KeyAlgorithmOf returns the algorithm of a PEM encoded public or private key
+func (s *encryptionService) KeyAlgorithmOf(key []byte) (KeyAlgorithm, error) {
+	algorithm, _, err := parsePEMKey(key)
+	return algorithm, err
+}
+
+// ValidatePublicKey checks that a public key registered by a client is usable and
+// strong enough for long-lived use, and returns its algorithm
+func (s *encryptionService) ValidatePublicKey(publicKey []byte) (KeyAlgorithm, error) {
+	algorithm, parsed, err := parsePEMKey(publicKey)
+	if err != nil {
+		return "", err
+	}
+
+	switch key := parsed.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < MinRSAKeyBits {
+			return "", ErrKeyTooWeak
+		}
+	case *ecdh.PublicKey, ed25519.PublicKey:
+	default:
+		return "", errors.New("expected a public key")
+	}
+
+	return algorithm, nil
+}
+
+// EncryptWithPublicKey wraps data for the holder of the private key, using HPKE for
+// X25519 keys and OAEP with SHA-256 for RSA keys
 func (s *encryptionService) EncryptWithPublicKey(data []byte, publicKey []byte) ([]byte, error) {
-	block, _ := pem.Decode(publicKey)
-	if block == nil {
-		return nil, errors.New("failed to decode public key")
+	_, parsed, err := parsePEMKey(publicKey)
+	if err != nil {
+		return nil, err
 	}
 
-	parsedKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	switch key := parsed.(type) {
+	case *ecdh.PublicKey:
+		return hpkeSeal(key, data, nil)
+	case *rsa.PublicKey:
+		hash := sha256.New()
+		return rsa.EncryptOAEP(hash, rand.Reader, key, data, nil)
+	default:
+		return nil, ErrUnsupportedKeyAlgorithm
+	}
+}
+
+func (s *encryptionService) DecryptWithPrivateKey(ciphertext []byte, privateKey []byte) ([]byte, error) {
+	_, parsed, err := parsePEMKey(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	hash := sha256.New()
-	ciphertext, err := rsa.EncryptOAEP(hash, rand.Reader, parsedKey, data, nil)
+	switch key := parsed.(type) {
+	case *ecdh.PrivateKey:
+		return hpkeOpen(key, ciphertext, nil)
+	case *rsa.PrivateKey:
+		hash := sha256.New()
+		return rsa.DecryptOAEP(hash, rand.Reader, key, ciphertext, nil)
+	default:
+		return nil, ErrUnsupportedKeyAlgorithm
+	}
+}
+
+// Sign signs data with an Ed25519 private key
+func (s *encryptionService) Sign(data []byte, privateKey []byte) ([]byte, error) {
+	_, parsed, err := parsePEMKey(privateKey)
 	if err != nil {
 		return nil, err
 	}
 
-	return ciphertext, nil
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, ErrUnsupportedKeyAlgorithm
+	}
+	return ed25519.Sign(key, data), nil
 }
 
-func (s *encryptionService) DecryptWithPrivateKey(ciphertext []byte, privateKey []byte) ([]byte, error) {
-	block, _ := pem.Decode(privateKey)
+// Verify checks an Ed25519 signature over data
+func (s *encryptionService) Verify(data, signature []byte, publicKey []byte) error {
+	_, parsed, err := parsePEMKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	key, ok := parsed.(ed25519.PublicKey)
+	if !ok {
+		return ErrUnsupportedKeyAlgorithm
+	}
+	if !ed25519.Verify(key, data, signature) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// parsePEMKey decodes a PEM encoded key and determines its algorithm. Keys without an
+// Algorithm header get one derived from the key type; legacy PKCS#1 RSA keys are accepted
+// so existing RSA-2048 key pairs keep working.
+func parsePEMKey(key []byte) (KeyAlgorithm, interface{}, error) {
+	block, _ := pem.Decode(key)
 	if block == nil {
-		return nil, errors.New("failed to decode private key")
+		return "", nil, errors.New("failed to decode key")
 	}
 
-	parsedKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		parsed, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return "", nil, ErrUnsupportedKeyAlgorithm
+	}
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	hash := sha256.New()
-	plaintext, err := rsa.DecryptOAEP(hash, rand.Reader, parsedKey, ciphertext, nil)
-	if err != nil {
-		return nil, err
+	var derived KeyAlgorithm
+	switch parsed.(type) {
+	case *ecdh.PublicKey, *ecdh.PrivateKey:
+		derived = KeyAlgorithmX25519HPKE
+	case ed25519.PublicKey, ed25519.PrivateKey:
+		derived = KeyAlgorithmEd25519
+	case *rsa.PublicKey, *rsa.PrivateKey:
+		derived = KeyAlgorithmRSAOAEP
+	default:
+		return "", nil, ErrUnsupportedKeyAlgorithm
 	}
 
-	return plaintext, nil
+	if header, ok := block.Headers[pemAlgorithmHeader]; ok && KeyAlgorithm(header) != derived {
+		return "", nil, ErrUnsupportedKeyAlgorithm
+	}
+
+	return derived, parsed, nil
 }
 
 func (s *encryptionService) GenerateSymmetricKey() ([]byte, error) {
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"errors"
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+var ErrInvalidIPAddress = errors.New("invalid IP address")
+
+// GeoLocation is where an IP address is located. Country is an ISO 3166-1 alpha-2 code.
+type GeoLocation struct {
+	Country   string  `json:"country"`
+	City      string  `json:"city,omitempty"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+// GeoIPResolver resolves IP addresses to locations without calling external services
+type GeoIPResolver interface {
+	Lookup(ip string) (*GeoLocation, error)
+	Close() error
+}
+
+type geoIPDatabase struct {
+	reader *geoip2.Reader
+}
+
+// OpenGeoIPDatabase opens a local MaxMind-format city database (such as GeoLite2-City.mmdb)
+func OpenGeoIPDatabase(path string) (GeoIPResolver, error) {
+	reader, err := geoip2.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &geoIPDatabase{reader: reader}, nil
+}
+
+// Lookup returns nil when the database has no country for the address, as for private
+// networks
+func (d *geoIPDatabase) Lookup(ip string) (*GeoLocation, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil, ErrInvalidIPAddress
+	}
+
+	record, err := d.reader.City(parsed)
+	if err != nil {
+		return nil, err
+	}
+	if record.Country.IsoCode == "" {
+		return nil, nil
+	}
+
+	return &GeoLocation{
+		Country:   record.Country.IsoCode,
+		City:      record.City.Names["en"],
+		Latitude:  record.Location.Latitude,
+		Longitude: record.Location.Longitude,
+	}, nil
+}
+
+func (d *geoIPDatabase) Close() error {
+	return d.reader.Close()
+}
@@ -0,0 +1,494 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrGroupNotFound = errors.New("group not found")
+)
+
+// GroupService manages an organization's groups. Members of a group hold the group's
+// role and collection access in addition to their own; their effective permissions
+// are the union of both.
+type GroupService interface {
+	// CreateGroup creates a group. Giving it a role also requires the manage_roles
+	// permission.
+	CreateGroup(ctx context.Context, orgID, adminID uuid.UUID, name string, roleID *uuid.UUID) (*models.Group, error)
+	// UpdateGroup renames the group and sets its role. Changing the role also requires
+	// the manage_roles permission.
+	UpdateGroup(ctx context.Context, orgID, adminID, groupID uuid.UUID, name string, roleID *uuid.UUID) (*models.Group, error)
+	DeleteGroup(ctx context.Context, orgID, adminID, groupID uuid.UUID) error
+	GetGroup(ctx context.Context, orgID, adminID, groupID uuid.UUID) (*models.Group, error)
+	ListGroups(ctx context.Context, orgID, adminID uuid.UUID) ([]models.Group, error)
+
+	// AddGroupMember adds a member of the organization to the group. When the group has
+	// a role the member gains its permissions, so this also requires the manage_roles
+	// permission.
+	AddGroupMember(ctx context.Context, orgID, adminID, groupID, userID uuid.UUID) error
+	RemoveGroupMember(ctx context.Context, orgID, adminID, groupID, userID uuid.UUID) error
+	ListGroupMembers(ctx context.Context, orgID, adminID, groupID uuid.UUID) ([]models.GroupUser, error)
+
+	// SetGroupCollectionAccess grants the group's members access to a collection,
+	// replacing any existing grant. It also requires the manage_collections permission.
+	SetGroupCollectionAccess(ctx context.Context, orgID, adminID, groupID, collectionID uuid.UUID, access CollectionAccess) error
+	RemoveGroupCollection(ctx context.Context, orgID, adminID, groupID, collectionID uuid.UUID) error
+	ListGroupCollections(ctx context.Context, orgID, adminID, groupID uuid.UUID) ([]models.CollectionGroup, error)
+
+	// SyncGroup creates or renames the group synced from a directory group and makes
+	// the users its only members. Users who are not members of the organization are
+	// skipped. adminID is the member running the directory sync, who needs the same
+	// permissions as for changing the group by hand: manage_groups, and manage_roles
+	// when members join a group with a role.
+	SyncGroup(ctx context.Context, orgID, adminID uuid.UUID, externalID, name string, userIDs []uuid.UUID) (*models.Group, error)
+}
+
+type groupService struct {
+	repo        repository.Repository
+	permissions PermissionResolver
+	push        NotificationHub
+}
+
+// NewGroupService creates the group service. push may be nil, in which case connected
+// clients are not told about changes.
+func NewGroupService(repo repository.Repository, permissions PermissionResolver, push NotificationHub) GroupService {
+	return &groupService{
+		repo:        repo,
+		permissions: permissions,
+		push:        push,
+	}
+}
+
+func (s *groupService) CreateGroup(ctx context.Context, orgID, adminID uuid.UUID, name string, roleID *uuid.UUID) (*models.Group, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: group name is required", ErrInvalidOperation)
+	}
+	if roleID != nil {
+		if err := s.requireGroupRole(ctx, orgID, adminID, *roleID); err != nil {
+			return nil, err
+		}
+	}
+
+	group := &models.Group{
+		OrganizationID: orgID,
+		Name:           name,
+		RoleID:         roleID,
+	}
+	if err := s.repo.CreateGroup(ctx, group); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("group_created", "Group created")
+	metadata["group_id"] = group.ID.String()
+	metadata["group_name"] = name
+	if roleID != nil {
+		metadata["role_id"] = roleID.String()
+	}
+	if err := s.createAuditLog(ctx, "group.created", adminID, orgID, metadata); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+func (s *groupService) UpdateGroup(ctx context.Context, orgID, adminID, groupID uuid.UUID, name string, roleID *uuid.UUID) (*models.Group, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("%w: group name is required", ErrInvalidOperation)
+	}
+	group, err := s.organizationGroup(ctx, orgID, groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	roleChanged := !sameRole(group.RoleID, roleID)
+	if roleChanged && roleID != nil {
+		if err := s.requireGroupRole(ctx, orgID, adminID, *roleID); err != nil {
+			return nil, err
+		}
+	} else if roleChanged {
+		if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageRoles); err != nil {
+			return nil, err
+		}
+	}
+
+	group.Name = name
+	group.RoleID = roleID
+	if err := s.repo.UpdateGroup(ctx, group); err != nil {
+		return nil, err
+	}
+
+	if roleChanged {
+		// The group's members gained or lost the role's permissions
+		s.invalidateMembers(ctx, orgID, groupID)
+		pushSync(ctx, s.push, PushTarget{OrganizationID: orgID}, PushSyncOrganization, uuid.Nil, orgID)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("group_updated", "Group updated")
+	metadata["group_id"] = groupID.String()
+	metadata["group_name"] = name
+	if roleChanged && roleID != nil {
+		metadata["role_id"] = roleID.String()
+	}
+	if err := s.createAuditLog(ctx, "group.updated", adminID, orgID, metadata); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+func (s *groupService) DeleteGroup(ctx context.Context, orgID, adminID, groupID uuid.UUID) error {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return err
+	}
+	group, err := s.organizationGroup(ctx, orgID, groupID)
+	if err != nil {
+		return err
+	}
+
+	// The members are needed to evict their permissions once the group is gone
+	members, err := s.repo.ListGroupUsers(ctx, groupID)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.DeleteGroup(ctx, groupID); err != nil {
+		return err
+	}
+	for _, member := range members {
+		s.permissions.InvalidateMember(ctx, orgID, member.UserID)
+	}
+	pushSync(ctx, s.push, PushTarget{OrganizationID: orgID}, PushSyncOrganization, uuid.Nil, orgID)
+
+	// Create audit log
+	metadata := createBasicMetadata("group_deleted", "Group deleted")
+	metadata["group_id"] = groupID.String()
+	metadata["group_name"] = group.Name
+	return s.createAuditLog(ctx, "group.deleted", adminID, orgID, metadata)
+}
+
+func (s *groupService) GetGroup(ctx context.Context, orgID, adminID, groupID uuid.UUID) (*models.Group, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return nil, err
+	}
+	return s.organizationGroup(ctx, orgID, groupID)
+}
+
+func (s *groupService) ListGroups(ctx context.Context, orgID, adminID uuid.UUID) ([]models.Group, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return nil, err
+	}
+	return s.repo.ListGroups(ctx, orgID)
+}
+
+func (s *groupService) AddGroupMember(ctx context.Context, orgID, adminID, groupID, userID uuid.UUID) error {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return err
+	}
+	group, err := s.organizationGroup(ctx, orgID, groupID)
+	if err != nil {
+		return err
+	}
+	member, err := s.repo.GetOrganizationUser(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return ErrUserNotFound
+	}
+	if err := s.requireJoinGroup(ctx, orgID, adminID, group); err != nil {
+		return err
+	}
+
+	err = s.repo.AddGroupUser(ctx, &models.GroupUser{
+		GroupID:   groupID,
+		UserID:    userID,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	s.permissions.InvalidateMember(ctx, orgID, userID)
+	pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncOrganization, uuid.Nil, orgID)
+
+	// Create audit log
+	metadata := createBasicMetadata("group_member_added", "Member added to group")
+	metadata["group_id"] = groupID.String()
+	metadata["group_name"] = group.Name
+	metadata["admin_id"] = adminID.String()
+	return s.createAuditLog(ctx, "group.member_added", userID, orgID, metadata)
+}
+
+func (s *groupService) RemoveGroupMember(ctx context.Context, orgID, adminID, groupID, userID uuid.UUID) error {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return err
+	}
+	group, err := s.organizationGroup(ctx, orgID, groupID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.RemoveGroupUser(ctx, groupID, userID); err != nil {
+		return err
+	}
+	s.permissions.InvalidateMember(ctx, orgID, userID)
+	pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncOrganization, uuid.Nil, orgID)
+
+	// Create audit log
+	metadata := createBasicMetadata("group_member_removed", "Member removed from group")
+	metadata["group_id"] = groupID.String()
+	metadata["group_name"] = group.Name
+	metadata["admin_id"] = adminID.String()
+	return s.createAuditLog(ctx, "group.member_removed", userID, orgID, metadata)
+}
+
+func (s *groupService) ListGroupMembers(ctx context.Context, orgID, adminID, groupID uuid.UUID) ([]models.GroupUser, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return nil, err
+	}
+	if _, err := s.organizationGroup(ctx, orgID, groupID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListGroupUsers(ctx, groupID)
+}
+
+func (s *groupService) SetGroupCollectionAccess(ctx context.Context, orgID, adminID, groupID, collectionID uuid.UUID, access CollectionAccess) error {
+	if !access.Valid() {
+		return fmt.Errorf("%w: unknown collection access %q", ErrInvalidOperation, access)
+	}
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups, PermissionManageCollections); err != nil {
+		return err
+	}
+	group, err := s.organizationGroup(ctx, orgID, groupID)
+	if err != nil {
+		return err
+	}
+	collection, err := s.repo.GetCollection(ctx, collectionID)
+	if err != nil {
+		return err
+	}
+	if collection == nil || collection.OrganizationID != orgID {
+		return fmt.Errorf("%w: unknown collection %s", ErrInvalidOperation, collectionID)
+	}
+
+	err = s.repo.SetCollectionGroup(ctx, &models.CollectionGroup{
+		CollectionID: collectionID,
+		GroupID:      groupID,
+		Access:       string(access),
+		CreatedAt:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	s.pushGroupMembers(ctx, orgID, groupID, PushSyncCollection, collectionID)
+
+	// Create audit log
+	metadata := createBasicMetadata("group_collection_granted", "Group granted collection access")
+	metadata["group_id"] = groupID.String()
+	metadata["group_name"] = group.Name
+	metadata["collection_id"] = collectionID.String()
+	metadata["access"] = string(access)
+	return s.createAuditLog(ctx, "group.collection_granted", adminID, orgID, metadata)
+}
+
+func (s *groupService) RemoveGroupCollection(ctx context.Context, orgID, adminID, groupID, collectionID uuid.UUID) error {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups, PermissionManageCollections); err != nil {
+		return err
+	}
+	group, err := s.organizationGroup(ctx, orgID, groupID)
+	if err != nil {
+		return err
+	}
+
+	if err := s.repo.RemoveCollectionGroup(ctx, collectionID, groupID); err != nil {
+		return err
+	}
+	s.pushGroupMembers(ctx, orgID, groupID, PushSyncCollection, collectionID)
+
+	// Create audit log
+	metadata := createBasicMetadata("group_collection_revoked", "Group collection access revoked")
+	metadata["group_id"] = groupID.String()
+	metadata["group_name"] = group.Name
+	metadata["collection_id"] = collectionID.String()
+	return s.createAuditLog(ctx, "group.collection_revoked", adminID, orgID, metadata)
+}
+
+func (s *groupService) ListGroupCollections(ctx context.Context, orgID, adminID, groupID uuid.UUID) ([]models.CollectionGroup, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return nil, err
+	}
+	if _, err := s.organizationGroup(ctx, orgID, groupID); err != nil {
+		return nil, err
+	}
+	return s.repo.ListGroupCollections(ctx, groupID)
+}
+
+func (s *groupService) SyncGroup(ctx context.Context, orgID, adminID uuid.UUID, externalID, name string, userIDs []uuid.UUID) (*models.Group, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageGroups); err != nil {
+		return nil, err
+	}
+	if externalID == "" {
+		return nil, fmt.Errorf("%w: synced groups need an external ID", ErrInvalidOperation)
+	}
+	if name == "" {
+		name = externalID
+	}
+
+	group, err := s.repo.GetGroupByExternalID(ctx, orgID, externalID)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		group = &models.Group{OrganizationID: orgID, Name: name, ExternalID: externalID}
+		if err := s.repo.CreateGroup(ctx, group); err != nil {
+			return nil, err
+		}
+	} else if group.Name != name {
+		group.Name = name
+		if err := s.repo.UpdateGroup(ctx, group); err != nil {
+			return nil, err
+		}
+	}
+
+	var members []uuid.UUID
+	for _, userID := range userIDs {
+		member, err := s.repo.GetOrganizationUser(ctx, orgID, userID)
+		if err != nil {
+			return nil, err
+		}
+		if member != nil {
+			members = append(members, userID)
+		}
+	}
+
+	previous, err := s.repo.ListGroupUsers(ctx, group.ID)
+	if err != nil {
+		return nil, err
+	}
+	changed := make(map[uuid.UUID]bool, len(previous)+len(members))
+	for _, membership := range previous {
+		changed[membership.UserID] = true
+	}
+	joined := false
+	for _, userID := range members {
+		joined = joined || !changed[userID]
+		changed[userID] = !changed[userID]
+	}
+	if joined {
+		if err := s.requireJoinGroup(ctx, orgID, adminID, group); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.repo.ReplaceGroupUsers(ctx, group.ID, members); err != nil {
+		return nil, err
+	}
+
+	// Evict everyone who joined or left
+	for userID, joinedOrLeft := range changed {
+		if !joinedOrLeft {
+			continue
+		}
+		s.permissions.InvalidateMember(ctx, orgID, userID)
+		pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncOrganization, uuid.Nil, orgID)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("group_synced", "Group synced from directory")
+	metadata["group_id"] = group.ID.String()
+	metadata["external_id"] = externalID
+	metadata["members"] = len(members)
+	if err := s.createAuditLog(ctx, "group.synced", adminID, orgID, metadata); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// requireGroupRole checks that the role belongs to the organization and that the admin
+// may hand it out
+func (s *groupService) requireGroupRole(ctx context.Context, orgID, adminID, roleID uuid.UUID) error {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageRoles); err != nil {
+		return err
+	}
+	role, err := s.repo.GetRoleByID(ctx, roleID)
+	if err != nil {
+		return err
+	}
+	if role == nil || role.OrganizationID != orgID {
+		return fmt.Errorf("%w: unknown role %s", ErrInvalidOperation, roleID)
+	}
+	return nil
+}
+
+// requireJoinGroup checks that the admin may add members to the group. Members of a
+// group with a role gain its permissions, so handing them out needs manage_roles, as
+// giving the group the role did.
+func (s *groupService) requireJoinGroup(ctx context.Context, orgID, adminID uuid.UUID, group *models.Group) error {
+	if group.RoleID == nil {
+		return nil
+	}
+	return s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageRoles)
+}
+
+// organizationGroup returns the group if it belongs to the organization
+func (s *groupService) organizationGroup(ctx context.Context, orgID, groupID uuid.UUID) (*models.Group, error) {
+	group, err := s.repo.GetGroup(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil || group.OrganizationID != orgID {
+		return nil, ErrGroupNotFound
+	}
+	return group, nil
+}
+
+// invalidateMembers forgets the cached permissions of the group's members
+func (s *groupService) invalidateMembers(ctx context.Context, orgID, groupID uuid.UUID) {
+	members, err := s.repo.ListGroupUsers(ctx, groupID)
+	if err != nil {
+		log.Printf("Failed to list members of group %s to evict their permissions: %v", groupID, err)
+		s.permissions.InvalidateOrganization(ctx, orgID)
+		return
+	}
+	for _, member := range members {
+		s.permissions.InvalidateMember(ctx, orgID, member.UserID)
+	}
+}
+
+// pushGroupMembers tells the group's members about a change to one of its collections.
+// The members may have just lost access, so the message goes to them directly.
+func (s *groupService) pushGroupMembers(ctx context.Context, orgID, groupID uuid.UUID, msgType PushType, id uuid.UUID) {
+	if s.push == nil {
+		return
+	}
+	members, err := s.repo.ListGroupUsers(ctx, groupID)
+	if err != nil {
+		log.Printf("Failed to list members of group %s to push %s: %v", groupID, msgType, err)
+		return
+	}
+	for _, member := range members {
+		pushSync(ctx, s.push, PushTarget{UserID: member.UserID, OrganizationID: orgID}, msgType, id, orgID)
+	}
+}
+
+func sameRole(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// HPKE (RFC 9180) base mode sealed boxes with DHKEM(X25519, HKDF-SHA256),
+// HKDF-SHA256 and AES-256-GCM. A sealed box is the encapsulated ephemeral
+// public key followed by the AEAD ciphertext.
+
+const (
+	hpkeKEMX25519HKDFSHA256 uint16 = 0x0020
+	hpkeKDFHKDFSHA256       uint16 = 0x0001
+	hpkeAEADAES256GCM       uint16 = 0x0002
+
+	hpkeModeBase     byte = 0x00
+	hpkeEncLength         = 32
+	hpkeSecretLength      = 32
+	hpkeKeyLength         = 32
+	hpkeNonceLength       = 12
+)
+
+// hpkeInfo binds sealed boxes to this application
+var hpkeInfo = []byte("passwordimmunity key wrap v1")
+
+var errHPKEMalformed = errors.New("malformed sealed box")
+
+func hpkeSeal(recipient *ecdh.PublicKey, plaintext, aad []byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return hpkeSealWithEphemeral(ephemeral, recipient, plaintext, aad)
+}
+
+func hpkeSealWithEphemeral(ephemeral *ecdh.PrivateKey, recipient *ecdh.PublicKey, plaintext, aad []byte) ([]byte, error) {
+	dh, err := ephemeral.ECDH(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := ephemeral.PublicKey().Bytes()
+	sharedSecret, err := hpkeExtractAndExpand(dh, enc, recipient.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	aead, nonce, err := hpkeKeySchedule(sharedSecret, hpkeInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(enc, nonce, plaintext, aad), nil
+}
+
+func hpkeOpen(recipient *ecdh.PrivateKey, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < hpkeEncLength {
+		return nil, errHPKEMalformed
+	}
+	enc, ciphertext := sealed[:hpkeEncLength], sealed[hpkeEncLength:]
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(enc)
+	if err != nil {
+		return nil, errHPKEMalformed
+	}
+
+	dh, err := recipient.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+
+	sharedSecret, err := hpkeExtractAndExpand(dh, enc, recipient.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	aead, nonce, err := hpkeKeySchedule(sharedSecret, hpkeInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+// hpkeExtractAndExpand derives the KEM shared secret from the DH output
+func hpkeExtractAndExpand(dh, enc, recipientPublicKey []byte) ([]byte, error) {
+	suiteID := hpkeKEMSuiteID()
+	kemContext := append(append([]byte{}, enc...), recipientPublicKey...)
+
+	prk := hpkeLabeledExtract(suiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(suiteID, prk, "shared_secret", kemContext, hpkeSecretLength)
+}
+
+// hpkeKeySchedule derives the AEAD and its base nonce for a single-shot base mode context
+func hpkeKeySchedule(sharedSecret, info []byte) (cipher.AEAD, []byte, error) {
+	suiteID := hpkeSuiteID()
+
+	pskIDHash := hpkeLabeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(suiteID, nil, "info_hash", info)
+	keyScheduleContext := append(append([]byte{hpkeModeBase}, pskIDHash...), infoHash...)
+
+	secret := hpkeLabeledExtract(suiteID, sharedSecret, "secret", nil)
+	key, err := hpkeLabeledExpand(suiteID, secret, "key", keyScheduleContext, hpkeKeyLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	baseNonce, err := hpkeLabeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, hpkeNonceLength)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Sequence number 0, so the nonce is the base nonce itself
+	return aead, baseNonce, nil
+}
+
+func hpkeLabeledExtract(suiteID, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := make([]byte, 0, 7+len(suiteID)+len(label)+len(ikm))
+	labeledIKM = append(labeledIKM, "HPKE-v1"...)
+	labeledIKM = append(labeledIKM, suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdf.Extract(sha256.New, labeledIKM, salt)
+}
+
+func hpkeLabeledExpand(suiteID, prk []byte, label string, info []byte, length int) ([]byte, error) {
+	labeledInfo := make([]byte, 2, 9+len(suiteID)+len(label)+len(info))
+	binary.BigEndian.PutUint16(labeledInfo, uint16(length))
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+
+	out := make([]byte, length)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, labeledInfo), out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func hpkeKEMSuiteID() []byte {
+	suiteID := []byte("KEM")
+	return binary.BigEndian.AppendUint16(suiteID, hpkeKEMX25519HKDFSHA256)
+}
+
+func hpkeSuiteID() []byte {
+	suiteID := []byte("HPKE")
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKEMX25519HKDFSHA256)
+	suiteID = binary.BigEndian.AppendUint16(suiteID, hpkeKDFHKDFSHA256)
+	return binary.BigEndian.AppendUint16(suiteID, hpkeAEADAES256GCM)
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrKeyConnectorNotEnabled = errors.New("key connector is not enabled for this user")
+	ErrKeyConnectorMigrated   = errors.New("user already unlocks with a key connector")
+)
+
+// keyConnectorTokenTTL is how long a client has to present a token to the key connector
+const keyConnectorTokenTTL = 5 * time.Minute
+
+// KeyConnectorTokenUse is the token_use claim of key connector tokens, so that the
+// connector cannot be handed a token meant for something else
+const KeyConnectorTokenUse = "key_connector"
+
+// KeyConnectorStatus tells the client how the user unlocks the vault. Required is set
+// when an organization's key_connector policy applies to a user who still has a master
+// password; the client then stores the user key with the connector at URL and calls
+// MigrateToKeyConnector.
+type KeyConnectorStatus struct {
+	Required       bool       `json:"required"`
+	Migrated       bool       `json:"migrated"`
+	OrganizationID *uuid.UUID `json:"organization_id,omitempty"`
+	URL            string     `json:"url,omitempty"`
+}
+
+// KeyConnectorToken authenticates the user to a key connector
+type KeyConnectorToken struct {
+	Token     string    `json:"token"`
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// KeyConnectorService lets members of organizations that run a key connector unlock
+// their vault without a master password. The connector holds the user keys; this server
+// only vouches for who is asking.
+type KeyConnectorService interface {
+	GetKeyConnectorStatus(ctx context.Context, userID uuid.UUID) (*KeyConnectorStatus, error)
+	// IssueKeyConnectorToken returns a short-lived token for the user's key connector
+	IssueKeyConnectorToken(ctx context.Context, userID uuid.UUID) (*KeyConnectorToken, error)
+	// MigrateToKeyConnector records that the client has stored the user key with the
+	// organization's key connector and removes the master password
+	MigrateToKeyConnector(ctx context.Context, userID, orgID uuid.UUID) error
+	// KeyConnectorJWKS returns the JSON Web Key Set key connectors verify tokens with
+	KeyConnectorJWKS() ([]byte, error)
+}
+
+type keyConnectorService struct {
+	repo     repository.Repository
+	policies PolicyService
+	tokens   *KeyConnectorTokenIssuer
+}
+
+func NewKeyConnectorService(repo repository.Repository, policies PolicyService, tokens *KeyConnectorTokenIssuer) KeyConnectorService {
+	return &keyConnectorService{
+		repo:     repo,
+		policies: policies,
+		tokens:   tokens,
+	}
+}
+
+func (s *keyConnectorService) GetKeyConnectorStatus(ctx context.Context, userID uuid.UUID) (*KeyConnectorStatus, error) {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+
+	if user.UsesKeyConnector {
+		status := &KeyConnectorStatus{
+			Migrated:       true,
+			OrganizationID: user.KeyConnectorOrganizationID,
+			URL:            user.KeyConnectorURL,
+		}
+		// Follow the connector if the organization moves it
+		if user.KeyConnectorOrganizationID != nil {
+			policy, err := s.policies.GetKeyConnectorPolicy(ctx, *user.KeyConnectorOrganizationID)
+			if err != nil {
+				return nil, err
+			}
+			if policy != nil && policy.URL != "" {
+				status.URL = policy.URL
+			}
+		}
+		return status, nil
+	}
+
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range memberships {
+		if member.Status != organizationMemberStatusConfirmed {
+			continue
+		}
+		policy, err := s.applicablePolicy(ctx, &member)
+		if err != nil {
+			return nil, err
+		}
+		if policy != nil {
+			orgID := member.OrganizationID
+			return &KeyConnectorStatus{Required: true, OrganizationID: &orgID, URL: policy.URL}, nil
+		}
+	}
+	return &KeyConnectorStatus{}, nil
+}
+
+// applicablePolicy returns the organization's key_connector policy if it applies to the
+// member
+func (s *keyConnectorService) applicablePolicy(ctx context.Context, member *models.OrganizationUser) (*KeyConnectorPolicySettings, error) {
+	policy, err := s.policies.GetKeyConnectorPolicy(ctx, member.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil || policy.URL == "" {
+		return nil, nil
+	}
+
+	// Members without a master password can only sign in with SSO
+	sso, err := s.repo.GetSSOConfiguration(ctx, member.OrganizationID)
+	if err != nil {
+		return nil, err
+	}
+	if sso == nil || !sso.Enabled {
+		return nil, nil
+	}
+
+	if len(policy.RoleIDs) == 0 {
+		return policy, nil
+	}
+	if member.RoleID != nil {
+		for _, roleID := range policy.RoleIDs {
+			if roleID == *member.RoleID {
+				return policy, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (s *keyConnectorService) IssueKeyConnectorToken(ctx context.Context, userID uuid.UUID) (*KeyConnectorToken, error) {
+	status, err := s.GetKeyConnectorStatus(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if (!status.Required && !status.Migrated) || status.URL == "" {
+		return nil, ErrKeyConnectorNotEnabled
+	}
+
+	token, expiresAt, err := s.tokens.Issue(userID, status.URL, keyConnectorTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyConnectorToken{Token: token, URL: status.URL, ExpiresAt: expiresAt}, nil
+}
+
+func (s *keyConnectorService) MigrateToKeyConnector(ctx context.Context, userID, orgID uuid.UUID) error {
+	status, err := s.GetKeyConnectorStatus(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if status.Migrated {
+		return ErrKeyConnectorMigrated
+	}
+	if !status.Required || *status.OrganizationID != orgID {
+		return ErrKeyConnectorNotEnabled
+	}
+
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+	user.UsesKeyConnector = true
+	user.KeyConnectorOrganizationID = &orgID
+	user.KeyConnectorURL = status.URL
+	user.PasswordHash = ""
+	if err := s.repo.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("key_connector_migrated", "User migrated to key connector unlock")
+	metadata["url"] = status.URL
+	return s.createAuditLog(ctx, "user.key_connector_migrated", userID, orgID, metadata)
+}
+
+func (s *keyConnectorService) KeyConnectorJWKS() ([]byte, error) {
+	return s.tokens.JWKS()
+}
+
+// KeyConnectorTokenIssuer signs the ES256 tokens key connectors accept. The subject is
+// the user ID and the audience the connector's URL.
+type KeyConnectorTokenIssuer struct {
+	key    *ecdsa.PrivateKey
+	issuer string
+	keyID  string
+}
+
+// NewKeyConnectorTokenIssuer creates an issuer signing with a P-256 key. issuer is this
+// server's public URL.
+func NewKeyConnectorTokenIssuer(key *ecdsa.PrivateKey, issuer string) (*KeyConnectorTokenIssuer, error) {
+	if key == nil || key.Curve != elliptic.P256() {
+		return nil, errors.New("key connector tokens need a P-256 signing key")
+	}
+	// The key ID is the RFC 7638 thumbprint of the public key
+	thumbprint, err := json.Marshal(struct {
+		Crv string `json:"crv"`
+		Kty string `json:"kty"`
+		X   string `json:"x"`
+		Y   string `json:"y"`
+	}{"P-256", "EC", jwkCoordinate(key.X.Bytes()), jwkCoordinate(key.Y.Bytes())})
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(thumbprint)
+
+	return &KeyConnectorTokenIssuer{
+		key:    key,
+		issuer: issuer,
+		keyID:  base64.RawURLEncoding.EncodeToString(digest[:]),
+	}, nil
+}
+
+// Issue returns a token for the user valid for ttl at the key connector audience
+func (i *KeyConnectorTokenIssuer) Issue(userID uuid.UUID, audience string, ttl time.Duration) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(ttl)
+
+	header, err := json.Marshal(map[string]string{"alg": "ES256", "kid": i.keyID, "typ": "JWT"})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"iss":       i.issuer,
+		"sub":       userID.String(),
+		"aud":       audience,
+		"iat":       now.Unix(),
+		"exp":       expiresAt.Unix(),
+		"jti":       uuid.New().String(),
+		"token_use": KeyConnectorTokenUse,
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, sig, err := ecdsa.Sign(rand.Reader, i.key, digest[:])
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// JWS encodes the signature as the fixed-size r and s values
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	sig.FillBytes(signature[32:])
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), expiresAt, nil
+}
+
+// JWKS returns the issuer's public key as a JSON Web Key Set
+func (i *KeyConnectorTokenIssuer) JWKS() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"kid": i.keyID,
+			"alg": "ES256",
+			"use": "sig",
+			"x":   jwkCoordinate(i.key.X.Bytes()),
+			"y":   jwkCoordinate(i.key.Y.Bytes()),
+		}},
+	})
+}
+
+// jwkCoordinate encodes a P-256 coordinate padded to 32 bytes
+func jwkCoordinate(b []byte) string {
+	padded := make([]byte, 32)
+	copy(padded[32-len(b):], b)
+	return base64.RawURLEncoding.EncodeToString(padded)
+}
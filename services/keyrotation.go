@@ -3,94 +3,504 @@ package services
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
 	"github.com/google/uuid"
 )
 
+var (
+	ErrKeyNotFound = errors.New("encryption key not found")
+	ErrKeyInactive = errors.New("encryption key is not active")
+	ErrKeyExpired  = errors.New("encryption key has expired")
+
+	ErrKeyRotationInProgress = errors.New("key rotation already in progress")
+)
+
+const (
+	keyOwnerUser         = "user"
+	keyOwnerOrganization = "organization"
+
+	keyRotationBatchSize = 100
+	// keyRotationStaleAfter is how long a running organization rotation may go without
+	// saving its job before another server takes it over. Jobs are saved after every
+	// batch and phase, so only a server that stopped leaves a job this long.
+	keyRotationStaleAfter = 30 * time.Minute
+
+	keyRotationStatusRunning    = "running"
+	keyRotationStatusCompleted  = "completed"
+	keyRotationStatusFailed     = "failed"
+	keyRotationStatusRolledBack = "rolled_back"
+
+	keyRotationPhaseItems       = "items"
+	keyRotationPhaseFolders     = "folders"
+	keyRotationPhaseSends       = "sends"
+	keyRotationPhaseCollections = "collections"
+	keyRotationPhaseMembers     = "members"
+	keyRotationPhaseFinalize    = "finalize"
+)
+
+// userKeyRotationPhases lists the rotation phases in the order they are executed
+var userKeyRotationPhases = []string{
+	keyRotationPhaseItems,
+	keyRotationPhaseFolders,
+	keyRotationPhaseSends,
+	keyRotationPhaseFinalize,
+}
+
 type KeyRotationService interface {
 	RotateUserKeys(ctx context.Context, userID uuid.UUID) error
 	RotateOrganizationKeys(ctx context.Context, orgID uuid.UUID) error
 	GetCurrentKey(ctx context.Context, keyID uuid.UUID) ([]byte, error)
+	GetOrganizationKeyRotation(ctx context.Context, orgID uuid.UUID) (*models.KeyRotationJob, error)
+	SyncOrganizationKeys(ctx context.Context, userID uuid.UUID) error
+	// ResumeOrganizationKeyRotations finishes organization key rotations left running by
+	// a server that stopped, checking every interval until ctx is done
+	ResumeOrganizationKeyRotations(ctx context.Context, interval time.Duration)
+	EscrowUserKey(ctx context.Context, orgID, userID uuid.UUID) (string, error)
+	VerifyEscrowedUserKey(ctx context.Context, orgID, userID uuid.UUID, escrow string) error
+	WrapOrganizationKey(ctx context.Context, orgID uuid.UUID, publicKey []byte) (wrapped string, version int, err error)
+	GrantOrganizationKey(ctx context.Context, orgID, userID uuid.UUID, key []byte, version int, roleID *uuid.UUID) error
 }
 
 type keyRotationService struct {
-	repo        repository.Repository
-	encryption  EncryptionService
+	repo       repository.Repository
+	encryption EncryptionService
+	sessions   SessionService
+	masterKey  []byte
 }
 
-func NewKeyRotationService(repo repository.Repository, encryption EncryptionService) KeyRotationService {
+// NewKeyRotationService creates a key rotation service. User and organization keys
+// are stored wrapped with masterKey.
+func NewKeyRotationService(repo repository.Repository, encryption EncryptionService, sessions SessionService, masterKey []byte) KeyRotationService {
 	return &keyRotationService{
 		repo:       repo,
 		encryption: encryption,
+		sessions:   sessions,
+		masterKey:  masterKey,
 	}
 }
 
 type KeyMetadata struct {
-	Version     int       `json:"version"`
-	CreatedAt   time.Time `json:"created_at"`
-	ExpiresAt   time.Time `json:"expires_at"`
-	IsActive    bool      `json:"is_active"`
-	KeyType     string    `json:"key_type"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	IsActive  bool      `json:"is_active"`
+	KeyType   string    `json:"key_type"`
 }
 
+// RotateUserKeys replaces the user key and re-wraps everything encrypted with it.
+// Progress is persisted after every batch; calling it again after an interruption
+// resumes the pending rotation instead of starting a new one.
 func (s *keyRotationService) RotateUserKeys(ctx context.Context, userID uuid.UUID) error {
-	// Generate new key pair
-	publicKey, privateKey, err := s.encryption.GenerateKeyPair()
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	job, err := s.repo.GetUnfinishedKeyRotationJob(ctx, keyOwnerUser, userID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		job, err = s.startUserKeyRotation(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			// First key for this user, nothing to re-encrypt
+			return nil
+		}
+	}
+
+	oldKey, err := s.unwrapKeyByID(ctx, job.OldKeyID)
+	if err != nil {
+		return err
+	}
+	newKeyRecord, err := s.repo.GetEncryptionKey(ctx, job.NewKeyID)
+	if err != nil {
+		return err
+	}
+	if newKeyRecord == nil {
+		return ErrKeyNotFound
+	}
+	newKey, err := s.unwrapKey(newKeyRecord)
+	if err != nil {
+		return err
+	}
+
+	started := false
+	for _, phase := range userKeyRotationPhases {
+		if !started && phase != job.Phase {
+			continue
+		}
+		started = true
+
+		if job.Phase != phase {
+			job.Phase = phase
+			if err := s.repo.UpdateKeyRotationJob(ctx, job); err != nil {
+				return err
+			}
+		}
+
+		if err := s.runUserRotationPhase(ctx, job, user, newKeyRecord, oldKey, newKey); err != nil {
+			job.Error = err.Error()
+			if updateErr := s.repo.UpdateKeyRotationJob(ctx, job); updateErr != nil {
+				return updateErr
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *keyRotationService) runUserRotationPhase(ctx context.Context, job *models.KeyRotationJob, user *models.User, newKeyRecord *models.EncryptionKey, oldKey, newKey []byte) error {
+	switch job.Phase {
+	case keyRotationPhaseItems:
+		return s.reencryptVaultItems(ctx, job, oldKey, newKey, newKeyRecord.Version)
+	case keyRotationPhaseFolders:
+		return s.reencryptFolders(ctx, job, oldKey, newKey, newKeyRecord.Version)
+	case keyRotationPhaseSends:
+		return s.reencryptSends(ctx, job, oldKey, newKey, newKeyRecord.Version)
+	case keyRotationPhaseFinalize:
+		return s.finalizeUserKeyRotation(ctx, job, user, newKeyRecord, oldKey, newKey)
+	default:
+		return ErrInvalidOperation
+	}
+}
+
+// startUserKeyRotation stores a new, inactive user key and the job that tracks its rollout.
+// It returns a nil job when the user had no key yet and the new key was activated directly.
+func (s *keyRotationService) startUserKeyRotation(ctx context.Context, userID uuid.UUID) (*models.KeyRotationJob, error) {
+	current, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerUser, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 1
+	algorithm := DefaultKeyAlgorithm
+	if current != nil {
+		version = current.Version + 1
+		algorithm = s.keyAlgorithmOf(current)
+	}
+
+	newKey, err := s.generateKey(keyOwnerUser, userID, version, algorithm)
 	if err != nil {
+		return nil, err
+	}
+
+	if current == nil {
+		// The first key is stored active, so that a failure leaves no key behind
+		if err := markKeyActive(newKey); err != nil {
+			return nil, err
+		}
+		return nil, s.repo.CreateEncryptionKey(ctx, newKey)
+	}
+
+	job := &models.KeyRotationJob{
+		OwnerType: keyOwnerUser,
+		OwnerID:   userID,
+		OldKeyID:  current.ID,
+		Status:    keyRotationStatusRunning,
+		Phase:     keyRotationPhaseItems,
+	}
+	if err := s.repo.CreateKeyRotation(ctx, newKey, job); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	auditMetadata := createBasicMetadata("key_rotation_started", "User key rotation started")
+	auditMetadata["key_version"] = version
+	if err := s.createAuditLog(ctx, "key.rotation_started", userID, uuid.Nil, auditMetadata); err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// finalizeUserKeyRotation activates the new key, ends the sessions issued under the old
+// one and then sweeps up anything written with the old key while the rotation ran.
+// Sweeping only once the new key is active means nothing can be written with the old
+// key after the sweep; running the phase again after an interruption is safe.
+func (s *keyRotationService) finalizeUserKeyRotation(ctx context.Context, job *models.KeyRotationJob, user *models.User, newKeyRecord *models.EncryptionKey, oldKey, newKey []byte) error {
+	version := newKeyRecord.Version
+	if err := s.activateKey(ctx, newKeyRecord); err != nil {
+		return err
+	}
+	if user.KeyVersion != version {
+		user.KeyVersion = version
+		if err := s.repo.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+	}
+	if err := s.sessions.RetireKeyVersion(ctx, user.ID, SessionIDFromContext(ctx), version); err != nil {
+		return err
+	}
+
+	if err := s.reencryptVaultItems(ctx, job, oldKey, newKey, version); err != nil {
+		return err
+	}
+	if err := s.reencryptFolders(ctx, job, oldKey, newKey, version); err != nil {
+		return err
+	}
+	if err := s.reencryptSends(ctx, job, oldKey, newKey, version); err != nil {
+		return err
+	}
+	if err := s.refreshUserAccountRecoveryKeys(ctx, user.ID); err != nil {
 		return err
 	}
 
-	// Create key metadata
+	now := time.Now()
+	job.Status = keyRotationStatusCompleted
+	job.Error = ""
+	job.CompletedAt = &now
+	if err := s.repo.UpdateKeyRotationJob(ctx, job); err != nil {
+		return err
+	}
+
+	// Create audit log
+	auditMetadata := createBasicMetadata("key_rotation", "User encryption keys rotated")
+	auditMetadata["key_version"] = version
+	auditMetadata["records_reencrypted"] = job.Processed
+	return s.createAuditLog(ctx, "key.rotated", user.ID, uuid.Nil, auditMetadata)
+}
+
+func (s *keyRotationService) GetCurrentKey(ctx context.Context, keyID uuid.UUID) ([]byte, error) {
+	key, err := s.repo.GetEncryptionKey(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrKeyNotFound
+	}
+	if !key.IsActive {
+		return nil, ErrKeyInactive
+	}
+
+	if len(key.Metadata) > 0 {
+		var metadata KeyMetadata
+		if err := json.Unmarshal(key.Metadata, &metadata); err != nil {
+			return nil, err
+		}
+		if !metadata.ExpiresAt.IsZero() && time.Now().After(metadata.ExpiresAt) {
+			return nil, ErrKeyExpired
+		}
+	}
+
+	return s.unwrapKey(key)
+}
+
+// reencryptVaultItems re-wraps the item keys of the user's personal vault items in batches,
+// or their data and password when an item has no key of its own.
+// Items already at the new key version are skipped, which makes the step safe to resume.
+func (s *keyRotationService) reencryptVaultItems(ctx context.Context, job *models.KeyRotationJob, oldKey, newKey []byte, version int) error {
+	for {
+		items, err := s.repo.ListUserVaultItemsBelowKeyVersion(ctx, job.OwnerID, version, keyRotationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		for i := range items {
+			if items[i].EncryptedKey != "" {
+				items[i].EncryptedKey, err = s.rewrap(items[i].EncryptedKey, oldKey, newKey)
+			} else {
+				// Items without their own key are encrypted with the user key directly
+				items[i].EncryptedData, err = s.rewrap(items[i].EncryptedData, oldKey, newKey)
+				if err == nil && items[i].EncryptedPassword != "" {
+					items[i].EncryptedPassword, err = s.rewrap(items[i].EncryptedPassword, oldKey, newKey)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			items[i].KeyVersion = version
+		}
+
+		if err := s.repo.UpdateVaultItems(ctx, items); err != nil {
+			return err
+		}
+		if err := s.recordProgress(ctx, job, len(items)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *keyRotationService) reencryptFolders(ctx context.Context, job *models.KeyRotationJob, oldKey, newKey []byte, version int) error {
+	for {
+		folders, err := s.repo.ListFoldersBelowKeyVersion(ctx, job.OwnerID, version, keyRotationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(folders) == 0 {
+			return nil
+		}
+
+		for i := range folders {
+			folders[i].EncryptedName, err = s.rewrap(folders[i].EncryptedName, oldKey, newKey)
+			if err != nil {
+				return err
+			}
+			folders[i].KeyVersion = version
+		}
+
+		if err := s.repo.UpdateFolders(ctx, folders); err != nil {
+			return err
+		}
+		if err := s.recordProgress(ctx, job, len(folders)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *keyRotationService) reencryptSends(ctx context.Context, job *models.KeyRotationJob, oldKey, newKey []byte, version int) error {
+	for {
+		sends, err := s.repo.ListSendsBelowKeyVersion(ctx, job.OwnerID, version, keyRotationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(sends) == 0 {
+			return nil
+		}
+
+		for i := range sends {
+			sends[i].EncryptedKey, err = s.rewrap(sends[i].EncryptedKey, oldKey, newKey)
+			if err != nil {
+				return err
+			}
+			sends[i].KeyVersion = version
+		}
+
+		if err := s.repo.UpdateSends(ctx, sends); err != nil {
+			return err
+		}
+		if err := s.recordProgress(ctx, job, len(sends)); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *keyRotationService) recordProgress(ctx context.Context, job *models.KeyRotationJob, processed int) error {
+	job.Processed += processed
+	return s.repo.UpdateKeyRotationJob(ctx, job)
+}
+
+// rewrap decrypts ciphertext with oldKey and encrypts the plaintext with newKey
+func (s *keyRotationService) rewrap(ciphertext string, oldKey, newKey []byte) (string, error) {
+	plaintext, err := s.encryption.DecryptSymmetric([]byte(ciphertext), oldKey)
+	if err != nil {
+		return "", err
+	}
+
+	rewrapped, err := s.encryption.EncryptSymmetric(plaintext, newKey)
+	if err != nil {
+		return "", err
+	}
+	return string(rewrapped), nil
+}
+
+// generateKey creates a new symmetric key and key pair for the owner, wrapped for storage
+func (s *keyRotationService) generateKey(ownerType string, ownerID uuid.UUID, version int, algorithm KeyAlgorithm) (*models.EncryptionKey, error) {
+	symmetricKey, err := s.encryption.GenerateSymmetricKey()
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, privateKey, err := s.encryption.GenerateKeyPairWithAlgorithm(algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := s.encryption.EncryptSymmetric(symmetricKey, s.masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappedPrivateKey, err := s.encryption.EncryptSymmetric(privateKey, symmetricKey)
+	if err != nil {
+		return nil, err
+	}
+
 	metadata := KeyMetadata{
-		Version:   1,
+		Version:   version,
 		CreatedAt: time.Now(),
 		ExpiresAt: time.Now().AddDate(1, 0, 0), // 1 year expiration
-		IsActive:  true,
-		KeyType:   "user",
+		IsActive:  false,
+		KeyType:   ownerType,
 	}
 
 	metadataBytes, err := json.Marshal(metadata)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Create audit log
-	auditMetadata := createBasicMetadata("key_rotation", "User encryption keys rotated")
-	if err := s.createAuditLog(ctx, "key.rotated", userID, uuid.Nil, auditMetadata); err != nil {
+	return &models.EncryptionKey{
+		OwnerType:         ownerType,
+		OwnerID:           ownerID,
+		Version:           version,
+		WrappedKey:        string(wrappedKey),
+		PublicKey:         string(publicKey),
+		WrappedPrivateKey: string(wrappedPrivateKey),
+		Metadata:          metadataBytes,
+	}, nil
+}
+
+// activateKey makes the key the owner's only active key and records it in the key metadata
+func (s *keyRotationService) activateKey(ctx context.Context, key *models.EncryptionKey) error {
+	if err := markKeyActive(key); err != nil {
 		return err
 	}
+	return s.repo.ActivateEncryptionKey(ctx, key)
+}
 
-	// TODO: Implement key storage and rotation logic
-	// This would involve:
-	// 1. Storing the new keys securely
-	// 2. Re-encrypting existing vault items with new keys
-	// 3. Updating key references
-	// 4. Marking old keys as inactive
+// markKeyActive marks the key active, in its metadata as well, without storing it
+func markKeyActive(key *models.EncryptionKey) error {
+	var metadata KeyMetadata
+	if len(key.Metadata) > 0 {
+		if err := json.Unmarshal(key.Metadata, &metadata); err != nil {
+			return err
+		}
+	}
+	metadata.IsActive = true
 
+	metadataBytes, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	key.Metadata = metadataBytes
+	key.IsActive = true
 	return nil
 }
 
-func (s *keyRotationService) RotateOrganizationKeys(ctx context.Context, orgID uuid.UUID) error {
-	// Similar to RotateUserKeys but for organization-wide keys
-	// Would need to handle re-encryption of shared vault items
-	// and distribution of new keys to organization members
-	return nil
+// keyAlgorithmOf returns the algorithm of the key's public key so that a rotation keeps
+// the owner's algorithm; legacy RSA-2048 keys are replaced with RSA-4096 keys.
+func (s *keyRotationService) keyAlgorithmOf(key *models.EncryptionKey) KeyAlgorithm {
+	algorithm, err := s.encryption.KeyAlgorithmOf([]byte(key.PublicKey))
+	if err != nil || algorithm == KeyAlgorithmEd25519 {
+		return DefaultKeyAlgorithm
+	}
+	return algorithm
 }
 
-func (s *keyRotationService) GetCurrentKey(ctx context.Context, keyID uuid.UUID) ([]byte, error) {
-	// Retrieve and validate the current active key
-	// Implementation would depend on key storage mechanism
-	return nil, nil
-}
-
-// Helper function to re-encrypt vault items with new key
-func (s *keyRotationService) reencryptVaultItems(ctx context.Context, userID uuid.UUID, oldKey, newKey []byte) error {
-	// TODO: Implement re-encryption logic
-	// 1. Fetch all vault items for user
-	// 2. Decrypt with old key
-	// 3. Re-encrypt with new key
-	// 4. Update vault items with new encrypted data
-	return nil
+func (s *keyRotationService) unwrapKeyByID(ctx context.Context, keyID uuid.UUID) ([]byte, error) {
+	key, err := s.repo.GetEncryptionKey(ctx, keyID)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, ErrKeyNotFound
+	}
+	return s.unwrapKey(key)
+}
+
+func (s *keyRotationService) unwrapKey(key *models.EncryptionKey) ([]byte, error) {
+	return s.encryption.DecryptSymmetric([]byte(key.WrappedKey), s.masterKey)
 }
@@ -0,0 +1,157 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+var ErrStaleKeyEscrow = errors.New("escrowed key does not match the current user key")
+
+// EscrowUserKey wraps the user's active key with the organization's public key so that
+// the organization can recover the account
+func (s *keyRotationService) EscrowUserKey(ctx context.Context, orgID, userID uuid.UUID) (string, error) {
+	orgKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerOrganization, orgID)
+	if err != nil {
+		return "", err
+	}
+	if orgKey == nil {
+		return "", ErrKeyNotFound
+	}
+	return s.escrowUserKey(ctx, userID, orgKey)
+}
+
+// VerifyEscrowedUserKey opens an escrowed user key with the organization's private key
+// and checks that it is still the user's active key
+func (s *keyRotationService) VerifyEscrowedUserKey(ctx context.Context, orgID, userID uuid.UUID, escrow string) error {
+	orgKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerOrganization, orgID)
+	if err != nil {
+		return err
+	}
+	if orgKey == nil {
+		return ErrKeyNotFound
+	}
+
+	orgSymmetricKey, err := s.unwrapKey(orgKey)
+	if err != nil {
+		return err
+	}
+	privateKey, err := s.encryption.DecryptSymmetric([]byte(orgKey.WrappedPrivateKey), orgSymmetricKey)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(privateKey)
+
+	wrapped, err := base64.StdEncoding.DecodeString(escrow)
+	if err != nil {
+		return err
+	}
+	recovered, err := s.encryption.DecryptWithPrivateKey(wrapped, privateKey)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(recovered)
+
+	userKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerUser, userID)
+	if err != nil {
+		return err
+	}
+	if userKey == nil {
+		return ErrKeyNotFound
+	}
+	current, err := s.unwrapKey(userKey)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(current)
+
+	if subtle.ConstantTimeCompare(recovered, current) != 1 {
+		return ErrStaleKeyEscrow
+	}
+	return nil
+}
+
+func (s *keyRotationService) escrowUserKey(ctx context.Context, userID uuid.UUID, orgKey *models.EncryptionKey) (string, error) {
+	userKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerUser, userID)
+	if err != nil {
+		return "", err
+	}
+	if userKey == nil {
+		return "", ErrKeyNotFound
+	}
+
+	key, err := s.unwrapKey(userKey)
+	if err != nil {
+		return "", err
+	}
+	defer zeroBytes(key)
+
+	wrapped, err := s.encryption.EncryptWithPublicKey(key, []byte(orgKey.PublicKey))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// refreshAccountRecoveryKeys re-escrows the user keys of enrolled members with the given
+// organization key, so that account recovery keeps working across organization rotations
+func (s *keyRotationService) refreshAccountRecoveryKeys(ctx context.Context, orgID uuid.UUID, orgKey *models.EncryptionKey) error {
+	members, err := s.repo.ListOrganizationUsersByStatus(ctx, orgID, organizationMemberStatusConfirmed)
+	if err != nil {
+		return err
+	}
+
+	for i := range members {
+		if members[i].ResetPasswordKey == "" {
+			continue
+		}
+		if err := s.refreshAccountRecoveryKey(ctx, &members[i], orgKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshUserAccountRecoveryKeys re-escrows a user's new key in every organization the
+// user is enrolled in for account recovery
+func (s *keyRotationService) refreshUserAccountRecoveryKeys(ctx context.Context, userID uuid.UUID) error {
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range memberships {
+		if memberships[i].ResetPasswordKey == "" {
+			continue
+		}
+
+		orgKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerOrganization, memberships[i].OrganizationID)
+		if err != nil {
+			return err
+		}
+		if orgKey == nil {
+			continue
+		}
+		if err := s.refreshAccountRecoveryKey(ctx, &memberships[i], orgKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *keyRotationService) refreshAccountRecoveryKey(ctx context.Context, member *models.OrganizationUser, orgKey *models.EncryptionKey) error {
+	escrow, err := s.escrowUserKey(ctx, member.UserID, orgKey)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	member.ResetPasswordKey = escrow
+	return s.repo.UpdateOrganizationUser(ctx, member)
+}
@@ -0,0 +1,552 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+const organizationMemberStatusConfirmed = "confirmed"
+
+// RotateOrganizationKeys generates a new organization key and starts a background job
+// that re-encrypts collections and organization items and re-wraps the key to every
+// confirmed member. If any step fails, the job restores the previous key.
+// Progress can be followed with GetOrganizationKeyRotation.
+func (s *keyRotationService) RotateOrganizationKeys(ctx context.Context, orgID uuid.UUID) error {
+	org, err := s.repo.GetOrganizationByID(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	if org == nil {
+		return ErrInvalidOperation
+	}
+
+	running, err := s.repo.GetUnfinishedKeyRotationJob(ctx, keyOwnerOrganization, orgID)
+	if err != nil {
+		return err
+	}
+	if running != nil {
+		return ErrKeyRotationInProgress
+	}
+
+	current, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerOrganization, orgID)
+	if err != nil {
+		return err
+	}
+
+	version := 1
+	algorithm := DefaultKeyAlgorithm
+	job := &models.KeyRotationJob{
+		OwnerType: keyOwnerOrganization,
+		OwnerID:   orgID,
+		Status:    keyRotationStatusRunning,
+		Phase:     keyRotationPhaseItems,
+	}
+	if current != nil {
+		version = current.Version + 1
+		algorithm = s.keyAlgorithmOf(current)
+		job.OldKeyID = current.ID
+	}
+
+	newKey, err := s.generateKey(keyOwnerOrganization, orgID, version, algorithm)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.CreateKeyRotation(ctx, newKey, job); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("organization_key_rotation_started", "Organization key rotation started")
+	metadata["job_id"] = job.ID.String()
+	metadata["key_version"] = version
+	if err := s.createAuditLog(ctx, "organization.key_rotation_started", uuid.Nil, orgID, metadata); err != nil {
+		return err
+	}
+
+	go s.runOrganizationKeyRotation(context.WithoutCancel(ctx), job)
+
+	return nil
+}
+
+// GetOrganizationKeyRotation returns the most recent key rotation job of an organization
+func (s *keyRotationService) GetOrganizationKeyRotation(ctx context.Context, orgID uuid.UUID) (*models.KeyRotationJob, error) {
+	return s.repo.GetLatestKeyRotationJob(ctx, keyOwnerOrganization, orgID)
+}
+
+func (s *keyRotationService) ResumeOrganizationKeyRotations(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.resumeStaleOrganizationKeyRotations(ctx); err != nil {
+			log.Printf("Failed to resume organization key rotations: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resumeStaleOrganizationKeyRotations runs every stale rotation again from the start.
+// Each step skips what is already at the new key version, so work done before the
+// server stopped is not repeated; a rotation that fails is rolled back as usual.
+func (s *keyRotationService) resumeStaleOrganizationKeyRotations(ctx context.Context) error {
+	jobs, err := s.repo.ListStaleKeyRotationJobs(ctx, keyOwnerOrganization, time.Now().Add(-keyRotationStaleAfter))
+	if err != nil {
+		return err
+	}
+
+	for i := range jobs {
+		job := &jobs[i]
+		claimed, err := s.repo.ClaimKeyRotationJob(ctx, job)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			// Another server took it over or the job moved on
+			continue
+		}
+
+		log.Printf("Resuming organization key rotation %s", job.ID)
+		s.runOrganizationKeyRotation(ctx, job)
+	}
+	return nil
+}
+
+// SyncOrganizationKeys wraps the current organization keys for every confirmed membership
+// of the user that still holds an older key version. It is called on login, so members
+// who could not be reached during a rotation pick up the new key when they next sign in.
+func (s *keyRotationService) SyncOrganizationKeys(ctx context.Context, userID uuid.UUID) error {
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for i := range memberships {
+		member := &memberships[i]
+		if member.Status != organizationMemberStatusConfirmed {
+			continue
+		}
+
+		orgKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerOrganization, member.OrganizationID)
+		if err != nil {
+			return err
+		}
+		if orgKey == nil || member.KeyVersion >= orgKey.Version {
+			continue
+		}
+
+		key, err := s.unwrapKey(orgKey)
+		if err != nil {
+			return err
+		}
+		err = s.distributeKeyToMember(ctx, member, key, orgKey.Version)
+		if errors.Is(err, ErrKeyNotFound) {
+			// The user has no key pair yet
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// keySyncingSessions is a session service that gives users the organization keys they
+// missed whenever they sign in
+type keySyncingSessions struct {
+	SessionService
+	keys KeyRotationService
+}
+
+// NewKeySyncingSessionService wraps sessions so that every login also runs
+// SyncOrganizationKeys. Handlers that sign users in are given the wrapped service; the
+// key rotation service itself depends on the plain one.
+func NewKeySyncingSessionService(sessions SessionService, keys KeyRotationService) SessionService {
+	return &keySyncingSessions{
+		SessionService: sessions,
+		keys:           keys,
+	}
+}
+
+func (s *keySyncingSessions) CreateSession(ctx context.Context, userID, deviceID uuid.UUID, deviceInfo string) (*models.Session, error) {
+	session, err := s.SessionService.CreateSession(ctx, userID, deviceID, deviceInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	// The login still succeeds; the next one tries again
+	if err := s.keys.SyncOrganizationKeys(ctx, userID); err != nil {
+		log.Printf("Failed to sync organization keys of user %s: %v", userID, err)
+	}
+	return session, nil
+}
+
+// WrapOrganizationKey encrypts the organization's active key with the given public key
+// without exposing the key itself
+func (s *keyRotationService) WrapOrganizationKey(ctx context.Context, orgID uuid.UUID, publicKey []byte) (string, int, error) {
+	orgKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerOrganization, orgID)
+	if err != nil {
+		return "", 0, err
+	}
+	if orgKey == nil {
+		return "", 0, ErrKeyNotFound
+	}
+
+	key, err := s.unwrapKey(orgKey)
+	if err != nil {
+		return "", 0, err
+	}
+
+	wrapped, err := s.encryption.EncryptWithPublicKey(key, publicKey)
+	if err != nil {
+		return "", 0, err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), orgKey.Version, nil
+}
+
+// GrantOrganizationKey gives a user a confirmed membership holding the organization key.
+// It is used when the key was recovered outside the normal distribution path.
+func (s *keyRotationService) GrantOrganizationKey(ctx context.Context, orgID, userID uuid.UUID, key []byte, version int, roleID *uuid.UUID) error {
+	member, err := s.repo.GetOrganizationUser(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		member = &models.OrganizationUser{
+			UserID:         userID,
+			OrganizationID: orgID,
+			CreatedAt:      time.Now(),
+		}
+	}
+
+	member.Status = organizationMemberStatusConfirmed
+	if roleID != nil {
+		member.RoleID = roleID
+	}
+	return s.distributeKeyToMember(ctx, member, key, version)
+}
+
+func (s *keyRotationService) runOrganizationKeyRotation(ctx context.Context, job *models.KeyRotationJob) {
+	err := s.rotateOrganization(ctx, job)
+	if err == nil {
+		return
+	}
+
+	log.Printf("Organization key rotation %s failed: %v", job.ID, err)
+	s.rollbackOrganizationKeyRotation(ctx, job, err)
+}
+
+func (s *keyRotationService) rotateOrganization(ctx context.Context, job *models.KeyRotationJob) error {
+	newKeyRecord, err := s.repo.GetEncryptionKey(ctx, job.NewKeyID)
+	if err != nil {
+		return err
+	}
+	if newKeyRecord == nil {
+		return ErrKeyNotFound
+	}
+	newKey, err := s.unwrapKey(newKeyRecord)
+	if err != nil {
+		return err
+	}
+
+	var oldKeyRecord *models.EncryptionKey
+	var oldKey []byte
+	if job.OldKeyID != uuid.Nil {
+		oldKeyRecord, err = s.repo.GetEncryptionKey(ctx, job.OldKeyID)
+		if err != nil {
+			return err
+		}
+		if oldKeyRecord == nil {
+			return ErrKeyNotFound
+		}
+		oldKey, err = s.unwrapKey(oldKeyRecord)
+		if err != nil {
+			return err
+		}
+
+		if err := s.setRotationPhase(ctx, job, keyRotationPhaseItems); err != nil {
+			return err
+		}
+		if err := s.reencryptOrganizationItems(ctx, job, oldKey, newKey, oldKeyRecord.Version, newKeyRecord.Version); err != nil {
+			return err
+		}
+
+		if err := s.setRotationPhase(ctx, job, keyRotationPhaseCollections); err != nil {
+			return err
+		}
+		if err := s.reencryptCollections(ctx, job, oldKey, newKey, oldKeyRecord.Version, newKeyRecord.Version); err != nil {
+			return err
+		}
+	}
+
+	if err := s.setRotationPhase(ctx, job, keyRotationPhaseMembers); err != nil {
+		return err
+	}
+	if err := s.distributeOrganizationKey(ctx, job.OwnerID, newKey, newKeyRecord.Version); err != nil {
+		return err
+	}
+	if err := s.wrapOrganizationKeyForRecovery(ctx, job.OwnerID, newKey, newKeyRecord.Version); err != nil {
+		return err
+	}
+	if err := s.refreshAccountRecoveryKeys(ctx, job.OwnerID, newKeyRecord); err != nil {
+		return err
+	}
+
+	if err := s.setRotationPhase(ctx, job, keyRotationPhaseFinalize); err != nil {
+		return err
+	}
+	if err := s.activateKey(ctx, newKeyRecord); err != nil {
+		return err
+	}
+
+	// Items and collections saved with the old key while the rotation ran are swept up
+	// once the new key is active, so nothing can be written with the old key after it
+	if oldKeyRecord != nil {
+		if err := s.reencryptOrganizationItems(ctx, job, oldKey, newKey, oldKeyRecord.Version, newKeyRecord.Version); err != nil {
+			return err
+		}
+		if err := s.reencryptCollections(ctx, job, oldKey, newKey, oldKeyRecord.Version, newKeyRecord.Version); err != nil {
+			return err
+		}
+	}
+
+	now := time.Now()
+	job.Status = keyRotationStatusCompleted
+	job.CompletedAt = &now
+	if err := s.repo.UpdateKeyRotationJob(ctx, job); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("organization_key_rotated", "Organization encryption keys rotated")
+	metadata["job_id"] = job.ID.String()
+	metadata["key_version"] = newKeyRecord.Version
+	metadata["records_reencrypted"] = job.Processed
+	return s.createAuditLog(ctx, "organization.key_rotated", uuid.Nil, job.OwnerID, metadata)
+}
+
+// rollbackOrganizationKeyRotation re-encrypts everything already moved to the new key
+// back to the previous key and restores the previous key for all members.
+func (s *keyRotationService) rollbackOrganizationKeyRotation(ctx context.Context, job *models.KeyRotationJob, cause error) {
+	job.Error = cause.Error()
+	job.Status = keyRotationStatusRolledBack
+	if err := s.restoreOrganizationKey(ctx, job); err != nil {
+		log.Printf("Rollback of organization key rotation %s failed: %v", job.ID, err)
+		job.Status = keyRotationStatusFailed
+		job.Error = errors.Join(cause, err).Error()
+	}
+
+	now := time.Now()
+	job.CompletedAt = &now
+	if err := s.repo.UpdateKeyRotationJob(ctx, job); err != nil {
+		log.Printf("Failed to update key rotation job %s: %v", job.ID, err)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("organization_key_rotation_failed", "Organization key rotation failed")
+	metadata["job_id"] = job.ID.String()
+	metadata["status"] = job.Status
+	metadata["error"] = job.Error
+	if err := s.createAuditLog(ctx, "organization.key_rotation_failed", uuid.Nil, job.OwnerID, metadata); err != nil {
+		log.Printf("Failed to create audit log: %v", err)
+	}
+}
+
+func (s *keyRotationService) restoreOrganizationKey(ctx context.Context, job *models.KeyRotationJob) error {
+	if job.OldKeyID == uuid.Nil {
+		// There was no previous key, so nothing was re-encrypted
+		return nil
+	}
+
+	oldKeyRecord, err := s.repo.GetEncryptionKey(ctx, job.OldKeyID)
+	if err != nil {
+		return err
+	}
+	if oldKeyRecord == nil {
+		return ErrKeyNotFound
+	}
+	oldKey, err := s.unwrapKey(oldKeyRecord)
+	if err != nil {
+		return err
+	}
+
+	newKeyRecord, err := s.repo.GetEncryptionKey(ctx, job.NewKeyID)
+	if err != nil {
+		return err
+	}
+	if newKeyRecord == nil {
+		return ErrKeyNotFound
+	}
+	newKey, err := s.unwrapKey(newKeyRecord)
+	if err != nil {
+		return err
+	}
+
+	if err := s.reencryptOrganizationItems(ctx, job, newKey, oldKey, newKeyRecord.Version, oldKeyRecord.Version); err != nil {
+		return err
+	}
+	if err := s.reencryptCollections(ctx, job, newKey, oldKey, newKeyRecord.Version, oldKeyRecord.Version); err != nil {
+		return err
+	}
+	if err := s.distributeOrganizationKey(ctx, job.OwnerID, oldKey, oldKeyRecord.Version); err != nil {
+		return err
+	}
+	if err := s.wrapOrganizationKeyForRecovery(ctx, job.OwnerID, oldKey, oldKeyRecord.Version); err != nil {
+		return err
+	}
+	if err := s.refreshAccountRecoveryKeys(ctx, job.OwnerID, oldKeyRecord); err != nil {
+		return err
+	}
+
+	return s.activateKey(ctx, oldKeyRecord)
+}
+
+func (s *keyRotationService) setRotationPhase(ctx context.Context, job *models.KeyRotationJob, phase string) error {
+	job.Phase = phase
+	return s.repo.UpdateKeyRotationJob(ctx, job)
+}
+
+// reencryptOrganizationItems moves organization vault items from one key version to another in batches
+func (s *keyRotationService) reencryptOrganizationItems(ctx context.Context, job *models.KeyRotationJob, fromKey, toKey []byte, fromVersion, toVersion int) error {
+	for {
+		items, err := s.repo.ListOrganizationVaultItemsByKeyVersion(ctx, job.OwnerID, fromVersion, keyRotationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(items) == 0 {
+			return nil
+		}
+
+		for i := range items {
+			if items[i].EncryptedKey != "" {
+				items[i].EncryptedKey, err = s.rewrap(items[i].EncryptedKey, fromKey, toKey)
+			} else {
+				items[i].EncryptedData, err = s.rewrap(items[i].EncryptedData, fromKey, toKey)
+				if err == nil && items[i].EncryptedPassword != "" {
+					items[i].EncryptedPassword, err = s.rewrap(items[i].EncryptedPassword, fromKey, toKey)
+				}
+			}
+			if err != nil {
+				return err
+			}
+			items[i].KeyVersion = toVersion
+		}
+
+		if err := s.repo.UpdateVaultItems(ctx, items); err != nil {
+			return err
+		}
+		if err := s.recordProgress(ctx, job, len(items)); err != nil {
+			return err
+		}
+	}
+}
+
+// reencryptCollections moves collection names from one key version to another in batches
+func (s *keyRotationService) reencryptCollections(ctx context.Context, job *models.KeyRotationJob, fromKey, toKey []byte, fromVersion, toVersion int) error {
+	for {
+		collections, err := s.repo.ListCollectionsByKeyVersion(ctx, job.OwnerID, fromVersion, keyRotationBatchSize)
+		if err != nil {
+			return err
+		}
+		if len(collections) == 0 {
+			return nil
+		}
+
+		for i := range collections {
+			collections[i].Name, err = s.rewrap(collections[i].Name, fromKey, toKey)
+			if err != nil {
+				return err
+			}
+			collections[i].KeyVersion = toVersion
+			collections[i].UpdatedAt = time.Now()
+		}
+
+		if err := s.repo.UpdateCollections(ctx, collections); err != nil {
+			return err
+		}
+		if err := s.recordProgress(ctx, job, len(collections)); err != nil {
+			return err
+		}
+	}
+}
+
+// distributeOrganizationKey wraps the key to every confirmed member's public key.
+// Members without a registered key pair are skipped and receive the key through
+// SyncOrganizationKeys once they have one.
+func (s *keyRotationService) distributeOrganizationKey(ctx context.Context, orgID uuid.UUID, key []byte, version int) error {
+	members, err := s.repo.ListOrganizationUsersByStatus(ctx, orgID, organizationMemberStatusConfirmed)
+	if err != nil {
+		return err
+	}
+
+	for i := range members {
+		err := s.distributeKeyToMember(ctx, &members[i], key, version)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *keyRotationService) distributeKeyToMember(ctx context.Context, member *models.OrganizationUser, key []byte, version int) error {
+	wrapped, err := s.wrapKeyForUser(ctx, member.UserID, key)
+	if err != nil {
+		return err
+	}
+
+	member.EncryptedKey = wrapped
+	member.KeyVersion = version
+	return s.repo.UpdateOrganizationUser(ctx, member)
+}
+
+// wrapKeyForUser encrypts the key with the user's active public key
+func (s *keyRotationService) wrapKeyForUser(ctx context.Context, userID uuid.UUID, key []byte) (string, error) {
+	userKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerUser, userID)
+	if err != nil {
+		return "", err
+	}
+	if userKey == nil || userKey.PublicKey == "" {
+		return "", ErrKeyNotFound
+	}
+
+	wrapped, err := s.encryption.EncryptWithPublicKey(key, []byte(userKey.PublicKey))
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// wrapOrganizationKeyForRecovery keeps the organization's recovery key able to unlock
+// the current organization key. Only the recovery public key is needed for this.
+func (s *keyRotationService) wrapOrganizationKeyForRecovery(ctx context.Context, orgID uuid.UUID, key []byte, version int) error {
+	recoveryKey, err := s.repo.GetActiveOrganizationRecoveryKey(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	if recoveryKey == nil {
+		return nil
+	}
+
+	wrapped, err := s.encryption.EncryptWithPublicKey(key, []byte(recoveryKey.PublicKey))
+	if err != nil {
+		return err
+	}
+
+	recoveryKey.WrappedOrgKey = base64.StdEncoding.EncodeToString(wrapped)
+	recoveryKey.OrgKeyVersion = version
+	return s.repo.UpdateOrganizationRecoveryKey(ctx, recoveryKey)
+}
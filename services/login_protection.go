@@ -0,0 +1,449 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrLoginThrottled = errors.New("too many failed sign-in attempts, try again later")
+	ErrAccountLocked  = errors.New("account is temporarily locked after too many failed sign-in attempts")
+)
+
+// Reasons passed to MetricsService.RecordAuthFailure
+const (
+	authFailureUnknownUser     = "unknown_user"
+	authFailureInvalidPassword = "invalid_password"
+	authFailureInvalidCode     = "invalid_2fa_code"
+	authFailureThrottled       = "throttled"
+	authFailureAccountLocked   = "account_locked"
+)
+
+// unknownUserPasswordHash is compared against when no account has the email, so that
+// unknown emails take as long to reject as wrong passwords
+var unknownUserPasswordHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+
+// LoginBlockedError is returned while a sign-in attempt is refused. It wraps
+// ErrLoginThrottled or ErrAccountLocked and tells the client when to retry.
+type LoginBlockedError struct {
+	Err     error
+	RetryAt time.Time
+}
+
+func (e *LoginBlockedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *LoginBlockedError) Unwrap() error {
+	return e.Err
+}
+
+// LoginProtectionConfig controls brute-force protection. After FreeAttempts failures
+// for an account (IPFreeAttempts for a client IP) each further attempt must wait
+// BaseDelay, doubling with every failure up to MaxDelay. An account is locked for
+// LockoutDuration after LockoutThreshold wrong passwords or TwoFactorLockoutThreshold
+// wrong two-factor codes. Counts start over after FailureWindow without failures.
+type LoginProtectionConfig struct {
+	FreeAttempts              int
+	IPFreeAttempts            int
+	BaseDelay                 time.Duration
+	MaxDelay                  time.Duration
+	LockoutThreshold          int
+	TwoFactorLockoutThreshold int
+	LockoutDuration           time.Duration
+	FailureWindow             time.Duration
+}
+
+var DefaultLoginProtectionConfig = LoginProtectionConfig{
+	FreeAttempts:              3,
+	IPFreeAttempts:            20,
+	BaseDelay:                 time.Second,
+	MaxDelay:                  15 * time.Minute,
+	LockoutThreshold:          10,
+	TwoFactorLockoutThreshold: 5,
+	LockoutDuration:           30 * time.Minute,
+	FailureWindow:             24 * time.Hour,
+}
+
+// LoginLockoutStatus describes the sign-in protection state of an account
+type LoginLockoutStatus struct {
+	Locked                  bool       `json:"locked"`
+	LockedUntil             *time.Time `json:"locked_until,omitempty"`
+	FailedAttempts          int        `json:"failed_attempts"`
+	FailedTwoFactorAttempts int        `json:"failed_two_factor_attempts"`
+}
+
+// LoginProtectionService throttles password and two-factor guessing. Attempts are
+// counted per account and per client IP, with separate counters for two-factor codes.
+// Each attempt is counted before the password or code is checked, so concurrent
+// attempts cannot slip past the back-off or lockout; a successful attempt takes its
+// count back. The client IP is read from the context (see ContextWithClientIP).
+type LoginProtectionService interface {
+	// AuthenticatePassword checks the master password for the account with the given
+	// email, refusing attempts while the account or client IP is throttled or locked
+	AuthenticatePassword(ctx context.Context, email, password string) (*models.User, error)
+	// CheckLockout returns an error while the account is locked. Sign-ins that do not
+	// check the master password, such as SSO and approved login requests, call it so
+	// that a lockout stops them as well.
+	CheckLockout(ctx context.Context, userID uuid.UUID) error
+	// CheckTwoFactor counts a two-factor attempt and returns an error if it may not be
+	// made now. The attempt counts as a failure until RecordTwoFactorSuccess.
+	CheckTwoFactor(ctx context.Context, userID uuid.UUID) error
+	// RecordTwoFactorFailure locks the account once its counted two-factor attempts
+	// reach the threshold
+	RecordTwoFactorFailure(ctx context.Context, userID uuid.UUID) error
+	RecordTwoFactorSuccess(ctx context.Context, userID uuid.UUID) error
+
+	GetLockoutStatus(ctx context.Context, orgID, adminID, memberID uuid.UUID) (*LoginLockoutStatus, error)
+	UnlockAccount(ctx context.Context, orgID, adminID, memberID uuid.UUID) error
+}
+
+type loginProtectionService struct {
+	repo        repository.Repository
+	email       EmailService
+	metrics     MetricsService
+	permissions PermissionResolver
+	config      LoginProtectionConfig
+}
+
+func NewLoginProtectionService(
+	repo repository.Repository,
+	email EmailService,
+	metrics MetricsService,
+	permissions PermissionResolver,
+	config LoginProtectionConfig,
+) LoginProtectionService {
+	return &loginProtectionService{
+		repo:        repo,
+		email:       email,
+		metrics:     metrics,
+		permissions: permissions,
+		config:      config,
+	}
+}
+
+type clientIPContextKey struct{}
+
+// ContextWithClientIP returns a context carrying the IP address of the client
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPContextKey{}, ip)
+}
+
+// ClientIPFromContext returns the IP address of the client, or an empty string
+func ClientIPFromContext(ctx context.Context) string {
+	if ip, ok := ctx.Value(clientIPContextKey{}).(string); ok {
+		return ip
+	}
+	return ""
+}
+
+func (s *loginProtectionService) AuthenticatePassword(ctx context.Context, email, password string) (*models.User, error) {
+	ip := ipKey(ClientIPFromContext(ctx))
+	if _, err := s.reserveAttempt(ctx, ip, s.config.IPFreeAttempts, 0); err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.GetUserByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, s.rejectUnknownEmail(ctx, email, password)
+	}
+
+	if err := s.checkLockout(ctx, accountKeys(user.ID)...); err != nil {
+		return nil, err
+	}
+	key := generateAuthRateLimitKey(user.ID)
+	attempts, err := s.reserveAttempt(ctx, key, s.config.FreeAttempts, s.config.LockoutThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		s.metrics.RecordAuthFailure(ctx, authFailureInvalidPassword)
+		if err := s.lockAtThreshold(ctx, user, key, attempts, s.config.LockoutThreshold); err != nil {
+			return nil, err
+		}
+		return nil, ErrInvalidPassword
+	}
+
+	if err := s.repo.DeleteAuthFailureCounters(ctx, key); err != nil {
+		return nil, err
+	}
+	s.releaseAttempt(ctx, ip)
+	return user, nil
+}
+
+func (s *loginProtectionService) CheckLockout(ctx context.Context, userID uuid.UUID) error {
+	return s.checkLockout(ctx, accountKeys(userID)...)
+}
+
+func (s *loginProtectionService) CheckTwoFactor(ctx context.Context, userID uuid.UUID) error {
+	if _, err := s.reserveAttempt(ctx, twoFactorKey(ipKey(ClientIPFromContext(ctx))), s.config.IPFreeAttempts, 0); err != nil {
+		return err
+	}
+	if err := s.checkLockout(ctx, accountKeys(userID)...); err != nil {
+		return err
+	}
+	_, err := s.reserveAttempt(ctx, twoFactorKey(generateAuthRateLimitKey(userID)), s.config.FreeAttempts, s.config.TwoFactorLockoutThreshold)
+	return err
+}
+
+func (s *loginProtectionService) RecordTwoFactorFailure(ctx context.Context, userID uuid.UUID) error {
+	s.metrics.RecordAuthFailure(ctx, authFailureInvalidCode)
+
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return ErrUserNotFound
+	}
+
+	// The failure was counted by CheckTwoFactor
+	key := twoFactorKey(generateAuthRateLimitKey(userID))
+	counter, err := s.repo.GetAuthFailureCounter(ctx, key)
+	if err != nil || counter == nil {
+		return err
+	}
+	return s.lockAtThreshold(ctx, user, key, counter.Failures, s.config.TwoFactorLockoutThreshold)
+}
+
+func (s *loginProtectionService) RecordTwoFactorSuccess(ctx context.Context, userID uuid.UUID) error {
+	if err := s.repo.DeleteAuthFailureCounters(ctx, twoFactorKey(generateAuthRateLimitKey(userID))); err != nil {
+		return err
+	}
+	s.releaseAttempt(ctx, twoFactorKey(ipKey(ClientIPFromContext(ctx))))
+	return nil
+}
+
+func (s *loginProtectionService) GetLockoutStatus(ctx context.Context, orgID, adminID, memberID uuid.UUID) (*LoginLockoutStatus, error) {
+	if err := requireMemberPermission(ctx, s.permissions, s.repo, orgID, adminID, memberID, PermissionUnlockAccounts); err != nil {
+		return nil, err
+	}
+
+	status := &LoginLockoutStatus{}
+	for _, key := range accountKeys(memberID) {
+		counter, err := s.repo.GetAuthFailureCounter(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if counter == nil {
+			continue
+		}
+
+		if key == generateAuthRateLimitKey(memberID) {
+			status.FailedAttempts = counter.Failures
+		} else {
+			status.FailedTwoFactorAttempts = counter.Failures
+		}
+		if counter.LockedUntil != nil && time.Now().Before(*counter.LockedUntil) {
+			if status.LockedUntil == nil || counter.LockedUntil.After(*status.LockedUntil) {
+				status.LockedUntil = counter.LockedUntil
+			}
+			status.Locked = true
+		}
+	}
+	return status, nil
+}
+
+// UnlockAccount clears the member's lockout and failure counts
+func (s *loginProtectionService) UnlockAccount(ctx context.Context, orgID, adminID, memberID uuid.UUID) error {
+	if err := requireMemberPermission(ctx, s.permissions, s.repo, orgID, adminID, memberID, PermissionUnlockAccounts); err != nil {
+		return err
+	}
+
+	if err := s.repo.DeleteAuthFailureCounters(ctx, accountKeys(memberID)...); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("account_unlocked", "Account sign-in lockout cleared by admin")
+	metadata["member_id"] = memberID.String()
+	return s.createAuditLog(ctx, "organization.account_unlocked", adminID, orgID, metadata)
+}
+
+// reserveAttempt counts an attempt under the key before it is checked and returns the
+// count including it. The attempt is refused while the back-off for the attempts before
+// it has not passed, or when lockoutThreshold attempts are already being checked; a
+// refused attempt still counts. A zero lockoutThreshold never locks.
+func (s *loginProtectionService) reserveAttempt(ctx context.Context, key string, freeAttempts, lockoutThreshold int) (int, error) {
+	if key == "" {
+		return 0, nil
+	}
+
+	counter, previous, err := s.repo.ReserveAuthAttempt(ctx, key, time.Now().Add(-s.config.FailureWindow))
+	if err != nil {
+		return 0, err
+	}
+	// The key may have been locked after the caller checked it
+	if counter.LockedUntil != nil && time.Now().Before(*counter.LockedUntil) {
+		s.metrics.RecordAuthFailure(ctx, authFailureAccountLocked)
+		return 0, &LoginBlockedError{Err: ErrAccountLocked, RetryAt: *counter.LockedUntil}
+	}
+	if counter.Failures <= 1 {
+		return counter.Failures, nil
+	}
+
+	if lockoutThreshold > 0 && counter.Failures > lockoutThreshold {
+		// An attempt reserved before this one reaches the threshold and locks the account
+		s.metrics.RecordAuthFailure(ctx, authFailureAccountLocked)
+		return 0, &LoginBlockedError{Err: ErrAccountLocked, RetryAt: counter.LastFailureAt.Add(s.config.LockoutDuration)}
+	}
+
+	// An attempt racing the first one of a counter has no earlier time to wait from
+	last := counter.LastFailureAt
+	if previous != nil {
+		last = *previous
+	}
+	if time.Now().Before(last.Add(s.backoffDelay(counter.Failures-1, freeAttempts))) {
+		s.metrics.RecordAuthFailure(ctx, authFailureThrottled)
+		return 0, &LoginBlockedError{
+			Err:     ErrLoginThrottled,
+			RetryAt: counter.LastFailureAt.Add(s.backoffDelay(counter.Failures, freeAttempts)),
+		}
+	}
+	return counter.Failures, nil
+}
+
+// releaseAttempt takes back an attempt counted under the key that succeeded. Errors are
+// logged rather than returned so that they do not fail the sign-in.
+func (s *loginProtectionService) releaseAttempt(ctx context.Context, key string) {
+	if key == "" {
+		return
+	}
+	if err := s.repo.ReleaseAuthAttempt(ctx, key); err != nil {
+		log.Printf("Failed to release sign-in attempt for %s: %v", key, err)
+	}
+}
+
+// backoffDelay is zero up to freeAttempts failures and then doubles from BaseDelay with
+// every further failure, capped at MaxDelay
+func (s *loginProtectionService) backoffDelay(failures, freeAttempts int) time.Duration {
+	if failures < freeAttempts {
+		return 0
+	}
+
+	delay := s.config.BaseDelay
+	for i := freeAttempts; i < failures && delay < s.config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > s.config.MaxDelay {
+		delay = s.config.MaxDelay
+	}
+	return delay
+}
+
+// checkLockout refuses the attempt while any of the counters is locked
+func (s *loginProtectionService) checkLockout(ctx context.Context, keys ...string) error {
+	for _, key := range keys {
+		counter, err := s.repo.GetAuthFailureCounter(ctx, key)
+		if err != nil {
+			return err
+		}
+		if counter != nil && counter.LockedUntil != nil && time.Now().Before(*counter.LockedUntil) {
+			s.metrics.RecordAuthFailure(ctx, authFailureAccountLocked)
+			return &LoginBlockedError{Err: ErrAccountLocked, RetryAt: *counter.LockedUntil}
+		}
+	}
+	return nil
+}
+
+// lockAtThreshold locks the account once the failed attempts counted under the key
+// reach threshold
+func (s *loginProtectionService) lockAtThreshold(ctx context.Context, user *models.User, key string, failures, threshold int) error {
+	if failures < threshold {
+		return nil
+	}
+
+	lockedUntil := time.Now().Add(s.config.LockoutDuration)
+	if err := s.repo.LockAuthFailureCounter(ctx, key, lockedUntil); err != nil {
+		return err
+	}
+	s.metrics.RecordAuthFailure(ctx, authFailureAccountLocked)
+
+	ip := ClientIPFromContext(ctx)
+	data := map[string]interface{}{
+		"Name":        user.Name,
+		"LockedUntil": lockedUntil,
+		"IP":          ip,
+		"TwoFactor":   key != generateAuthRateLimitKey(user.ID),
+	}
+	if err := s.email.SendTemplatedEmail(ctx, "account_locked", data, []string{user.Email}); err != nil {
+		log.Printf("Failed to notify user %s of account lockout: %v", user.ID, err)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("account_locked", "Account locked after too many failed sign-in attempts")
+	metadata["failures"] = failures
+	metadata["locked_until"] = lockedUntil
+	metadata["ip"] = ip
+	if err := s.createAuditLog(ctx, "user.account_locked", user.ID, uuid.Nil, metadata); err != nil {
+		log.Printf("Failed to create audit log: %v", err)
+	}
+	return nil
+}
+
+// rejectUnknownEmail answers a sign-in for an email without an account exactly like a
+// wrong password: attempts are counted under the email, back off and lock it at the
+// same thresholds, so responses do not reveal which emails are registered
+func (s *loginProtectionService) rejectUnknownEmail(ctx context.Context, email, password string) error {
+	key := unknownEmailKey(email)
+	if err := s.checkLockout(ctx, key); err != nil {
+		return err
+	}
+	attempts, err := s.reserveAttempt(ctx, key, s.config.FreeAttempts, s.config.LockoutThreshold)
+	if err != nil {
+		return err
+	}
+
+	bcrypt.CompareHashAndPassword(unknownUserPasswordHash, []byte(password))
+	s.metrics.RecordAuthFailure(ctx, authFailureUnknownUser)
+
+	if attempts >= s.config.LockoutThreshold {
+		if err := s.repo.LockAuthFailureCounter(ctx, key, time.Now().Add(s.config.LockoutDuration)); err != nil {
+			return err
+		}
+	}
+	return ErrInvalidPassword
+}
+
+// accountKeys returns the password and two-factor counter keys of an account
+func accountKeys(userID uuid.UUID) []string {
+	key := generateAuthRateLimitKey(userID)
+	return []string{key, twoFactorKey(key)}
+}
+
+// unknownEmailKey returns the counter key for an email without an account. The email
+// is hashed so that the counters do not keep a list of the addresses tried.
+func unknownEmailKey(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return "auth:email:" + hex.EncodeToString(sum[:])
+}
+
+// ipKey returns the counter key for a client IP, or an empty string if it is unknown
+func ipKey(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	return generateIPRateLimitKey(ip)
+}
+
+// twoFactorKey derives the two-factor counter key from a password counter key
+func twoFactorKey(key string) string {
+	if key == "" {
+		return ""
+	}
+	return key + ":2fa"
+}
@@ -0,0 +1,378 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+)
+
+var ErrSuspiciousLoginBlocked = errors.New("login blocked because it looks suspicious")
+
+// Login risk actions, from least to most strict
+const (
+	LoginRiskActionAllow            = "allow"
+	LoginRiskActionNotify           = "notify"
+	LoginRiskActionRequireTwoFactor = "require_2fa"
+	LoginRiskActionBlock            = "block"
+)
+
+// Login risk flags and the score each adds
+const (
+	LoginRiskFlagNewDevice        = "new_device"
+	LoginRiskFlagNewCountry       = "new_country"
+	LoginRiskFlagImpossibleTravel = "impossible_travel"
+)
+
+var loginRiskFlagScores = map[string]int{
+	LoginRiskFlagNewDevice:        30,
+	LoginRiskFlagNewCountry:       40,
+	LoginRiskFlagImpossibleTravel: 70,
+}
+
+const (
+	// defaultLoginRiskThreshold applies when no organization sets risk_threshold; any
+	// single flag reaches it
+	defaultLoginRiskThreshold = 30
+	// defaultMaxTravelSpeedKmh is roughly the cruising speed of an airliner
+	defaultMaxTravelSpeedKmh = 1000
+	// minImpossibleTravelKm ignores short distances, where GeoIP is too imprecise
+	minImpossibleTravelKm = 500
+	earthRadiusKm         = 6371
+)
+
+// LoginRiskAssessment is the outcome of scoring a login
+type LoginRiskAssessment struct {
+	Score    int          `json:"score"`
+	Flags    []string     `json:"flags"`
+	Action   string       `json:"action"`
+	Location *GeoLocation `json:"location,omitempty"`
+}
+
+// LoginRiskService scores each login against the user's known devices and previous
+// locations. It flags new devices, new countries and impossible travel, and applies the
+// strictest action required by the suspicious_login policies of the user's
+// organizations. Without a policy, flagged logins are notified.
+type LoginRiskService interface {
+	// AssessLogin scores a login that passed the password or passkey check and reports
+	// it if it looks suspicious. It returns ErrSuspiciousLoginBlocked if the login must
+	// be refused. The client IP is read from the context.
+	AssessLogin(ctx context.Context, user *models.User, deviceID uuid.UUID) (*LoginRiskAssessment, error)
+	// RecordLogin stores a login once it has fully succeeded, including any second
+	// factor, and marks the device as seen. Only recorded logins are compared against
+	// when later logins are assessed, so an attempt that was never finished cannot make
+	// a country or device look familiar.
+	RecordLogin(ctx context.Context, user *models.User, deviceID uuid.UUID) error
+}
+
+type loginRiskService struct {
+	repo     repository.Repository
+	policies PolicyService
+	devices  DeviceService
+	geoip    GeoIPResolver
+	email    EmailService
+}
+
+func NewLoginRiskService(
+	repo repository.Repository,
+	policies PolicyService,
+	devices DeviceService,
+	geoip GeoIPResolver,
+	email EmailService,
+) LoginRiskService {
+	return &loginRiskService{
+		repo:     repo,
+		policies: policies,
+		devices:  devices,
+		geoip:    geoip,
+		email:    email,
+	}
+}
+
+func (s *loginRiskService) AssessLogin(ctx context.Context, user *models.User, deviceID uuid.UUID) (*LoginRiskAssessment, error) {
+	ip := ClientIPFromContext(ctx)
+	assessment, orgIDs, _, err := s.assess(ctx, user.ID, deviceID, ip)
+	if err != nil {
+		return nil, err
+	}
+	if len(assessment.Flags) > 0 {
+		s.reportSuspiciousLogin(ctx, user, orgIDs, ip, assessment)
+	}
+
+	if assessment.Action == LoginRiskActionBlock {
+		return assessment, ErrSuspiciousLoginBlocked
+	}
+	return assessment, nil
+}
+
+func (s *loginRiskService) RecordLogin(ctx context.Context, user *models.User, deviceID uuid.UUID) error {
+	ip := ClientIPFromContext(ctx)
+	assessment, _, device, err := s.assess(ctx, user.ID, deviceID, ip)
+	if err != nil {
+		return err
+	}
+	return s.recordLogin(ctx, user.ID, device, ip, assessment)
+}
+
+// assess scores a login against the user's recorded logins and returns the assessment,
+// the user's organizations and their device, which is nil if it is unknown
+func (s *loginRiskService) assess(ctx context.Context, userID, deviceID uuid.UUID, ip string) (*LoginRiskAssessment, []uuid.UUID, *models.Device, error) {
+	assessment := &LoginRiskAssessment{Flags: []string{}, Action: LoginRiskActionAllow}
+	assessment.Location = s.locate(ip)
+
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var orgIDs []uuid.UUID
+	for _, membership := range memberships {
+		if membership.Status == organizationMemberStatusConfirmed {
+			orgIDs = append(orgIDs, membership.OrganizationID)
+		}
+	}
+	policies, err := s.loadPolicies(ctx, orgIDs)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	device, err := s.userDevice(ctx, userID, deviceID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// The first recorded login sets the baseline and is never flagged
+	previous, err := s.repo.GetLatestLoginEvent(ctx, userID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if previous != nil {
+		if device == nil || device.LastSeenAt == nil {
+			assessment.addFlag(LoginRiskFlagNewDevice)
+		}
+		if assessment.Location != nil {
+			seen, err := s.repo.HasLoginFromCountry(ctx, userID, assessment.Location.Country)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if !seen {
+				assessment.addFlag(LoginRiskFlagNewCountry)
+			}
+			if impossibleTravel(previous, assessment.Location, maxTravelSpeed(policies)) {
+				assessment.addFlag(LoginRiskFlagImpossibleTravel)
+			}
+		}
+	}
+	assessment.Action = loginRiskAction(policies, assessment.Score)
+	return assessment, orgIDs, device, nil
+}
+
+func (a *LoginRiskAssessment) addFlag(flag string) {
+	a.Flags = append(a.Flags, flag)
+	a.Score += loginRiskFlagScores[flag]
+	if a.Score > 100 {
+		a.Score = 100
+	}
+}
+
+// locate returns nil if the IP cannot be resolved; the login is then scored on its
+// device alone
+func (s *loginRiskService) locate(ip string) *GeoLocation {
+	if s.geoip == nil || ip == "" {
+		return nil
+	}
+	location, err := s.geoip.Lookup(ip)
+	if err != nil {
+		log.Printf("Failed to resolve location of %s: %v", ip, err)
+		return nil
+	}
+	return location
+}
+
+// loadPolicies returns the suspicious_login settings of each organization, using the
+// defaults for organizations without an enabled policy
+func (s *loginRiskService) loadPolicies(ctx context.Context, orgIDs []uuid.UUID) ([]SuspiciousLoginPolicySettings, error) {
+	defaults := SuspiciousLoginPolicySettings{
+		Action:            LoginRiskActionNotify,
+		RiskThreshold:     defaultLoginRiskThreshold,
+		MaxTravelSpeedKmh: defaultMaxTravelSpeedKmh,
+	}
+	if len(orgIDs) == 0 {
+		return []SuspiciousLoginPolicySettings{defaults}, nil
+	}
+
+	policies := make([]SuspiciousLoginPolicySettings, 0, len(orgIDs))
+	for _, orgID := range orgIDs {
+		settings, err := s.policies.GetSuspiciousLoginPolicy(ctx, orgID)
+		if err != nil {
+			return nil, err
+		}
+		if settings == nil {
+			policies = append(policies, defaults)
+			continue
+		}
+		if settings.Action == "" {
+			settings.Action = defaults.Action
+		}
+		if settings.RiskThreshold <= 0 {
+			settings.RiskThreshold = defaults.RiskThreshold
+		}
+		if settings.MaxTravelSpeedKmh <= 0 {
+			settings.MaxTravelSpeedKmh = defaults.MaxTravelSpeedKmh
+		}
+		policies = append(policies, *settings)
+	}
+	return policies, nil
+}
+
+// userDevice returns the device if it belongs to the user and is not blocked. It is
+// known if it has been seen at an earlier login.
+func (s *loginRiskService) userDevice(ctx context.Context, userID, deviceID uuid.UUID) (*models.Device, error) {
+	if deviceID == uuid.Nil {
+		return nil, nil
+	}
+
+	device, err := s.devices.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil || device.UserID != userID || device.Status == "blocked" {
+		return nil, nil
+	}
+	return device, nil
+}
+
+// recordLogin stores the login event and, unless the login is blocked, marks the
+// device as seen so that it is known next time
+func (s *loginRiskService) recordLogin(ctx context.Context, userID uuid.UUID, device *models.Device, ip string, assessment *LoginRiskAssessment) error {
+	event := &models.LoginEvent{
+		UserID:    userID,
+		IP:        ip,
+		RiskScore: assessment.Score,
+		Flags:     strings.Join(assessment.Flags, ","),
+		Action:    assessment.Action,
+	}
+	if assessment.Location != nil {
+		event.Country = assessment.Location.Country
+		event.City = assessment.Location.City
+		event.Latitude = assessment.Location.Latitude
+		event.Longitude = assessment.Location.Longitude
+	}
+	if device != nil {
+		event.DeviceID = &device.ID
+	}
+	if err := s.repo.CreateLoginEvent(ctx, event); err != nil {
+		return err
+	}
+
+	if device == nil || assessment.Action == LoginRiskActionBlock {
+		return nil
+	}
+	now := time.Now()
+	device.LastIP = ip
+	device.LastSeenAt = &now
+	return s.repo.UpdateDevice(ctx, device)
+}
+
+// reportSuspiciousLogin emails the user and writes a suspicious login audit event to
+// each of their organizations
+func (s *loginRiskService) reportSuspiciousLogin(ctx context.Context, user *models.User, orgIDs []uuid.UUID, ip string, assessment *LoginRiskAssessment) {
+	if assessment.Action != LoginRiskActionAllow {
+		data := map[string]interface{}{
+			"Name":     user.Name,
+			"Time":     time.Now(),
+			"IP":       ip,
+			"Location": assessment.Location,
+			"Flags":    assessment.Flags,
+			"Blocked":  assessment.Action == LoginRiskActionBlock,
+		}
+		if err := s.email.SendTemplatedEmail(ctx, "suspicious_login", data, []string{user.Email}); err != nil {
+			log.Printf("Failed to notify user %s of suspicious login: %v", user.ID, err)
+		}
+	}
+
+	if len(orgIDs) == 0 {
+		orgIDs = []uuid.UUID{uuid.Nil}
+	}
+	for _, orgID := range orgIDs {
+		// Create audit log
+		metadata := createBasicMetadata("suspicious_login", "Suspicious login detected")
+		metadata["ip"] = ip
+		metadata["flags"] = assessment.Flags
+		metadata["risk_score"] = assessment.Score
+		metadata["action"] = assessment.Action
+		if assessment.Location != nil {
+			metadata["country"] = assessment.Location.Country
+			metadata["city"] = assessment.Location.City
+		}
+		if err := s.createAuditLog(ctx, "user.suspicious_login", user.ID, orgID, metadata); err != nil {
+			log.Printf("Failed to create audit log: %v", err)
+		}
+	}
+}
+
+// loginRiskAction returns the strictest action among the policies whose threshold the
+// score reaches
+func loginRiskAction(policies []SuspiciousLoginPolicySettings, score int) string {
+	action := LoginRiskActionAllow
+	for _, policy := range policies {
+		if score >= policy.RiskThreshold && loginRiskActionRank(policy.Action) > loginRiskActionRank(action) {
+			action = policy.Action
+		}
+	}
+	return action
+}
+
+func loginRiskActionRank(action string) int {
+	switch action {
+	case LoginRiskActionNotify:
+		return 1
+	case LoginRiskActionRequireTwoFactor:
+		return 2
+	case LoginRiskActionBlock:
+		return 3
+	default:
+		return 0
+	}
+}
+
+// maxTravelSpeed returns the lowest speed limit among the policies
+func maxTravelSpeed(policies []SuspiciousLoginPolicySettings) float64 {
+	speed := float64(defaultMaxTravelSpeedKmh)
+	for _, policy := range policies {
+		if policy.MaxTravelSpeedKmh < speed {
+			speed = policy.MaxTravelSpeedKmh
+		}
+	}
+	return speed
+}
+
+// impossibleTravel reports whether getting from the previous login's location to the
+// current one would have required travelling faster than maxSpeedKmh
+func impossibleTravel(previous *models.LoginEvent, current *GeoLocation, maxSpeedKmh float64) bool {
+	if previous.Country == "" {
+		return false
+	}
+
+	distance := distanceKm(previous.Latitude, previous.Longitude, current.Latitude, current.Longitude)
+	if distance < minImpossibleTravelKm {
+		return false
+	}
+	hours := math.Max(time.Since(previous.CreatedAt).Hours(), 1.0/60)
+	return distance/hours > maxSpeedKmh
+}
+
+// distanceKm is the great-circle distance between two points
+func distanceKm(lat1, lon1, lat2, lon2 float64) float64 {
+	toRadians := func(degrees float64) float64 { return degrees * math.Pi / 180 }
+	dLat := toRadians(lat2 - lat1)
+	dLon := toRadians(lon2 - lon1)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRadians(lat1))*math.Cos(toRadians(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
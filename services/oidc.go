@@ -0,0 +1,188 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrInvalidOIDCDiscovery = errors.New("invalid OpenID Connect discovery document")
+	ErrOIDCExchangeFailed   = errors.New("authorization code exchange failed")
+	ErrInvalidIDToken       = errors.New("invalid ID token")
+)
+
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// OIDCConfig identifies this server as a client of an OpenID Connect provider
+type OIDCConfig struct {
+	// MetadataURL is the provider's issuer URL or its discovery document URL
+	MetadataURL  string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the authorization code
+	RedirectURL string
+	// Scopes defaults to openid, email and profile
+	Scopes []string
+}
+
+// OIDCClaims are the verified claims of an ID token. Raw holds every claim, for
+// mapping provider-specific ones.
+type OIDCClaims struct {
+	Issuer        string                 `json:"iss"`
+	Subject       string                 `json:"sub"`
+	Email         string                 `json:"email"`
+	EmailVerified bool                   `json:"-"`
+	Name          string                 `json:"name"`
+	Raw           map[string]interface{} `json:"-"`
+}
+
+// OIDCRelyingParty runs the authorization code flow with PKCE against one provider. It
+// holds no per-login state; the caller keeps the state, nonce and PKCE verifier between
+// the redirect and the callback.
+type OIDCRelyingParty struct {
+	verifier *oidc.IDTokenVerifier
+	oauth2   oauth2.Config
+	client   *http.Client
+}
+
+// oidcDiscoveryDocument is the part of the provider metadata the login flow needs
+type oidcDiscoveryDocument struct {
+	Issuer        string   `json:"issuer"`
+	AuthURL       string   `json:"authorization_endpoint"`
+	TokenURL      string   `json:"token_endpoint"`
+	UserInfoURL   string   `json:"userinfo_endpoint"`
+	JWKSURL       string   `json:"jwks_uri"`
+	Algorithms    []string `json:"id_token_signing_alg_values_supported"`
+	CodeChallenge []string `json:"code_challenge_methods_supported"`
+}
+
+// NewOIDCRelyingParty fetches the provider's discovery document. client may be nil to
+// use http.DefaultClient.
+func NewOIDCRelyingParty(ctx context.Context, config OIDCConfig, client *http.Client) (*OIDCRelyingParty, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	document, err := discoverOIDCProvider(ctx, config.MetadataURL, client)
+	if err != nil {
+		return nil, err
+	}
+	provider := (&oidc.ProviderConfig{
+		IssuerURL:   document.Issuer,
+		AuthURL:     document.AuthURL,
+		TokenURL:    document.TokenURL,
+		UserInfoURL: document.UserInfoURL,
+		JWKSURL:     document.JWKSURL,
+		Algorithms:  document.Algorithms,
+	}).NewProvider(oidc.ClientContext(ctx, client))
+
+	scopes := config.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+
+	return &OIDCRelyingParty{
+		verifier: provider.Verifier(&oidc.Config{ClientID: config.ClientID}),
+		oauth2: oauth2.Config{
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			Endpoint:     provider.Endpoint(),
+			RedirectURL:  config.RedirectURL,
+			Scopes:       scopes,
+		},
+		client: client,
+	}, nil
+}
+
+// discoverOIDCProvider fetches and checks the discovery document. When it is fetched from
+// the issuer's well-known location, the issuer it names must be that issuer.
+func discoverOIDCProvider(ctx context.Context, metadataURL string, client *http.Client) (*oidcDiscoveryDocument, error) {
+	if !strings.HasSuffix(metadataURL, oidcDiscoveryPath) {
+		metadataURL = strings.TrimSuffix(metadataURL, "/") + oidcDiscoveryPath
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %s", ErrInvalidOIDCDiscovery, metadataURL, resp.Status)
+	}
+
+	var document oidcDiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&document); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOIDCDiscovery, err)
+	}
+	if document.Issuer == "" || document.AuthURL == "" || document.TokenURL == "" || document.JWKSURL == "" {
+		return nil, fmt.Errorf("%w: missing issuer or endpoints", ErrInvalidOIDCDiscovery)
+	}
+	if strings.TrimSuffix(document.Issuer, "/") != strings.TrimSuffix(strings.TrimSuffix(metadataURL, oidcDiscoveryPath), "/") {
+		return nil, fmt.Errorf("%w: issuer %q does not match %s", ErrInvalidOIDCDiscovery, document.Issuer, metadataURL)
+	}
+	if len(document.CodeChallenge) > 0 && !contains(document.CodeChallenge, "S256") {
+		return nil, fmt.Errorf("%w: provider does not support S256 PKCE", ErrInvalidOIDCDiscovery)
+	}
+	return &document, nil
+}
+
+// AuthCodeURL returns the provider URL to send the user to. verifier is the PKCE code
+// verifier; only its S256 challenge leaves the server.
+func (rp *OIDCRelyingParty) AuthCodeURL(state, nonce, verifier string) string {
+	return rp.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+}
+
+// Exchange redeems the authorization code and verifies the ID token: its signature
+// against the provider's JWKS, issuer, audience, expiry and nonce.
+func (rp *OIDCRelyingParty) Exchange(ctx context.Context, code, verifier, nonce string) (*OIDCClaims, error) {
+	ctx = oidc.ClientContext(ctx, rp.client)
+
+	token, err := rp.oauth2.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCExchangeFailed, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok || rawIDToken == "" {
+		return nil, fmt.Errorf("%w: token response has no ID token", ErrInvalidIDToken)
+	}
+
+	idToken, err := rp.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if idToken.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+	if idToken.AccessTokenHash != "" {
+		if err := idToken.VerifyAccessToken(token.AccessToken); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+		}
+	}
+
+	var claims OIDCClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	if err := idToken.Claims(&claims.Raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIDToken, err)
+	}
+	// Some providers send email_verified as a string
+	switch verified := claims.Raw["email_verified"].(type) {
+	case bool:
+		claims.EmailVerified = verified
+	case string:
+		claims.EmailVerified = verified == "true"
+	}
+	return &claims, nil
+}
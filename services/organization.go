@@ -2,47 +2,49 @@ package services
 
 import (
 	"context"
+	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
 	"github.com/google/uuid"
 )
 
 func (s *service) CreateOrganization(ctx context.Context, name, orgType string, ownerID uuid.UUID) (*models.Organization, error) {
-	// Create organization
-	org := &models.Organization{
-		Name: name,
-		Type: orgType,
-	}
-
-	if err := s.repo.CreateOrganization(ctx, org); err != nil {
+	user, err := s.repo.GetUserByID(ctx, ownerID)
+	if err != nil {
 		return nil, err
 	}
-
-	// Create default admin role
-	adminRole := &models.Role{
-		Name:           "Admin",
-		Description:    "Organization Administrator",
-		OrganizationID: org.ID,
+	if user == nil {
+		return nil, ErrUserNotFound
 	}
 
-	if err := s.repo.CreateRole(ctx, adminRole); err != nil {
-		return nil, err
+	// The organization, its built-in roles and its owner are stored together so a
+	// failure leaves no organization without an owner
+	org := &models.Organization{
+		Base: models.Base{ID: uuid.New()},
+		Name: name,
+		Type: orgType,
 	}
-
-	// Add owner to organization with admin role
-	user, err := s.repo.GetUserByID(ctx, ownerID)
+	roles, err := s.templateRoles(ctx, org.ID)
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
-		return nil, ErrUserNotFound
+	created := make([]*models.Role, 0, len(RoleTemplates))
+	for _, template := range RoleTemplates {
+		created = append(created, roles[template.Name])
 	}
 
-	org.Users = append(org.Users, *user)
-	if err := s.repo.UpdateOrganization(ctx, org); err != nil {
+	owner := &models.OrganizationUser{
+		UserID:         ownerID,
+		OrganizationID: org.ID,
+		RoleID:         &roles[RoleOwner].ID,
+		Status:         organizationMemberStatusConfirmed,
+		CreatedAt:      time.Now(),
+	}
+	if err := s.repo.CreateOrganizationWithOwner(ctx, org, created, owner); err != nil {
 		return nil, err
 	}
 
+	pushSync(ctx, s.push, PushTarget{UserID: ownerID}, PushSyncOrganization, uuid.Nil, org.ID)
 	return org, nil
 }
 
@@ -71,8 +73,31 @@ func (s *service) AddUserToOrganization(ctx context.Context, orgID, userID, role
 		return ErrInvalidOperation
 	}
 
-	org.Users = append(org.Users, *user)
-	return s.repo.UpdateOrganization(ctx, org)
+	// The role is kept on the membership, where permissions are resolved from
+	member, err := s.repo.GetOrganizationUser(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		member = &models.OrganizationUser{
+			UserID:         userID,
+			OrganizationID: orgID,
+			Status:         organizationMemberStatusConfirmed,
+			CreatedAt:      time.Now(),
+		}
+	}
+	member.RoleID = &roleID
+	if err := s.repo.UpdateOrganizationUser(ctx, member); err != nil {
+		return err
+	}
+	s.permissions.InvalidateMember(ctx, orgID, userID)
+
+	if err := s.accountRecovery.ApplyAccountRecoveryPolicy(ctx, orgID, userID); err != nil {
+		return err
+	}
+
+	pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncOrganization, uuid.Nil, orgID)
+	return nil
 }
 
 func (s *service) RemoveUserFromOrganization(ctx context.Context, orgID, userID uuid.UUID) error {
@@ -84,14 +109,11 @@ func (s *service) RemoveUserFromOrganization(ctx context.Context, orgID, userID
 		return ErrInvalidOperation
 	}
 
-	// Filter out the user from the organization's users
-	var updatedUsers []models.User
-	for _, u := range org.Users {
-		if u.ID != userID {
-			updatedUsers = append(updatedUsers, u)
-		}
+	if err := s.repo.RemoveOrganizationUser(ctx, orgID, userID); err != nil {
+		return err
 	}
-	org.Users = updatedUsers
+	s.permissions.InvalidateMember(ctx, orgID, userID)
 
-	return s.repo.UpdateOrganization(ctx, org)
+	pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncOrganization, uuid.Nil, orgID)
+	return nil
 }
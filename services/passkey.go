@@ -0,0 +1,435 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrPasskeyNotFound            = errors.New("passkey not found")
+	ErrPasskeysUnavailable        = errors.New("passkeys are not configured on this server")
+	ErrPasskeyRegistrationExpired = errors.New("passkey registration has expired")
+	ErrPasskeyChallengeNotFound   = errors.New("passkey challenge not found or expired")
+)
+
+// PasskeyInfo describes a passkey without its credential or wrapped key
+type PasskeyInfo struct {
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	PRFEnabled bool       `json:"prf_enabled"`
+	CanUnlock  bool       `json:"can_unlock"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// PasskeyLoginChallenge carries the WebAuthn request options for a passwordless login
+type PasskeyLoginChallenge struct {
+	ChallengeID string                        `json:"challenge_id"`
+	ExpiresAt   time.Time                     `json:"expires_at"`
+	Options     *protocol.CredentialAssertion `json:"options"`
+}
+
+// PasskeyLoginResult is the outcome of a passwordless login. EncryptedUserKey is set
+// when the passkey can unlock the vault; otherwise the client asks for the master password.
+type PasskeyLoginResult struct {
+	User             *models.User `json:"-"`
+	PasskeyID        uuid.UUID    `json:"passkey_id"`
+	EncryptedUserKey string       `json:"encrypted_user_key,omitempty"`
+}
+
+// PasskeyService manages passkeys: discoverable WebAuthn credentials that sign a user in
+// without the master password and, with the PRF extension, unlock the vault. A passkey
+// login requires user verification, so it also satisfies two-factor authentication.
+type PasskeyService interface {
+	ListPasskeys(ctx context.Context, userID uuid.UUID) ([]PasskeyInfo, error)
+	BeginRegistration(ctx context.Context, userID uuid.UUID) (*protocol.CredentialCreation, error)
+	FinishRegistration(ctx context.Context, userID uuid.UUID, name string, response json.RawMessage, encryptedUserKey string) (*PasskeyInfo, error)
+	UpdatePasskeyUserKey(ctx context.Context, userID, passkeyID uuid.UUID, encryptedUserKey string) error
+	RemovePasskey(ctx context.Context, userID, passkeyID uuid.UUID) error
+
+	BeginLogin(ctx context.Context) (*PasskeyLoginChallenge, error)
+	FinishLogin(ctx context.Context, challengeID string, response json.RawMessage, deviceID uuid.UUID) (*PasskeyLoginResult, error)
+
+	ListMemberPasskeys(ctx context.Context, orgID, adminID, memberID uuid.UUID) ([]PasskeyInfo, error)
+	RevokeMemberPasskey(ctx context.Context, orgID, adminID, memberID, passkeyID uuid.UUID) error
+}
+
+// passkeyCeremony holds the WebAuthn session between the two steps of registration or
+// login. It lives in memory only.
+type passkeyCeremony struct {
+	userID    uuid.UUID
+	session   *webauthn.SessionData
+	expiresAt time.Time
+}
+
+type passkeyService struct {
+	repo        repository.Repository
+	webauthn    *WebAuthnRelyingParty
+	email       EmailService
+	risk        LoginRiskService
+	permissions PermissionResolver
+	mu          sync.Mutex
+	ceremonies  map[string]*passkeyCeremony
+}
+
+func NewPasskeyService(repo repository.Repository, relyingParty *WebAuthnRelyingParty, email EmailService, risk LoginRiskService, permissions PermissionResolver) PasskeyService {
+	return &passkeyService{
+		repo:        repo,
+		webauthn:    relyingParty,
+		email:       email,
+		risk:        risk,
+		permissions: permissions,
+		ceremonies:  make(map[string]*passkeyCeremony),
+	}
+}
+
+func (s *passkeyService) ListPasskeys(ctx context.Context, userID uuid.UUID) ([]PasskeyInfo, error) {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	return s.listPasskeys(ctx, user)
+}
+
+// BeginRegistration returns the options for creating a passkey. Only one registration
+// per user can be in progress.
+func (s *passkeyService) BeginRegistration(ctx context.Context, userID uuid.UUID) (*protocol.CredentialCreation, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysUnavailable
+	}
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := s.repo.ListPasskeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	options, session, err := s.webauthn.BeginPasskeyRegistration(user, passkeys)
+	if err != nil {
+		return nil, err
+	}
+	s.storeCeremony(passkeyRegistrationKey(userID), &passkeyCeremony{
+		userID:    userID,
+		session:   session,
+		expiresAt: time.Now().Add(twoFactorChallengeTTL),
+	})
+	return options, nil
+}
+
+// FinishRegistration verifies the new credential and stores the passkey. encryptedUserKey
+// is the user key wrapped with the PRF-derived key; it is ignored unless the
+// authenticator enabled PRF.
+func (s *passkeyService) FinishRegistration(ctx context.Context, userID uuid.UUID, name string, response json.RawMessage, encryptedUserKey string) (*PasskeyInfo, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysUnavailable
+	}
+
+	ceremony := s.takeCeremony(passkeyRegistrationKey(userID))
+	if ceremony == nil {
+		return nil, ErrPasskeyRegistrationExpired
+	}
+
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	passkeys, err := s.repo.ListPasskeys(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	passkey := &models.Passkey{UserID: userID, Name: name}
+	if err := s.webauthn.FinishPasskeyRegistration(user, passkeys, *ceremony.session, response, passkey); err != nil {
+		return nil, err
+	}
+	if passkey.PRFEnabled && encryptedUserKey != "" {
+		passkey.EncryptedUserKey = encryptedUserKey
+		passkey.UserKeyVersion = user.KeyVersion
+	}
+
+	if err := s.repo.CreatePasskey(ctx, passkey); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("passkey_registered", "Passkey registered")
+	metadata["passkey_id"] = passkey.ID.String()
+	metadata["prf_enabled"] = passkey.PRFEnabled
+	if err := s.createAuditLog(ctx, "user.passkey_registered", userID, uuid.Nil, metadata); err != nil {
+		return nil, err
+	}
+
+	info := passkeyInfo(passkey, user)
+	return &info, nil
+}
+
+// UpdatePasskeyUserKey stores a newly wrapped user key, e.g. after the user key was
+// rotated and the passkey could no longer unlock the vault
+func (s *passkeyService) UpdatePasskeyUserKey(ctx context.Context, userID, passkeyID uuid.UUID, encryptedUserKey string) error {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	passkey, err := s.getPasskey(ctx, userID, passkeyID)
+	if err != nil {
+		return err
+	}
+	if !passkey.PRFEnabled || encryptedUserKey == "" {
+		return ErrInvalidOperation
+	}
+
+	passkey.EncryptedUserKey = encryptedUserKey
+	passkey.UserKeyVersion = user.KeyVersion
+	return s.repo.UpdatePasskey(ctx, passkey)
+}
+
+func (s *passkeyService) RemovePasskey(ctx context.Context, userID, passkeyID uuid.UUID) error {
+	passkey, err := s.getPasskey(ctx, userID, passkeyID)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.DeletePasskey(ctx, passkey.ID); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("passkey_removed", "Passkey removed")
+	metadata["passkey_id"] = passkey.ID.String()
+	return s.createAuditLog(ctx, "user.passkey_removed", userID, uuid.Nil, metadata)
+}
+
+// BeginLogin starts a passwordless login. No user is named; the authenticator offers
+// the passkeys it holds for this site.
+func (s *passkeyService) BeginLogin(ctx context.Context) (*PasskeyLoginChallenge, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysUnavailable
+	}
+
+	options, session, err := s.webauthn.BeginPasskeyLogin()
+	if err != nil {
+		return nil, err
+	}
+	challengeID, err := generateChallengeID()
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := &PasskeyLoginChallenge{
+		ChallengeID: challengeID,
+		ExpiresAt:   time.Now().Add(twoFactorChallengeTTL),
+		Options:     options,
+	}
+	s.storeCeremony(passkeyLoginKey(challengeID), &passkeyCeremony{
+		session:   session,
+		expiresAt: challenge.ExpiresAt,
+	})
+	return challenge, nil
+}
+
+// FinishLogin verifies the assertion and returns the passkey's owner. The wrapped user
+// key is returned only if it wraps the current user key. The login is risk-scored like
+// a password login; a passkey already satisfies a policy that requires two factors.
+func (s *passkeyService) FinishLogin(ctx context.Context, challengeID string, response json.RawMessage, deviceID uuid.UUID) (*PasskeyLoginResult, error) {
+	if s.webauthn == nil {
+		return nil, ErrPasskeysUnavailable
+	}
+
+	ceremony := s.takeCeremony(passkeyLoginKey(challengeID))
+	if ceremony == nil {
+		return nil, ErrPasskeyChallengeNotFound
+	}
+
+	user, passkey, err := s.webauthn.FinishPasskeyLogin(*ceremony.session, response, func(userID uuid.UUID) (*models.User, []models.Passkey, error) {
+		user, err := s.repo.GetUserByID(ctx, userID)
+		if err != nil || user == nil {
+			return nil, nil, err
+		}
+		passkeys, err := s.repo.ListPasskeys(ctx, userID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return user, passkeys, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.risk.AssessLogin(ctx, user, deviceID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	passkey.LastUsedAt = &now
+	if err := s.repo.UpdatePasskey(ctx, passkey); err != nil {
+		return nil, err
+	}
+
+	result := &PasskeyLoginResult{User: user, PasskeyID: passkey.ID}
+	if canUnlock(passkey, user) {
+		result.EncryptedUserKey = passkey.EncryptedUserKey
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("passkey_login", "Signed in with a passkey")
+	metadata["passkey_id"] = passkey.ID.String()
+	metadata["vault_unlocked"] = result.EncryptedUserKey != ""
+	if err := s.createAuditLog(ctx, "user.passkey_login", user.ID, uuid.Nil, metadata); err != nil {
+		return nil, err
+	}
+	if err := s.risk.RecordLogin(ctx, user, deviceID); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ListMemberPasskeys lets an admin with the manage_passkeys permission see a member's passkeys
+func (s *passkeyService) ListMemberPasskeys(ctx context.Context, orgID, adminID, memberID uuid.UUID) ([]PasskeyInfo, error) {
+	if err := requireMemberPermission(ctx, s.permissions, s.repo, orgID, adminID, memberID, PermissionManagePasskeys); err != nil {
+		return nil, err
+	}
+	user, err := s.getUser(ctx, memberID)
+	if err != nil {
+		return nil, err
+	}
+	return s.listPasskeys(ctx, user)
+}
+
+// RevokeMemberPasskey lets an admin with the manage_passkeys permission delete a member's
+// passkey. The member is notified by email.
+func (s *passkeyService) RevokeMemberPasskey(ctx context.Context, orgID, adminID, memberID, passkeyID uuid.UUID) error {
+	if err := requireMemberPermission(ctx, s.permissions, s.repo, orgID, adminID, memberID, PermissionManagePasskeys); err != nil {
+		return err
+	}
+	user, err := s.getUser(ctx, memberID)
+	if err != nil {
+		return err
+	}
+	passkey, err := s.getPasskey(ctx, memberID, passkeyID)
+	if err != nil {
+		return err
+	}
+	if err := s.repo.DeletePasskey(ctx, passkey.ID); err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"Name":           user.Name,
+		"PasskeyName":    passkey.Name,
+		"OrganizationID": orgID,
+		"RevokedAt":      time.Now(),
+	}
+	if err := s.email.SendTemplatedEmail(ctx, "passkey_revoked", data, []string{user.Email}); err != nil {
+		log.Printf("Failed to notify user %s of passkey revocation: %v", user.ID, err)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("passkey_revoked", "Member passkey revoked by admin")
+	metadata["passkey_id"] = passkey.ID.String()
+	metadata["member_id"] = memberID.String()
+	return s.createAuditLog(ctx, "organization.passkey_revoked", adminID, orgID, metadata)
+}
+
+func (s *passkeyService) listPasskeys(ctx context.Context, user *models.User) ([]PasskeyInfo, error) {
+	passkeys, err := s.repo.ListPasskeys(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]PasskeyInfo, 0, len(passkeys))
+	for i := range passkeys {
+		infos = append(infos, passkeyInfo(&passkeys[i], user))
+	}
+	return infos, nil
+}
+
+func (s *passkeyService) getUser(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *passkeyService) getPasskey(ctx context.Context, userID, passkeyID uuid.UUID) (*models.Passkey, error) {
+	passkey, err := s.repo.GetPasskey(ctx, passkeyID)
+	if err != nil {
+		return nil, err
+	}
+	if passkey == nil || passkey.UserID != userID {
+		return nil, ErrPasskeyNotFound
+	}
+	return passkey, nil
+}
+
+func (s *passkeyService) storeCeremony(key string, ceremony *passkeyCeremony) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range s.ceremonies {
+		if now.After(c.expiresAt) {
+			delete(s.ceremonies, k)
+		}
+	}
+	s.ceremonies[key] = ceremony
+}
+
+func (s *passkeyService) takeCeremony(key string) *passkeyCeremony {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ceremony, ok := s.ceremonies[key]
+	if !ok {
+		return nil
+	}
+	delete(s.ceremonies, key)
+	if time.Now().After(ceremony.expiresAt) {
+		return nil
+	}
+	return ceremony
+}
+
+func passkeyRegistrationKey(userID uuid.UUID) string {
+	return "register:" + userID.String()
+}
+
+func passkeyLoginKey(challengeID string) string {
+	return "login:" + challengeID
+}
+
+// canUnlock reports whether the passkey's wrapped user key is for the current user key
+func canUnlock(passkey *models.Passkey, user *models.User) bool {
+	return passkey.PRFEnabled && passkey.EncryptedUserKey != "" && passkey.UserKeyVersion == user.KeyVersion
+}
+
+func passkeyInfo(passkey *models.Passkey, user *models.User) PasskeyInfo {
+	return PasskeyInfo{
+		ID:         passkey.ID,
+		Name:       passkey.Name,
+		PRFEnabled: passkey.PRFEnabled,
+		CanUnlock:  canUnlock(passkey, user),
+		CreatedAt:  passkey.CreatedAt,
+		LastUsedAt: passkey.LastUsedAt,
+	}
+}
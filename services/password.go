@@ -66,6 +66,16 @@ func (s *service) UpdateUserPassword(ctx context.Context, userID uuid.UUID, curr
 		return err
 	}
 
+	// Remembered devices must pass two-factor authentication again
+	if err := s.repo.DeleteTwoFactorRememberTokensForUser(ctx, user.ID); err != nil {
+		return err
+	}
+
+	// Sign out everywhere else, in case the old password was stolen
+	if err := s.sessions.RevokeOtherSessions(ctx, user.ID, SessionIDFromContext(ctx)); err != nil {
+		return err
+	}
+
 	// Create audit log
 	metadata := createBasicMetadata("password_changed", "User password changed")
 	if err := s.createAuditLog(ctx, AuditEventUserPasswordChanged, user.ID, uuid.Nil, metadata); err != nil {
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+)
+
+// permissionCacheTTL bounds how long a role or membership change on another server can
+// go unnoticed
+const permissionCacheTTL = 30 * time.Second
+
+// PermissionResolver answers whether a user may do something in an organization. A
+// user has a permission when they are a confirmed member whose role grants it.
+type PermissionResolver interface {
+	// HasPermission reports whether the user has the permission in the organization
+	HasPermission(ctx context.Context, userID, orgID uuid.UUID, permission string) (bool, error)
+	// RequirePermission returns ErrUnauthorized unless the user has every one of the
+	// permissions in the organization
+	RequirePermission(ctx context.Context, userID, orgID uuid.UUID, permissions ...string) error
+	// HasCollectionPermission reports whether the user has the permission in the
+	// collection's organization and was granted the collection
+	HasCollectionPermission(ctx context.Context, userID, collectionID uuid.UUID, permission string) (bool, error)
+	// OrganizationsWithPermission returns which of the organizations the user has the
+	// permission in, for list endpoints
+	OrganizationsWithPermission(ctx context.Context, userID uuid.UUID, orgIDs []uuid.UUID, permission string) (map[uuid.UUID]bool, error)
+	// CollectionsWithPermission returns which of the collections the user has the
+	// permission on, for list endpoints
+	CollectionsWithPermission(ctx context.Context, userID uuid.UUID, collectionIDs []uuid.UUID, permission string) (map[uuid.UUID]bool, error)
+	// InvalidateMember forgets the cached permissions of a member whose membership or
+	// role changed
+	InvalidateMember(ctx context.Context, orgID, userID uuid.UUID)
+	// InvalidateOrganization forgets the cached permissions of every member, after a
+	// role of the organization changed
+	InvalidateOrganization(ctx context.Context, orgID uuid.UUID)
+}
+
+// cachedPermissions is a member's permission set as kept in the cache. CachedAt lets
+// stale copies be ignored even if the cache keeps them longer.
+type cachedPermissions struct {
+	Permissions []string  `json:"permissions"`
+	CachedAt    time.Time `json:"cached_at"`
+}
+
+type permissionResolver struct {
+	repo  repository.Repository
+	cache CacheService
+}
+
+// NewPermissionResolver creates a permission resolver. cache may be nil; when set, each
+// member's permission set is cached briefly.
+func NewPermissionResolver(repo repository.Repository, cache CacheService) PermissionResolver {
+	return &permissionResolver{
+		repo:  repo,
+		cache: cache,
+	}
+}
+
+func (r *permissionResolver) HasPermission(ctx context.Context, userID, orgID uuid.UUID, permission string) (bool, error) {
+	permissions, err := r.memberPermissions(ctx, orgID, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, granted := range permissions {
+		if granted == permission {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *permissionResolver) RequirePermission(ctx context.Context, userID, orgID uuid.UUID, permissions ...string) error {
+	granted, err := r.memberPermissions(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	held := make(map[string]bool, len(granted))
+	for _, permission := range granted {
+		held[permission] = true
+	}
+	for _, permission := range permissions {
+		if !held[permission] {
+			return ErrUnauthorized
+		}
+	}
+	return nil
+}
+
+func (r *permissionResolver) HasCollectionPermission(ctx context.Context, userID, collectionID uuid.UUID, permission string) (bool, error) {
+	allowed, err := r.CollectionsWithPermission(ctx, userID, []uuid.UUID{collectionID}, permission)
+	if err != nil {
+		return false, err
+	}
+	return allowed[collectionID], nil
+}
+
+func (r *permissionResolver) OrganizationsWithPermission(ctx context.Context, userID uuid.UUID, orgIDs []uuid.UUID, permission string) (map[uuid.UUID]bool, error) {
+	allowed := make(map[uuid.UUID]bool, len(orgIDs))
+	if len(orgIDs) == 0 {
+		return allowed, nil
+	}
+	ids, err := r.repo.ListOrganizationsWithPermission(ctx, userID, orgIDs, permission)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return allowed, nil
+}
+
+func (r *permissionResolver) CollectionsWithPermission(ctx context.Context, userID uuid.UUID, collectionIDs []uuid.UUID, permission string) (map[uuid.UUID]bool, error) {
+	allowed := make(map[uuid.UUID]bool, len(collectionIDs))
+	if len(collectionIDs) == 0 {
+		return allowed, nil
+	}
+	ids, err := r.repo.ListCollectionsWithPermission(ctx, userID, collectionIDs, permission)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return allowed, nil
+}
+
+func (r *permissionResolver) InvalidateMember(ctx context.Context, orgID, userID uuid.UUID) {
+	if r.cache == nil {
+		return
+	}
+	if err := r.cache.Delete(ctx, generatePermissionCacheKey(orgID, userID)); err != nil {
+		log.Printf("Failed to evict cached permissions of %s: %v", userID, err)
+	}
+}
+
+func (r *permissionResolver) InvalidateOrganization(ctx context.Context, orgID uuid.UUID) {
+	if r.cache == nil {
+		return
+	}
+	members, err := r.repo.ListOrganizationUsersByStatus(ctx, orgID, organizationMemberStatusConfirmed)
+	if err != nil {
+		log.Printf("Failed to list members of %s to evict their permissions: %v", orgID, err)
+		return
+	}
+	for _, member := range members {
+		r.InvalidateMember(ctx, orgID, member.UserID)
+	}
+}
+
+// memberPermissions returns the member's permission set from the cache, or loads it
+// with a single query
+func (r *permissionResolver) memberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	key := generatePermissionCacheKey(orgID, userID)
+	if cached := r.getCachedPermissions(ctx, key); cached != nil {
+		return cached.Permissions, nil
+	}
+
+	permissions, err := r.repo.ListMemberPermissions(ctx, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if r.cache != nil {
+		cached := &cachedPermissions{Permissions: permissions, CachedAt: time.Now()}
+		if err := r.cache.Set(ctx, key, cached, permissionCacheTTL); err != nil {
+			log.Printf("Failed to cache permissions of %s: %v", userID, err)
+		}
+	}
+	return permissions, nil
+}
+
+func (r *permissionResolver) getCachedPermissions(ctx context.Context, key string) *cachedPermissions {
+	if r.cache == nil {
+		return nil
+	}
+	value, err := r.cache.Get(ctx, key)
+	if err != nil || value == nil {
+		return nil
+	}
+	cached, ok := value.(*cachedPermissions)
+	if !ok {
+		cached = &cachedPermissions{}
+		if err := decodeCachedValue(value, cached); err != nil {
+			return nil
+		}
+	}
+	if time.Since(cached.CachedAt) > permissionCacheTTL {
+		return nil
+	}
+	return cached
+}
+
+// requireMemberPermission checks that the admin has the permission in the organization
+// and that the member they act on is a confirmed member of it
+func requireMemberPermission(ctx context.Context, permissions PermissionResolver, repo repository.Repository, orgID, adminID, memberID uuid.UUID, permission string) error {
+	if err := permissions.RequirePermission(ctx, adminID, orgID, permission); err != nil {
+		return err
+	}
+	_, err := confirmedMember(ctx, repo, orgID, memberID)
+	return err
+}
+
+// confirmedMember returns the user's membership of the organization, or ErrUserNotFound
+// unless they are a confirmed member
+func confirmedMember(ctx context.Context, repo repository.Repository, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	member, err := repo.GetOrganizationUser(ctx, orgID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil || member.Status != organizationMemberStatusConfirmed {
+		return nil, ErrUserNotFound
+	}
+	return member, nil
+}
+
+func generatePermissionCacheKey(orgID, userID uuid.UUID) string {
+	return fmt.Sprintf("permissions:%s:%s", orgID, userID)
+}
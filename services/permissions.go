@@ -0,0 +1,145 @@
+package services
+
+// Permissions a role can grant in an organization. Migration 000021 seeds the permissions
+// table with this catalog; keep the two in step.
+const (
+	// PermissionCreateVaultItem allows adding items to the organization's vault
+	PermissionCreateVaultItem = "create_vault_item"
+	// PermissionReadVaultItems allows reading the organization's vault items
+	PermissionReadVaultItems = "read_vault_items"
+	// PermissionManageCollections allows creating, changing and deleting collections and
+	// granting members access to them
+	PermissionManageCollections = "manage_collections"
+	// PermissionManageMembers allows inviting and removing members and changing their role
+	PermissionManageMembers = "manage_members"
+	// PermissionManageGroups allows creating and changing groups and their members
+	PermissionManageGroups = "manage_groups"
+	// PermissionManageRoles allows creating roles and choosing their permissions
+	PermissionManageRoles = "manage_roles"
+	// PermissionManagePolicies allows enabling and configuring organization policies
+	PermissionManagePolicies = "manage_policies"
+	// PermissionViewAuditLogs allows reading the organization's audit log
+	PermissionViewAuditLogs = "view_audit_logs"
+	// PermissionManageSessions allows viewing and revoking the sessions organization members
+	// signed in to through the organization
+	PermissionManageSessions = "manage_sessions"
+	// PermissionUnlockAccounts allows viewing and clearing the sign-in lockout of organization members
+	PermissionUnlockAccounts = "unlock_accounts"
+	// PermissionApproveDevices allows reviewing the devices organization members sign in from
+	PermissionApproveDevices = "approve_devices"
+	// PermissionManageAccountRecovery allows resetting the master password of enrolled members
+	PermissionManageAccountRecovery = "manage_account_recovery"
+	// PermissionManageOrganizationRecovery allows setting up the organization recovery key
+	// and running a recovery with it
+	PermissionManageOrganizationRecovery = "manage_organization_recovery"
+	// PermissionManagePasskeys allows viewing and revoking the passkeys of organization members
+	PermissionManagePasskeys = "manage_passkeys"
+	// PermissionManageSSO allows viewing and changing an organization's SSO configuration
+	PermissionManageSSO = "manage_sso"
+)
+
+// PermissionInfo describes a permission of the catalog
+type PermissionInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// PermissionCatalog lists every permission a role can grant
+var PermissionCatalog = []PermissionInfo{
+	{PermissionCreateVaultItem, "Add items to the organization vault"},
+	{PermissionReadVaultItems, "Read items in the organization vault"},
+	{PermissionManageCollections, "Create, change and delete collections and grant access to them"},
+	{PermissionManageMembers, "Invite and remove members and change their role"},
+	{PermissionManageGroups, "Create and change groups and their members"},
+	{PermissionManageRoles, "Create roles and choose their permissions"},
+	{PermissionManagePolicies, "Enable and configure organization policies"},
+	{PermissionViewAuditLogs, "Read the organization audit log"},
+	{PermissionManageSessions, "View and revoke the sessions of members"},
+	{PermissionUnlockAccounts, "View and clear the sign-in lockout of members"},
+	{PermissionApproveDevices, "Approve or deny the new devices of members"},
+	{PermissionManageAccountRecovery, "Reset the master password of members enrolled in account recovery"},
+	{PermissionManageOrganizationRecovery, "Set up the organization recovery key and run a recovery"},
+	{PermissionManagePasskeys, "View and revoke the passkeys of members"},
+	{PermissionManageSSO, "View and change the single sign-on configuration"},
+}
+
+// IsKnownPermission reports whether the permission is part of the catalog
+func IsKnownPermission(name string) bool {
+	for _, permission := range PermissionCatalog {
+		if permission.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleTemplate is a built-in role created for every new organization
+type RoleTemplate struct {
+	Name        string
+	Description string
+	Permissions []string
+}
+
+// Built-in role names
+const (
+	RoleOwner   = "Owner"
+	RoleAdmin   = "Admin"
+	RoleManager = "Manager"
+	RoleUser    = "User"
+	RoleCustom  = "Custom"
+)
+
+// RoleTemplates are the roles every new organization starts with. The creator of the
+// organization becomes its Owner. Custom starts without permissions for admins to fill.
+var RoleTemplates = []RoleTemplate{
+	{
+		Name:        RoleOwner,
+		Description: "Full control of the organization",
+		Permissions: catalogPermissionNames(),
+	},
+	{
+		Name:        RoleAdmin,
+		Description: "Manages members, collections and member security",
+		Permissions: []string{
+			PermissionCreateVaultItem,
+			PermissionReadVaultItems,
+			PermissionManageCollections,
+			PermissionManageMembers,
+			PermissionManageGroups,
+			PermissionViewAuditLogs,
+			PermissionManageSessions,
+			PermissionUnlockAccounts,
+			PermissionApproveDevices,
+			PermissionManagePasskeys,
+		},
+	},
+	{
+		Name:        RoleManager,
+		Description: "Manages collections and their access",
+		Permissions: []string{
+			PermissionCreateVaultItem,
+			PermissionReadVaultItems,
+			PermissionManageCollections,
+		},
+	},
+	{
+		Name:        RoleUser,
+		Description: "Uses the organization vault",
+		Permissions: []string{
+			PermissionCreateVaultItem,
+			PermissionReadVaultItems,
+		},
+	},
+	{
+		Name:        RoleCustom,
+		Description: "Permissions chosen by an admin",
+	},
+}
+
+func catalogPermissionNames() []string {
+	names := make([]string, 0, len(PermissionCatalog))
+	for _, permission := range PermissionCatalog {
+		names = append(names, permission.Name)
+	}
+	return names
+}
@@ -18,6 +18,10 @@ const (
 	PolicyIPAllowlist      PolicyType = "ip_allowlist"
 	PolicyMasterPassword   PolicyType = "master_password"
 	PolicyVaultTimeout     PolicyType = "vault_timeout"
+	PolicySuspiciousLogin  PolicyType = "suspicious_login"
+	PolicyKeyConnector     PolicyType = "key_connector"
+	PolicyDeviceApproval   PolicyType = "device_approval"
+	PolicyRequireDPoP      PolicyType = "require_dpop"
 )
 
 type Policy struct {
@@ -26,6 +30,58 @@ type Policy struct {
 	Settings    json.RawMessage    `json:"settings"`
 }
 
+// MasterPasswordPolicySettings are the settings of the master_password policy
+type MasterPasswordPolicySettings struct {
+	MinLength int `json:"min_length"`
+	// RequireAccountRecovery keeps members from withdrawing from account recovery
+	RequireAccountRecovery bool `json:"require_account_recovery"`
+	// AutoEnrollAccountRecovery enrolls members in account recovery when they join
+	AutoEnrollAccountRecovery bool `json:"auto_enroll_account_recovery"`
+}
+
+// TwoFactorPolicySettings are the settings of the two_factor_auth policy. An enabled
+// policy requires members to have at least one verified two-factor method.
+type TwoFactorPolicySettings struct {
+	// RequirePhishingResistant only accepts WebAuthn security keys at login
+	RequirePhishingResistant bool `json:"require_phishing_resistant"`
+}
+
+// SuspiciousLoginPolicySettings are the settings of the suspicious_login policy. A login
+// whose risk score reaches RiskThreshold triggers Action: notify, require_2fa or block.
+type SuspiciousLoginPolicySettings struct {
+	Action        string `json:"action"`
+	RiskThreshold int    `json:"risk_threshold"`
+	// MaxTravelSpeedKmh is the speed between two logins above which travel is impossible
+	MaxTravelSpeedKmh float64 `json:"max_travel_speed_kmh"`
+}
+
+// KeyConnectorPolicySettings are the settings of the key_connector policy. Members it
+// applies to unlock their vault with the user key held by the key connector at URL
+// instead of a master password. The policy only applies while the organization has
+// SSO enabled.
+type KeyConnectorPolicySettings struct {
+	URL string `json:"url"`
+	// RoleIDs limits the policy to members with these roles; empty means every member
+	RoleIDs []uuid.UUID `json:"role_ids"`
+}
+
+// SessionTimeoutPolicySettings are the settings of the session_timeout policy. Sessions
+// of members end after IdleTimeoutMinutes without use, and MaxLifetimeHours after they
+// began, when these are shorter than the server's defaults.
+type SessionTimeoutPolicySettings struct {
+	IdleTimeoutMinutes int `json:"idle_timeout_minutes"`
+	MaxLifetimeHours   int `json:"max_lifetime_hours"`
+}
+
+// DeviceApprovalPolicySettings are the settings of the device_approval policy. An
+// enabled policy holds new devices of members as pending until the member approves them
+// from an authorized device or an admin approves them, and refuses sessions from
+// pending, blocked and unidentified devices.
+type DeviceApprovalPolicySettings struct {
+	// AdminApprovalOnly keeps members from approving their own devices
+	AdminApprovalOnly bool `json:"admin_approval_only"`
+}
+
 type PolicyService interface {
 	CreatePolicy(ctx context.Context, orgID uuid.UUID, policy Policy) error
 	UpdatePolicy(ctx context.Context, orgID uuid.UUID, policy Policy) error
@@ -33,6 +89,13 @@ type PolicyService interface {
 	GetPolicy(ctx context.Context, orgID uuid.UUID, policyType PolicyType) (*Policy, error)
 	ListPolicies(ctx context.Context, orgID uuid.UUID) ([]Policy, error)
 	EvaluatePolicy(ctx context.Context, orgID uuid.UUID, policyType PolicyType, data interface{}) (bool, error)
+	GetMasterPasswordPolicy(ctx context.Context, orgID uuid.UUID) (*MasterPasswordPolicySettings, error)
+	GetTwoFactorPolicy(ctx context.Context, orgID uuid.UUID) (*TwoFactorPolicySettings, error)
+	GetSuspiciousLoginPolicy(ctx context.Context, orgID uuid.UUID) (*SuspiciousLoginPolicySettings, error)
+	GetKeyConnectorPolicy(ctx context.Context, orgID uuid.UUID) (*KeyConnectorPolicySettings, error)
+	GetSessionTimeoutPolicy(ctx context.Context, orgID uuid.UUID) (*SessionTimeoutPolicySettings, error)
+	GetDeviceApprovalPolicy(ctx context.Context, orgID uuid.UUID) (*DeviceApprovalPolicySettings, error)
+	RequiresDPoP(ctx context.Context, orgID uuid.UUID) (bool, error)
 }
 
 type policyService struct {
@@ -103,14 +166,146 @@ func (s *policyService) EvaluatePolicy(ctx context.Context, orgID uuid.UUID, pol
 		return s.evaluateSessionTimeoutPolicy(policy, data)
 	case PolicyIPAllowlist:
 		return s.evaluateIPAllowlistPolicy(policy, data)
+	case PolicyMasterPassword:
+		return s.evaluateMasterPasswordPolicy(policy, data)
 	default:
 		return true, nil
 	}
 }
 
+// GetTwoFactorPolicy returns the organization's two-factor settings, or nil if the
+// policy is missing or disabled
+func (s *policyService) GetTwoFactorPolicy(ctx context.Context, orgID uuid.UUID) (*TwoFactorPolicySettings, error) {
+	policy, err := s.GetPolicy(ctx, orgID, PolicyTwoFactorAuth)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil || !policy.Enabled {
+		return nil, nil
+	}
+
+	settings := &TwoFactorPolicySettings{}
+	if len(policy.Settings) > 0 {
+		if err := json.Unmarshal(policy.Settings, settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// GetSuspiciousLoginPolicy returns the organization's suspicious login settings, or nil
+// if the policy is missing or disabled
+func (s *policyService) GetSuspiciousLoginPolicy(ctx context.Context, orgID uuid.UUID) (*SuspiciousLoginPolicySettings, error) {
+	policy, err := s.GetPolicy(ctx, orgID, PolicySuspiciousLogin)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil || !policy.Enabled {
+		return nil, nil
+	}
+
+	settings := &SuspiciousLoginPolicySettings{}
+	if len(policy.Settings) > 0 {
+		if err := json.Unmarshal(policy.Settings, settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// GetKeyConnectorPolicy returns the organization's key connector settings, or nil if
+// the policy is missing or disabled
+func (s *policyService) GetKeyConnectorPolicy(ctx context.Context, orgID uuid.UUID) (*KeyConnectorPolicySettings, error) {
+	policy, err := s.GetPolicy(ctx, orgID, PolicyKeyConnector)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil || !policy.Enabled {
+		return nil, nil
+	}
+
+	settings := &KeyConnectorPolicySettings{}
+	if len(policy.Settings) > 0 {
+		if err := json.Unmarshal(policy.Settings, settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// GetSessionTimeoutPolicy returns the organization's session timeout settings, or nil if
+// the policy is missing or disabled
+func (s *policyService) GetSessionTimeoutPolicy(ctx context.Context, orgID uuid.UUID) (*SessionTimeoutPolicySettings, error) {
+	policy, err := s.GetPolicy(ctx, orgID, PolicySessionTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil || !policy.Enabled {
+		return nil, nil
+	}
+
+	settings := &SessionTimeoutPolicySettings{}
+	if len(policy.Settings) > 0 {
+		if err := json.Unmarshal(policy.Settings, settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// GetDeviceApprovalPolicy returns the organization's device approval settings, or nil if
+// the policy is missing or disabled
+func (s *policyService) GetDeviceApprovalPolicy(ctx context.Context, orgID uuid.UUID) (*DeviceApprovalPolicySettings, error) {
+	policy, err := s.GetPolicy(ctx, orgID, PolicyDeviceApproval)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil || !policy.Enabled {
+		return nil, nil
+	}
+
+	settings := &DeviceApprovalPolicySettings{}
+	if len(policy.Settings) > 0 {
+		if err := json.Unmarshal(policy.Settings, settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// RequiresDPoP reports whether the organization's require_dpop policy is enabled. It
+// has no settings: members only get sessions bound to a device key with DPoP proofs.
+func (s *policyService) RequiresDPoP(ctx context.Context, orgID uuid.UUID) (bool, error) {
+	policy, err := s.GetPolicy(ctx, orgID, PolicyRequireDPoP)
+	if err != nil {
+		return false, err
+	}
+	return policy != nil && policy.Enabled, nil
+}
+
+// evaluateTwoFactorAuthPolicy accepts a user's two-factor methods and checks that at
+// least one verified method satisfies the policy
 func (s *policyService) evaluateTwoFactorAuthPolicy(policy *Policy, data interface{}) (bool, error) {
-	// TODO: Implement 2FA policy evaluation
-	return true, nil
+	var settings TwoFactorPolicySettings
+	if len(policy.Settings) > 0 {
+		if err := json.Unmarshal(policy.Settings, &settings); err != nil {
+			return false, err
+		}
+	}
+
+	methods, ok := data.([]models.TwoFactorMethod)
+	if !ok {
+		return true, nil
+	}
+	for _, method := range methods {
+		if !method.Verified {
+			continue
+		}
+		if !settings.RequirePhishingResistant || isPhishingResistant(method.Type) {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
 func (s *policyService) evaluatePasswordComplexityPolicy(policy *Policy, data interface{}) (bool, error) {
@@ -127,3 +322,42 @@ func (s *policyService) evaluateIPAllowlistPolicy(policy *Policy, data interface
 	// TODO: Implement IP allowlist policy evaluation
 	return true, nil
 }
+
+// GetMasterPasswordPolicy returns the organization's master password settings. A missing
+// or disabled policy yields zero settings.
+func (s *policyService) GetMasterPasswordPolicy(ctx context.Context, orgID uuid.UUID) (*MasterPasswordPolicySettings, error) {
+	settings := &MasterPasswordPolicySettings{}
+
+	policy, err := s.GetPolicy(ctx, orgID, PolicyMasterPassword)
+	if err != nil {
+		return nil, err
+	}
+	if policy == nil || !policy.Enabled || len(policy.Settings) == 0 {
+		return settings, nil
+	}
+
+	if err := json.Unmarshal(policy.Settings, settings); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// evaluateMasterPasswordPolicy accepts a new master password as a string, or a
+// membership to check account recovery enrollment
+func (s *policyService) evaluateMasterPasswordPolicy(policy *Policy, data interface{}) (bool, error) {
+	var settings MasterPasswordPolicySettings
+	if len(policy.Settings) > 0 {
+		if err := json.Unmarshal(policy.Settings, &settings); err != nil {
+			return false, err
+		}
+	}
+
+	switch v := data.(type) {
+	case string:
+		return len(v) >= settings.MinLength, nil
+	case *models.OrganizationUser:
+		return !settings.RequireAccountRecovery || v.ResetPasswordKey != "", nil
+	default:
+		return true, nil
+	}
+}
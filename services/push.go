@@ -0,0 +1,406 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// PushType is the kind of change a push message tells clients about
+type PushType string
+
+const (
+	PushSyncItem         PushType = "sync_item"
+	PushSyncFolder       PushType = "sync_folder"
+	PushSyncCollection   PushType = "sync_collection"
+	PushSyncOrganization PushType = "sync_organization"
+	// PushSyncVault asks for a full sync, when messages may have been missed
+	PushSyncVault PushType = "sync_vault"
+	// PushLogout tells the client its session was revoked; the connection is closed after it
+	PushLogout PushType = "logout"
+)
+
+const (
+	// pushChannel is the Postgres channel push messages are fanned out on
+	pushChannel = "vault_push"
+	// pushPayloadLimit stays below the 8000 byte limit of NOTIFY payloads
+	pushPayloadLimit = 7900
+	// pushBufferSize is how many messages a slow connection may fall behind before it
+	// is dropped. The client reconnects and syncs.
+	pushBufferSize = 32
+	// pushListenerPing checks the listening connection when no messages arrive
+	pushListenerPing = 90 * time.Second
+)
+
+var ErrPushPayloadTooLarge = errors.New("push message too large")
+
+// PushMessage is what clients receive: the kind of change and the item, folder,
+// collection or organization that changed
+type PushMessage struct {
+	Type           PushType   `json:"type"`
+	ID             *uuid.UUID `json:"id,omitempty"`
+	OrganizationID *uuid.UUID `json:"organization_id,omitempty"`
+	Date           time.Time  `json:"date"`
+}
+
+// PushTarget selects the connections a message goes to. Every ID that is set must
+// match; OrganizationID matches connections of confirmed members. OriginSessionID is
+// the session that made the change, which needs no message about it.
+//
+// CollectionScoped further limits an organization message to members who manage
+// collections and, when CollectionID is set, members who may read that collection,
+// so the IDs of items and collections only reach members who can see them.
+type PushTarget struct {
+	UserID           uuid.UUID `json:"user_id"`
+	OrganizationID   uuid.UUID `json:"organization_id"`
+	SessionID        uuid.UUID `json:"session_id"`
+	DeviceID         uuid.UUID `json:"device_id"`
+	OriginSessionID  uuid.UUID `json:"origin_session_id"`
+	CollectionScoped bool      `json:"collection_scoped"`
+	CollectionID     uuid.UUID `json:"collection_id"`
+}
+
+// collectionPushTarget selects the connections of members who can see the collection
+func collectionPushTarget(orgID, collectionID uuid.UUID) PushTarget {
+	return PushTarget{OrganizationID: orgID, CollectionScoped: true, CollectionID: collectionID}
+}
+
+// NotificationHub pushes changes to the clients connected to the notifications hub.
+// With a database URL, messages are fanned out to every server through Postgres
+// LISTEN/NOTIFY; otherwise they only reach connections to this server.
+type NotificationHub interface {
+	// Publish sends the message to the connections selected by target
+	Publish(ctx context.Context, target PushTarget, msg PushMessage) error
+	// Subscribe registers a connection of the user's session
+	Subscribe(ctx context.Context, userID, sessionID, deviceID uuid.UUID) (*PushSubscription, error)
+	// Run listens for messages published by any server until ctx is done
+	Run(ctx context.Context)
+}
+
+// PushSubscription is one connection to the hub. Messages is closed when the hub drops
+// the connection: after a logout message, or when the client falls behind.
+type PushSubscription struct {
+	hub       *notificationHub
+	userID    uuid.UUID
+	sessionID uuid.UUID
+	deviceID  uuid.UUID
+	messages  chan PushMessage
+	// organizations are the organizations the user is a confirmed member of, guarded by
+	// the hub's mutex
+	organizations map[uuid.UUID]bool
+}
+
+// Messages returns the messages for this connection
+func (s *PushSubscription) Messages() <-chan PushMessage {
+	return s.messages
+}
+
+// Close unregisters the connection
+func (s *PushSubscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// pushEnvelope is a message with its target as sent through Postgres
+type pushEnvelope struct {
+	Target  PushTarget  `json:"target"`
+	Message PushMessage `json:"message"`
+}
+
+type notificationHub struct {
+	repo        repository.Repository
+	databaseURL string
+
+	mu            sync.Mutex
+	subscriptions map[uuid.UUID]map[*PushSubscription]bool
+}
+
+// NewNotificationHub creates the hub. databaseURL is the Postgres connection string the
+// hub listens on; it may be empty when a single server runs.
+func NewNotificationHub(repo repository.Repository, databaseURL string) NotificationHub {
+	return &notificationHub{
+		repo:          repo,
+		databaseURL:   databaseURL,
+		subscriptions: make(map[uuid.UUID]map[*PushSubscription]bool),
+	}
+}
+
+func (h *notificationHub) Publish(ctx context.Context, target PushTarget, msg PushMessage) error {
+	envelope := pushEnvelope{Target: target, Message: msg}
+	if h.databaseURL == "" {
+		h.deliver(envelope)
+		return nil
+	}
+
+	payload, err := json.Marshal(envelope)
+	if err != nil {
+		return err
+	}
+	if len(payload) > pushPayloadLimit {
+		return ErrPushPayloadTooLarge
+	}
+	return h.repo.Notify(ctx, pushChannel, string(payload))
+}
+
+func (h *notificationHub) Subscribe(ctx context.Context, userID, sessionID, deviceID uuid.UUID) (*PushSubscription, error) {
+	organizations, err := h.memberOrganizations(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription := &PushSubscription{
+		hub:           h,
+		userID:        userID,
+		sessionID:     sessionID,
+		deviceID:      deviceID,
+		messages:      make(chan PushMessage, pushBufferSize),
+		organizations: organizations,
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subscriptions[userID] == nil {
+		h.subscriptions[userID] = make(map[*PushSubscription]bool)
+	}
+	h.subscriptions[userID][subscription] = true
+	return subscription, nil
+}
+
+func (h *notificationHub) Run(ctx context.Context) {
+	if h.databaseURL == "" {
+		<-ctx.Done()
+		return
+	}
+
+	listener := pq.NewListener(h.databaseURL, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Push listener connection event %d: %v", event, err)
+		}
+	})
+	defer listener.Close()
+
+	if err := listener.Listen(pushChannel); err != nil {
+		log.Printf("Failed to listen for push messages: %v", err)
+		return
+	}
+
+	ping := time.NewTimer(pushListenerPing)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case notification := <-listener.Notify:
+			h.receive(notification)
+			// The connection is only pinged once it has been quiet for a while
+			if !ping.Stop() {
+				select {
+				case <-ping.C:
+				default:
+				}
+			}
+		case <-ping.C:
+			go func() {
+				if err := listener.Ping(); err != nil {
+					log.Printf("Push listener ping failed: %v", err)
+				}
+			}()
+		}
+		ping.Reset(pushListenerPing)
+	}
+}
+
+// receive delivers a message published by any server. A nil notification means the
+// listening connection was lost and re-established.
+func (h *notificationHub) receive(notification *pq.Notification) {
+	if notification == nil {
+		// Messages sent meanwhile are gone, so every client syncs
+		h.deliver(pushEnvelope{Message: PushMessage{Type: PushSyncVault, Date: time.Now()}})
+		return
+	}
+	var envelope pushEnvelope
+	if err := json.Unmarshal([]byte(notification.Extra), &envelope); err != nil {
+		log.Printf("Failed to decode push message: %v", err)
+		return
+	}
+	h.deliver(envelope)
+}
+
+// deliver hands the message to the matching connections of this server
+func (h *notificationHub) deliver(envelope pushEnvelope) {
+	target, msg := envelope.Target, envelope.Message
+
+	// Collection access is looked up without holding the mutex
+	var allowed map[uuid.UUID]bool
+	if target.CollectionScoped && target.OrganizationID != uuid.Nil {
+		allowed = h.collectionReaders(target, h.recipients(target))
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for userID, subscriptions := range h.subscriptions {
+		if target.UserID != uuid.Nil && target.UserID != userID {
+			continue
+		}
+		if allowed != nil && !allowed[userID] {
+			continue
+		}
+		for subscription := range subscriptions {
+			if !subscription.matches(target) {
+				continue
+			}
+			select {
+			case subscription.messages <- msg:
+			default:
+				h.remove(subscription)
+				continue
+			}
+			if msg.Type == PushLogout {
+				h.remove(subscription)
+			}
+		}
+
+		// Membership changes are pushed to the member; their connections start or stop
+		// receiving the organization's messages
+		if msg.Type == PushSyncOrganization && target.UserID == userID {
+			go h.refreshOrganizations(userID)
+		}
+	}
+}
+
+// recipients returns the users with a connection the target matches
+func (h *notificationHub) recipients(target PushTarget) []uuid.UUID {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var userIDs []uuid.UUID
+	for userID, subscriptions := range h.subscriptions {
+		if target.UserID != uuid.Nil && target.UserID != userID {
+			continue
+		}
+		for subscription := range subscriptions {
+			if subscription.matches(target) {
+				userIDs = append(userIDs, userID)
+				break
+			}
+		}
+	}
+	return userIDs
+}
+
+// collectionReaders returns which of the users may see the collection of a collection
+// scoped message. Users whose access cannot be looked up are left out; they see the
+// change on their next sync.
+func (h *notificationHub) collectionReaders(target PushTarget, userIDs []uuid.UUID) map[uuid.UUID]bool {
+	ctx := context.Background()
+	allowed := make(map[uuid.UUID]bool, len(userIDs))
+	for _, userID := range userIDs {
+		manager, err := h.repo.MemberHasPermission(ctx, target.OrganizationID, userID, PermissionManageCollections)
+		if err != nil {
+			log.Printf("Failed to check collection access of push subscriber %s: %v", userID, err)
+			continue
+		}
+		if manager {
+			allowed[userID] = true
+			continue
+		}
+		if target.CollectionID == uuid.Nil {
+			continue
+		}
+		readable, err := h.repo.ListCollectionsWithPermission(ctx, userID, []uuid.UUID{target.CollectionID}, PermissionReadVaultItems)
+		if err != nil {
+			log.Printf("Failed to check collection access of push subscriber %s: %v", userID, err)
+			continue
+		}
+		allowed[userID] = len(readable) > 0
+	}
+	return allowed
+}
+
+func (s *PushSubscription) matches(target PushTarget) bool {
+	switch {
+	case target.OriginSessionID != uuid.Nil && target.OriginSessionID == s.sessionID:
+		return false
+	case target.SessionID != uuid.Nil && target.SessionID != s.sessionID:
+		return false
+	case target.DeviceID != uuid.Nil && target.DeviceID != s.deviceID:
+		return false
+	case target.OrganizationID != uuid.Nil && !s.organizations[target.OrganizationID]:
+		return false
+	}
+	return true
+}
+
+// remove unregisters the subscription and closes its channel. The hub's mutex must be
+// held.
+func (h *notificationHub) remove(subscription *PushSubscription) {
+	subscriptions := h.subscriptions[subscription.userID]
+	if !subscriptions[subscription] {
+		return
+	}
+	delete(subscriptions, subscription)
+	if len(subscriptions) == 0 {
+		delete(h.subscriptions, subscription.userID)
+	}
+	close(subscription.messages)
+}
+
+func (h *notificationHub) refreshOrganizations(userID uuid.UUID) {
+	organizations, err := h.memberOrganizations(context.Background(), userID)
+	if err != nil {
+		log.Printf("Failed to refresh organizations of push subscriber %s: %v", userID, err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscription := range h.subscriptions[userID] {
+		subscription.organizations = organizations
+	}
+}
+
+func (h *notificationHub) memberOrganizations(ctx context.Context, userID uuid.UUID) (map[uuid.UUID]bool, error) {
+	memberships, err := h.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	organizations := make(map[uuid.UUID]bool, len(memberships))
+	for _, member := range memberships {
+		if member.Status == organizationMemberStatusConfirmed {
+			organizations[member.OrganizationID] = true
+		}
+	}
+	return organizations, nil
+}
+
+// pushSync tells the clients selected by target about a change. The hub may be nil.
+// Failures are logged: clients still see the change on their next sync.
+func pushSync(ctx context.Context, hub NotificationHub, target PushTarget, msgType PushType, id, orgID uuid.UUID) {
+	if hub == nil {
+		return
+	}
+	if target.OriginSessionID == uuid.Nil {
+		target.OriginSessionID = SessionIDFromContext(ctx)
+	}
+
+	msg := PushMessage{Type: msgType, Date: time.Now()}
+	if id != uuid.Nil {
+		msg.ID = &id
+	}
+	if orgID != uuid.Nil {
+		msg.OrganizationID = &orgID
+	}
+	if err := hub.Publish(ctx, target, msg); err != nil {
+		log.Printf("Failed to push %s message: %v", msgType, err)
+	}
+}
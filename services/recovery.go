@@ -0,0 +1,690 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrRecoveryKeyNotFound        = errors.New("organization has no recovery key")
+	ErrRecoverySessionNotFound    = errors.New("recovery session not found")
+	ErrRecoverySessionInProgress  = errors.New("a recovery session is already open for this organization")
+	ErrRecoverySessionExpired     = errors.New("recovery session has expired")
+	ErrRecoverySessionLocked      = errors.New("recovery session has not been unlocked")
+	ErrInvalidRecoveryShare       = errors.New("invalid recovery share")
+	ErrRecoveryShareSubmitted     = errors.New("custodian has already submitted a share")
+	ErrCustodianKeyNotFound       = errors.New("custodian has no key pair")
+	ErrRecoveryVerificationFailed = errors.New("reconstructed recovery key does not match")
+)
+
+const (
+	recoverySessionCollecting = "collecting"
+	recoverySessionUnlocked   = "unlocked"
+	recoverySessionClosed     = "closed"
+	recoverySessionExpired    = "expired"
+	recoverySessionFailed     = "failed"
+
+	// recoveryShareCollectionWindow is how long custodians have to submit their shares
+	recoveryShareCollectionWindow = 24 * time.Hour
+	// recoverySessionDuration is how long the reconstructed key stays usable
+	recoverySessionDuration = time.Hour
+)
+
+// OrganizationRecoveryService manages break-glass recovery of an organization key.
+// The recovery key pair's private key is split into shares with SplitSecret, one per
+// custodian, and each share is stored encrypted with its custodian's public key. The
+// organization key is kept wrapped with the recovery public key so that rotations do
+// not need the custodians. Everything but the custodian's own share submission requires
+// the manage_organization_recovery permission.
+type OrganizationRecoveryService interface {
+	SetupRecoveryKey(ctx context.Context, orgID, actorID uuid.UUID, threshold int, custodianIDs []uuid.UUID) (*models.OrganizationRecoveryKey, error)
+	GetRecoveryKey(ctx context.Context, orgID, actorID uuid.UUID) (*models.OrganizationRecoveryKey, error)
+	DisableRecoveryKey(ctx context.Context, orgID, actorID uuid.UUID) error
+	StartRecovery(ctx context.Context, orgID, initiatorID uuid.UUID) (*models.RecoverySession, error)
+	GetRecoverySession(ctx context.Context, sessionID, actorID uuid.UUID) (*models.RecoverySession, error)
+	// GetCustodianShare returns the custodian's share, encrypted with their public key,
+	// while the session collects shares
+	GetCustodianShare(ctx context.Context, sessionID, custodianUserID uuid.UUID) (string, error)
+	// SubmitRecoveryShare records the custodian's decrypted share. Each custodian submits
+	// once; the share must match the commitment stored when the key was set up.
+	SubmitRecoveryShare(ctx context.Context, sessionID, custodianUserID uuid.UUID, share string) (*models.RecoverySession, error)
+	// RestoreOrganizationAccess gives a member back the organization key, keeping the
+	// role they had
+	RestoreOrganizationAccess(ctx context.Context, sessionID, actorID, userID uuid.UUID) error
+	CloseRecoverySession(ctx context.Context, sessionID, actorID uuid.UUID) error
+}
+
+type organizationRecoveryService struct {
+	repo        repository.Repository
+	encryption  EncryptionService
+	keys        KeyRotationService
+	email       EmailService
+	permissions PermissionResolver
+	shareKey    []byte
+}
+
+// NewOrganizationRecoveryService creates the recovery service. shareKey is the 32-byte
+// key submitted shares are encrypted with while a recovery session collects them.
+func NewOrganizationRecoveryService(
+	repo repository.Repository,
+	encryption EncryptionService,
+	keys KeyRotationService,
+	email EmailService,
+	permissions PermissionResolver,
+	shareKey []byte,
+) OrganizationRecoveryService {
+	return &organizationRecoveryService{
+		repo:        repo,
+		encryption:  encryption,
+		keys:        keys,
+		email:       email,
+		permissions: permissions,
+		shareKey:    shareKey,
+	}
+}
+
+// SetupRecoveryKey creates a recovery key for the organization, replacing any existing
+// one. Each custodian must be a confirmed member with a key pair; threshold shares are
+// needed to recover. No share is returned to the caller.
+func (s *organizationRecoveryService) SetupRecoveryKey(
+	ctx context.Context,
+	orgID, actorID uuid.UUID,
+	threshold int,
+	custodianIDs []uuid.UUID,
+) (*models.OrganizationRecoveryKey, error) {
+	if err := s.permissions.RequirePermission(ctx, actorID, orgID, PermissionManageOrganizationRecovery); err != nil {
+		return nil, err
+	}
+	if threshold < 2 || threshold > len(custodianIDs) {
+		return nil, ErrInvalidShareCount
+	}
+
+	custodians := make([]models.RecoveryCustodian, len(custodianIDs))
+	publicKeys := make([][]byte, len(custodianIDs))
+	for i, userID := range custodianIDs {
+		for _, other := range custodianIDs[:i] {
+			if other == userID {
+				return nil, ErrInvalidOperation
+			}
+		}
+		if _, err := confirmedMember(ctx, s.repo, orgID, userID); err != nil {
+			return nil, err
+		}
+		user, err := s.repo.GetUserByID(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, ErrUserNotFound
+		}
+		userKey, err := s.repo.GetActiveEncryptionKey(ctx, keyOwnerUser, userID)
+		if err != nil {
+			return nil, err
+		}
+		if userKey == nil || userKey.PublicKey == "" {
+			return nil, ErrCustodianKeyNotFound
+		}
+
+		custodians[i] = models.RecoveryCustodian{UserID: userID, Name: user.Name, Email: user.Email}
+		publicKeys[i] = []byte(userKey.PublicKey)
+	}
+
+	publicKey, privateKey, err := s.encryption.GenerateKeyPairWithAlgorithm(KeyAlgorithmX25519HPKE)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(privateKey)
+
+	wrappedOrgKey, version, err := s.keys.WrapOrganizationKey(ctx, orgID, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	shares, err := SplitSecret(privateKey, len(custodians), threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, share := range shares {
+			zeroBytes(share)
+		}
+	}()
+
+	for i := range custodians {
+		encrypted, err := s.encryption.EncryptWithPublicKey(shares[i], publicKeys[i])
+		if err != nil {
+			return nil, err
+		}
+		custodians[i].ShareIndex = int(shares[i][0])
+		custodians[i].EncryptedShare = base64.StdEncoding.EncodeToString(encrypted)
+		custodians[i].ShareCommitment = recoveryVerificationHash(shares[i])
+	}
+
+	recoveryKey := &models.OrganizationRecoveryKey{
+		OrganizationID:   orgID,
+		PublicKey:        string(publicKey),
+		VerificationHash: recoveryVerificationHash(privateKey),
+		Threshold:        threshold,
+		WrappedOrgKey:    wrappedOrgKey,
+		OrgKeyVersion:    version,
+		IsActive:         true,
+		CreatedBy:        actorID,
+		Custodians:       custodians,
+	}
+	if err := s.repo.CreateOrganizationRecoveryKey(ctx, recoveryKey); err != nil {
+		return nil, err
+	}
+
+	s.notifyCustodians(ctx, "recovery_custodian_assigned", recoveryKey, nil)
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_key_created", "Organization recovery key created")
+	metadata["recovery_key_id"] = recoveryKey.ID.String()
+	metadata["threshold"] = threshold
+	metadata["custodians"] = custodianNames(recoveryKey.Custodians)
+	if err := s.createAuditLog(ctx, "organization.recovery_key_created", actorID, orgID, metadata); err != nil {
+		return nil, err
+	}
+
+	return recoveryKey, nil
+}
+
+func (s *organizationRecoveryService) GetRecoveryKey(ctx context.Context, orgID, actorID uuid.UUID) (*models.OrganizationRecoveryKey, error) {
+	if err := s.permissions.RequirePermission(ctx, actorID, orgID, PermissionManageOrganizationRecovery); err != nil {
+		return nil, err
+	}
+	return s.activeRecoveryKey(ctx, orgID)
+}
+
+func (s *organizationRecoveryService) DisableRecoveryKey(ctx context.Context, orgID, actorID uuid.UUID) error {
+	if err := s.permissions.RequirePermission(ctx, actorID, orgID, PermissionManageOrganizationRecovery); err != nil {
+		return err
+	}
+
+	recoveryKey, err := s.activeRecoveryKey(ctx, orgID)
+	if err != nil {
+		return err
+	}
+
+	recoveryKey.IsActive = false
+	recoveryKey.WrappedOrgKey = ""
+	if err := s.repo.UpdateOrganizationRecoveryKey(ctx, recoveryKey); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_key_disabled", "Organization recovery key disabled")
+	metadata["recovery_key_id"] = recoveryKey.ID.String()
+	return s.createAuditLog(ctx, "organization.recovery_key_disabled", actorID, orgID, metadata)
+}
+
+// StartRecovery opens a recovery session and asks the custodians for their shares
+func (s *organizationRecoveryService) StartRecovery(ctx context.Context, orgID, initiatorID uuid.UUID) (*models.RecoverySession, error) {
+	if err := s.permissions.RequirePermission(ctx, initiatorID, orgID, PermissionManageOrganizationRecovery); err != nil {
+		return nil, err
+	}
+
+	recoveryKey, err := s.activeRecoveryKey(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if recoveryKey.WrappedOrgKey == "" {
+		return nil, ErrKeyNotFound
+	}
+
+	open, err := s.repo.GetOpenRecoverySession(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if open != nil {
+		if err := s.expireIfNeeded(ctx, open); err != nil && !errors.Is(err, ErrRecoverySessionExpired) {
+			return nil, err
+		}
+		if open.ClosedAt == nil {
+			return nil, ErrRecoverySessionInProgress
+		}
+	}
+
+	session := &models.RecoverySession{
+		OrganizationID: orgID,
+		RecoveryKeyID:  recoveryKey.ID,
+		InitiatedBy:    initiatorID,
+		Status:         recoverySessionCollecting,
+		SharesRequired: recoveryKey.Threshold,
+		ExpiresAt:      time.Now().Add(recoveryShareCollectionWindow),
+	}
+	if err := s.repo.CreateRecoverySession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	s.notifyCustodians(ctx, "recovery_shares_requested", recoveryKey, session)
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_started", "Organization recovery started")
+	metadata["session_id"] = session.ID.String()
+	metadata["recovery_key_id"] = recoveryKey.ID.String()
+	if err := s.createAuditLog(ctx, "organization.recovery_started", initiatorID, orgID, metadata); err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+func (s *organizationRecoveryService) GetRecoverySession(ctx context.Context, sessionID, actorID uuid.UUID) (*models.RecoverySession, error) {
+	session, err := s.repo.GetRecoverySession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrRecoverySessionNotFound
+	}
+	if err := s.permissions.RequirePermission(ctx, actorID, session.OrganizationID, PermissionManageOrganizationRecovery); err != nil {
+		return nil, err
+	}
+	if err := s.expireIfNeeded(ctx, session); err != nil && !errors.Is(err, ErrRecoverySessionExpired) {
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *organizationRecoveryService) GetCustodianShare(ctx context.Context, sessionID, custodianUserID uuid.UUID) (string, error) {
+	session, recoveryKey, err := s.collectingSession(ctx, sessionID)
+	if err != nil {
+		return "", err
+	}
+
+	custodian := custodianOf(recoveryKey, custodianUserID)
+	if custodian == nil {
+		return "", ErrUnauthorized
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_share_retrieved", "Recovery share retrieved by custodian")
+	metadata["session_id"] = session.ID.String()
+	metadata["custodian"] = custodian.Name
+	if err := s.createAuditLog(ctx, "organization.recovery_share_retrieved", custodianUserID, session.OrganizationID, metadata); err != nil {
+		return "", err
+	}
+
+	return custodian.EncryptedShare, nil
+}
+
+// SubmitRecoveryShare records a custodian's share. Once enough shares are collected the
+// recovery key is reconstructed and checked against its verification hash; the session
+// is then unlocked for recoverySessionDuration.
+func (s *organizationRecoveryService) SubmitRecoveryShare(ctx context.Context, sessionID, custodianUserID uuid.UUID, share string) (*models.RecoverySession, error) {
+	session, recoveryKey, err := s.collectingSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	custodian := custodianOf(recoveryKey, custodianUserID)
+	if custodian == nil {
+		return nil, ErrUnauthorized
+	}
+
+	shareBytes, err := base64.RawURLEncoding.DecodeString(share)
+	if err != nil || len(shareBytes) < 2 || int(shareBytes[0]) != custodian.ShareIndex {
+		return nil, ErrInvalidRecoveryShare
+	}
+	defer zeroBytes(shareBytes)
+	commitment, err := hex.DecodeString(custodian.ShareCommitment)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(shareBytes)
+	if subtle.ConstantTimeCompare(commitment, sum[:]) != 1 {
+		return nil, ErrInvalidRecoveryShare
+	}
+
+	sealed, err := s.encryption.EncryptSymmetric(shareBytes, s.shareKey)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := s.repo.CreateRecoverySessionShare(ctx, &models.RecoverySessionShare{
+		RecoverySessionID: session.ID,
+		CustodianID:       custodian.ID,
+		EncryptedShare:    base64.StdEncoding.EncodeToString(sealed),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !stored {
+		return nil, ErrRecoveryShareSubmitted
+	}
+
+	submitted, err := s.repo.ListRecoverySessionShares(ctx, session.ID)
+	if err != nil {
+		return nil, err
+	}
+	session.SharesReceived = len(submitted)
+	if err := s.repo.UpdateRecoverySession(ctx, session); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_share_submitted", "Recovery share submitted")
+	metadata["session_id"] = session.ID.String()
+	metadata["custodian"] = custodian.Name
+	metadata["shares_received"] = session.SharesReceived
+	if err := s.createAuditLog(ctx, "organization.recovery_share_submitted", custodianUserID, session.OrganizationID, metadata); err != nil {
+		return nil, err
+	}
+
+	if session.SharesReceived < recoveryKey.Threshold {
+		return session, nil
+	}
+
+	if err := s.unlock(ctx, session, recoveryKey); err != nil {
+		return nil, s.failSession(ctx, session, err)
+	}
+	return session, nil
+}
+
+// RestoreOrganizationAccess uses the recovered organization key to give a member a
+// confirmed membership again. Only someone who was a member can be restored, and they
+// keep the role they had.
+func (s *organizationRecoveryService) RestoreOrganizationAccess(ctx context.Context, sessionID, actorID, userID uuid.UUID) error {
+	session, err := s.openSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if session.InitiatedBy != actorID {
+		return ErrUnauthorized
+	}
+	if err := s.permissions.RequirePermission(ctx, actorID, session.OrganizationID, PermissionManageOrganizationRecovery); err != nil {
+		return err
+	}
+	if session.Status != recoverySessionUnlocked {
+		return ErrRecoverySessionLocked
+	}
+
+	member, err := s.repo.GetOrganizationUser(ctx, session.OrganizationID, userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return ErrUserNotFound
+	}
+
+	recoveryKey, err := s.repo.GetOrganizationRecoveryKey(ctx, session.RecoveryKeyID)
+	if err != nil {
+		return err
+	}
+	if recoveryKey == nil || !recoveryKey.IsActive {
+		return ErrRecoveryKeyNotFound
+	}
+
+	orgKey, err := s.recoverOrganizationKey(ctx, session, recoveryKey)
+	if err != nil {
+		return err
+	}
+	defer zeroBytes(orgKey)
+
+	if err := s.keys.GrantOrganizationKey(ctx, session.OrganizationID, userID, orgKey, recoveryKey.OrgKeyVersion, nil); err != nil {
+		return err
+	}
+	s.permissions.InvalidateMember(ctx, session.OrganizationID, userID)
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_access_restored", "Organization access restored through recovery")
+	metadata["session_id"] = session.ID.String()
+	metadata["restored_user_id"] = userID.String()
+	if member.RoleID != nil {
+		metadata["role_id"] = member.RoleID.String()
+	}
+	return s.createAuditLog(ctx, "organization.recovery_access_restored", actorID, session.OrganizationID, metadata)
+}
+
+// CloseRecoverySession ends a recovery session and discards the submitted shares
+func (s *organizationRecoveryService) CloseRecoverySession(ctx context.Context, sessionID, actorID uuid.UUID) error {
+	session, err := s.openSession(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+	if session.InitiatedBy != actorID {
+		return ErrUnauthorized
+	}
+
+	if err := s.closeSession(ctx, session, recoverySessionClosed); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_closed", "Organization recovery session closed")
+	metadata["session_id"] = session.ID.String()
+	return s.createAuditLog(ctx, "organization.recovery_closed", actorID, session.OrganizationID, metadata)
+}
+
+// unlock checks that the submitted shares recover the organization key and opens the
+// window in which access can be restored
+func (s *organizationRecoveryService) unlock(ctx context.Context, session *models.RecoverySession, recoveryKey *models.OrganizationRecoveryKey) error {
+	orgKey, err := s.recoverOrganizationKey(ctx, session, recoveryKey)
+	if err != nil {
+		return err
+	}
+	zeroBytes(orgKey)
+
+	now := time.Now()
+	session.Status = recoverySessionUnlocked
+	session.UnlockedAt = &now
+	session.ExpiresAt = now.Add(recoverySessionDuration)
+	if err := s.repo.UpdateRecoverySession(ctx, session); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_unlocked", "Organization recovery key reconstructed")
+	metadata["session_id"] = session.ID.String()
+	metadata["expires_at"] = session.ExpiresAt
+	return s.createAuditLog(ctx, "organization.recovery_unlocked", session.InitiatedBy, session.OrganizationID, metadata)
+}
+
+// recoverOrganizationKey reconstructs the recovery private key from the session's
+// shares and decrypts the organization key with it. Nothing recovered is kept, so
+// every server can serve the session.
+func (s *organizationRecoveryService) recoverOrganizationKey(ctx context.Context, session *models.RecoverySession, recoveryKey *models.OrganizationRecoveryKey) ([]byte, error) {
+	submitted, err := s.repo.ListRecoverySessionShares(ctx, session.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	shares := make([][]byte, 0, len(submitted))
+	defer func() {
+		for _, share := range shares {
+			zeroBytes(share)
+		}
+	}()
+	for _, stored := range submitted {
+		sealed, err := base64.StdEncoding.DecodeString(stored.EncryptedShare)
+		if err != nil {
+			return nil, err
+		}
+		share, err := s.encryption.DecryptSymmetric(sealed, s.shareKey)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, share)
+	}
+
+	privateKey, err := CombineShares(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroBytes(privateKey)
+
+	expected, err := hex.DecodeString(recoveryKey.VerificationHash)
+	if err != nil {
+		return nil, err
+	}
+	actual := sha256.Sum256(privateKey)
+	if subtle.ConstantTimeCompare(expected, actual[:]) != 1 {
+		return nil, ErrRecoveryVerificationFailed
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(recoveryKey.WrappedOrgKey)
+	if err != nil {
+		return nil, err
+	}
+	return s.encryption.DecryptWithPrivateKey(wrapped, privateKey)
+}
+
+func (s *organizationRecoveryService) activeRecoveryKey(ctx context.Context, orgID uuid.UUID) (*models.OrganizationRecoveryKey, error) {
+	recoveryKey, err := s.repo.GetActiveOrganizationRecoveryKey(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if recoveryKey == nil {
+		return nil, ErrRecoveryKeyNotFound
+	}
+	return recoveryKey, nil
+}
+
+// collectingSession loads an open session that is collecting shares and its active
+// recovery key
+func (s *organizationRecoveryService) collectingSession(ctx context.Context, sessionID uuid.UUID) (*models.RecoverySession, *models.OrganizationRecoveryKey, error) {
+	session, err := s.openSession(ctx, sessionID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if session.Status != recoverySessionCollecting {
+		return nil, nil, ErrInvalidOperation
+	}
+
+	recoveryKey, err := s.repo.GetOrganizationRecoveryKey(ctx, session.RecoveryKeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if recoveryKey == nil || !recoveryKey.IsActive {
+		return nil, nil, ErrRecoveryKeyNotFound
+	}
+	return session, recoveryKey, nil
+}
+
+// openSession loads a session that is neither closed nor expired
+func (s *organizationRecoveryService) openSession(ctx context.Context, sessionID uuid.UUID) (*models.RecoverySession, error) {
+	session, err := s.repo.GetRecoverySession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, ErrRecoverySessionNotFound
+	}
+	if err := s.expireIfNeeded(ctx, session); err != nil {
+		return nil, err
+	}
+	if session.ClosedAt != nil {
+		return nil, ErrInvalidOperation
+	}
+	return session, nil
+}
+
+func (s *organizationRecoveryService) expireIfNeeded(ctx context.Context, session *models.RecoverySession) error {
+	if session.ClosedAt != nil || time.Now().Before(session.ExpiresAt) {
+		return nil
+	}
+
+	if err := s.closeSession(ctx, session, recoverySessionExpired); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_expired", "Organization recovery session expired")
+	metadata["session_id"] = session.ID.String()
+	if err := s.createAuditLog(ctx, "organization.recovery_expired", uuid.Nil, session.OrganizationID, metadata); err != nil {
+		return err
+	}
+	return ErrRecoverySessionExpired
+}
+
+func (s *organizationRecoveryService) failSession(ctx context.Context, session *models.RecoverySession, cause error) error {
+	if err := s.closeSession(ctx, session, recoverySessionFailed); err != nil {
+		return errors.Join(cause, err)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("recovery_failed", "Organization recovery failed")
+	metadata["session_id"] = session.ID.String()
+	metadata["error"] = cause.Error()
+	if err := s.createAuditLog(ctx, "organization.recovery_failed", uuid.Nil, session.OrganizationID, metadata); err != nil {
+		return errors.Join(cause, err)
+	}
+	return cause
+}
+
+// closeSession discards the session's shares and marks it closed with the given status
+func (s *organizationRecoveryService) closeSession(ctx context.Context, session *models.RecoverySession, status string) error {
+	if err := s.repo.DeleteRecoverySessionShares(ctx, session.ID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	session.Status = status
+	session.ClosedAt = &now
+	return s.repo.UpdateRecoverySession(ctx, session)
+}
+
+// notifyCustodians emails custodians about the ceremony. Shares are never sent by email.
+func (s *organizationRecoveryService) notifyCustodians(ctx context.Context, template string, recoveryKey *models.OrganizationRecoveryKey, session *models.RecoverySession) {
+	var recipients []string
+	for _, custodian := range recoveryKey.Custodians {
+		if custodian.Email != "" {
+			recipients = append(recipients, custodian.Email)
+		}
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	data := map[string]interface{}{
+		"OrganizationID": recoveryKey.OrganizationID,
+		"Threshold":      recoveryKey.Threshold,
+	}
+	if session != nil {
+		data["SessionID"] = session.ID
+		data["ExpiresAt"] = session.ExpiresAt
+	}
+
+	if err := s.email.SendTemplatedEmail(ctx, template, data, recipients); err != nil {
+		log.Printf("Failed to notify recovery custodians: %v", err)
+	}
+}
+
+func recoveryVerificationHash(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
+
+// custodianOf returns the key's custodian who is the given user, or nil
+func custodianOf(recoveryKey *models.OrganizationRecoveryKey, userID uuid.UUID) *models.RecoveryCustodian {
+	for i := range recoveryKey.Custodians {
+		if recoveryKey.Custodians[i].UserID == userID {
+			return &recoveryKey.Custodians[i]
+		}
+	}
+	return nil
+}
+
+func custodianNames(custodians []models.RecoveryCustodian) []string {
+	names := make([]string, len(custodians))
+	for i, custodian := range custodians {
+		names[i] = custodian.Name
+	}
+	return names
+}
+
+func zeroBytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
 	"github.com/google/uuid"
@@ -39,42 +40,71 @@ func (s *service) AssignPermissionsToRole(ctx context.Context, roleID uuid.UUID,
 		return ErrInvalidOperation
 	}
 
-	var permissions []models.Permission
+	// Only permissions of the catalog can be granted
+	permissions, err := s.repo.GetPermissionsByIDs(ctx, permissionIDs)
+	if err != nil {
+		return err
+	}
+	known := make(map[uuid.UUID]bool, len(permissions))
+	for _, permission := range permissions {
+		if IsKnownPermission(permission.Name) {
+			known[permission.ID] = true
+		}
+	}
 	for _, permID := range permissionIDs {
-		perm := models.Permission{
-			Base: models.Base{ID: permID},
+		if !known[permID] {
+			return fmt.Errorf("%w: unknown permission %s", ErrInvalidOperation, permID)
 		}
-		permissions = append(permissions, perm)
 	}
 
-	role.Permissions = permissions
-	return s.repo.UpdateRole(ctx, role)
+	if err := s.repo.ReplaceRolePermissions(ctx, role, permissions); err != nil {
+		return err
+	}
+
+	// Members holding the role may have cached its old permissions
+	s.permissions.InvalidateOrganization(ctx, role.OrganizationID)
+	return nil
 }
 
-// Helper function to check if a user has a specific permission in an organization
-func (s *service) hasPermission(ctx context.Context, userID, orgID uuid.UUID, permissionName string) (bool, error) {
-	user, err := s.repo.GetUserByID(ctx, userID)
+// ListPermissions returns the seeded permissions with the IDs roles refer to them by
+func (s *service) ListPermissions(ctx context.Context) ([]models.Permission, error) {
+	return s.repo.ListPermissions(ctx)
+}
+
+// templateRoles builds the built-in roles of a new organization and returns them by name.
+// The roles are given IDs but not stored.
+func (s *service) templateRoles(ctx context.Context, orgID uuid.UUID) (map[string]*models.Role, error) {
+	permissions, err := s.repo.ListPermissions(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	if user == nil {
-		return false, ErrUserNotFound
+	byName := make(map[string]models.Permission, len(permissions))
+	for _, permission := range permissions {
+		byName[permission.Name] = permission
 	}
 
-	// Check each organization the user belongs to
-	for _, org := range user.Organizations {
-		if org.ID == orgID {
-			// Check each role in the organization
-			for _, role := range org.Roles {
-				// Check each permission in the role
-				for _, perm := range role.Permissions {
-					if perm.Name == permissionName {
-						return true, nil
-					}
-				}
+	roles := make(map[string]*models.Role, len(RoleTemplates))
+	for _, template := range RoleTemplates {
+		role := &models.Role{
+			Base:           models.Base{ID: uuid.New()},
+			Name:           template.Name,
+			Description:    template.Description,
+			OrganizationID: orgID,
+		}
+		for _, name := range template.Permissions {
+			permission, ok := byName[name]
+			if !ok {
+				// The catalog and the seeded permissions are out of step
+				return nil, fmt.Errorf("%w: permission %s is not seeded", ErrInvalidOperation, name)
 			}
+			role.Permissions = append(role.Permissions, permission)
 		}
+		roles[template.Name] = role
 	}
+	return roles, nil
+}
 
-	return false, nil
+// Helper function to check if a user has a specific permission in an organization
+func (s *service) hasPermission(ctx context.Context, userID, orgID uuid.UUID, permissionName string) (bool, error) {
+	return s.permissions.HasPermission(ctx, userID, orgID, permissionName)
 }
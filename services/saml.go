@@ -0,0 +1,299 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/crewjam/saml/samlsp"
+	dsig "github.com/russellhaering/goxmldsig"
+)
+
+var (
+	ErrInvalidSAMLMetadata   = errors.New("invalid SAML identity provider metadata")
+	ErrInvalidSAMLResponse   = errors.New("invalid SAML response")
+	ErrSAMLAssertionReplayed = errors.New("SAML assertion has already been used")
+)
+
+const (
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+)
+
+// SAMLConfig identifies this server as a SAML 2.0 service provider to one identity
+// provider
+type SAMLConfig struct {
+	// EntityID defaults to MetadataURL
+	EntityID string
+	// MetadataURL is where this service provider's metadata is served
+	MetadataURL string
+	// ACSURL is the assertion consumer service the identity provider posts responses to
+	ACSURL string
+	// IDPMetadata is the identity provider's metadata XML
+	IDPMetadata []byte
+	// Key signs authentication requests and decrypts encrypted assertions
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// SAMLAssertion is a verified assertion. Attributes are keyed by name and, where the
+// identity provider sets one, by friendly name.
+type SAMLAssertion struct {
+	ID           string
+	Issuer       string
+	NameID       string
+	NameIDFormat string
+	Attributes   map[string][]string
+	ExpiresAt    time.Time
+}
+
+// SAMLServiceProvider signs authentication requests and verifies responses for one
+// identity provider. Only responses to requests this server made are accepted; the
+// caller keeps the request ID between the two steps.
+type SAMLServiceProvider struct {
+	sp         *saml.ServiceProvider
+	assertions SAMLAssertionStore
+}
+
+// SAMLAssertionStore remembers accepted assertions until they expire, so that a
+// captured response cannot be posted again. It must be shared by all servers;
+// repository.Repository keeps them in Postgres.
+type SAMLAssertionStore interface {
+	// RecordSAMLAssertion reports false if the assertion was recorded before
+	RecordSAMLAssertion(ctx context.Context, assertionHash string, expiresAt time.Time) (bool, error)
+}
+
+func NewSAMLServiceProvider(config SAMLConfig, assertions SAMLAssertionStore) (*SAMLServiceProvider, error) {
+	idpMetadata, err := samlsp.ParseMetadata(config.IDPMetadata)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLMetadata, err)
+	}
+	if len(idpMetadata.IDPSSODescriptors) == 0 {
+		return nil, fmt.Errorf("%w: no IDPSSODescriptor", ErrInvalidSAMLMetadata)
+	}
+
+	metadataURL, err := url.Parse(config.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+	acsURL, err := url.Parse(config.ACSURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SAMLServiceProvider{
+		sp: &saml.ServiceProvider{
+			EntityID:          config.EntityID,
+			Key:               config.Key,
+			Certificate:       config.Certificate,
+			MetadataURL:       *metadataURL,
+			AcsURL:            *acsURL,
+			IDPMetadata:       idpMetadata,
+			AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+			SignatureMethod:   dsig.RSASHA256SignatureMethod,
+		},
+		assertions: assertions,
+	}, nil
+}
+
+// Metadata returns this service provider's metadata XML for the identity provider
+func (sp *SAMLServiceProvider) Metadata() ([]byte, error) {
+	return xml.MarshalIndent(sp.sp.Metadata(), "", "  ")
+}
+
+// RedirectAuthnRequest returns a signed AuthnRequest as an HTTP-Redirect binding URL
+func (sp *SAMLServiceProvider) RedirectAuthnRequest(relayState string) (string, string, error) {
+	location := sp.sp.GetSSOBindingLocation(saml.HTTPRedirectBinding)
+	if location == "" {
+		return "", "", fmt.Errorf("%w: no HTTP-Redirect single sign-on service", ErrInvalidSAMLMetadata)
+	}
+	req, err := sp.sp.MakeAuthenticationRequest(location, saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", "", err
+	}
+	redirectURL, err := req.Redirect(url.QueryEscape(relayState), sp.sp)
+	if err != nil {
+		return "", "", err
+	}
+	return req.ID, redirectURL.String(), nil
+}
+
+// PostAuthnRequest returns a signed AuthnRequest as a self-submitting HTTP-POST binding
+// form
+func (sp *SAMLServiceProvider) PostAuthnRequest(relayState string) (string, []byte, error) {
+	location := sp.sp.GetSSOBindingLocation(saml.HTTPPostBinding)
+	if location == "" {
+		return "", nil, fmt.Errorf("%w: no HTTP-POST single sign-on service", ErrInvalidSAMLMetadata)
+	}
+	req, err := sp.sp.MakeAuthenticationRequest(location, saml.HTTPPostBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", nil, err
+	}
+	return req.ID, req.Post(relayState), nil
+}
+
+// ParseResponse verifies a base64-encoded SAMLResponse sent to the assertion consumer
+// service in reply to requestID. The response or its assertion must be signed by the
+// identity provider, addressed to this service provider, and within its validity
+// period. Each assertion is accepted once.
+func (sp *SAMLServiceProvider) ParseResponse(ctx context.Context, samlResponse, requestID string) (*SAMLAssertion, error) {
+	raw, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLResponse, err)
+	}
+	if err := checkSAMLResponseStructure(raw); err != nil {
+		return nil, err
+	}
+
+	assertion, err := sp.sp.ParseXMLResponse(raw, []string{requestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSAMLResponse, err)
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, fmt.Errorf("%w: assertion has no NameID", ErrInvalidSAMLResponse)
+	}
+
+	result := &SAMLAssertion{
+		ID:           assertion.ID,
+		Issuer:       assertion.Issuer.Value,
+		NameID:       assertion.Subject.NameID.Value,
+		NameIDFormat: assertion.Subject.NameID.Format,
+		Attributes:   make(map[string][]string),
+		ExpiresAt:    time.Now().Add(saml.MaxIssueDelay),
+	}
+	if assertion.Conditions != nil && !assertion.Conditions.NotOnOrAfter.IsZero() {
+		result.ExpiresAt = assertion.Conditions.NotOnOrAfter.Add(saml.MaxClockSkew)
+	}
+	for _, statement := range assertion.AttributeStatements {
+		for _, attribute := range statement.Attributes {
+			values := make([]string, 0, len(attribute.Values))
+			for _, value := range attribute.Values {
+				values = append(values, value.Value)
+			}
+			result.Attributes[attribute.Name] = values
+			if attribute.FriendlyName != "" {
+				result.Attributes[attribute.FriendlyName] = values
+			}
+		}
+	}
+
+	// Assertion IDs are only unique per identity provider
+	sum := sha256.Sum256([]byte(result.Issuer + " " + result.ID))
+	fresh, err := sp.assertions.RecordSAMLAssertion(ctx, hex.EncodeToString(sum[:]), result.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, ErrSAMLAssertionReplayed
+	}
+	return result, nil
+}
+
+// checkSAMLResponseStructure rejects responses that could smuggle an unsigned assertion
+// past a signature over another element: there must be exactly one assertion, directly
+// inside the Response, and no two elements may share an ID.
+func checkSAMLResponseStructure(raw []byte) error {
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSAMLResponse, err)
+	}
+	root := doc.Root()
+	if root == nil || root.Tag != "Response" || root.NamespaceURI() != samlProtocolNamespace {
+		return fmt.Errorf("%w: root element is not a Response", ErrInvalidSAMLResponse)
+	}
+
+	ids := make(map[string]bool)
+	assertions := 0
+	var walk func(el *etree.Element) error
+	walk = func(el *etree.Element) error {
+		if id := el.SelectAttrValue("ID", ""); id != "" {
+			if ids[id] {
+				return fmt.Errorf("%w: duplicate ID %q", ErrInvalidSAMLResponse, id)
+			}
+			ids[id] = true
+		}
+		if el.Tag == "Assertion" || el.Tag == "EncryptedAssertion" {
+			if el.Parent() != root || el.NamespaceURI() != samlAssertionNamespace {
+				return fmt.Errorf("%w: unexpected %s element", ErrInvalidSAMLResponse, el.Tag)
+			}
+			assertions++
+		}
+		for _, child := range el.ChildElements() {
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(root); err != nil {
+		return err
+	}
+	if assertions != 1 {
+		return fmt.Errorf("%w: expected one assertion, found %d", ErrInvalidSAMLResponse, assertions)
+	}
+	return nil
+}
+
+// generateSAMLKeyPair creates the key and self-signed certificate a service provider
+// signs its requests with, PEM-encoded
+func generateSAMLKeyPair(commonName string) (string, string, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	certificatePEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate})
+	return string(keyPEM), string(certificatePEM), nil
+}
+
+// parseSAMLKeyPair decodes a key pair created by generateSAMLKeyPair
+func parseSAMLKeyPair(keyPEM, certificatePEM string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	keyBlock, _ := pem.Decode([]byte(keyPEM))
+	certificateBlock, _ := pem.Decode([]byte(certificatePEM))
+	if keyBlock == nil || certificateBlock == nil {
+		return nil, nil, errors.New("malformed SAML service provider key pair")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	certificate, err := x509.ParseCertificate(certificateBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, certificate, nil
+}
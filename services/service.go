@@ -34,18 +34,36 @@ type Service interface {
 	// Role and Permission operations
 	CreateRole(ctx context.Context, orgID uuid.UUID, name, description string) (*models.Role, error)
 	AssignPermissionsToRole(ctx context.Context, roleID uuid.UUID, permissionIDs []uuid.UUID) error
+	ListPermissions(ctx context.Context) ([]models.Permission, error)
 
 	// Vault operations
-	CreateVaultItem(ctx context.Context, userID, orgID uuid.UUID, itemType, name string, data []byte) (*models.VaultItem, error)
+	CreateVaultItem(ctx context.Context, userID, orgID uuid.UUID, collectionID *uuid.UUID, itemType, name, encryptedData, encryptedPassword string) (*models.VaultItem, error)
+	UpdateVaultItem(ctx context.Context, userID, itemID uuid.UUID, collectionID *uuid.UUID, name, encryptedData string, encryptedPassword *string) (*models.VaultItem, error)
+	DeleteVaultItem(ctx context.Context, userID, itemID uuid.UUID) error
 	GetVaultItems(ctx context.Context, userID, orgID uuid.UUID) ([]models.VaultItem, error)
 }
 
 type service struct {
-	repo repository.Repository
+	repo            repository.Repository
+	loginProtection LoginProtectionService
+	sessions        SessionService
+	permissions     PermissionResolver
+	accountRecovery AccountRecoveryService
+	push            NotificationHub
 }
 
-func NewService(repo repository.Repository) Service {
-	return &service{repo: repo}
+// NewService creates the core service. accountRecovery applies the master_password
+// policy to members as they join. push may be nil, in which case connected clients are
+// not told about changes.
+func NewService(repo repository.Repository, loginProtection LoginProtectionService, sessions SessionService, permissions PermissionResolver, accountRecovery AccountRecoveryService, push NotificationHub) Service {
+	return &service{
+		repo:            repo,
+		loginProtection: loginProtection,
+		sessions:        sessions,
+		permissions:     permissions,
+		accountRecovery: accountRecovery,
+		push:            push,
+	}
 }
 
 // User operations implementation
@@ -76,20 +94,10 @@ func (s *service) CreateUser(ctx context.Context, email, name, password string)
 	return user, nil
 }
 
+// AuthenticateUser checks the master password. Repeated failures are throttled and can
+// lock the account; see LoginProtectionService.
 func (s *service) AuthenticateUser(ctx context.Context, email, password string) (*models.User, error) {
-	user, err := s.repo.GetUserByEmail(ctx, email)
-	if err != nil {
-		return nil, err
-	}
-	if user == nil {
-		return nil, ErrUserNotFound
-	}
-
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
-		return nil, ErrInvalidPassword
-	}
-
-	return user, nil
+	return s.loginProtection.AuthenticatePassword(ctx, email, password)
 }
 
 // Additional service implementations will be added in subsequent files...
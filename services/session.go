@@ -3,26 +3,133 @@ package services
 import (
 	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
 	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
 	"github.com/google/uuid"
 )
 
+var ErrInvalidSession = errors.New("invalid or expired session")
+
+const (
+	// sessionIdleTimeout ends sessions that are not used for this long, unless a
+	// session_timeout policy sets a shorter timeout
+	sessionIdleTimeout = 24 * time.Hour
+	// sessionMaxLifetime ends sessions this long after they began however often they are
+	// used, unless a session_timeout policy sets a shorter lifetime
+	sessionMaxLifetime = 30 * 24 * time.Hour
+	// sessionTouchInterval limits how often a use of the session is written back
+	sessionTouchInterval = time.Minute
+	// sessionCacheTTL bounds how long a revocation on another server can go unnoticed
+	sessionCacheTTL = 30 * time.Second
+	// sessionRetention is how long expired and revoked sessions are kept before cleanup
+	sessionRetention = 7 * 24 * time.Hour
+	// sessionTicketTTL is how long a client has to open its connection with a ticket
+	sessionTicketTTL = 30 * time.Second
+)
+
 type SessionService interface {
-	CreateSession(ctx context.Context, userID uuid.UUID, deviceInfo string) (*models.Session, error)
-	ValidateSession(ctx context.Context, sessionID string) (*models.Session, error)
-	RevokeSession(ctx context.Context, sessionID string) error
+	// CreateSession signs the user in on the device, which may be uuid.Nil if the client
+	// did not name one. It fails if device approval refuses the device. When the login
+	// came with a DPoP proof, the session is bound to the key that signed it; when it came
+	// through an organization's single sign-on, the session belongs to that organization.
+	CreateSession(ctx context.Context, userID, deviceID uuid.UUID, deviceInfo string) (*models.Session, error)
+	ValidateSession(ctx context.Context, token string) (*models.Session, error)
+	RevokeSession(ctx context.Context, token string) error
 	RevokeAllUserSessions(ctx context.Context, userID uuid.UUID) error
+	RevokeOtherSessions(ctx context.Context, userID, currentSessionID uuid.UUID) error
+	// RetireKeyVersion ends the user's sessions issued under a user key older than
+	// version, except the current one, which moves to the new version
+	RetireKeyVersion(ctx context.Context, userID, currentSessionID uuid.UUID, version int) error
+	// CreateSessionTicket issues a ticket that stands in for the session token once,
+	// within sessionTicketTTL, for clients that cannot send the token
+	CreateSessionTicket(ctx context.Context, sessionID uuid.UUID) (*models.SessionTicket, error)
+	// RedeemSessionTicket uses up the ticket and returns its session if it is still
+	// active
+	RedeemSessionTicket(ctx context.Context, ticket string) (*models.Session, error)
+	// RunCleanup deletes stale sessions and tickets every interval until ctx is done
+	RunCleanup(ctx context.Context, interval time.Duration)
+
+	// ListSessions returns the user's active sessions, marking the current one
+	ListSessions(ctx context.Context, userID, currentSessionID uuid.UUID) ([]SessionInfo, error)
+	// RevokeUserSession revokes one of the user's own sessions
+	RevokeUserSession(ctx context.Context, userID, sessionID uuid.UUID) error
+	// ListMemberSessions, RevokeMemberSession and RevokeMemberSessions let an admin of an
+	// organization act on the member's sessions signed in through the organization's
+	// single sign-on; every call is audited in the organization's log.
+	ListMemberSessions(ctx context.Context, orgID, adminID, memberID uuid.UUID) ([]SessionInfo, error)
+	RevokeMemberSession(ctx context.Context, orgID, adminID, memberID, sessionID uuid.UUID) error
+	RevokeMemberSessions(ctx context.Context, orgID, adminID, memberID uuid.UUID) error
+}
+
+type sessionContextKey struct{}
+
+type deviceContextKey struct{}
+
+// ContextWithSessionID returns a context carrying the ID of the session serving the request
+func ContextWithSessionID(ctx context.Context, sessionID uuid.UUID) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, sessionID)
+}
+
+// SessionIDFromContext returns the ID of the session serving the request, or uuid.Nil
+func SessionIDFromContext(ctx context.Context) uuid.UUID {
+	if sessionID, ok := ctx.Value(sessionContextKey{}).(uuid.UUID); ok {
+		return sessionID
+	}
+	return uuid.Nil
+}
+
+// ContextWithDeviceID returns a context carrying the ID of the device the session serving
+// the request was signed in on
+func ContextWithDeviceID(ctx context.Context, deviceID uuid.UUID) context.Context {
+	return context.WithValue(ctx, deviceContextKey{}, deviceID)
+}
+
+// DeviceIDFromContext returns the ID of the device the request comes from, or uuid.Nil
+func DeviceIDFromContext(ctx context.Context) uuid.UUID {
+	if deviceID, ok := ctx.Value(deviceContextKey{}).(uuid.UUID); ok {
+		return deviceID
+	}
+	return uuid.Nil
+}
+
+// cachedSession is a session as kept in the cache. CachedAt lets stale copies be
+// ignored even if the cache keeps them longer.
+type cachedSession struct {
+	Session  models.Session `json:"session"`
+	CachedAt time.Time      `json:"cached_at"`
 }
 
 type sessionService struct {
-	repo repository.Repository
+	repo        repository.Repository
+	policies    PolicyService
+	devices     DeviceService
+	permissions PermissionResolver
+	cache       CacheService
+	geoip       GeoIPResolver
+	push        NotificationHub
 }
 
-func NewSessionService(repo repository.Repository) SessionService {
-	return &sessionService{repo: repo}
+// NewSessionService creates a session service storing sessions in Postgres. cache may
+// be nil; when set, validated sessions are cached briefly to spare the database. geoip
+// may be nil, in which case session locations are not shown. push may be nil; when set,
+// connections of revoked sessions are told to log out.
+func NewSessionService(repo repository.Repository, policies PolicyService, devices DeviceService, permissions PermissionResolver, cache CacheService, geoip GeoIPResolver, push NotificationHub) SessionService {
+	return &sessionService{
+		repo:        repo,
+		policies:    policies,
+		devices:     devices,
+		permissions: permissions,
+		cache:       cache,
+		geoip:       geoip,
+		push:        push,
+	}
 }
 
 func generateSessionToken() (string, error) {
@@ -33,23 +140,77 @@ func generateSessionToken() (string, error) {
 	return base64.URLEncoding.EncodeToString(bytes), nil
 }
 
-func (s *sessionService) CreateSession(ctx context.Context, userID uuid.UUID, deviceInfo string) (*models.Session, error) {
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *sessionService) CreateSession(ctx context.Context, userID, deviceID uuid.UUID, deviceInfo string) (*models.Session, error) {
+	device, err := s.devices.CheckLoginDevice(ctx, userID, deviceID, deviceInfo)
+	if err != nil {
+		return nil, err
+	}
+	proof := DPoPProofFromContext(ctx)
+	if proof == nil {
+		required, err := s.dpopRequired(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if required {
+			return nil, ErrDPoPProofRequired
+		}
+	}
+
 	token, err := generateSessionToken()
 	if err != nil {
 		return nil, err
 	}
 
+	idleTimeout, maxLifetime, err := s.sessionLimits(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
 	session := &models.Session{
-		UserID:     userID,
-		Token:      token,
-		DeviceInfo: deviceInfo,
-		ExpiresAt:  time.Now().Add(24 * time.Hour), // 24-hour session
-		LastUsed:   time.Now(),
+		Base:               models.Base{ID: uuid.New(), CreatedAt: now, UpdatedAt: now},
+		UserID:             userID,
+		Token:              token,
+		TokenHash:          hashSessionToken(token),
+		DeviceInfo:         deviceInfo,
+		ClientType:         string(sessionClientType(deviceInfo)),
+		IPAddress:          ClientIPFromContext(ctx),
+		IdleTimeoutMinutes: int(idleTimeout / time.Minute),
+		ExpiresAt:          now.Add(idleTimeout),
+		AbsoluteExpiresAt:  now.Add(maxLifetime),
+		LastUsed:           now,
+	}
+	if session.ExpiresAt.After(session.AbsoluteExpiresAt) {
+		session.ExpiresAt = session.AbsoluteExpiresAt
+	}
+	if device != nil {
+		session.DeviceID = &device.ID
+	}
+	if proof != nil {
+		session.KeyThumbprint = proof.Thumbprint
+	}
+	if orgID := SessionOrganizationFromContext(ctx); orgID != uuid.Nil {
+		session.OrganizationID = &orgID
+	}
+	if user, err := s.repo.GetUserByID(ctx, userID); err == nil && user != nil {
+		session.KeyVersion = user.KeyVersion
+	}
+	if err := s.repo.CreateSession(ctx, session); err != nil {
+		return nil, err
 	}
 
 	// Create audit log
 	metadata := createBasicMetadata("session_created", "New session created")
 	metadata["device_info"] = deviceInfo
+	metadata["session_id"] = session.ID.String()
+	if device != nil {
+		metadata["device_id"] = device.ID.String()
+	}
 	if err := s.createAuditLog(ctx, AuditEventUserLogin, userID, uuid.Nil, metadata); err != nil {
 		return nil, err
 	}
@@ -57,33 +218,349 @@ func (s *sessionService) CreateSession(ctx context.Context, userID uuid.UUID, de
 	return session, nil
 }
 
-func (s *sessionService) ValidateSession(ctx context.Context, sessionID string) (*models.Session, error) {
-	// TODO: Implement session validation
-	// 1. Retrieve session from storage
-	// 2. Check if expired
-	// 3. Update last used timestamp
-	// 4. Return session if valid
-	return nil, nil
+// dpopRequired reports whether an organization the user is a confirmed member of only
+// allows sessions bound to a device key
+func (s *sessionService) dpopRequired(ctx context.Context, userID uuid.UUID) (bool, error) {
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, member := range memberships {
+		if member.Status != organizationMemberStatusConfirmed {
+			continue
+		}
+		required, err := s.policies.RequiresDPoP(ctx, member.OrganizationID)
+		if err != nil {
+			return false, err
+		}
+		if required {
+			return true, nil
+		}
+	}
+	return false, nil
 }
 
-func (s *sessionService) RevokeSession(ctx context.Context, sessionID string) error {
-	// TODO: Implement session revocation
-	// 1. Mark session as revoked
-	// 2. Create audit log
-	return nil
+// sessionLimits returns the idle timeout and maximum lifetime for a new session of the
+// user: the server defaults, shortened by the strictest session_timeout policy of the
+// organizations the user is a confirmed member of
+func (s *sessionService) sessionLimits(ctx context.Context, userID uuid.UUID) (time.Duration, time.Duration, error) {
+	idleTimeout, maxLifetime := sessionIdleTimeout, sessionMaxLifetime
+
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, member := range memberships {
+		if member.Status != organizationMemberStatusConfirmed {
+			continue
+		}
+		policy, err := s.policies.GetSessionTimeoutPolicy(ctx, member.OrganizationID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if policy == nil {
+			continue
+		}
+		if timeout := time.Duration(policy.IdleTimeoutMinutes) * time.Minute; timeout > 0 && timeout < idleTimeout {
+			idleTimeout = timeout
+		}
+		if lifetime := time.Duration(policy.MaxLifetimeHours) * time.Hour; lifetime > 0 && lifetime < maxLifetime {
+			maxLifetime = lifetime
+		}
+	}
+	return idleTimeout, maxLifetime, nil
+}
+
+// ValidateSession returns the active session for the token and extends its expiry by
+// the idle timeout, up to its absolute expiry. Sessions issued under a user key that
+// has since been rotated are refused.
+func (s *sessionService) ValidateSession(ctx context.Context, token string) (*models.Session, error) {
+	tokenHash := hashSessionToken(token)
+
+	session := s.getCachedSession(ctx, tokenHash)
+	cached := session != nil
+	if !cached {
+		stored, err := s.repo.GetSessionByTokenHash(ctx, tokenHash)
+		if err != nil {
+			return nil, err
+		}
+		session = stored
+	}
+
+	now := time.Now()
+	if session == nil || session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+		s.deleteCachedSession(ctx, tokenHash)
+		return nil, ErrInvalidSession
+	}
+	if !cached {
+		// Cached sessions were checked when cached; retiring a key version evicts them
+		current, err := s.keyVersionCurrent(ctx, session)
+		if err != nil {
+			return nil, err
+		}
+		if !current {
+			return nil, ErrInvalidSession
+		}
+	}
+	if err := CheckDPoPBinding(ctx, session.KeyThumbprint, token); err != nil {
+		return nil, err
+	}
+
+	if now.Sub(session.LastUsed) >= sessionTouchInterval {
+		expiresAt := now.Add(time.Duration(session.IdleTimeoutMinutes) * time.Minute)
+		if expiresAt.After(session.AbsoluteExpiresAt) {
+			expiresAt = session.AbsoluteExpiresAt
+		}
+		ip := ClientIPFromContext(ctx)
+		active, err := s.repo.TouchSession(ctx, session.ID, now, expiresAt, ip)
+		if err != nil {
+			return nil, err
+		}
+		if !active {
+			s.deleteCachedSession(ctx, tokenHash)
+			return nil, ErrInvalidSession
+		}
+		session.LastUsed = now
+		session.ExpiresAt = expiresAt
+		if ip != "" {
+			session.IPAddress = ip
+		}
+		s.setCachedSession(ctx, session)
+	} else if !cached {
+		s.setCachedSession(ctx, session)
+	}
+
+	return session, nil
+}
+
+func (s *sessionService) CreateSessionTicket(ctx context.Context, sessionID uuid.UUID) (*models.SessionTicket, error) {
+	ticket, err := generateSessionToken()
+	if err != nil {
+		return nil, err
+	}
+	sessionTicket := &models.SessionTicket{
+		TicketHash: hashSessionToken(ticket),
+		Ticket:     ticket,
+		SessionID:  sessionID,
+		ExpiresAt:  time.Now().Add(sessionTicketTTL),
+	}
+	if err := s.repo.CreateSessionTicket(ctx, sessionTicket); err != nil {
+		return nil, err
+	}
+	return sessionTicket, nil
+}
+
+func (s *sessionService) RedeemSessionTicket(ctx context.Context, ticket string) (*models.Session, error) {
+	sessionTicket, err := s.repo.TakeSessionTicket(ctx, hashSessionToken(ticket))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if sessionTicket == nil || !now.Before(sessionTicket.ExpiresAt) {
+		return nil, ErrInvalidSession
+	}
+
+	session, err := s.repo.GetSession(ctx, sessionTicket.SessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.RevokedAt != nil || !now.Before(session.ExpiresAt) {
+		return nil, ErrInvalidSession
+	}
+	current, err := s.keyVersionCurrent(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	if !current {
+		return nil, ErrInvalidSession
+	}
+	return session, nil
+}
+
+func (s *sessionService) RevokeSession(ctx context.Context, token string) error {
+	tokenHash := hashSessionToken(token)
+	session, err := s.repo.GetSessionByTokenHash(ctx, tokenHash)
+	if err != nil {
+		return err
+	}
+	s.deleteCachedSession(ctx, tokenHash)
+	if session == nil {
+		return ErrInvalidSession
+	}
+
+	revoked, err := s.repo.RevokeSession(ctx, session.ID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return nil
+	}
+	pushSync(ctx, s.push, PushTarget{UserID: session.UserID, SessionID: session.ID}, PushLogout, uuid.Nil, uuid.Nil)
+
+	// Create audit log
+	metadata := createBasicMetadata("session_revoked", "Session revoked")
+	metadata["session_id"] = session.ID.String()
+	metadata["device_info"] = session.DeviceInfo
+	return s.createAuditLog(ctx, "session.revoked", session.UserID, uuid.Nil, metadata)
+}
+
+type sessionOrganizationContextKey struct{}
+
+// ContextWithSessionOrganization returns a context carrying the organization whose
+// single sign-on signed the user in
+func ContextWithSessionOrganization(ctx context.Context, orgID uuid.UUID) context.Context {
+	return context.WithValue(ctx, sessionOrganizationContextKey{}, orgID)
+}
+
+// SessionOrganizationFromContext returns the organization whose single sign-on signed
+// the user in, or uuid.Nil
+func SessionOrganizationFromContext(ctx context.Context) uuid.UUID {
+	if orgID, ok := ctx.Value(sessionOrganizationContextKey{}).(uuid.UUID); ok {
+		return orgID
+	}
+	return uuid.Nil
 }
 
 func (s *sessionService) RevokeAllUserSessions(ctx context.Context, userID uuid.UUID) error {
-	// TODO: Implement bulk session revocation
-	// 1. Mark all user sessions as revoked
-	// 2. Create audit log
+	return s.RevokeOtherSessions(ctx, userID, uuid.Nil)
+}
+
+// RevokeOtherSessions revokes all sessions of a user except the current one
+func (s *sessionService) RevokeOtherSessions(ctx context.Context, userID, currentSessionID uuid.UUID) error {
+	if err := s.revokeUserSessions(ctx, userID, currentSessionID); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("sessions_revoked", "User sessions revoked")
+	if currentSessionID != uuid.Nil {
+		metadata["kept_session_id"] = currentSessionID.String()
+	}
+	return s.createAuditLog(ctx, "session.revoked_all", userID, uuid.Nil, metadata)
+}
+
+// revokeUserSessions revokes all sessions of a user except keepSessionID, evicts them
+// from the cache and tells their connections to log out
+func (s *sessionService) revokeUserSessions(ctx context.Context, userID, keepSessionID uuid.UUID) error {
+	if s.cache != nil {
+		sessions, err := s.repo.ListActiveUserSessions(ctx, userID)
+		if err != nil {
+			return err
+		}
+		for _, session := range sessions {
+			if session.ID != keepSessionID {
+				s.deleteCachedSession(ctx, session.TokenHash)
+			}
+		}
+	}
+
+	if err := s.repo.RevokeUserSessions(ctx, userID, keepSessionID); err != nil {
+		return err
+	}
+	pushSync(ctx, s.push, PushTarget{UserID: userID, OriginSessionID: keepSessionID}, PushLogout, uuid.Nil, uuid.Nil)
 	return nil
 }
 
+func (s *sessionService) RetireKeyVersion(ctx context.Context, userID, currentSessionID uuid.UUID, version int) error {
+	if err := s.RevokeOtherSessions(ctx, userID, currentSessionID); err != nil {
+		return err
+	}
+	if currentSessionID == uuid.Nil {
+		return nil
+	}
+
+	session, err := s.repo.GetSession(ctx, currentSessionID)
+	if err != nil {
+		return err
+	}
+	if session == nil || session.UserID != userID {
+		return nil
+	}
+	s.deleteCachedSession(ctx, session.TokenHash)
+	return s.repo.SetSessionKeyVersion(ctx, session.ID, version)
+}
+
+// keyVersionCurrent reports whether the session was issued under the user's current key
+func (s *sessionService) keyVersionCurrent(ctx context.Context, session *models.Session) (bool, error) {
+	user, err := s.repo.GetUserByID(ctx, session.UserID)
+	if err != nil {
+		return false, err
+	}
+	return user != nil && session.KeyVersion >= user.KeyVersion, nil
+}
+
+func (s *sessionService) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.cleanupExpiredSessions(ctx); err != nil {
+			log.Printf("Failed to clean up sessions: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 // Helper function to clean up expired sessions
 func (s *sessionService) cleanupExpiredSessions(ctx context.Context) error {
-	// TODO: Implement session cleanup
-	// 1. Delete expired sessions
-	// 2. Create audit logs
-	return nil
+	deleted, err := s.repo.DeleteStaleSessions(ctx, time.Now().Add(-sessionRetention))
+	if err != nil {
+		return err
+	}
+	if deleted > 0 {
+		log.Printf("Deleted %d stale sessions", deleted)
+	}
+	_, err = s.repo.DeleteExpiredSessionTickets(ctx, time.Now())
+	return err
+}
+
+func (s *sessionService) getCachedSession(ctx context.Context, tokenHash string) *models.Session {
+	if s.cache == nil {
+		return nil
+	}
+	value, err := s.cache.Get(ctx, generateSessionCacheKey(tokenHash))
+	if err != nil || value == nil {
+		return nil
+	}
+	cached, ok := value.(*cachedSession)
+	if !ok {
+		cached = &cachedSession{}
+		if err := decodeCachedValue(value, cached); err != nil {
+			return nil
+		}
+	}
+	if time.Since(cached.CachedAt) > sessionCacheTTL {
+		return nil
+	}
+	session := cached.Session
+	return &session
+}
+
+func (s *sessionService) setCachedSession(ctx context.Context, session *models.Session) {
+	if s.cache == nil {
+		return
+	}
+	cached := &cachedSession{Session: *session, CachedAt: time.Now()}
+	if err := s.cache.Set(ctx, generateSessionCacheKey(session.TokenHash), cached, sessionCacheTTL); err != nil {
+		log.Printf("Failed to cache session %s: %v", session.ID, err)
+	}
+}
+
+func (s *sessionService) deleteCachedSession(ctx context.Context, tokenHash string) {
+	evictCachedSession(ctx, s.cache, tokenHash)
+}
+
+// evictCachedSession removes a session from the session cache, which may be nil, so
+// that a revocation takes effect before the cached copy expires
+func evictCachedSession(ctx context.Context, cache CacheService, tokenHash string) {
+	if cache == nil {
+		return
+	}
+	if err := cache.Delete(ctx, generateSessionCacheKey(tokenHash)); err != nil {
+		log.Printf("Failed to evict cached session: %v", err)
+	}
 }
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+var ErrSessionNotFound = errors.New("session not found")
+
+// SessionInfo describes an active session without its token
+type SessionInfo struct {
+	ID         uuid.UUID    `json:"id"`
+	DeviceID   *uuid.UUID   `json:"device_id,omitempty"`
+	Device     string       `json:"device"`
+	ClientType string       `json:"client_type,omitempty"`
+	IPAddress  string       `json:"ip_address,omitempty"`
+	Location   *GeoLocation `json:"location,omitempty"`
+	Current    bool         `json:"current"`
+	CreatedAt  time.Time    `json:"created_at"`
+	LastUsed   time.Time    `json:"last_used"`
+	ExpiresAt  time.Time    `json:"expires_at"`
+}
+
+func (s *sessionService) ListSessions(ctx context.Context, userID, currentSessionID uuid.UUID) ([]SessionInfo, error) {
+	sessions, err := s.repo.ListActiveUserSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]SessionInfo, 0, len(sessions))
+	for i := range sessions {
+		info := s.sessionInfo(&sessions[i])
+		info.Current = sessions[i].ID == currentSessionID
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (s *sessionService) RevokeUserSession(ctx context.Context, userID, sessionID uuid.UUID) error {
+	session, err := s.getSession(ctx, userID, sessionID)
+	if err != nil {
+		return err
+	}
+	if err := s.revokeSession(ctx, session); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("session_revoked", "Session revoked")
+	metadata["session_id"] = session.ID.String()
+	metadata["device_info"] = session.DeviceInfo
+	return s.createAuditLog(ctx, "session.revoked", userID, uuid.Nil, metadata)
+}
+
+// memberSessionScope is recorded on audit logs of admins acting on member sessions
+const memberSessionScope = "organization"
+
+// ListMemberSessions lets an admin with the manage_sessions permission see the member's
+// active sessions signed in through the organization. Sessions the member opened
+// otherwise are theirs alone.
+func (s *sessionService) ListMemberSessions(ctx context.Context, orgID, adminID, memberID uuid.UUID) ([]SessionInfo, error) {
+	if err := requireMemberPermission(ctx, s.permissions, s.repo, orgID, adminID, memberID, PermissionManageSessions); err != nil {
+		return nil, err
+	}
+	active, err := s.repo.ListActiveOrganizationSessions(ctx, orgID, memberID)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]SessionInfo, 0, len(active))
+	for i := range active {
+		sessions = append(sessions, s.sessionInfo(&active[i]))
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("member_sessions_viewed", "Member sessions viewed by admin")
+	metadata["member_id"] = memberID.String()
+	metadata["scope"] = memberSessionScope
+	metadata["session_count"] = len(sessions)
+	if err := s.createAuditLog(ctx, "organization.sessions_viewed", adminID, orgID, metadata); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// RevokeMemberSession lets an admin with the manage_sessions permission sign a member
+// out of one of their sessions signed in through the organization
+func (s *sessionService) RevokeMemberSession(ctx context.Context, orgID, adminID, memberID, sessionID uuid.UUID) error {
+	if err := requireMemberPermission(ctx, s.permissions, s.repo, orgID, adminID, memberID, PermissionManageSessions); err != nil {
+		return err
+	}
+	session, err := s.getSession(ctx, memberID, sessionID)
+	if err != nil {
+		return err
+	}
+	if session.OrganizationID == nil || *session.OrganizationID != orgID {
+		return ErrSessionNotFound
+	}
+	if err := s.revokeSession(ctx, session); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("member_session_revoked", "Member session revoked by admin")
+	metadata["session_id"] = session.ID.String()
+	metadata["member_id"] = memberID.String()
+	metadata["scope"] = memberSessionScope
+	return s.createAuditLog(ctx, "organization.session_revoked", adminID, orgID, metadata)
+}
+
+// RevokeMemberSessions lets an admin with the manage_sessions permission sign a member
+// out of every session signed in through the organization. The member stays signed in
+// wherever they signed in otherwise.
+func (s *sessionService) RevokeMemberSessions(ctx context.Context, orgID, adminID, memberID uuid.UUID) error {
+	if err := requireMemberPermission(ctx, s.permissions, s.repo, orgID, adminID, memberID, PermissionManageSessions); err != nil {
+		return err
+	}
+	revoked, err := s.repo.RevokeOrganizationSessions(ctx, orgID, memberID)
+	if err != nil {
+		return err
+	}
+	for _, session := range revoked {
+		s.deleteCachedSession(ctx, session.TokenHash)
+		pushSync(ctx, s.push, PushTarget{UserID: memberID, SessionID: session.ID}, PushLogout, uuid.Nil, uuid.Nil)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("member_sessions_revoked", "Member sessions revoked by admin")
+	metadata["member_id"] = memberID.String()
+	metadata["scope"] = memberSessionScope
+	metadata["session_count"] = len(revoked)
+	return s.createAuditLog(ctx, "organization.sessions_revoked", adminID, orgID, metadata)
+}
+
+func (s *sessionService) getSession(ctx context.Context, userID, sessionID uuid.UUID) (*models.Session, error) {
+	session, err := s.repo.GetSession(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if session == nil || session.UserID != userID || session.RevokedAt != nil || !time.Now().Before(session.ExpiresAt) {
+		return nil, ErrSessionNotFound
+	}
+	return session, nil
+}
+
+func (s *sessionService) revokeSession(ctx context.Context, session *models.Session) error {
+	s.deleteCachedSession(ctx, session.TokenHash)
+	revoked, err := s.repo.RevokeSession(ctx, session.ID)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return ErrSessionNotFound
+	}
+	pushSync(ctx, s.push, PushTarget{UserID: session.UserID, SessionID: session.ID}, PushLogout, uuid.Nil, uuid.Nil)
+	return nil
+}
+
+func (s *sessionService) sessionInfo(session *models.Session) SessionInfo {
+	info := SessionInfo{
+		ID:         session.ID,
+		DeviceID:   session.DeviceID,
+		Device:     session.DeviceInfo,
+		ClientType: session.ClientType,
+		IPAddress:  session.IPAddress,
+		CreatedAt:  session.CreatedAt,
+		LastUsed:   session.LastUsed,
+		ExpiresAt:  session.ExpiresAt,
+	}
+	if s.geoip != nil && session.IPAddress != "" {
+		location, err := s.geoip.Lookup(session.IPAddress)
+		if err != nil && !errors.Is(err, ErrInvalidIPAddress) {
+			log.Printf("Failed to locate session %s: %v", session.ID, err)
+		}
+		info.Location = location
+	}
+	return info
+}
+
+// sessionClientType guesses the kind of client from its user agent
+func sessionClientType(userAgent string) DeviceType {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case ua == "":
+		return ""
+	case strings.Contains(ua, "passwordimmunity-cli"), strings.HasPrefix(ua, "curl/"):
+		return DeviceCLI
+	case strings.Contains(ua, "electron"):
+		return DeviceDesktop
+	case strings.Contains(ua, "mobile"), strings.Contains(ua, "android"), strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"):
+		return DeviceMobile
+	case strings.Contains(ua, "mozilla"):
+		return DeviceBrowser
+	default:
+		return ""
+	}
+}
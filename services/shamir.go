@@ -0,0 +1,138 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// Shamir secret sharing over GF(2^8) with the AES reduction polynomial. Each byte of
+// the secret is the constant term of its own random polynomial of degree threshold-1.
+// A share is its x coordinate (1-255) followed by one y value per secret byte.
+
+var (
+	ErrInvalidShareCount = errors.New("threshold must be at least 2 and no greater than the number of shares, at most 255")
+	ErrInvalidShares     = errors.New("shares are malformed, duplicated or of different lengths")
+)
+
+var gfExp, gfLog = buildGFTables()
+
+// buildGFTables builds exponent and logarithm tables for generator 0x03
+func buildGFTables() (exp [510]byte, logs [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		logs[x] = byte(i)
+		x = gfMulSlow(x, 3)
+	}
+	return exp, logs
+}
+
+func gfMulSlow(a, b byte) byte {
+	var product byte
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return product
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// SplitSecret splits secret into n shares, any threshold of which reconstruct it
+func SplitSecret(secret []byte, n, threshold int) ([][]byte, error) {
+	if threshold < 2 || threshold > n || n > 255 {
+		return nil, ErrInvalidShareCount
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret must not be empty")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for j, b := range secret {
+		coefficients[0] = b
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for i := range shares {
+			x := shares[i][0]
+			// Horner's method
+			var y byte
+			for k := threshold - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ coefficients[k]
+			}
+			shares[i][j+1] = y
+		}
+	}
+
+	for i := range coefficients {
+		coefficients[i] = 0
+	}
+
+	return shares, nil
+}
+
+// CombineShares reconstructs a secret from at least threshold shares using Lagrange
+// interpolation at x = 0. Fewer shares yield an unrelated value, so callers verify the
+// result against a known hash.
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, ErrInvalidShares
+	}
+
+	length := len(shares[0])
+	if length < 2 {
+		return nil, ErrInvalidShares
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, share := range shares {
+		if len(share) != length || share[0] == 0 || seen[share[0]] {
+			return nil, ErrInvalidShares
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, length-1)
+	for i, share := range shares {
+		// Lagrange basis polynomial for this share evaluated at 0
+		basis := byte(1)
+		for j, other := range shares {
+			if i == j {
+				continue
+			}
+			basis = gfMul(basis, gfDiv(other[0], other[0]^share[0]))
+		}
+
+		for k := range secret {
+			secret[k] ^= gfMul(basis, share[k+1])
+		}
+	}
+
+	return secret, nil
+}
@@ -2,14 +2,34 @@ package services
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
 	"github.com/google/uuid"
+	"golang.org/x/oauth2"
 )
 
+var (
+	ErrSSONotConfigured   = errors.New("SSO is not configured for this organization")
+	ErrSSOStateNotFound   = errors.New("SSO login not found or expired")
+	ErrSSOUserNotFound    = errors.New("no member of this organization matches the SSO identity")
+	ErrSSOKeyNotAvailable = errors.New("SSO configuration key is not set")
+)
+
+// ssoStateTTL is how long the user has to sign in at the identity provider
+const ssoStateTTL = 10 * time.Minute
+
 type SSOProvider string
 
 const (
@@ -18,80 +38,551 @@ const (
 	SSOProviderOAuth2 SSOProvider = "oauth2"
 )
 
+// SSOConfig is an organization's SSO configuration. For OIDC, MetadataURL is the
+// issuer or its discovery document, CallbackURL the redirect URL registered with the
+// provider, and Configuration["scopes"] an optional space-separated scope list. For
+// SAML, MetadataURL is the identity provider's metadata, CallbackURL this server's
+// assertion consumer service, and Configuration["entity_id"],
+// Configuration["email_attribute"] and Configuration["name_attribute"] optionally
+// override the service provider's entity ID and the attributes holding the member's
+// email address and name.
 type SSOConfig struct {
-	Provider      SSOProvider         `json:"provider"`
-	ClientID      string             `json:"client_id"`
-	ClientSecret  string             `json:"client_secret"`
-	MetadataURL   string             `json:"metadata_url"`
-	CallbackURL   string             `json:"callback_url"`
-	Configuration map[string]string  `json:"configuration"`
-	Enabled       bool               `json:"enabled"`
+	Provider      SSOProvider       `json:"provider"`
+	ClientID      string            `json:"client_id"`
+	ClientSecret  string            `json:"client_secret,omitempty"`
+	MetadataURL   string            `json:"metadata_url"`
+	CallbackURL   string            `json:"callback_url"`
+	Configuration map[string]string `json:"configuration"`
+	Enabled       bool              `json:"enabled"`
+	// SPCertificate and SPPrivateKey are the SAML service provider's signing key pair,
+	// generated by the server. The private key is never returned.
+	SPCertificate string `json:"sp_certificate,omitempty"`
+	SPPrivateKey  string `json:"sp_private_key,omitempty"`
+	// Provisioning creates and updates members from the identity provider's claims
+	Provisioning *SSOProvisioning `json:"provisioning,omitempty"`
 }
 
+// SSOService configures single sign-on for organizations and signs members in through
+// their identity provider. Users are matched by the provider's subject, or on first
+// login by a verified email address of an existing member.
 type SSOService interface {
-	ConfigureSSO(ctx context.Context, orgID uuid.UUID, config SSOConfig) error
-	GetSSOConfig(ctx context.Context, orgID uuid.UUID) (*SSOConfig, error)
-	InitiateSSO(ctx context.Context, orgID uuid.UUID, provider SSOProvider) (string, error)
-	HandleCallback(ctx context.Context, orgID uuid.UUID, code string) (*models.User, error)
+	// ConfigureSSO stores the configuration encrypted. An empty ClientSecret keeps the
+	// stored one.
+	ConfigureSSO(ctx context.Context, orgID, adminID uuid.UUID, config SSOConfig) error
+	// GetSSOConfig returns the configuration without its client secret
+	GetSSOConfig(ctx context.Context, orgID, adminID uuid.UUID) (*SSOConfig, error)
+	// InitiateSSO returns the identity provider URL to redirect the user to. For SAML it
+	// carries a signed AuthnRequest in the HTTP-Redirect binding. deviceID is the
+	// signing-in device, if known, and is handed back when the login completes.
+	InitiateSSO(ctx context.Context, orgID uuid.UUID, provider SSOProvider, deviceID uuid.UUID) (string, error)
+	// HandleCallback completes an OIDC login started by InitiateSSO with the state and
+	// code the identity provider redirected back with
+	HandleCallback(ctx context.Context, orgID uuid.UUID, state, code string) (*SSOLoginResult, error)
+
+	// GetSAMLMetadata returns the organization's service provider metadata XML
+	GetSAMLMetadata(ctx context.Context, orgID uuid.UUID) ([]byte, error)
+	// InitiateSAMLPost returns an HTML form that posts a signed AuthnRequest to the
+	// identity provider (the HTTP-POST binding)
+	InitiateSAMLPost(ctx context.Context, orgID uuid.UUID, deviceID uuid.UUID) ([]byte, error)
+	// HandleSAMLResponse completes a SAML login with the SAMLResponse and RelayState
+	// posted to the assertion consumer service
+	HandleSAMLResponse(ctx context.Context, orgID uuid.UUID, samlResponse, relayState string) (*SSOLoginResult, error)
+
+	// PreviewSSOMapping shows what the provisioning rules, or the stored ones if nil,
+	// would grant a member with the sample claims
+	PreviewSSOMapping(ctx context.Context, orgID, adminID uuid.UUID, provisioning *SSOProvisioning, claims map[string]interface{}) (*SSOMappingResult, error)
+
+	// RunCleanup forgets unfinished logins and used SAML assertions once they expire,
+	// every interval until ctx is done
+	RunCleanup(ctx context.Context, interval time.Duration)
+}
+
+// SSOLoginResult is the member an SSO login signed in and the device the login was
+// started from, or uuid.Nil
+type SSOLoginResult struct {
+	User     *models.User
+	DeviceID uuid.UUID
+}
+
+// ssoRelyingParty is an organization's identity provider, set up from its discovery
+// document or metadata and cached until the configuration changes
+type ssoRelyingParty struct {
+	config          *SSOConfig
+	relyingParty    *OIDCRelyingParty
+	serviceProvider *SAMLServiceProvider
+	configuredAt    time.Time
+}
+
+// ssoIdentity is who the identity provider says signed in
+type ssoIdentity struct {
+	provider      SSOProvider
+	issuer        string
+	subject       string
+	email         string
+	emailVerified bool
+	name          string
+	// claims maps each claim or attribute name to its values
+	claims map[string][]string
 }
 
 type ssoService struct {
-	repo repository.Repository
-	encryption EncryptionService
+	repo           repository.Repository
+	encryption     EncryptionService
+	configKey      []byte
+	mu             sync.Mutex
+	relyingParties map[uuid.UUID]*ssoRelyingParty
+	permissions    PermissionResolver
+	recovery       AccountRecoveryService
+	risk           LoginRiskService
+	protection     LoginProtectionService
+	push           NotificationHub
 }
 
-func NewSSOService(repo repository.Repository, encryption EncryptionService) SSOService {
+// NewSSOService creates the SSO service. configKey is the 32-byte AES key that SSO
+// configurations are encrypted with. Role changes made by the group mapping are passed
+// on to permissions. Members created by JIT provisioning are enrolled through recovery
+// when the master_password policy asks for it. Like password logins, SSO logins are
+// refused while the account is locked and are scored by risk. push may be nil; when
+// set, the member's connected clients are told when a login changes their role or
+// collections.
+func NewSSOService(repo repository.Repository, encryption EncryptionService, configKey []byte, permissions PermissionResolver, recovery AccountRecoveryService, risk LoginRiskService, protection LoginProtectionService, push NotificationHub) SSOService {
 	return &ssoService{
-		repo: repo,
-		encryption: encryption,
+		repo:           repo,
+		encryption:     encryption,
+		configKey:      configKey,
+		relyingParties: make(map[uuid.UUID]*ssoRelyingParty),
+		permissions:    permissions,
+		recovery:       recovery,
+		risk:           risk,
+		protection:     protection,
+		push:           push,
 	}
 }
 
-func (s *ssoService) ConfigureSSO(ctx context.Context, orgID uuid.UUID, config SSOConfig) error {
+func (s *ssoService) ConfigureSSO(ctx context.Context, orgID, adminID uuid.UUID, config SSOConfig) error {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageSSO); err != nil {
+		return err
+	}
+
+	stored, err := s.repo.GetSSOConfiguration(ctx, orgID)
+	if err != nil {
+		return err
+	}
+	config.SPCertificate, config.SPPrivateKey = "", ""
+	if stored != nil {
+		previous, err := s.decryptConfig(stored)
+		if err != nil {
+			return err
+		}
+		if config.ClientSecret == "" {
+			config.ClientSecret = previous.ClientSecret
+		}
+		config.SPCertificate, config.SPPrivateKey = previous.SPCertificate, previous.SPPrivateKey
+	}
+	if err := s.validateSSOConfig(config); err != nil {
+		return err
+	}
+	if config.Provisioning != nil {
+		if err := s.validateSSOProvisioning(ctx, orgID, config.Provisioning); err != nil {
+			return err
+		}
+	}
+	if config.Provider == SSOProviderSAML && config.SPPrivateKey == "" {
+		config.SPPrivateKey, config.SPCertificate, err = generateSAMLKeyPair(config.CallbackURL)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Encrypt sensitive configuration data
 	configBytes, err := json.Marshal(config)
 	if err != nil {
 		return err
 	}
+	encryptedConfig, err := s.encryptConfig(configBytes)
+	if err != nil {
+		return err
+	}
 
-	encryptedConfig, err := s.encryption.EncryptSymmetric(configBytes, []byte("your-encryption-key"))
+	if stored == nil {
+		err = s.repo.CreateSSOConfiguration(ctx, &models.SSOConfiguration{
+			OrganizationID:  orgID,
+			Provider:        string(config.Provider),
+			EncryptedConfig: string(encryptedConfig),
+			Enabled:         config.Enabled,
+		})
+	} else {
+		stored.Provider = string(config.Provider)
+		stored.EncryptedConfig = string(encryptedConfig)
+		stored.Enabled = config.Enabled
+		err = s.repo.UpdateSSOConfiguration(ctx, stored)
+	}
 	if err != nil {
 		return err
 	}
 
+	s.mu.Lock()
+	delete(s.relyingParties, orgID)
+	s.mu.Unlock()
+
 	// Create audit log
 	metadata := createBasicMetadata("sso_configured", "SSO configuration updated")
 	metadata["provider"] = string(config.Provider)
-	if err := s.createAuditLog(ctx, "sso.configured", uuid.Nil, orgID, metadata); err != nil {
-		return err
+	metadata["enabled"] = config.Enabled
+	return s.createAuditLog(ctx, "sso.configured", adminID, orgID, metadata)
+}
+
+func (s *ssoService) GetSSOConfig(ctx context.Context, orgID, adminID uuid.UUID) (*SSOConfig, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageSSO); err != nil {
+		return nil, err
 	}
 
-	// TODO: Store encrypted configuration
-	return nil
+	stored, err := s.repo.GetSSOConfiguration(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil {
+		return nil, ErrSSONotConfigured
+	}
+	config, err := s.decryptConfig(stored)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientSecret = ""
+	config.SPPrivateKey = ""
+	return config, nil
 }
 
-func (s *ssoService) GetSSOConfig(ctx context.Context, orgID uuid.UUID) (*SSOConfig, error) {
-	// TODO: Implement SSO configuration retrieval
-	return nil, errors.New("not implemented")
+// InitiateSSO starts an authorization code flow with PKCE. The nonce and code verifier
+// are kept in Postgres under the state for ssoStateTTL, so the callback may reach any
+// server.
+func (s *ssoService) InitiateSSO(ctx context.Context, orgID uuid.UUID, provider SSOProvider, deviceID uuid.UUID) (string, error) {
+	switch provider {
+	case SSOProviderOIDC:
+	case SSOProviderSAML:
+		return s.initiateSAMLRedirect(ctx, orgID, deviceID)
+	default:
+		return "", ErrInvalidOperation
+	}
+
+	cached, err := s.loadProvider(ctx, orgID, SSOProviderOIDC)
+	if err != nil {
+		return "", err
+	}
+
+	state, err := generateSSOToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := generateSSOToken()
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	err = s.storeLogin(ctx, state, &models.SSOLogin{
+		OrganizationID: orgID,
+		Provider:       string(SSOProviderOIDC),
+		Nonce:          nonce,
+		CodeVerifier:   verifier,
+	}, deviceID)
+	if err != nil {
+		return "", err
+	}
+	return cached.relyingParty.AuthCodeURL(state, nonce, verifier), nil
 }
 
-func (s *ssoService) InitiateSSO(ctx context.Context, orgID uuid.UUID, provider SSOProvider) (string, error) {
-	// TODO: Implement SSO initiation
-	// 1. Get SSO configuration
-	// 2. Generate state parameter
-	// 3. Create authorization URL
-	// 4. Return URL for redirect
-	return "", errors.New("not implemented")
+// HandleCallback redeems the code and returns the member the ID token identifies. Each
+// state can be used once.
+func (s *ssoService) HandleCallback(ctx context.Context, orgID uuid.UUID, state, code string) (*SSOLoginResult, error) {
+	login, err := s.takeLogin(ctx, orgID, SSOProviderOIDC, state)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := s.loadProvider(ctx, orgID, SSOProviderOIDC)
+	if err != nil {
+		return nil, err
+	}
+
+	claims, err := cached.relyingParty.Exchange(ctx, code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		s.auditFailedLogin(ctx, orgID, SSOProviderOIDC, err)
+		return nil, err
+	}
+
+	deviceID := ssoLoginDevice(login)
+	user, err := s.completeLogin(ctx, orgID, cached.config, ssoIdentity{
+		provider:      SSOProviderOIDC,
+		issuer:        claims.Issuer,
+		subject:       claims.Subject,
+		email:         claims.Email,
+		emailVerified: claims.EmailVerified,
+		name:          claims.Name,
+		claims:        normalizeSSOClaims(claims.Raw),
+	}, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return &SSOLoginResult{User: user, DeviceID: deviceID}, nil
 }
 
-func (s *ssoService) HandleCallback(ctx context.Context, orgID uuid.UUID, code string) (*models.User, error) {
-	// TODO: Implement SSO callback handling
-	// 1. Validate state parameter
-	// 2. Exchange code for tokens
-	// 3. Get user information
-	// 4. Create or update user
-	// 5. Create audit log
-	return nil, errors.New("not implemented")
+// completeLogin finds or provisions the member the identity provider vouched for,
+// refuses the login if the account is locked or the login too risky, applies the group
+// mapping and audits the login
+func (s *ssoService) completeLogin(ctx context.Context, orgID uuid.UUID, config *SSOConfig, identity ssoIdentity, deviceID uuid.UUID) (*models.User, error) {
+	user, err := s.findUser(ctx, orgID, identity, config.Provisioning)
+	if err != nil {
+		s.auditFailedLogin(ctx, orgID, identity.provider, err)
+		return nil, err
+	}
+	if err := s.protection.CheckLockout(ctx, user.ID); err != nil {
+		s.auditFailedLogin(ctx, orgID, identity.provider, err)
+		return nil, err
+	}
+	if _, err := s.risk.AssessLogin(ctx, user, deviceID); err != nil {
+		s.auditFailedLogin(ctx, orgID, identity.provider, err)
+		return nil, err
+	}
+	if config.Provisioning != nil {
+		if err := s.applySSOMapping(ctx, orgID, user.ID, config.Provisioning.Evaluate(identity.claims)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("sso_login", "Signed in with SSO")
+	metadata["provider"] = string(identity.provider)
+	metadata["issuer"] = identity.issuer
+	metadata["subject"] = identity.subject
+	if err := s.createAuditLog(ctx, "user.sso_login", user.ID, orgID, metadata); err != nil {
+		return nil, err
+	}
+	if err := s.risk.RecordLogin(ctx, user, deviceID); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// findUser looks the user up by the provider's subject. On first login it links the
+// subject to the member with the same verified email address, or with JIT provisioning
+// creates the account if no user has that address. Existing accounts are never added
+// to the organization this way; they have to be invited.
+func (s *ssoService) findUser(ctx context.Context, orgID uuid.UUID, identity ssoIdentity, provisioning *SSOProvisioning) (*models.User, error) {
+	linked, err := s.repo.GetSSOIdentity(ctx, orgID, identity.issuer, identity.subject)
+	if err != nil {
+		return nil, err
+	}
+	if linked != nil {
+		user, err := s.repo.GetUserByID(ctx, linked.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, ErrSSOUserNotFound
+		}
+		return s.requireMember(ctx, orgID, user)
+	}
+
+	// Only the provider's verified addresses can be trusted to identify an account
+	if identity.email == "" || !identity.emailVerified {
+		return nil, ErrSSOUserNotFound
+	}
+	user, err := s.repo.GetUserByEmail(ctx, identity.email)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case user != nil:
+		if _, err := s.requireMember(ctx, orgID, user); err != nil {
+			return nil, err
+		}
+	case provisioning != nil && provisioning.JIT:
+		if user, err = s.provisionUser(ctx, orgID, identity, provisioning); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrSSOUserNotFound
+	}
+
+	linked = &models.SSOIdentity{
+		UserID:         user.ID,
+		OrganizationID: orgID,
+		Issuer:         identity.issuer,
+		Subject:        identity.subject,
+	}
+	if err := s.repo.CreateSSOIdentity(ctx, linked); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("sso_identity_linked", "SSO identity linked by verified email")
+	metadata["provider"] = string(identity.provider)
+	metadata["issuer"] = identity.issuer
+	metadata["subject"] = identity.subject
+	if err := s.createAuditLog(ctx, "user.sso_identity_linked", user.ID, orgID, metadata); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// requireMember returns the user if they are a confirmed member of the organization
+func (s *ssoService) requireMember(ctx context.Context, orgID uuid.UUID, user *models.User) (*models.User, error) {
+	member, err := s.repo.GetOrganizationUser(ctx, orgID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	if member == nil || member.Status != organizationMemberStatusConfirmed {
+		return nil, ErrSSOUserNotFound
+	}
+	return user, nil
+}
+
+func (s *ssoService) auditFailedLogin(ctx context.Context, orgID uuid.UUID, provider SSOProvider, cause error) {
+	// Create audit log
+	metadata := createBasicMetadata("sso_login_failed", "SSO login failed")
+	metadata["provider"] = string(provider)
+	metadata["reason"] = cause.Error()
+	if err := s.createAuditLog(ctx, "organization.sso_login_failed", uuid.Nil, orgID, metadata); err != nil {
+		log.Printf("Failed to create audit log: %v", err)
+	}
+}
+
+// loadProvider returns the organization's identity provider if SSO is enabled with the
+// given protocol. Discovery or metadata is fetched when the configuration is new or has
+// changed.
+func (s *ssoService) loadProvider(ctx context.Context, orgID uuid.UUID, provider SSOProvider) (*ssoRelyingParty, error) {
+	stored, err := s.repo.GetSSOConfiguration(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	if stored == nil || !stored.Enabled || stored.Provider != string(provider) {
+		return nil, ErrSSONotConfigured
+	}
+
+	s.mu.Lock()
+	cached := s.relyingParties[orgID]
+	s.mu.Unlock()
+	if cached != nil && cached.configuredAt.Equal(stored.UpdatedAt) {
+		return cached, nil
+	}
+
+	config, err := s.decryptConfig(stored)
+	if err != nil {
+		return nil, err
+	}
+	cached = &ssoRelyingParty{config: config, configuredAt: stored.UpdatedAt}
+	switch provider {
+	case SSOProviderOIDC:
+		cached.relyingParty, err = NewOIDCRelyingParty(ctx, OIDCConfig{
+			MetadataURL:  config.MetadataURL,
+			ClientID:     config.ClientID,
+			ClientSecret: config.ClientSecret,
+			RedirectURL:  config.CallbackURL,
+			Scopes:       strings.Fields(config.Configuration["scopes"]),
+		}, nil)
+	case SSOProviderSAML:
+		cached.serviceProvider, err = s.newSAMLServiceProvider(ctx, config)
+	default:
+		err = ErrSSONotConfigured
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.relyingParties[orgID] = cached
+	s.mu.Unlock()
+	return cached, nil
+}
+
+func (s *ssoService) encryptConfig(plaintext []byte) ([]byte, error) {
+	if len(s.configKey) == 0 {
+		return nil, ErrSSOKeyNotAvailable
+	}
+	return s.encryption.EncryptSymmetric(plaintext, s.configKey)
+}
+
+func (s *ssoService) decryptConfig(stored *models.SSOConfiguration) (*SSOConfig, error) {
+	if len(s.configKey) == 0 {
+		return nil, ErrSSOKeyNotAvailable
+	}
+	plaintext, err := s.encryption.DecryptSymmetric([]byte(stored.EncryptedConfig), s.configKey)
+	if err != nil {
+		return nil, err
+	}
+	var config SSOConfig
+	if err := json.Unmarshal(plaintext, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// storeLogin keeps the login under a hash of its state until ssoStateTTL has passed
+func (s *ssoService) storeLogin(ctx context.Context, state string, login *models.SSOLogin, deviceID uuid.UUID) error {
+	login.StateHash = hashSSOState(state)
+	login.ExpiresAt = time.Now().Add(ssoStateTTL)
+	if deviceID != uuid.Nil {
+		login.DeviceID = &deviceID
+	}
+	return s.repo.CreateSSOLogin(ctx, login)
+}
+
+// takeLogin removes the login stored under state and returns it if it was started for
+// the organization with the provider and has not expired. Each state can be used once.
+func (s *ssoService) takeLogin(ctx context.Context, orgID uuid.UUID, provider SSOProvider, state string) (*models.SSOLogin, error) {
+	if state == "" {
+		return nil, ErrSSOStateNotFound
+	}
+	login, err := s.repo.TakeSSOLogin(ctx, hashSSOState(state))
+	if err != nil {
+		return nil, err
+	}
+	if login == nil || login.OrganizationID != orgID || login.Provider != string(provider) || time.Now().After(login.ExpiresAt) {
+		return nil, ErrSSOStateNotFound
+	}
+	return login, nil
+}
+
+// RunCleanup deletes expired logins and assertions. Expired ones are refused anyway;
+// this only keeps the tables small.
+func (s *ssoService) RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			now := time.Now()
+			if _, err := s.repo.DeleteExpiredSSOLogins(ctx, now); err != nil {
+				log.Printf("Failed to delete expired SSO logins: %v", err)
+			}
+			if _, err := s.repo.DeleteExpiredSAMLAssertions(ctx, now); err != nil {
+				log.Printf("Failed to delete expired SAML assertions: %v", err)
+			}
+		}
+	}
+}
+
+func ssoLoginDevice(login *models.SSOLogin) uuid.UUID {
+	if login.DeviceID == nil {
+		return uuid.Nil
+	}
+	return *login.DeviceID
+}
+
+func hashSSOState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+func generateSSOToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
 }
 
 // Helper function to validate SSO configuration
@@ -99,18 +590,24 @@ func (s *ssoService) validateSSOConfig(config SSOConfig) error {
 	switch config.Provider {
 	case SSOProviderSAML:
 		if config.MetadataURL == "" {
-			return errors.New("SAML metadata URL is required")
+			return fmt.Errorf("%w: SAML metadata URL is required", ErrInvalidOperation)
+		}
+		if !strings.HasSuffix(config.CallbackURL, samlACSPath) {
+			return fmt.Errorf("%w: SAML callback URL must end with %s", ErrInvalidOperation, samlACSPath)
 		}
 	case SSOProviderOIDC:
 		if config.ClientID == "" || config.ClientSecret == "" {
-			return errors.New("OIDC client credentials are required")
+			return fmt.Errorf("%w: OIDC client credentials are required", ErrInvalidOperation)
+		}
+		if config.MetadataURL == "" || config.CallbackURL == "" {
+			return fmt.Errorf("%w: OIDC metadata and callback URLs are required", ErrInvalidOperation)
 		}
 	case SSOProviderOAuth2:
 		if config.ClientID == "" || config.ClientSecret == "" {
-			return errors.New("OAuth2 client credentials are required")
+			return fmt.Errorf("%w: OAuth2 client credentials are required", ErrInvalidOperation)
 		}
 	default:
-		return errors.New("unsupported SSO provider")
+		return fmt.Errorf("%w: unsupported SSO provider", ErrInvalidOperation)
 	}
 	return nil
 }
@@ -0,0 +1,403 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+// defaultSSOGroupsClaim is the claim or attribute mapping rules match by default
+const defaultSSOGroupsClaim = "groups"
+
+// SSOProvisioning controls what an SSO login does to the member's account. With JIT,
+// the first login of an email address that has no account yet creates the account and
+// a confirmed membership. Rules are evaluated on every login and map claim values, such
+// as the groups the identity provider lists, to a role and collection access.
+type SSOProvisioning struct {
+	JIT bool `json:"jit"`
+	// GroupsClaim is the claim or SAML attribute rules match when they don't name one
+	GroupsClaim string `json:"groups_claim,omitempty"`
+	// DefaultRoleID is the role of members no role rule matches
+	DefaultRoleID *uuid.UUID     `json:"default_role_id,omitempty"`
+	Rules         []SSOGroupRule `json:"rules"`
+}
+
+// SSOGroupRule applies when the claim contains Value. The first matching rule with a
+// role decides the member's role; the groups and collection grants of all matching
+// rules are combined.
+type SSOGroupRule struct {
+	Claim       string               `json:"claim,omitempty"`
+	Value       string               `json:"value"`
+	RoleID      *uuid.UUID           `json:"role_id,omitempty"`
+	Groups      []uuid.UUID          `json:"groups,omitempty"`
+	Collections []SSOCollectionGrant `json:"collections,omitempty"`
+}
+
+type SSOCollectionGrant struct {
+	CollectionID uuid.UUID        `json:"collection_id"`
+	Access       CollectionAccess `json:"access,omitempty"`
+	// ReadOnly is only read from mappings saved before access levels; Access takes
+	// precedence
+	ReadOnly bool `json:"read_only,omitempty"`
+}
+
+// access returns the level of the grant. Grants saved before access levels are view
+// or edit depending on their read-only flag.
+func (g SSOCollectionGrant) access() CollectionAccess {
+	if g.Access != "" {
+		return g.Access
+	}
+	if g.ReadOnly {
+		return CollectionAccessView
+	}
+	return CollectionAccessEdit
+}
+
+// SSOMappingResult is what the rules grant a member with a given set of claims
+type SSOMappingResult struct {
+	// MatchedRules are the indexes of the rules that matched
+	MatchedRules []int                `json:"matched_rules"`
+	RoleID       *uuid.UUID           `json:"role_id,omitempty"`
+	Groups       []uuid.UUID          `json:"groups"`
+	Collections  []SSOCollectionGrant `json:"collections"`
+}
+
+// Evaluate applies the rules to the claims, which map each claim or attribute name to
+// its values. Claim values are compared case-insensitively.
+func (p *SSOProvisioning) Evaluate(claims map[string][]string) *SSOMappingResult {
+	result := &SSOMappingResult{MatchedRules: []int{}, Groups: []uuid.UUID{}, Collections: []SSOCollectionGrant{}}
+	access := make(map[uuid.UUID]CollectionAccess)
+	groups := make(map[uuid.UUID]bool)
+
+	for i, rule := range p.Rules {
+		claim := rule.Claim
+		if claim == "" {
+			claim = p.groupsClaim()
+		}
+		if !contains(claims[claim], rule.Value) {
+			continue
+		}
+
+		result.MatchedRules = append(result.MatchedRules, i)
+		if result.RoleID == nil && rule.RoleID != nil {
+			result.RoleID = rule.RoleID
+		}
+		for _, groupID := range rule.Groups {
+			groups[groupID] = true
+		}
+		// A collection granted by several rules gets the access any of them allows
+		for _, grant := range rule.Collections {
+			access[grant.CollectionID] = MergeCollectionAccess(access[grant.CollectionID], grant.access())
+		}
+	}
+	if result.RoleID == nil {
+		result.RoleID = p.DefaultRoleID
+	}
+
+	for groupID := range groups {
+		result.Groups = append(result.Groups, groupID)
+	}
+	sort.Slice(result.Groups, func(i, j int) bool {
+		return result.Groups[i].String() < result.Groups[j].String()
+	})
+	for collectionID, level := range access {
+		result.Collections = append(result.Collections, SSOCollectionGrant{CollectionID: collectionID, Access: level})
+	}
+	sort.Slice(result.Collections, func(i, j int) bool {
+		return result.Collections[i].CollectionID.String() < result.Collections[j].CollectionID.String()
+	})
+	return result
+}
+
+func (p *SSOProvisioning) groupsClaim() string {
+	if p.GroupsClaim != "" {
+		return p.GroupsClaim
+	}
+	return defaultSSOGroupsClaim
+}
+
+// PreviewSSOMapping evaluates mapping rules against sample claims without changing any
+// member. It uses the stored rules unless provisioning is given.
+func (s *ssoService) PreviewSSOMapping(ctx context.Context, orgID, adminID uuid.UUID, provisioning *SSOProvisioning, claims map[string]interface{}) (*SSOMappingResult, error) {
+	if err := s.permissions.RequirePermission(ctx, adminID, orgID, PermissionManageSSO); err != nil {
+		return nil, err
+	}
+
+	if provisioning == nil {
+		stored, err := s.repo.GetSSOConfiguration(ctx, orgID)
+		if err != nil {
+			return nil, err
+		}
+		if stored == nil {
+			return nil, ErrSSONotConfigured
+		}
+		config, err := s.decryptConfig(stored)
+		if err != nil {
+			return nil, err
+		}
+		provisioning = config.Provisioning
+	} else if err := s.validateSSOProvisioning(ctx, orgID, provisioning); err != nil {
+		return nil, err
+	}
+	if provisioning == nil {
+		provisioning = &SSOProvisioning{}
+	}
+
+	return provisioning.Evaluate(normalizeSSOClaims(claims)), nil
+}
+
+// provisionUser creates the account and membership of a member the identity provider
+// knows but this server doesn't. The account has no master password.
+func (s *ssoService) provisionUser(ctx context.Context, orgID uuid.UUID, identity ssoIdentity, provisioning *SSOProvisioning) (*models.User, error) {
+	name := identity.name
+	if name == "" {
+		name = identity.email
+	}
+	user := &models.User{
+		Email: identity.email,
+		Name:  name,
+	}
+	if err := s.repo.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+
+	// The organization key is wrapped for the member on their first sync
+	member := &models.OrganizationUser{
+		UserID:         user.ID,
+		OrganizationID: orgID,
+		RoleID:         provisioning.DefaultRoleID,
+		Status:         organizationMemberStatusConfirmed,
+		CreatedAt:      time.Now(),
+	}
+	if err := s.repo.UpdateOrganizationUser(ctx, member); err != nil {
+		return nil, err
+	}
+	if err := s.recovery.ApplyAccountRecoveryPolicy(ctx, orgID, user.ID); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("sso_user_provisioned", "User provisioned by SSO")
+	metadata["provider"] = string(identity.provider)
+	metadata["issuer"] = identity.issuer
+	metadata["subject"] = identity.subject
+	if err := s.createAuditLog(ctx, "user.sso_provisioned", user.ID, orgID, metadata); err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// applySSOMapping brings the member's role, SSO-managed group memberships and
+// SSO-managed collection grants in line with the mapping. Memberships and grants made
+// by admins are left alone.
+func (s *ssoService) applySSOMapping(ctx context.Context, orgID, userID uuid.UUID, mapping *SSOMappingResult) error {
+	member, err := s.repo.GetOrganizationUser(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if member == nil {
+		return ErrSSOUserNotFound
+	}
+
+	changes := make(map[string]interface{})
+	if mapping.RoleID != nil && (member.RoleID == nil || *member.RoleID != *mapping.RoleID) {
+		member.RoleID = mapping.RoleID
+		if err := s.repo.UpdateOrganizationUser(ctx, member); err != nil {
+			return err
+		}
+		s.permissions.InvalidateMember(ctx, orgID, userID)
+		changes["role_id"] = mapping.RoleID.String()
+	}
+
+	memberships, err := s.repo.ListUserGroups(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	inGroup := make(map[uuid.UUID]models.GroupUser, len(memberships))
+	for _, membership := range memberships {
+		inGroup[membership.GroupID] = membership
+	}
+
+	var joined, left []string
+	wantedGroups := make(map[uuid.UUID]bool, len(mapping.Groups))
+	for _, groupID := range mapping.Groups {
+		wantedGroups[groupID] = true
+		if _, ok := inGroup[groupID]; ok {
+			continue
+		}
+		// Groups deleted since the rules were saved are skipped
+		group, err := s.repo.GetGroup(ctx, groupID)
+		if err != nil {
+			return err
+		}
+		if group == nil || group.OrganizationID != orgID {
+			continue
+		}
+		err = s.repo.AddGroupUser(ctx, &models.GroupUser{
+			GroupID:      groupID,
+			UserID:       userID,
+			ManagedBySSO: true,
+			CreatedAt:    time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		joined = append(joined, groupID.String())
+	}
+	for _, membership := range memberships {
+		if !membership.ManagedBySSO || wantedGroups[membership.GroupID] {
+			continue
+		}
+		if err := s.repo.RemoveGroupUser(ctx, membership.GroupID, userID); err != nil {
+			return err
+		}
+		left = append(left, membership.GroupID.String())
+	}
+	if len(joined) > 0 || len(left) > 0 {
+		s.permissions.InvalidateMember(ctx, orgID, userID)
+	}
+	if len(joined) > 0 {
+		changes["groups_joined"] = joined
+	}
+	if len(left) > 0 {
+		changes["groups_left"] = left
+	}
+
+	grants, err := s.repo.ListUserCollectionGrants(ctx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	existing := make(map[uuid.UUID]models.CollectionUser, len(grants))
+	for _, grant := range grants {
+		existing[grant.CollectionID] = grant
+	}
+
+	var granted, revoked []string
+	wanted := make(map[uuid.UUID]bool, len(mapping.Collections))
+	for _, grant := range mapping.Collections {
+		wanted[grant.CollectionID] = true
+		current, ok := existing[grant.CollectionID]
+		if ok && (!current.ManagedBySSO || current.Access == string(grant.Access)) {
+			continue
+		}
+		err := s.repo.UpdateCollectionUser(ctx, &models.CollectionUser{
+			CollectionID: grant.CollectionID,
+			UserID:       userID,
+			Access:       string(grant.Access),
+			ManagedBySSO: true,
+			CreatedAt:    time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		granted = append(granted, grant.CollectionID.String())
+	}
+	for _, grant := range grants {
+		if !grant.ManagedBySSO || wanted[grant.CollectionID] {
+			continue
+		}
+		if err := s.repo.RemoveCollectionUser(ctx, grant.CollectionID, userID); err != nil {
+			return err
+		}
+		revoked = append(revoked, grant.CollectionID.String())
+	}
+	if len(granted) > 0 {
+		changes["collections_granted"] = granted
+	}
+	if len(revoked) > 0 {
+		changes["collections_revoked"] = revoked
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	pushSync(ctx, s.push, PushTarget{UserID: userID}, PushSyncOrganization, uuid.Nil, orgID)
+
+	// Create audit log
+	metadata := createBasicMetadata("sso_mapping_applied", "SSO group mapping applied")
+	for key, value := range changes {
+		metadata[key] = value
+	}
+	return s.createAuditLog(ctx, "user.sso_mapping_applied", userID, orgID, metadata)
+}
+
+// validateSSOProvisioning checks that the rules only refer to the organization's roles,
+// groups and collections
+func (s *ssoService) validateSSOProvisioning(ctx context.Context, orgID uuid.UUID, provisioning *SSOProvisioning) error {
+	roleIDs := []*uuid.UUID{provisioning.DefaultRoleID}
+	var groupIDs, collectionIDs []uuid.UUID
+	for i, rule := range provisioning.Rules {
+		if rule.Value == "" {
+			return fmt.Errorf("%w: mapping rule %d has no value", ErrInvalidOperation, i)
+		}
+		roleIDs = append(roleIDs, rule.RoleID)
+		groupIDs = append(groupIDs, rule.Groups...)
+		for _, grant := range rule.Collections {
+			if grant.Access != "" && !grant.Access.Valid() {
+				return fmt.Errorf("%w: mapping rule %d has unknown collection access %q", ErrInvalidOperation, i, grant.Access)
+			}
+			collectionIDs = append(collectionIDs, grant.CollectionID)
+		}
+	}
+
+	for _, roleID := range roleIDs {
+		if roleID == nil {
+			continue
+		}
+		role, err := s.repo.GetRoleByID(ctx, *roleID)
+		if err != nil {
+			return err
+		}
+		if role == nil || role.OrganizationID != orgID {
+			return fmt.Errorf("%w: unknown role %s", ErrInvalidOperation, roleID)
+		}
+	}
+	for _, groupID := range groupIDs {
+		group, err := s.repo.GetGroup(ctx, groupID)
+		if err != nil {
+			return err
+		}
+		if group == nil || group.OrganizationID != orgID {
+			return fmt.Errorf("%w: unknown group %s", ErrInvalidOperation, groupID)
+		}
+	}
+	for _, collectionID := range collectionIDs {
+		collection, err := s.repo.GetCollection(ctx, collectionID)
+		if err != nil {
+			return err
+		}
+		if collection == nil || collection.OrganizationID != orgID {
+			return fmt.Errorf("%w: unknown collection %s", ErrInvalidOperation, collectionID)
+		}
+	}
+	return nil
+}
+
+// normalizeSSOClaims turns decoded JSON claims into lists of strings. Lists are
+// flattened; other values are formatted.
+func normalizeSSOClaims(raw map[string]interface{}) map[string][]string {
+	claims := make(map[string][]string, len(raw))
+	for name, value := range raw {
+		switch v := value.(type) {
+		case nil:
+		case string:
+			claims[name] = []string{v}
+		case []string:
+			claims[name] = v
+		case []interface{}:
+			values := make([]string, 0, len(v))
+			for _, item := range v {
+				if item != nil {
+					values = append(values, fmt.Sprint(item))
+				}
+			}
+			claims[name] = values
+		default:
+			claims[name] = []string{fmt.Sprint(v)}
+		}
+	}
+	return claims
+}
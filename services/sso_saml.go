@@ -0,0 +1,202 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+// The service provider endpoints sit next to each other under the organization's SSO
+// routes; the metadata URL is derived from the configured assertion consumer service.
+const (
+	samlACSPath      = "/saml/acs"
+	samlMetadataPath = "/saml/metadata"
+	// maxSAMLMetadataSize bounds the identity provider metadata the server will download
+	maxSAMLMetadataSize = 1 << 20
+)
+
+// samlEmailAttributes are the attributes common identity providers send the email
+// address in, tried in order unless Configuration["email_attribute"] names one
+var samlEmailAttributes = []string{
+	"email",
+	"mail",
+	"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+	"urn:oid:0.9.2342.19200300.100.1.3",
+}
+
+// samlNameAttributes hold the member's display name, unless
+// Configuration["name_attribute"] names another
+var samlNameAttributes = []string{
+	"displayName",
+	"http://schemas.microsoft.com/identity/claims/displayname",
+	"cn",
+}
+
+const samlEmailNameIDFormat = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+
+func (s *ssoService) GetSAMLMetadata(ctx context.Context, orgID uuid.UUID) ([]byte, error) {
+	cached, err := s.loadProvider(ctx, orgID, SSOProviderSAML)
+	if err != nil {
+		return nil, err
+	}
+	return cached.serviceProvider.Metadata()
+}
+
+// initiateSAMLRedirect starts a login with the HTTP-Redirect binding. The AuthnRequest
+// ID is kept in Postgres under the relay state for ssoStateTTL.
+func (s *ssoService) initiateSAMLRedirect(ctx context.Context, orgID, deviceID uuid.UUID) (string, error) {
+	cached, relayState, err := s.startSAMLLogin(ctx, orgID)
+	if err != nil {
+		return "", err
+	}
+	requestID, redirectURL, err := cached.serviceProvider.RedirectAuthnRequest(relayState)
+	if err != nil {
+		return "", err
+	}
+	if err := s.storeSAMLLogin(ctx, orgID, deviceID, relayState, requestID); err != nil {
+		return "", err
+	}
+	return redirectURL, nil
+}
+
+func (s *ssoService) InitiateSAMLPost(ctx context.Context, orgID, deviceID uuid.UUID) ([]byte, error) {
+	cached, relayState, err := s.startSAMLLogin(ctx, orgID)
+	if err != nil {
+		return nil, err
+	}
+	requestID, form, err := cached.serviceProvider.PostAuthnRequest(relayState)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.storeSAMLLogin(ctx, orgID, deviceID, relayState, requestID); err != nil {
+		return nil, err
+	}
+	return form, nil
+}
+
+// HandleSAMLResponse accepts only responses to a request this server made for the
+// organization. IdP-initiated logins are refused.
+func (s *ssoService) HandleSAMLResponse(ctx context.Context, orgID uuid.UUID, samlResponse, relayState string) (*SSOLoginResult, error) {
+	login, err := s.takeLogin(ctx, orgID, SSOProviderSAML, relayState)
+	if err != nil {
+		return nil, err
+	}
+	cached, err := s.loadProvider(ctx, orgID, SSOProviderSAML)
+	if err != nil {
+		return nil, err
+	}
+
+	assertion, err := cached.serviceProvider.ParseResponse(ctx, samlResponse, login.RequestID)
+	if err != nil {
+		s.auditFailedLogin(ctx, orgID, SSOProviderSAML, err)
+		return nil, err
+	}
+
+	email := samlEmail(assertion, cached.config)
+	deviceID := ssoLoginDevice(login)
+	user, err := s.completeLogin(ctx, orgID, cached.config, ssoIdentity{
+		provider: SSOProviderSAML,
+		issuer:   assertion.Issuer,
+		subject:  assertion.NameID,
+		email:    email,
+		// The identity provider asserts addresses from the organization's directory
+		emailVerified: email != "",
+		name:          samlAttribute(assertion, cached.config, "name_attribute", samlNameAttributes),
+		claims:        assertion.Attributes,
+	}, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	return &SSOLoginResult{User: user, DeviceID: deviceID}, nil
+}
+
+func (s *ssoService) startSAMLLogin(ctx context.Context, orgID uuid.UUID) (*ssoRelyingParty, string, error) {
+	cached, err := s.loadProvider(ctx, orgID, SSOProviderSAML)
+	if err != nil {
+		return nil, "", err
+	}
+	relayState, err := generateSSOToken()
+	if err != nil {
+		return nil, "", err
+	}
+	return cached, relayState, nil
+}
+
+func (s *ssoService) storeSAMLLogin(ctx context.Context, orgID, deviceID uuid.UUID, relayState, requestID string) error {
+	return s.storeLogin(ctx, relayState, &models.SSOLogin{
+		OrganizationID: orgID,
+		Provider:       string(SSOProviderSAML),
+		RequestID:      requestID,
+	}, deviceID)
+}
+
+// newSAMLServiceProvider downloads the identity provider's metadata and sets up the
+// service provider with the organization's key pair. Its entity ID is
+// Configuration["entity_id"], or the metadata URL if unset.
+func (s *ssoService) newSAMLServiceProvider(ctx context.Context, config *SSOConfig) (*SAMLServiceProvider, error) {
+	key, certificate, err := parseSAMLKeyPair(config.SPPrivateKey, config.SPCertificate)
+	if err != nil {
+		return nil, err
+	}
+	idpMetadata, err := fetchSAMLMetadata(ctx, config.MetadataURL)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSAMLServiceProvider(SAMLConfig{
+		EntityID:    config.Configuration["entity_id"],
+		MetadataURL: strings.TrimSuffix(config.CallbackURL, samlACSPath) + samlMetadataPath,
+		ACSURL:      config.CallbackURL,
+		IDPMetadata: idpMetadata,
+		Key:         key,
+		Certificate: certificate,
+	}, s.repo)
+}
+
+func fetchSAMLMetadata(ctx context.Context, metadataURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadataURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s returned %s", ErrInvalidSAMLMetadata, metadataURL, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSAMLMetadataSize))
+}
+
+// samlEmail returns the email address from the configured or a well-known attribute,
+// falling back to an email-format NameID
+func samlEmail(assertion *SAMLAssertion, config *SSOConfig) string {
+	if email := samlAttribute(assertion, config, "email_attribute", samlEmailAttributes); email != "" {
+		return email
+	}
+	if assertion.NameIDFormat == samlEmailNameIDFormat {
+		return assertion.NameID
+	}
+	return ""
+}
+
+// samlAttribute returns the first value of the attribute Configuration[setting] names,
+// or else of the first well-known attribute present
+func samlAttribute(assertion *SAMLAssertion, config *SSOConfig, setting string, wellKnown []string) string {
+	attributes := wellKnown
+	if name := config.Configuration[setting]; name != "" {
+		attributes = []string{name}
+	}
+	for _, name := range attributes {
+		if values := assertion.Attributes[name]; len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+	return ""
+}
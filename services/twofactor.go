@@ -4,15 +4,15 @@ import (
 	"context"
 	"crypto/rand"
 	"encoding/base32"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
 	"github.com/google/uuid"
-	"github.com/pquerna/otp/totp"
 )
 
-// Enable2FA generates a new TOTP secret for a user and returns the secret key
+// Enable2FA registers a new, unverified TOTP method for a user and returns its secret key
 func (s *service) Enable2FA(ctx context.Context, userID uuid.UUID) (string, error) {
 	user, err := s.repo.GetUserByID(ctx, userID)
 	if err != nil {
@@ -29,10 +29,14 @@ func (s *service) Enable2FA(ctx context.Context, userID uuid.UUID) (string, erro
 	}
 	secretBase32 := base32.StdEncoding.EncodeToString(secret)
 
-	// Update user with new 2FA secret
-	user.TwoFactorSecret = secretBase32
-	user.TwoFactorEnabled = false // Will be enabled after verification
-	if err := s.repo.UpdateUser(ctx, user); err != nil {
+	// Will be verified with Verify2FA
+	method := &models.TwoFactorMethod{
+		UserID: user.ID,
+		Type:   TwoFactorMethodTOTP,
+		Name:   defaultTwoFactorMethodName(TwoFactorMethodTOTP),
+		Secret: secretBase32,
+	}
+	if err := s.repo.CreateTwoFactorMethod(ctx, method); err != nil {
 		return "", err
 	}
 
@@ -46,7 +50,8 @@ func (s *service) Enable2FA(ctx context.Context, userID uuid.UUID) (string, erro
 	return secretBase32, nil
 }
 
-// Verify2FA validates a TOTP code and enables 2FA if valid
+// Verify2FA validates a TOTP code against the user's pending TOTP methods and enables
+// the one that matches
 func (s *service) Verify2FA(ctx context.Context, userID uuid.UUID, code string) error {
 	user, err := s.repo.GetUserByID(ctx, userID)
 	if err != nil {
@@ -56,17 +61,45 @@ func (s *service) Verify2FA(ctx context.Context, userID uuid.UUID, code string)
 		return ErrUserNotFound
 	}
 
+	methods, err := s.repo.ListTwoFactorMethods(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+
 	// Verify TOTP code
-	valid := totp.Validate(code, user.TwoFactorSecret)
-	if !valid {
+	var method *models.TwoFactorMethod
+	for i := range methods {
+		if methods[i].Type != TwoFactorMethodTOTP || methods[i].Verified {
+			continue
+		}
+		err := useTOTPCode(ctx, s.repo, &methods[i], code)
+		if err == nil {
+			method = &methods[i]
+			break
+		}
+		if !errors.Is(err, ErrInvalidTwoFactorCode) {
+			return err
+		}
+	}
+	if method == nil {
 		return ErrInvalidOperation
 	}
 
+	now := time.Now()
+	method.Verified = true
+	method.LastUsedAt = &now
+	if err := s.repo.UpdateTwoFactorMethod(ctx, method); err != nil {
+		return err
+	}
+
 	// Enable 2FA
 	user.TwoFactorEnabled = true
 	if err := s.repo.UpdateUser(ctx, user); err != nil {
 		return err
 	}
+	if err := s.sessions.RevokeOtherSessions(ctx, user.ID, SessionIDFromContext(ctx)); err != nil {
+		return err
+	}
 
 	// Create audit log
 	metadata := createBasicMetadata("2fa_enabled", "Two-factor authentication enabled")
@@ -91,16 +124,34 @@ func (s *service) Validate2FACode(ctx context.Context, userID uuid.UUID, code st
 	if !user.TwoFactorEnabled {
 		return ErrInvalidOperation
 	}
+	if err := s.loginProtection.CheckTwoFactor(ctx, user.ID); err != nil {
+		return err
+	}
 
-	valid := totp.Validate(code, user.TwoFactorSecret)
-	if !valid {
+	methods, err := s.repo.ListTwoFactorMethods(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	method, err := validateTOTPCode(ctx, s.repo, methods, code)
+	if err != nil {
+		return err
+	}
+	if method == nil {
+		if err := s.loginProtection.RecordTwoFactorFailure(ctx, user.ID); err != nil {
+			return err
+		}
 		return ErrUnauthorized
 	}
+	if err := s.loginProtection.RecordTwoFactorSuccess(ctx, user.ID); err != nil {
+		return err
+	}
 
-	return nil
+	now := time.Now()
+	method.LastUsedAt = &now
+	return s.repo.UpdateTwoFactorMethod(ctx, method)
 }
 
-// Generate2FABackupCodes generates new backup codes for a user
+// Generate2FABackupCodes generates new backup codes for a user. Previous codes stop working.
 func (s *service) Generate2FABackupCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
 	user, err := s.repo.GetUserByID(ctx, userID)
 	if err != nil {
@@ -114,17 +165,18 @@ func (s *service) Generate2FABackupCodes(ctx context.Context, userID uuid.UUID)
 		return nil, ErrInvalidOperation
 	}
 
-	// Generate 8 backup codes
-	var backupCodes []string
-	for i := 0; i < 8; i++ {
-		code := make([]byte, 4)
-		if _, err := rand.Read(code); err != nil {
-			return nil, err
-		}
-		backupCodes = append(backupCodes, fmt.Sprintf("%x", code))
+	backupCodes, err := issueRecoveryCodes(ctx, s.repo, user.ID)
+	if err != nil {
+		return nil, err
 	}
 
-	// TODO: Store hashed backup codes in the database
+	// Create audit log
+	metadata := createBasicMetadata("2fa_recovery_codes_generated", "Two-factor recovery codes regenerated")
+	metadata["count"] = len(backupCodes)
+	if err := s.createAuditLog(ctx, "user.2fa_recovery_codes_generated", user.ID, uuid.Nil, metadata); err != nil {
+		// Log error but don't fail the operation
+		fmt.Printf("Failed to create audit log: %v\n", err)
+	}
 
 	return backupCodes, nil
 }
@@ -0,0 +1,937 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrTwoFactorMethodNotFound      = errors.New("two-factor method not found")
+	ErrUnsupportedTwoFactorMethod   = errors.New("unsupported two-factor method")
+	ErrInvalidTwoFactorCode         = errors.New("invalid two-factor code")
+	ErrTwoFactorChallengeNotFound   = errors.New("two-factor challenge not found or expired")
+	ErrPhishingResistantRequired    = errors.New("organization policy requires a phishing-resistant two-factor method")
+	ErrTwoFactorRegistrationExpired = errors.New("two-factor registration has expired")
+)
+
+// Two-factor method types
+const (
+	TwoFactorMethodTOTP     = "totp"
+	TwoFactorMethodWebAuthn = "webauthn"
+	TwoFactorMethodEmail    = "email"
+)
+
+const (
+	totpIssuer = "PasswordImmunity"
+	// totpPeriod is the length of a TOTP time step in seconds
+	totpPeriod = 30
+
+	// emailCodeDigits is the length of emailed one-time codes
+	emailCodeDigits = 6
+	// emailCodeTTL is how long an emailed code stays valid
+	emailCodeTTL = 10 * time.Minute
+	// emailCodeMaxAttempts is the number of wrong guesses after which a code is discarded
+	emailCodeMaxAttempts = 5
+
+	// twoFactorChallengeTTL is how long a user has to complete two-factor login or
+	// finish registering a security key
+	twoFactorChallengeTTL = 5 * time.Minute
+)
+
+// isPhishingResistant reports whether a method type is bound to the site's origin
+func isPhishingResistant(methodType string) bool {
+	return methodType == TwoFactorMethodWebAuthn
+}
+
+// TwoFactorMethodInfo describes a registered method without its secrets
+type TwoFactorMethodInfo struct {
+	ID                uuid.UUID  `json:"id"`
+	Type              string     `json:"type"`
+	Name              string     `json:"name"`
+	Verified          bool       `json:"verified"`
+	PhishingResistant bool       `json:"phishing_resistant"`
+	CreatedAt         time.Time  `json:"created_at"`
+	LastUsedAt        *time.Time `json:"last_used_at,omitempty"`
+}
+
+// TwoFactorEnrollment is returned when a method is registered. The method stays
+// unverified until VerifyMethod succeeds with the matching response.
+type TwoFactorEnrollment struct {
+	Method          TwoFactorMethodInfo          `json:"method"`
+	TOTPSecret      string                       `json:"totp_secret,omitempty"`
+	TOTPURI         string                       `json:"totp_uri,omitempty"`
+	WebAuthnOptions *protocol.CredentialCreation `json:"webauthn_options,omitempty"`
+}
+
+// TwoFactorResponse answers a two-factor challenge: a code for TOTP and email methods,
+// or the WebAuthn credential JSON produced by the browser
+type TwoFactorResponse struct {
+	Code       string          `json:"code,omitempty"`
+	Credential json.RawMessage `json:"credential,omitempty"`
+}
+
+// TwoFactorLoginChallenge lets the client choose a method after the password check.
+// WebAuthnOptions is set when a security key can be used.
+type TwoFactorLoginChallenge struct {
+	ChallengeID               string                        `json:"challenge_id"`
+	ExpiresAt                 time.Time                     `json:"expires_at"`
+	Methods                   []TwoFactorMethodInfo         `json:"methods"`
+	WebAuthnOptions           *protocol.CredentialAssertion `json:"webauthn_options,omitempty"`
+	PhishingResistantRequired bool                          `json:"phishing_resistant_required"`
+	// Remembered is set when a valid remember-device token skipped the second factor.
+	// The challenge then carries no methods and User is the authenticated user.
+	Remembered bool         `json:"remembered,omitempty"`
+	User       *models.User `json:"-"`
+}
+
+// TwoFactorLoginResult is returned when two-factor login completes. RememberToken is
+// set when the client asked to remember the device and organization policy allows it.
+type TwoFactorLoginResult struct {
+	User              *models.User `json:"-"`
+	DeviceID          uuid.UUID    `json:"-"`
+	RememberToken     string       `json:"remember_token,omitempty"`
+	RememberExpiresAt *time.Time   `json:"remember_expires_at,omitempty"`
+}
+
+// TwoFactorService manages the two-factor methods a user has registered (TOTP apps,
+// WebAuthn security keys and email codes) and the second step of login
+type TwoFactorService interface {
+	ListMethods(ctx context.Context, userID uuid.UUID) ([]TwoFactorMethodInfo, error)
+	RegisterMethod(ctx context.Context, userID uuid.UUID, methodType, name string) (*TwoFactorEnrollment, error)
+	VerifyMethod(ctx context.Context, userID, methodID uuid.UUID, response TwoFactorResponse) (*TwoFactorMethodInfo, error)
+	RenameMethod(ctx context.Context, userID, methodID uuid.UUID, name string) error
+	RemoveMethod(ctx context.Context, userID, methodID uuid.UUID) error
+
+	StartLogin(ctx context.Context, email, password string, deviceID uuid.UUID, rememberToken string) (*TwoFactorLoginChallenge, error)
+	SendLoginCode(ctx context.Context, challengeID string, methodID uuid.UUID) error
+	CompleteLogin(ctx context.Context, challengeID string, methodID uuid.UUID, response TwoFactorResponse, rememberDeviceID uuid.UUID) (*TwoFactorLoginResult, error)
+	RevokeRememberedDevices(ctx context.Context, userID uuid.UUID) error
+}
+
+// twoFactorCeremony holds the state between the two steps of login or security key
+// registration. It is stored as a models.TwoFactorCeremony so that the second step can
+// reach any server.
+type twoFactorCeremony struct {
+	userID                uuid.UUID
+	deviceID              uuid.UUID
+	webauthn              *webauthn.SessionData
+	phishingResistantOnly bool
+	expiresAt             time.Time
+}
+
+type twoFactorService struct {
+	repo        repository.Repository
+	policies    PolicyService
+	preferences OrganizationPreferencesService
+	devices     DeviceService
+	email       EmailService
+	protection  LoginProtectionService
+	risk        LoginRiskService
+	webauthn    *WebAuthnRelyingParty
+	sessions    SessionService
+}
+
+func NewTwoFactorService(
+	repo repository.Repository,
+	policies PolicyService,
+	preferences OrganizationPreferencesService,
+	devices DeviceService,
+	email EmailService,
+	protection LoginProtectionService,
+	risk LoginRiskService,
+	relyingParty *WebAuthnRelyingParty,
+	sessions SessionService,
+) TwoFactorService {
+	return &twoFactorService{
+		repo:        repo,
+		policies:    policies,
+		preferences: preferences,
+		devices:     devices,
+		email:       email,
+		protection:  protection,
+		risk:        risk,
+		webauthn:    relyingParty,
+		sessions:    sessions,
+	}
+}
+
+func (s *twoFactorService) ListMethods(ctx context.Context, userID uuid.UUID) ([]TwoFactorMethodInfo, error) {
+	methods, err := s.repo.ListTwoFactorMethods(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]TwoFactorMethodInfo, 0, len(methods))
+	for i := range methods {
+		infos = append(infos, twoFactorMethodInfo(&methods[i]))
+	}
+	return infos, nil
+}
+
+// RegisterMethod adds an unverified method and returns what the client needs to verify
+// it: a TOTP secret, WebAuthn creation options, or nothing for email, whose code is sent
+// to the account address
+func (s *twoFactorService) RegisterMethod(ctx context.Context, userID uuid.UUID, methodType, name string) (*TwoFactorEnrollment, error) {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = defaultTwoFactorMethodName(methodType)
+	}
+	method := &models.TwoFactorMethod{UserID: userID, Type: methodType, Name: name}
+	enrollment := &TwoFactorEnrollment{}
+
+	switch methodType {
+	case TwoFactorMethodTOTP:
+		key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: user.Email})
+		if err != nil {
+			return nil, err
+		}
+		method.Secret = key.Secret()
+		enrollment.TOTPSecret = key.Secret()
+		enrollment.TOTPURI = key.URL()
+	case TwoFactorMethodWebAuthn:
+		if s.webauthn == nil {
+			return nil, ErrUnsupportedTwoFactorMethod
+		}
+	case TwoFactorMethodEmail:
+	default:
+		return nil, ErrUnsupportedTwoFactorMethod
+	}
+
+	if err := s.repo.CreateTwoFactorMethod(ctx, method); err != nil {
+		return nil, err
+	}
+
+	switch methodType {
+	case TwoFactorMethodWebAuthn:
+		methods, err := s.repo.ListTwoFactorMethods(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		options, session, err := s.webauthn.BeginRegistration(user, methods)
+		if err != nil {
+			return nil, err
+		}
+		enrollment.WebAuthnOptions = options
+		err = s.storeCeremony(ctx, registrationCeremonyKey(method.ID), &twoFactorCeremony{
+			userID:    userID,
+			webauthn:  session,
+			expiresAt: time.Now().Add(twoFactorChallengeTTL),
+		})
+		if err != nil {
+			return nil, err
+		}
+	case TwoFactorMethodEmail:
+		if err := s.sendEmailCode(ctx, user, method); err != nil {
+			return nil, err
+		}
+	}
+
+	enrollment.Method = twoFactorMethodInfo(method)
+	return enrollment, nil
+}
+
+// VerifyMethod checks the first response from a new method and enables it. Verifying
+// the first method turns on two-factor authentication for the account.
+func (s *twoFactorService) VerifyMethod(ctx context.Context, userID, methodID uuid.UUID, response TwoFactorResponse) (*TwoFactorMethodInfo, error) {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	method, err := s.getMethod(ctx, userID, methodID)
+	if err != nil {
+		return nil, err
+	}
+	if method.Verified {
+		return nil, ErrInvalidOperation
+	}
+
+	switch method.Type {
+	case TwoFactorMethodTOTP:
+		if err := useTOTPCode(ctx, s.repo, method, response.Code); err != nil {
+			return nil, err
+		}
+	case TwoFactorMethodEmail:
+		if err := s.checkEmailCode(ctx, method, response.Code); err != nil {
+			return nil, err
+		}
+	case TwoFactorMethodWebAuthn:
+		ceremony, err := s.takeCeremony(ctx, registrationCeremonyKey(method.ID))
+		if err != nil {
+			return nil, err
+		}
+		if ceremony == nil || ceremony.userID != userID {
+			return nil, ErrTwoFactorRegistrationExpired
+		}
+		methods, err := s.repo.ListTwoFactorMethods(ctx, userID)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.webauthn.FinishRegistration(user, methods, *ceremony.webauthn, response.Credential, method); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnsupportedTwoFactorMethod
+	}
+
+	now := time.Now()
+	method.Verified = true
+	method.LastUsedAt = &now
+	if err := s.repo.UpdateTwoFactorMethod(ctx, method); err != nil {
+		return nil, err
+	}
+
+	if !user.TwoFactorEnabled {
+		user.TwoFactorEnabled = true
+		if err := s.repo.UpdateUser(ctx, user); err != nil {
+			return nil, err
+		}
+	}
+
+	// Other sessions were signed in without the new method
+	if err := s.sessions.RevokeOtherSessions(ctx, userID, SessionIDFromContext(ctx)); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_method_added", "Two-factor method added")
+	metadata["method_id"] = method.ID.String()
+	metadata["method_type"] = method.Type
+	if err := s.createAuditLog(ctx, "user.2fa_method_added", userID, uuid.Nil, metadata); err != nil {
+		return nil, err
+	}
+
+	info := twoFactorMethodInfo(method)
+	return &info, nil
+}
+
+func (s *twoFactorService) RenameMethod(ctx context.Context, userID, methodID uuid.UUID, name string) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ErrInvalidOperation
+	}
+
+	method, err := s.getMethod(ctx, userID, methodID)
+	if err != nil {
+		return err
+	}
+	method.Name = name
+	return s.repo.UpdateTwoFactorMethod(ctx, method)
+}
+
+// RemoveMethod deletes a method. A user's last phishing-resistant method cannot be
+// removed while an organization requires one. Removing the last verified method turns
+// two-factor authentication off and discards the recovery codes.
+func (s *twoFactorService) RemoveMethod(ctx context.Context, userID, methodID uuid.UUID) error {
+	user, err := s.getUser(ctx, userID)
+	if err != nil {
+		return err
+	}
+	method, err := s.getMethod(ctx, userID, methodID)
+	if err != nil {
+		return err
+	}
+
+	methods, err := s.repo.ListTwoFactorMethods(ctx, userID)
+	if err != nil {
+		return err
+	}
+	remaining := make([]models.TwoFactorMethod, 0, len(methods))
+	for _, m := range methods {
+		if m.ID != method.ID && m.Verified {
+			remaining = append(remaining, m)
+		}
+	}
+
+	if method.Verified && isPhishingResistant(method.Type) && !hasPhishingResistantMethod(remaining) {
+		required, err := s.requiresPhishingResistant(ctx, userID)
+		if err != nil {
+			return err
+		}
+		if required {
+			return ErrPhishingResistantRequired
+		}
+	}
+
+	if err := s.repo.DeleteTwoFactorMethod(ctx, method.ID); err != nil {
+		return err
+	}
+	if _, err := s.takeCeremony(ctx, registrationCeremonyKey(method.ID)); err != nil {
+		return err
+	}
+
+	if len(remaining) == 0 && user.TwoFactorEnabled {
+		user.TwoFactorEnabled = false
+		if err := s.repo.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+		if err := s.repo.DeleteTwoFactorRecoveryCodes(ctx, userID); err != nil {
+			return err
+		}
+		if err := s.repo.DeleteTwoFactorRememberTokensForUser(ctx, userID); err != nil {
+			return err
+		}
+	}
+
+	if !method.Verified {
+		return nil
+	}
+	if err := s.sessions.RevokeOtherSessions(ctx, userID, SessionIDFromContext(ctx)); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_method_removed", "Two-factor method removed")
+	metadata["method_id"] = method.ID.String()
+	metadata["method_type"] = method.Type
+	if err := s.createAuditLog(ctx, "user.2fa_method_removed", userID, uuid.Nil, metadata); err != nil {
+		return err
+	}
+	if !user.TwoFactorEnabled {
+		metadata := createBasicMetadata("2fa_disabled", "Two-factor authentication disabled after last method was removed")
+		return s.createAuditLog(ctx, "user.2fa_disabled", userID, uuid.Nil, metadata)
+	}
+	return nil
+}
+
+// StartLogin checks the master password and returns the methods the user may choose
+// from. When an organization requires phishing-resistant methods only security keys are
+// offered; a user without one can still use their other methods so that they are able
+// to sign in and register a key.
+//
+// If deviceID and rememberToken identify a device remembered by an earlier login, the
+// second factor is skipped and the returned challenge is marked Remembered, unless the
+// login looks suspicious and policy requires two-factor authentication for it.
+func (s *twoFactorService) StartLogin(ctx context.Context, email, password string, deviceID uuid.UUID, rememberToken string) (*TwoFactorLoginChallenge, error) {
+	user, err := s.protection.AuthenticatePassword(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TwoFactorEnabled {
+		return nil, ErrInvalidOperation
+	}
+
+	assessment, err := s.risk.AssessLogin(ctx, user, deviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if rememberToken != "" && assessment.Action != LoginRiskActionRequireTwoFactor {
+		remembered, err := s.checkRememberToken(ctx, user.ID, deviceID, rememberToken)
+		if err != nil {
+			return nil, err
+		}
+		if remembered {
+			if err := s.risk.RecordLogin(ctx, user, deviceID); err != nil {
+				return nil, err
+			}
+			return &TwoFactorLoginChallenge{Methods: []TwoFactorMethodInfo{}, Remembered: true, User: user}, nil
+		}
+	}
+
+	methods, err := s.repo.ListTwoFactorMethods(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	required, err := s.requiresPhishingResistant(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	phishingResistantOnly := required && hasPhishingResistantMethod(methods)
+
+	challengeID, err := generateChallengeID()
+	if err != nil {
+		return nil, err
+	}
+	challenge := &TwoFactorLoginChallenge{
+		ChallengeID:               challengeID,
+		ExpiresAt:                 time.Now().Add(twoFactorChallengeTTL),
+		Methods:                   []TwoFactorMethodInfo{},
+		PhishingResistantRequired: required,
+	}
+	ceremony := &twoFactorCeremony{
+		userID:                user.ID,
+		deviceID:              deviceID,
+		phishingResistantOnly: phishingResistantOnly,
+		expiresAt:             challenge.ExpiresAt,
+	}
+
+	for i := range methods {
+		if !methods[i].Verified || (phishingResistantOnly && !isPhishingResistant(methods[i].Type)) {
+			continue
+		}
+		if methods[i].Type == TwoFactorMethodWebAuthn && s.webauthn == nil {
+			continue
+		}
+		challenge.Methods = append(challenge.Methods, twoFactorMethodInfo(&methods[i]))
+	}
+	if len(challenge.Methods) == 0 {
+		return nil, ErrInvalidOperation
+	}
+
+	if s.webauthn != nil && hasPhishingResistantMethod(methods) {
+		options, session, err := s.webauthn.BeginLogin(user, methods)
+		if err != nil {
+			return nil, err
+		}
+		challenge.WebAuthnOptions = options
+		ceremony.webauthn = session
+	}
+
+	if err := s.storeCeremony(ctx, loginCeremonyKey(challengeID), ceremony); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// SendLoginCode emails a one-time code for the chosen email method
+func (s *twoFactorService) SendLoginCode(ctx context.Context, challengeID string, methodID uuid.UUID) error {
+	ceremony, err := s.getCeremony(ctx, loginCeremonyKey(challengeID))
+	if err != nil {
+		return err
+	}
+	if ceremony == nil {
+		return ErrTwoFactorChallengeNotFound
+	}
+
+	method, err := s.getMethod(ctx, ceremony.userID, methodID)
+	if err != nil {
+		return err
+	}
+	if method.Type != TwoFactorMethodEmail || !method.Verified {
+		return ErrInvalidOperation
+	}
+	if ceremony.phishingResistantOnly {
+		return ErrPhishingResistantRequired
+	}
+
+	user, err := s.getUser(ctx, ceremony.userID)
+	if err != nil {
+		return err
+	}
+	return s.sendEmailCode(ctx, user, method)
+}
+
+// CompleteLogin verifies the response for the chosen method and returns the user. For
+// security keys the method is identified by the credential in the response. When
+// rememberDeviceID is set, a remember-device token is issued for that device.
+//
+// A challenge can be answered once: it is used up before the response is checked, so
+// after a wrong response the login starts over with the master password.
+func (s *twoFactorService) CompleteLogin(ctx context.Context, challengeID string, methodID uuid.UUID, response TwoFactorResponse, rememberDeviceID uuid.UUID) (*TwoFactorLoginResult, error) {
+	ceremony, err := s.takeCeremony(ctx, loginCeremonyKey(challengeID))
+	if err != nil {
+		return nil, err
+	}
+	if ceremony == nil {
+		return nil, ErrTwoFactorChallengeNotFound
+	}
+
+	user, err := s.getUser(ctx, ceremony.userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.protection.CheckTwoFactor(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	var method *models.TwoFactorMethod
+	if len(response.Credential) > 0 {
+		if ceremony.webauthn == nil {
+			return nil, ErrInvalidOperation
+		}
+		methods, err := s.repo.ListTwoFactorMethods(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		method, err = s.webauthn.FinishLogin(user, methods, *ceremony.webauthn, response.Credential)
+		if err != nil {
+			s.rejectTwoFactor(ctx, user.ID, TwoFactorMethodWebAuthn)
+			return nil, err
+		}
+	} else {
+		method, err = s.getMethod(ctx, user.ID, methodID)
+		if err != nil {
+			return nil, err
+		}
+		if !method.Verified {
+			return nil, ErrTwoFactorMethodNotFound
+		}
+		if ceremony.phishingResistantOnly && !isPhishingResistant(method.Type) {
+			return nil, ErrPhishingResistantRequired
+		}
+
+		switch method.Type {
+		case TwoFactorMethodTOTP:
+			if err := useTOTPCode(ctx, s.repo, method, response.Code); err != nil {
+				if errors.Is(err, ErrInvalidTwoFactorCode) {
+					s.rejectTwoFactor(ctx, user.ID, method.Type)
+				}
+				return nil, err
+			}
+		case TwoFactorMethodEmail:
+			if err := s.checkEmailCode(ctx, method, response.Code); err != nil {
+				s.rejectTwoFactor(ctx, user.ID, method.Type)
+				return nil, err
+			}
+		default:
+			return nil, ErrUnsupportedTwoFactorMethod
+		}
+	}
+
+	if err := s.protection.RecordTwoFactorSuccess(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	method.LastUsedAt = &now
+	if err := s.repo.UpdateTwoFactorMethod(ctx, method); err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_verified", "Two-factor authentication completed")
+	metadata["method_id"] = method.ID.String()
+	metadata["method_type"] = method.Type
+	if err := s.createAuditLog(ctx, "user.2fa_verified", user.ID, uuid.Nil, metadata); err != nil {
+		return nil, err
+	}
+
+	if err := s.risk.RecordLogin(ctx, user, ceremony.deviceID); err != nil {
+		return nil, err
+	}
+
+	result := &TwoFactorLoginResult{User: user, DeviceID: ceremony.deviceID}
+	if rememberDeviceID != uuid.Nil {
+		if err := s.rememberDevice(ctx, user.ID, rememberDeviceID, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// sendEmailCode stores the hash of a new code on the method and emails the code
+func (s *twoFactorService) sendEmailCode(ctx context.Context, user *models.User, method *models.TwoFactorMethod) error {
+	code, err := generateNumericCode(emailCodeDigits)
+	if err != nil {
+		return err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now().Add(emailCodeTTL)
+	method.CodeHash = string(hash)
+	method.CodeExpiresAt = &expiresAt
+	method.CodeAttempts = 0
+	if err := s.repo.UpdateTwoFactorMethod(ctx, method); err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"Name":      user.Name,
+		"Code":      code,
+		"ExpiresAt": expiresAt,
+	}
+	return s.email.SendTemplatedEmail(ctx, "2fa_email_code", data, []string{user.Email})
+}
+
+// checkEmailCode consumes the method's pending code if it matches. A code is discarded
+// after it is used, expires, or has been guessed wrong emailCodeMaxAttempts times.
+func (s *twoFactorService) checkEmailCode(ctx context.Context, method *models.TwoFactorMethod, code string) error {
+	if method.CodeHash == "" || method.CodeExpiresAt == nil || time.Now().After(*method.CodeExpiresAt) {
+		return ErrInvalidTwoFactorCode
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(method.CodeHash), []byte(strings.TrimSpace(code))) != nil {
+		method.CodeAttempts++
+		if method.CodeAttempts >= emailCodeMaxAttempts {
+			method.CodeHash = ""
+			method.CodeExpiresAt = nil
+		}
+		if err := s.repo.UpdateTwoFactorMethod(ctx, method); err != nil {
+			return err
+		}
+		return ErrInvalidTwoFactorCode
+	}
+
+	method.CodeHash = ""
+	method.CodeExpiresAt = nil
+	method.CodeAttempts = 0
+	return nil
+}
+
+// requiresPhishingResistant reports whether any organization the user belongs to
+// requires phishing-resistant two-factor methods
+func (s *twoFactorService) requiresPhishingResistant(ctx context.Context, userID uuid.UUID) (bool, error) {
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	for _, membership := range memberships {
+		if membership.Status != organizationMemberStatusConfirmed {
+			continue
+		}
+		settings, err := s.policies.GetTwoFactorPolicy(ctx, membership.OrganizationID)
+		if err != nil {
+			return false, err
+		}
+		if settings != nil && settings.RequirePhishingResistant {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// rejectTwoFactor counts a wrong two-factor response towards the user's lockout and
+// audits it
+func (s *twoFactorService) rejectTwoFactor(ctx context.Context, userID uuid.UUID, methodType string) {
+	if err := s.protection.RecordTwoFactorFailure(ctx, userID); err != nil {
+		log.Printf("Failed to record two-factor failure for user %s: %v", userID, err)
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_rejected", "Invalid two-factor response")
+	metadata["method_type"] = methodType
+	if err := s.createAuditLog(ctx, "user.2fa_rejected", userID, uuid.Nil, metadata); err != nil {
+		log.Printf("Failed to create audit log: %v", err)
+	}
+}
+
+func (s *twoFactorService) getUser(ctx context.Context, userID uuid.UUID) (*models.User, error) {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *twoFactorService) getMethod(ctx context.Context, userID, methodID uuid.UUID) (*models.TwoFactorMethod, error) {
+	method, err := s.repo.GetTwoFactorMethod(ctx, methodID)
+	if err != nil {
+		return nil, err
+	}
+	if method == nil || method.UserID != userID {
+		return nil, ErrTwoFactorMethodNotFound
+	}
+	return method, nil
+}
+
+// storeCeremony keeps the ceremony under a hash of its key until it expires, and
+// forgets the ceremonies nobody finished in time
+func (s *twoFactorService) storeCeremony(ctx context.Context, key string, ceremony *twoFactorCeremony) error {
+	if _, err := s.repo.DeleteExpiredTwoFactorCeremonies(ctx, time.Now()); err != nil {
+		return err
+	}
+
+	stored := &models.TwoFactorCeremony{
+		KeyHash:               hashCeremonyKey(key),
+		UserID:                ceremony.userID,
+		PhishingResistantOnly: ceremony.phishingResistantOnly,
+		ExpiresAt:             ceremony.expiresAt,
+	}
+	if ceremony.deviceID != uuid.Nil {
+		stored.DeviceID = &ceremony.deviceID
+	}
+	if ceremony.webauthn != nil {
+		session, err := json.Marshal(ceremony.webauthn)
+		if err != nil {
+			return err
+		}
+		stored.WebAuthnSession = string(session)
+	}
+	return s.repo.CreateTwoFactorCeremony(ctx, stored)
+}
+
+// getCeremony returns the ceremony stored under key, or nil if there is none or it has
+// expired
+func (s *twoFactorService) getCeremony(ctx context.Context, key string) (*twoFactorCeremony, error) {
+	stored, err := s.repo.GetTwoFactorCeremony(ctx, hashCeremonyKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return loadCeremony(stored)
+}
+
+// takeCeremony removes the ceremony stored under key and returns it, or nil if there is
+// none or it has expired. Concurrent calls cannot take the same ceremony.
+func (s *twoFactorService) takeCeremony(ctx context.Context, key string) (*twoFactorCeremony, error) {
+	stored, err := s.repo.TakeTwoFactorCeremony(ctx, hashCeremonyKey(key))
+	if err != nil {
+		return nil, err
+	}
+	return loadCeremony(stored)
+}
+
+func loadCeremony(stored *models.TwoFactorCeremony) (*twoFactorCeremony, error) {
+	if stored == nil || time.Now().After(stored.ExpiresAt) {
+		return nil, nil
+	}
+
+	ceremony := &twoFactorCeremony{
+		userID:                stored.UserID,
+		phishingResistantOnly: stored.PhishingResistantOnly,
+		expiresAt:             stored.ExpiresAt,
+	}
+	if stored.DeviceID != nil {
+		ceremony.deviceID = *stored.DeviceID
+	}
+	if stored.WebAuthnSession != "" {
+		var session webauthn.SessionData
+		if err := json.Unmarshal([]byte(stored.WebAuthnSession), &session); err != nil {
+			return nil, err
+		}
+		ceremony.webauthn = &session
+	}
+	return ceremony, nil
+}
+
+func hashCeremonyKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func registrationCeremonyKey(methodID uuid.UUID) string {
+	return "register:" + methodID.String()
+}
+
+func loginCeremonyKey(challengeID string) string {
+	return "login:" + challengeID
+}
+
+func twoFactorMethodInfo(method *models.TwoFactorMethod) TwoFactorMethodInfo {
+	return TwoFactorMethodInfo{
+		ID:                method.ID,
+		Type:              method.Type,
+		Name:              method.Name,
+		Verified:          method.Verified,
+		PhishingResistant: isPhishingResistant(method.Type),
+		CreatedAt:         method.CreatedAt,
+		LastUsedAt:        method.LastUsedAt,
+	}
+}
+
+func hasPhishingResistantMethod(methods []models.TwoFactorMethod) bool {
+	for _, method := range methods {
+		if method.Verified && isPhishingResistant(method.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+func defaultTwoFactorMethodName(methodType string) string {
+	switch methodType {
+	case TwoFactorMethodTOTP:
+		return "Authenticator app"
+	case TwoFactorMethodWebAuthn:
+		return "Security key"
+	case TwoFactorMethodEmail:
+		return "Email"
+	default:
+		return methodType
+	}
+}
+
+func generateChallengeID() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// generateNumericCode returns a uniformly random code of the given number of digits
+func generateNumericCode(digits int) (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(digits)), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", digits, n), nil
+}
+
+// validateTOTPCode checks a code against the user's verified TOTP methods and returns
+// the method that used it, or nil if none did
+func validateTOTPCode(ctx context.Context, repo repository.Repository, methods []models.TwoFactorMethod, code string) (*models.TwoFactorMethod, error) {
+	for i := range methods {
+		if methods[i].Type != TwoFactorMethodTOTP || !methods[i].Verified {
+			continue
+		}
+		err := useTOTPCode(ctx, repo, &methods[i], code)
+		if err == nil {
+			return &methods[i], nil
+		}
+		if !errors.Is(err, ErrInvalidTwoFactorCode) {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// useTOTPCode accepts a code for the method if it is valid and of a later time step than
+// the last code accepted, and records its step so that it cannot be used again
+func useTOTPCode(ctx context.Context, repo repository.Repository, method *models.TwoFactorMethod, code string) error {
+	step := matchTOTPStep(strings.TrimSpace(code), method.Secret)
+	if step == 0 || step <= method.LastTOTPStep {
+		return ErrInvalidTwoFactorCode
+	}
+	recorded, err := repo.RecordTOTPStep(ctx, method.ID, step)
+	if err != nil {
+		return err
+	}
+	if !recorded {
+		return ErrInvalidTwoFactorCode
+	}
+	method.LastTOTPStep = step
+	return nil
+}
+
+// matchTOTPStep returns the time step a code is valid for, allowing one step of clock
+// skew either way like totp.Validate, or zero if the code is not valid
+func matchTOTPStep(code, secret string) int64 {
+	now := time.Now()
+	for _, skew := range []int64{0, -1, 1} {
+		at := now.Add(time.Duration(skew*totpPeriod) * time.Second)
+		expected, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return at.Unix() / totpPeriod
+		}
+	}
+	return 0
+}
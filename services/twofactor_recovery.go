@@ -0,0 +1,278 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+
+const (
+	// recoveryCodeCount is the number of recovery codes issued at a time
+	recoveryCodeCount = 8
+	// recoveryCodeBytes is the entropy of each code; codes are shown as two groups of hex digits
+	recoveryCodeBytes = 5
+	// recoveryCodesLowThreshold is the number of unused codes at which the user is warned
+	recoveryCodesLowThreshold = 2
+)
+
+// RecoveryLoginResult is the outcome of a login with a recovery code
+type RecoveryLoginResult struct {
+	User              *models.User `json:"user"`
+	RemainingCodes    int          `json:"remaining_codes"`
+	TwoFactorDisabled bool         `json:"two_factor_disabled"`
+	RecoveryCodesLow  bool         `json:"recovery_codes_low"`
+}
+
+// TwoFactorRecoveryService manages single-use two-factor recovery codes and the login
+// path that accepts them in place of a second factor
+type TwoFactorRecoveryService interface {
+	GenerateRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error)
+	CountRemainingRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error)
+	LoginWithRecoveryCode(ctx context.Context, email, password, code string, deviceID uuid.UUID, disableTwoFactor bool) (*RecoveryLoginResult, error)
+}
+
+type twoFactorRecoveryService struct {
+	repo            repository.Repository
+	email           EmailService
+	notifications   NotificationService
+	loginProtection LoginProtectionService
+	risk            LoginRiskService
+	sessions        SessionService
+}
+
+func NewTwoFactorRecoveryService(
+	repo repository.Repository,
+	email EmailService,
+	notifications NotificationService,
+	loginProtection LoginProtectionService,
+	risk LoginRiskService,
+	sessions SessionService,
+) TwoFactorRecoveryService {
+	return &twoFactorRecoveryService{
+		repo:            repo,
+		email:           email,
+		notifications:   notifications,
+		loginProtection: loginProtection,
+		risk:            risk,
+		sessions:        sessions,
+	}
+}
+
+// GenerateRecoveryCodes issues a new set of recovery codes, invalidating any previous set.
+// The codes are returned once and only their hashes are stored.
+func (s *twoFactorRecoveryService) GenerateRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]string, error) {
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, ErrUserNotFound
+	}
+	if !user.TwoFactorEnabled {
+		return nil, ErrInvalidOperation
+	}
+
+	codes, err := issueRecoveryCodes(ctx, s.repo, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_recovery_codes_generated", "Two-factor recovery codes regenerated")
+	metadata["count"] = len(codes)
+	if err := s.createAuditLog(ctx, "user.2fa_recovery_codes_generated", userID, uuid.Nil, metadata); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+func (s *twoFactorRecoveryService) CountRemainingRecoveryCodes(ctx context.Context, userID uuid.UUID) (int, error) {
+	codes, err := s.repo.ListUnusedTwoFactorRecoveryCodes(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+	return len(codes), nil
+}
+
+// LoginWithRecoveryCode authenticates a user with their master password and a recovery
+// code instead of their second factor. The code is consumed; if disableTwoFactor is set,
+// two-factor authentication, all registered methods and the remaining codes are removed
+// as well.
+func (s *twoFactorRecoveryService) LoginWithRecoveryCode(ctx context.Context, email, password, code string, deviceID uuid.UUID, disableTwoFactor bool) (*RecoveryLoginResult, error) {
+	user, err := s.loginProtection.AuthenticatePassword(ctx, email, password)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TwoFactorEnabled {
+		return nil, ErrInvalidOperation
+	}
+	if _, err := s.risk.AssessLogin(ctx, user, deviceID); err != nil {
+		return nil, err
+	}
+	if err := s.loginProtection.CheckTwoFactor(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	if err := s.consumeRecoveryCode(ctx, user.ID, code); err != nil {
+		// Create audit log
+		metadata := createBasicMetadata("2fa_recovery_code_rejected", "Invalid two-factor recovery code")
+		if auditErr := s.createAuditLog(ctx, "user.2fa_recovery_code_rejected", user.ID, uuid.Nil, metadata); auditErr != nil {
+			log.Printf("Failed to create audit log: %v", auditErr)
+		}
+		if errors.Is(err, ErrInvalidRecoveryCode) {
+			if lockErr := s.loginProtection.RecordTwoFactorFailure(ctx, user.ID); lockErr != nil {
+				return nil, lockErr
+			}
+		}
+		return nil, err
+	}
+	if err := s.loginProtection.RecordTwoFactorSuccess(ctx, user.ID); err != nil {
+		return nil, err
+	}
+
+	result := &RecoveryLoginResult{User: user}
+	if disableTwoFactor {
+		user.TwoFactorEnabled = false
+		if err := s.repo.UpdateUser(ctx, user); err != nil {
+			return nil, err
+		}
+		if err := s.repo.DeleteTwoFactorMethods(ctx, user.ID); err != nil {
+			return nil, err
+		}
+		if err := s.repo.DeleteTwoFactorRecoveryCodes(ctx, user.ID); err != nil {
+			return nil, err
+		}
+		if err := s.repo.DeleteTwoFactorRememberTokensForUser(ctx, user.ID); err != nil {
+			return nil, err
+		}
+		// Whoever lost the second factor may have left sessions signed in elsewhere
+		if err := s.sessions.RevokeAllUserSessions(ctx, user.ID); err != nil {
+			return nil, err
+		}
+		result.TwoFactorDisabled = true
+	} else {
+		result.RemainingCodes, err = s.CountRemainingRecoveryCodes(ctx, user.ID)
+		if err != nil {
+			return nil, err
+		}
+		result.RecoveryCodesLow = result.RemainingCodes <= recoveryCodesLowThreshold
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_recovery_code_used", "Two-factor recovery code used to log in")
+	metadata["remaining_codes"] = result.RemainingCodes
+	metadata["two_factor_disabled"] = result.TwoFactorDisabled
+	if err := s.createAuditLog(ctx, "user.2fa_recovery_code_used", user.ID, uuid.Nil, metadata); err != nil {
+		return nil, err
+	}
+	if result.TwoFactorDisabled {
+		metadata := createBasicMetadata("2fa_disabled", "Two-factor authentication disabled after recovery login")
+		if err := s.createAuditLog(ctx, "user.2fa_disabled", user.ID, uuid.Nil, metadata); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := s.risk.RecordLogin(ctx, user, deviceID); err != nil {
+		return nil, err
+	}
+	s.notifyRecoveryCodeUsed(ctx, user, result)
+
+	return result, nil
+}
+
+// consumeRecoveryCode finds the unused code matching the input and marks it used
+func (s *twoFactorRecoveryService) consumeRecoveryCode(ctx context.Context, userID uuid.UUID, code string) error {
+	normalized := normalizeRecoveryCode(code)
+	if normalized == "" {
+		return ErrInvalidRecoveryCode
+	}
+
+	codes, err := s.repo.ListUnusedTwoFactorRecoveryCodes(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, stored := range codes {
+		if bcrypt.CompareHashAndPassword([]byte(stored.CodeHash), []byte(normalized)) != nil {
+			continue
+		}
+
+		consumed, err := s.repo.ConsumeTwoFactorRecoveryCode(ctx, stored.ID)
+		if err != nil {
+			return err
+		}
+		if !consumed {
+			// Used by a concurrent request
+			return ErrInvalidRecoveryCode
+		}
+		return nil
+	}
+
+	return ErrInvalidRecoveryCode
+}
+
+// notifyRecoveryCodeUsed emails the user about the recovery login and warns when few codes remain
+func (s *twoFactorRecoveryService) notifyRecoveryCodeUsed(ctx context.Context, user *models.User, result *RecoveryLoginResult) {
+	data := map[string]interface{}{
+		"Name":              user.Name,
+		"UsedAt":            time.Now(),
+		"RemainingCodes":    result.RemainingCodes,
+		"TwoFactorDisabled": result.TwoFactorDisabled,
+		"RecoveryCodesLow":  result.RecoveryCodesLow,
+	}
+	if err := s.email.SendTemplatedEmail(ctx, "2fa_recovery_code_used", data, []string{user.Email}); err != nil {
+		log.Printf("Failed to send recovery code email to user %s: %v", user.ID, err)
+	}
+
+	if result.RecoveryCodesLow {
+		message := fmt.Sprintf("Only %d two-factor recovery codes remain. Generate new codes to avoid losing access to your account.", result.RemainingCodes)
+		if err := s.notifications.CreateNotification(ctx, user.ID, NotificationTypeWarning, message, nil); err != nil {
+			log.Printf("Failed to create notification for user %s: %v", user.ID, err)
+		}
+	}
+}
+
+// issueRecoveryCodes generates recoveryCodeCount codes and replaces the user's stored
+// hashes with theirs
+func issueRecoveryCodes(ctx context.Context, repo repository.Repository, userID uuid.UUID) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	records := make([]models.TwoFactorRecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, recoveryCodeBytes)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		code := hex.EncodeToString(raw)
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+
+		codes[i] = code[:len(code)/2] + "-" + code[len(code)/2:]
+		records[i] = models.TwoFactorRecoveryCode{UserID: userID, CodeHash: string(hash)}
+	}
+
+	if err := repo.ReplaceTwoFactorRecoveryCodes(ctx, userID, records); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode strips separators and whitespace and lowercases the code
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+}
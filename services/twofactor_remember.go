@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/google/uuid"
+)
+
+// defaultMFARememberDays applies to users outside any organization and to organizations
+// that have not set sessionPolicy.mfaRememberDays
+const defaultMFARememberDays = 30
+
+// RevokeRememberedDevices makes every device of the user ask for the second factor again
+func (s *twoFactorService) RevokeRememberedDevices(ctx context.Context, userID uuid.UUID) error {
+	if _, err := s.getUser(ctx, userID); err != nil {
+		return err
+	}
+	if err := s.repo.DeleteTwoFactorRememberTokensForUser(ctx, userID); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_remembered_devices_revoked", "Remembered two-factor devices revoked")
+	return s.createAuditLog(ctx, "user.2fa_remembered_devices_revoked", userID, uuid.Nil, metadata)
+}
+
+// checkRememberToken reports whether the token was issued to this user and device, has
+// not expired, and is still within the remember period the user's organizations allow.
+// The device must still exist and not be blocked.
+func (s *twoFactorService) checkRememberToken(ctx context.Context, userID, deviceID uuid.UUID, token string) (bool, error) {
+	record, err := s.repo.GetTwoFactorRememberTokenByHash(ctx, hashRememberToken(token))
+	if err != nil {
+		return false, err
+	}
+	if record == nil || record.UserID != userID || record.DeviceID != deviceID || time.Now().After(record.ExpiresAt) {
+		return false, nil
+	}
+
+	// The organization may have shortened the period since the token was issued
+	days, err := s.rememberDays(ctx, userID)
+	if err != nil {
+		return false, err
+	}
+	if days <= 0 || time.Now().After(record.CreatedAt.AddDate(0, 0, days)) {
+		return false, nil
+	}
+
+	device, err := s.activeDevice(ctx, userID, deviceID)
+	if err != nil || device == nil {
+		return false, err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_remembered", "Two-factor authentication skipped on a remembered device")
+	metadata["device_id"] = device.ID.String()
+	metadata["device_name"] = device.Name
+	if err := s.createAuditLog(ctx, "user.2fa_remembered", userID, uuid.Nil, metadata); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rememberDevice issues a remember token for the device and adds it to the result. No
+// token is issued when organization policy disables remembering or the device is not an
+// active device of the user.
+func (s *twoFactorService) rememberDevice(ctx context.Context, userID, deviceID uuid.UUID, result *TwoFactorLoginResult) error {
+	days, err := s.rememberDays(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if days <= 0 {
+		return nil
+	}
+
+	device, err := s.activeDevice(ctx, userID, deviceID)
+	if err != nil || device == nil {
+		return err
+	}
+
+	token, err := generateRememberToken()
+	if err != nil {
+		return err
+	}
+	record := &models.TwoFactorRememberToken{
+		UserID:    userID,
+		DeviceID:  device.ID,
+		TokenHash: hashRememberToken(token),
+		ExpiresAt: time.Now().AddDate(0, 0, days),
+	}
+	if err := s.repo.CreateTwoFactorRememberToken(ctx, record); err != nil {
+		return err
+	}
+
+	// Create audit log
+	metadata := createBasicMetadata("2fa_device_remembered", "Device remembered for two-factor authentication")
+	metadata["device_id"] = device.ID.String()
+	metadata["device_name"] = device.Name
+	metadata["days"] = days
+	if err := s.createAuditLog(ctx, "user.2fa_device_remembered", userID, uuid.Nil, metadata); err != nil {
+		return err
+	}
+
+	result.RememberToken = token
+	result.RememberExpiresAt = &record.ExpiresAt
+	return nil
+}
+
+// rememberDays returns the shortest mfaRememberDays among the organizations the user is
+// a confirmed member of. Zero means devices must not be remembered.
+func (s *twoFactorService) rememberDays(ctx context.Context, userID uuid.UUID) (int, error) {
+	memberships, err := s.repo.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	days := defaultMFARememberDays
+	for _, membership := range memberships {
+		if membership.Status != organizationMemberStatusConfirmed {
+			continue
+		}
+		orgDays, err := s.organizationRememberDays(ctx, membership.OrganizationID)
+		if err != nil {
+			return 0, err
+		}
+		if orgDays < days {
+			days = orgDays
+		}
+	}
+	return days, nil
+}
+
+// organizationRememberDays reads sessionPolicy.mfaRememberDays from the organization's
+// preferences. Values decoded from JSON are float64.
+func (s *twoFactorService) organizationRememberDays(ctx context.Context, orgID uuid.UUID) (int, error) {
+	if s.preferences == nil {
+		return defaultMFARememberDays, nil
+	}
+
+	value, err := s.preferences.GetPreference(ctx, orgID, "sessionPolicy")
+	if err != nil {
+		return 0, err
+	}
+	policy, ok := value.(map[string]interface{})
+	if !ok {
+		return defaultMFARememberDays, nil
+	}
+
+	switch days := policy["mfaRememberDays"].(type) {
+	case int:
+		return days, nil
+	case float64:
+		return int(days), nil
+	default:
+		return defaultMFARememberDays, nil
+	}
+}
+
+// activeDevice returns the device if it belongs to the user and is not blocked
+func (s *twoFactorService) activeDevice(ctx context.Context, userID, deviceID uuid.UUID) (*models.Device, error) {
+	if s.devices == nil || deviceID == uuid.Nil {
+		return nil, nil
+	}
+
+	device, err := s.devices.GetDevice(ctx, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	if device == nil || device.UserID != userID || device.Status == "blocked" {
+		return nil, nil
+	}
+	return device, nil
+}
+
+func generateRememberToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// hashRememberToken returns the SHA-256 of the token. Tokens are random, so a fast hash
+// is enough to keep a database leak from exposing usable tokens.
+func hashRememberToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
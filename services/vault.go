@@ -2,102 +2,278 @@ package services
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
 	"errors"
-	"io"
+	"fmt"
 
 	"github.com/emailimmunity/passwordimmunity/db/models"
 	"github.com/google/uuid"
 )
 
-func (s *service) CreateVaultItem(ctx context.Context, userID, orgID uuid.UUID, itemType, name string, data []byte) (*models.VaultItem, error) {
-	// Verify user exists and has access
-	hasAccess, err := s.hasPermission(ctx, userID, orgID, "create_vault_item")
-	if err != nil {
-		return nil, err
+var ErrVaultItemNotFound = errors.New("vault item not found")
+
+// CreateVaultItem stores an item the client encrypted with the owner's vault key, which
+// the server holds and re-encrypts items with on rotation. Organization items may belong
+// to a collection the user can edit; only members who manage collections can create
+// items outside any collection.
+func (s *service) CreateVaultItem(ctx context.Context, userID, orgID uuid.UUID, collectionID *uuid.UUID, itemType, name, encryptedData, encryptedPassword string) (*models.VaultItem, error) {
+	// Personal items need no organization permission
+	if orgID != uuid.Nil {
+		hasAccess, err := s.hasPermission(ctx, userID, orgID, PermissionCreateVaultItem)
+		if err != nil {
+			return nil, err
+		}
+		if !hasAccess {
+			return nil, ErrUnauthorized
+		}
 	}
-	if !hasAccess {
-		return nil, ErrUnauthorized
+	if err := s.validateItemCollection(ctx, orgID, collectionID); err != nil {
+		return nil, err
 	}
-
-	// Encrypt the data
-	encryptedData, err := encryptData(data)
+	access, err := s.vaultItemAccess(ctx, userID, orgID, userID, collectionID)
 	if err != nil {
 		return nil, err
 	}
+	if !access.CanEdit() || (encryptedPassword != "" && access.HidesPasswords()) {
+		return nil, ErrUnauthorized
+	}
 
 	item := &models.VaultItem{
-		UserID:         userID,
-		OrganizationID: orgID,
-		Type:           itemType,
-		Name:           name,
-		Data:           encryptedData,
+		UserID:            userID,
+		OrganizationID:    orgID,
+		CollectionID:      collectionID,
+		Type:              itemType,
+		Name:              name,
+		EncryptedData:     encryptedData,
+		EncryptedPassword: encryptedPassword,
 	}
 
 	if err := s.repo.CreateVaultItem(ctx, item); err != nil {
 		return nil, err
 	}
 
+	pushSync(ctx, s.push, vaultItemPushTarget(item), PushSyncItem, item.ID, orgID)
+
 	return item, nil
 }
 
-func (s *service) GetVaultItems(ctx context.Context, userID, orgID uuid.UUID) ([]models.VaultItem, error) {
-	// Verify user has access to organization
-	hasAccess, err := s.hasPermission(ctx, userID, orgID, "read_vault_items")
+// UpdateVaultItem replaces an item's name and data and moves it to collectionID. A nil
+// encryptedPassword keeps the password, so members whose access hides passwords can
+// edit the rest of the item. Moving an item between collections requires manage access
+// to both.
+func (s *service) UpdateVaultItem(ctx context.Context, userID, itemID uuid.UUID, collectionID *uuid.UUID, name, encryptedData string, encryptedPassword *string) (*models.VaultItem, error) {
+	item, access, err := s.getVaultItem(ctx, userID, itemID)
 	if err != nil {
 		return nil, err
 	}
-	if !hasAccess {
+	if !access.CanEdit() || (encryptedPassword != nil && access.HidesPasswords()) {
 		return nil, ErrUnauthorized
 	}
+	previous := *item
+	if !sameCollection(item.CollectionID, collectionID) {
+		if err := s.validateItemCollection(ctx, item.OrganizationID, collectionID); err != nil {
+			return nil, err
+		}
+		target, err := s.vaultItemAccess(ctx, userID, item.OrganizationID, item.UserID, collectionID)
+		if err != nil {
+			return nil, err
+		}
+		if !access.CanManage() || !target.CanManage() {
+			return nil, ErrUnauthorized
+		}
+		item.CollectionID = collectionID
+	}
+
+	item.Name = name
+	item.EncryptedData = encryptedData
+	if encryptedPassword != nil {
+		item.EncryptedPassword = *encryptedPassword
+	}
+	if err := s.repo.UpdateVaultItem(ctx, item); err != nil {
+		return nil, err
+	}
+
+	pushSync(ctx, s.push, vaultItemPushTarget(item), PushSyncItem, item.ID, item.OrganizationID)
+	if !sameCollection(previous.CollectionID, item.CollectionID) {
+		// Members who could only see the old collection lose the item
+		pushSync(ctx, s.push, vaultItemPushTarget(&previous), PushSyncItem, item.ID, item.OrganizationID)
+	}
 
-	// TODO: Implement repository method to get vault items by user and org ID
-	// For now, return empty slice
-	return []models.VaultItem{}, nil
+	if access.HidesPasswords() {
+		item.EncryptedPassword = ""
+	}
+	return item, nil
 }
 
-// Helper functions for encryption/decryption
-func encryptData(data []byte) ([]byte, error) {
-	key := make([]byte, 32) // AES-256
-	if _, err := io.ReadFull(rand.Reader, key); err != nil {
-		return nil, err
+// DeleteVaultItem deletes an item the user can edit
+func (s *service) DeleteVaultItem(ctx context.Context, userID, itemID uuid.UUID) error {
+	item, access, err := s.getVaultItem(ctx, userID, itemID)
+	if err != nil {
+		return err
+	}
+	if !access.CanEdit() {
+		return ErrUnauthorized
 	}
+	if err := s.repo.DeleteVaultItem(ctx, itemID); err != nil {
+		return err
+	}
+
+	pushSync(ctx, s.push, vaultItemPushTarget(item), PushSyncItem, item.ID, item.OrganizationID)
+	return nil
+}
 
-	block, err := aes.NewCipher(key)
+func (s *service) GetVaultItems(ctx context.Context, userID, orgID uuid.UUID) ([]models.VaultItem, error) {
+	// Verify user has access to organization; personal items need no permission
+	if orgID != uuid.Nil {
+		hasAccess, err := s.hasPermission(ctx, userID, orgID, PermissionReadVaultItems)
+		if err != nil {
+			return nil, err
+		}
+		if !hasAccess {
+			return nil, ErrUnauthorized
+		}
+	}
+
+	if orgID == uuid.Nil {
+		return s.repo.ListPersonalVaultItems(ctx, userID)
+	}
+
+	items, err := s.repo.ListOrganizationVaultItems(ctx, orgID)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	// Members who manage collections can grant themselves any of them, so they see
+	// every item in full; everyone else sees what their collection access allows
+	manager, err := s.hasPermission(ctx, userID, orgID, PermissionManageCollections)
 	if err != nil {
 		return nil, err
 	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	if manager {
+		return items, nil
+	}
+	access, err := s.collectionAccess(ctx, orgID, userID)
+	if err != nil {
 		return nil, err
 	}
+	return RestrictVaultItems(items, access), nil
+}
+
+// getVaultItem returns an item with the user's access to it. Items the user cannot see
+// are reported as not found.
+func (s *service) getVaultItem(ctx context.Context, userID, itemID uuid.UUID) (*models.VaultItem, CollectionAccess, error) {
+	item, err := s.repo.GetVaultItemByID(ctx, itemID)
+	if err != nil {
+		return nil, "", err
+	}
+	if item == nil {
+		return nil, "", ErrVaultItemNotFound
+	}
+	if item.OrganizationID != uuid.Nil {
+		hasAccess, err := s.hasPermission(ctx, userID, item.OrganizationID, PermissionReadVaultItems)
+		if err != nil {
+			return nil, "", err
+		}
+		if !hasAccess {
+			return nil, "", ErrVaultItemNotFound
+		}
+	}
+	access, err := s.vaultItemAccess(ctx, userID, item.OrganizationID, item.UserID, item.CollectionID)
+	if err != nil {
+		return nil, "", err
+	}
+	if access == "" {
+		return nil, "", ErrVaultItemNotFound
+	}
+	return item, access, nil
+}
+
+// vaultItemAccess returns the user's access to an item of orgID owned by ownerID in
+// collectionID, or "" if they have none. Personal items are managed by their owner
+// alone. Members who manage collections manage every organization item; others reach
+// only items in collections they were granted.
+func (s *service) vaultItemAccess(ctx context.Context, userID, orgID, ownerID uuid.UUID, collectionID *uuid.UUID) (CollectionAccess, error) {
+	if orgID == uuid.Nil {
+		if ownerID != userID {
+			return "", nil
+		}
+		return CollectionAccessManage, nil
+	}
+
+	manager, err := s.hasPermission(ctx, userID, orgID, PermissionManageCollections)
+	if err != nil {
+		return "", err
+	}
+	if manager {
+		return CollectionAccessManage, nil
+	}
+	if collectionID == nil {
+		return "", nil
+	}
+	access, err := s.collectionAccess(ctx, orgID, userID)
+	if err != nil {
+		return "", err
+	}
+	return access[*collectionID], nil
+}
 
-	return gcm.Seal(nonce, nonce, data, nil), nil
+// validateItemCollection checks that an item of orgID may be put in collectionID:
+// personal items belong to no collection, and organization items only to collections
+// of their organization
+func (s *service) validateItemCollection(ctx context.Context, orgID uuid.UUID, collectionID *uuid.UUID) error {
+	if collectionID == nil {
+		return nil
+	}
+	if orgID == uuid.Nil {
+		return fmt.Errorf("%w: personal items cannot belong to a collection", ErrInvalidOperation)
+	}
+	collection, err := s.repo.GetCollection(ctx, *collectionID)
+	if err != nil {
+		return err
+	}
+	if collection == nil || collection.OrganizationID != orgID {
+		return fmt.Errorf("%w: collection %s is not in the organization", ErrInvalidOperation, *collectionID)
+	}
+	return nil
 }
 
-func decryptData(encryptedData []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key)
+func sameCollection(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// vaultItemPushTarget selects the connections told about a change to the item: its
+// owner's for a personal item, otherwise those of members who can see its collection
+func vaultItemPushTarget(item *models.VaultItem) PushTarget {
+	if item.OrganizationID == uuid.Nil {
+		return PushTarget{UserID: item.UserID}
+	}
+	if item.CollectionID == nil {
+		// Only members who manage collections see items outside any collection
+		return PushTarget{OrganizationID: item.OrganizationID, CollectionScoped: true}
+	}
+	return collectionPushTarget(item.OrganizationID, *item.CollectionID)
+}
+
+// collectionAccess returns the member's access to each collection of the organization
+// they were granted, directly or through their groups
+func (s *service) collectionAccess(ctx context.Context, orgID, userID uuid.UUID) (map[uuid.UUID]CollectionAccess, error) {
+	grants, err := s.repo.ListUserCollectionGrants(ctx, orgID, userID)
 	if err != nil {
 		return nil, err
 	}
-
-	gcm, err := cipher.NewGCM(block)
+	groupGrants, err := s.repo.ListUserGroupCollectionGrants(ctx, orgID, userID)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(encryptedData) < gcm.NonceSize() {
-		return nil, errors.New("malformed ciphertext")
+	access := make(map[uuid.UUID]CollectionAccess, len(grants)+len(groupGrants))
+	for _, grant := range grants {
+		access[grant.CollectionID] = MergeCollectionAccess(access[grant.CollectionID], CollectionAccess(grant.Access))
 	}
-
-	nonce, ciphertext := encryptedData[:gcm.NonceSize()], encryptedData[gcm.NonceSize():]
-	return gcm.Open(nil, nonce, ciphertext, nil)
+	for _, grant := range groupGrants {
+		access[grant.CollectionID] = MergeCollectionAccess(access[grant.CollectionID], CollectionAccess(grant.Access))
+	}
+	return access, nil
 }
@@ -0,0 +1,383 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrInvalidWebAuthnResponse = errors.New("invalid WebAuthn response")
+	ErrWebAuthnCloneDetected   = errors.New("security key signature counter went backwards")
+)
+
+// WebAuthnConfig identifies this server as a WebAuthn relying party
+type WebAuthnConfig struct {
+	// RPID is the domain credentials are scoped to, e.g. "vault.example.com"
+	RPID          string
+	RPDisplayName string
+	// RPOrigins are the origins the browser may report, e.g. "https://vault.example.com"
+	RPOrigins []string
+}
+
+// WebAuthnRelyingParty runs WebAuthn registration and authentication ceremonies for a
+// user's security key methods and passkeys. It holds no state; the caller keeps the
+// session data between the begin and finish steps.
+type WebAuthnRelyingParty struct {
+	webauthn *webauthn.WebAuthn
+}
+
+func NewWebAuthnRelyingParty(config WebAuthnConfig) (*WebAuthnRelyingParty, error) {
+	displayName := config.RPDisplayName
+	if displayName == "" {
+		displayName = "PasswordImmunity"
+	}
+
+	wa, err := webauthn.New(&webauthn.Config{
+		RPID:          config.RPID,
+		RPDisplayName: displayName,
+		RPOrigins:     config.RPOrigins,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WebAuthnRelyingParty{webauthn: wa}, nil
+}
+
+// BeginRegistration returns the options for navigator.credentials.create. Keys the
+// user has already registered are excluded.
+func (rp *WebAuthnRelyingParty) BeginRegistration(user *models.User, methods []models.TwoFactorMethod) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	wu, err := newWebAuthnUser(user, methods)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(wu.credentials))
+	for _, credential := range wu.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	return rp.webauthn.BeginRegistration(wu,
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithConveyancePreference(protocol.PreferNoAttestation),
+	)
+}
+
+// FinishRegistration verifies the authenticator's attestation response and stores the
+// new credential on method
+func (rp *WebAuthnRelyingParty) FinishRegistration(
+	user *models.User,
+	methods []models.TwoFactorMethod,
+	session webauthn.SessionData,
+	response []byte,
+	method *models.TwoFactorMethod,
+) error {
+	wu, err := newWebAuthnUser(user, methods)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return ErrInvalidWebAuthnResponse
+	}
+
+	credential, err := rp.webauthn.CreateCredential(wu, session, parsed)
+	if err != nil {
+		return ErrInvalidWebAuthnResponse
+	}
+
+	return setWebAuthnCredential(method, credential)
+}
+
+// BeginLogin returns the options for navigator.credentials.get, allowing any of the
+// user's verified security keys
+func (rp *WebAuthnRelyingParty) BeginLogin(user *models.User, methods []models.TwoFactorMethod) (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	wu, err := newWebAuthnUser(user, methods)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(wu.credentials) == 0 {
+		return nil, nil, ErrInvalidOperation
+	}
+	return rp.webauthn.BeginLogin(wu)
+}
+
+// FinishLogin verifies an assertion and returns the method whose key signed it, with its
+// signature counter updated. The caller persists the returned method.
+func (rp *WebAuthnRelyingParty) FinishLogin(
+	user *models.User,
+	methods []models.TwoFactorMethod,
+	session webauthn.SessionData,
+	response []byte,
+) (*models.TwoFactorMethod, error) {
+	wu, err := newWebAuthnUser(user, methods)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, ErrInvalidWebAuthnResponse
+	}
+
+	credential, err := rp.webauthn.ValidateLogin(wu, session, parsed)
+	if err != nil {
+		return nil, ErrInvalidWebAuthnResponse
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, ErrWebAuthnCloneDetected
+	}
+
+	credentialID := encodeCredentialID(credential.ID)
+	for i := range methods {
+		if methods[i].Type != TwoFactorMethodWebAuthn || methods[i].CredentialID != credentialID {
+			continue
+		}
+		method := methods[i]
+		if err := setWebAuthnCredential(&method, credential); err != nil {
+			return nil, err
+		}
+		return &method, nil
+	}
+	return nil, ErrInvalidWebAuthnResponse
+}
+
+// PasskeyLookup loads the owner of a discoverable credential from the user handle the
+// authenticator returned, together with the owner's passkeys
+type PasskeyLookup func(userID uuid.UUID) (*models.User, []models.Passkey, error)
+
+// passkeyPRFSalt is evaluated with the PRF extension on every passkey ceremony. The
+// client derives the key that wraps the user key from the PRF output, so the salt must
+// never change.
+var passkeyPRFSalt = sha256.Sum256([]byte("PasswordImmunity passkey PRF"))
+
+func passkeyPRFExtension() protocol.AuthenticationExtensions {
+	return protocol.AuthenticationExtensions{
+		"prf": map[string]interface{}{
+			"eval": map[string]interface{}{
+				"first": base64.RawURLEncoding.EncodeToString(passkeyPRFSalt[:]),
+			},
+		},
+	}
+}
+
+// BeginPasskeyRegistration returns the options for creating a discoverable credential
+// with user verification and the PRF extension
+func (rp *WebAuthnRelyingParty) BeginPasskeyRegistration(user *models.User, passkeys []models.Passkey) (*protocol.CredentialCreation, *webauthn.SessionData, error) {
+	wu, err := newPasskeyUser(user, passkeys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	exclusions := make([]protocol.CredentialDescriptor, 0, len(wu.credentials))
+	for _, credential := range wu.credentials {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+
+	return rp.webauthn.BeginRegistration(wu,
+		webauthn.WithAuthenticatorSelection(protocol.AuthenticatorSelection{
+			ResidentKey:        protocol.ResidentKeyRequirementRequired,
+			RequireResidentKey: protocol.ResidentKeyRequired(),
+			UserVerification:   protocol.VerificationRequired,
+		}),
+		webauthn.WithExclusions(exclusions),
+		webauthn.WithConveyancePreference(protocol.PreferNoAttestation),
+		webauthn.WithExtensions(passkeyPRFExtension()),
+	)
+}
+
+// FinishPasskeyRegistration verifies the attestation response and stores the new
+// credential on passkey, recording whether the authenticator enabled PRF
+func (rp *WebAuthnRelyingParty) FinishPasskeyRegistration(
+	user *models.User,
+	passkeys []models.Passkey,
+	session webauthn.SessionData,
+	response []byte,
+	passkey *models.Passkey,
+) error {
+	wu, err := newPasskeyUser(user, passkeys)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return ErrInvalidWebAuthnResponse
+	}
+
+	credential, err := rp.webauthn.CreateCredential(wu, session, parsed)
+	if err != nil {
+		return ErrInvalidWebAuthnResponse
+	}
+
+	passkey.PRFEnabled = prfEnabled(parsed.ClientExtensionResults)
+	return setPasskeyCredential(passkey, credential)
+}
+
+// BeginPasskeyLogin returns options for a discoverable login: the authenticator picks
+// the credential and tells us whose it is
+func (rp *WebAuthnRelyingParty) BeginPasskeyLogin() (*protocol.CredentialAssertion, *webauthn.SessionData, error) {
+	return rp.webauthn.BeginDiscoverableLogin(
+		webauthn.WithUserVerification(protocol.VerificationRequired),
+		webauthn.WithAssertionExtensions(passkeyPRFExtension()),
+	)
+}
+
+// FinishPasskeyLogin verifies a discoverable assertion and returns the user and the
+// passkey that signed it, with its signature counter updated. The caller persists the
+// returned passkey.
+func (rp *WebAuthnRelyingParty) FinishPasskeyLogin(session webauthn.SessionData, response []byte, lookup PasskeyLookup) (*models.User, *models.Passkey, error) {
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(response))
+	if err != nil {
+		return nil, nil, ErrInvalidWebAuthnResponse
+	}
+
+	var (
+		user     *models.User
+		passkeys []models.Passkey
+	)
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		userID, err := uuid.FromBytes(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		user, passkeys, err = lookup(userID)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, ErrUserNotFound
+		}
+		return newPasskeyUser(user, passkeys)
+	}
+
+	credential, err := rp.webauthn.ValidateDiscoverableLogin(handler, session, parsed)
+	if err != nil {
+		return nil, nil, ErrInvalidWebAuthnResponse
+	}
+	if credential.Authenticator.CloneWarning {
+		return nil, nil, ErrWebAuthnCloneDetected
+	}
+
+	credentialID := encodeCredentialID(credential.ID)
+	for i := range passkeys {
+		if passkeys[i].CredentialID != credentialID {
+			continue
+		}
+		passkey := passkeys[i]
+		if err := setPasskeyCredential(&passkey, credential); err != nil {
+			return nil, nil, err
+		}
+		return user, &passkey, nil
+	}
+	return nil, nil, ErrInvalidWebAuthnResponse
+}
+
+// prfEnabled reads the PRF client extension output of a registration
+func prfEnabled(outputs protocol.AuthenticationExtensionsClientOutputs) bool {
+	prf, ok := outputs["prf"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if enabled, ok := prf["enabled"].(bool); ok {
+		return enabled
+	}
+	_, ok = prf["results"]
+	return ok
+}
+
+// webAuthnUser adapts a user and their verified security keys or passkeys to webauthn.User
+type webAuthnUser struct {
+	user        *models.User
+	credentials []webauthn.Credential
+}
+
+func newWebAuthnUser(user *models.User, methods []models.TwoFactorMethod) (*webAuthnUser, error) {
+	wu := &webAuthnUser{user: user}
+	for _, method := range methods {
+		if method.Type != TwoFactorMethodWebAuthn || !method.Verified || method.Credential == "" {
+			continue
+		}
+		credential, err := decodeWebAuthnCredential(method.Credential)
+		if err != nil {
+			return nil, err
+		}
+		wu.credentials = append(wu.credentials, credential)
+	}
+	return wu, nil
+}
+
+func newPasskeyUser(user *models.User, passkeys []models.Passkey) (*webAuthnUser, error) {
+	wu := &webAuthnUser{user: user}
+	for _, passkey := range passkeys {
+		credential, err := decodeWebAuthnCredential(passkey.Credential)
+		if err != nil {
+			return nil, err
+		}
+		wu.credentials = append(wu.credentials, credential)
+	}
+	return wu, nil
+}
+
+// WebAuthnID is the user handle. It is the user ID, which never changes and reveals
+// nothing about the user.
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return u.user.ID[:]
+}
+
+func (u *webAuthnUser) WebAuthnName() string {
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnDisplayName() string {
+	if u.user.Name != "" {
+		return u.user.Name
+	}
+	return u.user.Email
+}
+
+func (u *webAuthnUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func setWebAuthnCredential(method *models.TwoFactorMethod, credential *webauthn.Credential) error {
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	method.CredentialID = encodeCredentialID(credential.ID)
+	method.Credential = string(encoded)
+	return nil
+}
+
+func setPasskeyCredential(passkey *models.Passkey, credential *webauthn.Credential) error {
+	encoded, err := json.Marshal(credential)
+	if err != nil {
+		return err
+	}
+	passkey.CredentialID = encodeCredentialID(credential.ID)
+	passkey.Credential = string(encoded)
+	return nil
+}
+
+func decodeWebAuthnCredential(encoded string) (webauthn.Credential, error) {
+	var credential webauthn.Credential
+	err := json.Unmarshal([]byte(encoded), &credential)
+	return credential, err
+}
+
+func encodeCredentialID(id []byte) string {
+	return base64.RawURLEncoding.EncodeToString(id)
+}
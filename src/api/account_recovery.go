@@ -0,0 +1,138 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// AccountRecoveryHandler serves account recovery enrollment and admin password resets
+type AccountRecoveryHandler struct {
+	recovery services.AccountRecoveryService
+	sessions services.SessionService
+}
+
+func NewAccountRecoveryHandler(recovery services.AccountRecoveryService, sessions services.SessionService) *AccountRecoveryHandler {
+	return &AccountRecoveryHandler{
+		recovery: recovery,
+		sessions: sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	POST|DELETE /api/account-recovery/organizations/{orgId}/enrollment
+//	POST        /api/account-recovery/organizations/{orgId}/members/{userId}/reset
+//	POST        /api/account-recovery/requests/{requestId}/confirm
+//	DELETE      /api/account-recovery/requests/{requestId}
+func (h *AccountRecoveryHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/api/account-recovery/", RequireSession(h.sessions, http.HandlerFunc(h.route)))
+}
+
+func (h *AccountRecoveryHandler) route(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/account-recovery/")
+	if len(segments) < 2 {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+
+	id, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+
+	switch {
+	case len(segments) == 3 && segments[0] == "organizations" && segments[2] == "enrollment":
+		switch r.Method {
+		case http.MethodPost:
+			h.enroll(w, r, id)
+		case http.MethodDelete:
+			h.withdraw(w, r, id)
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case len(segments) == 5 && segments[0] == "organizations" && segments[2] == "members" && segments[4] == "reset" && r.Method == http.MethodPost:
+		memberID, err := uuid.Parse(segments[3])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		h.initiateReset(w, r, id, memberID)
+	case len(segments) == 3 && segments[0] == "requests" && segments[2] == "confirm" && r.Method == http.MethodPost:
+		h.confirmReset(w, r, id)
+	case len(segments) == 2 && segments[0] == "requests" && r.Method == http.MethodDelete:
+		h.cancelReset(w, r, id)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *AccountRecoveryHandler) enroll(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	if err := h.recovery.EnrollAccountRecovery(r.Context(), orgID, UserIDFromContext(r.Context())); err != nil {
+		sendAccountRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *AccountRecoveryHandler) withdraw(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	if err := h.recovery.WithdrawAccountRecovery(r.Context(), orgID, UserIDFromContext(r.Context())); err != nil {
+		sendAccountRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *AccountRecoveryHandler) initiateReset(w http.ResponseWriter, r *http.Request, orgID, memberID uuid.UUID) {
+	request, err := h.recovery.InitiatePasswordReset(r.Context(), orgID, UserIDFromContext(r.Context()), memberID)
+	if err != nil {
+		sendAccountRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, Response{Success: true, Data: request})
+}
+
+func (h *AccountRecoveryHandler) confirmReset(w http.ResponseWriter, r *http.Request, requestID uuid.UUID) {
+	var req struct {
+		AdminPassword string `json:"admin_password"`
+		NewPassword   string `json:"new_password"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if err := h.recovery.ConfirmPasswordReset(r.Context(), requestID, UserIDFromContext(r.Context()), req.AdminPassword, req.NewPassword); err != nil {
+		sendAccountRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *AccountRecoveryHandler) cancelReset(w http.ResponseWriter, r *http.Request, requestID uuid.UUID) {
+	if err := h.recovery.CancelPasswordReset(r.Context(), requestID, UserIDFromContext(r.Context())); err != nil {
+		sendAccountRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func sendAccountRecoveryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrRecoveryRequestNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrRecoveryRequestExpired):
+		sendError(w, http.StatusGone, "REQUEST_EXPIRED", err.Error())
+	case errors.Is(err, services.ErrNotEnrolledInAccountRecovery), errors.Is(err, services.ErrAccountRecoveryRequired):
+		sendError(w, http.StatusConflict, "ACCOUNT_RECOVERY_POLICY", err.Error())
+	case errors.Is(err, services.ErrInvalidPassword):
+		sendError(w, http.StatusUnauthorized, "INVALID_PASSWORD", err.Error())
+	case errors.Is(err, services.ErrPasswordPolicyViolation), errors.Is(err, services.ErrStaleKeyEscrow):
+		sendError(w, http.StatusUnprocessableEntity, "PASSWORD_RESET_REJECTED", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
@@ -0,0 +1,183 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// AuthRequestHandler serves login approval: a new device asks to sign in and one of the
+// user's authorized devices approves it
+type AuthRequestHandler struct {
+	devices  services.DeviceService
+	sessions services.SessionService
+}
+
+func NewAuthRequestHandler(devices services.DeviceService, sessions services.SessionService) *AuthRequestHandler {
+	return &AuthRequestHandler{
+		devices:  devices,
+		sessions: sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	POST   /api/auth/requests
+//	GET    /api/auth/requests
+//	PUT    /api/auth/requests/{requestId}
+//	GET    /api/auth/requests/{requestId}?access_code={code}
+//	POST   /api/auth/requests/{requestId}/login
+func (h *AuthRequestHandler) RegisterRoutes(mux *http.ServeMux) {
+	authorized := RequireSession(h.sessions, http.HandlerFunc(h.routeAuthorized))
+	route := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := pathSegments(r, "/api/auth/requests")
+		switch {
+		case len(segments) == 0 && r.Method == http.MethodPost:
+			h.createRequest(w, r)
+		case len(segments) == 1 && r.Method == http.MethodGet:
+			h.getStatus(w, r, segments[0])
+		case len(segments) == 2 && segments[1] == "login" && r.Method == http.MethodPost:
+			h.login(w, r, segments[0])
+		default:
+			authorized.ServeHTTP(w, r)
+		}
+	})
+	mux.Handle("/api/auth/requests", route)
+	mux.Handle("/api/auth/requests/", route)
+}
+
+func (h *AuthRequestHandler) routeAuthorized(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/auth/requests")
+
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		h.listRequests(w, r)
+	case len(segments) == 1 && r.Method == http.MethodPut:
+		requestID, err := uuid.Parse(segments[0])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		h.respond(w, r, requestID)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *AuthRequestHandler) createRequest(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email       string              `json:"email"`
+		PublicKey   string              `json:"public_key"`
+		Fingerprint string              `json:"fingerprint"`
+		DeviceID    uuid.UUID           `json:"device_id"`
+		DeviceName  string              `json:"device_name"`
+		DeviceType  services.DeviceType `json:"device_type"`
+	}
+	if err := decodeJSON(r, &req); err != nil || req.Email == "" || req.PublicKey == "" || req.Fingerprint == "" {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	request, err := h.devices.CreateAuthRequest(r.Context(), req.Email, req.PublicKey, req.Fingerprint, req.DeviceID, req.DeviceName, req.DeviceType)
+	if err != nil {
+		sendAuthRequestError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, Response{Success: true, Data: request})
+}
+
+func (h *AuthRequestHandler) listRequests(w http.ResponseWriter, r *http.Request) {
+	requests, err := h.devices.ListPendingAuthRequests(r.Context(), UserIDFromContext(r.Context()))
+	if err != nil {
+		sendAuthRequestError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: requests})
+}
+
+func (h *AuthRequestHandler) respond(w http.ResponseWriter, r *http.Request, requestID uuid.UUID) {
+	var req struct {
+		DeviceID         uuid.UUID `json:"device_id"`
+		Approved         bool      `json:"approved"`
+		EncryptedUserKey string    `json:"encrypted_user_key"`
+	}
+	if err := decodeJSON(r, &req); err != nil || req.DeviceID == uuid.Nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	err := h.devices.RespondToAuthRequest(r.Context(), UserIDFromContext(r.Context()), requestID, req.DeviceID, req.Approved, req.EncryptedUserKey)
+	if err != nil {
+		sendAuthRequestError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *AuthRequestHandler) getStatus(w http.ResponseWriter, r *http.Request, id string) {
+	requestID, err := uuid.Parse(id)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+
+	status, err := h.devices.GetAuthRequestStatus(r.Context(), requestID, r.URL.Query().Get("access_code"))
+	if err != nil {
+		sendAuthRequestError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: status})
+}
+
+func (h *AuthRequestHandler) login(w http.ResponseWriter, r *http.Request, id string) {
+	requestID, err := uuid.Parse(id)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	var req struct {
+		AccessCode string `json:"access_code"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	result, err := h.devices.CompleteAuthRequest(r.Context(), requestID, req.AccessCode)
+	if err != nil {
+		sendAuthRequestError(w, err)
+		return
+	}
+
+	session, err := h.sessions.CreateSession(r.Context(), result.User.ID, result.DeviceID, r.UserAgent())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"token":              session.Token,
+			"expires_at":         session.ExpiresAt,
+			"encrypted_user_key": result.EncryptedUserKey,
+		},
+	})
+}
+
+func sendAuthRequestError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrAuthRequestNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrAuthRequestExpired):
+		sendError(w, http.StatusGone, "AUTH_REQUEST_EXPIRED", err.Error())
+	case errors.Is(err, services.ErrAuthRequestAnswered):
+		sendError(w, http.StatusConflict, "AUTH_REQUEST_ANSWERED", err.Error())
+	case errors.Is(err, services.ErrAuthRequestUnavailable), errors.Is(err, services.ErrInvalidAuthRequest):
+		sendError(w, http.StatusBadRequest, "INVALID_AUTH_REQUEST", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
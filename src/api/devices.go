@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// DeviceHandler serves device approval by the user from an authorized device, device
+// key registration and the organization approval queue for admins
+type DeviceHandler struct {
+	devices  services.DeviceService
+	sessions services.SessionService
+}
+
+func NewDeviceHandler(devices services.DeviceService, sessions services.SessionService) *DeviceHandler {
+	return &DeviceHandler{
+		devices:  devices,
+		sessions: sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	PUT    /api/devices/{deviceId}
+//	PUT    /api/devices/{deviceId}/key
+//	GET    /api/devices/organizations/{orgId}/pending
+//	PUT    /api/devices/organizations/{orgId}/pending/{deviceId}
+func (h *DeviceHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/api/devices/", RequireSession(h.sessions, http.HandlerFunc(h.route)))
+}
+
+func (h *DeviceHandler) route(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/devices/")
+
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodPut:
+		deviceID, err := uuid.Parse(segments[0])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		h.reviewDevice(w, r, deviceID)
+	case len(segments) == 2 && segments[1] == "key" && r.Method == http.MethodPut:
+		deviceID, err := uuid.Parse(segments[0])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		ctx := r.Context()
+		if err := h.devices.RegisterDeviceKey(ctx, UserIDFromContext(ctx), services.DeviceIDFromContext(ctx), deviceID); err != nil {
+			sendDeviceError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	case len(segments) >= 3 && segments[0] == "organizations" && segments[2] == "pending":
+		h.routeQueue(w, r, segments)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *DeviceHandler) routeQueue(w http.ResponseWriter, r *http.Request, segments []string) {
+	orgID, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	adminID := UserIDFromContext(r.Context())
+
+	switch {
+	case len(segments) == 3 && r.Method == http.MethodGet:
+		devices, err := h.devices.ListPendingDevices(r.Context(), orgID, adminID)
+		if err != nil {
+			sendDeviceError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: devices})
+	case len(segments) == 4 && r.Method == http.MethodPut:
+		deviceID, err := uuid.Parse(segments[3])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		var req struct {
+			Approved bool `json:"approved"`
+		}
+		if err := decodeJSON(r, &req); err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+			return
+		}
+		if err := h.devices.ReviewMemberDevice(r.Context(), orgID, adminID, deviceID, req.Approved); err != nil {
+			sendDeviceError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+// reviewDevice approves or denies one of the user's pending devices. The request must
+// come from a session signed in on an authorized device.
+func (h *DeviceHandler) reviewDevice(w http.ResponseWriter, r *http.Request, deviceID uuid.UUID) {
+	var req struct {
+		Approved bool `json:"approved"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	ctx := r.Context()
+	err := h.devices.ReviewDevice(ctx, UserIDFromContext(ctx), services.DeviceIDFromContext(ctx), deviceID, req.Approved)
+	if err != nil {
+		sendDeviceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func sendDeviceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrDeviceNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrDeviceNotPending):
+		sendError(w, http.StatusConflict, "DEVICE_NOT_PENDING", err.Error())
+	case errors.Is(err, services.ErrDeviceKeyRegistered):
+		sendError(w, http.StatusConflict, "DEVICE_KEY_REGISTERED", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
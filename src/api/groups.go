@@ -0,0 +1,224 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// GroupHandler lets organization admins manage groups, their members and their access
+type GroupHandler struct {
+	groups   services.GroupService
+	sessions services.SessionService
+}
+
+func NewGroupHandler(groups services.GroupService, sessions services.SessionService) *GroupHandler {
+	return &GroupHandler{
+		groups:   groups,
+		sessions: sessions,
+	}
+}
+
+// groupRequest creates or changes a group
+type groupRequest struct {
+	Name   string     `json:"name"`
+	RoleID *uuid.UUID `json:"role_id"`
+}
+
+// RegisterRoutes registers:
+//
+//	GET|POST       /api/groups/organizations/{orgId}
+//	GET|PUT|DELETE /api/groups/organizations/{orgId}/{groupId}
+//	GET            /api/groups/organizations/{orgId}/{groupId}/members
+//	PUT|DELETE     /api/groups/organizations/{orgId}/{groupId}/members/{userId}
+//	GET            /api/groups/organizations/{orgId}/{groupId}/collections
+//	PUT|DELETE     /api/groups/organizations/{orgId}/{groupId}/collections/{collectionId}
+func (h *GroupHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/api/groups/", RequireSession(h.sessions, http.HandlerFunc(h.route)))
+}
+
+func (h *GroupHandler) route(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/groups/")
+	if len(segments) < 2 || segments[0] != "organizations" {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+
+	// Every segment after "organizations" but the sub-resource names is an ID
+	var ids []uuid.UUID
+	for i, segment := range segments[1:] {
+		if i == 2 || i == 4 {
+			continue
+		}
+		id, err := uuid.Parse(segment)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		ids = append(ids, id)
+	}
+	orgID := ids[0]
+
+	switch {
+	case len(segments) == 2:
+		switch r.Method {
+		case http.MethodGet:
+			h.listGroups(w, r, orgID)
+		case http.MethodPost:
+			h.createGroup(w, r, orgID)
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case len(segments) == 3:
+		switch r.Method {
+		case http.MethodGet:
+			h.getGroup(w, r, orgID, ids[1])
+		case http.MethodPut:
+			h.updateGroup(w, r, orgID, ids[1])
+		case http.MethodDelete:
+			h.deleteGroup(w, r, orgID, ids[1])
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case len(segments) == 4 && segments[3] == "members" && r.Method == http.MethodGet:
+		h.listMembers(w, r, orgID, ids[1])
+	case len(segments) == 5 && segments[3] == "members":
+		switch r.Method {
+		case http.MethodPut:
+			h.addMember(w, r, orgID, ids[1], ids[2])
+		case http.MethodDelete:
+			h.removeMember(w, r, orgID, ids[1], ids[2])
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case len(segments) == 4 && segments[3] == "collections" && r.Method == http.MethodGet:
+		h.listCollections(w, r, orgID, ids[1])
+	case len(segments) == 5 && segments[3] == "collections":
+		switch r.Method {
+		case http.MethodPut:
+			h.setCollectionAccess(w, r, orgID, ids[1], ids[2])
+		case http.MethodDelete:
+			h.removeCollection(w, r, orgID, ids[1], ids[2])
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *GroupHandler) listGroups(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	groups, err := h.groups.ListGroups(r.Context(), orgID, UserIDFromContext(r.Context()))
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: groups})
+}
+
+func (h *GroupHandler) createGroup(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	var req groupRequest
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	group, err := h.groups.CreateGroup(r.Context(), orgID, UserIDFromContext(r.Context()), req.Name, req.RoleID)
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, Response{Success: true, Data: group})
+}
+
+func (h *GroupHandler) getGroup(w http.ResponseWriter, r *http.Request, orgID, groupID uuid.UUID) {
+	group, err := h.groups.GetGroup(r.Context(), orgID, UserIDFromContext(r.Context()), groupID)
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: group})
+}
+
+func (h *GroupHandler) updateGroup(w http.ResponseWriter, r *http.Request, orgID, groupID uuid.UUID) {
+	var req groupRequest
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	group, err := h.groups.UpdateGroup(r.Context(), orgID, UserIDFromContext(r.Context()), groupID, req.Name, req.RoleID)
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: group})
+}
+
+func (h *GroupHandler) deleteGroup(w http.ResponseWriter, r *http.Request, orgID, groupID uuid.UUID) {
+	if err := h.groups.DeleteGroup(r.Context(), orgID, UserIDFromContext(r.Context()), groupID); err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *GroupHandler) listMembers(w http.ResponseWriter, r *http.Request, orgID, groupID uuid.UUID) {
+	members, err := h.groups.ListGroupMembers(r.Context(), orgID, UserIDFromContext(r.Context()), groupID)
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: members})
+}
+
+func (h *GroupHandler) addMember(w http.ResponseWriter, r *http.Request, orgID, groupID, userID uuid.UUID) {
+	if err := h.groups.AddGroupMember(r.Context(), orgID, UserIDFromContext(r.Context()), groupID, userID); err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *GroupHandler) removeMember(w http.ResponseWriter, r *http.Request, orgID, groupID, userID uuid.UUID) {
+	if err := h.groups.RemoveGroupMember(r.Context(), orgID, UserIDFromContext(r.Context()), groupID, userID); err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *GroupHandler) listCollections(w http.ResponseWriter, r *http.Request, orgID, groupID uuid.UUID) {
+	grants, err := h.groups.ListGroupCollections(r.Context(), orgID, UserIDFromContext(r.Context()), groupID)
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: grants})
+}
+
+func (h *GroupHandler) setCollectionAccess(w http.ResponseWriter, r *http.Request, orgID, groupID, collectionID uuid.UUID) {
+	var req struct {
+		Access services.CollectionAccess `json:"access"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	err := h.groups.SetGroupCollectionAccess(r.Context(), orgID, UserIDFromContext(r.Context()), groupID, collectionID, req.Access)
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *GroupHandler) removeCollection(w http.ResponseWriter, r *http.Request, orgID, groupID, collectionID uuid.UUID) {
+	if err := h.groups.RemoveGroupCollection(r.Context(), orgID, UserIDFromContext(r.Context()), groupID, collectionID); err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
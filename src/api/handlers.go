@@ -2,7 +2,13 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/services"
 )
 
 // Response represents a standard API response
@@ -55,8 +61,75 @@ func sendError(w http.ResponseWriter, status int, code, message string) {
 	sendJSON(w, status, resp)
 }
 
-// Basic routes setup
-func SetupRoutes() http.Handler {
+// sendServiceError maps common service errors onto API errors
+func sendServiceError(w http.ResponseWriter, err error) {
+	var blocked *services.LoginBlockedError
+	if errors.As(err, &blocked) {
+		retryAfter := int(time.Until(blocked.RetryAt).Seconds()) + 1
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	}
+
+	// The client signs in with the same device ID once the device is approved
+	var pending *services.DevicePendingError
+	if errors.As(err, &pending) {
+		sendJSON(w, http.StatusForbidden, Response{
+			Success: false,
+			Data:    map[string]interface{}{"device_id": pending.DeviceID},
+			Error:   &Error{Code: "DEVICE_PENDING_APPROVAL", Message: err.Error()},
+		})
+		return
+	}
+
+	if errors.Is(err, services.ErrInvalidDPoPProof) || errors.Is(err, services.ErrDPoPProofRequired) {
+		sendDPoPError(w, err)
+		return
+	}
+
+	switch {
+	case errors.Is(err, services.ErrAccountLocked):
+		sendError(w, http.StatusLocked, "ACCOUNT_LOCKED", err.Error())
+	case errors.Is(err, services.ErrLoginThrottled):
+		sendError(w, http.StatusTooManyRequests, "TOO_MANY_ATTEMPTS", err.Error())
+	case errors.Is(err, services.ErrSuspiciousLoginBlocked):
+		sendError(w, http.StatusForbidden, "LOGIN_BLOCKED", err.Error())
+	case errors.Is(err, services.ErrDeviceBlocked):
+		sendError(w, http.StatusForbidden, "DEVICE_BLOCKED", err.Error())
+	case errors.Is(err, services.ErrUnauthorized):
+		sendError(w, http.StatusForbidden, "FORBIDDEN", err.Error())
+	case errors.Is(err, services.ErrUserNotFound), errors.Is(err, services.ErrGroupNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrInvalidOperation):
+		sendError(w, http.StatusBadRequest, "INVALID_OPERATION", err.Error())
+	default:
+		sendError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+	}
+}
+
+// decodeJSON decodes a JSON request body into v
+func decodeJSON(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// pathSegments returns the non-empty path segments following prefix
+func pathSegments(r *http.Request, prefix string) []string {
+	var segments []string
+	for _, segment := range strings.Split(strings.TrimPrefix(r.URL.Path, prefix), "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
+
+// RouteRegistrar is implemented by handlers that register their own routes
+type RouteRegistrar interface {
+	RegisterRoutes(mux *http.ServeMux)
+}
+
+// SetupRoutes registers all routes. Every request's DPoP proof is verified by dpop
+// against publicURL, the scheme and host clients reach the server at.
+func SetupRoutes(dpop services.DPoPService, publicURL string, registrars ...RouteRegistrar) http.Handler {
 	mux := http.NewServeMux()
 
 	// Auth routes
@@ -76,7 +149,11 @@ func SetupRoutes() http.Handler {
 	mux.HandleFunc("/api/roles", handleRoles)
 	mux.HandleFunc("/api/roles/", handleRole)
 
-	return mux
+	for _, registrar := range registrars {
+		registrar.RegisterRoutes(mux)
+	}
+
+	return WithClientIP(WithDPoP(dpop, publicURL, mux))
 }
 
 // Placeholder handlers - implementations will be added in separate PRs
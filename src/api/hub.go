@@ -0,0 +1,260 @@
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+)
+
+const (
+	// hubPingInterval keeps idle connections open through proxies
+	hubPingInterval = 30 * time.Second
+	// hubWriteTimeout bounds each write to a client
+	hubWriteTimeout = 10 * time.Second
+	// hubMaxConnectionAge closes connections regularly so the client reconnects and its
+	// session is checked again
+	hubMaxConnectionAge = time.Hour
+)
+
+// HubHandler serves the notifications hub, which pushes changes to connected clients
+// over WebSocket or server-sent events
+type HubHandler struct {
+	hub       services.NotificationHub
+	sessions  services.SessionService
+	publicURL string
+}
+
+// NewHubHandler creates the hub handler. publicURL is the scheme and host of the web
+// vault, the only origin browsers may open a WebSocket from.
+func NewHubHandler(hub services.NotificationHub, sessions services.SessionService, publicURL string) *HubHandler {
+	return &HubHandler{
+		hub:       hub,
+		sessions:  sessions,
+		publicURL: publicURL,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	GET    /notifications/hub
+//	POST   /notifications/hub/ticket
+func (h *HubHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/notifications/hub", h.requireSessionOrTicket(http.HandlerFunc(h.serve)))
+	mux.Handle("/notifications/hub/ticket", RequireSession(h.sessions, http.HandlerFunc(h.createTicket)))
+}
+
+// requireSessionOrTicket accepts a ticket from POST /notifications/hub/ticket as the
+// ticket query parameter, since browsers cannot set headers on WebSocket and
+// EventSource requests. Requests without one must carry the session token.
+func (h *HubHandler) requireSessionOrTicket(next http.Handler) http.Handler {
+	withSession := RequireSession(h.sessions, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ticket := r.URL.Query().Get("ticket")
+		if ticket == "" {
+			withSession.ServeHTTP(w, r)
+			return
+		}
+
+		session, err := h.sessions.RedeemSessionTicket(r.Context(), ticket)
+		if err != nil {
+			if !errors.Is(err, services.ErrInvalidSession) {
+				log.Printf("Failed to redeem hub ticket: %v", err)
+			}
+			sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid or expired ticket")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(sessionContext(r.Context(), session)))
+	})
+}
+
+func (h *HubHandler) createTicket(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+
+	ticket, err := h.sessions.CreateSessionTicket(r.Context(), services.SessionIDFromContext(r.Context()))
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"ticket":     ticket.Ticket,
+			"expires_at": ticket.ExpiresAt,
+		},
+	})
+}
+
+func (h *HubHandler) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+
+	ctx := r.Context()
+	subscription, err := h.hub.Subscribe(ctx, UserIDFromContext(ctx), services.SessionIDFromContext(ctx), services.DeviceIDFromContext(ctx))
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	defer subscription.Close()
+
+	if isWebSocketUpgrade(r) {
+		h.serveWebSocket(w, r, subscription)
+		return
+	}
+	h.serveEventStream(w, r, subscription)
+}
+
+// serveEventStream sends each message as a server-sent event named after its type
+func (h *HubHandler) serveEventStream(w http.ResponseWriter, r *http.Request, subscription *services.PushSubscription) {
+	controller := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keeps nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(format string, args ...interface{}) bool {
+		if err := controller.SetWriteDeadline(time.Now().Add(hubWriteTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return false
+		}
+		return controller.Flush() == nil
+	}
+	if !write(": connected\n\n") {
+		return
+	}
+
+	ping := time.NewTicker(hubPingInterval)
+	defer ping.Stop()
+	maxAge := time.NewTimer(hubMaxConnectionAge)
+	defer maxAge.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-maxAge.C:
+			return
+		case <-ping.C:
+			if !write(": ping\n\n") {
+				return
+			}
+		case msg, ok := <-subscription.Messages():
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Failed to encode push message: %v", err)
+				continue
+			}
+			if !write("event: %s\ndata: %s\n\n", msg.Type, data) {
+				return
+			}
+		}
+	}
+}
+
+// serveWebSocket sends each message as a JSON text frame. Frames from the client are
+// only read to answer pings and notice when it goes away.
+func (h *HubHandler) serveWebSocket(w http.ResponseWriter, r *http.Request, subscription *services.PushSubscription) {
+	conn, rw, err := upgradeWebSocket(w, r, h.publicURL)
+	if errors.Is(err, errWebSocketHandshake) {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid WebSocket handshake")
+		return
+	}
+	if errors.Is(err, errWebSocketOrigin) {
+		sendError(w, http.StatusForbidden, "FORBIDDEN", "Origin not allowed")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to upgrade notifications hub connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	write := func(opcode byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		if err := conn.SetWriteDeadline(time.Now().Add(hubWriteTimeout)); err != nil {
+			return err
+		}
+		return writeWebSocketFrame(rw.Writer, opcode, payload)
+	}
+	closeFrame := func(code uint16) {
+		payload := make([]byte, 2)
+		binary.BigEndian.PutUint16(payload, code)
+		write(wsOpClose, payload)
+	}
+
+	// The client must answer the pings sent every hubPingInterval
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			if err := conn.SetReadDeadline(time.Now().Add(2 * hubPingInterval)); err != nil {
+				return
+			}
+			opcode, payload, err := readWebSocketFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch opcode {
+			case wsOpPing:
+				if write(wsOpPong, payload) != nil {
+					return
+				}
+			case wsOpClose:
+				closeFrame(1000)
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(hubPingInterval)
+	defer ping.Stop()
+	maxAge := time.NewTimer(hubMaxConnectionAge)
+	defer maxAge.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-maxAge.C:
+			// Going away: the client reconnects
+			closeFrame(1001)
+			return
+		case <-ping.C:
+			if write(wsOpPing, nil) != nil {
+				return
+			}
+		case msg, ok := <-subscription.Messages():
+			if !ok {
+				closeFrame(1000)
+				return
+			}
+			data, err := json.Marshal(msg)
+			if err != nil {
+				log.Printf("Failed to encode push message: %v", err)
+				continue
+			}
+			if write(wsOpText, data) != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// KeyConnectorHandler serves key connector status, tokens and migration
+type KeyConnectorHandler struct {
+	keyConnector services.KeyConnectorService
+	sessions     services.SessionService
+}
+
+func NewKeyConnectorHandler(keyConnector services.KeyConnectorService, sessions services.SessionService) *KeyConnectorHandler {
+	return &KeyConnectorHandler{
+		keyConnector: keyConnector,
+		sessions:     sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	GET    /api/key-connector/status
+//	POST   /api/key-connector/token
+//	POST   /api/key-connector/migrate
+//	GET    /api/key-connector/jwks
+func (h *KeyConnectorHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/api/key-connector/status", RequireSession(h.sessions, http.HandlerFunc(h.getStatus)))
+	mux.Handle("/api/key-connector/token", RequireSession(h.sessions, http.HandlerFunc(h.issueToken)))
+	mux.Handle("/api/key-connector/migrate", RequireSession(h.sessions, http.HandlerFunc(h.migrate)))
+	mux.HandleFunc("/api/key-connector/jwks", h.getJWKS)
+}
+
+func (h *KeyConnectorHandler) getStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	status, err := h.keyConnector.GetKeyConnectorStatus(r.Context(), UserIDFromContext(r.Context()))
+	if err != nil {
+		sendKeyConnectorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: status})
+}
+
+func (h *KeyConnectorHandler) issueToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	token, err := h.keyConnector.IssueKeyConnectorToken(r.Context(), UserIDFromContext(r.Context()))
+	if err != nil {
+		sendKeyConnectorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: token})
+}
+
+func (h *KeyConnectorHandler) migrate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	var req struct {
+		OrganizationID uuid.UUID `json:"organization_id"`
+	}
+	if err := decodeJSON(r, &req); err != nil || req.OrganizationID == uuid.Nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+	if err := h.keyConnector.MigrateToKeyConnector(r.Context(), UserIDFromContext(r.Context()), req.OrganizationID); err != nil {
+		sendKeyConnectorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *KeyConnectorHandler) getJWKS(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+	jwks, err := h.keyConnector.KeyConnectorJWKS()
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write(jwks)
+}
+
+func sendKeyConnectorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrKeyConnectorNotEnabled):
+		sendError(w, http.StatusForbidden, "KEY_CONNECTOR_NOT_ENABLED", err.Error())
+	case errors.Is(err, services.ErrKeyConnectorMigrated):
+		sendError(w, http.StatusConflict, "KEY_CONNECTOR_MIGRATED", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
@@ -0,0 +1,67 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// LoginProtectionHandler lets organization admins inspect and clear member lockouts
+type LoginProtectionHandler struct {
+	protection services.LoginProtectionService
+	sessions   services.SessionService
+}
+
+func NewLoginProtectionHandler(protection services.LoginProtectionService, sessions services.SessionService) *LoginProtectionHandler {
+	return &LoginProtectionHandler{
+		protection: protection,
+		sessions:   sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	GET    /api/login-protection/organizations/{orgId}/members/{userId}/lockout
+//	DELETE /api/login-protection/organizations/{orgId}/members/{userId}/lockout
+func (h *LoginProtectionHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/api/login-protection/", RequireSession(h.sessions, http.HandlerFunc(h.route)))
+}
+
+func (h *LoginProtectionHandler) route(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/login-protection/")
+	if len(segments) != 5 || segments[0] != "organizations" || segments[2] != "members" || segments[4] != "lockout" {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+
+	orgID, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	memberID, err := uuid.Parse(segments[3])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	adminID := UserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		status, err := h.protection.GetLockoutStatus(r.Context(), orgID, adminID, memberID)
+		if err != nil {
+			sendServiceError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: status})
+	case http.MethodDelete:
+		if err := h.protection.UnlockAccount(r.Context(), orgID, adminID, memberID); err != nil {
+			sendServiceError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+	}
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+type userContextKey struct{}
+
+// RequireSession authenticates requests with a session token and stores the session,
+// device and user IDs in the request context. Tokens bound to a device key must use the
+// DPoP scheme and come with a proof verified by WithDPoP; other tokens use Bearer.
+func RequireSession(sessions services.SessionService, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization := r.Header.Get("Authorization")
+		token, dpop := strings.CutPrefix(authorization, "DPoP ")
+		if !dpop {
+			var ok bool
+			if token, ok = strings.CutPrefix(authorization, "Bearer "); !ok {
+				token = ""
+			}
+		}
+		if token == "" {
+			sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Missing bearer token")
+			return
+		}
+
+		session, err := sessions.ValidateSession(r.Context(), token)
+		if errors.Is(err, services.ErrInvalidDPoPProof) || errors.Is(err, services.ErrDPoPProofRequired) {
+			sendDPoPError(w, err)
+			return
+		}
+		if err != nil || session == nil {
+			sendError(w, http.StatusUnauthorized, "UNAUTHORIZED", "Invalid or expired session")
+			return
+		}
+		if session.KeyThumbprint != "" && !dpop {
+			sendDPoPError(w, services.ErrDPoPProofRequired)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(sessionContext(r.Context(), session)))
+	})
+}
+
+// sessionContext stores the session, device and user IDs of an authenticated request
+func sessionContext(ctx context.Context, session *models.Session) context.Context {
+	ctx = services.ContextWithSessionID(ctx, session.ID)
+	if session.DeviceID != nil {
+		ctx = services.ContextWithDeviceID(ctx, *session.DeviceID)
+	}
+	return context.WithValue(ctx, userContextKey{}, session.UserID)
+}
+
+// WithDPoP verifies the DPoP proof a request carries in its DPoP header and stores it in
+// the request context, where logins bind new sessions to its key and RequireSession
+// checks it against bound tokens. publicURL is the scheme and host clients use to reach
+// the server, which the htu claim of proofs must name. Requests without a proof pass
+// through unchanged.
+func WithDPoP(dpop services.DPoPService, publicURL string, next http.Handler) http.Handler {
+	publicURL = strings.TrimSuffix(publicURL, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proofs := r.Header.Values("DPoP")
+		if len(proofs) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(proofs) > 1 {
+			sendDPoPError(w, services.ErrInvalidDPoPProof)
+			return
+		}
+
+		proof, err := dpop.VerifyProof(r.Context(), proofs[0], r.Method, publicURL+r.URL.Path)
+		if err != nil {
+			if errors.Is(err, services.ErrInvalidDPoPProof) {
+				sendDPoPError(w, err)
+				return
+			}
+			log.Printf("Failed to verify DPoP proof: %v", err)
+			sendError(w, http.StatusInternalServerError, "INTERNAL_ERROR", "Internal server error")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(services.ContextWithDPoPProof(r.Context(), proof)))
+	})
+}
+
+// sendDPoPError refuses a request whose DPoP proof is missing or invalid, telling the
+// client in the WWW-Authenticate header as RFC 9449 describes
+func sendDPoPError(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `DPoP algs="ES256 EdDSA", error="invalid_dpop_proof"`)
+	sendError(w, http.StatusUnauthorized, "INVALID_DPOP_PROOF", err.Error())
+}
+
+// WithClientIP stores the client's IP address in the request context for brute-force
+// protection. It uses the connection's remote address; a reverse proxy in front of the
+// server must be configured to preserve it.
+func WithClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		next.ServeHTTP(w, r.WithContext(services.ContextWithClientIP(r.Context(), ip)))
+	})
+}
+
+// UserIDFromContext returns the authenticated user's ID, or uuid.Nil
+func UserIDFromContext(ctx context.Context) uuid.UUID {
+	if userID, ok := ctx.Value(userContextKey{}).(uuid.UUID); ok {
+		return userID
+	}
+	return uuid.Nil
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// PasskeyHandler serves passkey management, passwordless login and admin passkey revocation
+type PasskeyHandler struct {
+	passkeys services.PasskeyService
+	sessions services.SessionService
+}
+
+func NewPasskeyHandler(passkeys services.PasskeyService, sessions services.SessionService) *PasskeyHandler {
+	return &PasskeyHandler{
+		passkeys: passkeys,
+		sessions: sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	GET    /api/auth/passkeys
+//	POST   /api/auth/passkeys/register/begin
+//	POST   /api/auth/passkeys/register/finish
+//	PUT    /api/auth/passkeys/{passkeyId}/user-key
+//	DELETE /api/auth/passkeys/{passkeyId}
+//	POST   /api/auth/passkeys/login
+//	POST   /api/auth/passkeys/login/{challengeId}
+//	GET    /api/passkeys/organizations/{orgId}/members/{userId}
+//	DELETE /api/passkeys/organizations/{orgId}/members/{userId}/{passkeyId}
+func (h *PasskeyHandler) RegisterRoutes(mux *http.ServeMux) {
+	own := RequireSession(h.sessions, http.HandlerFunc(h.routeOwn))
+	mux.Handle("/api/auth/passkeys", own)
+	mux.Handle("/api/auth/passkeys/", own)
+	mux.HandleFunc("/api/auth/passkeys/login", h.routeLogin)
+	mux.HandleFunc("/api/auth/passkeys/login/", h.routeLogin)
+	mux.Handle("/api/passkeys/", RequireSession(h.sessions, http.HandlerFunc(h.routeAdmin)))
+}
+
+func (h *PasskeyHandler) routeOwn(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/auth/passkeys")
+
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		h.listPasskeys(w, r)
+	case len(segments) == 2 && segments[0] == "register" && segments[1] == "begin" && r.Method == http.MethodPost:
+		h.beginRegistration(w, r)
+	case len(segments) == 2 && segments[0] == "register" && segments[1] == "finish" && r.Method == http.MethodPost:
+		h.finishRegistration(w, r)
+	case len(segments) == 2 && segments[1] == "user-key" && r.Method == http.MethodPut:
+		passkeyID, err := uuid.Parse(segments[0])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		h.updateUserKey(w, r, passkeyID)
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		passkeyID, err := uuid.Parse(segments[0])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		h.removePasskey(w, r, passkeyID)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *PasskeyHandler) listPasskeys(w http.ResponseWriter, r *http.Request) {
+	passkeys, err := h.passkeys.ListPasskeys(r.Context(), UserIDFromContext(r.Context()))
+	if err != nil {
+		sendPasskeyError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: passkeys})
+}
+
+func (h *PasskeyHandler) beginRegistration(w http.ResponseWriter, r *http.Request) {
+	options, err := h.passkeys.BeginRegistration(r.Context(), UserIDFromContext(r.Context()))
+	if err != nil {
+		sendPasskeyError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: options})
+}
+
+func (h *PasskeyHandler) finishRegistration(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name             string          `json:"name"`
+		Credential       json.RawMessage `json:"credential"`
+		EncryptedUserKey string          `json:"encrypted_user_key"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	passkey, err := h.passkeys.FinishRegistration(r.Context(), UserIDFromContext(r.Context()), req.Name, req.Credential, req.EncryptedUserKey)
+	if err != nil {
+		sendPasskeyError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, Response{Success: true, Data: passkey})
+}
+
+func (h *PasskeyHandler) updateUserKey(w http.ResponseWriter, r *http.Request, passkeyID uuid.UUID) {
+	var req struct {
+		EncryptedUserKey string `json:"encrypted_user_key"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if err := h.passkeys.UpdatePasskeyUserKey(r.Context(), UserIDFromContext(r.Context()), passkeyID, req.EncryptedUserKey); err != nil {
+		sendPasskeyError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *PasskeyHandler) removePasskey(w http.ResponseWriter, r *http.Request, passkeyID uuid.UUID) {
+	if err := h.passkeys.RemovePasskey(r.Context(), UserIDFromContext(r.Context()), passkeyID); err != nil {
+		sendPasskeyError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *PasskeyHandler) routeLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+
+	segments := pathSegments(r, "/api/auth/passkeys/login")
+	switch len(segments) {
+	case 0:
+		challenge, err := h.passkeys.BeginLogin(r.Context())
+		if err != nil {
+			sendPasskeyError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: challenge})
+	case 1:
+		h.finishLogin(w, r, segments[0])
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *PasskeyHandler) finishLogin(w http.ResponseWriter, r *http.Request, challengeID string) {
+	var req struct {
+		Credential json.RawMessage `json:"credential"`
+		DeviceID   uuid.UUID       `json:"device_id"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	result, err := h.passkeys.FinishLogin(r.Context(), challengeID, req.Credential, req.DeviceID)
+	if err != nil {
+		sendPasskeyError(w, err)
+		return
+	}
+
+	session, err := h.sessions.CreateSession(r.Context(), result.User.ID, req.DeviceID, r.UserAgent())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"token":              session.Token,
+			"expires_at":         session.ExpiresAt,
+			"passkey_id":         result.PasskeyID,
+			"encrypted_user_key": result.EncryptedUserKey,
+		},
+	})
+}
+
+func (h *PasskeyHandler) routeAdmin(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/passkeys/")
+	if len(segments) < 4 || segments[0] != "organizations" || segments[2] != "members" {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+
+	orgID, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	memberID, err := uuid.Parse(segments[3])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	adminID := UserIDFromContext(r.Context())
+
+	switch {
+	case len(segments) == 4 && r.Method == http.MethodGet:
+		passkeys, err := h.passkeys.ListMemberPasskeys(r.Context(), orgID, adminID, memberID)
+		if err != nil {
+			sendPasskeyError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: passkeys})
+	case len(segments) == 5 && r.Method == http.MethodDelete:
+		passkeyID, err := uuid.Parse(segments[4])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		if err := h.passkeys.RevokeMemberPasskey(r.Context(), orgID, adminID, memberID, passkeyID); err != nil {
+			sendPasskeyError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func sendPasskeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrPasskeyNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrPasskeyChallengeNotFound), errors.Is(err, services.ErrPasskeyRegistrationExpired):
+		sendError(w, http.StatusGone, "CHALLENGE_EXPIRED", err.Error())
+	case errors.Is(err, services.ErrInvalidWebAuthnResponse), errors.Is(err, services.ErrWebAuthnCloneDetected):
+		sendError(w, http.StatusUnauthorized, "INVALID_PASSKEY", err.Error())
+	case errors.Is(err, services.ErrPasskeysUnavailable):
+		sendError(w, http.StatusNotImplemented, "PASSKEYS_UNAVAILABLE", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// PermissionHandler lists the permissions roles can grant
+type PermissionHandler struct {
+	service  services.Service
+	sessions services.SessionService
+}
+
+func NewPermissionHandler(service services.Service, sessions services.SessionService) *PermissionHandler {
+	return &PermissionHandler{
+		service:  service,
+		sessions: sessions,
+	}
+}
+
+// permissionResponse is a permission as returned to clients choosing a role's permissions
+type permissionResponse struct {
+	ID          uuid.UUID `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+}
+
+// RegisterRoutes registers:
+//
+//	GET    /api/permissions
+func (h *PermissionHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/api/permissions", RequireSession(h.sessions, http.HandlerFunc(h.list)))
+}
+
+func (h *PermissionHandler) list(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+
+	permissions, err := h.service.ListPermissions(r.Context())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+
+	data := make([]permissionResponse, 0, len(permissions))
+	for _, permission := range permissions {
+		data = append(data, permissionResponse{
+			ID:          permission.ID,
+			Name:        permission.Name,
+			Description: permission.Description,
+		})
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: data})
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// RecoveryHandler serves the organization recovery key ceremony endpoints
+type RecoveryHandler struct {
+	recovery services.OrganizationRecoveryService
+	sessions services.SessionService
+}
+
+func NewRecoveryHandler(recovery services.OrganizationRecoveryService, sessions services.SessionService) *RecoveryHandler {
+	return &RecoveryHandler{
+		recovery: recovery,
+		sessions: sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	GET|POST|DELETE /api/recovery/organizations/{orgId}/key
+//	POST            /api/recovery/organizations/{orgId}/sessions
+//	GET|DELETE      /api/recovery/sessions/{sessionId}
+//	GET             /api/recovery/sessions/{sessionId}/share
+//	POST            /api/recovery/sessions/{sessionId}/shares
+//	POST            /api/recovery/sessions/{sessionId}/restore
+func (h *RecoveryHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.Handle("/api/recovery/", RequireSession(h.sessions, http.HandlerFunc(h.route)))
+}
+
+func (h *RecoveryHandler) route(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/recovery/")
+	if len(segments) < 2 {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+
+	id, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+
+	switch {
+	case len(segments) == 3 && segments[0] == "organizations" && segments[2] == "key":
+		switch r.Method {
+		case http.MethodGet:
+			h.getRecoveryKey(w, r, id)
+		case http.MethodPost:
+			h.setupRecoveryKey(w, r, id)
+		case http.MethodDelete:
+			h.disableRecoveryKey(w, r, id)
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case len(segments) == 3 && segments[0] == "organizations" && segments[2] == "sessions" && r.Method == http.MethodPost:
+		h.startRecovery(w, r, id)
+	case len(segments) == 2 && segments[0] == "sessions":
+		switch r.Method {
+		case http.MethodGet:
+			h.getRecoverySession(w, r, id)
+		case http.MethodDelete:
+			h.closeRecoverySession(w, r, id)
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+	case len(segments) == 3 && segments[0] == "sessions" && segments[2] == "share" && r.Method == http.MethodGet:
+		h.getCustodianShare(w, r, id)
+	case len(segments) == 3 && segments[0] == "sessions" && segments[2] == "shares" && r.Method == http.MethodPost:
+		h.submitShare(w, r, id)
+	case len(segments) == 3 && segments[0] == "sessions" && segments[2] == "restore" && r.Method == http.MethodPost:
+		h.restoreAccess(w, r, id)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *RecoveryHandler) getRecoveryKey(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	key, err := h.recovery.GetRecoveryKey(r.Context(), orgID, UserIDFromContext(r.Context()))
+	if err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: key})
+}
+
+func (h *RecoveryHandler) setupRecoveryKey(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	var req struct {
+		Threshold    int         `json:"threshold"`
+		CustodianIDs []uuid.UUID `json:"custodian_ids"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	key, err := h.recovery.SetupRecoveryKey(r.Context(), orgID, UserIDFromContext(r.Context()), req.Threshold, req.CustodianIDs)
+	if err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, Response{Success: true, Data: key})
+}
+
+func (h *RecoveryHandler) disableRecoveryKey(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	if err := h.recovery.DisableRecoveryKey(r.Context(), orgID, UserIDFromContext(r.Context())); err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *RecoveryHandler) startRecovery(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	session, err := h.recovery.StartRecovery(r.Context(), orgID, UserIDFromContext(r.Context()))
+	if err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusCreated, Response{Success: true, Data: session})
+}
+
+func (h *RecoveryHandler) getRecoverySession(w http.ResponseWriter, r *http.Request, sessionID uuid.UUID) {
+	session, err := h.recovery.GetRecoverySession(r.Context(), sessionID, UserIDFromContext(r.Context()))
+	if err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: session})
+}
+
+func (h *RecoveryHandler) closeRecoverySession(w http.ResponseWriter, r *http.Request, sessionID uuid.UUID) {
+	if err := h.recovery.CloseRecoverySession(r.Context(), sessionID, UserIDFromContext(r.Context())); err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *RecoveryHandler) getCustodianShare(w http.ResponseWriter, r *http.Request, sessionID uuid.UUID) {
+	share, err := h.recovery.GetCustodianShare(r.Context(), sessionID, UserIDFromContext(r.Context()))
+	if err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data:    map[string]string{"encrypted_share": share},
+	})
+}
+
+func (h *RecoveryHandler) submitShare(w http.ResponseWriter, r *http.Request, sessionID uuid.UUID) {
+	var req struct {
+		Share string `json:"share"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	session, err := h.recovery.SubmitRecoveryShare(r.Context(), sessionID, UserIDFromContext(r.Context()), req.Share)
+	if err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: session})
+}
+
+func (h *RecoveryHandler) restoreAccess(w http.ResponseWriter, r *http.Request, sessionID uuid.UUID) {
+	var req struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if err := h.recovery.RestoreOrganizationAccess(r.Context(), sessionID, UserIDFromContext(r.Context()), req.UserID); err != nil {
+		sendRecoveryError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func sendRecoveryError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrRecoveryKeyNotFound), errors.Is(err, services.ErrRecoverySessionNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrRecoverySessionInProgress):
+		sendError(w, http.StatusConflict, "RECOVERY_IN_PROGRESS", err.Error())
+	case errors.Is(err, services.ErrRecoverySessionExpired):
+		sendError(w, http.StatusGone, "RECOVERY_EXPIRED", err.Error())
+	case errors.Is(err, services.ErrRecoverySessionLocked):
+		sendError(w, http.StatusConflict, "RECOVERY_LOCKED", err.Error())
+	case errors.Is(err, services.ErrRecoveryShareSubmitted):
+		sendError(w, http.StatusConflict, "SHARE_ALREADY_SUBMITTED", err.Error())
+	case errors.Is(err, services.ErrCustodianKeyNotFound):
+		sendError(w, http.StatusBadRequest, "CUSTODIAN_KEY_NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrInvalidRecoveryShare), errors.Is(err, services.ErrInvalidShareCount):
+		sendError(w, http.StatusBadRequest, "INVALID_SHARE", err.Error())
+	case errors.Is(err, services.ErrRecoveryVerificationFailed):
+		sendError(w, http.StatusUnprocessableEntity, "RECOVERY_VERIFICATION_FAILED", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
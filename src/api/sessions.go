@@ -0,0 +1,131 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// SessionHandler serves the user's active sessions and admin session revocation
+type SessionHandler struct {
+	sessions services.SessionService
+}
+
+func NewSessionHandler(sessions services.SessionService) *SessionHandler {
+	return &SessionHandler{sessions: sessions}
+}
+
+// RegisterRoutes registers:
+//
+//	GET    /api/auth/sessions
+//	DELETE /api/auth/sessions
+//	DELETE /api/auth/sessions/current
+//	DELETE /api/auth/sessions/{sessionId}
+//	GET    /api/sessions/organizations/{orgId}/members/{userId}
+//	DELETE /api/sessions/organizations/{orgId}/members/{userId}
+//	DELETE /api/sessions/organizations/{orgId}/members/{userId}/{sessionId}
+func (h *SessionHandler) RegisterRoutes(mux *http.ServeMux) {
+	own := RequireSession(h.sessions, http.HandlerFunc(h.routeOwn))
+	mux.Handle("/api/auth/sessions", own)
+	mux.Handle("/api/auth/sessions/", own)
+	mux.Handle("/api/sessions/", RequireSession(h.sessions, http.HandlerFunc(h.routeAdmin)))
+}
+
+func (h *SessionHandler) routeOwn(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/auth/sessions")
+	userID := UserIDFromContext(r.Context())
+	currentID := services.SessionIDFromContext(r.Context())
+
+	switch {
+	case len(segments) == 0 && r.Method == http.MethodGet:
+		sessions, err := h.sessions.ListSessions(r.Context(), userID, currentID)
+		if err != nil {
+			sendSessionError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: sessions})
+	case len(segments) == 0 && r.Method == http.MethodDelete:
+		// Sign out every other session
+		if err := h.sessions.RevokeOtherSessions(r.Context(), userID, currentID); err != nil {
+			sendSessionError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		sessionID := currentID
+		if segments[0] != "current" {
+			var err error
+			if sessionID, err = uuid.Parse(segments[0]); err != nil {
+				sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+				return
+			}
+		}
+		if err := h.sessions.RevokeUserSession(r.Context(), userID, sessionID); err != nil {
+			sendSessionError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *SessionHandler) routeAdmin(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/sessions/")
+	if len(segments) < 4 || segments[0] != "organizations" || segments[2] != "members" {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+
+	orgID, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	memberID, err := uuid.Parse(segments[3])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	adminID := UserIDFromContext(r.Context())
+
+	switch {
+	case len(segments) == 4 && r.Method == http.MethodGet:
+		sessions, err := h.sessions.ListMemberSessions(r.Context(), orgID, adminID, memberID)
+		if err != nil {
+			sendSessionError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: sessions})
+	case len(segments) == 4 && r.Method == http.MethodDelete:
+		if err := h.sessions.RevokeMemberSessions(r.Context(), orgID, adminID, memberID); err != nil {
+			sendSessionError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	case len(segments) == 5 && r.Method == http.MethodDelete:
+		sessionID, err := uuid.Parse(segments[4])
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+			return
+		}
+		if err := h.sessions.RevokeMemberSession(r.Context(), orgID, adminID, memberID, sessionID); err != nil {
+			sendSessionError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func sendSessionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrSessionNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
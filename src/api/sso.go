@@ -0,0 +1,305 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// SSOHandler serves organization SSO configuration and single sign-on login
+type SSOHandler struct {
+	sso      services.SSOService
+	sessions services.SessionService
+}
+
+func NewSSOHandler(sso services.SSOService, sessions services.SessionService) *SSOHandler {
+	return &SSOHandler{
+		sso:      sso,
+		sessions: sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	GET    /api/sso/organizations/{orgId}/config
+//	PUT    /api/sso/organizations/{orgId}/config
+//	POST   /api/sso/organizations/{orgId}/config/preview
+//	GET    /api/sso/organizations/{orgId}/login?device_id={deviceId}
+//	GET    /api/sso/organizations/{orgId}/callback
+//	GET    /api/sso/organizations/{orgId}/saml/metadata
+//	GET    /api/sso/organizations/{orgId}/saml/login?device_id={deviceId}
+//	POST   /api/sso/organizations/{orgId}/saml/acs
+func (h *SSOHandler) RegisterRoutes(mux *http.ServeMux) {
+	config := RequireSession(h.sessions, http.HandlerFunc(h.routeConfig))
+	mux.Handle("/api/sso/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		segments := pathSegments(r, "/api/sso/")
+		if len(segments) >= 3 && segments[2] == "config" {
+			config.ServeHTTP(w, r)
+			return
+		}
+		if len(segments) == 4 && segments[2] == "saml" {
+			h.routeSAML(w, r)
+			return
+		}
+		h.routeLogin(w, r)
+	}))
+}
+
+func (h *SSOHandler) routeConfig(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/sso/")
+	if len(segments) < 3 || len(segments) > 4 || segments[0] != "organizations" {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+	orgID, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+	adminID := UserIDFromContext(r.Context())
+
+	if len(segments) == 4 {
+		if segments[3] != "preview" || r.Method != http.MethodPost {
+			sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+			return
+		}
+		h.previewMapping(w, r, orgID, adminID)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		config, err := h.sso.GetSSOConfig(r.Context(), orgID, adminID)
+		if err != nil {
+			sendSSOError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: config})
+	case http.MethodPut:
+		var config services.SSOConfig
+		if err := decodeJSON(r, &config); err != nil {
+			sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+			return
+		}
+		if err := h.sso.ConfigureSSO(r.Context(), orgID, adminID, config); err != nil {
+			sendSSOError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true})
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+	}
+}
+
+// previewMapping evaluates the mapping rules in the body, or the stored ones, against
+// sample claims
+func (h *SSOHandler) previewMapping(w http.ResponseWriter, r *http.Request, orgID, adminID uuid.UUID) {
+	var req struct {
+		Provisioning *services.SSOProvisioning `json:"provisioning"`
+		Claims       map[string]interface{}    `json:"claims"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	result, err := h.sso.PreviewSSOMapping(r.Context(), orgID, adminID, req.Provisioning, req.Claims)
+	if err != nil {
+		sendSSOError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: result})
+}
+
+func (h *SSOHandler) routeLogin(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/sso/")
+	if len(segments) != 3 || segments[0] != "organizations" || r.Method != http.MethodGet {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+	orgID, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+
+	switch segments[2] {
+	case "login":
+		h.login(w, r, orgID)
+	case "callback":
+		h.callback(w, r, orgID)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+// login redirects the browser to the organization's identity provider
+func (h *SSOHandler) login(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	deviceID, ok := ssoDeviceID(w, r)
+	if !ok {
+		return
+	}
+	url, err := h.sso.InitiateSSO(r.Context(), orgID, services.SSOProviderOIDC, deviceID)
+	if err != nil {
+		sendSSOError(w, err)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+func (h *SSOHandler) callback(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	query := r.URL.Query()
+	if providerError := query.Get("error"); providerError != "" {
+		sendError(w, http.StatusUnauthorized, "SSO_FAILED", "Identity provider returned "+providerError)
+		return
+	}
+
+	result, err := h.sso.HandleCallback(r.Context(), orgID, query.Get("state"), query.Get("code"))
+	if err != nil {
+		sendSSOError(w, err)
+		return
+	}
+
+	// The session belongs to the organization, whose admins may sign it out
+	ctx := services.ContextWithSessionOrganization(r.Context(), orgID)
+	session, err := h.sessions.CreateSession(ctx, result.User.ID, result.DeviceID, r.UserAgent())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"token":      session.Token,
+			"expires_at": session.ExpiresAt,
+		},
+	})
+}
+
+func (h *SSOHandler) routeSAML(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/sso/")
+	if segments[0] != "organizations" {
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+		return
+	}
+	orgID, err := uuid.Parse(segments[1])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+
+	switch {
+	case segments[3] == "metadata" && r.Method == http.MethodGet:
+		h.samlMetadata(w, r, orgID)
+	case segments[3] == "login" && r.Method == http.MethodGet:
+		h.samlLogin(w, r, orgID)
+	case segments[3] == "acs" && r.Method == http.MethodPost:
+		h.samlACS(w, r, orgID)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *SSOHandler) samlMetadata(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	metadata, err := h.sso.GetSAMLMetadata(r.Context(), orgID)
+	if err != nil {
+		sendSSOError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(metadata)
+}
+
+// samlLogin sends a signed AuthnRequest to the identity provider, by redirect or, with
+// ?binding=post, by a self-submitting form
+func (h *SSOHandler) samlLogin(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	deviceID, ok := ssoDeviceID(w, r)
+	if !ok {
+		return
+	}
+	if r.URL.Query().Get("binding") == "post" {
+		form, err := h.sso.InitiateSAMLPost(r.Context(), orgID, deviceID)
+		if err != nil {
+			sendSSOError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		w.Write(form)
+		return
+	}
+
+	url, err := h.sso.InitiateSSO(r.Context(), orgID, services.SSOProviderSAML, deviceID)
+	if err != nil {
+		sendSSOError(w, err)
+		return
+	}
+	http.Redirect(w, r, url, http.StatusFound)
+}
+
+// samlACS is the assertion consumer service the identity provider posts its response to
+func (h *SSOHandler) samlACS(w http.ResponseWriter, r *http.Request, orgID uuid.UUID) {
+	if err := r.ParseForm(); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid form body")
+		return
+	}
+
+	result, err := h.sso.HandleSAMLResponse(r.Context(), orgID, r.PostForm.Get("SAMLResponse"), r.PostForm.Get("RelayState"))
+	if err != nil {
+		sendSSOError(w, err)
+		return
+	}
+
+	// The session belongs to the organization, whose admins may sign it out
+	ctx := services.ContextWithSessionOrganization(r.Context(), orgID)
+	session, err := h.sessions.CreateSession(ctx, result.User.ID, result.DeviceID, r.UserAgent())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"token":      session.Token,
+			"expires_at": session.ExpiresAt,
+		},
+	})
+}
+
+// ssoDeviceID reads the optional device_id the login is started for
+func ssoDeviceID(w http.ResponseWriter, r *http.Request) (uuid.UUID, bool) {
+	value := r.URL.Query().Get("device_id")
+	if value == "" {
+		return uuid.Nil, true
+	}
+	deviceID, err := uuid.Parse(value)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid device ID")
+		return uuid.Nil, false
+	}
+	return deviceID, true
+}
+
+func sendSSOError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrSSONotConfigured):
+		sendError(w, http.StatusNotFound, "SSO_NOT_CONFIGURED", err.Error())
+	case errors.Is(err, services.ErrSSOStateNotFound):
+		sendError(w, http.StatusGone, "SSO_EXPIRED", err.Error())
+	case errors.Is(err, services.ErrSSOUserNotFound):
+		sendError(w, http.StatusForbidden, "SSO_USER_NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrInvalidIDToken), errors.Is(err, services.ErrOIDCExchangeFailed),
+		errors.Is(err, services.ErrInvalidSAMLResponse), errors.Is(err, services.ErrSAMLAssertionReplayed):
+		sendError(w, http.StatusUnauthorized, "SSO_FAILED", err.Error())
+	case errors.Is(err, services.ErrInvalidOIDCDiscovery), errors.Is(err, services.ErrInvalidSAMLMetadata):
+		sendError(w, http.StatusBadGateway, "SSO_PROVIDER_ERROR", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// TwoFactorRecoveryHandler serves recovery code management and the recovery code login
+type TwoFactorRecoveryHandler struct {
+	recovery services.TwoFactorRecoveryService
+	sessions services.SessionService
+}
+
+func NewTwoFactorRecoveryHandler(recovery services.TwoFactorRecoveryService, sessions services.SessionService) *TwoFactorRecoveryHandler {
+	return &TwoFactorRecoveryHandler{
+		recovery: recovery,
+		sessions: sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	POST     /api/auth/2fa/recovery
+//	GET|POST /api/auth/2fa/recovery-codes
+func (h *TwoFactorRecoveryHandler) RegisterRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/api/auth/2fa/recovery", h.handleRecoveryLogin)
+	mux.Handle("/api/auth/2fa/recovery-codes", RequireSession(h.sessions, http.HandlerFunc(h.handleRecoveryCodes)))
+}
+
+func (h *TwoFactorRecoveryHandler) handleRecoveryLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+
+	var req struct {
+		Email            string    `json:"email"`
+		Password         string    `json:"password"`
+		RecoveryCode     string    `json:"recovery_code"`
+		DeviceID         uuid.UUID `json:"device_id"`
+		DisableTwoFactor bool      `json:"disable_two_factor"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	result, err := h.recovery.LoginWithRecoveryCode(r.Context(), req.Email, req.Password, req.RecoveryCode, req.DeviceID, req.DisableTwoFactor)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrUserNotFound), errors.Is(err, services.ErrInvalidPassword), errors.Is(err, services.ErrInvalidRecoveryCode):
+			sendError(w, http.StatusUnauthorized, "INVALID_CREDENTIALS", "Invalid credentials or recovery code")
+		default:
+			sendServiceError(w, err)
+		}
+		return
+	}
+
+	session, err := h.sessions.CreateSession(r.Context(), result.User.ID, req.DeviceID, r.UserAgent())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"token":               session.Token,
+			"expires_at":          session.ExpiresAt,
+			"remaining_codes":     result.RemainingCodes,
+			"recovery_codes_low":  result.RecoveryCodesLow,
+			"two_factor_disabled": result.TwoFactorDisabled,
+		},
+	})
+}
+
+func (h *TwoFactorRecoveryHandler) handleRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := UserIDFromContext(r.Context())
+
+	switch r.Method {
+	case http.MethodGet:
+		remaining, err := h.recovery.CountRemainingRecoveryCodes(r.Context(), userID)
+		if err != nil {
+			sendServiceError(w, err)
+			return
+		}
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: map[string]int{"remaining_codes": remaining}})
+	case http.MethodPost:
+		codes, err := h.recovery.GenerateRecoveryCodes(r.Context(), userID)
+		if err != nil {
+			sendServiceError(w, err)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: map[string][]string{"recovery_codes": codes}})
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+	}
+}
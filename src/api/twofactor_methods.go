@@ -0,0 +1,283 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// TwoFactorHandler serves two-factor method management and the two-factor login step
+type TwoFactorHandler struct {
+	twoFactor services.TwoFactorService
+	sessions  services.SessionService
+}
+
+func NewTwoFactorHandler(twoFactor services.TwoFactorService, sessions services.SessionService) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		twoFactor: twoFactor,
+		sessions:  sessions,
+	}
+}
+
+// RegisterRoutes registers:
+//
+//	GET|POST     /api/auth/2fa/methods
+//	PATCH|DELETE /api/auth/2fa/methods/{methodId}
+//	POST         /api/auth/2fa/methods/{methodId}/verify
+//	DELETE       /api/auth/2fa/remembered-devices
+//	POST         /api/auth/2fa/login
+//	POST         /api/auth/2fa/login/{challengeId}
+//	POST         /api/auth/2fa/login/{challengeId}/email
+func (h *TwoFactorHandler) RegisterRoutes(mux *http.ServeMux) {
+	methods := RequireSession(h.sessions, http.HandlerFunc(h.routeMethods))
+	mux.Handle("/api/auth/2fa/methods", methods)
+	mux.Handle("/api/auth/2fa/methods/", methods)
+	mux.Handle("/api/auth/2fa/remembered-devices", RequireSession(h.sessions, http.HandlerFunc(h.revokeRememberedDevices)))
+	mux.HandleFunc("/api/auth/2fa/login", h.routeLogin)
+	mux.HandleFunc("/api/auth/2fa/login/", h.routeLogin)
+}
+
+func (h *TwoFactorHandler) routeMethods(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r, "/api/auth/2fa/methods")
+
+	if len(segments) == 0 {
+		switch r.Method {
+		case http.MethodGet:
+			h.listMethods(w, r)
+		case http.MethodPost:
+			h.registerMethod(w, r)
+		default:
+			sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		}
+		return
+	}
+
+	methodID, err := uuid.Parse(segments[0])
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_ID", "Invalid ID")
+		return
+	}
+
+	switch {
+	case len(segments) == 1 && r.Method == http.MethodPatch:
+		h.renameMethod(w, r, methodID)
+	case len(segments) == 1 && r.Method == http.MethodDelete:
+		h.removeMethod(w, r, methodID)
+	case len(segments) == 2 && segments[1] == "verify" && r.Method == http.MethodPost:
+		h.verifyMethod(w, r, methodID)
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *TwoFactorHandler) listMethods(w http.ResponseWriter, r *http.Request) {
+	methods, err := h.twoFactor.ListMethods(r.Context(), UserIDFromContext(r.Context()))
+	if err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: methods})
+}
+
+func (h *TwoFactorHandler) registerMethod(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	enrollment, err := h.twoFactor.RegisterMethod(r.Context(), UserIDFromContext(r.Context()), req.Type, req.Name)
+	if err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	sendJSON(w, http.StatusCreated, Response{Success: true, Data: enrollment})
+}
+
+func (h *TwoFactorHandler) verifyMethod(w http.ResponseWriter, r *http.Request, methodID uuid.UUID) {
+	var req services.TwoFactorResponse
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	method, err := h.twoFactor.VerifyMethod(r.Context(), UserIDFromContext(r.Context()), methodID, req)
+	if err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: method})
+}
+
+func (h *TwoFactorHandler) renameMethod(w http.ResponseWriter, r *http.Request, methodID uuid.UUID) {
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if err := h.twoFactor.RenameMethod(r.Context(), UserIDFromContext(r.Context()), methodID, req.Name); err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *TwoFactorHandler) removeMethod(w http.ResponseWriter, r *http.Request, methodID uuid.UUID) {
+	if err := h.twoFactor.RemoveMethod(r.Context(), UserIDFromContext(r.Context()), methodID); err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *TwoFactorHandler) revokeRememberedDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+
+	if err := h.twoFactor.RevokeRememberedDevices(r.Context(), UserIDFromContext(r.Context())); err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *TwoFactorHandler) routeLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		sendError(w, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+		return
+	}
+
+	segments := pathSegments(r, "/api/auth/2fa/login")
+	switch {
+	case len(segments) == 0:
+		h.startLogin(w, r)
+	case len(segments) == 1:
+		h.completeLogin(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "email":
+		h.sendLoginCode(w, r, segments[0])
+	default:
+		sendError(w, http.StatusNotFound, "NOT_FOUND", "Unknown endpoint")
+	}
+}
+
+func (h *TwoFactorHandler) startLogin(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Email         string    `json:"email"`
+		Password      string    `json:"password"`
+		DeviceID      uuid.UUID `json:"device_id"`
+		RememberToken string    `json:"remember_token"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	challenge, err := h.twoFactor.StartLogin(r.Context(), req.Email, req.Password, req.DeviceID, req.RememberToken)
+	if err != nil {
+		if errors.Is(err, services.ErrUserNotFound) || errors.Is(err, services.ErrInvalidPassword) {
+			sendError(w, http.StatusUnauthorized, "INVALID_CREDENTIALS", "Invalid credentials")
+			return
+		}
+		sendTwoFactorError(w, err)
+		return
+	}
+
+	if !challenge.Remembered {
+		sendJSON(w, http.StatusOK, Response{Success: true, Data: challenge})
+		return
+	}
+
+	// A remembered device skips the second factor
+	session, err := h.sessions.CreateSession(r.Context(), challenge.User.ID, req.DeviceID, r.UserAgent())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"remembered": true,
+			"token":      session.Token,
+			"expires_at": session.ExpiresAt,
+		},
+	})
+}
+
+func (h *TwoFactorHandler) sendLoginCode(w http.ResponseWriter, r *http.Request, challengeID string) {
+	var req struct {
+		MethodID uuid.UUID `json:"method_id"`
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	if err := h.twoFactor.SendLoginCode(r.Context(), challengeID, req.MethodID); err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true})
+}
+
+func (h *TwoFactorHandler) completeLogin(w http.ResponseWriter, r *http.Request, challengeID string) {
+	var req struct {
+		MethodID       uuid.UUID `json:"method_id"`
+		RememberDevice uuid.UUID `json:"remember_device_id"`
+		services.TwoFactorResponse
+	}
+	if err := decodeJSON(r, &req); err != nil {
+		sendError(w, http.StatusBadRequest, "INVALID_REQUEST", "Invalid request body")
+		return
+	}
+
+	result, err := h.twoFactor.CompleteLogin(r.Context(), challengeID, req.MethodID, req.TwoFactorResponse, req.RememberDevice)
+	if err != nil {
+		sendTwoFactorError(w, err)
+		return
+	}
+
+	session, err := h.sessions.CreateSession(r.Context(), result.User.ID, result.DeviceID, r.UserAgent())
+	if err != nil {
+		sendServiceError(w, err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"token":      session.Token,
+		"expires_at": session.ExpiresAt,
+	}
+	if result.RememberToken != "" {
+		w.Header().Set("Cache-Control", "no-store")
+		data["remember_token"] = result.RememberToken
+		data["remember_expires_at"] = result.RememberExpiresAt
+	}
+	sendJSON(w, http.StatusOK, Response{Success: true, Data: data})
+}
+
+func sendTwoFactorError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, services.ErrTwoFactorMethodNotFound):
+		sendError(w, http.StatusNotFound, "NOT_FOUND", err.Error())
+	case errors.Is(err, services.ErrTwoFactorChallengeNotFound), errors.Is(err, services.ErrTwoFactorRegistrationExpired):
+		sendError(w, http.StatusGone, "CHALLENGE_EXPIRED", err.Error())
+	case errors.Is(err, services.ErrInvalidTwoFactorCode), errors.Is(err, services.ErrInvalidWebAuthnResponse), errors.Is(err, services.ErrWebAuthnCloneDetected):
+		sendError(w, http.StatusUnauthorized, "INVALID_TWO_FACTOR", err.Error())
+	case errors.Is(err, services.ErrPhishingResistantRequired):
+		sendError(w, http.StatusForbidden, "PHISHING_RESISTANT_REQUIRED", err.Error())
+	case errors.Is(err, services.ErrUnsupportedTwoFactorMethod):
+		sendError(w, http.StatusBadRequest, "UNSUPPORTED_METHOD", err.Error())
+	default:
+		sendServiceError(w, err)
+	}
+}
@@ -0,0 +1,146 @@
+package api
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+)
+
+// wsMaxFrameSize bounds the frames clients may send; the hub only expects control frames
+const wsMaxFrameSize = 4096
+
+// wsAcceptGUID is appended to the client's key to prove the server speaks WebSocket
+const wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var (
+	errWebSocketHandshake = errors.New("invalid websocket handshake")
+	errWebSocketOrigin    = errors.New("websocket origin not allowed")
+	errWebSocketFrame     = errors.New("invalid websocket frame")
+)
+
+// isWebSocketUpgrade reports whether the request asks to switch to WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// upgradeWebSocket completes the opening handshake and takes over the connection.
+// Browsers must connect from allowedOrigin, the scheme and host of the web vault;
+// clients that send no Origin are not browsers and are let through. Deadlines set by
+// the server are cleared; the caller manages its own. Only errWebSocketHandshake and
+// errWebSocketOrigin leave the response writer usable.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, allowedOrigin string) (net.Conn, *bufio.ReadWriter, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, nil, errWebSocketHandshake
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !strings.EqualFold(origin, strings.TrimSuffix(allowedOrigin, "/")) {
+		return nil, nil, errWebSocketOrigin
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, rw, nil
+}
+
+// writeWebSocketFrame writes one unfragmented, unmasked frame as servers send them
+func writeWebSocketFrame(w *bufio.Writer, opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode}
+	switch length := len(payload); {
+	case length < 126:
+		header = append(header, byte(length))
+	case length <= 0xFFFF:
+		header = append(header, 126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readWebSocketFrame reads one frame from the client and returns its opcode and
+// unmasked payload. The hub expects no fragmented messages, so frames must be final,
+// and like all client frames they must be masked.
+func readWebSocketFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	// FIN set, no extension bits and not a continuation
+	opcode := header[0] & 0x0F
+	if header[0]&0xF0 != 0x80 || opcode == 0 {
+		return 0, nil, errWebSocketFrame
+	}
+	if header[1]&0x80 == 0 {
+		return 0, nil, errWebSocketFrame
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var extended [2]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		if _, err := io.ReadFull(r, extended[:]); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if length > wsMaxFrameSize {
+		return 0, nil, errWebSocketFrame
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
@@ -0,0 +1,234 @@
+// Package keyconnector is a self-hosted service that holds the user keys of members
+// who sign in with SSO and have no master password. Clients authenticate with
+// short-lived tokens issued by the PasswordImmunity server; the connector verifies them
+// against the server's published keys and never sees a session.
+package keyconnector
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/google/uuid"
+)
+
+// tokenUse is the token_use claim the server puts in key connector tokens
+const tokenUse = "key_connector"
+
+// maxKeySize bounds the user key a client may store
+const maxKeySize = 16 << 10
+
+// Config configures a key connector
+type Config struct {
+	// Issuer is the PasswordImmunity server's public URL
+	Issuer string
+	// Audience is this connector's public URL, as set in the key_connector policy
+	Audience string
+	// JWKSURL is where the server publishes its token signing keys
+	JWKSURL string
+	// WrappingKey is the 32-byte AES key user keys are encrypted with at rest
+	WrappingKey []byte
+	Store       Store
+	// Client fetches the signing keys; http.DefaultClient is used if nil
+	Client *http.Client
+}
+
+// Server serves the key connector API
+type Server struct {
+	store    Store
+	aead     cipher.AEAD
+	verifier *oidc.IDTokenVerifier
+
+	// Writes for one user are serialized so a create can't race a rotation
+	mu sync.Mutex
+}
+
+func NewServer(config Config) (*Server, error) {
+	if config.Issuer == "" || config.Audience == "" || config.JWKSURL == "" {
+		return nil, errors.New("issuer, audience and JWKS URL are required")
+	}
+	if len(config.WrappingKey) != 32 {
+		return nil, errors.New("wrapping key must be 32 bytes")
+	}
+	if config.Store == nil {
+		return nil, errors.New("store is required")
+	}
+
+	block, err := aes.NewCipher(config.WrappingKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	if config.Client != nil {
+		ctx = oidc.ClientContext(ctx, config.Client)
+	}
+	keys := oidc.NewRemoteKeySet(ctx, config.JWKSURL)
+	verifier := oidc.NewVerifier(config.Issuer, keys, &oidc.Config{
+		ClientID:             config.Audience,
+		SupportedSigningAlgs: []string{oidc.ES256},
+	})
+
+	return &Server{
+		store:    config.Store,
+		aead:     aead,
+		verifier: verifier,
+	}, nil
+}
+
+// Handler serves:
+//
+//	GET  /user-keys
+//	POST /user-keys
+//	PUT  /user-keys
+//	GET  /health
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		sendJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/user-keys", s.handleUserKeys)
+	return mux
+}
+
+type userKeyRequest struct {
+	Key string `json:"key"`
+}
+
+func (s *Server) handleUserKeys(w http.ResponseWriter, r *http.Request) {
+	userID, err := s.authenticate(r)
+	if err != nil {
+		log.Printf("Key connector rejected token from %s: %v", r.RemoteAddr, err)
+		sendError(w, http.StatusUnauthorized, "Invalid token")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		key, err := s.getKey(r.Context(), userID)
+		if errors.Is(err, ErrKeyNotFound) {
+			sendError(w, http.StatusNotFound, "No key stored for this user")
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to read key for user %s: %v", userID, err)
+			sendError(w, http.StatusInternalServerError, "Internal server error")
+			return
+		}
+		log.Printf("Key read for user %s", userID)
+		sendJSON(w, http.StatusOK, userKeyRequest{Key: key})
+	case http.MethodPost, http.MethodPut:
+		var req userKeyRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxKeySize)).Decode(&req); err != nil || req.Key == "" {
+			sendError(w, http.StatusBadRequest, "Invalid request body")
+			return
+		}
+		// POST stores the key of a user who is migrating; PUT replaces it after a key
+		// rotation
+		err := s.putKey(r.Context(), userID, req.Key, r.Method == http.MethodPut)
+		switch {
+		case errors.Is(err, errKeyExists):
+			sendError(w, http.StatusConflict, "A key is already stored for this user")
+		case errors.Is(err, ErrKeyNotFound):
+			sendError(w, http.StatusNotFound, "No key stored for this user")
+		case err != nil:
+			log.Printf("Failed to store key for user %s: %v", userID, err)
+			sendError(w, http.StatusInternalServerError, "Internal server error")
+		default:
+			log.Printf("Key stored for user %s", userID)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		sendError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	}
+}
+
+// authenticate verifies the bearer token and returns the user it was issued for
+func (s *Server) authenticate(r *http.Request) (uuid.UUID, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return uuid.Nil, errors.New("missing bearer token")
+	}
+	token, err := s.verifier.Verify(r.Context(), raw)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	var claims struct {
+		TokenUse string `json:"token_use"`
+	}
+	if err := token.Claims(&claims); err != nil {
+		return uuid.Nil, err
+	}
+	if claims.TokenUse != tokenUse {
+		return uuid.Nil, fmt.Errorf("unexpected token use %q", claims.TokenUse)
+	}
+	return uuid.Parse(token.Subject)
+}
+
+var errKeyExists = errors.New("user key already exists")
+
+func (s *Server) getKey(ctx context.Context, userID uuid.UUID) (string, error) {
+	wrapped, err := s.store.Get(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+	size := s.aead.NonceSize()
+	if len(wrapped) < size {
+		return "", errors.New("stored key is corrupt")
+	}
+	key, err := s.aead.Open(nil, wrapped[:size], wrapped[size:], userID[:])
+	if err != nil {
+		return "", err
+	}
+	return string(key), nil
+}
+
+func (s *Server) putKey(ctx context.Context, userID uuid.UUID, key string, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.store.Get(ctx, userID)
+	exists := err == nil
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	if replace && !exists {
+		return ErrKeyNotFound
+	}
+	if !replace && exists {
+		return errKeyExists
+	}
+
+	// The user ID is bound as additional data so keys can't be swapped between files
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	wrapped := s.aead.Seal(nonce, nonce, []byte(key), userID[:])
+	return s.store.Put(ctx, userID, wrapped)
+}
+
+func sendJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(data)
+}
+
+func sendError(w http.ResponseWriter, status int, message string) {
+	sendJSON(w, status, map[string]string{"error": message})
+}
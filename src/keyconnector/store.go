@@ -0,0 +1,93 @@
+package keyconnector
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ErrKeyNotFound is returned by stores that hold no key for the user
+var ErrKeyNotFound = errors.New("user key not found")
+
+// Store persists wrapped user keys. Keys are encrypted before they reach the store.
+type Store interface {
+	Get(ctx context.Context, userID uuid.UUID) ([]byte, error)
+	Put(ctx context.Context, userID uuid.UUID, wrapped []byte) error
+}
+
+// FileStore keeps each wrapped key in its own file under a directory
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) Get(ctx context.Context, userID uuid.UUID) ([]byte, error) {
+	wrapped, err := os.ReadFile(s.path(userID))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrKeyNotFound
+	}
+	return wrapped, err
+}
+
+func (s *FileStore) Put(ctx context.Context, userID uuid.UUID, wrapped []byte) error {
+	// Write to a temporary file first so a crash never leaves a truncated key
+	tmp, err := os.CreateTemp(s.dir, ".key-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(wrapped); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path(userID))
+}
+
+func (s *FileStore) path(userID uuid.UUID) string {
+	return filepath.Join(s.dir, userID.String()+".key")
+}
+
+// MemoryStore keeps wrapped keys in memory. It is meant for tests.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	keys map[uuid.UUID][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{keys: make(map[uuid.UUID][]byte)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, userID uuid.UUID) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	wrapped, ok := s.keys[userID]
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	return append([]byte(nil), wrapped...), nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, userID uuid.UUID, wrapped []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[userID] = append([]byte(nil), wrapped...)
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"log"
 	"net/http"
 	"os"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/emailimmunity/passwordimmunity/api"
 	"github.com/emailimmunity/passwordimmunity/db"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
 )
 
 func main() {
@@ -18,14 +21,40 @@ func main() {
 	cfg := loadConfig()
 
 	// Initialize database connection
-	if err := initDB(cfg); err != nil {
+	database, err := initDB(cfg)
+	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
+	defer database.Close()
+
+	keyEncryptionKey, err := base64.StdEncoding.DecodeString(cfg.KeyEncryptionKey)
+	if err != nil {
+		log.Fatalf("Invalid KEY_ENCRYPTION_KEY: %v", err)
+	}
+
+	// Initialize services
+	repo := repository.NewRepository(database.DB)
+	push := services.NewNotificationHub(repo, cfg.DatabaseURL)
+	permissions := services.NewPermissionResolver(repo, nil)
+	policies := services.NewPolicyService(repo)
+	devices := services.NewDeviceService(repo, nil, policies, services.NewNotificationService(repo), permissions, nil, push)
+	baseSessions := services.NewSessionService(repo, policies, devices, permissions, nil, nil, push)
+	keys := services.NewKeyRotationService(repo, services.NewEncryptionService(), baseSessions, keyEncryptionKey)
+	sessions := services.NewKeySyncingSessionService(baseSessions, keys)
+	dpop := services.NewDPoPService(repo)
+
+	// Background jobs run until the server shuts down
+	jobs, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	go push.Run(jobs)
+	go keys.ResumeOrganizationKeyRotations(jobs, time.Minute)
+	go baseSessions.RunCleanup(jobs, time.Hour)
+	go dpop.RunCleanup(jobs, time.Hour)
 
 	// Setup HTTP server
 	srv := &http.Server{
 		Addr:         cfg.ServerAddr,
-		Handler:      api.SetupRoutes(),
+		Handler:      api.SetupRoutes(dpop, cfg.PublicURL, api.NewHubHandler(push, sessions, cfg.PublicURL)),
 		ReadTimeout:  15 * time.Second,
 		WriteTimeout: 15 * time.Second,
 		IdleTimeout:  60 * time.Second,
@@ -45,6 +74,7 @@ func main() {
 	<-quit
 
 	// Graceful shutdown
+	stopJobs()
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
@@ -56,15 +86,19 @@ func main() {
 }
 
 type Config struct {
-	ServerAddr  string
-	DatabaseURL string
+	ServerAddr       string
+	PublicURL        string
+	DatabaseURL      string
+	KeyEncryptionKey string
 	// Add other configuration fields as needed
 }
 
 func loadConfig() *Config {
 	return &Config{
-		ServerAddr:  getEnv("SERVER_ADDR", ":8000"),
-		DatabaseURL: getEnv("DATABASE_URL", "postgresql://localhost/passwordimmunity?sslmode=disable"),
+		ServerAddr:       getEnv("SERVER_ADDR", ":8000"),
+		PublicURL:        getEnv("PUBLIC_URL", "http://localhost:8000"),
+		DatabaseURL:      getEnv("DATABASE_URL", "postgresql://localhost/passwordimmunity?sslmode=disable"),
+		KeyEncryptionKey: os.Getenv("KEY_ENCRYPTION_KEY"),
 	}
 }
 
@@ -75,7 +109,6 @@ func getEnv(key, fallback string) string {
 	return fallback
 }
 
-func initDB(cfg *Config) error {
-	// Database initialization will be implemented in a separate PR
-	return nil
+func initDB(cfg *Config) (*db.DB, error) {
+	return db.Connect(db.NewConfig())
 }
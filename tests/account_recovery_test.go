@@ -0,0 +1,244 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// joiningRepository keeps the organization a member joins on top of
+// keyRotationRepository; any other call panics
+type joiningRepository struct {
+	*keyRotationRepository
+	org     *models.Organization
+	role    *models.Role
+	members []models.OrganizationUser
+}
+
+func (r *joiningRepository) GetOrganizationByID(ctx context.Context, id uuid.UUID) (*models.Organization, error) {
+	if r.org.ID == id {
+		return r.org, nil
+	}
+	return nil, nil
+}
+
+func (r *joiningRepository) GetRoleByID(ctx context.Context, id uuid.UUID) (*models.Role, error) {
+	if r.role.ID == id {
+		return r.role, nil
+	}
+	return nil, nil
+}
+
+func (r *joiningRepository) GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	for _, member := range r.members {
+		if member.OrganizationID == orgID && member.UserID == userID {
+			found := member
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *joiningRepository) UpdateOrganizationUser(ctx context.Context, member *models.OrganizationUser) error {
+	for i := range r.members {
+		if r.members[i].OrganizationID == member.OrganizationID && r.members[i].UserID == member.UserID {
+			r.members[i] = *member
+			return nil
+		}
+	}
+	r.members = append(r.members, *member)
+	return nil
+}
+
+// fixedPolicies returns the same master_password settings for every organization
+type fixedPolicies struct {
+	services.PolicyService
+	masterPassword services.MasterPasswordPolicySettings
+}
+
+func (p *fixedPolicies) GetMasterPasswordPolicy(ctx context.Context, orgID uuid.UUID) (*services.MasterPasswordPolicySettings, error) {
+	settings := p.masterPassword
+	return &settings, nil
+}
+
+// resetRepository keeps organization members, their permissions and password reset
+// requests in memory; any other call panics
+type resetRepository struct {
+	repository.Repository
+	members  []models.OrganizationUser
+	grants   map[uuid.UUID][]string
+	requests map[uuid.UUID]*models.AccountRecoveryRequest
+}
+
+func (r *resetRepository) GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	for _, member := range r.members {
+		if member.OrganizationID == orgID && member.UserID == userID {
+			found := member
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *resetRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	return r.grants[userID], nil
+}
+
+func (r *resetRepository) CreateAccountRecoveryRequest(ctx context.Context, request *models.AccountRecoveryRequest) error {
+	request.ID = uuid.New()
+	stored := *request
+	r.requests[request.ID] = &stored
+	return nil
+}
+
+func (r *resetRepository) GetAccountRecoveryRequest(ctx context.Context, id uuid.UUID) (*models.AccountRecoveryRequest, error) {
+	if request, ok := r.requests[id]; ok {
+		found := *request
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *resetRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+func TestPasswordResetPermissions(t *testing.T) {
+	ctx := context.Background()
+	orgID := uuid.New()
+	adminID, memberID, ownerID := uuid.New(), uuid.New(), uuid.New()
+
+	// newService sets up an admin who may reset passwords, a plain member and an owner
+	// who also manages roles, both enrolled in account recovery
+	newService := func() (services.AccountRecoveryService, *resetRepository) {
+		repo := &resetRepository{
+			grants: map[uuid.UUID][]string{
+				adminID:  {services.PermissionManageAccountRecovery, services.PermissionCreateVaultItem},
+				memberID: {services.PermissionCreateVaultItem},
+				ownerID:  {services.PermissionManageAccountRecovery, services.PermissionManageRoles},
+			},
+			requests: make(map[uuid.UUID]*models.AccountRecoveryRequest),
+		}
+		for _, userID := range []uuid.UUID{adminID, memberID, ownerID} {
+			repo.members = append(repo.members, models.OrganizationUser{OrganizationID: orgID, UserID: userID, Status: "confirmed", ResetPasswordKey: "escrowed"})
+		}
+		return services.NewAccountRecoveryService(repo, nil, nil, nil, nil, services.NewPermissionResolver(repo, nil)), repo
+	}
+
+	t.Run("Resets Member With Fewer Permissions", func(t *testing.T) {
+		recovery, _ := newService()
+
+		if _, err := recovery.InitiatePasswordReset(ctx, orgID, adminID, memberID); err != nil {
+			t.Errorf("Expected the admin to reset the member, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Member With More Permissions", func(t *testing.T) {
+		recovery, repo := newService()
+
+		if _, err := recovery.InitiatePasswordReset(ctx, orgID, adminID, ownerID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected the reset of a member holding manage_roles to be refused, got %v", err)
+		}
+		if len(repo.requests) != 0 {
+			t.Errorf("Expected no reset request, got %d", len(repo.requests))
+		}
+	})
+
+	t.Run("Refuses Confirming After Promotion", func(t *testing.T) {
+		recovery, repo := newService()
+
+		request, err := recovery.InitiatePasswordReset(ctx, orgID, adminID, memberID)
+		if err != nil {
+			t.Fatalf("Failed to initiate reset: %v", err)
+		}
+		repo.grants[memberID] = append(repo.grants[memberID], services.PermissionManageRoles)
+		if err := recovery.ConfirmPasswordReset(ctx, request.ID, adminID, "admin password", "new master password"); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected the reset of a promoted member to be refused, got %v", err)
+		}
+		if repo.requests[request.ID].Status != "pending" {
+			t.Errorf("Expected the request to be left pending, got %s", repo.requests[request.ID].Status)
+		}
+	})
+}
+
+func TestAccountRecoveryPolicyOnJoin(t *testing.T) {
+	encryption := services.NewEncryptionService()
+	masterKey, _ := encryption.GenerateSymmetricKey()
+	ctx := context.Background()
+	orgID, userID := uuid.New(), uuid.New()
+
+	orgPublicKey, orgPrivateKey, err := encryption.GenerateKeyPairWithAlgorithm(services.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+	orgKey, _ := encryption.GenerateSymmetricKey()
+	wrappedOrgKey, _ := encryption.EncryptSymmetric(orgKey, masterKey)
+	userKey, _ := encryption.GenerateSymmetricKey()
+	wrappedUserKey, _ := encryption.EncryptSymmetric(userKey, masterKey)
+
+	// newService sets up an organization with a key pair and a user who may have a key
+	newService := func(t *testing.T, settings services.MasterPasswordPolicySettings, withUserKey bool) (services.Service, *joiningRepository) {
+		t.Helper()
+		repo := &joiningRepository{
+			keyRotationRepository: &keyRotationRepository{
+				users: map[uuid.UUID]*models.User{userID: {Base: models.Base{ID: userID}}},
+				keys: []*models.EncryptionKey{
+					{Base: models.Base{ID: uuid.New()}, OwnerType: "organization", OwnerID: orgID, Version: 1, WrappedKey: string(wrappedOrgKey), PublicKey: string(orgPublicKey), IsActive: true},
+				},
+			},
+			org:  &models.Organization{Base: models.Base{ID: orgID}},
+			role: &models.Role{Base: models.Base{ID: uuid.New()}, OrganizationID: orgID},
+		}
+		if withUserKey {
+			repo.keys = append(repo.keys, &models.EncryptionKey{Base: models.Base{ID: uuid.New()}, OwnerType: "user", OwnerID: userID, Version: 1, WrappedKey: string(wrappedUserKey), IsActive: true})
+		}
+
+		keys := services.NewKeyRotationService(repo, encryption, &retiringSessions{}, masterKey)
+		permissions := services.NewPermissionResolver(repo, nil)
+		recovery := services.NewAccountRecoveryService(repo, keys, &fixedPolicies{masterPassword: settings}, nil, nil, permissions)
+		return services.NewService(repo, nil, nil, permissions, recovery, nil), repo
+	}
+
+	t.Run("Enrolls Member When Policy Auto Enrolls", func(t *testing.T) {
+		svc, repo := newService(t, services.MasterPasswordPolicySettings{AutoEnrollAccountRecovery: true}, true)
+
+		if err := svc.AddUserToOrganization(ctx, orgID, userID, repo.role.ID); err != nil {
+			t.Fatalf("Failed to add user: %v", err)
+		}
+		escrow, err := base64.StdEncoding.DecodeString(repo.members[0].ResetPasswordKey)
+		if err != nil || len(escrow) == 0 {
+			t.Fatalf("Expected the member to be enrolled, got %q", repo.members[0].ResetPasswordKey)
+		}
+		if key, err := encryption.DecryptWithPrivateKey(escrow, orgPrivateKey); err != nil || string(key) != string(userKey) {
+			t.Errorf("Expected the escrow to hold the user key, got %v", err)
+		}
+	})
+
+	t.Run("Leaves Member When Policy Is Off", func(t *testing.T) {
+		svc, repo := newService(t, services.MasterPasswordPolicySettings{}, true)
+
+		if err := svc.AddUserToOrganization(ctx, orgID, userID, repo.role.ID); err != nil {
+			t.Fatalf("Failed to add user: %v", err)
+		}
+		if repo.members[0].ResetPasswordKey != "" {
+			t.Error("Expected the member not to be enrolled")
+		}
+	})
+
+	t.Run("Skips Member Without User Key", func(t *testing.T) {
+		svc, repo := newService(t, services.MasterPasswordPolicySettings{RequireAccountRecovery: true}, false)
+
+		if err := svc.AddUserToOrganization(ctx, orgID, userID, repo.role.ID); err != nil {
+			t.Fatalf("Expected a member without keys to join, got %v", err)
+		}
+		if repo.members[0].ResetPasswordKey != "" {
+			t.Error("Expected nothing to be escrowed without a user key")
+		}
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/emailimmunity/passwordimmunity/api"
+	"github.com/emailimmunity/passwordimmunity/services"
 )
 
 func TestAPIHandlers(t *testing.T) {
@@ -16,7 +17,7 @@ func TestAPIHandlers(t *testing.T) {
 		req := httptest.NewRequest("POST", "/api/auth/login", strings.NewReader(payload))
 		w := httptest.NewRecorder()
 
-		api.SetupRoutes().ServeHTTP(w, req)
+		api.SetupRoutes(services.NewDPoPService(nil), "https://vault.example.com").ServeHTTP(w, req)
 
 		if w.Code != http.StatusOK {
 			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
@@ -28,7 +29,7 @@ func TestAPIHandlers(t *testing.T) {
 		req.Header.Set("Authorization", "Bearer test_token")
 		w := httptest.NewRecorder()
 
-		api.SetupRoutes().ServeHTTP(w, req)
+		api.SetupRoutes(services.NewDPoPService(nil), "https://vault.example.com").ServeHTTP(w, req)
 
 		var resp api.Response
 		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
@@ -42,7 +43,7 @@ func TestAPIHandlers(t *testing.T) {
 		req.Header.Set("Authorization", "Bearer test_token")
 		w := httptest.NewRecorder()
 
-		api.SetupRoutes().ServeHTTP(w, req)
+		api.SetupRoutes(services.NewDPoPService(nil), "https://vault.example.com").ServeHTTP(w, req)
 
 		if w.Code != http.StatusOK {
 			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
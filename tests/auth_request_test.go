@@ -0,0 +1,306 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// authRequestRepository keeps one user, their devices and login requests in memory; any
+// other call panics
+type authRequestRepository struct {
+	repository.Repository
+	user     *models.User
+	devices  map[uuid.UUID]*models.Device
+	requests map[uuid.UUID]*models.AuthRequest
+}
+
+func (r *authRequestRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	if r.user.Email != email {
+		return nil, nil
+	}
+	return r.user, nil
+}
+
+func (r *authRequestRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if r.user.ID != id {
+		return nil, nil
+	}
+	return r.user, nil
+}
+
+func (r *authRequestRepository) GetDevice(ctx context.Context, id uuid.UUID) (*models.Device, error) {
+	if device, ok := r.devices[id]; ok {
+		found := *device
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *authRequestRepository) ListDevices(ctx context.Context, userID uuid.UUID) ([]models.Device, error) {
+	var devices []models.Device
+	for _, device := range r.devices {
+		if device.UserID == userID {
+			devices = append(devices, *device)
+		}
+	}
+	return devices, nil
+}
+
+func (r *authRequestRepository) CreateAuthRequest(ctx context.Context, request *models.AuthRequest) error {
+	stored := *request
+	r.requests[request.ID] = &stored
+	return nil
+}
+
+func (r *authRequestRepository) GetAuthRequest(ctx context.Context, id uuid.UUID) (*models.AuthRequest, error) {
+	if request, ok := r.requests[id]; ok {
+		found := *request
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *authRequestRepository) RespondToAuthRequest(ctx context.Context, request *models.AuthRequest) (bool, error) {
+	stored, ok := r.requests[request.ID]
+	if !ok || stored.Status != "pending" {
+		return false, nil
+	}
+	stored.Status = request.Status
+	stored.ResponseDeviceID = request.ResponseDeviceID
+	stored.EncryptedUserKey = request.EncryptedUserKey
+	stored.RespondedAt = request.RespondedAt
+	return true, nil
+}
+
+func (r *authRequestRepository) ConsumeAuthRequest(ctx context.Context, id uuid.UUID) (bool, error) {
+	stored, ok := r.requests[id]
+	if !ok || stored.Status != "approved" || stored.UsedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	stored.UsedAt = &now
+	return true, nil
+}
+
+func (r *authRequestRepository) DeleteExpiredAuthRequests(ctx context.Context, before time.Time) error {
+	for id, request := range r.requests {
+		if request.ExpiresAt.Before(before) {
+			delete(r.requests, id)
+		}
+	}
+	return nil
+}
+
+func (r *authRequestRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+func TestAuthRequestFingerprint(t *testing.T) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	publicKey := key.PublicKey().Bytes()
+
+	fingerprint := services.AuthRequestFingerprint("alice@example.com", publicKey)
+	if words := strings.Split(fingerprint, "-"); len(words) != 5 {
+		t.Errorf("Expected five words, got %q", fingerprint)
+	}
+
+	t.Run("Email Case Ignored", func(t *testing.T) {
+		if other := services.AuthRequestFingerprint(" Alice@Example.com", publicKey); other != fingerprint {
+			t.Errorf("Expected %q, got %q", fingerprint, other)
+		}
+	})
+
+	t.Run("Bound To Key And Account", func(t *testing.T) {
+		otherKey, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		if services.AuthRequestFingerprint("alice@example.com", otherKey.PublicKey().Bytes()) == fingerprint {
+			t.Error("Expected a different phrase for another key")
+		}
+		if services.AuthRequestFingerprint("bob@example.com", publicKey) == fingerprint {
+			t.Error("Expected a different phrase for another account")
+		}
+	})
+}
+
+func TestAuthRequestLogin(t *testing.T) {
+	ctx := context.Background()
+	const email = "alice@example.com"
+	userID, otherUserID := uuid.New(), uuid.New()
+	trusted, pendingDevice, otherDevice := uuid.New(), uuid.New(), uuid.New()
+
+	sealed := make([]byte, 64)
+	rand.Read(sealed)
+	encryptedUserKey := base64.StdEncoding.EncodeToString(sealed)
+
+	// newFixture sets up a user with an authorized and a pending device, and a device of
+	// another user
+	newFixture := func() (services.DeviceService, *authRequestRepository, *notifiedUsers) {
+		repo := &authRequestRepository{
+			user: &models.User{Base: models.Base{ID: userID}, Email: email},
+			devices: map[uuid.UUID]*models.Device{
+				trusted:       {Base: models.Base{ID: trusted}, UserID: userID, Name: "Laptop", Status: "authorized"},
+				pendingDevice: {Base: models.Base{ID: pendingDevice}, UserID: userID, Name: "Tablet", Status: "pending"},
+				otherDevice:   {Base: models.Base{ID: otherDevice}, UserID: otherUserID, Name: "Phone", Status: "authorized"},
+			},
+			requests: make(map[uuid.UUID]*models.AuthRequest),
+		}
+		notifications := &notifiedUsers{}
+		return services.NewDeviceService(repo, nil, nil, notifications, nil, nil, nil), repo, notifications
+	}
+
+	// newRequest asks to sign in from a new device with a fresh key pair
+	newRequest := func(t *testing.T, devices services.DeviceService) *services.CreatedAuthRequest {
+		t.Helper()
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		publicKey := key.PublicKey().Bytes()
+		fingerprint := services.AuthRequestFingerprint(email, publicKey)
+		request, err := devices.CreateAuthRequest(ctx, email, base64.StdEncoding.EncodeToString(publicKey), fingerprint, uuid.Nil, "New laptop", services.DeviceDesktop)
+		if err != nil {
+			t.Fatalf("Failed to create auth request: %v", err)
+		}
+		return request
+	}
+
+	t.Run("Signs In Once When Approved", func(t *testing.T) {
+		devices, repo, notifications := newFixture()
+		request := newRequest(t, devices)
+		if stored := repo.requests[request.ID]; stored.AccessCodeHash == request.AccessCode {
+			t.Error("Expected only a hash of the access code to be stored")
+		}
+		if len(notifications.userIDs) != 1 || notifications.userIDs[0] != userID {
+			t.Errorf("Expected the user to be notified, got %v", notifications.userIDs)
+		}
+
+		if _, err := devices.CompleteAuthRequest(ctx, request.ID, request.AccessCode); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected an unanswered request not to sign in, got %v", err)
+		}
+		if err := devices.RespondToAuthRequest(ctx, userID, request.ID, trusted, true, encryptedUserKey); err != nil {
+			t.Fatalf("Failed to approve request: %v", err)
+		}
+		result, err := devices.CompleteAuthRequest(ctx, request.ID, request.AccessCode)
+		if err != nil {
+			t.Fatalf("Failed to sign in: %v", err)
+		}
+		if result.User.ID != userID || result.EncryptedUserKey != encryptedUserKey {
+			t.Errorf("Expected the user and the sealed key, got %s and %q", result.User.ID, result.EncryptedUserKey)
+		}
+		if _, err := devices.CompleteAuthRequest(ctx, request.ID, request.AccessCode); !errors.Is(err, services.ErrAuthRequestAnswered) {
+			t.Errorf("Expected a used approval to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Denied Request Cannot Sign In", func(t *testing.T) {
+		devices, repo, _ := newFixture()
+		request := newRequest(t, devices)
+
+		if err := devices.RespondToAuthRequest(ctx, userID, request.ID, trusted, false, ""); err != nil {
+			t.Fatalf("Failed to deny request: %v", err)
+		}
+		if err := devices.RespondToAuthRequest(ctx, userID, request.ID, trusted, true, encryptedUserKey); !errors.Is(err, services.ErrAuthRequestAnswered) {
+			t.Errorf("Expected only the first answer to count, got %v", err)
+		}
+		if _, err := devices.CompleteAuthRequest(ctx, request.ID, request.AccessCode); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a denied request not to sign in, got %v", err)
+		}
+		if repo.requests[request.ID].EncryptedUserKey != "" {
+			t.Error("Expected a denied request to carry no key")
+		}
+	})
+
+	t.Run("Refuses Expired Request", func(t *testing.T) {
+		devices, repo, _ := newFixture()
+		request := newRequest(t, devices)
+		repo.requests[request.ID].ExpiresAt = time.Now().Add(-time.Second)
+
+		if err := devices.RespondToAuthRequest(ctx, userID, request.ID, trusted, true, encryptedUserKey); !errors.Is(err, services.ErrAuthRequestExpired) {
+			t.Errorf("Expected an expired request not to be answered, got %v", err)
+		}
+
+		approved := newRequest(t, devices)
+		if err := devices.RespondToAuthRequest(ctx, userID, approved.ID, trusted, true, encryptedUserKey); err != nil {
+			t.Fatalf("Failed to approve request: %v", err)
+		}
+		repo.requests[approved.ID].ExpiresAt = time.Now().Add(-time.Second)
+		if _, err := devices.CompleteAuthRequest(ctx, approved.ID, approved.AccessCode); !errors.Is(err, services.ErrAuthRequestExpired) {
+			t.Errorf("Expected an expired approval not to sign in, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Wrong Access Code", func(t *testing.T) {
+		devices, _, _ := newFixture()
+		request := newRequest(t, devices)
+		if err := devices.RespondToAuthRequest(ctx, userID, request.ID, trusted, true, encryptedUserKey); err != nil {
+			t.Fatalf("Failed to approve request: %v", err)
+		}
+
+		if _, err := devices.GetAuthRequestStatus(ctx, request.ID, "wrong"); !errors.Is(err, services.ErrAuthRequestNotFound) {
+			t.Errorf("Expected polling with a wrong code to be refused, got %v", err)
+		}
+		if _, err := devices.CompleteAuthRequest(ctx, request.ID, "wrong"); !errors.Is(err, services.ErrAuthRequestNotFound) {
+			t.Errorf("Expected signing in with a wrong code to be refused, got %v", err)
+		}
+		if _, err := devices.CompleteAuthRequest(ctx, request.ID, request.AccessCode); err != nil {
+			t.Errorf("Expected the approval to stay usable with the right code, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Responder That Is Not Authorized", func(t *testing.T) {
+		devices, repo, _ := newFixture()
+		request := newRequest(t, devices)
+
+		responders := []struct {
+			name     string
+			userID   uuid.UUID
+			deviceID uuid.UUID
+		}{
+			{"Pending Device", userID, pendingDevice},
+			{"Device Of Another User", userID, otherDevice},
+			{"Unknown Device", userID, uuid.New()},
+		}
+		for _, responder := range responders {
+			if err := devices.RespondToAuthRequest(ctx, responder.userID, request.ID, responder.deviceID, true, encryptedUserKey); !errors.Is(err, services.ErrUnauthorized) {
+				t.Errorf("%s: expected the answer to be refused, got %v", responder.name, err)
+			}
+		}
+		if err := devices.RespondToAuthRequest(ctx, otherUserID, request.ID, otherDevice, true, encryptedUserKey); !errors.Is(err, services.ErrAuthRequestNotFound) {
+			t.Errorf("Expected another user's request to be hidden, got %v", err)
+		}
+		if repo.requests[request.ID].Status != "pending" {
+			t.Errorf("Expected the request to stay pending, got %s", repo.requests[request.ID].Status)
+		}
+	})
+
+	t.Run("Refuses Invalid Request", func(t *testing.T) {
+		devices, repo, _ := newFixture()
+		key, _ := ecdh.X25519().GenerateKey(rand.Reader)
+		publicKey := base64.StdEncoding.EncodeToString(key.PublicKey().Bytes())
+
+		if _, err := devices.CreateAuthRequest(ctx, email, publicKey, "wrong-phrase", uuid.Nil, "", ""); !errors.Is(err, services.ErrInvalidAuthRequest) {
+			t.Errorf("Expected a wrong fingerprint to be refused, got %v", err)
+		}
+		delete(repo.devices, trusted)
+		fingerprint := services.AuthRequestFingerprint(email, key.PublicKey().Bytes())
+		if _, err := devices.CreateAuthRequest(ctx, email, publicKey, fingerprint, uuid.Nil, "", ""); !errors.Is(err, services.ErrAuthRequestUnavailable) {
+			t.Errorf("Expected an account without an authorized device to be refused, got %v", err)
+		}
+		if len(repo.requests) != 0 {
+			t.Errorf("Expected no request to be stored, got %d", len(repo.requests))
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// collectionVaultRepository keeps an organization's collections, collection grants,
+// member permissions and vault items in memory; any other call panics
+type collectionVaultRepository struct {
+	repository.Repository
+	collections map[uuid.UUID]*models.Collection
+	grants      []models.CollectionUser
+	permissions map[uuid.UUID][]string
+	items       map[uuid.UUID]*models.VaultItem
+}
+
+func (r *collectionVaultRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	return r.permissions[userID], nil
+}
+
+func (r *collectionVaultRepository) ListUserCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionUser, error) {
+	var grants []models.CollectionUser
+	for _, grant := range r.grants {
+		if grant.UserID == userID {
+			grants = append(grants, grant)
+		}
+	}
+	return grants, nil
+}
+
+func (r *collectionVaultRepository) ListUserGroupCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionGroup, error) {
+	return nil, nil
+}
+
+func (r *collectionVaultRepository) GetCollection(ctx context.Context, id uuid.UUID) (*models.Collection, error) {
+	return r.collections[id], nil
+}
+
+func (r *collectionVaultRepository) GetVaultItemByID(ctx context.Context, id uuid.UUID) (*models.VaultItem, error) {
+	if item, ok := r.items[id]; ok {
+		found := *item
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *collectionVaultRepository) CreateVaultItem(ctx context.Context, item *models.VaultItem) error {
+	item.ID = uuid.New()
+	stored := *item
+	r.items[item.ID] = &stored
+	return nil
+}
+
+func (r *collectionVaultRepository) UpdateVaultItem(ctx context.Context, item *models.VaultItem) error {
+	stored := *item
+	r.items[item.ID] = &stored
+	return nil
+}
+
+func (r *collectionVaultRepository) DeleteVaultItem(ctx context.Context, id uuid.UUID) error {
+	delete(r.items, id)
+	return nil
+}
+
+func (r *collectionVaultRepository) ListOrganizationVaultItems(ctx context.Context, orgID uuid.UUID) ([]models.VaultItem, error) {
+	var items []models.VaultItem
+	for _, item := range r.items {
+		if item.OrganizationID == orgID {
+			items = append(items, *item)
+		}
+	}
+	return items, nil
+}
+
+func TestMergeCollectionAccess(t *testing.T) {
+	cases := []struct {
+		a, b, want services.CollectionAccess
+	}{
+		{services.CollectionAccessView, "", services.CollectionAccessView},
+		{services.CollectionAccessView, services.CollectionAccessEdit, services.CollectionAccessEdit},
+		{services.CollectionAccessViewExceptPasswords, services.CollectionAccessView, services.CollectionAccessView},
+		{services.CollectionAccessViewExceptPasswords, services.CollectionAccessEditExceptPasswords, services.CollectionAccessEditExceptPasswords},
+		{services.CollectionAccessEditExceptPasswords, services.CollectionAccessView, services.CollectionAccessEdit},
+		{services.CollectionAccessViewExceptPasswords, services.CollectionAccessManage, services.CollectionAccessManage},
+	}
+	for _, c := range cases {
+		if got := services.MergeCollectionAccess(c.a, c.b); got != c.want {
+			t.Errorf("Merging %s and %s: expected %s, got %s", c.a, c.b, c.want, got)
+		}
+		if got := services.MergeCollectionAccess(c.b, c.a); got != c.want {
+			t.Errorf("Merging %s and %s: expected %s, got %s", c.b, c.a, c.want, got)
+		}
+	}
+}
+
+func TestRestrictVaultItems(t *testing.T) {
+	visible, hidden, denied := uuid.New(), uuid.New(), uuid.New()
+	item := func(collectionID *uuid.UUID) models.VaultItem {
+		return models.VaultItem{
+			Base:              models.Base{ID: uuid.New()},
+			CollectionID:      collectionID,
+			EncryptedData:     "data",
+			EncryptedPassword: "password",
+		}
+	}
+	items := []models.VaultItem{item(nil), item(&visible), item(&hidden), item(&denied)}
+
+	restricted := services.RestrictVaultItems(items, map[uuid.UUID]services.CollectionAccess{
+		visible: services.CollectionAccessView,
+		hidden:  services.CollectionAccessViewExceptPasswords,
+	})
+	if len(restricted) != 2 {
+		t.Fatalf("Expected two items, got %d", len(restricted))
+	}
+	for _, item := range restricted {
+		if item.CollectionID == nil {
+			t.Error("Expected the item outside any collection to be left out")
+			continue
+		}
+		if *item.CollectionID == denied {
+			t.Error("Expected the item of an ungranted collection to be left out")
+		}
+		hides := *item.CollectionID == hidden
+		if hides && item.EncryptedPassword != "" {
+			t.Error("Expected the password to be withheld")
+		}
+		if !hides && item.EncryptedPassword != "password" {
+			t.Error("Expected the password to be returned")
+		}
+		if item.EncryptedData != "data" {
+			t.Error("Expected the rest of the item to be returned")
+		}
+	}
+	if items[2].EncryptedPassword != "password" {
+		t.Error("Expected the caller's items to be left unchanged")
+	}
+}
+
+func TestVaultItemCollectionAccess(t *testing.T) {
+	ctx := context.Background()
+	orgID := uuid.New()
+	helpdeskID, editorID, managerID := uuid.New(), uuid.New(), uuid.New()
+	shared, other, foreign := uuid.New(), uuid.New(), uuid.New()
+	member := []string{services.PermissionReadVaultItems, services.PermissionCreateVaultItem}
+
+	// newFixture sets up a shared collection the helpdesk may use without seeing
+	// passwords and the editor may edit, another collection, and a manager of all
+	// collections. The organization has an item in the shared collection and one in no
+	// collection.
+	newFixture := func() (services.Service, *collectionVaultRepository, uuid.UUID, uuid.UUID) {
+		repo := &collectionVaultRepository{
+			collections: map[uuid.UUID]*models.Collection{
+				shared:  {ID: shared, OrganizationID: orgID},
+				other:   {ID: other, OrganizationID: orgID},
+				foreign: {ID: foreign, OrganizationID: uuid.New()},
+			},
+			grants: []models.CollectionUser{
+				{CollectionID: shared, UserID: helpdeskID, Access: string(services.CollectionAccessViewExceptPasswords)},
+				{CollectionID: shared, UserID: editorID, Access: string(services.CollectionAccessEdit)},
+				{CollectionID: other, UserID: editorID, Access: string(services.CollectionAccessManage)},
+			},
+			permissions: map[uuid.UUID][]string{
+				helpdeskID: member,
+				editorID:   member,
+				managerID:  append([]string{services.PermissionManageCollections}, member...),
+			},
+			items: make(map[uuid.UUID]*models.VaultItem),
+		}
+		collectionID := shared
+		sharedItem := &models.VaultItem{Base: models.Base{ID: uuid.New()}, OrganizationID: orgID, CollectionID: &collectionID, EncryptedData: "data", EncryptedPassword: "password"}
+		unassignedItem := &models.VaultItem{Base: models.Base{ID: uuid.New()}, OrganizationID: orgID, EncryptedData: "data", EncryptedPassword: "password"}
+		repo.items[sharedItem.ID] = sharedItem
+		repo.items[unassignedItem.ID] = unassignedItem
+		return services.NewService(repo, nil, nil, services.NewPermissionResolver(repo, nil), nil, nil), repo, sharedItem.ID, unassignedItem.ID
+	}
+
+	t.Run("Hide Password Member Reads Collection Item", func(t *testing.T) {
+		svc, _, sharedItemID, _ := newFixture()
+
+		items, err := svc.GetVaultItems(ctx, helpdeskID, orgID)
+		if err != nil {
+			t.Fatalf("Failed to list items: %v", err)
+		}
+		if len(items) != 1 || items[0].ID != sharedItemID {
+			t.Fatalf("Expected only the shared item, got %d items", len(items))
+		}
+		if items[0].EncryptedPassword != "" {
+			t.Error("Expected the password to be withheld")
+		}
+		if items[0].EncryptedData != "data" {
+			t.Error("Expected the rest of the item to be returned")
+		}
+	})
+
+	t.Run("Manager Sees Every Item", func(t *testing.T) {
+		svc, _, _, _ := newFixture()
+
+		items, err := svc.GetVaultItems(ctx, managerID, orgID)
+		if err != nil {
+			t.Fatalf("Failed to list items: %v", err)
+		}
+		if len(items) != 2 {
+			t.Fatalf("Expected both items, got %d", len(items))
+		}
+		for _, item := range items {
+			if item.EncryptedPassword != "password" {
+				t.Errorf("Expected the manager to see the password of %s", item.ID)
+			}
+		}
+	})
+
+	t.Run("Create Needs Editable Collection", func(t *testing.T) {
+		svc, _, _, _ := newFixture()
+		otherID := other
+		sharedID := shared
+		foreignID := foreign
+
+		tests := []struct {
+			name         string
+			userID       uuid.UUID
+			collectionID *uuid.UUID
+			password     string
+			want         error
+		}{
+			{"Editor In Collection", editorID, &sharedID, "password", nil},
+			{"Hide Password Member", helpdeskID, &sharedID, "", services.ErrUnauthorized},
+			{"Ungranted Collection", helpdeskID, &otherID, "", services.ErrUnauthorized},
+			{"No Collection", editorID, nil, "password", services.ErrUnauthorized},
+			{"Manager Without Collection", managerID, nil, "password", nil},
+			{"Collection Of Another Organization", managerID, &foreignID, "password", services.ErrInvalidOperation},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				_, err := svc.CreateVaultItem(ctx, tt.userID, orgID, tt.collectionID, "login", "Item", "data", tt.password)
+				if !errors.Is(err, tt.want) {
+					t.Errorf("Expected %v, got %v", tt.want, err)
+				}
+			})
+		}
+	})
+
+	t.Run("Edit Except Passwords Keeps Password", func(t *testing.T) {
+		svc, repo, sharedItemID, _ := newFixture()
+		repo.grants[0].Access = string(services.CollectionAccessEditExceptPasswords)
+		collectionID := shared
+
+		updated, err := svc.UpdateVaultItem(ctx, helpdeskID, sharedItemID, &collectionID, "Renamed", "new data", nil)
+		if err != nil {
+			t.Fatalf("Failed to update item: %v", err)
+		}
+		if updated.EncryptedPassword != "" {
+			t.Error("Expected the password to be withheld from the result")
+		}
+		if stored := repo.items[sharedItemID]; stored.EncryptedPassword != "password" || stored.EncryptedData != "new data" {
+			t.Errorf("Expected the data to change and the password to be kept, got %+v", stored)
+		}
+
+		password := "new password"
+		if _, err := svc.UpdateVaultItem(ctx, helpdeskID, sharedItemID, &collectionID, "Renamed", "new data", &password); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected setting the password to be refused, got %v", err)
+		}
+	})
+
+	t.Run("View Access Cannot Write", func(t *testing.T) {
+		svc, repo, sharedItemID, _ := newFixture()
+		collectionID := shared
+
+		if _, err := svc.UpdateVaultItem(ctx, helpdeskID, sharedItemID, &collectionID, "Renamed", "new data", nil); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected the update to be refused, got %v", err)
+		}
+		if err := svc.DeleteVaultItem(ctx, helpdeskID, sharedItemID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected the deletion to be refused, got %v", err)
+		}
+		if _, ok := repo.items[sharedItemID]; !ok {
+			t.Error("Expected the item to be kept")
+		}
+	})
+
+	t.Run("Unreachable Items Not Found", func(t *testing.T) {
+		svc, _, _, unassignedItemID := newFixture()
+
+		if _, err := svc.UpdateVaultItem(ctx, editorID, unassignedItemID, nil, "Renamed", "new data", nil); !errors.Is(err, services.ErrVaultItemNotFound) {
+			t.Errorf("Expected an item outside any collection to be unreachable, got %v", err)
+		}
+		if err := svc.DeleteVaultItem(ctx, helpdeskID, unassignedItemID); !errors.Is(err, services.ErrVaultItemNotFound) {
+			t.Errorf("Expected an item outside any collection to be unreachable, got %v", err)
+		}
+		if err := svc.DeleteVaultItem(ctx, managerID, unassignedItemID); err != nil {
+			t.Errorf("Expected the manager to delete the item, got %v", err)
+		}
+	})
+
+	t.Run("Moving Needs Manage Access", func(t *testing.T) {
+		svc, repo, sharedItemID, _ := newFixture()
+		otherID := other
+
+		if _, err := svc.UpdateVaultItem(ctx, editorID, sharedItemID, &otherID, "Item", "data", nil); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected moving without manage access to be refused, got %v", err)
+		}
+		if _, err := svc.UpdateVaultItem(ctx, editorID, sharedItemID, nil, "Item", "data", nil); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected moving out of the collection to be refused, got %v", err)
+		}
+		if _, err := svc.UpdateVaultItem(ctx, managerID, sharedItemID, &otherID, "Item", "data", nil); err != nil {
+			t.Fatalf("Expected the manager to move the item, got %v", err)
+		}
+		if moved := repo.items[sharedItemID].CollectionID; moved == nil || *moved != other {
+			t.Errorf("Expected the item to move to %s, got %v", other, moved)
+		}
+	})
+}
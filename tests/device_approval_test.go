@@ -0,0 +1,420 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// approvalRepository keeps the devices and memberships of one organization in memory;
+// any other call panics
+type approvalRepository struct {
+	repository.Repository
+	users       map[uuid.UUID]*models.User
+	devices     map[uuid.UUID]*models.Device
+	memberships []models.OrganizationUser
+	grants      map[uuid.UUID][]string
+	forgotten   []uuid.UUID
+}
+
+func (r *approvalRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return r.users[id], nil
+}
+
+func (r *approvalRepository) GetDevice(ctx context.Context, id uuid.UUID) (*models.Device, error) {
+	if device, ok := r.devices[id]; ok {
+		found := *device
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *approvalRepository) CreateDevice(ctx context.Context, device *models.Device) error {
+	stored := *device
+	r.devices[device.ID] = &stored
+	return nil
+}
+
+func (r *approvalRepository) UpdateDevice(ctx context.Context, device *models.Device) error {
+	stored := *device
+	r.devices[device.ID] = &stored
+	return nil
+}
+
+func (r *approvalRepository) ReviewPendingDevice(ctx context.Context, device *models.Device) (bool, error) {
+	if stored, ok := r.devices[device.ID]; !ok || stored.Status != "pending" {
+		return false, nil
+	}
+	return true, r.UpdateDevice(ctx, device)
+}
+
+func (r *approvalRepository) SetDeviceKey(ctx context.Context, id uuid.UUID, publicKey, thumbprint string) (bool, error) {
+	device, ok := r.devices[id]
+	if !ok || device.KeyThumbprint != "" {
+		return false, nil
+	}
+	device.PublicKey = publicKey
+	device.KeyThumbprint = thumbprint
+	return true, nil
+}
+
+func (r *approvalRepository) DeleteTwoFactorRememberTokensForDevice(ctx context.Context, deviceID uuid.UUID) error {
+	r.forgotten = append(r.forgotten, deviceID)
+	return nil
+}
+
+func (r *approvalRepository) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error) {
+	var memberships []models.OrganizationUser
+	for _, member := range r.memberships {
+		if member.UserID == userID {
+			memberships = append(memberships, member)
+		}
+	}
+	return memberships, nil
+}
+
+func (r *approvalRepository) GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	for _, member := range r.memberships {
+		if member.OrganizationID == orgID && member.UserID == userID {
+			found := member
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *approvalRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	return r.grants[userID], nil
+}
+
+func (r *approvalRepository) ListMembersWithPermission(ctx context.Context, orgID uuid.UUID, permission string) ([]uuid.UUID, error) {
+	var userIDs []uuid.UUID
+	for userID, granted := range r.grants {
+		for _, name := range granted {
+			if name == permission {
+				userIDs = append(userIDs, userID)
+			}
+		}
+	}
+	return userIDs, nil
+}
+
+func (r *approvalRepository) ListPendingOrganizationDevices(ctx context.Context, orgID uuid.UUID) ([]models.Device, error) {
+	var pending []models.Device
+	for _, device := range r.devices {
+		if member, _ := r.GetOrganizationUser(ctx, orgID, device.UserID); member != nil && device.Status == "pending" {
+			pending = append(pending, *device)
+		}
+	}
+	return pending, nil
+}
+
+func (r *approvalRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+// approvalPolicy returns the same device approval settings for every organization; nil
+// means the policy is off
+type approvalPolicy struct {
+	services.PolicyService
+	settings *services.DeviceApprovalPolicySettings
+}
+
+func (p *approvalPolicy) GetDeviceApprovalPolicy(ctx context.Context, orgID uuid.UUID) (*services.DeviceApprovalPolicySettings, error) {
+	return p.settings, nil
+}
+
+// notifiedUsers records who was notified
+type notifiedUsers struct {
+	services.NotificationService
+	userIDs []uuid.UUID
+}
+
+func (n *notifiedUsers) CreateNotification(ctx context.Context, userID uuid.UUID, notificationType services.NotificationType, message string, metadata map[string]interface{}) error {
+	n.userIDs = append(n.userIDs, userID)
+	return nil
+}
+
+func TestDeviceApproval(t *testing.T) {
+	ctx := context.Background()
+	orgID, userID, adminID := uuid.New(), uuid.New(), uuid.New()
+	userAgent := "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"
+
+	type fixture struct {
+		devices       services.DeviceService
+		repo          *approvalRepository
+		policy        *approvalPolicy
+		notifications *notifiedUsers
+		trusted       uuid.UUID
+	}
+
+	// newFixture sets up an organization requiring device approval, a member with one
+	// authorized device and an admin who may approve devices
+	newFixture := func(t *testing.T) *fixture {
+		t.Helper()
+		trusted := uuid.New()
+		f := &fixture{
+			repo: &approvalRepository{
+				users: map[uuid.UUID]*models.User{
+					userID:  {Base: models.Base{ID: userID}, Email: "member@example.com"},
+					adminID: {Base: models.Base{ID: adminID}, Email: "admin@example.com"},
+				},
+				devices: map[uuid.UUID]*models.Device{
+					trusted: {Base: models.Base{ID: trusted}, UserID: userID, Name: "Laptop", Status: "authorized"},
+				},
+				memberships: []models.OrganizationUser{
+					{UserID: userID, OrganizationID: orgID, Status: "confirmed"},
+					{UserID: adminID, OrganizationID: orgID, Status: "confirmed"},
+				},
+				grants: map[uuid.UUID][]string{adminID: {services.PermissionApproveDevices}},
+			},
+			policy:        &approvalPolicy{settings: &services.DeviceApprovalPolicySettings{}},
+			notifications: &notifiedUsers{},
+			trusted:       trusted,
+		}
+		permissions := services.NewPermissionResolver(f.repo, nil)
+		f.devices = services.NewDeviceService(f.repo, nil, f.policy, f.notifications, permissions, nil, nil)
+		return f
+	}
+
+	// newDevice signs in from an unknown device and returns the pending device's ID
+	newDevice := func(t *testing.T, f *fixture) uuid.UUID {
+		t.Helper()
+		_, err := f.devices.CheckLoginDevice(ctx, userID, uuid.Nil, userAgent)
+		var pending *services.DevicePendingError
+		if !errors.As(err, &pending) {
+			t.Fatalf("Expected the new device to wait for approval, got %v", err)
+		}
+		return pending.DeviceID
+	}
+
+	t.Run("Holds New Device For Approval", func(t *testing.T) {
+		f := newFixture(t)
+
+		deviceID := newDevice(t, f)
+		if device := f.repo.devices[deviceID]; device == nil || device.Status != "pending" || device.UserID != userID {
+			t.Fatalf("Expected a pending device of the member, got %+v", device)
+		}
+		if len(f.notifications.userIDs) != 2 || f.notifications.userIDs[0] != userID || f.notifications.userIDs[1] != adminID {
+			t.Errorf("Expected the member and the admin to be notified, got %v", f.notifications.userIDs)
+		}
+		if _, err := f.devices.CheckLoginDevice(ctx, userID, deviceID, userAgent); !errors.Is(err, services.ErrDevicePendingApproval) {
+			t.Errorf("Expected the pending device to be refused, got %v", err)
+		}
+
+		pending, err := f.devices.ListPendingDevices(ctx, orgID, adminID)
+		if err != nil {
+			t.Fatalf("Failed to list pending devices: %v", err)
+		}
+		if len(pending) != 1 || pending[0].ID != deviceID || pending[0].Email != "member@example.com" {
+			t.Errorf("Expected the device in the approval queue, got %+v", pending)
+		}
+		if _, err := f.devices.ListPendingDevices(ctx, orgID, userID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without the permission to be refused the queue, got %v", err)
+		}
+	})
+
+	t.Run("Approves From Authorized Device", func(t *testing.T) {
+		f := newFixture(t)
+		deviceID := newDevice(t, f)
+
+		if err := f.devices.ReviewDevice(ctx, userID, deviceID, deviceID, true); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a pending device not to approve itself, got %v", err)
+		}
+		if err := f.devices.ReviewDevice(ctx, userID, f.trusted, deviceID, true); err != nil {
+			t.Fatalf("Failed to approve device: %v", err)
+		}
+		device, err := f.devices.CheckLoginDevice(ctx, userID, deviceID, userAgent)
+		if err != nil || device == nil || device.Status != "authorized" {
+			t.Errorf("Expected the approved device to sign in, got %v", err)
+		}
+	})
+
+	t.Run("Admin Only Approval", func(t *testing.T) {
+		f := newFixture(t)
+		f.policy.settings.AdminApprovalOnly = true
+		deviceID := newDevice(t, f)
+
+		if err := f.devices.ReviewDevice(ctx, userID, f.trusted, deviceID, true); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected the member to be refused approving their device, got %v", err)
+		}
+		if err := f.devices.ReviewMemberDevice(ctx, orgID, userID, deviceID, true); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without the permission to be refused, got %v", err)
+		}
+		if err := f.devices.ReviewMemberDevice(ctx, orgID, adminID, deviceID, true); err != nil {
+			t.Fatalf("Failed to approve device: %v", err)
+		}
+		if f.repo.devices[deviceID].Status != "authorized" {
+			t.Errorf("Expected the device to be authorized, got %s", f.repo.devices[deviceID].Status)
+		}
+	})
+
+	t.Run("Denial Blocks Device", func(t *testing.T) {
+		f := newFixture(t)
+		deviceID := newDevice(t, f)
+
+		if err := f.devices.ReviewMemberDevice(ctx, orgID, adminID, deviceID, false); err != nil {
+			t.Fatalf("Failed to deny device: %v", err)
+		}
+		if _, err := f.devices.CheckLoginDevice(ctx, userID, deviceID, userAgent); !errors.Is(err, services.ErrDeviceBlocked) {
+			t.Errorf("Expected the denied device to be refused, got %v", err)
+		}
+		if len(f.repo.forgotten) != 1 || f.repo.forgotten[0] != deviceID {
+			t.Errorf("Expected the denied device's remembered second factor to be revoked, got %v", f.repo.forgotten)
+		}
+		if err := f.devices.ReviewDevice(ctx, userID, f.trusted, deviceID, true); !errors.Is(err, services.ErrDeviceNotPending) {
+			t.Errorf("Expected only the first decision to count, got %v", err)
+		}
+	})
+
+	t.Run("Authorizes Right Away Without Policy", func(t *testing.T) {
+		f := newFixture(t)
+		f.policy.settings = nil
+
+		device, err := f.devices.CheckLoginDevice(ctx, userID, uuid.Nil, userAgent)
+		if err != nil || device != nil {
+			t.Errorf("Expected a login without a device to be let through, got %v", err)
+		}
+		if err := f.devices.RegisterDevice(ctx, userID, models.Device{Name: "Phone", Type: "mobile"}); err != nil {
+			t.Fatalf("Failed to register device: %v", err)
+		}
+		for _, device := range f.repo.devices {
+			if device.Status != "authorized" {
+				t.Errorf("Expected devices to be authorized without the policy, got %s", device.Status)
+			}
+		}
+	})
+}
+
+func TestDeviceKeyRegistration(t *testing.T) {
+	ctx := context.Background()
+	userID := uuid.New()
+	userAgent := "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"
+
+	// signed returns a context carrying a proof signed by the key with the thumbprint
+	signed := func(thumbprint string) context.Context {
+		return services.ContextWithDPoPProof(ctx, &services.DPoPProof{Thumbprint: thumbprint, PublicKey: []byte(`{"kty":"OKP"}`)})
+	}
+
+	// newFixture sets up a user with one authorized device registered without a key; the
+	// policy is off unless approval is true
+	newFixture := func(approval bool) (services.DeviceService, *approvalRepository, uuid.UUID) {
+		trusted := uuid.New()
+		repo := &approvalRepository{
+			users: map[uuid.UUID]*models.User{userID: {Base: models.Base{ID: userID}, Email: "member@example.com"}},
+			devices: map[uuid.UUID]*models.Device{
+				trusted: {Base: models.Base{ID: trusted}, UserID: userID, Name: "Laptop", Status: "authorized"},
+			},
+			memberships: []models.OrganizationUser{{UserID: userID, OrganizationID: uuid.New(), Status: "confirmed"}},
+		}
+		policy := &approvalPolicy{}
+		if approval {
+			policy.settings = &services.DeviceApprovalPolicySettings{}
+		}
+		devices := services.NewDeviceService(repo, nil, policy, &notifiedUsers{}, services.NewPermissionResolver(repo, nil), nil, nil)
+		return devices, repo, trusted
+	}
+
+	t.Run("Registers Key With New Device", func(t *testing.T) {
+		devices, repo, trusted := newFixture(true)
+
+		_, err := devices.CheckLoginDevice(signed("device-key"), userID, uuid.Nil, userAgent)
+		var pending *services.DevicePendingError
+		if !errors.As(err, &pending) {
+			t.Fatalf("Expected the new device to wait for approval, got %v", err)
+		}
+		if repo.devices[pending.DeviceID].KeyThumbprint != "device-key" {
+			t.Fatalf("Expected the key to be registered with the device, got %q", repo.devices[pending.DeviceID].KeyThumbprint)
+		}
+		if err := devices.ReviewDevice(ctx, userID, trusted, pending.DeviceID, true); err != nil {
+			t.Fatalf("Failed to approve device: %v", err)
+		}
+
+		if _, err := devices.CheckLoginDevice(signed("other-key"), userID, pending.DeviceID, userAgent); !errors.Is(err, services.ErrInvalidDPoPProof) {
+			t.Errorf("Expected a login signed by another key to be refused, got %v", err)
+		}
+		if _, err := devices.CheckLoginDevice(ctx, userID, pending.DeviceID, userAgent); !errors.Is(err, services.ErrDPoPProofRequired) {
+			t.Errorf("Expected a login without a proof to be refused, got %v", err)
+		}
+		if _, err := devices.CheckLoginDevice(signed("device-key"), userID, pending.DeviceID, userAgent); err != nil {
+			t.Errorf("Expected a login signed by the device key to pass, got %v", err)
+		}
+	})
+
+	t.Run("Login Does Not Register Key", func(t *testing.T) {
+		devices, repo, trusted := newFixture(false)
+
+		if _, err := devices.CheckLoginDevice(signed("first-key"), userID, trusted, userAgent); err != nil {
+			t.Fatalf("Expected the login to pass, got %v", err)
+		}
+		if repo.devices[trusted].KeyThumbprint != "" {
+			t.Errorf("Expected the proof of a login not to register a key, got %q", repo.devices[trusted].KeyThumbprint)
+		}
+	})
+
+	t.Run("Registers Key From Own Session", func(t *testing.T) {
+		devices, repo, trusted := newFixture(false)
+
+		if err := devices.RegisterDeviceKey(signed("device-key"), userID, uuid.New(), trusted); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected another device to be refused, got %v", err)
+		}
+		if err := devices.RegisterDeviceKey(ctx, userID, trusted, trusted); !errors.Is(err, services.ErrDPoPProofRequired) {
+			t.Errorf("Expected a request without a proof to be refused, got %v", err)
+		}
+		if err := devices.RegisterDeviceKey(signed("device-key"), userID, trusted, trusted); err != nil {
+			t.Fatalf("Failed to register key: %v", err)
+		}
+		if repo.devices[trusted].KeyThumbprint != "device-key" {
+			t.Errorf("Expected the key to be registered, got %q", repo.devices[trusted].KeyThumbprint)
+		}
+		if err := devices.RegisterDeviceKey(signed("other-key"), userID, trusted, trusted); !errors.Is(err, services.ErrDeviceKeyRegistered) {
+			t.Errorf("Expected the registered key not to be replaced, got %v", err)
+		}
+	})
+}
+
+// approvedRequest signs in with every login request as the same user
+type approvedRequest struct {
+	services.DeviceService
+	user *models.User
+}
+
+func (d *approvedRequest) CompleteAuthRequest(ctx context.Context, requestID uuid.UUID, accessCode string) (*services.AuthRequestLoginResult, error) {
+	return &services.AuthRequestLoginResult{User: d.user, EncryptedUserKey: "sealed"}, nil
+}
+
+func TestAuthRequestLoginChecks(t *testing.T) {
+	ctx := context.Background()
+	user := &models.User{Base: models.Base{ID: uuid.New()}, Email: "user@example.com"}
+
+	tests := []struct {
+		name    string
+		locked  bool
+		blocked bool
+		want    error
+	}{
+		{"Signs In", false, false, nil},
+		{"Refuses Locked Account", true, false, services.ErrAccountLocked},
+		{"Refuses Suspicious Login", false, true, services.ErrSuspiciousLoginBlocked},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			protection := &passwordProtection{user: user, locked: tt.locked}
+			devices := services.NewLoginCheckingDeviceService(&approvedRequest{user: user}, &decidingRisk{blocked: tt.blocked}, protection)
+
+			result, err := devices.CompleteAuthRequest(ctx, uuid.New(), "access code")
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, err)
+			}
+			if tt.want == nil && (result == nil || result.User.ID != user.ID) {
+				t.Errorf("Expected the user to be signed in, got %+v", result)
+			}
+		})
+	}
+}
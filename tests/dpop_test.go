@@ -0,0 +1,219 @@
+package tests
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/api"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+)
+
+const dpopTargetURL = "https://vault.example.com/api/auth/sessions"
+
+func signDPoPProof(t *testing.T, header, claims map[string]interface{}, sign func([]byte) []byte) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatalf("Failed to encode header: %v", err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("Failed to encode claims: %v", err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func es256Signer(t *testing.T) (map[string]interface{}, func([]byte) []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	jwk := map[string]interface{}{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+	return jwk, func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("Failed to sign proof: %v", err)
+		}
+		return append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	}
+}
+
+func dpopClaims(method string, issuedAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"jti": base64.RawURLEncoding.EncodeToString([]byte(issuedAt.String())),
+		"htm": method,
+		"htu": dpopTargetURL,
+		"iat": issuedAt.Unix(),
+	}
+}
+
+func TestParseDPoPProof(t *testing.T) {
+	now := time.Now()
+	jwk, sign := es256Signer(t)
+	header := map[string]interface{}{"typ": "dpop+jwt", "alg": "ES256", "jwk": jwk}
+
+	proof, err := services.ParseDPoPProof(signDPoPProof(t, header, dpopClaims("GET", now), sign), "GET", dpopTargetURL, now)
+	if err != nil {
+		t.Fatalf("Failed to verify proof: %v", err)
+	}
+
+	t.Run("Thumbprint Stable", func(t *testing.T) {
+		other, err := services.ParseDPoPProof(signDPoPProof(t, header, dpopClaims("GET", now.Add(-time.Second)), sign), "GET", dpopTargetURL, now)
+		if err != nil {
+			t.Fatalf("Failed to verify proof: %v", err)
+		}
+		if proof.Thumbprint == "" || other.Thumbprint != proof.Thumbprint {
+			t.Errorf("Expected the same thumbprint for one key, got %q and %q", proof.Thumbprint, other.Thumbprint)
+		}
+	})
+
+	t.Run("Query Ignored", func(t *testing.T) {
+		claims := dpopClaims("GET", now)
+		claims["htu"] = "https://VAULT.example.com/api/auth/sessions?page=2"
+		if _, err := services.ParseDPoPProof(signDPoPProof(t, header, claims, sign), "GET", dpopTargetURL, now); err != nil {
+			t.Errorf("Expected proof to be accepted, got %v", err)
+		}
+	})
+
+	t.Run("Ed25519", func(t *testing.T) {
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		edHeader := map[string]interface{}{
+			"typ": "dpop+jwt",
+			"alg": "EdDSA",
+			"jwk": map[string]interface{}{"kty": "OKP", "crv": "Ed25519", "x": base64.RawURLEncoding.EncodeToString(public)},
+		}
+		edSign := func(input []byte) []byte { return ed25519.Sign(private, input) }
+		if _, err := services.ParseDPoPProof(signDPoPProof(t, edHeader, dpopClaims("POST", now), edSign), "POST", dpopTargetURL, now); err != nil {
+			t.Errorf("Expected proof to be accepted, got %v", err)
+		}
+	})
+
+	rejected := []struct {
+		name   string
+		proof  func() string
+		method string
+	}{
+		{"Wrong Method", func() string { return signDPoPProof(t, header, dpopClaims("GET", now), sign) }, "DELETE"},
+		{"Wrong URL", func() string {
+			claims := dpopClaims("GET", now)
+			claims["htu"] = "https://vault.example.com/api/devices/"
+			return signDPoPProof(t, header, claims, sign)
+		}, "GET"},
+		{"Too Old", func() string { return signDPoPProof(t, header, dpopClaims("GET", now.Add(-10*time.Minute)), sign) }, "GET"},
+		{"From The Future", func() string { return signDPoPProof(t, header, dpopClaims("GET", now.Add(5*time.Minute)), sign) }, "GET"},
+		{"Wrong Type", func() string {
+			return signDPoPProof(t, map[string]interface{}{"typ": "JWT", "alg": "ES256", "jwk": jwk}, dpopClaims("GET", now), sign)
+		}, "GET"},
+		{"Private Key", func() string {
+			private := map[string]interface{}{"d": "c2VjcmV0"}
+			for k, v := range jwk {
+				private[k] = v
+			}
+			return signDPoPProof(t, map[string]interface{}{"typ": "dpop+jwt", "alg": "ES256", "jwk": private}, dpopClaims("GET", now), sign)
+		}, "GET"},
+		{"Bad Signature", func() string {
+			_, otherSign := es256Signer(t)
+			return signDPoPProof(t, header, dpopClaims("GET", now), otherSign)
+		}, "GET"},
+	}
+	for _, tc := range rejected {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := services.ParseDPoPProof(tc.proof(), tc.method, dpopTargetURL, now)
+			if !errors.Is(err, services.ErrInvalidDPoPProof) {
+				t.Errorf("Expected ErrInvalidDPoPProof, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckDPoPBinding(t *testing.T) {
+	token := "session-token"
+	ctx := services.ContextWithDPoPProof(context.Background(), &services.DPoPProof{
+		Thumbprint:      "thumbprint",
+		AccessTokenHash: services.DPoPAccessTokenHash(token),
+	})
+
+	if err := services.CheckDPoPBinding(context.Background(), "", token); err != nil {
+		t.Errorf("Expected unbound token to need no proof, got %v", err)
+	}
+	if err := services.CheckDPoPBinding(ctx, "thumbprint", token); err != nil {
+		t.Errorf("Expected bound token to be accepted, got %v", err)
+	}
+	if err := services.CheckDPoPBinding(context.Background(), "thumbprint", token); !errors.Is(err, services.ErrDPoPProofRequired) {
+		t.Errorf("Expected ErrDPoPProofRequired, got %v", err)
+	}
+	if err := services.CheckDPoPBinding(ctx, "other", token); !errors.Is(err, services.ErrInvalidDPoPProof) {
+		t.Errorf("Expected ErrInvalidDPoPProof for another key, got %v", err)
+	}
+	if err := services.CheckDPoPBinding(ctx, "thumbprint", "other-token"); !errors.Is(err, services.ErrInvalidDPoPProof) {
+		t.Errorf("Expected ErrInvalidDPoPProof for another token, got %v", err)
+	}
+}
+
+// usedProofs remembers recorded DPoP proofs in memory; any other call panics
+type usedProofs struct {
+	repository.Repository
+	hashes map[string]bool
+}
+
+func (r *usedProofs) RecordDPoPProof(ctx context.Context, proofHash string, expiresAt time.Time) (bool, error) {
+	if r.hashes[proofHash] {
+		return false, nil
+	}
+	r.hashes[proofHash] = true
+	return true, nil
+}
+
+func TestDPoPRoutes(t *testing.T) {
+	jwk, sign := es256Signer(t)
+	header := map[string]interface{}{"typ": "dpop+jwt", "alg": "ES256", "jwk": jwk}
+	routes := api.SetupRoutes(services.NewDPoPService(&usedProofs{hashes: make(map[string]bool)}), "https://vault.example.com/")
+
+	// send calls the sessions endpoint with the given proofs and returns the status
+	send := func(proofs ...string) int {
+		req := httptest.NewRequest("GET", "/api/auth/sessions", nil)
+		for _, proof := range proofs {
+			req.Header.Add("DPoP", proof)
+		}
+		w := httptest.NewRecorder()
+		routes.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	proof := signDPoPProof(t, header, dpopClaims("GET", time.Now()), sign)
+	if code := send(proof); code == http.StatusUnauthorized {
+		t.Fatal("Expected a valid proof to be accepted")
+	}
+	if code := send(proof); code != http.StatusUnauthorized {
+		t.Errorf("Expected a replayed proof to be refused, got %d", code)
+	}
+	if code := send(signDPoPProof(t, header, dpopClaims("POST", time.Now()), sign)); code != http.StatusUnauthorized {
+		t.Errorf("Expected a proof for another method to be refused, got %d", code)
+	}
+	if code := send(); code == http.StatusUnauthorized {
+		t.Errorf("Expected a request without a proof to pass through, got %d", code)
+	}
+}
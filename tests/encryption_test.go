@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+)
+
+func TestEncryptionService(t *testing.T) {
+	encryption := services.NewEncryptionService()
+	secret := []byte("organization key material")
+
+	t.Run("Default Algorithm", func(t *testing.T) {
+		publicKey, _, err := encryption.GenerateKeyPair()
+		if err != nil {
+			t.Fatalf("Failed to generate key pair: %v", err)
+		}
+		algorithm, err := encryption.KeyAlgorithmOf(publicKey)
+		if err != nil {
+			t.Fatalf("Failed to read key algorithm: %v", err)
+		}
+		if algorithm != services.KeyAlgorithmX25519HPKE {
+			t.Errorf("Expected %s, got %s", services.KeyAlgorithmX25519HPKE, algorithm)
+		}
+	})
+
+	for _, algorithm := range []services.KeyAlgorithm{services.KeyAlgorithmX25519HPKE, services.KeyAlgorithmRSAOAEP} {
+		t.Run("Key Wrap "+string(algorithm), func(t *testing.T) {
+			publicKey, privateKey, err := encryption.GenerateKeyPairWithAlgorithm(algorithm)
+			if err != nil {
+				t.Fatalf("Failed to generate key pair: %v", err)
+			}
+			if _, err := encryption.ValidatePublicKey(publicKey); err != nil {
+				t.Errorf("Expected generated key to be valid, got error: %v", err)
+			}
+
+			ciphertext, err := encryption.EncryptWithPublicKey(secret, publicKey)
+			if err != nil {
+				t.Fatalf("Failed to encrypt: %v", err)
+			}
+			plaintext, err := encryption.DecryptWithPrivateKey(ciphertext, privateKey)
+			if err != nil {
+				t.Fatalf("Failed to decrypt: %v", err)
+			}
+			if !bytes.Equal(plaintext, secret) {
+				t.Error("Decrypted data does not match")
+			}
+
+			ciphertext[len(ciphertext)-1] ^= 0xff
+			if _, err := encryption.DecryptWithPrivateKey(ciphertext, privateKey); err == nil {
+				t.Error("Expected tampered ciphertext to be rejected")
+			}
+		})
+	}
+
+	t.Run("Sign And Verify", func(t *testing.T) {
+		publicKey, privateKey, err := encryption.GenerateKeyPairWithAlgorithm(services.KeyAlgorithmEd25519)
+		if err != nil {
+			t.Fatalf("Failed to generate key pair: %v", err)
+		}
+
+		signature, err := encryption.Sign(secret, privateKey)
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		if err := encryption.Verify(secret, signature, publicKey); err != nil {
+			t.Errorf("Expected valid signature, got error: %v", err)
+		}
+		if err := encryption.Verify([]byte("other data"), signature, publicKey); !errors.Is(err, services.ErrInvalidSignature) {
+			t.Errorf("Expected ErrInvalidSignature, got %v", err)
+		}
+		if _, err := encryption.EncryptWithPublicKey(secret, publicKey); !errors.Is(err, services.ErrUnsupportedKeyAlgorithm) {
+			t.Errorf("Expected signing key to be rejected for encryption, got %v", err)
+		}
+	})
+
+	t.Run("Legacy RSA Keys", func(t *testing.T) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("Failed to generate RSA key: %v", err)
+		}
+		publicKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(&key.PublicKey)})
+		privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+		ciphertext, err := encryption.EncryptWithPublicKey(secret, publicKey)
+		if err != nil {
+			t.Fatalf("Failed to encrypt with legacy key: %v", err)
+		}
+		plaintext, err := encryption.DecryptWithPrivateKey(ciphertext, privateKey)
+		if err != nil || !bytes.Equal(plaintext, secret) {
+			t.Errorf("Expected legacy key to decrypt, got error: %v", err)
+		}
+
+		if _, err := encryption.ValidatePublicKey(publicKey); !errors.Is(err, services.ErrKeyTooWeak) {
+			t.Errorf("Expected ErrKeyTooWeak for RSA-2048, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,334 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// groupRepository keeps one organization's roles, members, groups, collections and
+// items in memory. A member's permissions are the union of their own role's and those
+// of their groups' roles; any other call panics.
+type groupRepository struct {
+	repository.Repository
+	orgID            uuid.UUID
+	roles            map[uuid.UUID][]string
+	members          map[uuid.UUID]uuid.UUID
+	groups           map[uuid.UUID]*models.Group
+	groupUsers       map[uuid.UUID]map[uuid.UUID]bool
+	collections      map[uuid.UUID]*models.Collection
+	collectionGroups map[uuid.UUID]map[uuid.UUID]string
+	items            []models.VaultItem
+}
+
+func (r *groupRepository) GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	roleID, ok := r.members[userID]
+	if !ok || orgID != r.orgID {
+		return nil, nil
+	}
+	return &models.OrganizationUser{OrganizationID: orgID, UserID: userID, RoleID: &roleID, Status: "confirmed"}, nil
+}
+
+func (r *groupRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	roleID, ok := r.members[userID]
+	if !ok || orgID != r.orgID {
+		return nil, nil
+	}
+	roleIDs := []uuid.UUID{roleID}
+	for groupID, users := range r.groupUsers {
+		if group := r.groups[groupID]; users[userID] && group.RoleID != nil {
+			roleIDs = append(roleIDs, *group.RoleID)
+		}
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, id := range roleIDs {
+		for _, name := range r.roles[id] {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+func (r *groupRepository) GetGroup(ctx context.Context, id uuid.UUID) (*models.Group, error) {
+	if group, ok := r.groups[id]; ok {
+		found := *group
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *groupRepository) GetGroupByExternalID(ctx context.Context, orgID uuid.UUID, externalID string) (*models.Group, error) {
+	for _, group := range r.groups {
+		if group.OrganizationID == orgID && group.ExternalID == externalID {
+			found := *group
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *groupRepository) CreateGroup(ctx context.Context, group *models.Group) error {
+	group.ID = uuid.New()
+	stored := *group
+	r.groups[group.ID] = &stored
+	r.groupUsers[group.ID] = make(map[uuid.UUID]bool)
+	return nil
+}
+
+func (r *groupRepository) UpdateGroup(ctx context.Context, group *models.Group) error {
+	stored := *group
+	r.groups[group.ID] = &stored
+	return nil
+}
+
+func (r *groupRepository) AddGroupUser(ctx context.Context, membership *models.GroupUser) error {
+	r.groupUsers[membership.GroupID][membership.UserID] = true
+	return nil
+}
+
+func (r *groupRepository) RemoveGroupUser(ctx context.Context, groupID, userID uuid.UUID) error {
+	delete(r.groupUsers[groupID], userID)
+	return nil
+}
+
+func (r *groupRepository) ListGroupUsers(ctx context.Context, groupID uuid.UUID) ([]models.GroupUser, error) {
+	var memberships []models.GroupUser
+	for userID := range r.groupUsers[groupID] {
+		memberships = append(memberships, models.GroupUser{GroupID: groupID, UserID: userID})
+	}
+	return memberships, nil
+}
+
+func (r *groupRepository) ReplaceGroupUsers(ctx context.Context, groupID uuid.UUID, userIDs []uuid.UUID) error {
+	r.groupUsers[groupID] = make(map[uuid.UUID]bool)
+	for _, userID := range userIDs {
+		r.groupUsers[groupID][userID] = true
+	}
+	return nil
+}
+
+func (r *groupRepository) GetCollection(ctx context.Context, id uuid.UUID) (*models.Collection, error) {
+	return r.collections[id], nil
+}
+
+func (r *groupRepository) SetCollectionGroup(ctx context.Context, grant *models.CollectionGroup) error {
+	r.collectionGroups[grant.GroupID][grant.CollectionID] = grant.Access
+	return nil
+}
+
+func (r *groupRepository) RemoveCollectionGroup(ctx context.Context, collectionID, groupID uuid.UUID) error {
+	delete(r.collectionGroups[groupID], collectionID)
+	return nil
+}
+
+func (r *groupRepository) ListUserCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionUser, error) {
+	return nil, nil
+}
+
+func (r *groupRepository) ListUserGroupCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionGroup, error) {
+	var grants []models.CollectionGroup
+	for groupID, collections := range r.collectionGroups {
+		if !r.groupUsers[groupID][userID] {
+			continue
+		}
+		for collectionID, access := range collections {
+			grants = append(grants, models.CollectionGroup{CollectionID: collectionID, GroupID: groupID, Access: access})
+		}
+	}
+	return grants, nil
+}
+
+func (r *groupRepository) ListOrganizationVaultItems(ctx context.Context, orgID uuid.UUID) ([]models.VaultItem, error) {
+	return r.items, nil
+}
+
+func (r *groupRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+func TestGroupService(t *testing.T) {
+	ctx := context.Background()
+	orgID := uuid.New()
+	ownerID, adminID, userID := uuid.New(), uuid.New(), uuid.New()
+	roleIDs := make(map[string]uuid.UUID)
+	for _, template := range services.RoleTemplates {
+		roleIDs[template.Name] = uuid.New()
+	}
+
+	// newFixture sets up an Owner, an Admin and a User, a group holding the Owner role,
+	// a group holding the Manager role and a group synced from a directory that holds
+	// the Owner role. The organization has one item in a collection no one was granted.
+	newFixture := func() (services.GroupService, services.PermissionResolver, *groupRepository) {
+		repo := &groupRepository{
+			orgID:            orgID,
+			roles:            make(map[uuid.UUID][]string),
+			members:          map[uuid.UUID]uuid.UUID{ownerID: roleIDs[services.RoleOwner], adminID: roleIDs[services.RoleAdmin], userID: roleIDs[services.RoleUser]},
+			groups:           make(map[uuid.UUID]*models.Group),
+			groupUsers:       make(map[uuid.UUID]map[uuid.UUID]bool),
+			collections:      make(map[uuid.UUID]*models.Collection),
+			collectionGroups: make(map[uuid.UUID]map[uuid.UUID]string),
+		}
+		for _, template := range services.RoleTemplates {
+			repo.roles[roleIDs[template.Name]] = template.Permissions
+		}
+		for _, group := range []models.Group{
+			{Name: "Owners", RoleID: ptrTo(roleIDs[services.RoleOwner])},
+			{Name: "Managers", RoleID: ptrTo(roleIDs[services.RoleManager])},
+			{Name: "Staff"},
+			{Name: "Directory Owners", ExternalID: "cn=owners", RoleID: ptrTo(roleIDs[services.RoleOwner])},
+		} {
+			group := group
+			group.Base = models.Base{ID: uuid.New()}
+			group.OrganizationID = orgID
+			repo.groups[group.ID] = &group
+			repo.groupUsers[group.ID] = make(map[uuid.UUID]bool)
+			repo.collectionGroups[group.ID] = make(map[uuid.UUID]string)
+		}
+		collectionID := uuid.New()
+		repo.collections[collectionID] = &models.Collection{ID: collectionID, OrganizationID: orgID}
+		repo.items = []models.VaultItem{{Base: models.Base{ID: uuid.New()}, OrganizationID: orgID, CollectionID: &collectionID}}
+
+		resolver := services.NewPermissionResolver(repo, &memoryCache{values: make(map[string]interface{})})
+		return services.NewGroupService(repo, resolver, nil), resolver, repo
+	}
+
+	groupNamed := func(repo *groupRepository, name string) uuid.UUID {
+		for id, group := range repo.groups {
+			if group.Name == name {
+				return id
+			}
+		}
+		return uuid.Nil
+	}
+
+	t.Run("Admin Cannot Join Group With Owner Role", func(t *testing.T) {
+		groups, resolver, repo := newFixture()
+		owners := groupNamed(repo, "Owners")
+
+		if err := groups.AddGroupMember(ctx, orgID, adminID, owners, adminID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected an admin without manage_roles to be refused, got %v", err)
+		}
+		if err := groups.AddGroupMember(ctx, orgID, adminID, owners, userID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected an admin without manage_roles to be refused, got %v", err)
+		}
+		if len(repo.groupUsers[owners]) != 0 {
+			t.Errorf("Expected the group to stay empty, got %d members", len(repo.groupUsers[owners]))
+		}
+		if allowed, _ := resolver.HasPermission(ctx, adminID, orgID, services.PermissionManageRoles); allowed {
+			t.Error("Expected the admin not to gain manage_roles")
+		}
+
+		if err := groups.AddGroupMember(ctx, orgID, ownerID, owners, adminID); err != nil {
+			t.Errorf("Expected the owner to add members to the group, got %v", err)
+		}
+		if err := groups.AddGroupMember(ctx, orgID, adminID, groupNamed(repo, "Staff"), userID); err != nil {
+			t.Errorf("Expected the admin to add members to a group without a role, got %v", err)
+		}
+	})
+
+	t.Run("Directory Sync Checks The Admin", func(t *testing.T) {
+		groups, _, repo := newFixture()
+		owners := groupNamed(repo, "Directory Owners")
+
+		if _, err := groups.SyncGroup(ctx, orgID, userID, "cn=staff", "Staff", []uuid.UUID{userID}); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without manage_groups to be refused, got %v", err)
+		}
+		if _, err := groups.SyncGroup(ctx, orgID, adminID, "cn=owners", "Directory Owners", []uuid.UUID{adminID}); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected an admin without manage_roles to be refused, got %v", err)
+		}
+		if len(repo.groupUsers[owners]) != 0 {
+			t.Errorf("Expected the group to stay empty, got %d members", len(repo.groupUsers[owners]))
+		}
+
+		if _, err := groups.SyncGroup(ctx, orgID, adminID, "cn=staff", "Staff", []uuid.UUID{userID}); err != nil {
+			t.Errorf("Expected the admin to sync a group without a role, got %v", err)
+		}
+		if _, err := groups.SyncGroup(ctx, orgID, ownerID, "cn=owners", "Directory Owners", []uuid.UUID{adminID}); err != nil {
+			t.Fatalf("Expected the owner to sync the group, got %v", err)
+		}
+		// Removing members hands out nothing
+		if _, err := groups.SyncGroup(ctx, orgID, adminID, "cn=owners", "Directory Owners", nil); err != nil {
+			t.Errorf("Expected the admin to remove members of the group, got %v", err)
+		}
+	})
+
+	t.Run("Permissions Are Union Of Own And Group Roles", func(t *testing.T) {
+		groups, resolver, repo := newFixture()
+		managers := groupNamed(repo, "Managers")
+
+		// Cache the user's own permissions first; joining must evict them
+		if allowed, _ := resolver.HasPermission(ctx, userID, orgID, services.PermissionManageCollections); allowed {
+			t.Fatal("Expected the user not to manage collections on their own")
+		}
+		if err := groups.AddGroupMember(ctx, orgID, ownerID, managers, userID); err != nil {
+			t.Fatalf("Failed to add group member: %v", err)
+		}
+		for _, permission := range []string{services.PermissionManageCollections, services.PermissionCreateVaultItem, services.PermissionReadVaultItems} {
+			if allowed, _ := resolver.HasPermission(ctx, userID, orgID, permission); !allowed {
+				t.Errorf("Expected the user to hold %s", permission)
+			}
+		}
+		if allowed, _ := resolver.HasPermission(ctx, userID, orgID, services.PermissionManageMembers); allowed {
+			t.Error("Expected the user not to gain permissions neither role grants")
+		}
+
+		if err := groups.RemoveGroupMember(ctx, orgID, ownerID, managers, userID); err != nil {
+			t.Fatalf("Failed to remove group member: %v", err)
+		}
+		if allowed, _ := resolver.HasPermission(ctx, userID, orgID, services.PermissionManageCollections); allowed {
+			t.Error("Expected the user to lose the group role's permissions")
+		}
+		if allowed, _ := resolver.HasPermission(ctx, userID, orgID, services.PermissionCreateVaultItem); !allowed {
+			t.Error("Expected the user to keep their own role's permissions")
+		}
+	})
+
+	t.Run("Group Collection Grant", func(t *testing.T) {
+		groups, resolver, repo := newFixture()
+		staff := groupNamed(repo, "Staff")
+		collectionID := *repo.items[0].CollectionID
+		svc := services.NewService(repo, nil, nil, resolver, nil, nil)
+
+		if err := groups.AddGroupMember(ctx, orgID, ownerID, staff, userID); err != nil {
+			t.Fatalf("Failed to add group member: %v", err)
+		}
+		if items, _ := svc.GetVaultItems(ctx, userID, orgID); len(items) != 0 {
+			t.Fatalf("Expected no items before the grant, got %d", len(items))
+		}
+
+		if err := groups.SetGroupCollectionAccess(ctx, orgID, adminID, staff, uuid.New(), services.CollectionAccessView); !errors.Is(err, services.ErrInvalidOperation) {
+			t.Errorf("Expected a collection outside the organization to be refused, got %v", err)
+		}
+		if err := groups.SetGroupCollectionAccess(ctx, orgID, adminID, staff, collectionID, services.CollectionAccessView); err != nil {
+			t.Fatalf("Failed to grant collection: %v", err)
+		}
+		items, err := svc.GetVaultItems(ctx, userID, orgID)
+		if err != nil {
+			t.Fatalf("Failed to list items: %v", err)
+		}
+		if len(items) != 1 || items[0].ID != repo.items[0].ID {
+			t.Errorf("Expected the group's collection item, got %d items", len(items))
+		}
+
+		if err := groups.RemoveGroupCollection(ctx, orgID, adminID, staff, collectionID); err != nil {
+			t.Fatalf("Failed to revoke collection: %v", err)
+		}
+		if items, _ := svc.GetVaultItems(ctx, userID, orgID); len(items) != 0 {
+			t.Errorf("Expected no items after the grant is revoked, got %d", len(items))
+		}
+	})
+}
+
+func ptrTo(id uuid.UUID) *uuid.UUID {
+	return &id
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/emailimmunity/passwordimmunity/src/keyconnector"
+	"github.com/google/uuid"
+)
+
+func TestKeyConnector(t *testing.T) {
+	signingKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate signing key: %v", err)
+	}
+
+	// The JWKS handler needs the issuer, which needs the server URL
+	var issuer *services.KeyConnectorTokenIssuer
+	passwordServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		jwks, err := issuer.JWKS()
+		if err != nil {
+			t.Errorf("Failed to build JWKS: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jwks)
+	}))
+	defer passwordServer.Close()
+
+	issuer, err = services.NewKeyConnectorTokenIssuer(signingKey, passwordServer.URL)
+	if err != nil {
+		t.Fatalf("Failed to create token issuer: %v", err)
+	}
+
+	const audience = "https://keys.example.com"
+	dataDir := t.TempDir()
+	store, err := keyconnector.NewFileStore(dataDir)
+	if err != nil {
+		t.Fatalf("Failed to create store: %v", err)
+	}
+	wrappingKey := make([]byte, 32)
+	rand.Read(wrappingKey)
+	connector, err := keyconnector.NewServer(keyconnector.Config{
+		Issuer:      passwordServer.URL,
+		Audience:    audience,
+		JWKSURL:     passwordServer.URL + "/api/key-connector/jwks",
+		WrappingKey: wrappingKey,
+		Store:       store,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create key connector: %v", err)
+	}
+	server := httptest.NewServer(connector.Handler())
+	defer server.Close()
+
+	request := func(method, token, key string) *http.Response {
+		var body bytes.Buffer
+		if key != "" {
+			json.NewEncoder(&body).Encode(map[string]string{"key": key})
+		}
+		req, _ := http.NewRequest(method, server.URL+"/user-keys", &body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		return resp
+	}
+	issue := func(userID uuid.UUID, audience string, ttl time.Duration) string {
+		token, _, err := issuer.Issue(userID, audience, ttl)
+		if err != nil {
+			t.Fatalf("Failed to issue token: %v", err)
+		}
+		return token
+	}
+
+	userID := uuid.New()
+	const userKey = "2.wrapped-user-key|iv|mac"
+
+	t.Run("Store And Read Key", func(t *testing.T) {
+		token := issue(userID, audience, time.Minute)
+
+		resp := request(http.MethodPost, token, userKey)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("Expected 204 storing the key, got %d", resp.StatusCode)
+		}
+
+		resp = request(http.MethodPost, token, userKey)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected 409 storing the key twice, got %d", resp.StatusCode)
+		}
+
+		resp = request(http.MethodGet, token, "")
+		defer resp.Body.Close()
+		var body struct {
+			Key string `json:"key"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != http.StatusOK || body.Key != userKey {
+			t.Errorf("Expected the stored key, got %d %q", resp.StatusCode, body.Key)
+		}
+	})
+
+	t.Run("Key Encrypted At Rest", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join(dataDir, userID.String()+".key"))
+		if err != nil {
+			t.Fatalf("Failed to read key file: %v", err)
+		}
+		if strings.Contains(string(data), "wrapped-user-key") {
+			t.Error("Expected the key file not to contain the plaintext key")
+		}
+	})
+
+	t.Run("Other User", func(t *testing.T) {
+		resp := request(http.MethodGet, issue(uuid.New(), audience, time.Minute), "")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Expected 404 for another user, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("Rejected Tokens", func(t *testing.T) {
+		forgedKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		forger, _ := services.NewKeyConnectorTokenIssuer(forgedKey, passwordServer.URL)
+		forged, _, _ := forger.Issue(userID, audience, time.Minute)
+
+		tokens := map[string]string{
+			"wrong audience": issue(userID, "https://other.example.com", time.Minute),
+			"expired":        issue(userID, audience, -time.Minute),
+			"forged":         forged,
+			"missing":        "",
+		}
+		for name, token := range tokens {
+			resp := request(http.MethodGet, token, "")
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Errorf("Expected 401 for %s token, got %d", name, resp.StatusCode)
+			}
+		}
+	})
+}
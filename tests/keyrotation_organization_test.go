@@ -0,0 +1,312 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// organizationRotationRepository adds the organization records of a key rotation to
+// keyRotationRepository; any other call panics
+type organizationRotationRepository struct {
+	*keyRotationRepository
+	members     []models.OrganizationUser
+	collections []models.Collection
+	claims      int
+	// onMembers runs the first time members are listed, while items are already rotated
+	onMembers func()
+}
+
+func (r *organizationRotationRepository) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error) {
+	var memberships []models.OrganizationUser
+	for _, member := range r.members {
+		if member.UserID == userID {
+			memberships = append(memberships, member)
+		}
+	}
+	return memberships, nil
+}
+
+func (r *organizationRotationRepository) ListOrganizationUsersByStatus(ctx context.Context, orgID uuid.UUID, status string) ([]models.OrganizationUser, error) {
+	if r.onMembers != nil {
+		r.onMembers()
+		r.onMembers = nil
+	}
+	var members []models.OrganizationUser
+	for _, member := range r.members {
+		if member.OrganizationID == orgID && member.Status == status {
+			members = append(members, member)
+		}
+	}
+	return members, nil
+}
+
+func (r *organizationRotationRepository) UpdateOrganizationUser(ctx context.Context, member *models.OrganizationUser) error {
+	for i := range r.members {
+		if r.members[i].UserID == member.UserID && r.members[i].OrganizationID == member.OrganizationID {
+			r.members[i] = *member
+		}
+	}
+	return nil
+}
+
+func (r *organizationRotationRepository) ListOrganizationVaultItemsByKeyVersion(ctx context.Context, orgID uuid.UUID, version, limit int) ([]models.VaultItem, error) {
+	var items []models.VaultItem
+	for _, item := range r.items {
+		if item.OrganizationID == orgID && item.KeyVersion == version && len(items) < limit {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (r *organizationRotationRepository) ListCollectionsByKeyVersion(ctx context.Context, orgID uuid.UUID, version, limit int) ([]models.Collection, error) {
+	var collections []models.Collection
+	for _, collection := range r.collections {
+		if collection.OrganizationID == orgID && collection.KeyVersion == version && len(collections) < limit {
+			collections = append(collections, collection)
+		}
+	}
+	return collections, nil
+}
+
+func (r *organizationRotationRepository) UpdateCollections(ctx context.Context, collections []models.Collection) error {
+	for _, updated := range collections {
+		for i := range r.collections {
+			if r.collections[i].ID == updated.ID {
+				r.collections[i] = updated
+			}
+		}
+	}
+	return nil
+}
+
+func (r *organizationRotationRepository) GetActiveOrganizationRecoveryKey(ctx context.Context, orgID uuid.UUID) (*models.OrganizationRecoveryKey, error) {
+	return nil, nil
+}
+
+func (r *organizationRotationRepository) ListStaleKeyRotationJobs(ctx context.Context, ownerType string, updatedBefore time.Time) ([]models.KeyRotationJob, error) {
+	var jobs []models.KeyRotationJob
+	for _, job := range r.jobs {
+		if job.OwnerType == ownerType && job.Status == "running" && job.UpdatedAt.Before(updatedBefore) {
+			jobs = append(jobs, *job)
+		}
+	}
+	return jobs, nil
+}
+
+func (r *organizationRotationRepository) ClaimKeyRotationJob(ctx context.Context, job *models.KeyRotationJob) (bool, error) {
+	r.claims++
+	for _, stored := range r.jobs {
+		if stored.ID == job.ID && stored.UpdatedAt.Equal(job.UpdatedAt) {
+			stored.UpdatedAt = time.Now()
+			job.UpdatedAt = stored.UpdatedAt
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *organizationRotationRepository) UpdateKeyRotationJob(ctx context.Context, job *models.KeyRotationJob) error {
+	for i, stored := range r.jobs {
+		if stored.ID == job.ID {
+			updated := *job
+			r.jobs[i] = &updated
+		}
+	}
+	return nil
+}
+
+// signedInSessions creates sessions without checking anything
+type signedInSessions struct {
+	services.SessionService
+}
+
+func (s *signedInSessions) CreateSession(ctx context.Context, userID, deviceID uuid.UUID, deviceInfo string) (*models.Session, error) {
+	return &models.Session{Base: models.Base{ID: uuid.New()}, UserID: userID}, nil
+}
+
+func TestOrganizationKeyRotation(t *testing.T) {
+	encryption := services.NewEncryptionService()
+	masterKey, _ := encryption.GenerateSymmetricKey()
+	orgID, memberID := uuid.New(), uuid.New()
+	ctx := context.Background()
+
+	publicKey, privateKey, err := encryption.GenerateKeyPairWithAlgorithm(services.DefaultKeyAlgorithm)
+	if err != nil {
+		t.Fatalf("Failed to generate key pair: %v", err)
+	}
+
+	orgKey := func(t *testing.T, version int, active bool) ([]byte, *models.EncryptionKey) {
+		t.Helper()
+		key, err := encryption.GenerateSymmetricKey()
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		wrapped, _ := encryption.EncryptSymmetric(key, masterKey)
+		return key, &models.EncryptionKey{
+			Base:       models.Base{ID: uuid.New()},
+			OwnerType:  "organization",
+			OwnerID:    orgID,
+			Version:    version,
+			WrappedKey: string(wrapped),
+			IsActive:   active,
+		}
+	}
+
+	// newRepository sets up an organization at key version 1 with one member and one item
+	newRepository := func(t *testing.T) (*organizationRotationRepository, []byte) {
+		t.Helper()
+		oldKey, oldRecord := orgKey(t, 1, true)
+		data, _ := encryption.EncryptSymmetric([]byte("item"), oldKey)
+		repo := &organizationRotationRepository{
+			keyRotationRepository: &keyRotationRepository{
+				keys: []*models.EncryptionKey{
+					oldRecord,
+					{Base: models.Base{ID: uuid.New()}, OwnerType: "user", OwnerID: memberID, Version: 1, PublicKey: string(publicKey), IsActive: true},
+				},
+				items: []models.VaultItem{{Base: models.Base{ID: uuid.New()}, OrganizationID: orgID, EncryptedData: string(data), KeyVersion: 1}},
+			},
+			members: []models.OrganizationUser{{UserID: memberID, OrganizationID: orgID, Status: "confirmed", KeyVersion: 1}},
+		}
+		return repo, oldKey
+	}
+
+	memberKey := func(t *testing.T, member models.OrganizationUser) []byte {
+		t.Helper()
+		wrapped, err := base64.StdEncoding.DecodeString(member.EncryptedKey)
+		if err != nil {
+			t.Fatalf("Failed to decode member key: %v", err)
+		}
+		key, err := encryption.DecryptWithPrivateKey(wrapped, privateKey)
+		if err != nil {
+			t.Fatalf("Failed to unwrap member key: %v", err)
+		}
+		return key
+	}
+
+	t.Run("Resumes Stale Rotation", func(t *testing.T) {
+		repo, oldKey := newRepository(t)
+		newKey, newRecord := orgKey(t, 2, false)
+		repo.keys = append(repo.keys, newRecord)
+		// The server running the rotation stopped halfway through the items
+		moved, _ := encryption.EncryptSymmetric([]byte("moved"), newKey)
+		repo.items = append(repo.items, models.VaultItem{Base: models.Base{ID: uuid.New()}, OrganizationID: orgID, EncryptedData: string(moved), KeyVersion: 2})
+		repo.jobs = []*models.KeyRotationJob{{
+			Base:      models.Base{ID: uuid.New(), UpdatedAt: time.Now().Add(-time.Hour)},
+			OwnerType: "organization",
+			OwnerID:   orgID,
+			OldKeyID:  repo.keys[0].ID,
+			NewKeyID:  newRecord.ID,
+			Status:    "running",
+			Phase:     "items",
+		}}
+		rotation := services.NewKeyRotationService(repo, encryption, &retiringSessions{}, masterKey)
+
+		// A canceled context runs a single pass
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		rotation.ResumeOrganizationKeyRotations(canceled, time.Minute)
+
+		if repo.jobs[0].Status != "completed" {
+			t.Fatalf("Expected the rotation to complete, got %s: %s", repo.jobs[0].Status, repo.jobs[0].Error)
+		}
+		if !newRecord.IsActive {
+			t.Error("Expected the new key to be active")
+		}
+		for _, item := range repo.items {
+			if _, err := encryption.DecryptSymmetric([]byte(item.EncryptedData), newKey); item.KeyVersion != 2 || err != nil {
+				t.Errorf("Expected every item to be encrypted with the new key, got version %d, %v", item.KeyVersion, err)
+			}
+		}
+		if _, err := encryption.DecryptSymmetric([]byte(repo.items[0].EncryptedData), oldKey); err == nil {
+			t.Error("Expected the old key to no longer decrypt the item")
+		}
+		if repo.members[0].KeyVersion != 2 || string(memberKey(t, repo.members[0])) != string(newKey) {
+			t.Errorf("Expected the member to receive the new key, got version %d", repo.members[0].KeyVersion)
+		}
+	})
+
+	t.Run("Sweeps After Activation", func(t *testing.T) {
+		repo, oldKey := newRepository(t)
+		newKey, newRecord := orgKey(t, 2, false)
+		repo.keys = append(repo.keys, newRecord)
+		repo.jobs = []*models.KeyRotationJob{{
+			Base:      models.Base{ID: uuid.New(), UpdatedAt: time.Now().Add(-time.Hour)},
+			OwnerType: "organization",
+			OwnerID:   orgID,
+			OldKeyID:  repo.keys[0].ID,
+			NewKeyID:  newRecord.ID,
+			Status:    "running",
+			Phase:     "items",
+		}}
+		// A member who still holds the old key saves an item while the key is distributed
+		repo.onMembers = func() {
+			data, _ := encryption.EncryptSymmetric([]byte("late"), oldKey)
+			repo.items = append(repo.items, models.VaultItem{Base: models.Base{ID: uuid.New()}, OrganizationID: orgID, EncryptedData: string(data), KeyVersion: 1})
+			repo.events = nil
+		}
+		rotation := services.NewKeyRotationService(repo, encryption, &retiringSessions{}, masterKey)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		rotation.ResumeOrganizationKeyRotations(canceled, time.Minute)
+
+		if repo.jobs[0].Status != "completed" {
+			t.Fatalf("Expected the rotation to complete, got %s: %s", repo.jobs[0].Status, repo.jobs[0].Error)
+		}
+		late := repo.items[len(repo.items)-1]
+		if _, err := encryption.DecryptSymmetric([]byte(late.EncryptedData), newKey); late.KeyVersion != 2 || err != nil {
+			t.Fatalf("Expected the late item to be swept up, got version %d, %v", late.KeyVersion, err)
+		}
+		if len(repo.events) != 2 || repo.events[0] != "activate" || repo.events[1] != "items" {
+			t.Errorf("Expected the sweep to run after the new key was activated, got %v", repo.events)
+		}
+	})
+
+	t.Run("Leaves Active Rotation", func(t *testing.T) {
+		repo, _ := newRepository(t)
+		_, newRecord := orgKey(t, 2, false)
+		repo.keys = append(repo.keys, newRecord)
+		repo.jobs = []*models.KeyRotationJob{{
+			Base:      models.Base{ID: uuid.New(), UpdatedAt: time.Now()},
+			OwnerType: "organization",
+			OwnerID:   orgID,
+			OldKeyID:  repo.keys[0].ID,
+			NewKeyID:  newRecord.ID,
+			Status:    "running",
+			Phase:     "items",
+		}}
+		rotation := services.NewKeyRotationService(repo, encryption, &retiringSessions{}, masterKey)
+
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
+		rotation.ResumeOrganizationKeyRotations(canceled, time.Minute)
+
+		if repo.claims != 0 || repo.jobs[0].Status != "running" || repo.items[0].KeyVersion != 1 {
+			t.Errorf("Expected a rotation that is still saving progress to be left alone, got %d claims", repo.claims)
+		}
+	})
+
+	t.Run("Syncs Key On Login", func(t *testing.T) {
+		repo, _ := newRepository(t)
+		// The organization moved to key version 2 without reaching the member
+		repo.keys[0].IsActive = false
+		newKey, newRecord := orgKey(t, 2, true)
+		repo.keys = append(repo.keys, newRecord)
+		rotation := services.NewKeyRotationService(repo, encryption, &retiringSessions{}, masterKey)
+		sessions := services.NewKeySyncingSessionService(&signedInSessions{}, rotation)
+
+		if _, err := sessions.CreateSession(ctx, memberID, uuid.Nil, "test"); err != nil {
+			t.Fatalf("Failed to sign in: %v", err)
+		}
+		if repo.members[0].KeyVersion != 2 || string(memberKey(t, repo.members[0])) != string(newKey) {
+			t.Errorf("Expected the member to receive the current key on login, got version %d", repo.members[0].KeyVersion)
+		}
+	})
+}
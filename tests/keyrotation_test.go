@@ -0,0 +1,393 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// keyRotationRepository keeps the keys, jobs and encrypted records of a user key
+// rotation in memory and logs the writes that matter for their order; any other call
+// panics
+type keyRotationRepository struct {
+	repository.Repository
+	users   map[uuid.UUID]*models.User
+	keys    []*models.EncryptionKey
+	jobs    []*models.KeyRotationJob
+	items   []models.VaultItem
+	folders []models.Folder
+	events  []string
+	// failItemUpdates makes that many item batch writes fail, as an interruption would
+	failItemUpdates int
+	// onFolders runs the first time folders are listed, while items are already rotated
+	onFolders func()
+	// failRotationStart makes that many rotation starts fail, storing nothing
+	failRotationStart int
+}
+
+func (r *keyRotationRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return r.users[id], nil
+}
+
+func (r *keyRotationRepository) UpdateUser(ctx context.Context, user *models.User) error {
+	r.users[user.ID] = user
+	return nil
+}
+
+func (r *keyRotationRepository) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error) {
+	return nil, nil
+}
+
+func (r *keyRotationRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+func (r *keyRotationRepository) CreateEncryptionKey(ctx context.Context, key *models.EncryptionKey) error {
+	key.ID = uuid.New()
+	r.keys = append(r.keys, key)
+	return nil
+}
+
+func (r *keyRotationRepository) GetEncryptionKey(ctx context.Context, id uuid.UUID) (*models.EncryptionKey, error) {
+	for _, key := range r.keys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *keyRotationRepository) GetActiveEncryptionKey(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.EncryptionKey, error) {
+	for _, key := range r.keys {
+		if key.OwnerType == ownerType && key.OwnerID == ownerID && key.IsActive {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *keyRotationRepository) ActivateEncryptionKey(ctx context.Context, key *models.EncryptionKey) error {
+	for _, other := range r.keys {
+		if other.OwnerType == key.OwnerType && other.OwnerID == key.OwnerID {
+			other.IsActive = other.ID == key.ID
+		}
+	}
+	r.events = append(r.events, "activate")
+	return nil
+}
+
+func (r *keyRotationRepository) CreateKeyRotation(ctx context.Context, key *models.EncryptionKey, job *models.KeyRotationJob) error {
+	if r.failRotationStart > 0 {
+		r.failRotationStart--
+		return errInterrupted
+	}
+	for _, other := range r.keys {
+		if other.OwnerType == key.OwnerType && other.OwnerID == key.OwnerID && other.Version == key.Version {
+			return errors.New("duplicate key version")
+		}
+	}
+	r.CreateEncryptionKey(ctx, key)
+	job.ID = uuid.New()
+	job.NewKeyID = key.ID
+	r.jobs = append(r.jobs, job)
+	return nil
+}
+
+func (r *keyRotationRepository) UpdateKeyRotationJob(ctx context.Context, job *models.KeyRotationJob) error {
+	return nil
+}
+
+func (r *keyRotationRepository) GetUnfinishedKeyRotationJob(ctx context.Context, ownerType string, ownerID uuid.UUID) (*models.KeyRotationJob, error) {
+	for _, job := range r.jobs {
+		if job.OwnerType == ownerType && job.OwnerID == ownerID && job.Status == "running" {
+			return job, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *keyRotationRepository) ListUserVaultItemsBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.VaultItem, error) {
+	var items []models.VaultItem
+	for _, item := range r.items {
+		if item.UserID == userID && item.KeyVersion < version && len(items) < limit {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func (r *keyRotationRepository) UpdateVaultItems(ctx context.Context, items []models.VaultItem) error {
+	if r.failItemUpdates > 0 {
+		r.failItemUpdates--
+		return errInterrupted
+	}
+	for _, updated := range items {
+		for i := range r.items {
+			if r.items[i].ID == updated.ID {
+				r.items[i] = updated
+			}
+		}
+	}
+	r.events = append(r.events, "items")
+	return nil
+}
+
+func (r *keyRotationRepository) ListFoldersBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.Folder, error) {
+	if r.onFolders != nil {
+		r.onFolders()
+		r.onFolders = nil
+	}
+	var folders []models.Folder
+	for _, folder := range r.folders {
+		if folder.UserID == userID && folder.KeyVersion < version && len(folders) < limit {
+			folders = append(folders, folder)
+		}
+	}
+	return folders, nil
+}
+
+func (r *keyRotationRepository) UpdateFolders(ctx context.Context, folders []models.Folder) error {
+	for _, updated := range folders {
+		for i := range r.folders {
+			if r.folders[i].ID == updated.ID {
+				r.folders[i] = updated
+			}
+		}
+	}
+	return nil
+}
+
+func (r *keyRotationRepository) ListSendsBelowKeyVersion(ctx context.Context, userID uuid.UUID, version, limit int) ([]models.Send, error) {
+	return nil, nil
+}
+
+// retiringSessions records the key versions the rotation retires
+type retiringSessions struct {
+	services.SessionService
+	retired []int
+	kept    []uuid.UUID
+}
+
+func (s *retiringSessions) RetireKeyVersion(ctx context.Context, userID, currentSessionID uuid.UUID, version int) error {
+	s.retired = append(s.retired, version)
+	s.kept = append(s.kept, currentSessionID)
+	return nil
+}
+
+func TestUserKeyRotation(t *testing.T) {
+	encryption := services.NewEncryptionService()
+	masterKey, _ := encryption.GenerateSymmetricKey()
+	userID := uuid.New()
+
+	// newRotation sets up a user whose vault is encrypted with user key version 1
+	newRotation := func(t *testing.T) (*keyRotationRepository, *retiringSessions, services.KeyRotationService, []byte) {
+		t.Helper()
+		oldKey, err := encryption.GenerateSymmetricKey()
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		wrapped, _ := encryption.EncryptSymmetric(oldKey, masterKey)
+		repo := &keyRotationRepository{
+			users: map[uuid.UUID]*models.User{userID: {Base: models.Base{ID: userID}, KeyVersion: 1}},
+			keys: []*models.EncryptionKey{{
+				Base:       models.Base{ID: uuid.New()},
+				OwnerType:  "user",
+				OwnerID:    userID,
+				Version:    1,
+				WrappedKey: string(wrapped),
+				IsActive:   true,
+			}},
+		}
+		for i := 0; i < 3; i++ {
+			data, _ := encryption.EncryptSymmetric([]byte("item"), oldKey)
+			repo.items = append(repo.items, models.VaultItem{Base: models.Base{ID: uuid.New()}, UserID: userID, EncryptedData: string(data), KeyVersion: 1})
+		}
+		name, _ := encryption.EncryptSymmetric([]byte("folder"), oldKey)
+		repo.folders = append(repo.folders, models.Folder{Base: models.Base{ID: uuid.New()}, UserID: userID, EncryptedName: string(name), KeyVersion: 1})
+
+		sessions := &retiringSessions{}
+		return repo, sessions, services.NewKeyRotationService(repo, encryption, sessions, masterKey), oldKey
+	}
+
+	activeKey := func(t *testing.T, repo *keyRotationRepository) []byte {
+		t.Helper()
+		key, _ := repo.GetActiveEncryptionKey(context.Background(), "user", userID)
+		if key == nil {
+			t.Fatal("Expected an active user key")
+		}
+		unwrapped, err := encryption.DecryptSymmetric([]byte(key.WrappedKey), masterKey)
+		if err != nil {
+			t.Fatalf("Failed to unwrap key: %v", err)
+		}
+		return unwrapped
+	}
+
+	t.Run("Re-encrypts Vault", func(t *testing.T) {
+		repo, sessions, rotation, _ := newRotation(t)
+		sessionID := uuid.New()
+		ctx := services.ContextWithSessionID(context.Background(), sessionID)
+
+		if err := rotation.RotateUserKeys(ctx, userID); err != nil {
+			t.Fatalf("Failed to rotate keys: %v", err)
+		}
+
+		newKey := activeKey(t, repo)
+		for _, item := range repo.items {
+			if item.KeyVersion != 2 {
+				t.Errorf("Expected item at key version 2, got %d", item.KeyVersion)
+			}
+			if plaintext, err := encryption.DecryptSymmetric([]byte(item.EncryptedData), newKey); err != nil || string(plaintext) != "item" {
+				t.Errorf("Expected the item to decrypt with the new key, got %q, %v", plaintext, err)
+			}
+		}
+		if repo.folders[0].KeyVersion != 2 {
+			t.Errorf("Expected folder at key version 2, got %d", repo.folders[0].KeyVersion)
+		}
+		if repo.users[userID].KeyVersion != 2 {
+			t.Errorf("Expected user key version 2, got %d", repo.users[userID].KeyVersion)
+		}
+		if len(sessions.retired) != 1 || sessions.retired[0] != 2 || sessions.kept[0] != sessionID {
+			t.Errorf("Expected the old key version to be retired keeping the current session, got %v %v", sessions.retired, sessions.kept)
+		}
+		if repo.jobs[0].Status != "completed" {
+			t.Errorf("Expected the job to be completed, got %s", repo.jobs[0].Status)
+		}
+	})
+
+	t.Run("Resumes After Interruption", func(t *testing.T) {
+		repo, _, rotation, _ := newRotation(t)
+		repo.failItemUpdates = 1
+		ctx := context.Background()
+
+		if err := rotation.RotateUserKeys(ctx, userID); !errors.Is(err, errInterrupted) {
+			t.Fatalf("Expected the interruption to be reported, got %v", err)
+		}
+		if repo.users[userID].KeyVersion != 1 {
+			t.Error("Expected the old key to stay in use until the rotation finishes")
+		}
+
+		if err := rotation.RotateUserKeys(ctx, userID); err != nil {
+			t.Fatalf("Failed to resume rotation: %v", err)
+		}
+		if len(repo.jobs) != 1 || len(repo.keys) != 2 {
+			t.Errorf("Expected the pending rotation to be resumed, got %d jobs and %d keys", len(repo.jobs), len(repo.keys))
+		}
+		for _, item := range repo.items {
+			if item.KeyVersion != 2 {
+				t.Errorf("Expected item at key version 2, got %d", item.KeyVersion)
+			}
+		}
+	})
+
+	t.Run("Retries Failed Start", func(t *testing.T) {
+		repo, _, rotation, _ := newRotation(t)
+		repo.failRotationStart = 1
+		ctx := context.Background()
+
+		if err := rotation.RotateUserKeys(ctx, userID); !errors.Is(err, errInterrupted) {
+			t.Fatalf("Expected the failed start to be reported, got %v", err)
+		}
+		if len(repo.keys) != 1 || len(repo.jobs) != 0 {
+			t.Fatalf("Expected no key without a job, got %d keys and %d jobs", len(repo.keys), len(repo.jobs))
+		}
+
+		if err := rotation.RotateUserKeys(ctx, userID); err != nil {
+			t.Fatalf("Failed to rotate keys after a failed start: %v", err)
+		}
+		if repo.users[userID].KeyVersion != 2 {
+			t.Errorf("Expected user key version 2, got %d", repo.users[userID].KeyVersion)
+		}
+	})
+
+	t.Run("Stores First Key Active", func(t *testing.T) {
+		repo, _, rotation, _ := newRotation(t)
+		repo.keys = nil
+
+		if err := rotation.RotateUserKeys(context.Background(), userID); err != nil {
+			t.Fatalf("Failed to create the first key: %v", err)
+		}
+		if len(repo.keys) != 1 || !repo.keys[0].IsActive || len(repo.jobs) != 0 {
+			t.Errorf("Expected one active key and no job, got %d keys and %d jobs", len(repo.keys), len(repo.jobs))
+		}
+	})
+
+	t.Run("Sweeps After Activation", func(t *testing.T) {
+		repo, _, rotation, oldKey := newRotation(t)
+		// A client that still holds the old key saves an item while folders are rotated
+		repo.onFolders = func() {
+			data, _ := encryption.EncryptSymmetric([]byte("late"), oldKey)
+			repo.items = append(repo.items, models.VaultItem{Base: models.Base{ID: uuid.New()}, UserID: userID, EncryptedData: string(data), KeyVersion: 1})
+			repo.events = nil
+		}
+
+		if err := rotation.RotateUserKeys(context.Background(), userID); err != nil {
+			t.Fatalf("Failed to rotate keys: %v", err)
+		}
+
+		late := repo.items[len(repo.items)-1]
+		if late.KeyVersion != 2 {
+			t.Fatalf("Expected the late item to be swept up, got key version %d", late.KeyVersion)
+		}
+		if len(repo.events) != 2 || repo.events[0] != "activate" || repo.events[1] != "items" {
+			t.Errorf("Expected the sweep to run after the new key was activated, got %v", repo.events)
+		}
+	})
+}
+
+// keyVersionSessionRepository serves one stored session and its user; any other call
+// panics
+type keyVersionSessionRepository struct {
+	repository.Repository
+	session *models.Session
+	user    *models.User
+}
+
+func (r *keyVersionSessionRepository) GetSessionByTokenHash(ctx context.Context, tokenHash string) (*models.Session, error) {
+	if r.session.TokenHash != tokenHash {
+		return nil, nil
+	}
+	return r.session, nil
+}
+
+func (r *keyVersionSessionRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return r.user, nil
+}
+
+func TestSessionKeyVersion(t *testing.T) {
+	const token = "session-token"
+	hash := sha256.Sum256([]byte(token))
+	now := time.Now()
+	userID := uuid.New()
+	repo := &keyVersionSessionRepository{
+		session: &models.Session{
+			Base:              models.Base{ID: uuid.New()},
+			UserID:            userID,
+			TokenHash:         hex.EncodeToString(hash[:]),
+			KeyVersion:        1,
+			ExpiresAt:         now.Add(time.Hour),
+			AbsoluteExpiresAt: now.Add(24 * time.Hour),
+			LastUsed:          now,
+		},
+		user: &models.User{Base: models.Base{ID: userID}, KeyVersion: 1},
+	}
+	sessions := services.NewSessionService(repo, nil, nil, nil, nil, nil, nil)
+
+	if _, err := sessions.ValidateSession(context.Background(), token); err != nil {
+		t.Fatalf("Expected the session to be valid, got %v", err)
+	}
+
+	repo.user.KeyVersion = 2
+	if _, err := sessions.ValidateSession(context.Background(), token); !errors.Is(err, services.ErrInvalidSession) {
+		t.Errorf("Expected a session of a retired key version to be refused, got %v", err)
+	}
+}
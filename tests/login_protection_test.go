@@ -0,0 +1,280 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// failureCounterRepository keeps one user and the sign-in failure counters in memory,
+// safe for concurrent attempts; any other call panics
+type failureCounterRepository struct {
+	repository.Repository
+	mu       sync.Mutex
+	user     *models.User
+	counters map[string]*models.AuthFailureCounter
+}
+
+func (r *failureCounterRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	if r.user.Email == email {
+		return r.user, nil
+	}
+	return nil, nil
+}
+
+func (r *failureCounterRepository) ReserveAuthAttempt(ctx context.Context, key string, resetBefore time.Time) (*models.AuthFailureCounter, *time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var previous *time.Time
+	counter, ok := r.counters[key]
+	if !ok {
+		counter = &models.AuthFailureCounter{Key: key}
+		r.counters[key] = counter
+	} else {
+		last := counter.LastFailureAt
+		previous = &last
+	}
+	if counter.LastFailureAt.Before(resetBefore) {
+		counter.Failures = 0
+	}
+	counter.Failures++
+	counter.LastFailureAt = time.Now()
+	found := *counter
+	return &found, previous, nil
+}
+
+func (r *failureCounterRepository) ReleaseAuthAttempt(ctx context.Context, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if counter, ok := r.counters[key]; ok && counter.Failures > 0 {
+		counter.Failures--
+	}
+	return nil
+}
+
+func (r *failureCounterRepository) GetAuthFailureCounter(ctx context.Context, key string) (*models.AuthFailureCounter, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if counter, ok := r.counters[key]; ok {
+		found := *counter
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *failureCounterRepository) LockAuthFailureCounter(ctx context.Context, key string, until time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[key].Failures = 0
+	r.counters[key].LockedUntil = &until
+	return nil
+}
+
+func (r *failureCounterRepository) DeleteAuthFailureCounters(ctx context.Context, keys ...string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		delete(r.counters, key)
+	}
+	return nil
+}
+
+func (r *failureCounterRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+// quietMetrics drops every metric
+type quietMetrics struct {
+	services.MetricsService
+}
+
+func (m *quietMetrics) RecordAuthFailure(ctx context.Context, reason string) {}
+
+func TestLoginProtection(t *testing.T) {
+	ctx := context.Background()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("master password"), bcrypt.MinCost)
+
+	// newService sets up one account with the given protection settings
+	newService := func(t *testing.T, config services.LoginProtectionConfig) (services.LoginProtectionService, *failureCounterRepository, *sentEmails) {
+		t.Helper()
+		repo := &failureCounterRepository{
+			user:     &models.User{Base: models.Base{ID: uuid.New()}, Email: "user@example.com", PasswordHash: string(hash)},
+			counters: make(map[string]*models.AuthFailureCounter),
+		}
+		email := &sentEmails{}
+		return services.NewLoginProtectionService(repo, email, &quietMetrics{}, nil, config), repo, email
+	}
+
+	// lockoutConfig locks after three failures without any back-off in between
+	lockoutConfig := services.LoginProtectionConfig{
+		FreeAttempts:     3,
+		LockoutThreshold: 3,
+		LockoutDuration:  30 * time.Minute,
+		FailureWindow:    24 * time.Hour,
+	}
+
+	// backoffConfig backs off after three failures and never locks
+	backoffConfig := services.LoginProtectionConfig{
+		FreeAttempts:     3,
+		BaseDelay:        time.Minute,
+		MaxDelay:         4 * time.Minute,
+		LockoutThreshold: 100,
+		LockoutDuration:  time.Hour,
+		FailureWindow:    24 * time.Hour,
+	}
+
+	t.Run("Backs Off After Free Attempts", func(t *testing.T) {
+		// A refused attempt still counts, so the wait it reports is for the attempt after it
+		tests := []struct {
+			name     string
+			failures int
+			delay    time.Duration
+		}{
+			{"Below Free Attempts", 2, 0},
+			{"At Free Attempts", 3, 2 * time.Minute},
+			{"Doubles", 4, 4 * time.Minute},
+			{"Capped At Max Delay", 9, 4 * time.Minute},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				protection, repo, _ := newService(t, backoffConfig)
+				lastFailure := time.Now().Add(-time.Second)
+				repo.counters[keyFor(repo)] = &models.AuthFailureCounter{Key: keyFor(repo), Failures: tt.failures, LastFailureAt: lastFailure}
+
+				_, err := protection.AuthenticatePassword(ctx, "user@example.com", "master password")
+				if tt.delay == 0 {
+					if err != nil {
+						t.Fatalf("Expected no back-off below the free attempts, got %v", err)
+					}
+					return
+				}
+				var blocked *services.LoginBlockedError
+				if !errors.As(err, &blocked) || !errors.Is(err, services.ErrLoginThrottled) {
+					t.Fatalf("Expected the attempt to be throttled, got %v", err)
+				}
+				if until := time.Until(blocked.RetryAt); until < tt.delay-time.Second || until > tt.delay {
+					t.Errorf("Expected to retry after %v, got %v", tt.delay, until)
+				}
+			})
+		}
+	})
+
+	t.Run("Concurrent Attempts", func(t *testing.T) {
+		tests := []struct {
+			name   string
+			config services.LoginProtectionConfig
+			refuse error
+		}{
+			{"Back Off", backoffConfig, services.ErrLoginThrottled},
+			{"Lockout", lockoutConfig, services.ErrAccountLocked},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				protection, _, email := newService(t, tt.config)
+
+				errs := make(chan error, 20)
+				var wg sync.WaitGroup
+				for i := 0; i < 20; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						_, err := protection.AuthenticatePassword(ctx, "user@example.com", "wrong")
+						errs <- err
+					}()
+				}
+				wg.Wait()
+				close(errs)
+
+				checked := 0
+				for err := range errs {
+					switch {
+					case errors.Is(err, services.ErrInvalidPassword):
+						checked++
+					case !errors.Is(err, tt.refuse):
+						t.Errorf("Expected the attempt to be refused with %v, got %v", tt.refuse, err)
+					}
+				}
+				if checked != 3 {
+					t.Errorf("Expected only the 3 free attempts to check the password, got %d", checked)
+				}
+				if tt.refuse == services.ErrAccountLocked && len(email.templates) != 1 {
+					t.Errorf("Expected one lockout email, got %v", email.templates)
+				}
+			})
+		}
+	})
+
+	t.Run("Locks Account At Threshold", func(t *testing.T) {
+		protection, repo, email := newService(t, lockoutConfig)
+
+		for i := 0; i < 3; i++ {
+			if _, err := protection.AuthenticatePassword(ctx, "user@example.com", "wrong"); !errors.Is(err, services.ErrInvalidPassword) {
+				t.Fatalf("Expected attempt %d to be a wrong password, got %v", i+1, err)
+			}
+		}
+		if len(email.templates) != 1 || email.templates[0] != "account_locked" {
+			t.Errorf("Expected the owner to be emailed about the lockout, got %v", email.templates)
+		}
+
+		_, err := protection.AuthenticatePassword(ctx, "user@example.com", "master password")
+		var blocked *services.LoginBlockedError
+		if !errors.As(err, &blocked) || !errors.Is(err, services.ErrAccountLocked) {
+			t.Fatalf("Expected the locked account to refuse the right password, got %v", err)
+		}
+		if until := time.Until(blocked.RetryAt); until < 29*time.Minute || until > 30*time.Minute {
+			t.Errorf("Expected the account to be locked for 30 minutes, got %v", until)
+		}
+
+		if err := repo.DeleteAuthFailureCounters(ctx, keyFor(repo)); err != nil {
+			t.Fatalf("Failed to clear counters: %v", err)
+		}
+		if user, err := protection.AuthenticatePassword(ctx, "user@example.com", "master password"); err != nil || user.ID != repo.user.ID {
+			t.Errorf("Expected the unlocked account to sign in, got %v", err)
+		}
+	})
+
+	t.Run("Treats Unknown Email Like Account", func(t *testing.T) {
+		protection, repo, email := newService(t, lockoutConfig)
+
+		for i := 0; i < 3; i++ {
+			if _, err := protection.AuthenticatePassword(ctx, "nobody@example.com", "wrong"); !errors.Is(err, services.ErrInvalidPassword) {
+				t.Fatalf("Expected attempt %d to look like a wrong password, got %v", i+1, err)
+			}
+		}
+		_, err := protection.AuthenticatePassword(ctx, "Nobody@example.com", "wrong")
+		var blocked *services.LoginBlockedError
+		if !errors.As(err, &blocked) || !errors.Is(err, services.ErrAccountLocked) {
+			t.Fatalf("Expected the unknown email to be locked like an account, got %v", err)
+		}
+		if until := time.Until(blocked.RetryAt); until < 29*time.Minute || until > 30*time.Minute {
+			t.Errorf("Expected the email to be locked for 30 minutes, got %v", until)
+		}
+		if len(email.templates) != 0 {
+			t.Errorf("Expected no email for an unknown address, got %v", email.templates)
+		}
+		if _, err := protection.AuthenticatePassword(ctx, "user@example.com", "master password"); err != nil {
+			t.Errorf("Expected the real account to be unaffected, got %v", err)
+		}
+		for key := range repo.counters {
+			if strings.Contains(key, "nobody") {
+				t.Errorf("Expected counters not to keep the email, got %q", key)
+			}
+		}
+	})
+}
+
+// keyFor returns the password counter key of the repository's user
+func keyFor(repo *failureCounterRepository) string {
+	return "auth:" + repo.user.ID.String()
+}
@@ -0,0 +1,226 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// loginHistoryRepository returns one previous login from a country the user has always
+// signed in from, and records the logins and device updates stored; any other call
+// panics
+type loginHistoryRepository struct {
+	repository.Repository
+	previous    *models.LoginEvent
+	memberships []models.OrganizationUser
+	events      []*models.LoginEvent
+	seen        []*models.Device
+}
+
+func (r *loginHistoryRepository) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error) {
+	return r.memberships, nil
+}
+
+func (r *loginHistoryRepository) GetLatestLoginEvent(ctx context.Context, userID uuid.UUID) (*models.LoginEvent, error) {
+	return r.previous, nil
+}
+
+func (r *loginHistoryRepository) HasLoginFromCountry(ctx context.Context, userID uuid.UUID, country string) (bool, error) {
+	return true, nil
+}
+
+func (r *loginHistoryRepository) CreateLoginEvent(ctx context.Context, event *models.LoginEvent) error {
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *loginHistoryRepository) UpdateDevice(ctx context.Context, device *models.Device) error {
+	r.seen = append(r.seen, device)
+	return nil
+}
+
+func (r *loginHistoryRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+// fixedLocation resolves every IP to the same location
+type fixedLocation struct {
+	location services.GeoLocation
+}
+
+func (g *fixedLocation) Lookup(ip string) (*services.GeoLocation, error) {
+	location := g.location
+	return &location, nil
+}
+
+func (g *fixedLocation) Close() error {
+	return nil
+}
+
+// travelPolicies returns a suspicious_login policy with the given speed limit for every
+// organization
+type travelPolicies struct {
+	services.PolicyService
+	maxSpeedKmh float64
+}
+
+func (p *travelPolicies) GetSuspiciousLoginPolicy(ctx context.Context, orgID uuid.UUID) (*services.SuspiciousLoginPolicySettings, error) {
+	return &services.SuspiciousLoginPolicySettings{MaxTravelSpeedKmh: p.maxSpeedKmh}, nil
+}
+
+// place is where a login came from
+type place struct {
+	country   string
+	latitude  float64
+	longitude float64
+}
+
+var (
+	london       = place{"GB", 51.5074, -0.1278}
+	paris        = place{"FR", 48.8566, 2.3522}
+	newYork      = place{"US", 40.7128, -74.0060}
+	tokyo        = place{"JP", 35.6762, 139.6503}
+	sanFrancisco = place{"US", 37.7749, -122.4194}
+	sydney       = place{"AU", -33.8688, 151.2093}
+)
+
+func TestLoginRiskTravel(t *testing.T) {
+	user := &models.User{Base: models.Base{ID: uuid.New()}, Email: "user@example.com"}
+	deviceID := uuid.New()
+	lastSeen := time.Now().Add(-24 * time.Hour)
+
+	// travelled reports whether a login at to, elapsed after one at from, is flagged as
+	// impossible travel. The device is known so that only travel can be flagged; a
+	// maxSpeedKmh of 0 keeps the default limit.
+	travelled := func(t *testing.T, from, to place, elapsed time.Duration, maxSpeedKmh float64) bool {
+		t.Helper()
+		repo := &loginHistoryRepository{
+			previous: &models.LoginEvent{
+				Base:      models.Base{CreatedAt: time.Now().Add(-elapsed)},
+				UserID:    user.ID,
+				Country:   from.country,
+				Latitude:  from.latitude,
+				Longitude: from.longitude,
+			},
+		}
+		if maxSpeedKmh > 0 {
+			repo.memberships = []models.OrganizationUser{{UserID: user.ID, OrganizationID: uuid.New(), Status: "confirmed"}}
+		}
+		devices := &knownDevices{devices: map[uuid.UUID]*models.Device{
+			deviceID: {Base: models.Base{ID: deviceID}, UserID: user.ID, Status: "authorized", LastSeenAt: &lastSeen},
+		}}
+		geoip := &fixedLocation{location: services.GeoLocation{Country: to.country, Latitude: to.latitude, Longitude: to.longitude}}
+		risk := services.NewLoginRiskService(repo, &travelPolicies{maxSpeedKmh: maxSpeedKmh}, devices, geoip, &sentEmails{})
+
+		ctx := services.ContextWithClientIP(context.Background(), "203.0.113.7")
+		assessment, err := risk.AssessLogin(ctx, user, deviceID)
+		if err != nil {
+			t.Fatalf("Failed to assess login: %v", err)
+		}
+		for _, flag := range assessment.Flags {
+			if flag == services.LoginRiskFlagImpossibleTravel {
+				return true
+			}
+		}
+		return false
+	}
+
+	t.Run("Great Circle Distance", func(t *testing.T) {
+		// Over twenty hours the speed is a twentieth of the distance, so a limit 2% either
+		// side of it tells whether the distance is right
+		tests := []struct {
+			name       string
+			from, to   place
+			distanceKm float64
+		}{
+			{"London To New York", london, newYork, 5570},
+			{"Tokyo To San Francisco Across Date Line", tokyo, sanFrancisco, 8275},
+			{"London To Sydney Across Equator", london, sydney, 16994},
+			{"Symmetric", newYork, london, 5570},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				speed := tt.distanceKm / 20
+				if !travelled(t, tt.from, tt.to, 20*time.Hour, speed*0.98) {
+					t.Errorf("Expected about %.0f km to exceed %.0f km/h", tt.distanceKm, speed*0.98)
+				}
+				if travelled(t, tt.from, tt.to, 20*time.Hour, speed*1.02) {
+					t.Errorf("Expected about %.0f km to stay under %.0f km/h", tt.distanceKm, speed*1.02)
+				}
+			})
+		}
+	})
+
+	t.Run("Speed Threshold", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			from, to    place
+			elapsed     time.Duration
+			maxSpeedKmh float64
+			want        bool
+		}{
+			{"Flight Too Fast", london, newYork, time.Hour, 0, true},
+			{"Flight Plausible", london, newYork, 8 * time.Hour, 0, false},
+			{"Stricter Policy", london, newYork, 8 * time.Hour, 500, true},
+			{"Same Instant", london, newYork, 0, 0, true},
+			{"Short Distance Ignored", london, paris, time.Minute, 0, false},
+			{"Same Place", london, london, time.Minute, 0, false},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if got := travelled(t, tt.from, tt.to, tt.elapsed, tt.maxSpeedKmh); got != tt.want {
+					t.Errorf("Expected impossible travel %v, got %v", tt.want, got)
+				}
+			})
+		}
+	})
+
+	t.Run("Ignores Previous Login Without Location", func(t *testing.T) {
+		if travelled(t, place{}, newYork, time.Minute, 0) {
+			t.Error("Expected a previous login without a location not to be compared")
+		}
+	})
+}
+
+func TestLoginRiskRecording(t *testing.T) {
+	ctx := services.ContextWithClientIP(context.Background(), "203.0.113.7")
+	user := &models.User{Base: models.Base{ID: uuid.New()}, Email: "user@example.com"}
+	deviceID := uuid.New()
+
+	repo := &loginHistoryRepository{
+		previous: &models.LoginEvent{Base: models.Base{CreatedAt: time.Now().Add(-24 * time.Hour)}, UserID: user.ID, Country: london.country},
+	}
+	devices := &knownDevices{devices: map[uuid.UUID]*models.Device{
+		deviceID: {Base: models.Base{ID: deviceID}, UserID: user.ID, Status: "authorized"},
+	}}
+	geoip := &fixedLocation{location: services.GeoLocation{Country: london.country, Latitude: london.latitude, Longitude: london.longitude}}
+	risk := services.NewLoginRiskService(repo, &travelPolicies{}, devices, geoip, &sentEmails{})
+
+	assessment, err := risk.AssessLogin(ctx, user, deviceID)
+	if err != nil {
+		t.Fatalf("Failed to assess login: %v", err)
+	}
+	if len(assessment.Flags) != 1 || assessment.Flags[0] != services.LoginRiskFlagNewDevice {
+		t.Errorf("Expected the unseen device to be flagged, got %v", assessment.Flags)
+	}
+	if len(repo.events) != 0 || len(repo.seen) != 0 {
+		t.Fatalf("Expected an assessed login not to be recorded, got %d events and %d devices", len(repo.events), len(repo.seen))
+	}
+
+	if err := risk.RecordLogin(ctx, user, deviceID); err != nil {
+		t.Fatalf("Failed to record login: %v", err)
+	}
+	if len(repo.events) != 1 || repo.events[0].Country != london.country {
+		t.Errorf("Expected the completed login to be recorded, got %d events", len(repo.events))
+	}
+	if len(repo.seen) != 1 || repo.seen[0].LastSeenAt == nil {
+		t.Error("Expected the device to be marked as seen")
+	}
+}
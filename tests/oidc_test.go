@@ -0,0 +1,294 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+)
+
+const (
+	testOIDCClientID     = "passwordimmunity"
+	testOIDCClientSecret = "client-secret"
+	testOIDCRedirectURL  = "https://vault.example.com/api/sso/callback"
+)
+
+// mockIdP is an in-process OpenID Connect provider. It issues RS256 ID tokens and
+// enforces PKCE S256 at its token endpoint.
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+	// signingKey signs ID tokens; set it to another key to forge a signature
+	signingKey *rsa.PrivateKey
+	// issuer overrides the issuer named in the discovery document
+	issuer string
+	// audience overrides the ID token's audience
+	audience string
+
+	mu    sync.Mutex
+	codes map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	nonce     string
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate IdP key: %v", err)
+	}
+	idp := &mockIdP{key: key, signingKey: key, codes: make(map[string]mockAuthorization)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// set changes the provider's behaviour while its handlers may be running
+func (idp *mockIdP) set(change func()) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	change()
+}
+
+func (idp *mockIdP) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mu.Lock()
+	issuer := idp.issuer
+	idp.mu.Unlock()
+	if issuer == "" {
+		issuer = idp.server.URL
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                idp.server.URL + "/authorize",
+		"token_endpoint":                        idp.server.URL + "/token",
+		"jwks_uri":                              idp.server.URL + "/jwks",
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (idp *mockIdP) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   b64(idp.key.N.Bytes()),
+			"e":   b64(big.NewInt(int64(idp.key.E)).Bytes()),
+		}},
+	})
+}
+
+// authorize plays the user signing in at the provider and returns the code and state
+// it would redirect back with
+func (idp *mockIdP) authorize(t *testing.T, authURL string) (string, string) {
+	parsed, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("Failed to parse authorization URL: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != testOIDCClientID {
+		t.Fatalf("Unexpected authorization request: %s", authURL)
+	}
+
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatalf("Failed to generate code: %v", err)
+	}
+	code := b64(raw)
+	idp.mu.Lock()
+	idp.codes[code] = mockAuthorization{challenge: query.Get("code_challenge"), nonce: query.Get("nonce")}
+	idp.mu.Unlock()
+	return code, query.Get("state")
+}
+
+func (idp *mockIdP) token(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok || clientID != testOIDCClientID || clientSecret != testOIDCClientSecret {
+		http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+		return
+	}
+
+	idp.mu.Lock()
+	authorization, ok := idp.codes[r.PostForm.Get("code")]
+	delete(idp.codes, r.PostForm.Get("code"))
+	signingKey, audience := idp.signingKey, idp.audience
+	idp.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !ok || b64(challenge[:]) != authorization.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	if audience == "" {
+		audience = testOIDCClientID
+	}
+	idToken := signJWT(signingKey, map[string]interface{}{
+		"iss":            idp.server.URL,
+		"sub":            "idp-user-1",
+		"aud":            audience,
+		"iat":            time.Now().Unix(),
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          authorization.nonce,
+		"email":          "sso@example.com",
+		"email_verified": true,
+		"name":           "SSO User",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "access-token",
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     idToken,
+	})
+}
+
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signingInput + "." + b64(signature)
+}
+
+func newTestOIDCRelyingParty(t *testing.T, idp *mockIdP, metadataURL string) *services.OIDCRelyingParty {
+	rp, err := services.NewOIDCRelyingParty(context.Background(), services.OIDCConfig{
+		MetadataURL:  metadataURL,
+		ClientID:     testOIDCClientID,
+		ClientSecret: testOIDCClientSecret,
+		RedirectURL:  testOIDCRedirectURL,
+	}, idp.server.Client())
+	if err != nil {
+		t.Fatalf("Failed to create relying party: %v", err)
+	}
+	return rp
+}
+
+func TestOIDCRelyingParty(t *testing.T) {
+	idp := newMockIdP(t)
+	rp := newTestOIDCRelyingParty(t, idp, idp.server.URL)
+	ctx := context.Background()
+
+	t.Run("Authorization Code Flow With PKCE", func(t *testing.T) {
+		verifier := "a-code-verifier-that-is-long-enough-for-pkce-0123456789"
+		authURL := rp.AuthCodeURL("state-1", "nonce-1", verifier)
+		if !strings.HasPrefix(authURL, idp.server.URL+"/authorize?") {
+			t.Fatalf("Expected the discovered authorization endpoint, got %s", authURL)
+		}
+		query, _ := url.Parse(authURL)
+		if query.Query().Get("code_challenge_method") != "S256" {
+			t.Errorf("Expected S256 code challenge, got %q", query.Query().Get("code_challenge_method"))
+		}
+		if strings.Contains(authURL, verifier) {
+			t.Error("Authorization URL must not contain the code verifier")
+		}
+
+		code, state := idp.authorize(t, authURL)
+		if state != "state-1" {
+			t.Errorf("Expected state state-1, got %s", state)
+		}
+		claims, err := rp.Exchange(ctx, code, verifier, "nonce-1")
+		if err != nil {
+			t.Fatalf("Failed to exchange code: %v", err)
+		}
+		if claims.Issuer != idp.server.URL || claims.Subject != "idp-user-1" {
+			t.Errorf("Unexpected issuer or subject: %s %s", claims.Issuer, claims.Subject)
+		}
+		if claims.Email != "sso@example.com" || !claims.EmailVerified {
+			t.Errorf("Expected verified email sso@example.com, got %s (verified %v)", claims.Email, claims.EmailVerified)
+		}
+		if claims.Raw["name"] != "SSO User" {
+			t.Errorf("Expected raw name claim, got %v", claims.Raw["name"])
+		}
+
+		if _, err := rp.Exchange(ctx, code, verifier, "nonce-1"); !errors.Is(err, services.ErrOIDCExchangeFailed) {
+			t.Errorf("Expected reused code to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Wrong Code Verifier", func(t *testing.T) {
+		code, _ := idp.authorize(t, rp.AuthCodeURL("state", "nonce", "the-verifier-sent-in-the-challenge-0123456789abcdef"))
+		_, err := rp.Exchange(ctx, code, "a-different-verifier-0123456789abcdef0123456789", "nonce")
+		if !errors.Is(err, services.ErrOIDCExchangeFailed) {
+			t.Errorf("Expected ErrOIDCExchangeFailed, got %v", err)
+		}
+	})
+
+	t.Run("Wrong Nonce", func(t *testing.T) {
+		verifier := "another-code-verifier-that-is-long-enough-0123456789"
+		code, _ := idp.authorize(t, rp.AuthCodeURL("state", "nonce-issued", verifier))
+		_, err := rp.Exchange(ctx, code, verifier, "nonce-expected")
+		if !errors.Is(err, services.ErrInvalidIDToken) {
+			t.Errorf("Expected ErrInvalidIDToken, got %v", err)
+		}
+	})
+
+	t.Run("Forged Signature", func(t *testing.T) {
+		forger, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("Failed to generate key: %v", err)
+		}
+		idp.set(func() { idp.signingKey = forger })
+		defer idp.set(func() { idp.signingKey = idp.key })
+
+		verifier := "forged-signature-code-verifier-0123456789abcdef"
+		code, _ := idp.authorize(t, rp.AuthCodeURL("state", "nonce", verifier))
+		if _, err := rp.Exchange(ctx, code, verifier, "nonce"); !errors.Is(err, services.ErrInvalidIDToken) {
+			t.Errorf("Expected ErrInvalidIDToken, got %v", err)
+		}
+	})
+
+	t.Run("Wrong Audience", func(t *testing.T) {
+		idp.set(func() { idp.audience = "another-client" })
+		defer idp.set(func() { idp.audience = "" })
+
+		verifier := "wrong-audience-code-verifier-0123456789abcdef"
+		code, _ := idp.authorize(t, rp.AuthCodeURL("state", "nonce", verifier))
+		if _, err := rp.Exchange(ctx, code, verifier, "nonce"); !errors.Is(err, services.ErrInvalidIDToken) {
+			t.Errorf("Expected ErrInvalidIDToken, got %v", err)
+		}
+	})
+
+	t.Run("Discovery Issuer Mismatch", func(t *testing.T) {
+		idp.set(func() { idp.issuer = "https://attacker.example.com" })
+		defer idp.set(func() { idp.issuer = "" })
+
+		_, err := services.NewOIDCRelyingParty(ctx, services.OIDCConfig{
+			MetadataURL: idp.server.URL + "/.well-known/openid-configuration",
+			ClientID:    testOIDCClientID,
+		}, idp.server.Client())
+		if !errors.Is(err, services.ErrInvalidOIDCDiscovery) {
+			t.Errorf("Expected ErrInvalidOIDCDiscovery, got %v", err)
+		}
+	})
+}
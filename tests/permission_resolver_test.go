@@ -0,0 +1,144 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// permissionRepository answers permission queries from a fixed grant table and counts
+// the queries; any other call panics
+type permissionRepository struct {
+	repository.Repository
+	grants  map[uuid.UUID]map[uuid.UUID][]string
+	queries int
+}
+
+func (r *permissionRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	r.queries++
+	return r.grants[orgID][userID], nil
+}
+
+func (r *permissionRepository) ListOrganizationsWithPermission(ctx context.Context, userID uuid.UUID, orgIDs []uuid.UUID, permissionName string) ([]uuid.UUID, error) {
+	r.queries++
+	var ids []uuid.UUID
+	for _, orgID := range orgIDs {
+		for _, granted := range r.grants[orgID][userID] {
+			if granted == permissionName {
+				ids = append(ids, orgID)
+			}
+		}
+	}
+	return ids, nil
+}
+
+// memoryCache is an in-process CacheService
+type memoryCache struct {
+	values map[string]interface{}
+}
+
+func (c *memoryCache) Get(ctx context.Context, key string) (interface{}, error) {
+	return c.values[key], nil
+}
+
+func (c *memoryCache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+	c.values[key] = value
+	return nil
+}
+
+func (c *memoryCache) Delete(ctx context.Context, key string) error {
+	delete(c.values, key)
+	return nil
+}
+
+func (c *memoryCache) Clear(ctx context.Context) error {
+	c.values = make(map[string]interface{})
+	return nil
+}
+
+func (c *memoryCache) GetOrSet(ctx context.Context, key string, fn func() (interface{}, error), expiration time.Duration) (interface{}, error) {
+	if value, ok := c.values[key]; ok {
+		return value, nil
+	}
+	value, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	c.values[key] = value
+	return value, nil
+}
+
+func TestPermissionResolver(t *testing.T) {
+	ctx := context.Background()
+	userID := uuid.New()
+	orgID, otherOrgID := uuid.New(), uuid.New()
+	repo := &permissionRepository{grants: map[uuid.UUID]map[uuid.UUID][]string{
+		orgID:      {userID: {"read_vault_items", "create_vault_item"}},
+		otherOrgID: {userID: {"read_vault_items"}},
+	}}
+	resolver := services.NewPermissionResolver(repo, &memoryCache{values: make(map[string]interface{})})
+
+	t.Run("Granted By Role", func(t *testing.T) {
+		allowed, err := resolver.HasPermission(ctx, userID, orgID, "create_vault_item")
+		if err != nil {
+			t.Fatalf("Failed to resolve permission: %v", err)
+		}
+		if !allowed {
+			t.Error("Expected the permission to be granted")
+		}
+		if allowed, _ := resolver.HasPermission(ctx, userID, orgID, "view_audit_logs"); allowed {
+			t.Error("Expected a permission the role lacks to be refused")
+		}
+		if allowed, _ := resolver.HasPermission(ctx, uuid.New(), orgID, "read_vault_items"); allowed {
+			t.Error("Expected a non-member to be refused")
+		}
+	})
+
+	t.Run("Require Every Permission", func(t *testing.T) {
+		if err := resolver.RequirePermission(ctx, userID, orgID, "read_vault_items", "create_vault_item"); err != nil {
+			t.Errorf("Expected the permissions to be granted, got %v", err)
+		}
+		err := resolver.RequirePermission(ctx, userID, orgID, "read_vault_items", "view_audit_logs")
+		if !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected ErrUnauthorized when one permission is missing, got %v", err)
+		}
+		if err := resolver.RequirePermission(ctx, uuid.New(), orgID, "read_vault_items"); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected ErrUnauthorized for a non-member, got %v", err)
+		}
+	})
+
+	t.Run("Cached Until Invalidated", func(t *testing.T) {
+		resolver.HasPermission(ctx, userID, otherOrgID, "read_vault_items")
+		before := repo.queries
+		resolver.HasPermission(ctx, userID, otherOrgID, "read_vault_items")
+		if repo.queries != before {
+			t.Errorf("Expected the cached permissions to be used, got %d new queries", repo.queries-before)
+		}
+
+		repo.grants[otherOrgID][userID] = nil
+		resolver.InvalidateMember(ctx, otherOrgID, userID)
+		if allowed, _ := resolver.HasPermission(ctx, userID, otherOrgID, "read_vault_items"); allowed {
+			t.Error("Expected the revoked permission to be refused after invalidation")
+		}
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		repo.grants[otherOrgID][userID] = []string{"read_vault_items"}
+		before := repo.queries
+		allowed, err := resolver.OrganizationsWithPermission(ctx, userID, []uuid.UUID{orgID, otherOrgID, uuid.New()}, "create_vault_item")
+		if err != nil {
+			t.Fatalf("Failed to resolve permissions: %v", err)
+		}
+		if repo.queries-before != 1 {
+			t.Errorf("Expected one query, got %d", repo.queries-before)
+		}
+		if !allowed[orgID] || allowed[otherOrgID] || len(allowed) != 1 {
+			t.Errorf("Expected only %s to be allowed, got %v", orgID, allowed)
+		}
+	})
+}
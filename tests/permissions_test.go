@@ -0,0 +1,61 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+)
+
+func TestPermissionCatalog(t *testing.T) {
+	t.Run("Templates Use Catalog", func(t *testing.T) {
+		for _, template := range services.RoleTemplates {
+			for _, permission := range template.Permissions {
+				if !services.IsKnownPermission(permission) {
+					t.Errorf("Role %s grants %s, which is not in the catalog", template.Name, permission)
+				}
+			}
+		}
+		if services.IsKnownPermission("delete_everything") {
+			t.Error("Expected a permission outside the catalog to be unknown")
+		}
+	})
+
+	t.Run("Owner Has Every Permission", func(t *testing.T) {
+		for _, template := range services.RoleTemplates {
+			if template.Name != services.RoleOwner {
+				continue
+			}
+			if len(template.Permissions) != len(services.PermissionCatalog) {
+				t.Errorf("Expected the owner to have %d permissions, got %d", len(services.PermissionCatalog), len(template.Permissions))
+			}
+			return
+		}
+		t.Error("Expected an Owner role template")
+	})
+
+	t.Run("Migrations Seed Catalog", func(t *testing.T) {
+		files, err := filepath.Glob("../db/migrations/*.sql")
+		if err != nil || len(files) == 0 {
+			t.Fatalf("Failed to find migrations: %v", err)
+		}
+		var migrations strings.Builder
+		for _, file := range files {
+			if strings.HasSuffix(file, "_rollback.sql") {
+				continue
+			}
+			migration, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Failed to read migration: %v", err)
+			}
+			migrations.Write(migration)
+		}
+		for _, permission := range services.PermissionCatalog {
+			if !strings.Contains(migrations.String(), "'"+permission.Name+"', '"+permission.Description+"'") {
+				t.Errorf("Expected a migration to seed %s as in the catalog", permission.Name)
+			}
+		}
+	})
+}
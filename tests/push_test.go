@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// membershipRepository answers the membership and collection access lookups of the
+// notifications hub; any other call panics
+type membershipRepository struct {
+	repository.Repository
+	memberships map[uuid.UUID][]models.OrganizationUser
+	managers    map[uuid.UUID]bool
+	readable    map[uuid.UUID][]uuid.UUID
+}
+
+func (r *membershipRepository) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error) {
+	return r.memberships[userID], nil
+}
+
+func (r *membershipRepository) MemberHasPermission(ctx context.Context, orgID, userID uuid.UUID, permissionName string) (bool, error) {
+	return permissionName == services.PermissionManageCollections && r.managers[userID], nil
+}
+
+func (r *membershipRepository) ListCollectionsWithPermission(ctx context.Context, userID uuid.UUID, collectionIDs []uuid.UUID, permissionName string) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	for _, id := range collectionIDs {
+		for _, readable := range r.readable[userID] {
+			if readable == id && permissionName == services.PermissionReadVaultItems {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, nil
+}
+
+func receivePush(t *testing.T, subscription *services.PushSubscription) (services.PushMessage, bool) {
+	t.Helper()
+	select {
+	case msg, ok := <-subscription.Messages():
+		return msg, ok
+	case <-time.After(time.Second):
+		t.Fatal("Expected a push message")
+		return services.PushMessage{}, false
+	}
+}
+
+func expectNoPush(t *testing.T, subscription *services.PushSubscription) {
+	t.Helper()
+	select {
+	case msg := <-subscription.Messages():
+		t.Errorf("Expected no push message, got %s", msg.Type)
+	default:
+	}
+}
+
+func TestNotificationHub(t *testing.T) {
+	ctx := context.Background()
+	alice, bob := uuid.New(), uuid.New()
+	orgID := uuid.New()
+	repo := &membershipRepository{memberships: map[uuid.UUID][]models.OrganizationUser{
+		alice: {{UserID: alice, OrganizationID: orgID, Status: "confirmed"}},
+		bob:   {{UserID: bob, OrganizationID: orgID, Status: "invited"}},
+	}}
+	hub := services.NewNotificationHub(repo, "")
+
+	aliceSession, aliceOther := uuid.New(), uuid.New()
+	aliceSub, err := hub.Subscribe(ctx, alice, aliceSession, uuid.Nil)
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	defer aliceSub.Close()
+	aliceOtherSub, _ := hub.Subscribe(ctx, alice, aliceOther, uuid.Nil)
+	defer aliceOtherSub.Close()
+	bobSub, _ := hub.Subscribe(ctx, bob, uuid.New(), uuid.Nil)
+	defer bobSub.Close()
+
+	t.Run("User Message", func(t *testing.T) {
+		itemID := uuid.New()
+		hub.Publish(ctx, services.PushTarget{UserID: alice}, services.PushMessage{Type: services.PushSyncItem, ID: &itemID})
+		if msg, _ := receivePush(t, aliceSub); msg.Type != services.PushSyncItem || *msg.ID != itemID {
+			t.Errorf("Expected sync_item for %s, got %+v", itemID, msg)
+		}
+		receivePush(t, aliceOtherSub)
+		expectNoPush(t, bobSub)
+	})
+
+	t.Run("Organization Message Reaches Confirmed Members", func(t *testing.T) {
+		hub.Publish(ctx, services.PushTarget{OrganizationID: orgID}, services.PushMessage{Type: services.PushSyncCollection})
+		receivePush(t, aliceSub)
+		receivePush(t, aliceOtherSub)
+		expectNoPush(t, bobSub)
+	})
+
+	t.Run("Origin Session Skipped", func(t *testing.T) {
+		hub.Publish(ctx, services.PushTarget{UserID: alice, OriginSessionID: aliceSession}, services.PushMessage{Type: services.PushSyncFolder})
+		receivePush(t, aliceOtherSub)
+		expectNoPush(t, aliceSub)
+	})
+
+	t.Run("Logout Closes Session Connection", func(t *testing.T) {
+		hub.Publish(ctx, services.PushTarget{UserID: alice, SessionID: aliceOther}, services.PushMessage{Type: services.PushLogout})
+		if msg, _ := receivePush(t, aliceOtherSub); msg.Type != services.PushLogout {
+			t.Errorf("Expected logout, got %s", msg.Type)
+		}
+		if _, ok := receivePush(t, aliceOtherSub); ok {
+			t.Error("Expected the connection to be closed after logout")
+		}
+		expectNoPush(t, aliceSub)
+	})
+
+	t.Run("Membership Change Refreshes Organizations", func(t *testing.T) {
+		repo.memberships[bob] = []models.OrganizationUser{{UserID: bob, OrganizationID: orgID, Status: "confirmed"}}
+		hub.Publish(ctx, services.PushTarget{UserID: bob}, services.PushMessage{Type: services.PushSyncOrganization, OrganizationID: &orgID})
+		receivePush(t, bobSub)
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			hub.Publish(ctx, services.PushTarget{OrganizationID: orgID}, services.PushMessage{Type: services.PushSyncCollection})
+			receivePush(t, aliceSub)
+			select {
+			case <-bobSub.Messages():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("Expected the new member to receive organization messages")
+			}
+		}
+	})
+}
+
+func TestNotificationHubCollectionScope(t *testing.T) {
+	ctx := context.Background()
+	orgID := uuid.New()
+	shared, hidden := uuid.New(), uuid.New()
+	manager, reader, outsider := uuid.New(), uuid.New(), uuid.New()
+
+	repo := &membershipRepository{
+		memberships: make(map[uuid.UUID][]models.OrganizationUser),
+		managers:    map[uuid.UUID]bool{manager: true},
+		readable:    map[uuid.UUID][]uuid.UUID{reader: {shared}},
+	}
+	for _, userID := range []uuid.UUID{manager, reader, outsider} {
+		repo.memberships[userID] = []models.OrganizationUser{{UserID: userID, OrganizationID: orgID, Status: "confirmed"}}
+	}
+	hub := services.NewNotificationHub(repo, "")
+
+	subscriptions := make(map[uuid.UUID]*services.PushSubscription)
+	for _, userID := range []uuid.UUID{manager, reader, outsider} {
+		subscription, err := hub.Subscribe(ctx, userID, uuid.New(), uuid.Nil)
+		if err != nil {
+			t.Fatalf("Failed to subscribe: %v", err)
+		}
+		defer subscription.Close()
+		subscriptions[userID] = subscription
+	}
+
+	tests := []struct {
+		name       string
+		target     services.PushTarget
+		recipients []uuid.UUID
+	}{
+		{"Shared Collection", services.PushTarget{OrganizationID: orgID, CollectionScoped: true, CollectionID: shared}, []uuid.UUID{manager, reader}},
+		{"Hidden Collection", services.PushTarget{OrganizationID: orgID, CollectionScoped: true, CollectionID: hidden}, []uuid.UUID{manager}},
+		{"No Collection", services.PushTarget{OrganizationID: orgID, CollectionScoped: true}, []uuid.UUID{manager}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			itemID := uuid.New()
+			hub.Publish(ctx, tt.target, services.PushMessage{Type: services.PushSyncItem, ID: &itemID})
+
+			for userID, subscription := range subscriptions {
+				expected := false
+				for _, recipient := range tt.recipients {
+					expected = expected || recipient == userID
+				}
+				if !expected {
+					expectNoPush(t, subscription)
+					continue
+				}
+				if msg, _ := receivePush(t, subscription); msg.ID == nil || *msg.ID != itemID {
+					t.Errorf("Expected sync_item for %s, got %+v", itemID, msg)
+				}
+			}
+		})
+	}
+}
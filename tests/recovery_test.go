@@ -0,0 +1,301 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// recoveryRepository keeps the records of an organization recovery in memory on top of
+// organizationRotationRepository; any other call panics
+type recoveryRepository struct {
+	*organizationRotationRepository
+	grants       map[uuid.UUID][]string
+	recoveryKeys []*models.OrganizationRecoveryKey
+	sessions     []*models.RecoverySession
+	shares       []models.RecoverySessionShare
+}
+
+func (r *recoveryRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	return r.grants[userID], nil
+}
+
+func (r *recoveryRepository) GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	for _, member := range r.members {
+		if member.OrganizationID == orgID && member.UserID == userID {
+			found := member
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *recoveryRepository) CreateOrganizationRecoveryKey(ctx context.Context, key *models.OrganizationRecoveryKey) error {
+	key.ID = uuid.New()
+	for i := range key.Custodians {
+		key.Custodians[i].ID = uuid.New()
+	}
+	r.recoveryKeys = append(r.recoveryKeys, key)
+	return nil
+}
+
+func (r *recoveryRepository) GetActiveOrganizationRecoveryKey(ctx context.Context, orgID uuid.UUID) (*models.OrganizationRecoveryKey, error) {
+	for _, key := range r.recoveryKeys {
+		if key.OrganizationID == orgID && key.IsActive {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *recoveryRepository) GetOrganizationRecoveryKey(ctx context.Context, id uuid.UUID) (*models.OrganizationRecoveryKey, error) {
+	for _, key := range r.recoveryKeys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *recoveryRepository) CreateRecoverySession(ctx context.Context, session *models.RecoverySession) error {
+	session.ID = uuid.New()
+	r.sessions = append(r.sessions, session)
+	return nil
+}
+
+func (r *recoveryRepository) GetRecoverySession(ctx context.Context, id uuid.UUID) (*models.RecoverySession, error) {
+	for _, session := range r.sessions {
+		if session.ID == id {
+			return session, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *recoveryRepository) GetOpenRecoverySession(ctx context.Context, orgID uuid.UUID) (*models.RecoverySession, error) {
+	for _, session := range r.sessions {
+		if session.OrganizationID == orgID && session.ClosedAt == nil {
+			return session, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *recoveryRepository) UpdateRecoverySession(ctx context.Context, session *models.RecoverySession) error {
+	return nil
+}
+
+func (r *recoveryRepository) CreateRecoverySessionShare(ctx context.Context, share *models.RecoverySessionShare) (bool, error) {
+	for _, stored := range r.shares {
+		if stored.RecoverySessionID == share.RecoverySessionID && stored.CustodianID == share.CustodianID {
+			return false, nil
+		}
+	}
+	r.shares = append(r.shares, *share)
+	return true, nil
+}
+
+func (r *recoveryRepository) ListRecoverySessionShares(ctx context.Context, sessionID uuid.UUID) ([]models.RecoverySessionShare, error) {
+	var shares []models.RecoverySessionShare
+	for _, share := range r.shares {
+		if share.RecoverySessionID == sessionID {
+			shares = append(shares, share)
+		}
+	}
+	return shares, nil
+}
+
+func (r *recoveryRepository) DeleteRecoverySessionShares(ctx context.Context, sessionID uuid.UUID) error {
+	var kept []models.RecoverySessionShare
+	for _, share := range r.shares {
+		if share.RecoverySessionID != sessionID {
+			kept = append(kept, share)
+		}
+	}
+	r.shares = kept
+	return nil
+}
+
+// quietEmail accepts every email without sending it
+type quietEmail struct {
+	services.EmailService
+}
+
+func (e *quietEmail) SendTemplatedEmail(ctx context.Context, template string, data interface{}, recipients []string) error {
+	return nil
+}
+
+func TestOrganizationRecovery(t *testing.T) {
+	encryption := services.NewEncryptionService()
+	masterKey, _ := encryption.GenerateSymmetricKey()
+	shareKey, _ := encryption.GenerateSymmetricKey()
+	ctx := context.Background()
+	orgID, ownerID, memberID, lostID := uuid.New(), uuid.New(), uuid.New(), uuid.New()
+	custodianIDs := []uuid.UUID{uuid.New(), uuid.New(), uuid.New()}
+	roleID := uuid.New()
+
+	orgKey, _ := encryption.GenerateSymmetricKey()
+	wrappedOrgKey, _ := encryption.EncryptSymmetric(orgKey, masterKey)
+	privateKeys := make(map[uuid.UUID][]byte)
+
+	// newService sets up an organization whose owner may run a recovery, three custodians,
+	// a plain member and a member who lost access to the organization key
+	newService := func(t *testing.T) (services.OrganizationRecoveryService, *recoveryRepository) {
+		t.Helper()
+		repo := &recoveryRepository{
+			organizationRotationRepository: &organizationRotationRepository{
+				keyRotationRepository: &keyRotationRepository{
+					users: make(map[uuid.UUID]*models.User),
+					keys: []*models.EncryptionKey{
+						{Base: models.Base{ID: uuid.New()}, OwnerType: "organization", OwnerID: orgID, Version: 1, WrappedKey: string(wrappedOrgKey), IsActive: true},
+					},
+				},
+			},
+			grants: map[uuid.UUID][]string{
+				ownerID:  {services.PermissionManageOrganizationRecovery},
+				memberID: {services.PermissionReadVaultItems},
+			},
+		}
+		for _, userID := range append([]uuid.UUID{ownerID, memberID, lostID}, custodianIDs...) {
+			publicKey, privateKey, err := encryption.GenerateKeyPairWithAlgorithm(services.DefaultKeyAlgorithm)
+			if err != nil {
+				t.Fatalf("Failed to generate key pair: %v", err)
+			}
+			privateKeys[userID] = privateKey
+			repo.users[userID] = &models.User{Base: models.Base{ID: userID}, Name: userID.String()}
+			repo.keys = append(repo.keys, &models.EncryptionKey{Base: models.Base{ID: uuid.New()}, OwnerType: "user", OwnerID: userID, Version: 1, PublicKey: string(publicKey), IsActive: true})
+			repo.members = append(repo.members, models.OrganizationUser{UserID: userID, OrganizationID: orgID, Status: "confirmed", KeyVersion: 1})
+		}
+		repo.members[2].RoleID = &roleID
+		repo.members[2].KeyVersion = 0
+
+		keys := services.NewKeyRotationService(repo, encryption, &retiringSessions{}, masterKey)
+		permissions := services.NewPermissionResolver(repo, nil)
+		return services.NewOrganizationRecoveryService(repo, encryption, keys, &quietEmail{}, permissions, shareKey), repo
+	}
+
+	// custodianShare decrypts the custodian's share the way their client would
+	custodianShare := func(t *testing.T, recovery services.OrganizationRecoveryService, sessionID, custodianID uuid.UUID) string {
+		t.Helper()
+		encrypted, err := recovery.GetCustodianShare(ctx, sessionID, custodianID)
+		if err != nil {
+			t.Fatalf("Failed to get custodian share: %v", err)
+		}
+		sealed, _ := base64.StdEncoding.DecodeString(encrypted)
+		share, err := encryption.DecryptWithPrivateKey(sealed, privateKeys[custodianID])
+		if err != nil {
+			t.Fatalf("Expected the share to be encrypted to its custodian, got %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(share)
+	}
+
+	t.Run("Requires Recovery Permission", func(t *testing.T) {
+		recovery, repo := newService(t)
+
+		if _, err := recovery.SetupRecoveryKey(ctx, orgID, memberID, 2, custodianIDs); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without the permission to be refused, got %v", err)
+		}
+		if _, err := recovery.SetupRecoveryKey(ctx, orgID, ownerID, 2, custodianIDs); err != nil {
+			t.Fatalf("Failed to set up recovery key: %v", err)
+		}
+		if _, err := recovery.GetRecoveryKey(ctx, orgID, memberID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without the permission to be refused the key, got %v", err)
+		}
+		if _, err := recovery.StartRecovery(ctx, orgID, memberID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without the permission to be refused a recovery, got %v", err)
+		}
+		if err := recovery.DisableRecoveryKey(ctx, orgID, memberID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without the permission to be refused disabling, got %v", err)
+		}
+		if len(repo.sessions) != 0 || !repo.recoveryKeys[0].IsActive {
+			t.Error("Expected refused calls to change nothing")
+		}
+	})
+
+	t.Run("Rejects Custodian Outside Organization", func(t *testing.T) {
+		recovery, _ := newService(t)
+
+		outsiders := append([]uuid.UUID{uuid.New()}, custodianIDs[1:]...)
+		if _, err := recovery.SetupRecoveryKey(ctx, orgID, ownerID, 2, outsiders); !errors.Is(err, services.ErrUserNotFound) {
+			t.Errorf("Expected a custodian outside the organization to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Recovers With Custodian Shares", func(t *testing.T) {
+		recovery, repo := newService(t)
+
+		if _, err := recovery.SetupRecoveryKey(ctx, orgID, ownerID, 2, custodianIDs); err != nil {
+			t.Fatalf("Failed to set up recovery key: %v", err)
+		}
+		session, err := recovery.StartRecovery(ctx, orgID, ownerID)
+		if err != nil {
+			t.Fatalf("Failed to start recovery: %v", err)
+		}
+
+		if _, err := recovery.GetCustodianShare(ctx, session.ID, memberID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member who is not a custodian to be refused a share, got %v", err)
+		}
+		first := custodianShare(t, recovery, session.ID, custodianIDs[0])
+		if _, err := recovery.SubmitRecoveryShare(ctx, session.ID, memberID, first); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member who is not a custodian to be refused, got %v", err)
+		}
+		if _, err := recovery.SubmitRecoveryShare(ctx, session.ID, custodianIDs[1], first); !errors.Is(err, services.ErrInvalidRecoveryShare) {
+			t.Errorf("Expected another custodian's share to be rejected, got %v", err)
+		}
+		if _, err := recovery.SubmitRecoveryShare(ctx, session.ID, custodianIDs[0], first); err != nil {
+			t.Fatalf("Failed to submit share: %v", err)
+		}
+		if _, err := recovery.SubmitRecoveryShare(ctx, session.ID, custodianIDs[0], first); !errors.Is(err, services.ErrRecoveryShareSubmitted) {
+			t.Errorf("Expected a second share from the same custodian to be refused, got %v", err)
+		}
+
+		second, _ := base64.RawURLEncoding.DecodeString(custodianShare(t, recovery, session.ID, custodianIDs[1]))
+		second[len(second)-1] ^= 1
+		if _, err := recovery.SubmitRecoveryShare(ctx, session.ID, custodianIDs[1], base64.RawURLEncoding.EncodeToString(second)); !errors.Is(err, services.ErrInvalidRecoveryShare) {
+			t.Errorf("Expected a tampered share to fail its commitment, got %v", err)
+		}
+		if session.SharesReceived != 1 {
+			t.Errorf("Expected rejected shares not to count, got %d", session.SharesReceived)
+		}
+
+		unlocked, err := recovery.SubmitRecoveryShare(ctx, session.ID, custodianIDs[1], custodianShare(t, recovery, session.ID, custodianIDs[1]))
+		if err != nil {
+			t.Fatalf("Failed to submit share: %v", err)
+		}
+		if unlocked.Status != "unlocked" {
+			t.Fatalf("Expected the threshold to unlock the session, got %s", unlocked.Status)
+		}
+		for _, stored := range repo.shares {
+			if stored.EncryptedShare == first {
+				t.Error("Expected submitted shares to be encrypted at rest")
+			}
+		}
+
+		if err := recovery.RestoreOrganizationAccess(ctx, session.ID, ownerID, uuid.New()); !errors.Is(err, services.ErrUserNotFound) {
+			t.Errorf("Expected restoring someone who was not a member to be refused, got %v", err)
+		}
+		if err := recovery.RestoreOrganizationAccess(ctx, session.ID, ownerID, lostID); err != nil {
+			t.Fatalf("Failed to restore access: %v", err)
+		}
+		restored := repo.members[2]
+		if restored.RoleID == nil || *restored.RoleID != roleID {
+			t.Errorf("Expected the member to keep their role, got %v", restored.RoleID)
+		}
+		wrapped, _ := base64.StdEncoding.DecodeString(restored.EncryptedKey)
+		if key, err := encryption.DecryptWithPrivateKey(wrapped, privateKeys[lostID]); err != nil || string(key) != string(orgKey) {
+			t.Errorf("Expected the member to receive the organization key, got %v", err)
+		}
+
+		if err := recovery.CloseRecoverySession(ctx, session.ID, ownerID); err != nil {
+			t.Fatalf("Failed to close session: %v", err)
+		}
+		if len(repo.shares) != 0 {
+			t.Errorf("Expected closing the session to discard the shares, got %d", len(repo.shares))
+		}
+	})
+}
@@ -0,0 +1,355 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"html"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+	"github.com/emailimmunity/passwordimmunity/services"
+)
+
+const (
+	testSAMLMetadataURL = "https://vault.example.com/api/sso/organizations/org/saml/metadata"
+	testSAMLACSURL      = "https://vault.example.com/api/sso/organizations/org/saml/acs"
+)
+
+// mockSAMLIdP is an in-process SAML identity provider. It signs both the response and
+// the assertion, and encrypts the assertion when the service provider metadata it
+// holds has an encryption key.
+type mockSAMLIdP struct {
+	idp *saml.IdentityProvider
+	// serviceProvider is the metadata the identity provider addresses responses with,
+	// whichever service provider sent the request
+	serviceProvider *saml.EntityDescriptor
+}
+
+func (m *mockSAMLIdP) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	return m.serviceProvider, nil
+}
+
+func newMockSAMLIdP(t *testing.T) *mockSAMLIdP {
+	key, certificate := newTestSAMLKeyPair(t, "idp.example.com")
+	metadataURL, _ := url.Parse("https://idp.example.com/metadata")
+	ssoURL, _ := url.Parse("https://idp.example.com/sso")
+
+	m := &mockSAMLIdP{}
+	m.idp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             certificate,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: m,
+	}
+	return m
+}
+
+func (m *mockSAMLIdP) metadata(t *testing.T) []byte {
+	metadata, err := xml.Marshal(m.idp.Metadata())
+	if err != nil {
+		t.Fatalf("Failed to marshal IdP metadata: %v", err)
+	}
+	return metadata
+}
+
+// trust registers the service provider's metadata with the identity provider. Without
+// encryption, the encryption key is left out and assertions are sent in plain text.
+func (m *mockSAMLIdP) trust(t *testing.T, sp *services.SAMLServiceProvider, encryption bool) {
+	metadata, err := sp.Metadata()
+	if err != nil {
+		t.Fatalf("Failed to get SP metadata: %v", err)
+	}
+	var descriptor saml.EntityDescriptor
+	if err := xml.Unmarshal(metadata, &descriptor); err != nil {
+		t.Fatalf("Failed to parse SP metadata: %v", err)
+	}
+	if !encryption {
+		for i := range descriptor.SPSSODescriptors {
+			var keys []saml.KeyDescriptor
+			for _, key := range descriptor.SPSSODescriptors[i].KeyDescriptors {
+				if key.Use != "encryption" {
+					keys = append(keys, key)
+				}
+			}
+			descriptor.SPSSODescriptors[i].KeyDescriptors = keys
+		}
+	}
+	m.serviceProvider = &descriptor
+}
+
+// respond plays the user signing in at the identity provider with a redirect binding
+// AuthnRequest and returns the SAMLResponse and RelayState it would post back
+func (m *mockSAMLIdP) respond(t *testing.T, redirectURL, nameID string) (string, string) {
+	r := httptest.NewRequest(http.MethodGet, redirectURL, nil)
+	req, err := saml.NewIdpAuthnRequest(m.idp, r)
+	if err != nil {
+		t.Fatalf("Failed to read AuthnRequest: %v", err)
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("IdP rejected AuthnRequest: %v", err)
+	}
+	err = saml.DefaultAssertionMaker{}.MakeAssertion(req, &saml.Session{
+		ID:           "session-1",
+		NameID:       nameID,
+		NameIDFormat: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent",
+		CustomAttributes: []saml.Attribute{{
+			Name:   "mail",
+			Values: []saml.AttributeValue{{Type: "xs:string", Value: "saml@example.com"}},
+		}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to make assertion: %v", err)
+	}
+	form, err := req.PostBinding()
+	if err != nil {
+		t.Fatalf("Failed to make response: %v", err)
+	}
+	if form.URL != testSAMLACSURL {
+		t.Fatalf("Expected response to be posted to %s, got %s", testSAMLACSURL, form.URL)
+	}
+	return form.SAMLResponse, form.RelayState
+}
+
+func newTestSAMLKeyPair(t *testing.T, commonName string) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	certificate, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatalf("Failed to parse certificate: %v", err)
+	}
+	return key, certificate
+}
+
+// usedAssertions keeps the assertions a service provider accepted in memory
+type usedAssertions struct {
+	hashes map[string]time.Time
+}
+
+func newUsedAssertions() *usedAssertions {
+	return &usedAssertions{hashes: make(map[string]time.Time)}
+}
+
+func (a *usedAssertions) RecordSAMLAssertion(ctx context.Context, assertionHash string, expiresAt time.Time) (bool, error) {
+	if _, ok := a.hashes[assertionHash]; ok {
+		return false, nil
+	}
+	a.hashes[assertionHash] = expiresAt
+	return true, nil
+}
+
+func newTestSAMLServiceProvider(t *testing.T, idp *mockSAMLIdP, entityID string, assertions services.SAMLAssertionStore) *services.SAMLServiceProvider {
+	key, certificate := newTestSAMLKeyPair(t, "vault.example.com")
+	sp, err := services.NewSAMLServiceProvider(services.SAMLConfig{
+		EntityID:    entityID,
+		MetadataURL: testSAMLMetadataURL,
+		ACSURL:      testSAMLACSURL,
+		IDPMetadata: idp.metadata(t),
+		Key:         key,
+		Certificate: certificate,
+	}, assertions)
+	if err != nil {
+		t.Fatalf("Failed to create service provider: %v", err)
+	}
+	return sp
+}
+
+// editSAMLResponse decodes a SAMLResponse, lets edit change it and encodes it again
+func editSAMLResponse(t *testing.T, samlResponse string, edit func(response *etree.Element)) string {
+	raw, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	doc := etree.NewDocument()
+	if err := doc.ReadFromBytes(raw); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	edit(doc.Root())
+	raw, err = doc.WriteToBytes()
+	if err != nil {
+		t.Fatalf("Failed to write response: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+func TestSAMLServiceProvider(t *testing.T) {
+	ctx := context.Background()
+	idp := newMockSAMLIdP(t)
+	sp := newTestSAMLServiceProvider(t, idp, "", newUsedAssertions())
+	idp.trust(t, sp, false)
+
+	t.Run("Redirect Binding", func(t *testing.T) {
+		requestID, redirectURL, err := sp.RedirectAuthnRequest("relay-1")
+		if err != nil {
+			t.Fatalf("Failed to create AuthnRequest: %v", err)
+		}
+		query, _ := url.Parse(redirectURL)
+		if !strings.HasPrefix(redirectURL, "https://idp.example.com/sso?") {
+			t.Errorf("Expected the IdP's single sign-on URL, got %s", redirectURL)
+		}
+		if query.Query().Get("SigAlg") == "" || query.Query().Get("Signature") == "" {
+			t.Error("Expected a signed AuthnRequest")
+		}
+
+		samlResponse, relayState := idp.respond(t, redirectURL, "idp-user-1")
+		if relayState != "relay-1" {
+			t.Errorf("Expected relay state relay-1, got %s", relayState)
+		}
+		assertion, err := sp.ParseResponse(ctx, samlResponse, requestID)
+		if err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if assertion.Issuer != "https://idp.example.com/metadata" || assertion.NameID != "idp-user-1" {
+			t.Errorf("Unexpected issuer or NameID: %s %s", assertion.Issuer, assertion.NameID)
+		}
+		if values := assertion.Attributes["mail"]; len(values) != 1 || values[0] != "saml@example.com" {
+			t.Errorf("Expected mail attribute, got %v", values)
+		}
+
+		if _, err := sp.ParseResponse(ctx, samlResponse, requestID); !errors.Is(err, services.ErrSAMLAssertionReplayed) {
+			t.Errorf("Expected replayed assertion to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Post Binding", func(t *testing.T) {
+		requestID, form, err := sp.PostAuthnRequest("relay-2")
+		if err != nil {
+			t.Fatalf("Failed to create AuthnRequest: %v", err)
+		}
+		if requestID == "" || !strings.Contains(string(form), `action="https://idp.example.com/sso"`) {
+			t.Fatalf("Expected a form posting to the IdP, got %s", form)
+		}
+
+		// The form carries the request as an XML document with an enveloped signature
+		start := strings.Index(string(form), `name="SAMLRequest" value="`) + len(`name="SAMLRequest" value="`)
+		end := strings.Index(string(form)[start:], `"`)
+		raw, err := base64.StdEncoding.DecodeString(html.UnescapeString(string(form)[start : start+end]))
+		if err != nil {
+			t.Fatalf("Failed to decode SAMLRequest: %v", err)
+		}
+		if !strings.Contains(string(raw), "SignatureValue") || !strings.Contains(string(raw), requestID) {
+			t.Errorf("Expected a signed AuthnRequest with ID %s", requestID)
+		}
+	})
+
+	t.Run("Encrypted Assertion", func(t *testing.T) {
+		idp.trust(t, sp, true)
+		defer idp.trust(t, sp, false)
+
+		requestID, redirectURL, err := sp.RedirectAuthnRequest("relay")
+		if err != nil {
+			t.Fatalf("Failed to create AuthnRequest: %v", err)
+		}
+		samlResponse, _ := idp.respond(t, redirectURL, "idp-user-2")
+		raw, _ := base64.StdEncoding.DecodeString(samlResponse)
+		if !strings.Contains(string(raw), "EncryptedAssertion") {
+			t.Fatal("Expected an encrypted assertion")
+		}
+		assertion, err := sp.ParseResponse(ctx, samlResponse, requestID)
+		if err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if assertion.NameID != "idp-user-2" {
+			t.Errorf("Expected NameID idp-user-2, got %s", assertion.NameID)
+		}
+	})
+
+	t.Run("Tampered NameID", func(t *testing.T) {
+		requestID, redirectURL, _ := sp.RedirectAuthnRequest("relay")
+		samlResponse, _ := idp.respond(t, redirectURL, "idp-user-1")
+		tampered := editSAMLResponse(t, samlResponse, func(response *etree.Element) {
+			response.FindElement("./Assertion/Subject/NameID").SetText("admin")
+		})
+		if _, err := sp.ParseResponse(ctx, tampered, requestID); !errors.Is(err, services.ErrInvalidSAMLResponse) {
+			t.Errorf("Expected ErrInvalidSAMLResponse, got %v", err)
+		}
+	})
+
+	t.Run("Signature Wrapping", func(t *testing.T) {
+		requestID, redirectURL, _ := sp.RedirectAuthnRequest("relay")
+		samlResponse, _ := idp.respond(t, redirectURL, "idp-user-1")
+
+		// Keep the signed assertion but put a forged one where a careless parser looks
+		// first
+		wrapped := editSAMLResponse(t, samlResponse, func(response *etree.Element) {
+			signed := response.FindElement("./Assertion")
+			forged := signed.Copy()
+			forged.RemoveChild(forged.FindElement("./Signature"))
+			forged.FindElement("./Subject/NameID").SetText("admin")
+			response.InsertChildAt(signed.Index(), forged)
+		})
+		if _, err := sp.ParseResponse(ctx, wrapped, requestID); !errors.Is(err, services.ErrInvalidSAMLResponse) {
+			t.Errorf("Expected wrapped response to be rejected, got %v", err)
+		}
+
+		// Move the signed assertion out of sight and leave the forged one in its place
+		hidden := editSAMLResponse(t, samlResponse, func(response *etree.Element) {
+			signed := response.FindElement("./Assertion")
+			forged := signed.Copy()
+			forged.RemoveChild(forged.FindElement("./Signature"))
+			forged.FindElement("./Subject/NameID").SetText("admin")
+			forged.CreateAttr("ID", "forged")
+			response.RemoveChild(signed)
+			extensions := response.CreateElement("samlp:Extensions")
+			extensions.AddChild(signed)
+			response.AddChild(forged)
+		})
+		if _, err := sp.ParseResponse(ctx, hidden, requestID); !errors.Is(err, services.ErrInvalidSAMLResponse) {
+			t.Errorf("Expected wrapped response to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Unsolicited Response", func(t *testing.T) {
+		_, redirectURL, _ := sp.RedirectAuthnRequest("relay")
+		samlResponse, _ := idp.respond(t, redirectURL, "idp-user-1")
+		if _, err := sp.ParseResponse(ctx, samlResponse, "id-another-request"); !errors.Is(err, services.ErrInvalidSAMLResponse) {
+			t.Errorf("Expected ErrInvalidSAMLResponse, got %v", err)
+		}
+	})
+
+	t.Run("Wrong Audience", func(t *testing.T) {
+		// The identity provider addresses its response to sp, not to other
+		other := newTestSAMLServiceProvider(t, idp, "https://other.example.com/saml", newUsedAssertions())
+		requestID, redirectURL, _ := other.RedirectAuthnRequest("relay")
+		samlResponse, _ := idp.respond(t, redirectURL, "idp-user-1")
+		if _, err := other.ParseResponse(ctx, samlResponse, requestID); !errors.Is(err, services.ErrInvalidSAMLResponse) {
+			t.Errorf("Expected ErrInvalidSAMLResponse, got %v", err)
+		}
+	})
+
+	t.Run("Expired Assertion", func(t *testing.T) {
+		requestID, redirectURL, _ := sp.RedirectAuthnRequest("relay")
+		saml.TimeNow = func() time.Time { return time.Now().UTC().Add(-time.Hour) }
+		samlResponse, _ := idp.respond(t, redirectURL, "idp-user-1")
+		saml.TimeNow = func() time.Time { return time.Now().UTC() }
+
+		if _, err := sp.ParseResponse(ctx, samlResponse, requestID); !errors.Is(err, services.ErrInvalidSAMLResponse) {
+			t.Errorf("Expected ErrInvalidSAMLResponse, got %v", err)
+		}
+	})
+}
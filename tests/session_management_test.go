@@ -0,0 +1,236 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// memberSessionRepository keeps organization members, their permissions and sessions in
+// memory; any other call panics
+type memberSessionRepository struct {
+	repository.Repository
+	memberships []models.OrganizationUser
+	grants      map[uuid.UUID][]string
+	sessions    map[uuid.UUID]*models.Session
+}
+
+func (r *memberSessionRepository) GetOrganizationUser(ctx context.Context, orgID, userID uuid.UUID) (*models.OrganizationUser, error) {
+	for _, member := range r.memberships {
+		if member.OrganizationID == orgID && member.UserID == userID {
+			found := member
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *memberSessionRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	if member, _ := r.GetOrganizationUser(ctx, orgID, userID); member == nil {
+		return nil, nil
+	}
+	return r.grants[userID], nil
+}
+
+func (r *memberSessionRepository) GetSession(ctx context.Context, id uuid.UUID) (*models.Session, error) {
+	if session, ok := r.sessions[id]; ok {
+		found := *session
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *memberSessionRepository) ListActiveOrganizationSessions(ctx context.Context, orgID, userID uuid.UUID) ([]models.Session, error) {
+	var active []models.Session
+	for _, session := range r.sessions {
+		if inOrganization(session, orgID, userID) && session.RevokedAt == nil {
+			active = append(active, *session)
+		}
+	}
+	return active, nil
+}
+
+func (r *memberSessionRepository) RevokeSession(ctx context.Context, id uuid.UUID) (bool, error) {
+	session, ok := r.sessions[id]
+	if !ok || session.RevokedAt != nil {
+		return false, nil
+	}
+	now := time.Now()
+	session.RevokedAt = &now
+	return true, nil
+}
+
+func (r *memberSessionRepository) RevokeOrganizationSessions(ctx context.Context, orgID, userID uuid.UUID) ([]models.Session, error) {
+	var revoked []models.Session
+	now := time.Now()
+	for _, session := range r.sessions {
+		if inOrganization(session, orgID, userID) && session.RevokedAt == nil {
+			session.RevokedAt = &now
+			revoked = append(revoked, *session)
+		}
+	}
+	return revoked, nil
+}
+
+// inOrganization reports whether the session is the user's and was signed in through the
+// organization
+func inOrganization(session *models.Session, orgID, userID uuid.UUID) bool {
+	return session.UserID == userID && session.OrganizationID != nil && *session.OrganizationID == orgID
+}
+
+func (r *memberSessionRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+func TestMemberSessions(t *testing.T) {
+	ctx := context.Background()
+	orgID := uuid.New()
+	adminID := uuid.New()
+	memberID := uuid.New()
+	outsiderID := uuid.New()
+
+	// newSessions sets up an admin who may manage sessions, a plain member with two
+	// sessions signed in through the organization and one signed in with their own
+	// password, and a user outside the organization with one session
+	newSessions := func(t *testing.T) (services.SessionService, *memberSessionRepository) {
+		t.Helper()
+		repo := &memberSessionRepository{
+			memberships: []models.OrganizationUser{
+				{OrganizationID: orgID, UserID: adminID, Status: "confirmed"},
+				{OrganizationID: orgID, UserID: memberID, Status: "confirmed"},
+			},
+			grants:   map[uuid.UUID][]string{adminID: {services.PermissionManageSessions}},
+			sessions: make(map[uuid.UUID]*models.Session),
+		}
+		for _, userID := range []uuid.UUID{memberID, memberID, outsiderID} {
+			session := &models.Session{
+				Base:           models.Base{ID: uuid.New()},
+				UserID:         userID,
+				OrganizationID: &orgID,
+				ExpiresAt:      time.Now().Add(time.Hour),
+			}
+			repo.sessions[session.ID] = session
+		}
+		personal := &models.Session{Base: models.Base{ID: uuid.New()}, UserID: memberID, ExpiresAt: time.Now().Add(time.Hour)}
+		repo.sessions[personal.ID] = personal
+		return services.NewSessionService(repo, nil, nil, services.NewPermissionResolver(repo, nil), nil, nil, nil), repo
+	}
+
+	// sessionOf returns the ID of one of the user's sessions signed in through the
+	// organization
+	sessionOf := func(repo *memberSessionRepository, userID uuid.UUID) uuid.UUID {
+		for id, session := range repo.sessions {
+			if inOrganization(session, orgID, userID) {
+				return id
+			}
+		}
+		return uuid.Nil
+	}
+
+	// personalSession returns the ID of the member's session signed in with their password
+	personalSession := func(repo *memberSessionRepository) uuid.UUID {
+		for id, session := range repo.sessions {
+			if session.OrganizationID == nil {
+				return id
+			}
+		}
+		return uuid.Nil
+	}
+
+	t.Run("Lists Member Sessions", func(t *testing.T) {
+		sessions, _ := newSessions(t)
+
+		infos, err := sessions.ListMemberSessions(ctx, orgID, adminID, memberID)
+		if err != nil {
+			t.Fatalf("Failed to list member sessions: %v", err)
+		}
+		if len(infos) != 2 {
+			t.Errorf("Expected the member's 2 sessions signed in through the organization, got %d", len(infos))
+		}
+	})
+
+	t.Run("Requires Permission", func(t *testing.T) {
+		sessions, repo := newSessions(t)
+
+		if _, err := sessions.ListMemberSessions(ctx, orgID, memberID, adminID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without manage_sessions to be refused, got %v", err)
+		}
+		if err := sessions.RevokeMemberSessions(ctx, orgID, memberID, adminID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected a member without manage_sessions to be refused, got %v", err)
+		}
+		if _, err := sessions.ListMemberSessions(ctx, uuid.New(), adminID, memberID); !errors.Is(err, services.ErrUnauthorized) {
+			t.Errorf("Expected the admin to be refused in another organization, got %v", err)
+		}
+		for _, session := range repo.sessions {
+			if session.RevokedAt != nil {
+				t.Errorf("Expected no session to be revoked, got %s", session.ID)
+			}
+		}
+	})
+
+	t.Run("Refuses Users Outside Organization", func(t *testing.T) {
+		sessions, repo := newSessions(t)
+
+		if _, err := sessions.ListMemberSessions(ctx, orgID, adminID, outsiderID); !errors.Is(err, services.ErrUserNotFound) {
+			t.Errorf("Expected a user outside the organization to be refused, got %v", err)
+		}
+		if err := sessions.RevokeMemberSession(ctx, orgID, adminID, outsiderID, sessionOf(repo, outsiderID)); !errors.Is(err, services.ErrUserNotFound) {
+			t.Errorf("Expected a session outside the organization to be refused, got %v", err)
+		}
+		if err := sessions.RevokeMemberSessions(ctx, orgID, adminID, outsiderID); !errors.Is(err, services.ErrUserNotFound) {
+			t.Errorf("Expected a user outside the organization to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Revokes One Member Session", func(t *testing.T) {
+		sessions, repo := newSessions(t)
+
+		if err := sessions.RevokeMemberSession(ctx, orgID, adminID, memberID, sessionOf(repo, outsiderID)); !errors.Is(err, services.ErrSessionNotFound) {
+			t.Errorf("Expected another user's session to be refused, got %v", err)
+		}
+		sessionID := sessionOf(repo, memberID)
+		if err := sessions.RevokeMemberSession(ctx, orgID, adminID, memberID, sessionID); err != nil {
+			t.Fatalf("Failed to revoke member session: %v", err)
+		}
+		if repo.sessions[sessionID].RevokedAt == nil {
+			t.Error("Expected the member session to be revoked")
+		}
+		if infos, _ := sessions.ListMemberSessions(ctx, orgID, adminID, memberID); len(infos) != 1 {
+			t.Errorf("Expected 1 session to remain, got %d", len(infos))
+		}
+	})
+
+	t.Run("Revokes All Member Sessions", func(t *testing.T) {
+		sessions, repo := newSessions(t)
+
+		if err := sessions.RevokeMemberSessions(ctx, orgID, adminID, memberID); err != nil {
+			t.Fatalf("Failed to revoke member sessions: %v", err)
+		}
+		for _, session := range repo.sessions {
+			if revoked := session.RevokedAt != nil; revoked != inOrganization(session, orgID, memberID) {
+				t.Errorf("Expected only the member's organization sessions to be revoked, got %v for %s", revoked, session.ID)
+			}
+		}
+	})
+
+	t.Run("Leaves Sessions Outside Organization", func(t *testing.T) {
+		sessions, repo := newSessions(t)
+		sessionID := personalSession(repo)
+
+		if err := sessions.RevokeMemberSession(ctx, orgID, adminID, memberID, sessionID); !errors.Is(err, services.ErrSessionNotFound) {
+			t.Errorf("Expected a session signed in with the member's password to be refused, got %v", err)
+		}
+		if err := sessions.RevokeMemberSessions(ctx, orgID, adminID, memberID); err != nil {
+			t.Fatalf("Failed to revoke member sessions: %v", err)
+		}
+		if repo.sessions[sessionID].RevokedAt != nil {
+			t.Error("Expected the member to stay signed in outside the organization")
+		}
+	})
+}
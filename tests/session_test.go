@@ -0,0 +1,286 @@
+package tests
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// deviceSessionRepository serves one device and one session signed in from it, and
+// records stale session cleanups; any other call panics
+type deviceSessionRepository struct {
+	repository.Repository
+	device  *models.Device
+	session *models.Session
+	user    *models.User
+	stale   chan time.Time
+}
+
+func (r *deviceSessionRepository) GetSessionByTokenHash(ctx context.Context, tokenHash string) (*models.Session, error) {
+	if r.session.TokenHash != tokenHash {
+		return nil, nil
+	}
+	found := *r.session
+	return &found, nil
+}
+
+func (r *deviceSessionRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return r.user, nil
+}
+
+func (r *deviceSessionRepository) GetDevice(ctx context.Context, id uuid.UUID) (*models.Device, error) {
+	return r.device, nil
+}
+
+func (r *deviceSessionRepository) UpdateDevice(ctx context.Context, device *models.Device) error {
+	return nil
+}
+
+func (r *deviceSessionRepository) DeleteDevice(ctx context.Context, id uuid.UUID) error {
+	return nil
+}
+
+func (r *deviceSessionRepository) RevokeDeviceSessions(ctx context.Context, deviceID uuid.UUID) ([]string, error) {
+	if r.session.DeviceID == nil || *r.session.DeviceID != deviceID || r.session.RevokedAt != nil {
+		return nil, nil
+	}
+	now := time.Now()
+	r.session.RevokedAt = &now
+	return []string{r.session.TokenHash}, nil
+}
+
+func (r *deviceSessionRepository) DeleteTwoFactorRememberTokensForDevice(ctx context.Context, deviceID uuid.UUID) error {
+	return nil
+}
+
+func (r *deviceSessionRepository) DeleteStaleSessions(ctx context.Context, before time.Time) (int64, error) {
+	r.stale <- before
+	return 0, nil
+}
+
+func (r *deviceSessionRepository) DeleteExpiredSessionTickets(ctx context.Context, before time.Time) (int64, error) {
+	return 0, nil
+}
+
+func (r *deviceSessionRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+// ticketRepository keeps one session, its user and session tickets in memory; any other
+// call panics
+type ticketRepository struct {
+	repository.Repository
+	session *models.Session
+	user    *models.User
+	tickets map[string]*models.SessionTicket
+}
+
+func (r *ticketRepository) GetSession(ctx context.Context, id uuid.UUID) (*models.Session, error) {
+	if r.session.ID != id {
+		return nil, nil
+	}
+	found := *r.session
+	return &found, nil
+}
+
+func (r *ticketRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	return r.user, nil
+}
+
+func (r *ticketRepository) CreateSessionTicket(ctx context.Context, ticket *models.SessionTicket) error {
+	stored := *ticket
+	stored.Ticket = ""
+	r.tickets[ticket.TicketHash] = &stored
+	return nil
+}
+
+func (r *ticketRepository) TakeSessionTicket(ctx context.Context, ticketHash string) (*models.SessionTicket, error) {
+	ticket := r.tickets[ticketHash]
+	delete(r.tickets, ticketHash)
+	return ticket, nil
+}
+
+func TestSessionTicket(t *testing.T) {
+	ctx := context.Background()
+
+	newFixture := func() (services.SessionService, *ticketRepository) {
+		userID := uuid.New()
+		repo := &ticketRepository{
+			session: &models.Session{
+				Base:       models.Base{ID: uuid.New()},
+				UserID:     userID,
+				KeyVersion: 1,
+				ExpiresAt:  time.Now().Add(time.Hour),
+			},
+			user:    &models.User{Base: models.Base{ID: userID}, KeyVersion: 1},
+			tickets: make(map[string]*models.SessionTicket),
+		}
+		return services.NewSessionService(repo, nil, nil, nil, nil, nil, nil), repo
+	}
+
+	t.Run("Opens One Connection", func(t *testing.T) {
+		sessions, repo := newFixture()
+
+		ticket, err := sessions.CreateSessionTicket(ctx, repo.session.ID)
+		if err != nil {
+			t.Fatalf("Failed to create ticket: %v", err)
+		}
+		if _, stored := repo.tickets[ticket.Ticket]; stored {
+			t.Error("Expected only a hash of the ticket to be stored")
+		}
+		if until := time.Until(ticket.ExpiresAt); until <= 0 || until > 30*time.Second {
+			t.Errorf("Expected the ticket to expire within 30 seconds, got %v", until)
+		}
+
+		session, err := sessions.RedeemSessionTicket(ctx, ticket.Ticket)
+		if err != nil {
+			t.Fatalf("Failed to redeem ticket: %v", err)
+		}
+		if session.ID != repo.session.ID {
+			t.Errorf("Expected session %s, got %s", repo.session.ID, session.ID)
+		}
+		if _, err := sessions.RedeemSessionTicket(ctx, ticket.Ticket); !errors.Is(err, services.ErrInvalidSession) {
+			t.Errorf("Expected a used ticket to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Expired Ticket", func(t *testing.T) {
+		sessions, repo := newFixture()
+
+		ticket, _ := sessions.CreateSessionTicket(ctx, repo.session.ID)
+		for _, stored := range repo.tickets {
+			stored.ExpiresAt = time.Now().Add(-time.Second)
+		}
+		if _, err := sessions.RedeemSessionTicket(ctx, ticket.Ticket); !errors.Is(err, services.ErrInvalidSession) {
+			t.Errorf("Expected an expired ticket to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Ticket Of Ended Session", func(t *testing.T) {
+		tests := []struct {
+			name string
+			end  func(repo *ticketRepository)
+		}{
+			{"Revoked", func(repo *ticketRepository) {
+				now := time.Now()
+				repo.session.RevokedAt = &now
+			}},
+			{"Expired", func(repo *ticketRepository) { repo.session.ExpiresAt = time.Now().Add(-time.Second) }},
+			{"Key Rotated", func(repo *ticketRepository) { repo.user.KeyVersion = 2 }},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				sessions, repo := newFixture()
+
+				ticket, _ := sessions.CreateSessionTicket(ctx, repo.session.ID)
+				tt.end(repo)
+				if _, err := sessions.RedeemSessionTicket(ctx, ticket.Ticket); !errors.Is(err, services.ErrInvalidSession) {
+					t.Errorf("Expected the ticket to be refused, got %v", err)
+				}
+			})
+		}
+	})
+}
+
+func TestDeviceSessionEviction(t *testing.T) {
+	const token = "session-token"
+	hash := sha256.Sum256([]byte(token))
+	ctx := context.Background()
+
+	// signedIn caches a session of a device and returns the services sharing that cache
+	signedIn := func(t *testing.T) (services.DeviceService, services.SessionService, *memoryCache) {
+		t.Helper()
+		now := time.Now()
+		userID := uuid.New()
+		deviceID := uuid.New()
+		repo := &deviceSessionRepository{
+			device: &models.Device{Base: models.Base{ID: deviceID}, UserID: userID, Status: "authorized"},
+			session: &models.Session{
+				Base:              models.Base{ID: uuid.New()},
+				UserID:            userID,
+				DeviceID:          &deviceID,
+				TokenHash:         hex.EncodeToString(hash[:]),
+				ExpiresAt:         now.Add(time.Hour),
+				AbsoluteExpiresAt: now.Add(24 * time.Hour),
+				LastUsed:          now,
+			},
+			user: &models.User{Base: models.Base{ID: userID}},
+		}
+		cache := &memoryCache{values: make(map[string]interface{})}
+		devices := services.NewDeviceService(repo, nil, nil, nil, nil, cache, nil)
+		sessions := services.NewSessionService(repo, nil, devices, nil, cache, nil, nil)
+
+		if _, err := sessions.ValidateSession(ctx, token); err != nil {
+			t.Fatalf("Expected the session to be valid, got %v", err)
+		}
+		if len(cache.values) != 1 {
+			t.Fatalf("Expected the session to be cached, got %d entries", len(cache.values))
+		}
+		return devices, sessions, cache
+	}
+
+	t.Run("Block Device", func(t *testing.T) {
+		devices, sessions, cache := signedIn(t)
+
+		if err := devices.BlockDevice(ctx, uuid.Nil); err != nil {
+			t.Fatalf("Failed to block device: %v", err)
+		}
+		if len(cache.values) != 0 {
+			t.Errorf("Expected the session to be evicted, got %d entries", len(cache.values))
+		}
+		if _, err := sessions.ValidateSession(ctx, token); !errors.Is(err, services.ErrInvalidSession) {
+			t.Errorf("Expected the session of a blocked device to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Deregister Device", func(t *testing.T) {
+		devices, sessions, cache := signedIn(t)
+
+		if err := devices.DeregisterDevice(ctx, uuid.Nil); err != nil {
+			t.Fatalf("Failed to deregister device: %v", err)
+		}
+		if len(cache.values) != 0 {
+			t.Errorf("Expected the session to be evicted, got %d entries", len(cache.values))
+		}
+		if _, err := sessions.ValidateSession(ctx, token); !errors.Is(err, services.ErrInvalidSession) {
+			t.Errorf("Expected the session of a removed device to be refused, got %v", err)
+		}
+	})
+}
+
+func TestSessionCleanup(t *testing.T) {
+	repo := &deviceSessionRepository{stale: make(chan time.Time, 1)}
+	sessions := services.NewSessionService(repo, nil, nil, nil, nil, nil, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sessions.RunCleanup(ctx, time.Hour)
+		close(done)
+	}()
+
+	select {
+	case before := <-repo.stale:
+		if age := time.Since(before); age < 7*24*time.Hour || age > 7*24*time.Hour+time.Minute {
+			t.Errorf("Expected sessions stale for a week to be deleted, got %v", age)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected stale sessions to be deleted on start")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the cleanup to stop when cancelled")
+	}
+}
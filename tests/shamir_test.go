@@ -0,0 +1,66 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+)
+
+func TestShamirSecretSharing(t *testing.T) {
+	secret := make([]byte, 48)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatalf("Failed to generate secret: %v", err)
+	}
+
+	shares, err := services.SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Failed to split secret: %v", err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("Expected 5 shares, got %d", len(shares))
+	}
+
+	t.Run("Any Threshold Subset Reconstructs", func(t *testing.T) {
+		subsets := [][]int{{0, 1, 2}, {0, 2, 4}, {1, 3, 4}, {4, 2, 0}, {0, 1, 2, 3, 4}}
+		for _, subset := range subsets {
+			var selected [][]byte
+			for _, i := range subset {
+				selected = append(selected, shares[i])
+			}
+			recovered, err := services.CombineShares(selected)
+			if err != nil {
+				t.Fatalf("Failed to combine shares %v: %v", subset, err)
+			}
+			if !bytes.Equal(recovered, secret) {
+				t.Errorf("Shares %v did not reconstruct the secret", subset)
+			}
+		}
+	})
+
+	t.Run("Below Threshold Does Not Reconstruct", func(t *testing.T) {
+		recovered, err := services.CombineShares([][]byte{shares[0], shares[3]})
+		if err != nil {
+			t.Fatalf("Failed to combine shares: %v", err)
+		}
+		if bytes.Equal(recovered, secret) {
+			t.Error("Expected two shares not to reconstruct the secret")
+		}
+	})
+
+	t.Run("Invalid Input", func(t *testing.T) {
+		if _, err := services.SplitSecret(secret, 3, 4); err == nil {
+			t.Error("Expected threshold above share count to be rejected")
+		}
+		if _, err := services.SplitSecret(secret, 3, 1); err == nil {
+			t.Error("Expected threshold of one to be rejected")
+		}
+		if _, err := services.CombineShares([][]byte{shares[0], shares[0]}); err == nil {
+			t.Error("Expected duplicate shares to be rejected")
+		}
+		if _, err := services.CombineShares([][]byte{shares[0], shares[1][:10]}); err == nil {
+			t.Error("Expected shares of different lengths to be rejected")
+		}
+	})
+}
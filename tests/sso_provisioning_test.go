@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+func TestSSOProvisioningEvaluate(t *testing.T) {
+	adminRole, userRole, defaultRole := uuid.New(), uuid.New(), uuid.New()
+	engineering, shared := uuid.New(), uuid.New()
+
+	provisioning := &services.SSOProvisioning{
+		JIT:           true,
+		DefaultRoleID: &defaultRole,
+		Rules: []services.SSOGroupRule{
+			{Value: "Vault-Admins", RoleID: &adminRole},
+			{Value: "engineering", RoleID: &userRole, Collections: []services.SSOCollectionGrant{
+				{CollectionID: engineering},
+				{CollectionID: shared, Access: services.CollectionAccessView},
+			}},
+			{Claim: "department", Value: "support", Collections: []services.SSOCollectionGrant{
+				{CollectionID: shared, Access: services.CollectionAccessViewExceptPasswords},
+			}},
+		},
+	}
+
+	t.Run("First Role Rule Wins", func(t *testing.T) {
+		result := provisioning.Evaluate(map[string][]string{
+			"groups": {"engineering", "vault-admins"},
+		})
+		if len(result.MatchedRules) != 2 || result.MatchedRules[0] != 0 || result.MatchedRules[1] != 1 {
+			t.Errorf("Expected rules 0 and 1 to match, got %v", result.MatchedRules)
+		}
+		if result.RoleID == nil || *result.RoleID != adminRole {
+			t.Errorf("Expected the admin role, got %v", result.RoleID)
+		}
+		if len(result.Collections) != 2 {
+			t.Errorf("Expected two collections, got %v", result.Collections)
+		}
+	})
+
+	t.Run("Writable Grant Wins", func(t *testing.T) {
+		writable := &services.SSOProvisioning{Rules: []services.SSOGroupRule{
+			{Value: "readers", Collections: []services.SSOCollectionGrant{{CollectionID: shared, Access: services.CollectionAccessView}}},
+			{Value: "writers", Collections: []services.SSOCollectionGrant{{CollectionID: shared}}},
+		}}
+		result := writable.Evaluate(map[string][]string{"groups": {"readers", "writers"}})
+		if len(result.Collections) != 1 || result.Collections[0].Access != services.CollectionAccessEdit {
+			t.Errorf("Expected one writable grant, got %v", result.Collections)
+		}
+		if result.RoleID != nil {
+			t.Errorf("Expected no role, got %v", result.RoleID)
+		}
+	})
+
+	t.Run("Custom Claim", func(t *testing.T) {
+		result := provisioning.Evaluate(map[string][]string{
+			"groups":     {"marketing"},
+			"department": {"Support"},
+		})
+		if len(result.MatchedRules) != 1 || result.MatchedRules[0] != 2 {
+			t.Errorf("Expected rule 2 to match, got %v", result.MatchedRules)
+		}
+		if len(result.Collections) != 1 || result.Collections[0].CollectionID != shared || result.Collections[0].Access != services.CollectionAccessViewExceptPasswords {
+			t.Errorf("Expected password-hiding access to the shared collection, got %v", result.Collections)
+		}
+		if result.RoleID == nil || *result.RoleID != defaultRole {
+			t.Errorf("Expected the default role, got %v", result.RoleID)
+		}
+	})
+
+	t.Run("No Match", func(t *testing.T) {
+		result := provisioning.Evaluate(map[string][]string{})
+		if len(result.MatchedRules) != 0 || len(result.Collections) != 0 {
+			t.Errorf("Expected nothing to match, got %v", result)
+		}
+		if result.RoleID == nil || *result.RoleID != defaultRole {
+			t.Errorf("Expected the default role, got %v", result.RoleID)
+		}
+	})
+
+	t.Run("Groups Of All Matching Rules", func(t *testing.T) {
+		admins, developers := uuid.New(), uuid.New()
+		grouped := &services.SSOProvisioning{Rules: []services.SSOGroupRule{
+			{Value: "vault-admins", Groups: []uuid.UUID{admins, developers}},
+			{Value: "engineering", Groups: []uuid.UUID{developers}},
+			{Value: "marketing", Groups: []uuid.UUID{uuid.New()}},
+		}}
+		result := grouped.Evaluate(map[string][]string{"groups": {"engineering", "vault-admins"}})
+		if len(result.Groups) != 2 {
+			t.Fatalf("Expected two groups, got %v", result.Groups)
+		}
+		if result.Groups[0].String() > result.Groups[1].String() {
+			t.Errorf("Expected groups in order, got %v", result.Groups)
+		}
+		for _, groupID := range []uuid.UUID{admins, developers} {
+			if result.Groups[0] != groupID && result.Groups[1] != groupID {
+				t.Errorf("Expected group %s, got %v", groupID, result.Groups)
+			}
+		}
+
+		result = grouped.Evaluate(map[string][]string{})
+		if result.Groups == nil || len(result.Groups) != 0 {
+			t.Errorf("Expected an empty group list, got %v", result.Groups)
+		}
+	})
+
+	t.Run("Read-Only Grant Saved Before Access Levels", func(t *testing.T) {
+		legacy := &services.SSOProvisioning{Rules: []services.SSOGroupRule{
+			{Value: "readers", Collections: []services.SSOCollectionGrant{{CollectionID: shared, ReadOnly: true}}},
+		}}
+		result := legacy.Evaluate(map[string][]string{"groups": {"readers"}})
+		if len(result.Collections) != 1 || result.Collections[0].Access != services.CollectionAccessView {
+			t.Errorf("Expected view access, got %v", result.Collections)
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// ssoRepository keeps an organization's SSO configuration, linked identities and
+// unfinished logins on top of joiningRepository; any other call panics
+type ssoRepository struct {
+	*joiningRepository
+	grants     map[uuid.UUID][]string
+	config     *models.SSOConfiguration
+	identities []models.SSOIdentity
+	logins     map[string]models.SSOLogin
+}
+
+func (r *ssoRepository) ListMemberPermissions(ctx context.Context, orgID, userID uuid.UUID) ([]string, error) {
+	return r.grants[userID], nil
+}
+
+func (r *ssoRepository) CreateSSOConfiguration(ctx context.Context, config *models.SSOConfiguration) error {
+	config.ID = uuid.New()
+	r.config = config
+	return nil
+}
+
+func (r *ssoRepository) GetSSOConfiguration(ctx context.Context, orgID uuid.UUID) (*models.SSOConfiguration, error) {
+	if r.config == nil || r.config.OrganizationID != orgID {
+		return nil, nil
+	}
+	return r.config, nil
+}
+
+func (r *ssoRepository) CreateSSOIdentity(ctx context.Context, identity *models.SSOIdentity) error {
+	r.identities = append(r.identities, *identity)
+	return nil
+}
+
+func (r *ssoRepository) GetSSOIdentity(ctx context.Context, orgID uuid.UUID, issuer, subject string) (*models.SSOIdentity, error) {
+	for _, identity := range r.identities {
+		if identity.OrganizationID == orgID && identity.Issuer == issuer && identity.Subject == subject {
+			found := identity
+			return &found, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *ssoRepository) CreateSSOLogin(ctx context.Context, login *models.SSOLogin) error {
+	r.logins[login.StateHash] = *login
+	return nil
+}
+
+func (r *ssoRepository) TakeSSOLogin(ctx context.Context, stateHash string) (*models.SSOLogin, error) {
+	login, ok := r.logins[stateHash]
+	if !ok {
+		return nil, nil
+	}
+	delete(r.logins, stateHash)
+	return &login, nil
+}
+
+func (r *ssoRepository) GetUserByEmail(ctx context.Context, email string) (*models.User, error) {
+	for _, user := range r.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *ssoRepository) CreateUser(ctx context.Context, user *models.User) error {
+	user.ID = uuid.New()
+	r.users[user.ID] = user
+	return nil
+}
+
+func (r *ssoRepository) ListUserGroups(ctx context.Context, orgID, userID uuid.UUID) ([]models.GroupUser, error) {
+	return nil, nil
+}
+
+func (r *ssoRepository) ListUserCollectionGrants(ctx context.Context, orgID, userID uuid.UUID) ([]models.CollectionUser, error) {
+	return nil, nil
+}
+
+// recordingRecovery records the members the account recovery policy is applied to
+type recordingRecovery struct {
+	services.AccountRecoveryService
+	applied []uuid.UUID
+}
+
+func (r *recordingRecovery) ApplyAccountRecoveryPolicy(ctx context.Context, orgID, userID uuid.UUID) error {
+	r.applied = append(r.applied, userID)
+	return nil
+}
+
+func TestSSOLogin(t *testing.T) {
+	encryption := services.NewEncryptionService()
+	configKey, _ := encryption.GenerateSymmetricKey()
+	ctx := context.Background()
+	orgID, adminID := uuid.New(), uuid.New()
+
+	type fixture struct {
+		sso        services.SSOService
+		repo       *ssoRepository
+		recovery   *recordingRecovery
+		risk       *decidingRisk
+		protection *passwordProtection
+		idp        *mockIdP
+	}
+
+	// newFixture configures OIDC with JIT provisioning against a mock identity provider
+	newFixture := func(t *testing.T) *fixture {
+		t.Helper()
+		f := &fixture{
+			repo: &ssoRepository{
+				joiningRepository: &joiningRepository{
+					keyRotationRepository: &keyRotationRepository{users: make(map[uuid.UUID]*models.User)},
+				},
+				grants: map[uuid.UUID][]string{adminID: {services.PermissionManageSSO}},
+				logins: make(map[string]models.SSOLogin),
+			},
+			recovery:   &recordingRecovery{},
+			risk:       &decidingRisk{},
+			protection: &passwordProtection{},
+			idp:        newMockIdP(t),
+		}
+		f.sso = services.NewSSOService(f.repo, encryption, configKey, services.NewPermissionResolver(f.repo, nil), f.recovery, f.risk, f.protection, nil)
+
+		err := f.sso.ConfigureSSO(ctx, orgID, adminID, services.SSOConfig{
+			Provider:     services.SSOProviderOIDC,
+			ClientID:     testOIDCClientID,
+			ClientSecret: testOIDCClientSecret,
+			MetadataURL:  f.idp.server.URL,
+			CallbackURL:  testOIDCRedirectURL,
+			Enabled:      true,
+			Provisioning: &services.SSOProvisioning{JIT: true},
+		})
+		if err != nil {
+			t.Fatalf("Failed to configure SSO: %v", err)
+		}
+		return f
+	}
+
+	// authorize starts a login and returns the code and state the identity provider
+	// redirects back with
+	authorize := func(t *testing.T, f *fixture) (string, string) {
+		t.Helper()
+		authURL, err := f.sso.InitiateSSO(ctx, orgID, services.SSOProviderOIDC, uuid.Nil)
+		if err != nil {
+			t.Fatalf("Failed to initiate SSO: %v", err)
+		}
+		return f.idp.authorize(t, authURL)
+	}
+
+	// signIn runs the authorization code flow and returns the callback's result
+	signIn := func(t *testing.T, f *fixture) (*services.SSOLoginResult, error) {
+		t.Helper()
+		code, state := authorize(t, f)
+		return f.sso.HandleCallback(ctx, orgID, state, code)
+	}
+
+	t.Run("Applies Account Recovery Policy To Provisioned Member", func(t *testing.T) {
+		f := newFixture(t)
+
+		result, err := signIn(t, f)
+		if err != nil {
+			t.Fatalf("Failed to sign in: %v", err)
+		}
+		if result.User.Email != "sso@example.com" || len(f.repo.members) != 1 || f.repo.members[0].Status != "confirmed" {
+			t.Fatalf("Expected the member to be provisioned, got %d members", len(f.repo.members))
+		}
+		if len(f.recovery.applied) != 1 || f.recovery.applied[0] != result.User.ID {
+			t.Errorf("Expected the account recovery policy to be applied to the new member, got %v", f.recovery.applied)
+		}
+	})
+
+	t.Run("Refuses Locked Account", func(t *testing.T) {
+		f := newFixture(t)
+		f.protection.locked = true
+
+		if _, err := signIn(t, f); !errors.Is(err, services.ErrAccountLocked) {
+			t.Errorf("Expected the locked account to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Suspicious Login", func(t *testing.T) {
+		f := newFixture(t)
+		f.risk.blocked = true
+
+		if _, err := signIn(t, f); !errors.Is(err, services.ErrSuspiciousLoginBlocked) {
+			t.Errorf("Expected the blocked login to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Keeps Login In Repository Once", func(t *testing.T) {
+		f := newFixture(t)
+		code, state := authorize(t, f)
+
+		if len(f.repo.logins) != 1 {
+			t.Fatalf("Expected the login to be stored, got %d", len(f.repo.logins))
+		}
+		for stateHash, login := range f.repo.logins {
+			if stateHash == state || login.Nonce == "" || login.CodeVerifier == "" || login.OrganizationID != orgID {
+				t.Errorf("Expected the login stored under a hash of its state, got %+v", login)
+			}
+		}
+		if _, err := f.sso.HandleCallback(ctx, orgID, state, code); err != nil {
+			t.Fatalf("Failed to sign in: %v", err)
+		}
+		if _, err := f.sso.HandleCallback(ctx, orgID, state, code); !errors.Is(err, services.ErrSSOStateNotFound) {
+			t.Errorf("Expected a state to be usable once, got %v", err)
+		}
+
+		code, state = authorize(t, f)
+		if _, err := f.sso.HandleCallback(ctx, uuid.New(), state, code); !errors.Is(err, services.ErrSSOStateNotFound) {
+			t.Errorf("Expected the state to be refused for another organization, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Expired Login", func(t *testing.T) {
+		f := newFixture(t)
+		code, state := authorize(t, f)
+		for stateHash, login := range f.repo.logins {
+			login.ExpiresAt = time.Now().Add(-time.Minute)
+			f.repo.logins[stateHash] = login
+		}
+
+		if _, err := f.sso.HandleCallback(ctx, orgID, state, code); !errors.Is(err, services.ErrSSOStateNotFound) {
+			t.Errorf("Expected the expired login to be refused, got %v", err)
+		}
+	})
+}
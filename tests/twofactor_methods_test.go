@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+	"github.com/pquerna/otp/totp"
+)
+
+func TestTwoFactorLoginChallenge(t *testing.T) {
+	ctx := context.Background()
+	const secret = "JBSWY3DPEHPK3PXP"
+
+	// newFixture sets up a user with one verified method of the given type; services
+	// built with newService share its repository like servers sharing a database
+	newFixture := func(methodType string) (*rememberRepository, *codeEmails, *decidingRisk, func() services.TwoFactorService) {
+		user := &models.User{Base: models.Base{ID: uuid.New()}, Email: "user@example.com", TwoFactorEnabled: true}
+		repo := &rememberRepository{
+			user:       user,
+			method:     &models.TwoFactorMethod{Base: models.Base{ID: uuid.New()}, UserID: user.ID, Type: methodType, Name: "Second factor", Secret: secret, Verified: true},
+			ceremonies: make(map[string]*models.TwoFactorCeremony),
+		}
+		email := &codeEmails{}
+		risk := &decidingRisk{}
+		newService := func() services.TwoFactorService {
+			protection := &passwordProtection{user: user, password: "master password"}
+			return services.NewTwoFactorService(repo, &noTwoFactorPolicy{}, &rememberPreferences{}, &knownDevices{}, email, protection, risk, nil, nil)
+		}
+		return repo, email, risk, newService
+	}
+
+	startLogin := func(t *testing.T, twoFactor services.TwoFactorService) string {
+		t.Helper()
+		challenge, err := twoFactor.StartLogin(ctx, "user@example.com", "master password", uuid.Nil, "")
+		if err != nil {
+			t.Fatalf("Failed to start login: %v", err)
+		}
+		return challenge.ChallengeID
+	}
+
+	t.Run("Completes On Another Server", func(t *testing.T) {
+		repo, email, risk, newService := newFixture(services.TwoFactorMethodEmail)
+
+		challengeID := startLogin(t, newService())
+		if _, stored := repo.ceremonies[challengeID]; stored {
+			t.Error("Expected only a hash of the challenge ID to be stored")
+		}
+		if err := newService().SendLoginCode(ctx, challengeID, repo.method.ID); err != nil {
+			t.Fatalf("Failed to send code: %v", err)
+		}
+		result, err := newService().CompleteLogin(ctx, challengeID, repo.method.ID, services.TwoFactorResponse{Code: email.code}, uuid.Nil)
+		if err != nil {
+			t.Fatalf("Failed to complete login: %v", err)
+		}
+		if result.User.ID != repo.user.ID {
+			t.Errorf("Expected user %s, got %s", repo.user.ID, result.User.ID)
+		}
+		if len(repo.ceremonies) != 0 {
+			t.Errorf("Expected the challenge to be used up, got %d stored", len(repo.ceremonies))
+		}
+		if len(risk.recorded) != 1 {
+			t.Errorf("Expected the completed login to be recorded once, got %d", len(risk.recorded))
+		}
+	})
+
+	t.Run("Wrong Code Uses Up Challenge", func(t *testing.T) {
+		repo, email, risk, newService := newFixture(services.TwoFactorMethodEmail)
+		twoFactor := newService()
+
+		challengeID := startLogin(t, twoFactor)
+		if err := twoFactor.SendLoginCode(ctx, challengeID, repo.method.ID); err != nil {
+			t.Fatalf("Failed to send code: %v", err)
+		}
+		wrong := services.TwoFactorResponse{Code: "not the code"}
+		if _, err := twoFactor.CompleteLogin(ctx, challengeID, repo.method.ID, wrong, uuid.Nil); !errors.Is(err, services.ErrInvalidTwoFactorCode) {
+			t.Fatalf("Expected a wrong code to be refused, got %v", err)
+		}
+		right := services.TwoFactorResponse{Code: email.code}
+		if _, err := twoFactor.CompleteLogin(ctx, challengeID, repo.method.ID, right, uuid.Nil); !errors.Is(err, services.ErrTwoFactorChallengeNotFound) {
+			t.Errorf("Expected the challenge to be used up, got %v", err)
+		}
+		if len(risk.recorded) != 0 {
+			t.Errorf("Expected an unfinished login not to be recorded, got %d", len(risk.recorded))
+		}
+	})
+
+	t.Run("Refuses Expired Challenge", func(t *testing.T) {
+		repo, _, _, newService := newFixture(services.TwoFactorMethodTOTP)
+		twoFactor := newService()
+
+		challengeID := startLogin(t, twoFactor)
+		for _, ceremony := range repo.ceremonies {
+			ceremony.ExpiresAt = time.Now().Add(-time.Second)
+		}
+		code, _ := totp.GenerateCode(secret, time.Now())
+		if _, err := twoFactor.CompleteLogin(ctx, challengeID, repo.method.ID, services.TwoFactorResponse{Code: code}, uuid.Nil); !errors.Is(err, services.ErrTwoFactorChallengeNotFound) {
+			t.Errorf("Expected an expired challenge to be refused, got %v", err)
+		}
+	})
+
+	t.Run("Refuses Reused Authenticator Code", func(t *testing.T) {
+		repo, _, _, newService := newFixture(services.TwoFactorMethodTOTP)
+		twoFactor := newService()
+		code, _ := totp.GenerateCode(secret, time.Now())
+
+		if _, err := twoFactor.CompleteLogin(ctx, startLogin(t, twoFactor), repo.method.ID, services.TwoFactorResponse{Code: code}, uuid.Nil); err != nil {
+			t.Fatalf("Failed to complete login: %v", err)
+		}
+		if repo.method.LastTOTPStep == 0 {
+			t.Error("Expected the time step of the code to be recorded")
+		}
+		if _, err := twoFactor.CompleteLogin(ctx, startLogin(t, twoFactor), repo.method.ID, services.TwoFactorResponse{Code: code}, uuid.Nil); !errors.Is(err, services.ErrInvalidTwoFactorCode) {
+			t.Errorf("Expected a used code to be refused, got %v", err)
+		}
+	})
+}
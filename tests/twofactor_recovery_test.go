@@ -0,0 +1,315 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// recoveryCodeRepository keeps a user and their recovery codes in memory; any other
+// call panics
+type recoveryCodeRepository struct {
+	repository.Repository
+	user          *models.User
+	codes         []models.TwoFactorRecoveryCode
+	methods       int
+	rememberToken bool
+}
+
+func (r *recoveryCodeRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if r.user.ID == id {
+		return r.user, nil
+	}
+	return nil, nil
+}
+
+func (r *recoveryCodeRepository) UpdateUser(ctx context.Context, user *models.User) error {
+	r.user = user
+	return nil
+}
+
+func (r *recoveryCodeRepository) ReplaceTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID, codes []models.TwoFactorRecoveryCode) error {
+	r.codes = nil
+	for _, code := range codes {
+		code.ID = uuid.New()
+		r.codes = append(r.codes, code)
+	}
+	return nil
+}
+
+func (r *recoveryCodeRepository) ListUnusedTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID) ([]models.TwoFactorRecoveryCode, error) {
+	var unused []models.TwoFactorRecoveryCode
+	for _, code := range r.codes {
+		if code.UserID == userID && code.UsedAt == nil {
+			unused = append(unused, code)
+		}
+	}
+	return unused, nil
+}
+
+func (r *recoveryCodeRepository) ConsumeTwoFactorRecoveryCode(ctx context.Context, id uuid.UUID) (bool, error) {
+	for i := range r.codes {
+		if r.codes[i].ID == id && r.codes[i].UsedAt == nil {
+			now := time.Now()
+			r.codes[i].UsedAt = &now
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *recoveryCodeRepository) DeleteTwoFactorRecoveryCodes(ctx context.Context, userID uuid.UUID) error {
+	r.codes = nil
+	return nil
+}
+
+func (r *recoveryCodeRepository) DeleteTwoFactorMethods(ctx context.Context, userID uuid.UUID) error {
+	r.methods = 0
+	return nil
+}
+
+func (r *recoveryCodeRepository) DeleteTwoFactorRememberTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	r.rememberToken = false
+	return nil
+}
+
+func (r *recoveryCodeRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+// passwordProtection accepts the user's password and counts second factor failures.
+// Set locked to lock the account.
+type passwordProtection struct {
+	services.LoginProtectionService
+	user     *models.User
+	password string
+	failures int
+	locked   bool
+}
+
+func (p *passwordProtection) AuthenticatePassword(ctx context.Context, email, password string) (*models.User, error) {
+	if email != p.user.Email || password != p.password {
+		return nil, services.ErrInvalidPassword
+	}
+	return p.user, nil
+}
+
+func (p *passwordProtection) CheckLockout(ctx context.Context, userID uuid.UUID) error {
+	if p.locked {
+		return services.ErrAccountLocked
+	}
+	return nil
+}
+
+func (p *passwordProtection) CheckTwoFactor(ctx context.Context, userID uuid.UUID) error {
+	return nil
+}
+
+func (p *passwordProtection) RecordTwoFactorFailure(ctx context.Context, userID uuid.UUID) error {
+	p.failures++
+	return nil
+}
+
+func (p *passwordProtection) RecordTwoFactorSuccess(ctx context.Context, userID uuid.UUID) error {
+	return nil
+}
+
+// decidingRisk refuses every login when blocked is set, and records the users whose
+// logins completed
+type decidingRisk struct {
+	blocked  bool
+	recorded []uuid.UUID
+}
+
+func (r *decidingRisk) AssessLogin(ctx context.Context, user *models.User, deviceID uuid.UUID) (*services.LoginRiskAssessment, error) {
+	if r.blocked {
+		return nil, services.ErrSuspiciousLoginBlocked
+	}
+	return &services.LoginRiskAssessment{}, nil
+}
+
+func (r *decidingRisk) RecordLogin(ctx context.Context, user *models.User, deviceID uuid.UUID) error {
+	r.recorded = append(r.recorded, user.ID)
+	return nil
+}
+
+// sentEmails records the templates of the emails sent
+type sentEmails struct {
+	services.EmailService
+	templates []string
+}
+
+func (e *sentEmails) SendTemplatedEmail(ctx context.Context, template string, data interface{}, recipients []string) error {
+	e.templates = append(e.templates, template)
+	return nil
+}
+
+// recordedNotifications records the messages of the notifications created
+type recordedNotifications struct {
+	services.NotificationService
+	messages []string
+}
+
+func (n *recordedNotifications) CreateNotification(ctx context.Context, userID uuid.UUID, notificationType services.NotificationType, message string, metadata map[string]interface{}) error {
+	n.messages = append(n.messages, message)
+	return nil
+}
+
+// revokingSessions records the users whose sessions were all revoked
+type revokingSessions struct {
+	services.SessionService
+	revoked []uuid.UUID
+}
+
+func (s *revokingSessions) RevokeAllUserSessions(ctx context.Context, userID uuid.UUID) error {
+	s.revoked = append(s.revoked, userID)
+	return nil
+}
+
+func TestTwoFactorRecoveryCodes(t *testing.T) {
+	ctx := context.Background()
+	codeFormat := regexp.MustCompile(`^[0-9a-f]{5}-[0-9a-f]{5}$`)
+
+	type fixture struct {
+		recovery      services.TwoFactorRecoveryService
+		repo          *recoveryCodeRepository
+		protection    *passwordProtection
+		risk          *decidingRisk
+		email         *sentEmails
+		notifications *recordedNotifications
+		sessions      *revokingSessions
+		codes         []string
+	}
+
+	// newFixture sets up a user with two-factor authentication and a fresh set of codes
+	newFixture := func(t *testing.T) *fixture {
+		t.Helper()
+		user := &models.User{Base: models.Base{ID: uuid.New()}, Email: "user@example.com", TwoFactorEnabled: true}
+		f := &fixture{
+			repo:          &recoveryCodeRepository{user: user, methods: 1, rememberToken: true},
+			protection:    &passwordProtection{user: user, password: "master password"},
+			risk:          &decidingRisk{},
+			email:         &sentEmails{},
+			notifications: &recordedNotifications{},
+			sessions:      &revokingSessions{},
+		}
+		f.recovery = services.NewTwoFactorRecoveryService(f.repo, f.email, f.notifications, f.protection, f.risk, f.sessions)
+
+		codes, err := f.recovery.GenerateRecoveryCodes(ctx, user.ID)
+		if err != nil {
+			t.Fatalf("Failed to generate recovery codes: %v", err)
+		}
+		f.codes = codes
+		return f
+	}
+
+	t.Run("Stores Only Hashes", func(t *testing.T) {
+		f := newFixture(t)
+
+		if len(f.codes) != 8 || len(f.repo.codes) != 8 {
+			t.Fatalf("Expected 8 codes, got %d returned and %d stored", len(f.codes), len(f.repo.codes))
+		}
+		for i, code := range f.codes {
+			if !codeFormat.MatchString(code) {
+				t.Errorf("Expected codes formatted as two groups of hex digits, got %q", code)
+			}
+			if stored := f.repo.codes[i].CodeHash; stored == code || stored == code[:5]+code[6:] {
+				t.Error("Expected codes to be stored hashed")
+			}
+		}
+	})
+
+	t.Run("Consumes Code Once", func(t *testing.T) {
+		f := newFixture(t)
+
+		// Codes are accepted without the separator and in upper case
+		input := " " + strings.ToUpper(f.codes[0][:5]+f.codes[0][6:]) + " "
+		result, err := f.recovery.LoginWithRecoveryCode(ctx, "user@example.com", "master password", input, uuid.Nil, false)
+		if err != nil {
+			t.Fatalf("Failed to log in with recovery code: %v", err)
+		}
+		if result.RemainingCodes != 7 || result.RecoveryCodesLow || result.TwoFactorDisabled {
+			t.Errorf("Expected 7 remaining codes, got %+v", result)
+		}
+		if len(f.email.templates) != 1 || f.email.templates[0] != "2fa_recovery_code_used" {
+			t.Errorf("Expected the user to be emailed about the recovery login, got %v", f.email.templates)
+		}
+
+		_, err = f.recovery.LoginWithRecoveryCode(ctx, "user@example.com", "master password", f.codes[0], uuid.Nil, false)
+		if !errors.Is(err, services.ErrInvalidRecoveryCode) {
+			t.Errorf("Expected a used code to be rejected, got %v", err)
+		}
+		if f.protection.failures != 1 {
+			t.Errorf("Expected the rejected code to count as a failed second factor, got %d failures", f.protection.failures)
+		}
+	})
+
+	t.Run("Regeneration Invalidates Old Codes", func(t *testing.T) {
+		f := newFixture(t)
+
+		if _, err := f.recovery.GenerateRecoveryCodes(ctx, f.repo.user.ID); err != nil {
+			t.Fatalf("Failed to regenerate recovery codes: %v", err)
+		}
+		_, err := f.recovery.LoginWithRecoveryCode(ctx, "user@example.com", "master password", f.codes[0], uuid.Nil, false)
+		if !errors.Is(err, services.ErrInvalidRecoveryCode) {
+			t.Errorf("Expected a code from the previous set to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Warns When Few Codes Remain", func(t *testing.T) {
+		f := newFixture(t)
+
+		var result *services.RecoveryLoginResult
+		for _, code := range f.codes[:6] {
+			var err error
+			if result, err = f.recovery.LoginWithRecoveryCode(ctx, "user@example.com", "master password", code, uuid.Nil, false); err != nil {
+				t.Fatalf("Failed to log in with recovery code: %v", err)
+			}
+		}
+		if result.RemainingCodes != 2 || !result.RecoveryCodesLow {
+			t.Errorf("Expected a warning with 2 codes left, got %+v", result)
+		}
+		if len(f.notifications.messages) != 1 {
+			t.Errorf("Expected one low codes notification, got %d", len(f.notifications.messages))
+		}
+	})
+
+	t.Run("Disables Two Factor After Use", func(t *testing.T) {
+		f := newFixture(t)
+
+		result, err := f.recovery.LoginWithRecoveryCode(ctx, "user@example.com", "master password", f.codes[0], uuid.Nil, true)
+		if err != nil {
+			t.Fatalf("Failed to log in with recovery code: %v", err)
+		}
+		if !result.TwoFactorDisabled || f.repo.user.TwoFactorEnabled {
+			t.Error("Expected two-factor authentication to be disabled")
+		}
+		if len(f.repo.codes) != 0 || f.repo.methods != 0 || f.repo.rememberToken {
+			t.Error("Expected the codes, methods and remembered devices to be removed")
+		}
+		if len(f.sessions.revoked) != 1 || f.sessions.revoked[0] != f.repo.user.ID {
+			t.Errorf("Expected the user's other sessions to be revoked, got %v", f.sessions.revoked)
+		}
+	})
+
+	t.Run("Refuses Blocked Login Before Consuming", func(t *testing.T) {
+		f := newFixture(t)
+		f.risk.blocked = true
+
+		_, err := f.recovery.LoginWithRecoveryCode(ctx, "user@example.com", "master password", f.codes[0], uuid.Nil, false)
+		if !errors.Is(err, services.ErrSuspiciousLoginBlocked) {
+			t.Fatalf("Expected the blocked login to be refused, got %v", err)
+		}
+		if remaining, _ := f.recovery.CountRemainingRecoveryCodes(ctx, f.repo.user.ID); remaining != 8 {
+			t.Errorf("Expected the code to stay unused, got %d remaining", remaining)
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/db/repository"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/google/uuid"
+)
+
+// rememberRepository keeps a user with one second factor, their memberships, two-factor
+// ceremonies and remember tokens in memory; any other call panics
+type rememberRepository struct {
+	repository.Repository
+	user        *models.User
+	method      *models.TwoFactorMethod
+	memberships []models.OrganizationUser
+	ceremonies  map[string]*models.TwoFactorCeremony
+	tokens      []*models.TwoFactorRememberToken
+}
+
+func (r *rememberRepository) GetUserByID(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if r.user.ID == id {
+		return r.user, nil
+	}
+	return nil, nil
+}
+
+func (r *rememberRepository) ListUserMemberships(ctx context.Context, userID uuid.UUID) ([]models.OrganizationUser, error) {
+	return r.memberships, nil
+}
+
+func (r *rememberRepository) ListTwoFactorMethods(ctx context.Context, userID uuid.UUID) ([]models.TwoFactorMethod, error) {
+	return []models.TwoFactorMethod{*r.method}, nil
+}
+
+func (r *rememberRepository) GetTwoFactorMethod(ctx context.Context, id uuid.UUID) (*models.TwoFactorMethod, error) {
+	if r.method.ID == id {
+		method := *r.method
+		return &method, nil
+	}
+	return nil, nil
+}
+
+func (r *rememberRepository) UpdateTwoFactorMethod(ctx context.Context, method *models.TwoFactorMethod) error {
+	updated := *method
+	r.method = &updated
+	return nil
+}
+
+func (r *rememberRepository) RecordTOTPStep(ctx context.Context, methodID uuid.UUID, step int64) (bool, error) {
+	if r.method.ID != methodID || r.method.LastTOTPStep >= step {
+		return false, nil
+	}
+	r.method.LastTOTPStep = step
+	return true, nil
+}
+
+func (r *rememberRepository) CreateTwoFactorCeremony(ctx context.Context, ceremony *models.TwoFactorCeremony) error {
+	stored := *ceremony
+	r.ceremonies[ceremony.KeyHash] = &stored
+	return nil
+}
+
+func (r *rememberRepository) GetTwoFactorCeremony(ctx context.Context, keyHash string) (*models.TwoFactorCeremony, error) {
+	if ceremony, ok := r.ceremonies[keyHash]; ok {
+		found := *ceremony
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func (r *rememberRepository) TakeTwoFactorCeremony(ctx context.Context, keyHash string) (*models.TwoFactorCeremony, error) {
+	ceremony := r.ceremonies[keyHash]
+	delete(r.ceremonies, keyHash)
+	return ceremony, nil
+}
+
+func (r *rememberRepository) DeleteExpiredTwoFactorCeremonies(ctx context.Context, before time.Time) (int64, error) {
+	var deleted int64
+	for keyHash, ceremony := range r.ceremonies {
+		if ceremony.ExpiresAt.Before(before) {
+			delete(r.ceremonies, keyHash)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (r *rememberRepository) CreateTwoFactorRememberToken(ctx context.Context, token *models.TwoFactorRememberToken) error {
+	token.ID = uuid.New()
+	token.CreatedAt = time.Now()
+	r.tokens = append(r.tokens, token)
+	return nil
+}
+
+func (r *rememberRepository) GetTwoFactorRememberTokenByHash(ctx context.Context, tokenHash string) (*models.TwoFactorRememberToken, error) {
+	for _, token := range r.tokens {
+		if token.TokenHash == tokenHash {
+			return token, nil
+		}
+	}
+	return nil, nil
+}
+
+func (r *rememberRepository) DeleteTwoFactorRememberTokensForUser(ctx context.Context, userID uuid.UUID) error {
+	r.tokens = nil
+	return nil
+}
+
+func (r *rememberRepository) CreateAuditLog(ctx context.Context, log *models.AuditLog) error {
+	return nil
+}
+
+// codeEmails keeps the last two-factor code emailed
+type codeEmails struct {
+	services.EmailService
+	code string
+}
+
+func (e *codeEmails) SendTemplatedEmail(ctx context.Context, template string, data interface{}, recipients []string) error {
+	e.code, _ = data.(map[string]interface{})["Code"].(string)
+	return nil
+}
+
+// rememberPreferences returns the same sessionPolicy for every organization
+type rememberPreferences struct {
+	services.OrganizationPreferencesService
+	days float64
+}
+
+func (p *rememberPreferences) GetPreference(ctx context.Context, orgID uuid.UUID, key string) (interface{}, error) {
+	return map[string]interface{}{"mfaRememberDays": p.days}, nil
+}
+
+// noTwoFactorPolicy is an organization without a two-factor policy
+type noTwoFactorPolicy struct {
+	services.PolicyService
+}
+
+func (p *noTwoFactorPolicy) GetTwoFactorPolicy(ctx context.Context, orgID uuid.UUID) (*services.TwoFactorPolicySettings, error) {
+	return &services.TwoFactorPolicySettings{}, nil
+}
+
+// knownDevices looks devices up in a fixed set
+type knownDevices struct {
+	services.DeviceService
+	devices map[uuid.UUID]*models.Device
+}
+
+func (d *knownDevices) GetDevice(ctx context.Context, deviceID uuid.UUID) (*models.Device, error) {
+	return d.devices[deviceID], nil
+}
+
+func TestTwoFactorRememberDevice(t *testing.T) {
+	ctx := context.Background()
+
+	type fixture struct {
+		twoFactor   services.TwoFactorService
+		repo        *rememberRepository
+		email       *codeEmails
+		preferences *rememberPreferences
+		devices     *knownDevices
+		deviceID    uuid.UUID
+	}
+
+	// newFixture sets up a member of one organization with an email second factor and
+	// an authorized device
+	newFixture := func(t *testing.T, days float64) *fixture {
+		t.Helper()
+		user := &models.User{Base: models.Base{ID: uuid.New()}, Email: "user@example.com", TwoFactorEnabled: true}
+		deviceID := uuid.New()
+		f := &fixture{
+			repo: &rememberRepository{
+				user:        user,
+				method:      &models.TwoFactorMethod{Base: models.Base{ID: uuid.New()}, UserID: user.ID, Type: services.TwoFactorMethodEmail, Name: "Email", Verified: true},
+				memberships: []models.OrganizationUser{{UserID: user.ID, OrganizationID: uuid.New(), Status: "confirmed"}},
+				ceremonies:  make(map[string]*models.TwoFactorCeremony),
+			},
+			email:       &codeEmails{},
+			preferences: &rememberPreferences{days: days},
+			devices:     &knownDevices{devices: map[uuid.UUID]*models.Device{deviceID: {Base: models.Base{ID: deviceID}, UserID: user.ID, Name: "Laptop", Status: "authorized"}}},
+			deviceID:    deviceID,
+		}
+		protection := &passwordProtection{user: user, password: "master password"}
+		f.twoFactor = services.NewTwoFactorService(f.repo, &noTwoFactorPolicy{}, f.preferences, f.devices, f.email, protection, &decidingRisk{}, nil, nil)
+		return f
+	}
+
+	// signIn passes the second factor by email and asks to remember the device
+	signIn := func(t *testing.T, f *fixture) *services.TwoFactorLoginResult {
+		t.Helper()
+		challenge, err := f.twoFactor.StartLogin(ctx, "user@example.com", "master password", f.deviceID, "")
+		if err != nil {
+			t.Fatalf("Failed to start login: %v", err)
+		}
+		if err := f.twoFactor.SendLoginCode(ctx, challenge.ChallengeID, f.repo.method.ID); err != nil {
+			t.Fatalf("Failed to send code: %v", err)
+		}
+		result, err := f.twoFactor.CompleteLogin(ctx, challenge.ChallengeID, f.repo.method.ID, services.TwoFactorResponse{Code: f.email.code}, f.deviceID)
+		if err != nil {
+			t.Fatalf("Failed to complete login: %v", err)
+		}
+		return result
+	}
+
+	remembered := func(t *testing.T, f *fixture, deviceID uuid.UUID, token string) bool {
+		t.Helper()
+		challenge, err := f.twoFactor.StartLogin(ctx, "user@example.com", "master password", deviceID, token)
+		if err != nil {
+			t.Fatalf("Failed to start login: %v", err)
+		}
+		return challenge.Remembered
+	}
+
+	t.Run("Skips Second Factor On Remembered Device", func(t *testing.T) {
+		f := newFixture(t, 7)
+
+		result := signIn(t, f)
+		if result.RememberToken == "" || result.RememberExpiresAt == nil {
+			t.Fatal("Expected a remember token")
+		}
+		if days := time.Until(*result.RememberExpiresAt).Hours() / 24; days < 6.9 || days > 7 {
+			t.Errorf("Expected the token to last the organization's 7 days, got %.1f", days)
+		}
+		if f.repo.tokens[0].TokenHash == result.RememberToken {
+			t.Error("Expected the token to be stored hashed")
+		}
+		if !remembered(t, f, f.deviceID, result.RememberToken) {
+			t.Error("Expected the remembered device to skip the second factor")
+		}
+	})
+
+	t.Run("Binds Token To Device", func(t *testing.T) {
+		f := newFixture(t, 7)
+		result := signIn(t, f)
+
+		if remembered(t, f, uuid.New(), result.RememberToken) {
+			t.Error("Expected the token to be refused on another device")
+		}
+	})
+
+	t.Run("Honors Organization Disabling Remember", func(t *testing.T) {
+		f := newFixture(t, 0)
+
+		if result := signIn(t, f); result.RememberToken != "" {
+			t.Error("Expected no remember token when the organization sets 0 days")
+		}
+	})
+
+	t.Run("Forgets Device When Period Is Shortened", func(t *testing.T) {
+		f := newFixture(t, 30)
+		result := signIn(t, f)
+		f.repo.tokens[0].CreatedAt = time.Now().Add(-48 * time.Hour)
+		f.preferences.days = 1
+
+		if remembered(t, f, f.deviceID, result.RememberToken) {
+			t.Error("Expected a token older than the organization's new period to be refused")
+		}
+	})
+
+	t.Run("Forgets Blocked Device", func(t *testing.T) {
+		f := newFixture(t, 7)
+		result := signIn(t, f)
+		f.devices.devices[f.deviceID].Status = "blocked"
+
+		if remembered(t, f, f.deviceID, result.RememberToken) {
+			t.Error("Expected a blocked device to be asked for the second factor")
+		}
+	})
+
+	t.Run("Revokes Remembered Devices", func(t *testing.T) {
+		f := newFixture(t, 7)
+		result := signIn(t, f)
+
+		if err := f.twoFactor.RevokeRememberedDevices(ctx, f.repo.user.ID); err != nil {
+			t.Fatalf("Failed to revoke remembered devices: %v", err)
+		}
+		if remembered(t, f, f.deviceID, result.RememberToken) {
+			t.Error("Expected revoked tokens to be refused")
+		}
+	})
+}
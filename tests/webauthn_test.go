@@ -0,0 +1,330 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/emailimmunity/passwordimmunity/db/models"
+	"github.com/emailimmunity/passwordimmunity/services"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	testRPID   = "vault.example.com"
+	testOrigin = "https://vault.example.com"
+)
+
+// softAuthenticator is a minimal FIDO2 authenticator with a single ES256 credential
+// that produces "none" attestations
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	counter      uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate authenticator key: %v", err)
+	}
+	credentialID := make([]byte, 32)
+	if _, err := rand.Read(credentialID); err != nil {
+		t.Fatalf("Failed to generate credential ID: %v", err)
+	}
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+func (a *softAuthenticator) authenticatorData(flags byte, attested []byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRPID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	return append(data, attested...)
+}
+
+func (a *softAuthenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	return data
+}
+
+// register answers navigator.credentials.create for the given challenge
+func (a *softAuthenticator) register(t *testing.T, challenge string) []byte {
+	return a.registerWithExtensions(t, challenge, nil)
+}
+
+func (a *softAuthenticator) registerWithExtensions(t *testing.T, challenge string, extensions map[string]interface{}) []byte {
+	coseKey, err := cbor.Marshal(map[int]interface{}{
+		1:  2,  // kty: EC2
+		3:  -7, // alg: ES256
+		-1: 1,  // crv: P-256
+		-2: a.key.X.FillBytes(make([]byte, 32)),
+		-3: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode credential key: %v", err)
+	}
+
+	attested := make([]byte, 16) // AAGUID
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(a.credentialID)))
+	attested = append(attested, a.credentialID...)
+	attested = append(attested, coseKey...)
+
+	// UP | UV | AT
+	authData := a.authenticatorData(0x45, attested)
+	attestationObject, err := cbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode attestation object: %v", err)
+	}
+
+	return a.credentialJSON(t, map[string]string{
+		"clientDataJSON":    b64(a.clientData("webauthn.create", challenge)),
+		"attestationObject": b64(attestationObject),
+	}, extensions)
+}
+
+// assert answers navigator.credentials.get for the given challenge
+func (a *softAuthenticator) assert(t *testing.T, challenge string, userHandle []byte) []byte {
+	a.counter++
+
+	// UP | UV
+	authData := a.authenticatorData(0x05, nil)
+	clientData := a.clientData("webauthn.get", challenge)
+	clientDataHash := sha256.Sum256(clientData)
+
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign assertion: %v", err)
+	}
+
+	return a.credentialJSON(t, map[string]string{
+		"clientDataJSON":    b64(clientData),
+		"authenticatorData": b64(authData),
+		"signature":         b64(signature),
+		"userHandle":        b64(userHandle),
+	}, nil)
+}
+
+func (a *softAuthenticator) credentialJSON(t *testing.T, response map[string]string, extensions map[string]interface{}) []byte {
+	body, err := json.Marshal(map[string]interface{}{
+		"id":                     b64(a.credentialID),
+		"rawId":                  b64(a.credentialID),
+		"type":                   "public-key",
+		"response":               response,
+		"clientExtensionResults": extensions,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode credential: %v", err)
+	}
+	return body
+}
+
+func b64(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func TestWebAuthnRelyingParty(t *testing.T) {
+	rp, err := services.NewWebAuthnRelyingParty(services.WebAuthnConfig{
+		RPID:      testRPID,
+		RPOrigins: []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create relying party: %v", err)
+	}
+
+	user := &models.User{Email: "test@example.com", Name: "Test User"}
+	user.ID = uuid.New()
+	authenticator := newSoftAuthenticator(t)
+
+	method := models.TwoFactorMethod{UserID: user.ID, Type: services.TwoFactorMethodWebAuthn, Name: "Security key"}
+	method.ID = uuid.New()
+
+	t.Run("Registration", func(t *testing.T) {
+		options, session, err := rp.BeginRegistration(user, nil)
+		if err != nil {
+			t.Fatalf("Failed to begin registration: %v", err)
+		}
+		if options.Response.RelyingParty.ID != testRPID {
+			t.Errorf("Expected RP ID %s, got %s", testRPID, options.Response.RelyingParty.ID)
+		}
+
+		response := authenticator.register(t, options.Response.Challenge.String())
+		if err := rp.FinishRegistration(user, nil, *session, response, &method); err != nil {
+			t.Fatalf("Failed to finish registration: %v", err)
+		}
+		if method.CredentialID != b64(authenticator.credentialID) {
+			t.Errorf("Expected credential ID %s, got %s", b64(authenticator.credentialID), method.CredentialID)
+		}
+		method.Verified = true
+	})
+
+	t.Run("Registration Excludes Existing Keys", func(t *testing.T) {
+		options, _, err := rp.BeginRegistration(user, []models.TwoFactorMethod{method})
+		if err != nil {
+			t.Fatalf("Failed to begin registration: %v", err)
+		}
+		if len(options.Response.CredentialExcludeList) != 1 {
+			t.Errorf("Expected 1 excluded credential, got %d", len(options.Response.CredentialExcludeList))
+		}
+	})
+
+	t.Run("Registration With Wrong Challenge", func(t *testing.T) {
+		_, session, err := rp.BeginRegistration(user, nil)
+		if err != nil {
+			t.Fatalf("Failed to begin registration: %v", err)
+		}
+		other := newSoftAuthenticator(t)
+		response := other.register(t, b64([]byte("not the issued challenge")))
+		var rejected models.TwoFactorMethod
+		err = rp.FinishRegistration(user, nil, *session, response, &rejected)
+		if !errors.Is(err, services.ErrInvalidWebAuthnResponse) {
+			t.Errorf("Expected ErrInvalidWebAuthnResponse, got %v", err)
+		}
+	})
+
+	t.Run("Authentication", func(t *testing.T) {
+		methods := []models.TwoFactorMethod{method}
+		options, session, err := rp.BeginLogin(user, methods)
+		if err != nil {
+			t.Fatalf("Failed to begin login: %v", err)
+		}
+		if len(options.Response.AllowedCredentials) != 1 {
+			t.Fatalf("Expected 1 allowed credential, got %d", len(options.Response.AllowedCredentials))
+		}
+
+		response := authenticator.assert(t, options.Response.Challenge.String(), user.ID[:])
+		used, err := rp.FinishLogin(user, methods, *session, response)
+		if err != nil {
+			t.Fatalf("Failed to finish login: %v", err)
+		}
+		if used.ID != method.ID {
+			t.Errorf("Expected method %s, got %s", method.ID, used.ID)
+		}
+		method = *used
+	})
+
+	t.Run("Replayed Assertion", func(t *testing.T) {
+		methods := []models.TwoFactorMethod{method}
+		options, session, err := rp.BeginLogin(user, methods)
+		if err != nil {
+			t.Fatalf("Failed to begin login: %v", err)
+		}
+
+		// A cloned authenticator reuses an old signature counter
+		authenticator.counter--
+		response := authenticator.assert(t, options.Response.Challenge.String(), user.ID[:])
+		if _, err := rp.FinishLogin(user, methods, *session, response); !errors.Is(err, services.ErrWebAuthnCloneDetected) {
+			t.Errorf("Expected ErrWebAuthnCloneDetected, got %v", err)
+		}
+	})
+
+	t.Run("Assertion For Other User", func(t *testing.T) {
+		methods := []models.TwoFactorMethod{method}
+		options, session, err := rp.BeginLogin(user, methods)
+		if err != nil {
+			t.Fatalf("Failed to begin login: %v", err)
+		}
+
+		otherUser := uuid.New()
+		response := authenticator.assert(t, options.Response.Challenge.String(), otherUser[:])
+		if _, err := rp.FinishLogin(user, methods, *session, response); !errors.Is(err, services.ErrInvalidWebAuthnResponse) {
+			t.Errorf("Expected ErrInvalidWebAuthnResponse, got %v", err)
+		}
+	})
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	rp, err := services.NewWebAuthnRelyingParty(services.WebAuthnConfig{
+		RPID:      testRPID,
+		RPOrigins: []string{testOrigin},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create relying party: %v", err)
+	}
+
+	user := &models.User{Email: "test@example.com", Name: "Test User"}
+	user.ID = uuid.New()
+	authenticator := newSoftAuthenticator(t)
+
+	passkey := models.Passkey{UserID: user.ID, Name: "Laptop"}
+	passkey.ID = uuid.New()
+
+	lookup := func(userID uuid.UUID) (*models.User, []models.Passkey, error) {
+		if userID != user.ID {
+			return nil, nil, nil
+		}
+		return user, []models.Passkey{passkey}, nil
+	}
+
+	t.Run("Registration", func(t *testing.T) {
+		options, session, err := rp.BeginPasskeyRegistration(user, nil)
+		if err != nil {
+			t.Fatalf("Failed to begin registration: %v", err)
+		}
+		if options.Response.AuthenticatorSelection.ResidentKey != "required" {
+			t.Errorf("Expected a discoverable credential, got resident key %q", options.Response.AuthenticatorSelection.ResidentKey)
+		}
+		if _, ok := options.Response.Extensions["prf"]; !ok {
+			t.Error("Expected the PRF extension to be requested")
+		}
+
+		response := authenticator.registerWithExtensions(t, options.Response.Challenge.String(), map[string]interface{}{
+			"prf": map[string]interface{}{"enabled": true},
+		})
+		if err := rp.FinishPasskeyRegistration(user, nil, *session, response, &passkey); err != nil {
+			t.Fatalf("Failed to finish registration: %v", err)
+		}
+		if !passkey.PRFEnabled {
+			t.Error("Expected PRF to be enabled")
+		}
+	})
+
+	t.Run("Discoverable Login", func(t *testing.T) {
+		options, session, err := rp.BeginPasskeyLogin()
+		if err != nil {
+			t.Fatalf("Failed to begin login: %v", err)
+		}
+		if len(options.Response.AllowedCredentials) != 0 {
+			t.Errorf("Expected no allowed credentials, got %d", len(options.Response.AllowedCredentials))
+		}
+
+		response := authenticator.assert(t, options.Response.Challenge.String(), user.ID[:])
+		owner, used, err := rp.FinishPasskeyLogin(*session, response, lookup)
+		if err != nil {
+			t.Fatalf("Failed to finish login: %v", err)
+		}
+		if owner.ID != user.ID || used.ID != passkey.ID {
+			t.Errorf("Expected user %s and passkey %s, got %s and %s", user.ID, passkey.ID, owner.ID, used.ID)
+		}
+		passkey = *used
+	})
+
+	t.Run("Unknown User Handle", func(t *testing.T) {
+		options, session, err := rp.BeginPasskeyLogin()
+		if err != nil {
+			t.Fatalf("Failed to begin login: %v", err)
+		}
+
+		otherUser := uuid.New()
+		response := authenticator.assert(t, options.Response.Challenge.String(), otherUser[:])
+		if _, _, err := rp.FinishPasskeyLogin(*session, response, lookup); !errors.Is(err, services.ErrInvalidWebAuthnResponse) {
+			t.Errorf("Expected ErrInvalidWebAuthnResponse, got %v", err)
+		}
+	})
+}